@@ -20,21 +20,27 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
 	"gopkg.in/yaml.v3"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 
 	"github.com/opsmx/oes-birger/app/agent/cfg"
 	"github.com/opsmx/oes-birger/pkg/secrets"
@@ -51,16 +57,45 @@ var (
 	caCertFile = flag.String("caCertFile", "/app/config/ca.pem", "The file containing the CA certificate we will use to verify the controller's cert")
 	configFile = flag.String("configFile", "/app/config/config.yaml", "The file with the controller config")
 
+	inCluster      = flag.Bool("in-cluster", false, "Use the in-cluster Kubernetes service account rather than a kubeconfig")
+	kubeconfigFlag = flag.String("kubeconfig", "", "Kubeconfig files to merge, separated by colons, overriding KUBECONFIG")
+
+	terminationGracePeriod = flag.Duration("terminationGracePeriod", 25*time.Second, "On SIGTERM, how long to wait for requests in progress to finish before disconnecting")
+
+	watchConfig = flag.Bool("watchConfig", true, "Reload the endpoints when the services config, or a kubeconfig it uses, changes")
+
+	neverAllowInsecure = flag.Bool("neverAllowInsecure", false, "Refuse to run if any endpoint would skip verifying its server's TLS certificate")
+
+	reconnectMinDelay = flag.Duration("reconnectMinDelay", time.Second, "Initial delay before reconnecting to the controller")
+	reconnectMaxDelay = flag.Duration("reconnectMaxDelay", time.Minute, "Maximum delay between attempts to reconnect to the controller")
+	certRenewBefore   = flag.Duration("certRenewBefore", 30*24*time.Hour, "Renew the agent certificate when it is this close to expiring; zero disables renewal")
+
+	keepaliveTime                = flag.Duration("keepaliveTime", 20*time.Second, "Send a keepalive ping when the connection to the controller has been idle this long; zero disables keepalive pings")
+	keepaliveTimeout             = flag.Duration("keepaliveTimeout", 10*time.Second, "Consider the connection to the controller lost if a keepalive ping is not answered within this time")
+	keepalivePermitWithoutStream = flag.Bool("keepalivePermitWithoutStream", true, "Send keepalive pings even when no tunnel is open on the connection")
+
+	prometheusListenPort = flag.Uint("prometheusListenPort", 0, "If set, serve Prometheus metrics and a health check on this port")
+	enableDebugEndpoints = flag.Bool("enableDebugEndpoints", false, "Serve pprof profiles and /debug/vars on the Prometheus port")
+
+	healthListenPort = flag.Uint("healthListenPort", 0, "If set, serve /healthz and /readyz on this port")
+	probeInterval    = flag.Duration("probeInterval", 30*time.Second, "How often to check that each endpoint's upstream answers, for /readyz")
+
+	diagnose = flag.Bool("diagnose", false, "Check the connection to the controller and each endpoint once, print a report, and exit non-zero if any check failed")
+
+	logLevel  = flag.String("logLevel", "info", "The minimum level to log: debug, info, warn, or error")
+	logFormat = flag.String("logFormat", "console", "The log format: console or json")
+
+	showVersion = flag.Bool("version", false, "Print the version and exit")
+
 	emptyBytes = []byte("")
 
-	config             *cfg.AgentConfig
-	agentServiceConfig *cfg.AgentServiceConfig
+	config *cfg.AgentConfig
 
 	hostname = getHostname()
 
 	secretsLoader secrets.SecretLoader
 
-	endpoints []configuredEndpoint
+	endpoints *endpointTable
 )
 
 type serverContext struct{}
@@ -71,11 +106,15 @@ type configuredEndpoint struct {
 	Configured bool     `json:"configured,omitempty"`
 	Namespace  []string `json:"namespace,omitempty"`
 
+	// allowClusterScoped permits cluster-scoped requests on a kubernetes
+	// endpoint restricted to Namespace.
+	allowClusterScoped bool
+
 	instance httpRequestProcessor
 }
 
 type httpRequestProcessor interface {
-	executeHTTPRequest(chan *tunnel.AgentToControllerWrapper, *tunnel.HttpRequest)
+	executeHTTPRequest(chan *tunnel.AgentToControllerWrapper, *tunnel.HttpRequest, io.ReadCloser)
 }
 
 func (e *configuredEndpoint) String() string {
@@ -91,50 +130,121 @@ func endpointsToPB(endpoints []configuredEndpoint) []*tunnel.EndpointHealth {
 			Configured: ep.Configured,
 			Namespaces: ep.Namespace,
 		}
+		if r, ok := ep.instance.(tlsModeReporter); ok && ep.Configured {
+			endp.TlsMode = r.tlsMode()
+		}
 		pbEndpoints[i] = endp
 	}
+	if files := fileEndpoint(); files != nil {
+		pbEndpoints = append(pbEndpoints, files)
+	}
 	return pbEndpoints
 }
 
-func tickerPinger(stream tunnel.AgentTunnelService_EventTunnelClient) {
+func tickerPinger(ctx context.Context, dataflow chan *tunnel.AgentToControllerWrapper) {
 	ticker := time.NewTicker(time.Duration(*tickTime) * time.Second)
-
-	for ts := range ticker.C {
-		req := &tunnel.AgentToControllerWrapper{
-			Event: &tunnel.AgentToControllerWrapper_PingRequest{
-				PingRequest: &tunnel.PingRequest{Ts: uint64(ts.UnixNano())},
-			},
-		}
-		if err := stream.Send(req); err != nil {
-			log.Fatalf("Unable to send a PingRequest: %v", err)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ts := <-ticker.C:
+			dataflow <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_PingRequest{
+					PingRequest: &tunnel.PingRequest{Ts: uint64(ts.UnixNano())},
+				},
+			}
 		}
 	}
 }
 
-func dataflowHandler(dataflow chan *tunnel.AgentToControllerWrapper, stream tunnel.AgentTunnelService_EventTunnelClient) {
+// makePingResponse answers a ping from the controller, which arrived at
+// received.
+func makePingResponse(req *tunnel.PingRequest, received time.Time) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_PingResponse{
+			PingResponse: tunnel.MakePingResponse(req, received),
+		},
+	}
+}
+
+// dataflowHandler is the only writer to the stream.  Once a send fails,
+// the error is reported on errc and any further messages are discarded
+// until dataflow is closed, so late responses from in-flight requests
+// never block.  Chunks are released whether sent or discarded, so no
+// response waits on its window forever.  A nil message closes the
+// sending side of the stream, and anything after it is discarded too.
+func dataflowHandler(dataflow chan *tunnel.AgentToControllerWrapper, stream tunnel.AgentTunnelService_EventTunnelClient, errc chan error) {
+	failed := false
 	for ew := range dataflow {
+		if failed {
+			responseChunks.release(ew)
+			continue
+		}
+		if ew == nil {
+			failed = true
+			if err := stream.CloseSend(); err != nil {
+				util.Warnf("While closing stream: %v", err)
+			}
+			continue
+		}
 		if err := stream.Send(ew); err != nil {
-			log.Fatalf("Unable to respond over GRPC: %v", err)
+			failed = true
+			errc <- fmt.Errorf("unable to respond over GRPC: %v", err)
+			responseChunks.release(ew)
+			continue
 		}
+		countSent(ew)
+		responseChunks.release(ew)
 	}
+}
+
+// errConnectionLost is returned by a tunnel whose connection to the
+// controller failed after it was established, such as when a keepalive
+// ping went unanswered.
+var errConnectionLost = errors.New("connection to the controller lost")
 
+// receiveError describes an error receiving from the controller, wrapping
+// errConnectionLost if the connection itself failed.
+func receiveError(err error) error {
+	if status.Code(err) == codes.Unavailable {
+		return fmt.Errorf("%w: %v", errConnectionLost, err)
+	}
+	return fmt.Errorf("failed to receive a message: %v", err)
 }
 
-func runTunnel(wg *sync.WaitGroup, sa *serverContext, conn *grpc.ClientConn, endpoints []configuredEndpoint) {
-	defer wg.Done()
+// runTunnel runs a single session with the controller, returning when the
+// stream fails or the controller closes it.  connected is called once the
+// hello has been sent.  Requests are routed to the endpoints in the table
+// when they arrive, and the controller is told each time they change.  If
+// drain starts, new requests are refused, and the session ends with
+// errDrained once those in progress finish or terminationGracePeriod
+// passes.  Any requests still in progress when the session ends are
+// cancelled.
+func runTunnel(ctx context.Context, sa *serverContext, conn *grpc.ClientConn, endpoints *endpointTable, connected func(), drain *drainer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	client := tunnel.NewAgentTunnelServiceClient(conn)
-	ctx := context.Background()
 
 	stream, err := client.EventTunnel(ctx)
 	if err != nil {
-		log.Fatalf("%v.EventTunnel(_) = _, %v", client, err)
+		return fmt.Errorf("EventTunnel(): %v", err)
 	}
-	pbEndpoints := endpointsToPB(endpoints)
+	current, endpointsChanged := endpoints.get()
+	pbEndpoints := endpointsToPB(current)
 	helloMsg := &tunnel.AgentHello{
 		Version:   version.String(),
+		Commit:    util.GitCommit,
+		BuildDate: util.BuildDate,
 		Endpoints: pbEndpoints,
 		Hostname:  hostname,
+
+		ResponseChunkSize:      uint32(responseChunks.size),
+		ResponseChunksInFlight: uint32(responseChunks.inFlight),
+		AnswersPings:           true,
+		AcceptsFlowControl:     true,
 	}
 	hello := &tunnel.AgentToControllerWrapper{
 		Event: &tunnel.AgentToControllerWrapper_AgentHello{
@@ -142,113 +252,303 @@ func runTunnel(wg *sync.WaitGroup, sa *serverContext, conn *grpc.ClientConn, end
 		},
 	}
 	if err = stream.Send(hello); err != nil {
-		log.Fatalf("Unable to send hello packet: %v", err)
+		return fmt.Errorf("unable to send hello packet: %v", err)
 	}
+	countSent(hello)
+	sessionConnected()
+	defer sessionDisconnected()
+	connected()
 
 	dataflow := make(chan *tunnel.AgentToControllerWrapper, 20)
+	errc := make(chan error, 2)
+
+	// The controller may send more for a request before it sees our
+	// acknowledgement of a cancel, or cancel the same request twice.
+	cancelled := tunnel.NewTombstones(tunnel.DefaultTombstoneTTL)
+
+	// Everything which may write to dataflow is tracked, so it is only
+	// closed once all of them are finished.
+	var inflight sync.WaitGroup
+	run := func(f func()) {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			f()
+		}()
+	}
 
-	go tickerPinger(stream)
-	go dataflowHandler(dataflow, stream)
+	// Requests are tracked separately, so a drain can wait for them.  Once
+	// one finishes, any of its body still to arrive is discarded.
+	requests := &requestTracker{}
+	startRequest := func(id string, f func()) bool {
+		if !requests.add(id) {
+			return false
+		}
+		run(func() {
+			defer requests.done(id)
+			defer cancelRequestBody(id)
+			f()
+		})
+		return true
+	}
+
+	run(func() { tickerPinger(ctx, dataflow) })
+	run(func() { advertiseEndpoints(ctx, endpoints, endpointsChanged, dataflow) })
+	go dataflowHandler(dataflow, stream, errc)
 
 	waitc := make(chan struct{})
 	go func() {
+		defer close(waitc)
 		for {
 			in, err := stream.Recv()
 			if err == io.EOF {
 				// Server has closed the connection.
-				close(waitc)
+				errc <- fmt.Errorf("controller closed the connection")
 				return
 			}
 			if err != nil {
-				log.Fatalf("Failed to receive a message: %T: %v", err, err)
+				errc <- receiveError(err)
+				return
 			}
+			countReceived(in)
 			switch x := in.Event.(type) {
 			case *tunnel.ControllerToAgentWrapper_PingResponse:
-				continue
+				recordPingResponse(in.GetPingResponse(), time.Now())
+			case *tunnel.ControllerToAgentWrapper_PingRequest:
+				dataflow <- makePingResponse(in.GetPingRequest(), time.Now())
 			case *tunnel.ControllerToAgentWrapper_CancelRequest:
 				req := in.GetCancelRequest()
+				if !cancelled.Add(req.Id) {
+					continue
+				}
 				callCancelFunction(req.Id)
+				responseChunks.resume(req.Id)
+				cancelRequestBody(req.Id)
+				cancelCommandStdin(req.Id)
+				closeStream(req.Id)
+				dataflow <- makeCancelAck(req.Id)
+				cancelsAcked.Inc()
 			case *tunnel.ControllerToAgentWrapper_HttpRequest:
 				req := in.GetHttpRequest()
-				found := false
-				for _, endpoint := range endpoints {
-					if endpoint.Configured && endpoint.Type == req.Type && endpoint.Name == req.Name {
-						go endpoint.instance.executeHTTPRequest(dataflow, req)
-						found = true
-						break
-					}
+				requestsReceived.WithLabelValues(req.Type).Inc()
+				if requests.isClosed() {
+					refuseDraining(dataflow, req.Id)
+					continue
 				}
-				if !found {
-					log.Printf("Request for unsupported HTTP tunnel type=%s name=%s", req.Type, req.Name)
+				endpoint := findEndpoint(endpoints.current(), req.Type, req.Name)
+				if endpoint == nil {
+					util.Warnf("Request for unsupported HTTP tunnel type=%s name=%s", req.Type, req.Name)
 					dataflow <- makeBadGatewayResponse(req.Id)
+					continue
+				}
+				if err := checkNamespace(endpoint, req.URI); err != nil {
+					util.Warnf("Rejecting request %s: %v", req.Id, err)
+					dataflow <- makeHTTPStatusResponse(req.Id, http.StatusForbidden, err.Error())
+					continue
+				}
+				instance := endpoint.instance
+				body := requestBody(req)
+				if !startRequest(req.Id, func() { instance.executeHTTPRequest(dataflow, req, body) }) {
+					cancelRequestBody(req.Id)
+					refuseDraining(dataflow, req.Id)
+				}
+			case *tunnel.ControllerToAgentWrapper_StreamOpen:
+				req := in.GetStreamOpen().Request
+				requestsReceived.WithLabelValues(req.Type).Inc()
+				if requests.isClosed() {
+					refuseDraining(dataflow, req.Id)
+					continue
+				}
+				endpoint := findEndpoint(endpoints.current(), req.Type, req.Name)
+				if endpoint == nil {
+					util.Warnf("Stream request for unsupported HTTP tunnel type=%s name=%s", req.Type, req.Name)
+					dataflow <- makeBadGatewayResponse(req.Id)
+					continue
+				}
+				if err := checkNamespace(endpoint, req.URI); err != nil {
+					util.Warnf("Rejecting stream request %s: %v", req.Id, err)
+					dataflow <- makeHTTPStatusResponse(req.Id, http.StatusForbidden, err.Error())
+					continue
 				}
+				instance, ok := endpoint.instance.(streamRequestProcessor)
+				if !ok {
+					util.Warnf("Endpoint type=%s name=%s does not support connection upgrades", req.Type, req.Name)
+					dataflow <- makeHTTPErrorResponse(req.Id, fmt.Errorf("endpoint does not support connection upgrades"))
+					continue
+				}
+				queue := openStream(req.Id)
+				if !startRequest(req.Id, func() { instance.executeStreamRequest(dataflow, req, queue) }) {
+					closeStream(req.Id)
+					refuseDraining(dataflow, req.Id)
+				}
+			case *tunnel.ControllerToAgentWrapper_StreamData:
+				data := in.GetStreamData()
+				if discardLate(cancelled, data.Id) {
+					continue
+				}
+				appendStreamData(data)
+			case *tunnel.ControllerToAgentWrapper_StreamClose:
+				id := in.GetStreamClose().Id
+				callCancelFunction(id)
+				closeStream(id)
+			case *tunnel.ControllerToAgentWrapper_HttpRequestChunk:
+				chunk := in.GetHttpRequestChunk()
+				if discardLate(cancelled, chunk.Id) {
+					continue
+				}
+				appendRequestBody(chunk)
+			case *tunnel.ControllerToAgentWrapper_ControllerDraining:
+				util.Infof("Controller is shutting down, will reconnect once it closes the connection")
+			case *tunnel.ControllerToAgentWrapper_AgentReplaced:
+				util.Warnf("Another instance of this agent connected to the controller and replaced this one")
 			case *tunnel.ControllerToAgentWrapper_CommandRequest:
 				req := in.GetCommandRequest()
-				log.Printf("Got cmd request: %s %v %v", req.Name, req.Arguments, req.Environment)
-				switch req.Name {
-				case "sh":
-					log.Printf("Running 'sh'")
-					go runCommand(dataflow, req)
-				default:
-					log.Printf("Unknown command %s", req.Name)
-					dataflow <- makeCommandFailed(req, nil, "Agent: Unknown command")
+				util.Debugf("Got cmd request: %s", req.LogString())
+				if requests.isClosed() {
+					dataflow <- makeCommandRejected(req, errAgentDraining)
+					continue
+				}
+				command, err := resolveCommand(config, req)
+				if err != nil {
+					util.Warnf("Rejecting command request %s: %v", req.Id, err)
+					dataflow <- makeCommandRejected(req, err)
+					continue
+				}
+				util.Infof("Running '%s' as %s", req.Name, command.path)
+				stdin := commandStdin(req)
+				window := commandOutputWindow(req)
+				if !startRequest(req.Id, func() { runCommand(dataflow, req, command, stdin, window) }) {
+					cancelCommandStdin(req.Id)
+					closeCommandOutputWindow(req.Id)
+					dataflow <- makeCommandRejected(req, errAgentDraining)
+				}
+			case *tunnel.ControllerToAgentWrapper_FileRequest:
+				req := in.GetFileRequest()
+				util.Debugf("Got file request: %s", req.Path)
+				if requests.isClosed() {
+					dataflow <- makeFileFailed(req, errAgentDraining)
+					continue
+				}
+				window := fileOutputWindow(req)
+				if !startRequest(req.Id, func() { sendFile(dataflow, req, config.FileDirectories, window) }) {
+					closeCommandOutputWindow(req.Id)
+					dataflow <- makeFileFailed(req, errAgentDraining)
+				}
+			case *tunnel.ControllerToAgentWrapper_HttpFlowControl:
+				responseChunks.flowControl(in.GetHttpFlowControl())
+			case *tunnel.ControllerToAgentWrapper_CommandCancel:
+				callCancelFunction(in.GetCommandCancel().Id)
+			case *tunnel.ControllerToAgentWrapper_CommandAck:
+				ackCommandOutput(in.GetCommandAck())
+			case *tunnel.ControllerToAgentWrapper_CommandData:
+				data := in.GetCommandData()
+				if discardLate(cancelled, data.Id) {
+					continue
+				}
+				if data.Channel == tunnel.ChannelDirection_STDIN {
+					appendCommandStdin(data)
 				}
 			case nil:
 				continue
 			default:
-				log.Printf("Received unknown message: %T", x)
+				util.Warnf("Received unknown message: %T", x)
 			}
 		}
 	}()
+
+	select {
+	case err = <-errc:
+	case <-drain.started():
+		err = drainTunnel(dataflow, requests, errc, *terminationGracePeriod)
+	}
+	cancel()
 	<-waitc
-	close(dataflow)
-	_ = stream.CloseSend()
+
+	// Fail anything still running.  The controller closes out its side of
+	// these requests when the stream goes away, so any final responses are
+	// simply discarded.  Only this tunnel's requests are failed, as another
+	// may have taken over from it.
+	for _, id := range requests.ids() {
+		failRequest(id)
+	}
+	go func() {
+		inflight.Wait()
+		close(dataflow)
+	}()
+	return err
 }
 
-func loadCert() []byte {
+func loadCert() ([]byte, error) {
 	cert, err := ioutil.ReadFile(*caCertFile)
 	if err == nil {
-		return cert
+		return cert, nil
 	}
 	if config.CACert64 == nil {
-		log.Fatal("Unable to load CA certificate from file or from config")
+		return nil, fmt.Errorf("unable to load CA certificate from file or from config")
 	}
 	cert, err = base64.StdEncoding.DecodeString(*config.CACert64)
 	if err != nil {
-		log.Fatal("Unable to decode CA cert base64 from config")
+		return nil, fmt.Errorf("unable to decode CA cert base64 from config")
 	}
-	return cert
+	return cert, nil
 }
 
-func configureEndpoints(secretsLoader secrets.SecretLoader) {
+// controllerTLSConfig returns the TLS configuration used to connect to the
+// controller, with the agent's current certificate and the CA to verify
+// the controller's.
+func controllerTLSConfig(creds *agentCredentials) (*tls.Config, error) {
+	srvcert, err := loadCert()
+	if err != nil {
+		return nil, err
+	}
+	caCertPool := x509.NewCertPool()
+	if ok := caCertPool.AppendCertsFromPEM(srvcert); !ok {
+		return nil, fmt.Errorf("unable to append CA certificate to pool")
+	}
+
+	tlsConfig := &tls.Config{
+		GetClientCertificate: creds.getClientCertificate,
+		RootCAs:              caCertPool,
+	}
+	config.TLS.Apply(tlsConfig)
+	return tlsConfig, nil
+}
+
+// buildEndpoints creates an instance of each enabled service.  If any
+// cannot be created, those which were are closed and the error returned.
+func buildEndpoints(serviceConfig *cfg.AgentServiceConfig, secretsLoader secrets.SecretLoader) ([]configuredEndpoint, error) {
 	// For each service, if it is enabled, find and create an instance.
-	endpoints = []configuredEndpoint{}
-	for _, service := range agentServiceConfig.Services {
+	endpoints := []configuredEndpoint{}
+	for _, service := range serviceConfig.Services {
 		var instance httpRequestProcessor
 		var configured bool
 
 		if service.Enabled {
 			config, err := yaml.Marshal(service.Config)
 			if err != nil {
-				log.Fatal(err)
+				closeEndpoints(endpoints)
+				return nil, err
 			}
 			switch service.Type {
 			case "kubernetes":
 				instance, configured, err = MakeKubernetesEndpoint(service.Name, config)
 			case "aws":
 				instance, configured, err = MakeAwsEndpoint(service.Name, config, secretsLoader)
+			case "jenkins":
+				instance, configured, err = MakeJenkinsEndpoint(service.Name, config, secretsLoader)
 			default:
 				instance, configured, err = MakeGenericEndpoint(service.Type, service.Name, config, secretsLoader)
 			}
 
 			// If the instance-specific make method returns an error, catch it here.
 			if err != nil {
-				log.Fatal(err)
+				closeEndpoints(endpoints)
+				return nil, fmt.Errorf("%s endpoint %s: %v", service.Type, service.Name, err)
 			}
 
 			if len(service.Namespaces) == 0 {
 				// If it did not return an error, a nil instance means it is not fully configured.
-				log.Printf("Adding endpoint type %s, name %s, configured %v", service.Type, service.Name, configured)
+				util.Infof("Adding endpoint type %s, name %s, configured %v", service.Type, service.Name, configured)
 				endpoints = append(endpoints, configuredEndpoint{
 					Type:       service.Type,
 					Name:       service.Name,
@@ -257,108 +557,266 @@ func configureEndpoints(secretsLoader secrets.SecretLoader) {
 				})
 			} else {
 				for _, ns := range service.Namespaces {
-					log.Printf("Adding endpoint type %s, name %s, configured %v, namespaces %v", service.Type, ns.Name, configured, ns.Namespaces)
+					util.Infof("Adding endpoint type %s, name %s, configured %v, namespaces %v", service.Type, ns.Name, configured, ns.Namespaces)
 					newep := configuredEndpoint{
-						Type:       service.Type,
-						Name:       ns.Name,
-						Configured: configured,
-						instance:   instance,
-						Namespace:  ns.Namespaces,
+						Type:               service.Type,
+						Name:               ns.Name,
+						Configured:         configured,
+						instance:           instance,
+						Namespace:          ns.Namespaces,
+						allowClusterScoped: ns.AllowClusterScoped,
 					}
 					endpoints = append(endpoints, newep)
 				}
 			}
+
+			// Each kubeconfig context is also reachable as its own endpoint,
+			// restricted as the service is.
+			if ke, ok := instance.(*KubernetesEndpoint); ok {
+				namespaces, allowClusterScoped := serviceNamespaces(service)
+				for _, name := range ke.ContextNames() {
+					if hasEndpoint(endpoints, service.Type, name) {
+						continue
+					}
+					util.Infof("Adding endpoint type %s, name %s (kubeconfig context), configured %v, namespaces %v", service.Type, name, configured, namespaces)
+					endpoints = append(endpoints, configuredEndpoint{
+						Type:               service.Type,
+						Name:               name,
+						Configured:         configured,
+						instance:           ke.contextEndpoint(name),
+						Namespace:          namespaces,
+						allowClusterScoped: allowClusterScoped,
+					})
+				}
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// serviceNamespaces returns the namespaces a service is restricted to,
+// across all of its namespace entries, and whether cluster-scoped requests
+// are allowed, which they are only if every entry allows them.  No
+// namespaces means the service is not restricted.
+func serviceNamespaces(service cfg.ServiceConfig) ([]string, bool) {
+	if len(service.Namespaces) == 0 {
+		return nil, false
+	}
+	namespaces := []string{}
+	allowClusterScoped := true
+	for _, ns := range service.Namespaces {
+		namespaces = append(namespaces, ns.Namespaces...)
+		allowClusterScoped = allowClusterScoped && ns.AllowClusterScoped
+	}
+	return namespaces, allowClusterScoped
+}
+
+// findEndpoint returns the configured endpoint with the type and name, or
+// nil if there is none.
+func findEndpoint(endpoints []configuredEndpoint, endpointType string, name string) *configuredEndpoint {
+	for i := range endpoints {
+		ep := &endpoints[i]
+		if ep.Configured && ep.Type == endpointType && ep.Name == name {
+			return ep
+		}
+	}
+	return nil
+}
+
+func hasEndpoint(endpoints []configuredEndpoint, endpointType string, name string) bool {
+	for _, ep := range endpoints {
+		if ep.Type == endpointType && ep.Name == name {
+			return true
 		}
 	}
+	return false
 }
 
 func getHostname() string {
 	hn, err := os.Hostname()
 	if err != nil {
-		log.Printf("Unable to get hostname: %v, using 'unknown'", err)
+		util.Warnf("Unable to get hostname: %v, using 'unknown'", err)
 		return "unknown"
 	}
 	return hn
 }
 
 func main() {
-	log.Printf("Agent version %s starting", version.String())
+	flag.Usage = cfg.FlagUsage(flag.CommandLine)
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("agent %s\n", version.Detailed())
+		return
+	}
+	if err := cfg.ApplyEnvironment(flag.CommandLine, os.LookupEnv); err != nil {
+		util.Fatalf("%v", err)
+	}
+
+	// The config file may set flags too, including the logging ones, so
+	// it is loaded before logging is set up.
+	c, err := cfg.Load(*configFile)
+	if err != nil {
+		util.Fatalf("Error loading config: %v", err)
+	}
+	if err := cfg.ApplyFileFlags(flag.CommandLine, c.Flags, "configFile"); err != nil {
+		util.Fatalf("Error loading config: %v", err)
+	}
+	config = c
+	util.SetRedactedHeaders(config.RedactHeaders)
+	responseChunks = newChunkPool(config.ResponseChunkSize, config.ResponseChunksInFlight)
+
+	if err := util.SetupLogging(*logLevel, *logFormat); err != nil {
+		util.Fatalf("%v", err)
+	}
 
-	var err error
+	util.Infof("Agent version %s starting", version.Detailed())
 
 	arg0hash, err := updater.HashSelf()
 	if err != nil {
-		log.Printf("Could not hash self: %v", err)
+		util.Warnf("Could not hash self: %v", err)
 		arg0hash = "unknown"
 	}
-	log.Printf("Binary hash: %s\n", arg0hash)
-
-	flag.Parse()
+	util.Infof("Binary hash: %s", arg0hash)
 
-	log.Printf("OS type: %s, CPU: %s, cores: %d", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	util.Infof("OS type: %s, CPU: %s, cores: %d", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
 
 	namespace, ok := os.LookupEnv("POD_NAMESPACE")
 	if !ok {
-		log.Fatalf("envar POD_NAMESPACE not set to the pod's namespace")
+		util.Fatalf("envar POD_NAMESPACE not set to the pod's namespace")
 	}
 	secretsLoader, err = secrets.MakeKubernetesSecretLoader(namespace)
 	if err != nil {
-		log.Fatal(err)
+		util.Fatalf("%v", err)
 	}
 
-	c, err := cfg.Load(*configFile)
+	util.Infof("controller hostname: %s", config.ControllerHostname)
+
+	controllerProxy, err := config.ControllerProxy()
 	if err != nil {
-		log.Fatalf("Error loading config: %v", err)
+		util.Fatalf("%v", err)
 	}
-	config = c
-	log.Printf("controller hostname: %s", config.ControllerHostname)
+	if controllerProxy != nil {
+		util.Infof("controller proxy: %s", controllerProxy.Redacted())
+	}
+	dialController := controllerDialer(controllerProxy)
 
 	uc, err := cfg.LoadServiceConfig(config.ServicesConfigPath)
 	if err != nil {
-		log.Fatalf("Error loading services config: %v", err)
+		util.Fatalf("Error loading services config: %v", err)
+	}
+	configured, err := buildEndpoints(uc, secretsLoader)
+	if err != nil {
+		util.Fatalf("%v", err)
 	}
-	agentServiceConfig = uc
+	endpoints = newEndpointTable(configured)
 
-	configureEndpoints(secretsLoader)
+	if *diagnose {
+		if !runDiagnosis(context.Background(), os.Stdout, config.ControllerHostname, dialController, configured) {
+			os.Exit(1)
+		}
+		return
+	}
 
-	// load client cert/key, cacert
-	clcert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
-	if err != nil {
-		log.Fatalf("Unable to load agent certificate or key: %v", err)
+	if *watchConfig {
+		w := newConfigWatcher(config.ServicesConfigPath, endpoints, func(c *cfg.AgentServiceConfig) ([]configuredEndpoint, error) {
+			return buildEndpoints(c, secretsLoader)
+		})
+		go w.run(context.Background())
 	}
-	caCertPool := x509.NewCertPool()
-	srvcert := loadCert()
-	if ok := caCertPool.AppendCertsFromPEM(srvcert); !ok {
-		log.Fatalf("Unable to append certificate to pool: %v", err)
+
+	if *prometheusListenPort > 0 {
+		go runPrometheusHTTPServer(uint16(*prometheusListenPort))
 	}
 
-	ta := credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{clcert},
-		RootCAs:      caCertPool,
-	})
+	if *healthListenPort > 0 {
+		probes := newEndpointProbes()
+		go probes.run(context.Background(), endpoints, *probeInterval)
+		go runHealthHTTPServer(uint16(*healthListenPort), probes, endpoints, 3*(*probeInterval))
+	}
+
+	creds, err := loadAgentCredentials(config.CertFile, config.KeyFile)
+	if err != nil {
+		util.Fatalf("%v", err)
+	}
+	tlsConfig, err := controllerTLSConfig(creds)
+	if err != nil {
+		util.Fatalf("%v", err)
+	}
+	ta := credentials.NewTLS(tlsConfig)
 
 	sa := &serverContext{}
 
+	retry := newBackoff(*reconnectMinDelay, *reconnectMaxDelay)
+	opts := controllerDialOptions(ta, dialController, retry)
+
+	var renewed chan struct{}
+	if *certRenewBefore > 0 {
+		renewer := newCertRenewer(creds, config.CertFile, config.KeyFile, *certRenewBefore, func(ctx context.Context) (*tunnel.CertificateRenewalResponse, error) {
+			return requestCertificateRenewal(ctx, opts)
+		})
+		renewed = renewer.renewed
+		go renewer.run(context.Background())
+	}
+
+	drain := newDrainer()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		util.Infof("Received %s, draining", sig)
+		drain.start()
+	}()
+
+	run := func(ctx context.Context, connected func(), drain *drainer) error {
+		return connectAndRun(ctx, sa, opts, connected, drain)
+	}
+	runSessions(context.Background(), run, drain, renewed, retry)
+	util.Infof("Drained, exiting")
+}
+
+// controllerDialOptions returns the options for each connection to the
+// controller.  Keepalive pings detect a connection which has silently gone
+// away, such as one dropped by a load balancer, and the attempts within a
+// dial follow the same backoff as reconnects.
+func controllerDialOptions(creds credentials.TransportCredentials, dial dialFunc, retry *backoff) []grpc.DialOption {
 	opts := []grpc.DialOption{
-		grpc.WithTransportCredentials(ta),
+		grpc.WithTransportCredentials(creds),
 		grpc.WithBlock(),
+		grpc.WithContextDialer(dial),
+		grpc.WithConnectParams(retry.connectParams()),
+	}
+	if *keepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                *keepaliveTime,
+			Timeout:             *keepaliveTimeout,
+			PermitWithoutStream: *keepalivePermitWithoutStream,
+		}))
 	}
+	return opts
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// connectAndRun dials the controller and runs a single tunnel session.
+func connectAndRun(ctx context.Context, sa *serverContext, opts []grpc.DialOption, connected func(), drain *drainer) error {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	conn, err := grpc.DialContext(ctx, config.ControllerHostname, opts...)
+	conn, err := grpc.DialContext(dialCtx, config.ControllerHostname, opts...)
 	if err != nil {
-		log.Fatalf("Could not connect: %v", err)
+		return fmt.Errorf("could not connect: %v", err)
 	}
 	defer conn.Close()
 
-	var wg sync.WaitGroup
-
-	log.Printf("Starting GRPC tunnel.")
-	wg.Add(1)
-	go runTunnel(&wg, sa, conn, endpoints)
+	util.Infof("Starting GRPC tunnel.")
+	return runTunnel(ctx, sa, conn, endpoints, connected, drain)
+}
 
-	wg.Wait()
-	log.Printf("Done.")
+// requestCertificateRenewal asks the controller for a new certificate,
+// authenticating with the current one.
+func requestCertificateRenewal(ctx context.Context, opts []grpc.DialOption) (*tunnel.CertificateRenewalResponse, error) {
+	conn, err := grpc.DialContext(ctx, config.ControllerHostname, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	return tunnel.NewAgentTunnelServiceClient(conn).RenewCertificate(ctx, &tunnel.CertificateRenewalRequest{})
 }
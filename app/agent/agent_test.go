@@ -0,0 +1,156 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/agent/cfg"
+	"github.com/opsmx/oes-birger/pkg/ca"
+)
+
+// startTestController accepts TLS connections as a controller issued its
+// certificate by authority would, requiring a client certificate.  Each
+// handshake's result is sent on the returned channel.
+func startTestController(t *testing.T, authority *ca.CA) (string, chan error) {
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := authority.MakeCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	results := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			results <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return lis.Addr().String(), results
+}
+
+func TestControllerTLSConfig_caRotation(t *testing.T) {
+	oldCert, oldKey, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert, newKey, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCA, err := ca.MakeCAFromData(oldCert, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A controller part way through a rotation has the new CA, followed
+	// by the old one.
+	rotatedCA, err := ca.MakeCAFromData(append(append([]byte{}, newCert...), oldCert...), newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle64, err := rotatedCA.GetCACert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := base64.StdEncoding.DecodeString(bundle64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs, err := ca.ParseCertificates(bundle); err != nil || len(certs) != 2 {
+		t.Fatalf("GetCACert() returned %d certificates (%v), want 2", len(certs), err)
+	}
+
+	dir := t.TempDir()
+	bundleFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(bundleFile, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+	savedCACertFile := *caCertFile
+	*caCertFile = bundleFile
+	config = &cfg.AgentConfig{}
+	defer func() {
+		*caCertFile = savedCACertFile
+		config = nil
+	}()
+
+	agentName := ca.CertificateName{Agent: "agent1", Purpose: ca.CertificatePurposeAgent}
+	tests := []struct {
+		name       string
+		controller *ca.CA
+		issuer     *ca.CA
+	}{
+		{"old controller, old agent certificate", oldCA, oldCA},
+		{"rotated controller, old agent certificate", rotatedCA, oldCA},
+		{"rotated controller, new agent certificate", rotatedCA, rotatedCA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPEM, keyPEM := issueTestCertificate(t, tt.issuer, agentName, time.Hour)
+			certFile := filepath.Join(t.TempDir(), "tls.crt")
+			keyFile := filepath.Join(t.TempDir(), "tls.key")
+			if err := writeCertificateFiles(certFile, certPEM, keyFile, keyPEM); err != nil {
+				t.Fatal(err)
+			}
+			creds, err := loadAgentCredentials(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig, err := controllerTLSConfig(creds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig.ServerName = "localhost"
+
+			addr, results := startTestController(t, tt.controller)
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, tlsConfig)
+			if err != nil {
+				t.Fatalf("agent could not connect: %v", err)
+			}
+			defer conn.Close()
+			select {
+			case err := <-results:
+				if err != nil {
+					t.Errorf("controller refused the agent: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for the handshake")
+			}
+		})
+	}
+}
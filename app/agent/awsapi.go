@@ -20,7 +20,8 @@ import (
 	"bytes"
 	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
@@ -32,6 +33,7 @@ import (
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/opsmx/oes-birger/pkg/secrets"
 	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 	"golang.org/x/net/context"
 	"gopkg.in/yaml.v3"
 )
@@ -110,8 +112,16 @@ func MakeAwsEndpoint(name string, configBytes []byte, secretsLoader secrets.Secr
 	return k, true, nil
 }
 
-func (a *AwsEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest) {
-	log.Printf("Running request %v", req)
+// tlsMode returns the TLS mode of requests to AWS, which are always
+// verified against the system roots.
+func (a *AwsEndpoint) tlsMode() string {
+	return tunnel.TLSModeVerified
+}
+
+func (a *AwsEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, body io.ReadCloser) {
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	defer body.Close()
+	logger.Debugf("Running request %s", req.LogString())
 	tlsConfig := &tls.Config{
 		MinVersion: tls.VersionTLS12,
 	}
@@ -120,6 +130,7 @@ func (a *AwsEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToController
 		IdleConnTimeout:    30 * time.Second,
 		DisableCompression: true,
 		TLSClientConfig:    tlsConfig,
+		Proxy:              http.ProxyFromEnvironment,
 	}
 	client := &http.Client{
 		Transport: tr,
@@ -137,7 +148,7 @@ func (a *AwsEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToController
 	}
 
 	if len(host) == 0 || len(port) == 0 || len(signerService) == 0 || len(signingRegion) == 0 || len(timestamp) == 0 {
-		log.Printf("aws: required headers missing from request")
+		logger.Warnf("aws: required headers missing from request")
 		dataflow <- makeBadGatewayResponse(req.Id)
 		return
 	}
@@ -149,9 +160,18 @@ func (a *AwsEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToController
 	baseURL := fmt.Sprintf("https://%s:%s", host, port)
 	actualurl := fmt.Sprintf("https://%s:%s%s", host, port, req.URI)
 
-	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, actualurl, bytes.NewBuffer(req.Body))
+	// The signature covers the payload, so the body must be fully read
+	// before the request can be sent.
+	bodyBytes, err := ioutil.ReadAll(body)
+	if err != nil {
+		logger.Warnf("Failed to read request body for %s to %s: %v", req.Method, actualurl, err)
+		dataflow <- makeBadGatewayResponse(req.Id)
+		return
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, actualurl, bytes.NewReader(bodyBytes))
 	if err != nil {
-		log.Printf("Failed to build request for %s to %s: %v", req.Method, actualurl, err)
+		logger.Warnf("Failed to build request for %s to %s: %v", req.Method, actualurl, err)
 		dataflow <- makeBadGatewayResponse(req.Id)
 		return
 	}
@@ -166,10 +186,10 @@ func (a *AwsEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToController
 		}
 	}
 
-	bodyBuffer := bytes.NewReader(req.Body)
+	bodyBuffer := bytes.NewReader(bodyBytes)
 	_, err = a.signer.Sign(httpRequest, bodyBuffer, signerService, signingRegion, ts)
 	if err != nil {
-		log.Printf("Failed to sign AWS request: %v", err)
+		logger.Warnf("Failed to sign AWS request: %v", err)
 		dataflow <- makeBadGatewayResponse(req.Id)
 		return
 	}
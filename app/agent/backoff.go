@@ -0,0 +1,81 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	grpcbackoff "google.golang.org/grpc/backoff"
+)
+
+// backoff computes jittered exponential delays between reconnect attempts.
+// Each delay is chosen at random from the upper half of the current
+// window, and the window doubles up to max.
+type backoff struct {
+	sync.Mutex
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newBackoff(min time.Duration, max time.Duration) *backoff {
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max, current: min}
+}
+
+// Next returns the delay to wait before the next attempt.
+func (b *backoff) Next() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	d := b.current
+	b.current *= 2
+	if b.current > b.max || b.current <= 0 {
+		b.current = b.max
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Reset starts the sequence over, and is called once a connection succeeds.
+func (b *backoff) Reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.current = b.min
+}
+
+// connectParams returns gRPC's connection parameters for the same policy,
+// so the attempts gRPC makes within a dial back off as reconnects do.
+// gRPC's jitter is symmetric, so its delays match ours only roughly.
+func (b *backoff) connectParams() grpc.ConnectParams {
+	return grpc.ConnectParams{
+		Backoff: grpcbackoff.Config{
+			BaseDelay:  b.min,
+			Multiplier: 2,
+			Jitter:     0.25,
+			MaxDelay:   b.max,
+		},
+		MinConnectTimeout: 20 * time.Second,
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff_Next(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second)
+
+	windows := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, w := range windows {
+		window := w * time.Second
+		d := b.Next()
+		if d < window/2 || d > window {
+			t.Errorf("attempt %d: delay %s not in [%s, %s]", i, d, window/2, window)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d > time.Second {
+		t.Errorf("after Reset(): delay %s > %s", d, time.Second)
+	}
+}
+
+func TestNewBackoff_limits(t *testing.T) {
+	b := newBackoff(5*time.Second, time.Second)
+	if b.max != 5*time.Second {
+		t.Errorf("expected max to be raised to min, got %s", b.max)
+	}
+	b = newBackoff(0, time.Second)
+	if b.min != time.Second {
+		t.Errorf("expected default min of 1s, got %s", b.min)
+	}
+}
+
+func TestBackoff_connectParams(t *testing.T) {
+	p := newBackoff(2*time.Second, 30*time.Second).connectParams()
+	if p.Backoff.BaseDelay != 2*time.Second || p.Backoff.MaxDelay != 30*time.Second {
+		t.Errorf("connectParams() delays = %s..%s, want 2s..30s", p.Backoff.BaseDelay, p.Backoff.MaxDelay)
+	}
+	if p.Backoff.Multiplier != 2 {
+		t.Errorf("connectParams() multiplier = %v, want 2", p.Backoff.Multiplier)
+	}
+}
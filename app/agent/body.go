@@ -0,0 +1,117 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How many chunks may be queued for a single request body.  The tunnel
+// receive loop never waits for the upstream request to consume them, as
+// that would hold up every other request on the tunnel, so a request whose
+// body arrives faster than this is failed.
+const requestBodyQueueLength = 64
+
+var errRequestBodyOverflow = errors.New("request body arrived faster than the upstream service read it")
+
+// requestBodyQueue holds the chunks of a request body not yet written to
+// the pipe the upstream request reads.
+type requestBodyQueue struct {
+	c  chan []byte
+	pw *io.PipeWriter
+}
+
+var bodyRegistry = struct {
+	sync.Mutex
+	m map[string]*requestBodyQueue
+}{m: make(map[string]*requestBodyQueue)}
+
+// requestBody returns the body reader to use for an incoming request.  If
+// the controller indicated there is no body, http.NoBody is returned,
+// otherwise a reader is returned which will be fed by HttpRequestChunk
+// messages as they arrive.  The returned ReadCloser must be closed when
+// the request completes.
+func requestBody(req *tunnel.HttpRequest) io.ReadCloser {
+	if req.ContentLength == 0 {
+		return http.NoBody
+	}
+
+	c := make(chan []byte, requestBodyQueueLength)
+	pr, pw := io.Pipe()
+	bodyRegistry.Lock()
+	bodyRegistry.m[req.Id] = &requestBodyQueue{c: c, pw: pw}
+	bodyRegistry.Unlock()
+
+	go bodyPump(c, pw)
+	return pr
+}
+
+// bodyPump copies chunks into the pipe until EOF or cancellation.  If the
+// reader goes away early, remaining chunks are drained and discarded so the
+// tunnel receive loop never blocks on an abandoned request.
+func bodyPump(c chan []byte, pw *io.PipeWriter) {
+	for data := range c {
+		if len(data) == 0 {
+			_ = pw.Close()
+			continue
+		}
+		_, _ = pw.Write(data)
+	}
+	_ = pw.CloseWithError(context.Canceled)
+}
+
+// appendRequestBody is called from the tunnel receive loop with each chunk
+// of a request body.  A zero length chunk indicates EOF.  If the queue is
+// full, the upstream request fails.
+func appendRequestBody(chunk *tunnel.HttpRequestChunk) {
+	bodyRegistry.Lock()
+	defer bodyRegistry.Unlock()
+	q, ok := bodyRegistry.m[chunk.Id]
+	if !ok {
+		return
+	}
+	select {
+	case q.c <- chunk.Body:
+	default:
+		util.Warnf("Request body for %s is queued faster than the upstream service reads it, failing the request", chunk.Id)
+		_ = q.pw.CloseWithError(errRequestBodyOverflow)
+		close(q.c)
+		delete(bodyRegistry.m, chunk.Id)
+		return
+	}
+	if len(chunk.Body) == 0 {
+		close(q.c)
+		delete(bodyRegistry.m, chunk.Id)
+	}
+}
+
+// cancelRequestBody stops any pending body transfer for the request id.
+func cancelRequestBody(id string) {
+	bodyRegistry.Lock()
+	defer bodyRegistry.Unlock()
+	if q, ok := bodyRegistry.m[id]; ok {
+		close(q.c)
+		delete(bodyRegistry.m, id)
+	}
+}
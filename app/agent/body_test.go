@@ -0,0 +1,97 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestRequestBody_noBody(t *testing.T) {
+	body := requestBody(&tunnel.HttpRequest{Id: "nobody", ContentLength: 0})
+	if body != http.NoBody {
+		t.Errorf("expected http.NoBody, got %T", body)
+	}
+}
+
+func TestRequestBody_chunks(t *testing.T) {
+	body := requestBody(&tunnel.HttpRequest{Id: "chunks", ContentLength: -1})
+
+	go func() {
+		appendRequestBody(&tunnel.HttpRequestChunk{Id: "chunks", Body: []byte("foo")})
+		appendRequestBody(&tunnel.HttpRequestChunk{Id: "chunks", Body: []byte("bar")})
+		appendRequestBody(&tunnel.HttpRequestChunk{Id: "chunks", Body: []byte{}})
+	}()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "foobar" {
+		t.Errorf("expected 'foobar', got '%s'", string(data))
+	}
+}
+
+func TestRequestBody_cancel(t *testing.T) {
+	body := requestBody(&tunnel.HttpRequest{Id: "cancel", ContentLength: 100})
+
+	go func() {
+		appendRequestBody(&tunnel.HttpRequestChunk{Id: "cancel", Body: []byte("foo")})
+		cancelRequestBody("cancel")
+		// late chunks for a cancelled request are ignored
+		appendRequestBody(&tunnel.HttpRequestChunk{Id: "cancel", Body: []byte("bar")})
+	}()
+
+	data, err := ioutil.ReadAll(body)
+	if err == nil {
+		t.Errorf("expected an error, got data '%s'", string(data))
+	}
+}
+
+func TestRequestBody_readerClosed(t *testing.T) {
+	body := requestBody(&tunnel.HttpRequest{Id: "closed", ContentLength: -1})
+	body.Close()
+
+	// None of these should block, even though nothing is reading.
+	for i := 0; i < requestBodyQueueLength*2; i++ {
+		appendRequestBody(&tunnel.HttpRequestChunk{Id: "closed", Body: []byte("data")})
+	}
+	appendRequestBody(&tunnel.HttpRequestChunk{Id: "closed", Body: []byte{}})
+}
+
+func TestRequestBody_overflow(t *testing.T) {
+	body := requestBody(&tunnel.HttpRequest{Id: "overflow", ContentLength: -1})
+	defer body.Close()
+
+	// Nothing is reading, so the queue fills, and the request then fails
+	// instead of blocking the tunnel.
+	for i := 0; i < requestBodyQueueLength*2; i++ {
+		appendRequestBody(&tunnel.HttpRequestChunk{Id: "overflow", Body: []byte("data")})
+	}
+	bodyRegistry.Lock()
+	_, found := bodyRegistry.m["overflow"]
+	bodyRegistry.Unlock()
+	if found {
+		t.Errorf("overflowing request body is still registered")
+	}
+	if _, err := ioutil.ReadAll(body); err != errRequestBodyOverflow {
+		t.Errorf("ReadAll() = %v, want %v", err, errRequestBodyOverflow)
+	}
+}
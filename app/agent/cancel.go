@@ -18,8 +18,10 @@ package main
 
 import (
 	"context"
-	"log"
 	"sync"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 )
 
 var cancelRegistry = struct {
@@ -45,6 +47,34 @@ func callCancelFunction(id string) {
 	cancel, ok := cancelRegistry.m[id]
 	if ok {
 		cancel()
-		log.Printf("Cancelling request %s", id)
+		util.Debugf("Cancelling request %s", id)
+	}
+}
+
+// failRequest stops whatever is left of a request when its tunnel closes.
+func failRequest(id string) {
+	callCancelFunction(id)
+	responseChunks.resume(id)
+	cancelRequestBody(id)
+	cancelCommandStdin(id)
+	closeCommandOutputWindow(id)
+	closeStream(id)
+}
+
+// discardLate returns true, counting the message, if id belongs to a
+// request the controller has already cancelled.
+func discardLate(cancelled *tunnel.Tombstones, id string) bool {
+	if !cancelled.Contains(id) {
+		return false
+	}
+	lateMessagesDiscarded.Inc()
+	return true
+}
+
+func makeCancelAck(id string) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_CancelAck{
+			CancelAck: &tunnel.CancelAck{Id: id},
+		},
 	}
 }
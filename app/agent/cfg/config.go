@@ -17,26 +17,191 @@
 package cfg
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 )
 
 const (
 	defaultCertPath       = "/app/secrets/agent/tls.crt"
 	defaultKeyPath        = "/app/secrets/agent/tls.key"
 	defaultUserconfigPath = "/app/config/services.yaml"
+
+	// DefaultResponseChunkSize is the largest piece of a response body
+	// sent to the controller in one message, unless configured.
+	DefaultResponseChunkSize = 64 * 1024
+
+	// DefaultResponseChunksInFlight is how many chunks of one response
+	// may wait to be sent to the controller, unless configured.
+	DefaultResponseChunksInFlight = 16
+
+	maxResponseChunksInFlight = 1024
 )
 
-// AgentConfig holds all the configuration for the agent.  The
-// configuration file is loaded from disk first, and then any
-// environment variables are applied.
+// AgentConfig holds all the configuration for the agent.  Unknown keys
+// in the file are an error.
 type AgentConfig struct {
 	ControllerHostname string  `yaml:"controllerHostname,omitempty"`
 	CACert64           *string `yaml:"caCert64,omitempty"`
 	CertFile           string  `yaml:"certFile,omitempty"`
 	KeyFile            string  `yaml:"keyFile,omitempty"`
 	ServicesConfigPath string  `yaml:"servicesConfigPath,omitempty"`
+
+	// ControllerProxyURL is the proxy used to reach the controller, as an
+	// http, https, or socks5 URL.  If empty, the proxy, if any, is taken
+	// from HTTPS_PROXY and NO_PROXY.
+	ControllerProxyURL string `yaml:"controllerProxyURL,omitempty"`
+
+	// AllowedCommands lists the commands the controller may ask the agent
+	// to run, by the name used in the request.  No other commands will run.
+	AllowedCommands map[string]AllowedCommand `yaml:"allowedCommands,omitempty"`
+
+	// CommandEnvironment is the baseline environment, as NAME=value
+	// entries, given to every command.
+	CommandEnvironment []string `yaml:"commandEnvironment,omitempty"`
+
+	// FileDirectories lists the directories the controller may fetch files
+	// from.  Files in their subdirectories may be fetched too, but not
+	// through a symlink which leads outside them.
+	FileDirectories []string `yaml:"fileDirectories,omitempty"`
+
+	// CommandDirectories lists the directories a command may be asked to
+	// run in.  Their subdirectories are allowed too, but not through a
+	// symlink which leads outside them.  If empty, commands always run in
+	// the agent's working directory.
+	CommandDirectories []string `yaml:"commandDirectories,omitempty"`
+
+	// Flags sets command line flags, by flag name, which were given
+	// neither on the command line nor in the environment.
+	Flags map[string]string `yaml:"flags,omitempty"`
+
+	// ResponseChunkSize is the largest piece of an HTTP response body sent
+	// to the controller in one message.  Smaller reads from the upstream
+	// service are combined until a chunk is full or briefly idle.
+	ResponseChunkSize int `yaml:"responseChunkSize,omitempty"`
+
+	// ResponseChunksInFlight is how many chunks of one HTTP response may
+	// be held waiting to be sent before reading from the upstream service
+	// pauses.
+	ResponseChunksInFlight int `yaml:"responseChunksInFlight,omitempty"`
+
+	// TLS restricts the TLS versions and cipher suites used to connect
+	// to the controller.
+	TLS util.TLSConfig `yaml:"tls,omitempty"`
+
+	// RedactHeaders lists the headers whose values are never logged.  If
+	// empty, util.DefaultRedactedHeaders are redacted.
+	RedactHeaders []string `yaml:"redactHeaders,omitempty"`
+}
+
+// AllowedCommand describes one command the agent is allowed to run.
+type AllowedCommand struct {
+	// Path is the absolute path to the executable.
+	Path string `yaml:"path"`
+
+	// Arguments are always passed first, ahead of any from the request.
+	Arguments []string `yaml:"arguments,omitempty"`
+
+	// Environment lists the names of the variables the request may set.
+	Environment []string `yaml:"environment,omitempty"`
+
+	// Umask, if set, is the octal umask the command starts with, such
+	// as "022".  Otherwise it inherits the agent's.
+	Umask string `yaml:"umask,omitempty"`
+}
+
+// ParseUmask returns the command's umask, and whether one is set.
+func (c AllowedCommand) ParseUmask() (int, bool, error) {
+	if c.Umask == "" {
+		return 0, false, nil
+	}
+	umask, err := strconv.ParseUint(c.Umask, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, false, fmt.Errorf("umask '%s' must be octal, from 000 to 777", c.Umask)
+	}
+	return int(umask), true, nil
+}
+
+// ParseProxyURL parses a proxy URL, which must be http, https, or socks5.
+// An empty URL gives a nil proxy.
+func ParseProxyURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy URL '%s' must be http, https, or socks5", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL '%s' has no host", s)
+	}
+	return u, nil
+}
+
+// ControllerProxy returns the proxy configured to reach the controller, or
+// nil to use the environment's.
+func (c *AgentConfig) ControllerProxy() (*url.URL, error) {
+	return ParseProxyURL(c.ControllerProxyURL)
+}
+
+func (c *AgentConfig) validate() error {
+	for name, command := range c.AllowedCommands {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("command name '%s' is invalid", name)
+		}
+		if !filepath.IsAbs(command.Path) || filepath.Clean(command.Path) != command.Path {
+			return fmt.Errorf("command %s: path '%s' must be a clean absolute path", name, command.Path)
+		}
+		if _, _, err := command.ParseUmask(); err != nil {
+			return fmt.Errorf("command %s: %v", name, err)
+		}
+	}
+	for _, dir := range c.FileDirectories {
+		if !filepath.IsAbs(dir) || filepath.Clean(dir) != dir {
+			return fmt.Errorf("fileDirectories: '%s' must be a clean absolute path", dir)
+		}
+	}
+	for _, dir := range c.CommandDirectories {
+		if !filepath.IsAbs(dir) || filepath.Clean(dir) != dir {
+			return fmt.Errorf("commandDirectories: '%s' must be a clean absolute path", dir)
+		}
+	}
+	for _, env := range c.CommandEnvironment {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("commandEnvironment entry '%s' must be NAME=value", env)
+		}
+	}
+	if c.ResponseChunkSize > tunnel.MaxResponseChunkSize {
+		return fmt.Errorf("responseChunkSize must be at most %d", tunnel.MaxResponseChunkSize)
+	}
+	if c.ResponseChunksInFlight > maxResponseChunksInFlight {
+		return fmt.Errorf("responseChunksInFlight must be at most %d", maxResponseChunksInFlight)
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+	if err := util.ValidateHeaderNames(c.RedactHeaders); err != nil {
+		return fmt.Errorf("redactHeaders%v", err)
+	}
+	if _, err := c.ControllerProxy(); err != nil {
+		return fmt.Errorf("controllerProxyURL: %v", err)
+	}
+	return nil
 }
 
 func (c *AgentConfig) applyDefaults() {
@@ -55,10 +220,17 @@ func (c *AgentConfig) applyDefaults() {
 	if len(c.ServicesConfigPath) == 0 {
 		c.ServicesConfigPath = defaultUserconfigPath
 	}
+
+	if c.ResponseChunkSize <= 0 {
+		c.ResponseChunkSize = DefaultResponseChunkSize
+	}
+
+	if c.ResponseChunksInFlight <= 0 {
+		c.ResponseChunksInFlight = DefaultResponseChunksInFlight
+	}
 }
 
-// Load will load YAML configuration from the provided filename, and then apply
-// environment variables to override some subset of available options.
+// Load will load YAML configuration from the provided filename.
 func Load(filename string) (*AgentConfig, error) {
 	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -66,12 +238,17 @@ func Load(filename string) (*AgentConfig, error) {
 	}
 
 	config := &AgentConfig{}
-	err = yaml.Unmarshal(buf, config)
-	if err != nil {
+	decoder := yaml.NewDecoder(bytes.NewReader(buf))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
 		return nil, err
 	}
 
 	config.applyDefaults()
 
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cfg
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Each agent flag may also be set from the environment, or from the
+// "flags" section of the config file.  The command line takes precedence
+// over the environment, which takes precedence over the file.
+
+const flagEnvPrefix = "AGENT_"
+
+// FlagEnvName returns the environment variable which sets a flag, such as
+// AGENT_RECONNECT_MIN_DELAY for reconnectMinDelay.
+func FlagEnvName(name string) string {
+	var b strings.Builder
+	b.WriteString(flagEnvPrefix)
+	prev := rune(0)
+	for _, r := range name {
+		switch {
+		case r == '-':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// ApplyEnvironment sets each flag not already set from its environment
+// variable, if present.
+func ApplyEnvironment(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	set := setFlags(fs)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := FlagEnvName(f.Name)
+		if value, found := lookupEnv(name); found {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("environment variable %s: %v", name, e)
+			}
+		}
+	})
+	return err
+}
+
+// ApplyFileFlags sets each flag not already set from the config file's
+// flags section.  Names which are not flags are an error, as is naming
+// the config file itself.
+func ApplyFileFlags(fs *flag.FlagSet, values map[string]string, configFileFlag string) error {
+	set := setFlags(fs)
+	for name, value := range values {
+		if name == configFileFlag {
+			return fmt.Errorf("flags: %s cannot be set in the config file", name)
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("flags: unknown flag '%s'", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("flags: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// FlagUsage returns a function for flag.Usage which also lists the
+// environment variable for each flag, and the order of precedence.
+func FlagUsage(fs *flag.FlagSet) func() {
+	return func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		fmt.Fprintf(out, "\nEach flag may also be set by an environment variable, or in the \"flags\"\n")
+		fmt.Fprintf(out, "section of the config file.  The command line takes precedence over the\n")
+		fmt.Fprintf(out, "environment, which takes precedence over the config file.\n\n")
+		fs.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(out, "  -%s: %s\n", f.Name, FlagEnvName(f.Name))
+		})
+	}
+}
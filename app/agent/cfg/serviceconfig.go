@@ -53,9 +53,13 @@ type ServiceConfig struct {
 	Namespaces []serviceNamespace          `yaml:"namespaces,omitempty"`
 }
 
+// serviceNamespace limits a kubernetes endpoint to the listed namespaces.
+// Cluster-scoped requests, such as listing nodes, are refused unless
+// AllowClusterScoped is set.
 type serviceNamespace struct {
-	Name       string   `yaml:"name"`
-	Namespaces []string `yaml:"namespaces"`
+	Name               string   `yaml:"name"`
+	Namespaces         []string `yaml:"namespaces"`
+	AllowClusterScoped bool     `yaml:"allowClusterScoped,omitempty"`
 }
 
 // AgentServiceConfig defines a service level configuration top-level list.
@@ -0,0 +1,180 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"sync"
+
+	"github.com/opsmx/oes-birger/app/agent/cfg"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// responseChunks holds the buffers HTTP response bodies are read into, and
+// limits how many chunks of each response may wait to be sent.
+var responseChunks = newChunkPool(cfg.DefaultResponseChunkSize, cfg.DefaultResponseChunksInFlight)
+
+// chunkPool reuses fixed-size buffers for response body chunks.  A buffer
+// may be returned once the message holding it has been sent, as gRPC has
+// serialized the message by then.
+type chunkPool struct {
+	size     int
+	inFlight int
+	pool     sync.Pool
+
+	// windows holds, by transaction ID, the window of each response whose
+	// body is being queued.
+	windows struct {
+		sync.Mutex
+		m map[string]*responseWindow
+	}
+}
+
+// responseWindow holds a slot for each of a response's chunks waiting to
+// be sent.  While the controller has paused the response, resumed is a
+// channel closed when it continues.
+type responseWindow struct {
+	slots   chan struct{}
+	resumed chan struct{}
+}
+
+func newChunkPool(size int, inFlight int) *chunkPool {
+	p := &chunkPool{size: size, inFlight: inFlight}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	p.windows.m = make(map[string]*responseWindow)
+	return p
+}
+
+// get returns a buffer of the pool's size.
+func (p *chunkPool) get() []byte {
+	return *(p.pool.Get().(*[]byte))
+}
+
+// put returns buf to the pool.  Buffers which did not come from the pool
+// are ignored.
+func (p *chunkPool) put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+// reserve blocks until another chunk of the response for id may be
+// queued, which is once the response is not paused and fewer than
+// inFlight of its chunks are waiting to be sent.
+func (p *chunkPool) reserve(id string) {
+	p.windows.Lock()
+	w, ok := p.windows.m[id]
+	if !ok {
+		w = &responseWindow{slots: make(chan struct{}, p.inFlight)}
+		p.windows.m[id] = w
+	}
+	resumed := w.resumed
+	p.windows.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+	w.slots <- struct{}{}
+}
+
+// finish forgets the window for id, once its last chunk is queued.
+func (p *chunkPool) finish(id string) {
+	p.windows.Lock()
+	defer p.windows.Unlock()
+	delete(p.windows.m, id)
+}
+
+// pause stops further chunks of the response for id being queued until it
+// is resumed.  Responses which are not being queued are ignored.
+func (p *chunkPool) pause(id string) {
+	p.windows.Lock()
+	defer p.windows.Unlock()
+	if w, ok := p.windows.m[id]; ok && w.resumed == nil {
+		w.resumed = make(chan struct{})
+	}
+}
+
+// resume lets the response for id continue after a pause.
+func (p *chunkPool) resume(id string) {
+	p.windows.Lock()
+	defer p.windows.Unlock()
+	if w, ok := p.windows.m[id]; ok && w.resumed != nil {
+		close(w.resumed)
+		w.resumed = nil
+	}
+}
+
+// flowControl pauses or resumes a response as the controller asks.
+func (p *chunkPool) flowControl(fc *tunnel.HttpFlowControl) {
+	if fc.Paused {
+		p.pause(fc.Id)
+	} else {
+		p.resume(fc.Id)
+	}
+}
+
+// streaming returns the number of responses whose body is still being
+// queued.
+func (p *chunkPool) streaming() int {
+	p.windows.Lock()
+	defer p.windows.Unlock()
+	return len(p.windows.m)
+}
+
+// paused returns the number of responses the controller has paused.
+func (p *chunkPool) paused() int {
+	p.windows.Lock()
+	defer p.windows.Unlock()
+	n := 0
+	for _, w := range p.windows.m {
+		if w.resumed != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// sent frees the window slot held by a chunked response once it has been
+// sent, or discarded.
+func (p *chunkPool) sent(m *tunnel.AgentToControllerWrapper) {
+	chunk := m.GetHttpChunkedResponse()
+	if chunk == nil || len(chunk.Body) == 0 {
+		return
+	}
+	p.windows.Lock()
+	w, ok := p.windows.m[chunk.Id]
+	p.windows.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case <-w.slots:
+	default:
+	}
+}
+
+// release frees the window slot and returns the buffer held by a sent
+// chunked response to the pool.
+func (p *chunkPool) release(m *tunnel.AgentToControllerWrapper) {
+	p.sent(m)
+	if chunk := m.GetHttpChunkedResponse(); chunk != nil {
+		p.put(chunk.Body)
+	}
+}
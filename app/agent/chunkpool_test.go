@@ -0,0 +1,263 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestChunkPool(t *testing.T) {
+	p := newChunkPool(16, 4)
+
+	buf := p.get()
+	if len(buf) != 16 {
+		t.Fatalf("expected a 16 byte buffer, got %d", len(buf))
+	}
+	p.release(makeChunkedResponse("id1", buf[:3]))
+	if got := p.get(); len(got) != 16 {
+		t.Errorf("expected a released buffer to be restored to 16 bytes, got %d", len(got))
+	}
+
+	// Buffers of the wrong size, and other messages, are ignored.
+	p.put(make([]byte, 8))
+	p.release(makeChunkedResponse("id1", emptyBytes))
+	p.release(makeBadGatewayResponse("id1"))
+	for i := 0; i < 4; i++ {
+		if got := p.get(); len(got) != 16 {
+			t.Errorf("expected a 16 byte buffer, got %d", len(got))
+		}
+	}
+}
+
+func TestSendHTTPResponse_chunks(t *testing.T) {
+	saved := responseChunks
+	responseChunks = newChunkPool(4, 4)
+	defer func() { responseChunks = saved }()
+
+	body := []byte("0123456789")
+	httpResponse := &http.Response{StatusCode: 200, ContentLength: -1, Body: ioutil.NopCloser(bytes.NewReader(body))}
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	sendHTTPResponse(&tunnel.HttpRequest{Id: "id1"}, httpResponse, dataflow)
+	close(dataflow)
+
+	if (<-dataflow).GetHttpResponse() == nil {
+		t.Fatalf("expected HttpResponse first")
+	}
+	got := []byte{}
+	chunks := 0
+	for msg := range dataflow {
+		chunk := msg.GetHttpChunkedResponse().Body
+		if len(chunk) > 4 {
+			t.Errorf("chunk of %d bytes exceeds the configured size", len(chunk))
+		}
+		got = append(got, chunk...)
+		chunks++
+		responseChunks.release(msg)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("expected body '%s', got '%s'", body, got)
+	}
+	if chunks != 4 {
+		t.Errorf("expected 3 data chunks and an end marker, got %d messages", chunks)
+	}
+}
+
+func TestSendHTTPResponse_coalesce(t *testing.T) {
+	pr, pw := io.Pipe()
+	httpResponse := &http.Response{StatusCode: 200, ContentLength: -1, Body: pr}
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	go sendHTTPResponse(&tunnel.HttpRequest{Id: "id1"}, httpResponse, dataflow)
+	if (<-dataflow).GetHttpResponse() == nil {
+		t.Fatalf("expected HttpResponse first")
+	}
+
+	// Small writes are sent together once the flush interval passes, even
+	// though the body is still open.
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := pw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case msg := <-dataflow:
+		if got := string(msg.GetHttpChunkedResponse().Body); got != "abc" {
+			t.Errorf("expected one chunk 'abc', got '%s'", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the chunk to be flushed")
+	}
+
+	_ = pw.Close()
+	if body := (<-dataflow).GetHttpChunkedResponse().Body; len(body) != 0 {
+		t.Errorf("expected an end marker, got '%s'", body)
+	}
+}
+
+func TestSendHTTPResponse_window(t *testing.T) {
+	saved := responseChunks
+	responseChunks = newChunkPool(4, 2)
+	defer func() { responseChunks = saved }()
+
+	body := []byte("0123456789abcdefghij")
+	httpResponse := &http.Response{StatusCode: 200, ContentLength: -1, Body: ioutil.NopCloser(bytes.NewReader(body))}
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	done := make(chan struct{})
+	go func() {
+		sendHTTPResponse(&tunnel.HttpRequest{Id: "id1"}, httpResponse, dataflow)
+		close(done)
+	}()
+
+	// Only the headers and two chunks are queued until one is sent.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dataflow) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(dataflow); n != 3 {
+		t.Fatalf("expected 3 messages queued, got %d", n)
+	}
+
+	got := []byte{}
+	for {
+		select {
+		case msg := <-dataflow:
+			if chunk := msg.GetHttpChunkedResponse(); chunk != nil {
+				got = append(got, chunk.Body...)
+			}
+			responseChunks.release(msg)
+			continue
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the response")
+		}
+		break
+	}
+	for len(dataflow) > 0 {
+		got = append(got, (<-dataflow).GetHttpChunkedResponse().Body...)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("expected body '%s', got '%s'", body, got)
+	}
+}
+
+func TestSendHTTPResponse_pause(t *testing.T) {
+	saved := responseChunks
+	responseChunks = newChunkPool(4, 4)
+	defer func() { responseChunks = saved }()
+
+	pr, pw := io.Pipe()
+	httpResponse := &http.Response{StatusCode: 200, ContentLength: -1, Body: pr}
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	go sendHTTPResponse(&tunnel.HttpRequest{Id: "id1"}, httpResponse, dataflow)
+	if (<-dataflow).GetHttpResponse() == nil {
+		t.Fatalf("expected HttpResponse first")
+	}
+
+	write := func(s string) {
+		if _, err := pw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func() *tunnel.AgentToControllerWrapper {
+		select {
+		case msg := <-dataflow:
+			responseChunks.release(msg)
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a chunk")
+		}
+		return nil
+	}
+
+	write("0123")
+	if got := string(next().GetHttpChunkedResponse().Body); got != "0123" {
+		t.Fatalf("expected chunk '0123', got '%s'", got)
+	}
+
+	responseChunks.flowControl(&tunnel.HttpFlowControl{Id: "id1", Paused: true})
+	if n := responseChunks.paused(); n != 1 {
+		t.Errorf("expected 1 paused response, got %d", n)
+	}
+	write("4567")
+	select {
+	case msg := <-dataflow:
+		t.Fatalf("expected nothing sent while paused, got %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	responseChunks.flowControl(&tunnel.HttpFlowControl{Id: "id1"})
+	if got := string(next().GetHttpChunkedResponse().Body); got != "4567" {
+		t.Errorf("expected chunk '4567' once resumed, got '%s'", got)
+	}
+	_ = pw.Close()
+	if body := next().GetHttpChunkedResponse().Body; len(body) != 0 {
+		t.Errorf("expected an end marker, got '%s'", body)
+	}
+
+	// Responses no longer being sent are ignored.
+	deadline := time.Now().Add(5 * time.Second)
+	for responseChunks.streaming() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	responseChunks.pause("id1")
+	if n := responseChunks.paused(); n != 0 {
+		t.Errorf("expected no paused responses, got %d", n)
+	}
+}
+
+// benchmarkSendHTTPResponse streams 1MB responses, returning each chunk's
+// buffer to the pool as the tunnel would if release is set.
+func benchmarkSendHTTPResponse(b *testing.B, release bool) {
+	body := make([]byte, 1024*1024)
+	req := &tunnel.HttpRequest{Id: "id1"}
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dataflow := make(chan *tunnel.AgentToControllerWrapper, 20)
+		done := make(chan struct{})
+		go func() {
+			for msg := range dataflow {
+				if release {
+					responseChunks.release(msg)
+				} else {
+					responseChunks.sent(msg)
+				}
+			}
+			close(done)
+		}()
+		httpResponse := &http.Response{StatusCode: 200, ContentLength: -1, Body: ioutil.NopCloser(bytes.NewReader(body))}
+		sendHTTPResponse(req, httpResponse, dataflow)
+		close(dataflow)
+		<-done
+	}
+}
+
+func BenchmarkSendHTTPResponse_pooled(b *testing.B) {
+	benchmarkSendHTTPResponse(b, true)
+}
+
+func BenchmarkSendHTTPResponse_unpooled(b *testing.B) {
+	benchmarkSendHTTPResponse(b, false)
+}
@@ -19,18 +19,28 @@ package main
 import (
 	"fmt"
 	"io"
-	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/opsmx/oes-birger/app/agent/cfg"
 	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 	"golang.org/x/net/context"
 )
 
-func outputSender(channel tunnel.ChannelDirection, c chan *outputMessage, in io.Reader) {
+// outputSender copies from in to c until EOF or an error, and then sends
+// a single closed message and returns.  Nothing more is read while window
+// is full.
+func outputSender(channel tunnel.ChannelDirection, c chan *outputMessage, in io.Reader, window *outputWindow, wg *sync.WaitGroup) {
+	defer wg.Done()
 	buffer := make([]byte, 10240)
 	for {
-		n, err := in.Read(buffer)
+		n, err := in.Read(buffer[:window.wait(len(buffer))])
+		window.record(n)
 		if n > 0 {
 			// we need to copy the underlying data, since we will re-use it.
 			tmp := make([]byte, n)
@@ -42,13 +52,137 @@ func outputSender(channel tunnel.ChannelDirection, c chan *outputMessage, in io.
 			return
 		}
 		if err != nil {
-			log.Printf("Got %v in read", err)
+			util.Warnf("Got %v in read", err)
 			c <- &outputMessage{channel: channel, value: emptyBytes, closed: true}
 			return
 		}
 	}
 }
 
+// allowedCommand is a command request resolved against the agent's
+// command allowlist.
+type allowedCommand struct {
+	path        string
+	arguments   []string
+	environment []string
+	dir         string
+	umask       int
+	setUmask    bool
+}
+
+// resolveCommand looks up the requested command by name.  Only commands
+// listed in the configuration may run, with the configured arguments
+// first, and only the allowed environment variables from the request are
+// added to the baseline environment.
+func resolveCommand(c *cfg.AgentConfig, req *tunnel.CommandRequest) (*allowedCommand, error) {
+	command, found := c.AllowedCommands[req.Name]
+	if !found {
+		return nil, fmt.Errorf("command '%s' is not allowed", req.Name)
+	}
+	arguments := make([]string, 0, len(command.Arguments)+len(req.Arguments))
+	arguments = append(arguments, command.Arguments...)
+	arguments = append(arguments, req.Arguments...)
+	umask, setUmask, err := command.ParseUmask()
+	if err != nil {
+		return nil, err
+	}
+	ret := &allowedCommand{
+		path:        command.Path,
+		arguments:   arguments,
+		environment: filterEnvironment(req.Environment, command.Environment, c.CommandEnvironment),
+		umask:       umask,
+		setUmask:    setUmask,
+	}
+	if req.WorkingDirectory != "" {
+		dir, err := resolveWorkingDirectory(c.CommandDirectories, req.WorkingDirectory)
+		if err != nil {
+			return nil, err
+		}
+		ret.dir = dir
+	}
+	return ret, nil
+}
+
+// resolveWorkingDirectory checks path is a directory within dirs, even
+// once symlinks are followed, and returns it with the symlinks resolved.
+func resolveWorkingDirectory(dirs []string, path string) (string, error) {
+	if len(dirs) == 0 {
+		return "", fmt.Errorf("commands may not be given a working directory")
+	}
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return "", fmt.Errorf("working directory '%s' must be a clean absolute path", path)
+	}
+	if !withinAnyDirectory(dirs, path) {
+		return "", fmt.Errorf("working directory '%s' is not in a directory commands may run in", path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("working directory '%s' does not exist", path)
+	}
+	if err != nil {
+		return "", err
+	}
+	resolvedDirs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if d, err := filepath.EvalSymlinks(dir); err == nil {
+			resolvedDirs = append(resolvedDirs, d)
+		}
+	}
+	if !withinAnyDirectory(resolvedDirs, resolved) {
+		return "", fmt.Errorf("working directory '%s' leads outside the directories commands may run in", path)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("working directory '%s' is not a directory", path)
+	}
+	return resolved, nil
+}
+
+// umaskLock is held while any process is started, and the process umask is
+// only changed while it is held, so commands started at the same time
+// cannot see each other's.
+var umaskLock sync.Mutex
+
+// startProcess starts cmd with the agent's own umask.
+func startProcess(cmd *exec.Cmd) error {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	return cmd.Start()
+}
+
+// startWithUmask starts cmd with the given umask.  The umask belongs to the
+// whole agent process, so it is only changed for as long as Start() takes.
+func startWithUmask(cmd *exec.Cmd, umask int) error {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	old := syscall.Umask(umask)
+	defer syscall.Umask(old)
+	return cmd.Start()
+}
+
+// filterEnvironment returns the baseline followed by the NAME=value
+// entries from requested whose names are allowed.
+func filterEnvironment(requested []string, allowed []string, baseline []string) []string {
+	ret := make([]string, 0, len(baseline)+len(requested))
+	ret = append(ret, baseline...)
+	for _, env := range requested {
+		i := strings.Index(env, "=")
+		if i <= 0 {
+			continue
+		}
+		for _, name := range allowed {
+			if env[:i] == name {
+				ret = append(ret, env)
+				break
+			}
+		}
+	}
+	return ret
+}
+
 type outputMessage struct {
 	channel tunnel.ChannelDirection
 	value   []byte
@@ -73,6 +207,20 @@ func makeCommandFailed(req *tunnel.CommandRequest, err error, message string) *t
 	}
 }
 
+// makeCommandRejected reports a command which the agent will not run, using
+// the shell's exit code for a command which cannot be executed.
+func makeCommandRejected(req *tunnel.CommandRequest, err error) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_CommandTermination{
+			CommandTermination: &tunnel.CommandTermination{
+				Id:       req.Id,
+				ExitCode: 126,
+				Message:  fmt.Sprintf("Agent: %v", err),
+			},
+		},
+	}
+}
+
 func makeCommandTermination(req *tunnel.CommandRequest, exitstatus int) *tunnel.AgentToControllerWrapper {
 	return &tunnel.AgentToControllerWrapper{
 		Event: &tunnel.AgentToControllerWrapper_CommandTermination{
@@ -84,6 +232,22 @@ func makeCommandTermination(req *tunnel.CommandRequest, exitstatus int) *tunnel.
 	}
 }
 
+// exitCancelled is the exit code reported for a cancelled command, as a
+// shell does for one killed by SIGINT.
+const exitCancelled = 130
+
+func makeCommandCancelled(req *tunnel.CommandRequest) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_CommandTermination{
+			CommandTermination: &tunnel.CommandTermination{
+				Id:       req.Id,
+				ExitCode: exitCancelled,
+				Message:  "Agent: command cancelled",
+			},
+		},
+	}
+}
+
 func makeCommandData(req *tunnel.CommandRequest, channel tunnel.ChannelDirection, data []byte) *tunnel.AgentToControllerWrapper {
 	return &tunnel.AgentToControllerWrapper{
 		Event: &tunnel.AgentToControllerWrapper_CommandData{
@@ -108,21 +272,51 @@ func makeCommandDataClosed(req *tunnel.CommandRequest, channel tunnel.ChannelDir
 	}
 }
 
-func runCommand(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.CommandRequest) {
+// runCommand runs the allowed command, sending its output and exit status to
+// dataflow.  If stdin is not nil, it supplies the command's standard input
+// and is always drained, even if the command cannot be started.  If window
+// is not nil, output is only read while it has room.
+func runCommand(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.CommandRequest, command *allowedCommand, stdin chan []byte, window *outputWindow) {
+	logger := util.LogWith("transaction", req.Id, "command", req.Name)
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	registerCancelFunction(req.Id, cancel)
 	defer unregisterCancelFunction(req.Id)
+	defer cancelCommandStdin(req.Id)
+	defer closeCommandOutputWindow(req.Id)
+
+	// Once cancelled, no more acks will come, as the command-tool may have
+	// gone away, so the output is read without waiting for them.
+	go func() {
+		<-ctx.Done()
+		window.close()
+	}()
 
-	log.Printf("Got command request: %v", req)
+	logger.Debugf("Got command request: %s", req.LogString())
 
 	// aggregation channel, for stdout and stderr to be send through.
 	agg := make(chan *outputMessage)
 
-	cmd := exec.CommandContext(ctx, req.Name, req.Arguments...)
-	cmd.Env = req.Environment
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	// The command runs in its own process group, so cancelling kills any
+	// children it started as well.
+	cmd := exec.Command(command.path, command.arguments...)
+	cmd.Env = command.environment
+	cmd.Dir = command.dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 65534, Gid: 65534}
 
+	// Wait closes the stdin pipe when the command exits, so the pump can
+	// never be left blocked writing to a command which has gone away.
+	if stdin != nil {
+		stdinWriter, err := cmd.StdinPipe()
+		if err != nil {
+			go writePump(stdin, nil)
+			dataflow <- makeCommandFailed(req, err, "StdinPipe()")
+			return
+		}
+		go writePump(stdin, stdinWriter)
+	}
+
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		dataflow <- makeCommandFailed(req, err, "StdoutPipe()")
@@ -135,10 +329,11 @@ func runCommand(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.Comm
 		return
 	}
 
-	go outputSender(tunnel.ChannelDirection_STDOUT, agg, stdout)
-	go outputSender(tunnel.ChannelDirection_STDERR, agg, stderr)
-
-	err = cmd.Start()
+	if command.setUmask {
+		err = startWithUmask(cmd, command.umask)
+	} else {
+		err = startProcess(cmd)
+	}
 	if err != nil {
 		// this path will occur if the command can't be found.  Other errors
 		// are possible, but this is most likely.
@@ -146,38 +341,66 @@ func runCommand(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.Comm
 		return
 	}
 
-	activeCount := 2
+	exited := make(chan struct{})
+	go killOnCancel(ctx, exited, cmd.Process.Pid, logger)
+
+	// The senders are only started once the command is running, and agg
+	// is closed once both have finished, so neither can be left blocked.
+	var senders sync.WaitGroup
+	senders.Add(2)
+	go outputSender(tunnel.ChannelDirection_STDOUT, agg, stdout, window, &senders)
+	go outputSender(tunnel.ChannelDirection_STDERR, agg, stderr, window, &senders)
+	go func() {
+		senders.Wait()
+		close(agg)
+	}()
+
 	for msg := range agg {
 		if msg.closed {
-			log.Printf("Channel %d closed", msg.channel)
+			logger.Debugf("Channel %d closed", msg.channel)
 			dataflow <- makeCommandDataClosed(req, msg.channel)
-			activeCount--
-			if activeCount == 0 {
-				break
-			}
 		} else {
 			dataflow <- makeCommandData(req, msg.channel, msg.value)
 		}
 	}
 
-	log.Printf("Command closed both stdin and stdout.")
+	logger.Debugf("Command closed both stdin and stdout.")
 
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	close(exited)
+	if ctx.Err() != nil {
+		logger.Infof("Command cancelled")
+		dataflow <- makeCommandCancelled(req)
+		return
+	}
+	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
-			log.Printf("exited with code != 0")
+			logger.Debugf("exited with code != 0")
 			// The program has exited with an exit code != 0
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				log.Printf("Captured exit code %d", status.ExitStatus())
+				logger.Debugf("Captured exit code %d", status.ExitStatus())
 				dataflow <- makeCommandTermination(req, status.ExitStatus())
 				return
 			}
-			log.Printf("Could not retrieve exit code.")
+			logger.Warnf("Could not retrieve exit code.")
 		} else {
 			dataflow <- makeCommandFailed(req, err, "Wait()")
 			return
 		}
 	}
 
-	log.Printf("Exit code 0")
+	logger.Debugf("Exit code 0")
 	dataflow <- makeCommandTermination(req, 0)
 }
+
+// killOnCancel kills the process group pgid if ctx is cancelled before
+// exited is closed.
+func killOnCancel(ctx context.Context, exited chan struct{}, pgid int, logger *util.Logger) {
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			logger.Warnf("Unable to kill process group %d: %v", pgid, err)
+		}
+	}
+}
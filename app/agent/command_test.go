@@ -0,0 +1,406 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/agent/cfg"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// runCommands runs the command n times, draining and discarding its output.
+func runCommands(t *testing.T, n int, name string, args ...string) {
+	for i := 0; i < n; i++ {
+		dataflow := make(chan *tunnel.AgentToControllerWrapper)
+		done := make(chan struct{})
+		go func() {
+			for range dataflow {
+			}
+			close(done)
+		}()
+		runCommand(dataflow, &tunnel.CommandRequest{
+			Id:   fmt.Sprintf("cmd-%d", i),
+			Name: name,
+		}, &allowedCommand{path: name, arguments: args}, nil, nil)
+		close(dataflow)
+		<-done
+	}
+}
+
+// settledGoroutines gives exiting goroutines a chance to finish before
+// counting them.
+func settledGoroutines() int {
+	n := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		time.Sleep(10 * time.Millisecond)
+		m := runtime.NumGoroutine()
+		if m == n {
+			return m
+		}
+		n = m
+	}
+	return n
+}
+
+func TestRunCommand_noGoroutineLeak(t *testing.T) {
+	tests := []struct {
+		name     string
+		needRoot bool
+		command  string
+		args     []string
+	}{
+		{"start fails", false, "/nonexistent/command", nil},
+		{"runs", true, "/bin/sh", []string{"-c", "echo out; echo err >&2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// commands are run as nobody, which requires root
+			if tt.needRoot && os.Geteuid() != 0 {
+				t.Skip("must be root to run commands")
+			}
+			runCommands(t, 10, tt.command, tt.args...)
+			before := settledGoroutines()
+			runCommands(t, 300, tt.command, tt.args...)
+			after := settledGoroutines()
+			if after > before+5 {
+				t.Errorf("goroutines grew from %d to %d", before, after)
+			}
+		})
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	c := &cfg.AgentConfig{
+		AllowedCommands: map[string]cfg.AllowedCommand{
+			"sh": {Path: "/bin/sh"},
+			"kubectl": {
+				Path:        "/usr/local/bin/kubectl",
+				Arguments:   []string{"--kubeconfig", "/app/config/kubeconfig"},
+				Environment: []string{"KUBECTL_TIMEOUT"},
+			},
+		},
+		CommandEnvironment: []string{"PATH=/usr/bin:/bin"},
+	}
+	tests := []struct {
+		name    string
+		req     *tunnel.CommandRequest
+		want    *allowedCommand
+		wantErr bool
+	}{
+		{
+			"allowed",
+			&tunnel.CommandRequest{Name: "sh", Arguments: []string{"-c", "true"}},
+			&allowedCommand{path: "/bin/sh", arguments: []string{"-c", "true"}, environment: []string{"PATH=/usr/bin:/bin"}},
+			false,
+		},
+		{
+			"argument prefix and environment",
+			&tunnel.CommandRequest{
+				Name:        "kubectl",
+				Arguments:   []string{"get", "pods"},
+				Environment: []string{"KUBECTL_TIMEOUT=5s", "LD_PRELOAD=/tmp/evil.so", "PATH=/tmp"},
+			},
+			&allowedCommand{
+				path:        "/usr/local/bin/kubectl",
+				arguments:   []string{"--kubeconfig", "/app/config/kubeconfig", "get", "pods"},
+				environment: []string{"PATH=/usr/bin:/bin", "KUBECTL_TIMEOUT=5s"},
+			},
+			false,
+		},
+		{"unknown", &tunnel.CommandRequest{Name: "bash"}, nil, true},
+		{"empty", &tunnel.CommandRequest{Name: ""}, nil, true},
+		{"absolute path", &tunnel.CommandRequest{Name: "/bin/sh"}, nil, true},
+		{"relative path", &tunnel.CommandRequest{Name: "./sh"}, nil, true},
+		{"parent traversal", &tunnel.CommandRequest{Name: "../../bin/sh"}, nil, true},
+		{"traversal back to an allowed name", &tunnel.CommandRequest{Name: "sh/../sh"}, nil, true},
+		{"allowed path as name", &tunnel.CommandRequest{Name: "/usr/local/bin/kubectl"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveCommand(c, tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveCommand() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeCommandRejected(t *testing.T) {
+	c := &cfg.AgentConfig{}
+	req := &tunnel.CommandRequest{Id: "cmd-1", Name: "../bin/sh"}
+	_, err := resolveCommand(c, req)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	termination := makeCommandRejected(req, err).GetCommandTermination()
+	if termination.Id != "cmd-1" || termination.ExitCode != 126 {
+		t.Errorf("expected exit code 126 for cmd-1, got %d for %s", termination.ExitCode, termination.Id)
+	}
+	want := "Agent: command '../bin/sh' is not allowed"
+	if termination.Message != want {
+		t.Errorf("expected message '%s', got '%s'", want, termination.Message)
+	}
+}
+
+func TestRunCommand_cancel(t *testing.T) {
+	// commands are run as nobody, which requires root
+	if os.Geteuid() != 0 {
+		t.Skip("must be root to run commands")
+	}
+
+	// The background sleep holds stdout open, so the command only finishes
+	// if its whole process group is killed.
+	req := &tunnel.CommandRequest{Id: "cmd-cancel", Name: "/bin/sh"}
+	command := &allowedCommand{path: "/bin/sh", arguments: []string{"-c", "echo started; sleep 60 & sleep 60"}}
+
+	dataflow := make(chan *tunnel.AgentToControllerWrapper)
+	go runCommand(dataflow, req, command, nil, nil)
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-dataflow:
+			if data := msg.GetCommandData(); data != nil && len(data.Body) > 0 {
+				callCancelFunction(req.Id)
+			}
+			if termination := msg.GetCommandTermination(); termination != nil {
+				if termination.ExitCode != exitCancelled {
+					t.Errorf("expected exit code %d, got %d", exitCancelled, termination.ExitCode)
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatalf("command was not stopped")
+		}
+	}
+}
+
+func TestRunCommand_outputWindow(t *testing.T) {
+	// commands are run as nobody, which requires root
+	if os.Geteuid() != 0 {
+		t.Skip("must be root to run commands")
+	}
+
+	req := &tunnel.CommandRequest{Id: "cmd-window", Name: "/bin/sh", Window: 1000}
+	command := &allowedCommand{path: "/bin/sh", arguments: []string{"-c", "head -c 100000 /dev/zero"}}
+	window := commandOutputWindow(req)
+	dataflow := make(chan *tunnel.AgentToControllerWrapper)
+	go runCommand(dataflow, req, command, nil, window)
+
+	// receive reads output until want bytes in total have arrived, and
+	// then checks no more arrives for a while.
+	total := 0
+	receive := func(want int) {
+		t.Helper()
+		deadline := time.After(10 * time.Second)
+		quiet := time.After(time.Hour)
+		for {
+			select {
+			case msg := <-dataflow:
+				if termination := msg.GetCommandTermination(); termination != nil {
+					t.Fatalf("command ended early: %v", termination)
+				}
+				total += len(msg.GetCommandData().GetBody())
+				if total > want {
+					t.Fatalf("received %d bytes, want only %d", total, want)
+				}
+				if total == want {
+					quiet = time.After(100 * time.Millisecond)
+				}
+			case <-quiet:
+				return
+			case <-deadline:
+				t.Fatalf("received %d bytes, want %d", total, want)
+			}
+		}
+	}
+	receive(1000)
+	ackCommandOutput(&tunnel.CommandAck{Id: req.Id, Consumed: 1000})
+	receive(2000)
+
+	// Once cancelled, as when the command-tool goes away, the command
+	// finishes without waiting for acks.
+	callCancelFunction(req.Id)
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-dataflow:
+			if termination := msg.GetCommandTermination(); termination != nil {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("command did not finish after being cancelled")
+		}
+	}
+}
+
+func TestResolveWorkingDirectory(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "work")
+	if err := os.MkdirAll(filepath.Join(allowed, "build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "secret"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(allowed, "output.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "secret"), filepath.Join(allowed, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(allowed, "build"), filepath.Join(allowed, "latest")); err != nil {
+		t.Fatal(err)
+	}
+	dirs := []string{allowed}
+
+	tests := []struct {
+		name    string
+		dirs    []string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"base directory", dirs, allowed, allowed, false},
+		{"subdirectory", dirs, filepath.Join(allowed, "build"), filepath.Join(allowed, "build"), false},
+		{"symlink within", dirs, filepath.Join(allowed, "latest"), filepath.Join(allowed, "build"), false},
+		{"symlink escape", dirs, filepath.Join(allowed, "escape"), "", true},
+		{"outside", dirs, filepath.Join(root, "secret"), "", true},
+		{"parent traversal", dirs, allowed + "/../secret", "", true},
+		{"relative", dirs, "work/build", "", true},
+		{"missing", dirs, filepath.Join(allowed, "missing"), "", true},
+		{"not a directory", dirs, filepath.Join(allowed, "output.txt"), "", true},
+		{"none allowed", nil, allowed, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveWorkingDirectory(tt.dirs, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveWorkingDirectory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveWorkingDirectory() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCommand_workingDirectoryAndUmask(t *testing.T) {
+	dir := t.TempDir()
+	c := &cfg.AgentConfig{
+		AllowedCommands: map[string]cfg.AllowedCommand{
+			"make": {Path: "/usr/bin/make", Umask: "027"},
+		},
+		CommandDirectories: []string{dir},
+	}
+	got, err := resolveCommand(c, &tunnel.CommandRequest{Name: "make", WorkingDirectory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.dir != dir || !got.setUmask || got.umask != 027 {
+		t.Errorf("resolveCommand() = %#v, want dir %s and umask 027", got, dir)
+	}
+
+	// A rejected directory is reported as the command being rejected.
+	req := &tunnel.CommandRequest{Id: "cmd-1", Name: "make", WorkingDirectory: "/etc"}
+	_, err = resolveCommand(c, req)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	termination := makeCommandRejected(req, err).GetCommandTermination()
+	want := "Agent: working directory '/etc' is not in a directory commands may run in"
+	if termination.ExitCode != 126 || termination.Message != want {
+		t.Errorf("got exit code %d and message '%s', want 126 and '%s'", termination.ExitCode, termination.Message, want)
+	}
+}
+
+func TestRunCommand_workingDirectoryAndUmask(t *testing.T) {
+	// commands are run as nobody, which requires root
+	if os.Geteuid() != 0 {
+		t.Skip("must be root to run commands")
+	}
+
+	// nobody must be able to enter the directory.
+	dir, err := ioutil.TempDir("", "command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &tunnel.CommandRequest{Id: "cmd-dir", Name: "/bin/sh"}
+	command := &allowedCommand{path: "/bin/sh", arguments: []string{"-c", "pwd; umask"}, dir: dir, umask: 027, setUmask: true}
+	dataflow := make(chan *tunnel.AgentToControllerWrapper)
+	go runCommand(dataflow, req, command, nil, nil)
+
+	var stdout []byte
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-dataflow:
+			if data := msg.GetCommandData(); data != nil && data.Channel == tunnel.ChannelDirection_STDOUT {
+				stdout = append(stdout, data.Body...)
+			}
+			if termination := msg.GetCommandTermination(); termination != nil {
+				if termination.ExitCode != 0 {
+					t.Fatalf("command failed: %v", termination)
+				}
+				want := dir + "\n0027\n"
+				if string(stdout) != want {
+					t.Errorf("got output %q, want %q", stdout, want)
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatalf("command did not finish")
+		}
+	}
+}
+
+// TestStartProcess_umaskLock checks that a process is not started while
+// another command's umask may be in effect.
+func TestStartProcess_umaskLock(t *testing.T) {
+	umaskLock.Lock()
+	started := make(chan error, 1)
+	cmd := exec.Command("/bin/true")
+	go func() { started <- startProcess(cmd) }()
+	select {
+	case <-started:
+		umaskLock.Unlock()
+		t.Fatal("process started while the umask was being changed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	umaskLock.Unlock()
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	_ = cmd.Wait()
+}
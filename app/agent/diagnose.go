@@ -0,0 +1,228 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How long each step of a diagnosis may take.
+const diagnoseStepTimeout = 10 * time.Second
+
+// diagnosis writes the result of each check to out as it is made, and
+// counts those which failed.
+type diagnosis struct {
+	out    io.Writer
+	checks int
+	failed int
+}
+
+func (d *diagnosis) pass(check string, format string, args ...interface{}) {
+	d.checks++
+	fmt.Fprintf(d.out, "OK    %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) fail(check string, err error) {
+	d.checks++
+	d.failed++
+	fmt.Fprintf(d.out, "FAIL  %s: %v\n", check, err)
+}
+
+func (d *diagnosis) skip(check string, reason string) {
+	fmt.Fprintf(d.out, "SKIP  %s: %s\n", check, reason)
+}
+
+// runDiagnosis checks once that the agent can reach the controller and
+// sign in, and that each endpoint's upstream answers.  A report is written
+// to out, and false returned if any check failed.
+func runDiagnosis(ctx context.Context, out io.Writer, address string, dial dialFunc, endpoints []configuredEndpoint) bool {
+	d := &diagnosis{out: out}
+	fmt.Fprintf(out, "Agent %s on %s, controller %s\n", version.String(), hostname, address)
+	tlsConfig, err := diagnoseCertificate(d)
+	if err != nil {
+		d.fail("agent certificate", err)
+	} else {
+		diagnoseController(ctx, d, address, dial, tlsConfig)
+	}
+	diagnoseEndpoints(ctx, d, endpoints)
+	if d.failed > 0 {
+		fmt.Fprintf(out, "%d of %d checks failed\n", d.failed, d.checks)
+		return false
+	}
+	fmt.Fprintf(out, "All %d checks passed\n", d.checks)
+	return true
+}
+
+// diagnoseCertificate loads the agent's certificate, reporting when it
+// expires, and returns the TLS config to connect to the controller with.
+func diagnoseCertificate(d *diagnosis) (*tls.Config, error) {
+	creds, err := loadAgentCredentials(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf := creds.get().Leaf
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("expired %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	tlsConfig, err := controllerTLSConfig(creds)
+	if err != nil {
+		return nil, err
+	}
+	d.pass("agent certificate", "serial %s, expires %s", leaf.SerialNumber, leaf.NotAfter.UTC().Format(time.RFC3339))
+	return tlsConfig, nil
+}
+
+// diagnoseController dials the controller, through its proxy if it has
+// one, completes a TLS handshake, and signs in.  Each step is only tried
+// if the one before it passed.
+func diagnoseController(ctx context.Context, d *diagnosis, address string, dial dialFunc, tlsConfig *tls.Config) {
+	start := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, diagnoseStepTimeout)
+	conn, err := dial(dialCtx, address)
+	cancel()
+	if err != nil {
+		d.fail("connect", err)
+		d.skip("TLS handshake", "not connected")
+		d.skip("sign in", "not connected")
+		return
+	}
+	d.pass("connect", "connected to %s in %s", conn.RemoteAddr(), time.Since(start).Round(time.Millisecond))
+
+	tlsConn := tls.Client(conn, diagnoseTLSConfig(tlsConfig, address))
+	_ = tlsConn.SetDeadline(time.Now().Add(diagnoseStepTimeout))
+	err = tlsConn.Handshake()
+	tlsConn.Close()
+	if err != nil {
+		d.fail("TLS handshake", err)
+		d.skip("sign in", "no TLS session")
+		return
+	}
+	peer := tlsConn.ConnectionState().PeerCertificates[0]
+	d.pass("TLS handshake", "controller certificate %s, expires %s", peer.Subject, peer.NotAfter.UTC().Format(time.RFC3339))
+
+	start = time.Now()
+	if err := diagnoseSignIn(ctx, address, dial, tlsConfig); err != nil {
+		d.fail("sign in", err)
+		return
+	}
+	d.pass("sign in", "controller accepted the agent and answered a ping in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// diagnoseTLSConfig returns tlsConfig with the server name set from
+// address, as gRPC does, unless it is already set.
+func diagnoseTLSConfig(tlsConfig *tls.Config, address string) *tls.Config {
+	c := tlsConfig.Clone()
+	if c.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		c.ServerName = host
+	}
+	return c
+}
+
+// diagnoseSignIn opens a tunnel and waits for the controller to answer a
+// ping.  The hello lists no endpoints, so no requests are routed to the
+// session, but under the "replace" duplicate agent policy the controller
+// will still close any other session of this agent.
+func diagnoseSignIn(ctx context.Context, address string, dial dialFunc, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, diagnoseStepTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, address,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(dial))
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := tunnel.NewAgentTunnelServiceClient(conn).EventTunnel(ctx)
+	if err != nil {
+		return fmt.Errorf("EventTunnel(): %v", err)
+	}
+	hello := &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_AgentHello{
+			AgentHello: &tunnel.AgentHello{
+				Version:   version.String(),
+				Commit:    util.GitCommit,
+				BuildDate: util.BuildDate,
+				Endpoints: []*tunnel.EndpointHealth{},
+				Hostname:  hostname,
+			},
+		},
+	}
+	if err := stream.Send(hello); err != nil {
+		return fmt.Errorf("unable to send hello packet: %v", err)
+	}
+	ping := &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_PingRequest{
+			PingRequest: &tunnel.PingRequest{Ts: uint64(time.Now().UnixNano())},
+		},
+	}
+	if err := stream.Send(ping); err != nil {
+		return fmt.Errorf("unable to send ping: %v", err)
+	}
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("controller closed the connection")
+		}
+		if err != nil {
+			return err
+		}
+		if in.GetPingResponse() != nil {
+			_ = stream.CloseSend()
+			return nil
+		}
+	}
+}
+
+// diagnoseEndpoints probes each configured endpoint's upstream.
+func diagnoseEndpoints(ctx context.Context, d *diagnosis, endpoints []configuredEndpoint) {
+	for _, ep := range endpoints {
+		check := fmt.Sprintf("endpoint %s/%s", ep.Type, ep.Name)
+		if !ep.Configured {
+			d.skip(check, "not configured")
+			continue
+		}
+		prober, ok := ep.instance.(endpointProber)
+		if !ok {
+			d.skip(check, "cannot be probed")
+			continue
+		}
+		start := time.Now()
+		if err := runProbe(ctx, prober); err != nil {
+			d.fail(check, err)
+			continue
+		}
+		d.pass(check, "upstream answered in %s", time.Since(start).Round(time.Millisecond))
+	}
+}
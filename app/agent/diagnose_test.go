@@ -0,0 +1,92 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiagnoseEndpoints(t *testing.T) {
+	var out strings.Builder
+	d := &diagnosis{out: &out}
+	diagnoseEndpoints(context.Background(), d, []configuredEndpoint{
+		{Type: "kubernetes", Name: "k8s", Configured: true, instance: &fakeProber{}},
+		{Type: "jenkins", Name: "j1", Configured: true, instance: &fakeProber{err: errors.New("connection refused")}},
+		{Type: "jenkins", Name: "j2"},
+		{Type: "aws", Name: "a1", Configured: true, instance: &closeCounter{}},
+	})
+	if d.checks != 2 || d.failed != 1 {
+		t.Errorf("checks = %d, failed = %d, want 2 and 1", d.checks, d.failed)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		"OK    endpoint kubernetes/k8s: ",
+		"FAIL  endpoint jenkins/j1: connection refused",
+		"SKIP  endpoint jenkins/j2: not configured",
+		"SKIP  endpoint aws/a1: cannot be probed",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("report is %q", out.String())
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("line %d = %q, want it to start with %q", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestDiagnoseController(t *testing.T) {
+	t.Run("unreachable", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := l.Addr().String()
+		l.Close()
+
+		var out strings.Builder
+		d := &diagnosis{out: &out}
+		diagnoseController(context.Background(), d, address, controllerDialer(nil), &tls.Config{})
+		if d.failed != 1 {
+			t.Errorf("failed = %d, want 1", d.failed)
+		}
+		if !strings.HasPrefix(out.String(), "FAIL  connect: ") || !strings.Contains(out.String(), "SKIP  sign in: not connected") {
+			t.Errorf("unexpected report %q", out.String())
+		}
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		srv := httptest.NewTLSServer(nil)
+		defer srv.Close()
+
+		var out strings.Builder
+		d := &diagnosis{out: &out}
+		diagnoseController(context.Background(), d, srv.Listener.Addr().String(), controllerDialer(nil), &tls.Config{})
+		if d.checks != 2 || d.failed != 1 {
+			t.Errorf("checks = %d, failed = %d, want 2 and 1", d.checks, d.failed)
+		}
+		if !strings.Contains(out.String(), "FAIL  TLS handshake: ") || !strings.Contains(out.String(), "SKIP  sign in: no TLS session") {
+			t.Errorf("unexpected report %q", out.String())
+		}
+	})
+}
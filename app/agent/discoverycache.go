@@ -0,0 +1,264 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+const (
+	defaultDiscoveryCacheTTL = 600
+
+	// discoveryCacheHeader is set to HIT or MISS on discovery responses,
+	// to say whether they came from the cache.  Sent on a request with
+	// the value "invalidate", it empties the cache for the context first.
+	discoveryCacheHeader     = "X-Birger-Cache"
+	discoveryCacheHit        = "HIT"
+	discoveryCacheMiss       = "MISS"
+	discoveryCacheInvalidate = "invalidate"
+
+	// Larger discovery responses are relayed, but not cached.
+	maxDiscoveryCacheBodyBytes = 4 * 1024 * 1024
+)
+
+// discoveryCacheConfig turns on caching of the API discovery responses
+// kubectl fetches before each command.  TTL is in seconds.
+type discoveryCacheConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	TTL     int  `yaml:"ttl,omitempty"`
+}
+
+// discoveryCacheKey identifies a cached response.  The Accept headers are
+// part of it, as newer clients ask for aggregated discovery documents
+// from the same URIs, and the body is kept as the API server encoded it.
+type discoveryCacheKey struct {
+	context        string
+	uri            string
+	accept         string
+	acceptEncoding string
+}
+
+type discoveryCacheEntry struct {
+	status  int32
+	headers []*tunnel.HttpHeader
+	body    []byte
+	expires time.Time
+}
+
+// discoveryCache holds successful discovery responses for each context
+// until they expire.
+type discoveryCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[discoveryCacheKey]*discoveryCacheEntry
+
+	now func() time.Time
+}
+
+func newDiscoveryCache(ttl time.Duration) *discoveryCache {
+	return &discoveryCache{
+		ttl:     ttl,
+		entries: map[discoveryCacheKey]*discoveryCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+// isDiscoveryRequest returns true for a GET of /api, /apis, or the group
+// and version documents below them.
+func isDiscoveryRequest(req *tunnel.HttpRequest) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	path := strings.SplitN(req.URI, "?", 2)[0]
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	switch parts[0] {
+	case "api":
+		return len(parts) <= 2
+	case "apis":
+		return len(parts) <= 3
+	}
+	return false
+}
+
+func makeDiscoveryCacheKey(contextName string, req *tunnel.HttpRequest) discoveryCacheKey {
+	key := discoveryCacheKey{context: contextName, uri: req.URI}
+	for _, h := range req.Headers {
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Accept":
+			key.accept = strings.Join(h.Values, ",")
+		case "Accept-Encoding":
+			key.acceptEncoding = strings.Join(h.Values, ",")
+		}
+	}
+	return key
+}
+
+// wantsInvalidate returns true if the request asks for the cache to be
+// invalidated.
+func wantsInvalidate(req *tunnel.HttpRequest) bool {
+	for _, h := range req.Headers {
+		if http.CanonicalHeaderKey(h.Name) != discoveryCacheHeader {
+			continue
+		}
+		for _, v := range h.Values {
+			if strings.EqualFold(v, discoveryCacheInvalidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (dc *discoveryCache) get(key discoveryCacheKey) (*discoveryCacheEntry, bool) {
+	dc.Lock()
+	defer dc.Unlock()
+	entry, found := dc.entries[key]
+	if !found {
+		return nil, false
+	}
+	if !dc.now().Before(entry.expires) {
+		delete(dc.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (dc *discoveryCache) put(key discoveryCacheKey, entry *discoveryCacheEntry) {
+	dc.Lock()
+	defer dc.Unlock()
+	entry.expires = dc.now().Add(dc.ttl)
+	dc.entries[key] = entry
+}
+
+// invalidate removes every entry for the named context.
+func (dc *discoveryCache) invalidate(contextName string) {
+	dc.Lock()
+	defer dc.Unlock()
+	for key := range dc.entries {
+		if key.context == contextName {
+			delete(dc.entries, key)
+		}
+	}
+}
+
+// clear removes every entry, as when the kubeconfig changes.
+func (dc *discoveryCache) clear() {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.entries = map[discoveryCacheKey]*discoveryCacheEntry{}
+}
+
+// serve sends the cached response for key, if there is one, and returns
+// true if it did.
+func (dc *discoveryCache) serve(key discoveryCacheKey, req *tunnel.HttpRequest, dataflow chan *tunnel.AgentToControllerWrapper) bool {
+	entry, found := dc.get(key)
+	if !found {
+		return false
+	}
+	discoveryCacheRequests.WithLabelValues("hit").Inc()
+	sendDiscoveryResponse(req.Id, entry, discoveryCacheHit, dataflow)
+	return true
+}
+
+// runRequest runs a discovery request upstream, and caches a successful
+// response before relaying it.  Anything else is relayed as usual.
+func (dc *discoveryCache) runRequest(key discoveryCacheKey, client *http.Client, req *tunnel.HttpRequest, httpRequest *http.Request, dataflow chan *tunnel.AgentToControllerWrapper, baseURL string) {
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	logger.Debugf("Sending discovery request: %s to %v", req.Method, baseURL+req.URI)
+	discoveryCacheRequests.WithLabelValues("miss").Inc()
+	start := time.Now()
+	httpResponse, err := client.Do(httpRequest)
+	upstreamLatency.WithLabelValues(req.Type).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logger.Warnf("Failed to execute request for %s to %s: %v", req.Method, baseURL+req.URI, err)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
+		return
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		sendHTTPResponse(req, httpResponse, dataflow)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(httpResponse.Body, maxDiscoveryCacheBodyBytes+1))
+	if err != nil {
+		httpResponse.Body.Close()
+		logger.Warnf("Failed to read response for %s to %s: %v", req.Method, baseURL+req.URI, err)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
+		return
+	}
+	if len(body) > maxDiscoveryCacheBodyBytes {
+		httpResponse.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), httpResponse.Body), httpResponse.Body}
+		sendHTTPResponse(req, httpResponse, dataflow)
+		return
+	}
+	httpResponse.Body.Close()
+
+	entry := &discoveryCacheEntry{
+		status:  int32(httpResponse.StatusCode),
+		headers: makeHeaders(httpResponse.Header),
+		body:    body,
+	}
+	dc.put(key, entry)
+	sendDiscoveryResponse(req.Id, entry, discoveryCacheMiss, dataflow)
+}
+
+// sendDiscoveryResponse sends a cached response, with its headers marked
+// to say where it came from.  The entry is shared, so is not modified.
+func sendDiscoveryResponse(id string, entry *discoveryCacheEntry, result string, dataflow chan *tunnel.AgentToControllerWrapper) {
+	headers := make([]*tunnel.HttpHeader, 0, len(entry.headers)+1)
+	headers = append(headers, entry.headers...)
+	headers = append(headers, &tunnel.HttpHeader{Name: discoveryCacheHeader, Values: []string{result}})
+	dataflow <- &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+			HttpResponse: &tunnel.HttpResponse{
+				Id:            id,
+				Status:        entry.status,
+				ContentLength: int64(len(entry.body)),
+				Headers:       headers,
+			},
+		},
+	}
+	if len(entry.body) == 0 {
+		return
+	}
+	for body := entry.body; len(body) > 0; {
+		n := len(body)
+		if n > responseChunks.size {
+			n = responseChunks.size
+		}
+		dataflow <- makeChunkedResponse(id, body[:n])
+		body = body[n:]
+	}
+	dataflow <- makeChunkedResponse(id, emptyBytes)
+}
@@ -0,0 +1,193 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestIsDiscoveryRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		uri    string
+		want   bool
+	}{
+		{"GET", "/api", true},
+		{"GET", "/api/v1", true},
+		{"GET", "/apis", true},
+		{"GET", "/apis/apps", true},
+		{"GET", "/apis/apps/v1", true},
+		{"GET", "/apis/apps/v1?timeout=32s", true},
+		{"GET", "/api/v1/pods", false},
+		{"GET", "/apis/apps/v1/deployments", false},
+		{"GET", "/apis//v1", false},
+		{"GET", "/version", false},
+		{"GET", "/", false},
+		{"POST", "/api", false},
+	}
+	for _, tt := range tests {
+		req := &tunnel.HttpRequest{Method: tt.method, URI: tt.uri}
+		if got := isDiscoveryRequest(req); got != tt.want {
+			t.Errorf("isDiscoveryRequest(%s %s) = %v, want %v", tt.method, tt.uri, got, tt.want)
+		}
+	}
+}
+
+// discoveryResponse is the headers and body of a response read from a
+// dataflow.
+type discoveryResponse struct {
+	status  int32
+	headers map[string][]string
+	body    string
+}
+
+func runDiscoveryRequest(t *testing.T, ke *KubernetesEndpoint, uri string, headers ...*tunnel.HttpHeader) discoveryResponse {
+	t.Helper()
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 100)
+	req := &tunnel.HttpRequest{Id: "id1", Type: "kubernetes", Name: "k8s", Method: "GET", URI: uri, Headers: headers}
+	ke.executeHTTPRequest(dataflow, req, http.NoBody)
+	close(dataflow)
+	msg := <-dataflow
+	resp := msg.GetHttpResponse()
+	if resp == nil {
+		t.Fatalf("%s: expected an HttpResponse, got %v", uri, msg.Event)
+	}
+	ret := discoveryResponse{status: resp.Status, headers: map[string][]string{}}
+	for _, h := range resp.Headers {
+		ret.headers[h.Name] = h.Values
+	}
+	var body strings.Builder
+	for msg := range dataflow {
+		body.Write(msg.GetHttpChunkedResponse().Body)
+	}
+	ret.body = body.String()
+	return ret
+}
+
+func TestKubernetesEndpoint_discoveryCache(t *testing.T) {
+	var lock sync.Mutex
+	upstreamHits := map[string]int{}
+	var cacheHeaders []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		upstreamHits[r.URL.Path]++
+		cacheHeaders = append(cacheHeaders, r.Header.Values(discoveryCacheHeader)...)
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Audit-Id", "upstream")
+		if r.URL.Path == "/apis/missing/v1" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	defer srv.Close()
+
+	ke := &KubernetesEndpoint{
+		config:    kubernetesConfig{MaxIdleConnsPerHost: 1, IdleConnTimeout: 30},
+		discovery: newDiscoveryCache(time.Minute),
+	}
+	now := time.Now()
+	ke.discovery.now = func() time.Time { return now }
+	kcs := &kubeContexts{
+		current:  "ctx1",
+		contexts: map[string]*kubeContext{"ctx1": {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}}},
+	}
+	ke.attachClients(kcs, nil)
+	ke.f = *kcs
+
+	hits := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		n := 0
+		for _, count := range upstreamHits {
+			n += count
+		}
+		return n
+	}
+	cacheHits := testutil.ToFloat64(discoveryCacheRequests.WithLabelValues("hit"))
+
+	// The requests kubectl makes before a command, and the command itself.
+	burst := []string{"/api", "/apis", "/api/v1", "/apis/apps/v1", "/apis/missing/v1", "/api/v1/namespaces/default/pods"}
+	for i := 0; i < 3; i++ {
+		for _, uri := range burst {
+			resp := runDiscoveryRequest(t, ke, uri)
+			if want := `{"path":"` + uri + `"}`; resp.body != want {
+				t.Errorf("%s: body = %q, want %q", uri, resp.body, want)
+			}
+			if uri == "/apis/missing/v1" && resp.status != http.StatusNotFound {
+				t.Errorf("%s: status = %d, want 404", uri, resp.status)
+			}
+			if resp.headers["Content-Type"][0] != "application/json" || resp.headers["Audit-Id"][0] != "upstream" {
+				t.Errorf("%s: upstream headers not kept: %v", uri, resp.headers)
+			}
+			want := ""
+			switch {
+			case uri == "/apis/missing/v1" || !isDiscoveryRequest(&tunnel.HttpRequest{Method: "GET", URI: uri}):
+			case i == 0:
+				want = discoveryCacheMiss
+			default:
+				want = discoveryCacheHit
+			}
+			if got := strings.Join(resp.headers[discoveryCacheHeader], ","); got != want {
+				t.Errorf("pass %d: %s: %s = %q, want %q", i, uri, discoveryCacheHeader, got, want)
+			}
+		}
+	}
+	// Without the cache, each pass would send all six upstream.
+	if got, want := hits(), 6+2+2; got != want {
+		t.Errorf("upstream requests = %d, want %d: %v", got, want, upstreamHits)
+	}
+	if got := testutil.ToFloat64(discoveryCacheRequests.WithLabelValues("hit")) - cacheHits; got != 8 {
+		t.Errorf("cache hit metric increased by %v, want 8", got)
+	}
+
+	// Different Accept headers are cached separately.
+	resp := runDiscoveryRequest(t, ke, "/apis", &tunnel.HttpHeader{Name: "Accept", Values: []string{"application/json;g=apidiscovery.k8s.io;v=v2"}})
+	if resp.headers[discoveryCacheHeader][0] != discoveryCacheMiss {
+		t.Errorf("a new Accept header was served from the cache")
+	}
+
+	// Invalidating sends the request upstream again, without the header.
+	before := hits()
+	resp = runDiscoveryRequest(t, ke, "/api", &tunnel.HttpHeader{Name: discoveryCacheHeader, Values: []string{"invalidate"}})
+	if resp.headers[discoveryCacheHeader][0] != discoveryCacheMiss || hits() != before+1 {
+		t.Errorf("invalidating did not refetch /api")
+	}
+	if len(cacheHeaders) != 0 {
+		t.Errorf("%s was sent upstream: %v", discoveryCacheHeader, cacheHeaders)
+	}
+	if resp := runDiscoveryRequest(t, ke, "/apis"); resp.headers[discoveryCacheHeader][0] != discoveryCacheMiss {
+		t.Errorf("/apis was not invalidated")
+	}
+
+	// Entries expire after the TTL.
+	now = now.Add(time.Minute)
+	before = hits()
+	if resp := runDiscoveryRequest(t, ke, "/api/v1"); resp.headers[discoveryCacheHeader][0] != discoveryCacheMiss || hits() != before+1 {
+		t.Errorf("expired entry was served")
+	}
+}
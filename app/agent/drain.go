@@ -0,0 +1,177 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How long to wait for the controller to close the stream after the agent
+// has closed its side at the end of a drain.
+const drainCloseTimeout = 5 * time.Second
+
+var (
+	// errDrained is returned by runTunnel when it ended because of a drain.
+	errDrained = errors.New("agent drained")
+
+	errAgentDraining = errors.New("agent is shutting down")
+)
+
+// drainer is started when the agent is asked to shut down.  Once it is,
+// a tunnel refuses new requests, and closes once those in progress finish.
+type drainer struct {
+	once      sync.Once
+	requested chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{requested: make(chan struct{})}
+}
+
+// start begins the drain.  It may be called more than once.
+func (d *drainer) start() {
+	d.once.Do(func() { close(d.requested) })
+}
+
+// started returns a channel which is closed once the drain begins.
+func (d *drainer) started() <-chan struct{} {
+	return d.requested
+}
+
+// runningRequests counts the requests running on every tunnel.
+var runningRequests int64
+
+// requestTracker records the requests a tunnel is running, so a drain can
+// wait for them, and those still running when it closes can be stopped
+// without touching another tunnel's.  Once closed, no more may be added.
+type requestTracker struct {
+	sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	running map[string]bool
+}
+
+// add records a new request, returning false if the tracker is closed.
+func (t *requestTracker) add(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.running == nil {
+		t.running = map[string]bool{}
+	}
+	t.running[id] = true
+	t.wg.Add(1)
+	atomic.AddInt64(&runningRequests, 1)
+	return true
+}
+
+func (t *requestTracker) done(id string) {
+	t.Lock()
+	delete(t.running, id)
+	t.Unlock()
+	atomic.AddInt64(&runningRequests, -1)
+	t.wg.Done()
+}
+
+// ids returns the requests still running.
+func (t *requestTracker) ids() []string {
+	t.Lock()
+	defer t.Unlock()
+	ret := make([]string, 0, len(t.running))
+	for id := range t.running {
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+func (t *requestTracker) isClosed() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.closed
+}
+
+// close stops any more requests being added, and returns a channel which
+// is closed once those already running are done.
+func (t *requestTracker) close() <-chan struct{} {
+	t.Lock()
+	t.closed = true
+	t.Unlock()
+	idle := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(idle)
+	}()
+	return idle
+}
+
+// drainTunnel refuses new requests, and waits up to grace for those in
+// progress to send their final responses.  The sending side of the stream
+// is then closed, and it waits briefly for the controller to close the
+// stream.  If the stream fails first, its error is returned; otherwise
+// errDrained.  Anything still running when it returns is cancelled by
+// runTunnel.
+func drainTunnel(dataflow chan *tunnel.AgentToControllerWrapper, requests *requestTracker, errc chan error, grace time.Duration) error {
+	util.Infof("Draining: refusing new requests, and waiting up to %s for those in progress", grace)
+	idle := requests.close()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case err := <-errc:
+		return err
+	case <-idle:
+		util.Infof("Draining: all requests finished")
+	case <-timer.C:
+		util.Warnf("Draining: requests still in progress after %s will be cancelled", grace)
+	}
+
+	// Everything queued before this is sent before the stream is closed.
+	dataflow <- nil
+	select {
+	case <-errc:
+	case <-time.After(drainCloseTimeout):
+		util.Warnf("Draining: controller did not close the stream after %s", drainCloseTimeout)
+	}
+	return errDrained
+}
+
+// refuseDraining refuses a request because the agent is shutting down.
+func refuseDraining(dataflow chan *tunnel.AgentToControllerWrapper, id string) {
+	requestsRefusedDraining.Inc()
+	dataflow <- makeDrainingResponse(id)
+}
+
+func makeDrainingResponse(id string) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpError{
+			HttpError: &tunnel.HttpError{
+				Id:       id,
+				Status:   http.StatusServiceUnavailable,
+				Message:  errAgentDraining.Error(),
+				Draining: true,
+			},
+		},
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestRequestTracker(t *testing.T) {
+	requests := &requestTracker{}
+	if !requests.add("r1") {
+		t.Fatalf("add() = false before close")
+	}
+	if ids := requests.ids(); len(ids) != 1 || ids[0] != "r1" {
+		t.Errorf("ids() = %v, want [r1]", ids)
+	}
+	idle := requests.close()
+	if !requests.isClosed() {
+		t.Errorf("isClosed() = false after close")
+	}
+	if requests.add("r2") {
+		t.Errorf("add() = true after close")
+	}
+	select {
+	case <-idle:
+		t.Fatalf("idle before the running request finished")
+	case <-time.After(10 * time.Millisecond):
+	}
+	requests.done("r1")
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatalf("not idle after the running request finished")
+	}
+	if ids := requests.ids(); len(ids) != 0 {
+		t.Errorf("ids() = %v after the request finished", ids)
+	}
+}
+
+func TestDrainer(t *testing.T) {
+	d := newDrainer()
+	select {
+	case <-d.started():
+		t.Fatalf("started before start()")
+	default:
+	}
+	d.start()
+	d.start()
+	select {
+	case <-d.started():
+	default:
+		t.Fatalf("not started after start()")
+	}
+}
+
+func TestDrainTunnel(t *testing.T) {
+	errStream := errors.New("stream failed")
+	tests := []struct {
+		name      string
+		finish    bool
+		grace     time.Duration
+		failWith  error
+		want      error
+		wantClose bool
+	}{
+		{"requests finish", true, time.Minute, nil, errDrained, true},
+		{"grace period passes", false, 10 * time.Millisecond, nil, errDrained, true},
+		{"stream fails", false, time.Minute, errStream, errStream, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataflow := make(chan *tunnel.AgentToControllerWrapper, 1)
+			errc := make(chan error, 1)
+			requests := &requestTracker{}
+			requests.add("r1")
+			if tt.finish {
+				requests.done("r1")
+			}
+			if tt.failWith != nil {
+				errc <- tt.failWith
+			}
+
+			done := make(chan error)
+			go func() { done <- drainTunnel(dataflow, requests, errc, tt.grace) }()
+
+			if tt.wantClose {
+				select {
+				case ew := <-dataflow:
+					if ew != nil {
+						t.Fatalf("expected the close sentinel, got %v", ew)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("stream was not closed")
+				}
+				// The controller closes its side in response.
+				errc <- errors.New("EOF")
+			}
+			select {
+			case err := <-done:
+				if err != tt.want {
+					t.Errorf("drainTunnel() = %v, want %v", err, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("drainTunnel did not return")
+			}
+			if !requests.isClosed() {
+				t.Errorf("requests still accepted after drainTunnel")
+			}
+		})
+	}
+}
+
+func TestMakeDrainingResponse(t *testing.T) {
+	ew := makeDrainingResponse("id1")
+	e := ew.GetHttpError()
+	if e == nil {
+		t.Fatalf("expected an HttpError, got %v", ew)
+	}
+	if e.Id != "id1" || e.Status != http.StatusServiceUnavailable || !e.Draining {
+		t.Errorf("unexpected response %v", e)
+	}
+}
+
+// fakeTunnelClient records what the agent sends on the tunnel.
+type fakeTunnelClient struct {
+	grpc.ClientStream
+	sent   []*tunnel.AgentToControllerWrapper
+	closed bool
+}
+
+func (f *fakeTunnelClient) Send(ew *tunnel.AgentToControllerWrapper) error {
+	if f.closed {
+		return errors.New("send after CloseSend")
+	}
+	f.sent = append(f.sent, ew)
+	return nil
+}
+
+func (f *fakeTunnelClient) Recv() (*tunnel.ControllerToAgentWrapper, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeTunnelClient) CloseSend() error {
+	f.closed = true
+	return nil
+}
+
+func TestDataflowHandler_closeSend(t *testing.T) {
+	stream := &fakeTunnelClient{}
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 3)
+	errc := make(chan error, 1)
+	dataflow <- makeDrainingResponse("id1")
+	dataflow <- nil
+	dataflow <- makeDrainingResponse("id2")
+	close(dataflow)
+
+	dataflowHandler(dataflow, stream, errc)
+
+	if !stream.closed {
+		t.Errorf("CloseSend was not called")
+	}
+	if len(stream.sent) != 1 || stream.sent[0].GetHttpError().Id != "id1" {
+		t.Errorf("expected only the message before the sentinel to be sent, got %v", stream.sent)
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("unexpected error %v", err)
+	default:
+	}
+}
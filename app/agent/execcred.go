@@ -0,0 +1,172 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/kubeconfig"
+)
+
+// How long an exec plugin may run before it is abandoned.
+const execCredentialTimeout = 30 * time.Second
+
+// Tokens are refreshed this long before they expire, so a request does not
+// reach the API server just as its token expires.
+const execCredentialExpirySkew = 10 * time.Second
+
+// The ExecCredential API versions we can exchange with a plugin.
+var execCredentialAPIVersions = map[string]bool{
+	"client.authentication.k8s.io/v1alpha1": true,
+	"client.authentication.k8s.io/v1beta1":  true,
+	"client.authentication.k8s.io/v1":       true,
+}
+
+// execCredential obtains a bearer token by running a kubeconfig exec
+// plugin, such as `aws eks get-token`, and caches it until it expires.
+type execCredential struct {
+	sync.Mutex
+	contextName string
+	config      kubeconfig.ExecConfig
+	token       string
+	expiry      time.Time // zero if the token does not expire
+
+	run func(ctx context.Context, config *kubeconfig.ExecConfig) ([]byte, error)
+	now func() time.Time
+}
+
+func newExecCredential(contextName string, config kubeconfig.ExecConfig) (*execCredential, error) {
+	if config.Command == "" {
+		return nil, fmt.Errorf("exec plugin has no command")
+	}
+	if !execCredentialAPIVersions[config.APIVersion] {
+		return nil, fmt.Errorf("exec plugin apiVersion '%s' is not supported", config.APIVersion)
+	}
+	return &execCredential{
+		contextName: contextName,
+		config:      config,
+		run:         runExecPlugin,
+		now:         time.Now,
+	}, nil
+}
+
+// Token returns the cached token, running the plugin for a new one if
+// there is none or it is about to expire.  If the plugin fails, the
+// context is marked unhealthy and an error is returned.
+func (ec *execCredential) Token() (string, error) {
+	ec.Lock()
+	defer ec.Unlock()
+	if ec.token != "" && (ec.expiry.IsZero() || ec.now().Add(execCredentialExpirySkew).Before(ec.expiry)) {
+		return ec.token, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execCredentialTimeout)
+	defer cancel()
+	token, expiry, err := ec.fetch(ctx)
+	if err != nil {
+		kubernetesContextHealthy.WithLabelValues(ec.contextName).Set(0)
+		ec.token = ""
+		return "", fmt.Errorf("exec plugin %s for context %s: %v", ec.config.Command, ec.contextName, err)
+	}
+	kubernetesContextHealthy.WithLabelValues(ec.contextName).Set(1)
+	ec.token = token
+	ec.expiry = expiry
+	return token, nil
+}
+
+func (ec *execCredential) fetch(ctx context.Context) (string, time.Time, error) {
+	out, err := ec.run(ctx, &ec.config)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return parseExecCredential(ec.config.APIVersion, out)
+}
+
+// execCredentialMessage is the ExecCredential exchanged with a plugin.
+// Only the fields we use are included.
+type execCredentialMessage struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Spec       execCredentialSpec    `json:"spec"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialSpec struct {
+	Interactive bool `json:"interactive"`
+}
+
+type execCredentialStatus struct {
+	Token               string     `json:"token,omitempty"`
+	ExpirationTimestamp *time.Time `json:"expirationTimestamp,omitempty"`
+}
+
+// parseExecCredential returns the token and its expiry, which is zero if
+// there is none, from a plugin's output.
+func parseExecCredential(apiVersion string, out []byte) (string, time.Time, error) {
+	var msg execCredentialMessage
+	if err := json.Unmarshal(out, &msg); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to parse output: %v", err)
+	}
+	if msg.Kind != "ExecCredential" {
+		return "", time.Time{}, fmt.Errorf("returned kind '%s', not 'ExecCredential'", msg.Kind)
+	}
+	if msg.APIVersion != apiVersion {
+		return "", time.Time{}, fmt.Errorf("returned apiVersion '%s', not '%s'", msg.APIVersion, apiVersion)
+	}
+	if msg.Status == nil || msg.Status.Token == "" {
+		return "", time.Time{}, fmt.Errorf("returned no token (client certificates from exec plugins are not supported)")
+	}
+	var expiry time.Time
+	if msg.Status.ExpirationTimestamp != nil {
+		expiry = *msg.Status.ExpirationTimestamp
+	}
+	return msg.Status.Token, expiry, nil
+}
+
+// runExecPlugin runs the plugin non-interactively, returning its output.
+func runExecPlugin(ctx context.Context, config *kubeconfig.ExecConfig) ([]byte, error) {
+	info, err := json.Marshal(execCredentialMessage{APIVersion: config.APIVersion, Kind: "ExecCredential"})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, config.Command, config.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+	for _, e := range config.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = startProcess(cmd)
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
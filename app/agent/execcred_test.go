@@ -0,0 +1,175 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/kubeconfig"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testExecAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+func TestParseExecCredential(t *testing.T) {
+	tests := []struct {
+		name       string
+		out        string
+		wantToken  string
+		wantExpiry time.Time
+		wantErr    string
+	}{
+		{
+			"token with expiry",
+			`{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"abc","expirationTimestamp":"2021-06-01T12:00:00Z"}}`,
+			"abc",
+			time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+			"",
+		},
+		{
+			"token without expiry",
+			`{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"abc"}}`,
+			"abc",
+			time.Time{},
+			"",
+		},
+		{"not JSON", `Unable to locate credentials`, "", time.Time{}, "unable to parse output"},
+		{"wrong kind", `{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"Secret"}`, "", time.Time{}, "returned kind 'Secret'"},
+		{"wrong apiVersion", `{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"abc"}}`, "", time.Time{}, "returned apiVersion"},
+		{
+			"client certificate only",
+			`{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"clientCertificateData":"x","clientKeyData":"y"}}`,
+			"",
+			time.Time{},
+			"returned no token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, expiry, err := parseExecCredential(testExecAPIVersion, []byte(tt.out))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseExecCredential() error = %v, want '%s'", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExecCredential() error = %v", err)
+			}
+			if token != tt.wantToken || !expiry.Equal(tt.wantExpiry) {
+				t.Errorf("parseExecCredential() = %s, %s, want %s, %s", token, expiry, tt.wantToken, tt.wantExpiry)
+			}
+		})
+	}
+}
+
+func TestNewExecCredential(t *testing.T) {
+	if _, err := newExecCredential("ctx", kubeconfig.ExecConfig{APIVersion: testExecAPIVersion}); err == nil {
+		t.Errorf("expected an error for a missing command")
+	}
+	if _, err := newExecCredential("ctx", kubeconfig.ExecConfig{APIVersion: "v2", Command: "aws"}); err == nil {
+		t.Errorf("expected an error for an unsupported apiVersion")
+	}
+}
+
+func TestExecCredential_Token(t *testing.T) {
+	ec, err := newExecCredential("exec-ctx", kubeconfig.ExecConfig{APIVersion: testExecAPIVersion, Command: "plugin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 6, 1, 11, 0, 0, 0, time.UTC)
+	ec.now = func() time.Time { return now }
+	runs := 0
+	var output string
+	var failure error
+	ec.run = func(ctx context.Context, config *kubeconfig.ExecConfig) ([]byte, error) {
+		runs++
+		return []byte(output), failure
+	}
+	healthy := func() float64 { return testutil.ToFloat64(kubernetesContextHealthy.WithLabelValues("exec-ctx")) }
+
+	output = `{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"token1","expirationTimestamp":"2021-06-01T12:00:00Z"}}`
+	steps := []struct {
+		name        string
+		at          time.Time
+		output      string
+		failure     error
+		wantToken   string
+		wantErr     bool
+		wantRuns    int
+		wantHealthy float64
+	}{
+		{"first use runs the plugin", now, output, nil, "token1", false, 1, 1},
+		{"cached", now.Add(30 * time.Minute), output, nil, "token1", false, 1, 1},
+		{"about to expire", now.Add(time.Hour - 5*time.Second), output, errors.New("no credentials"), "", true, 2, 0},
+		{
+			"recovers",
+			now.Add(time.Hour),
+			`{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"token2"}}`,
+			nil,
+			"token2",
+			false,
+			3,
+			1,
+		},
+		{"never expires", now.Add(100 * time.Hour), "", nil, "token2", false, 3, 1},
+	}
+	for _, s := range steps {
+		now = s.at
+		output = s.output
+		failure = s.failure
+		token, err := ec.Token()
+		if (err != nil) != s.wantErr || token != s.wantToken {
+			t.Errorf("%s: Token() = %s, %v, want %s, error %v", s.name, token, err, s.wantToken, s.wantErr)
+		}
+		if runs != s.wantRuns {
+			t.Errorf("%s: expected %d runs, got %d", s.name, s.wantRuns, runs)
+		}
+		if got := healthy(); got != s.wantHealthy {
+			t.Errorf("%s: expected healthy %g, got %g", s.name, s.wantHealthy, got)
+		}
+	}
+}
+
+func TestRunExecPlugin(t *testing.T) {
+	config := &kubeconfig.ExecConfig{
+		APIVersion: testExecAPIVersion,
+		Command:    "/bin/sh",
+		Args:       []string{"-c", `echo "$KUBERNETES_EXEC_INFO" | grep -q '"kind":"ExecCredential"' || exit 1; printf '{"apiVersion":"%s","kind":"ExecCredential","status":{"token":"%s"}}' "$API_VERSION" "$TOKEN"`},
+		Env: []kubeconfig.ExecEnvVar{
+			{Name: "API_VERSION", Value: testExecAPIVersion},
+			{Name: "TOKEN", Value: "from-plugin"},
+		},
+	}
+	out, err := runExecPlugin(context.Background(), config)
+	if err != nil {
+		t.Fatalf("runExecPlugin() error = %v", err)
+	}
+	token, _, err := parseExecCredential(testExecAPIVersion, out)
+	if err != nil || token != "from-plugin" {
+		t.Errorf("expected token 'from-plugin', got '%s', %v", token, err)
+	}
+
+	failing := &kubeconfig.ExecConfig{APIVersion: testExecAPIVersion, Command: "/bin/sh", Args: []string{"-c", "echo expired credentials >&2; exit 1"}}
+	if _, err := runExecPlugin(context.Background(), failing); err == nil || !strings.Contains(err.Error(), "expired credentials") {
+		t.Errorf("expected the plugin's error output, got %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// The largest piece of a file sent in one message.
+const fileChunkSize = 32 * 1024
+
+var errFileCancelled = errors.New("transfer cancelled")
+
+// fileEndpoint returns the endpoint which tells the controller files may
+// be fetched from this agent, or nil if none may.
+func fileEndpoint() *tunnel.EndpointHealth {
+	if config == nil || len(config.FileDirectories) == 0 {
+		return nil
+	}
+	return &tunnel.EndpointHealth{
+		Type:       tunnel.FileEndpointType,
+		Name:       tunnel.FileEndpointName,
+		Configured: true,
+	}
+}
+
+// withinDirectory returns true if path is dir, or anything below it.  Both
+// must be clean.
+func withinDirectory(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func withinAnyDirectory(dirs []string, path string) bool {
+	for _, dir := range dirs {
+		if withinDirectory(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// openAllowedFile opens the regular file at path, if it is in one of dirs.
+// The path must be absolute and clean, so ".." cannot be used to leave the
+// directory, and it is checked again once symlinks are followed, so a
+// symlink cannot be either.  Nothing outside dirs is looked at, so whether
+// a file exists there is not revealed.
+func openAllowedFile(dirs []string, path string) (*os.File, error) {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return nil, fmt.Errorf("path '%s' must be a clean absolute path", path)
+	}
+	if !withinAnyDirectory(dirs, path) {
+		return nil, fmt.Errorf("path '%s' is not in a directory files may be fetched from", path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("path '%s' does not exist", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolvedDirs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if d, err := filepath.EvalSymlinks(dir); err == nil {
+			resolvedDirs = append(resolvedDirs, d)
+		}
+	}
+	if !withinAnyDirectory(resolvedDirs, resolved) {
+		return nil, fmt.Errorf("path '%s' leads outside the directories files may be fetched from", path)
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("path '%s' is not a regular file", path)
+	}
+	return f, nil
+}
+
+func makeFileChunk(req *tunnel.FileRequest, data []byte) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_FileChunk{
+			FileChunk: &tunnel.FileChunk{
+				Id:   req.Id,
+				Body: data,
+			},
+		},
+	}
+}
+
+func makeFileTermination(req *tunnel.FileRequest, size uint64, sum []byte) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_FileTermination{
+			FileTermination: &tunnel.FileTermination{
+				Id:     req.Id,
+				Size:   size,
+				Sha256: sum,
+			},
+		},
+	}
+}
+
+func makeFileFailed(req *tunnel.FileRequest, err error) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_FileTermination{
+			FileTermination: &tunnel.FileTermination{
+				Id:    req.Id,
+				Error: fmt.Sprintf("Agent: %v", err),
+			},
+		},
+	}
+}
+
+// sendFile sends the requested file to dataflow in chunks, followed by its
+// size and SHA-256, or by an error if it may not be fetched or cannot be
+// read.  If window is not nil, the file is only read while it has room.
+func sendFile(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.FileRequest, dirs []string, window *outputWindow) {
+	logger := util.LogWith("transaction", req.Id, "path", req.Path)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerCancelFunction(req.Id, cancel)
+	defer unregisterCancelFunction(req.Id)
+	defer closeCommandOutputWindow(req.Id)
+
+	// Once cancelled, no more acks will come, so nothing should wait for
+	// them.
+	go func() {
+		<-ctx.Done()
+		window.close()
+	}()
+
+	f, err := openAllowedFile(dirs, req.Path)
+	if err != nil {
+		logger.Warnf("Refusing file request: %v", err)
+		dataflow <- makeFileFailed(req, err)
+		return
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	var size uint64
+	buffer := make([]byte, fileChunkSize)
+	for {
+		n, err := f.Read(buffer[:window.wait(len(buffer))])
+		if ctx.Err() != nil {
+			logger.Infof("File transfer cancelled after %d bytes", size)
+			dataflow <- makeFileFailed(req, errFileCancelled)
+			return
+		}
+		window.record(n)
+		if n > 0 {
+			tmp := make([]byte, n)
+			copy(tmp, buffer[:n])
+			hash.Write(tmp)
+			size += uint64(n)
+			dataflow <- makeFileChunk(req, tmp)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warnf("File transfer failed after %d bytes: %v", size, err)
+			dataflow <- makeFileFailed(req, err)
+			return
+		}
+	}
+	logger.Infof("Sent file, %d bytes", size)
+	dataflow <- makeFileTermination(req, size, hash.Sum(nil))
+}
@@ -0,0 +1,183 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// makeFileTree returns a directory holding an allowed directory, with a
+// file, a subdirectory, and a symlink leading out of it, and a secret file
+// outside it.
+func makeFileTree(t *testing.T) (string, string) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "allowed")
+	for _, dir := range []string{allowed, filepath.Join(allowed, "sub")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(allowed, "build.log"):      "log",
+		filepath.Join(allowed, "sub", "app.jar"): "jar",
+		filepath.Join(root, "secret"):            "secret",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "secret"), filepath.Join(allowed, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(allowed, "build.log"), filepath.Join(allowed, "latest.log")); err != nil {
+		t.Fatal(err)
+	}
+	return root, allowed
+}
+
+func TestOpenAllowedFile(t *testing.T) {
+	root, allowed := makeFileTree(t)
+	dirs := []string{allowed}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{"file", filepath.Join(allowed, "build.log"), "log", ""},
+		{"subdirectory", filepath.Join(allowed, "sub", "app.jar"), "jar", ""},
+		{"symlink inside", filepath.Join(allowed, "latest.log"), "log", ""},
+		{"relative", "allowed/build.log", "", "clean absolute path"},
+		{"traversal", allowed + "/../secret", "", "clean absolute path"},
+		{"outside", filepath.Join(root, "secret"), "", "not in a directory"},
+		{"prefix of allowed", allowed + "-other/build.log", "", "not in a directory"},
+		{"symlink outside", filepath.Join(allowed, "escape"), "", "leads outside"},
+		{"missing", filepath.Join(allowed, "missing.log"), "", "does not exist"},
+		{"directory", filepath.Join(allowed, "sub"), "", "not a regular file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := openAllowedFile(dirs, tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("openAllowedFile() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("openAllowedFile() = %v", err)
+			}
+			defer f.Close()
+			got, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789"), fileChunkSize/4)
+	path := filepath.Join(dir, "artifact.tgz")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+		req := &tunnel.FileRequest{Id: "file-ok", Path: path}
+		sendFile(dataflow, req, []string{dir}, nil)
+		close(dataflow)
+		var got []byte
+		var result *tunnel.FileTermination
+		for msg := range dataflow {
+			if chunk := msg.GetFileChunk(); chunk != nil {
+				if len(chunk.Body) > fileChunkSize {
+					t.Errorf("chunk of %d bytes, want at most %d", len(chunk.Body), fileChunkSize)
+				}
+				got = append(got, chunk.Body...)
+			}
+			if term := msg.GetFileTermination(); term != nil {
+				result = term
+			}
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("received %d bytes, not the file's %d", len(got), len(content))
+		}
+		sum := sha256.Sum256(content)
+		if result == nil || result.Error != "" || result.Size != uint64(len(content)) || !bytes.Equal(result.Sha256, sum[:]) {
+			t.Errorf("termination = %v, want size %d and SHA-256 %x", result, len(content), sum)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+		req := &tunnel.FileRequest{Id: "file-refused", Path: "/etc/passwd"}
+		sendFile(dataflow, req, []string{dir}, nil)
+		msg := <-dataflow
+		if term := msg.GetFileTermination(); term == nil || term.Error == "" {
+			t.Errorf("expected a failed termination, got %v", msg)
+		}
+	})
+
+	t.Run("tunnel closed mid-transfer", func(t *testing.T) {
+		dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+		req := &tunnel.FileRequest{Id: "file-cut", Path: path, Window: fileChunkSize}
+		window := fileOutputWindow(req)
+		done := make(chan struct{})
+		go func() {
+			sendFile(dataflow, req, []string{dir}, window)
+			close(done)
+		}()
+
+		// The first chunk fills the window, so nothing more is sent
+		// until the tunnel closes.
+		if msg := <-dataflow; msg.GetFileChunk() == nil {
+			t.Fatalf("expected a chunk, got %v", msg)
+		}
+		select {
+		case msg := <-dataflow:
+			t.Fatalf("sent %v with the window full", msg)
+		case <-time.After(20 * time.Millisecond):
+		}
+		failRequest(req.Id)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("transfer not stopped when the tunnel closed")
+		}
+		msg := <-dataflow
+		if term := msg.GetFileTermination(); term == nil || !strings.Contains(term.Error, errFileCancelled.Error()) {
+			t.Errorf("expected a cancelled termination, got %v", msg)
+		}
+	})
+}
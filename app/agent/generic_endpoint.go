@@ -17,25 +17,32 @@ package main
  */
 
 import (
-	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/opsmx/oes-birger/pkg/secrets"
 	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 	"golang.org/x/net/context"
 	"gopkg.in/yaml.v3"
 )
 
+// genericEndpointCredentials are added to each request.  The "header"
+// type sends the token as the value of HeaderName, such as the
+// X-JFrog-Art-Api header used by Artifactory.
 type genericEndpointCredentials struct {
 	Type       string `yaml:"type,omitempty"`
 	Username   string `yaml:"username,omitempty"`
 	Password   string `yaml:"password,omitempty"`
 	Token      string `yaml:"token,omitempty"`
+	HeaderName string `yaml:"headerName,omitempty"`
 	SecretName string `yaml:"secretName,omitempty"`
 
 	rawUsername string `yaml:"-"`
@@ -43,9 +50,16 @@ type genericEndpointCredentials struct {
 	rawToken    string `yaml:"-"`
 }
 
+// genericEndpointConfig is the per-service configuration.  The server's
+// certificate is verified against the system roots, or against the CA in
+// caCertFile or caCert64 (base64 PEM) if either is set.  ServerName, if
+// set, overrides the name sent in SNI and checked against the certificate.
 type genericEndpointConfig struct {
 	URL         string                     `yaml:"url,omitempty"`
 	Insecure    bool                       `yaml:"insecure,omitempty"`
+	CACertFile  string                     `yaml:"caCertFile,omitempty"`
+	CACert64    string                     `yaml:"caCert64,omitempty"`
+	ServerName  string                     `yaml:"serverName,omitempty"`
 	Credentials genericEndpointCredentials `yaml:"credentials,omitempty"`
 }
 
@@ -55,6 +69,9 @@ type GenericEndpoint struct {
 	endpointType string
 	endpointName string
 	config       genericEndpointConfig
+
+	// client is shared by all requests, so upstream connections are reused.
+	client *http.Client
 }
 
 func (ep *GenericEndpoint) loadSecrets(secretsLoader secrets.SecretLoader) error {
@@ -98,6 +115,16 @@ func (ep *GenericEndpoint) loadBase64Secrets() error {
 		}
 		ep.config.Credentials.rawToken = string(rawToken)
 		return nil
+	case "header":
+		if token == "" || ep.config.Credentials.HeaderName == "" {
+			return fmt.Errorf("headerName or token missing for credential type 'header'")
+		}
+		rawToken, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return err
+		}
+		ep.config.Credentials.rawToken = string(rawToken)
+		return nil
 	default:
 		return fmt.Errorf("unknown credential type %s", ep.config.Credentials.Type)
 	}
@@ -140,6 +167,15 @@ func (ep *GenericEndpoint) loadKubernetesSecrets(secretsLoader secrets.SecretLoa
 		}
 		ep.config.Credentials.rawToken = string(token)
 		return nil
+	case "header":
+		if ep.config.Credentials.HeaderName == "" {
+			return fmt.Errorf("header: headerName missing")
+		}
+		if !hasToken {
+			return fmt.Errorf("header: token missing in secret")
+		}
+		ep.config.Credentials.rawToken = string(token)
+		return nil
 	default:
 		return fmt.Errorf("unknown or unsupported credential type %s", ep.config.Credentials.Type)
 	}
@@ -159,45 +195,100 @@ func MakeGenericEndpoint(endpointType string, endpointName string, configBytes [
 	}
 	ep.config = config
 
+	if config.Insecure {
+		if err := checkInsecure(fmt.Sprintf("endpoint %s/%s", endpointType, endpointName)); err != nil {
+			return nil, false, err
+		}
+	}
+
 	err = ep.loadSecrets(secretsLoader)
 	if err != nil {
-		log.Printf("Unable to load secret: %v", err)
+		util.Warnf("Unable to load secret: %v", err)
 		return nil, false, nil
 	}
 
 	if ep.config.URL == "" {
-		log.Printf("url not set for %s/%s", endpointType, endpointName)
+		util.Warnf("url not set for %s/%s", endpointType, endpointName)
 		return nil, false, nil
 	}
 
+	client, err := ep.makeClient()
+	if err != nil {
+		util.Warnf("Unable to configure TLS for %s/%s: %v", endpointType, endpointName, err)
+		return nil, false, nil
+	}
+	ep.client = client
+
 	return ep, true, nil
 }
 
-func (ep *GenericEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest) {
-	log.Printf("Running request %v", req)
+// loadCACert returns the configured CA certificate in PEM form, or nil if
+// none is configured.
+func (ep *GenericEndpoint) loadCACert() ([]byte, error) {
+	if ep.config.CACertFile != "" {
+		return ioutil.ReadFile(ep.config.CACertFile)
+	}
+	if ep.config.CACert64 != "" {
+		return base64.StdEncoding.DecodeString(ep.config.CACert64)
+	}
+	return nil, nil
+}
+
+// makeClient builds the HTTP client used for every request to the endpoint.
+func (ep *GenericEndpoint) makeClient() (*http.Client, error) {
 	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: ep.config.Insecure,
+		ServerName:         ep.config.ServerName,
+	}
+	caCert, err := ep.loadCACert()
+	if err != nil {
+		return nil, err
+	}
+	if caCert != nil {
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA certificate")
+		}
+		tlsConfig.RootCAs = caCertPool
 	}
 	tr := &http.Transport{
 		MaxIdleConns:       10,
 		IdleConnTimeout:    30 * time.Second,
 		DisableCompression: true,
 		TLSClientConfig:    tlsConfig,
+		Proxy:              http.ProxyFromEnvironment,
 	}
-	if ep.config.Insecure {
-		tr.TLSClientConfig.InsecureSkipVerify = true
-	}
-	client := &http.Client{
+	return &http.Client{
 		Transport: tr,
+	}, nil
+}
+
+// tlsMode returns the TLS mode of the connection to the endpoint's server.
+func (ep *GenericEndpoint) tlsMode() string {
+	switch {
+	case strings.HasPrefix(ep.config.URL, "http:"):
+		return tunnel.TLSModePlaintext
+	case ep.config.Insecure:
+		return tunnel.TLSModeInsecure
+	case ep.config.CACertFile != "" || ep.config.CACert64 != "" || ep.config.ServerName != "":
+		return tunnel.TLSModeCustom
 	}
+	return tunnel.TLSModeVerified
+}
+
+func (ep *GenericEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, body io.ReadCloser) {
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	defer body.Close()
+	logger.Debugf("Running request %s", req.LogString())
 
 	ctx, cancel := context.WithCancel(context.Background())
 	registerCancelFunction(req.Id, cancel)
 	defer unregisterCancelFunction(req.Id)
 
-	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, ep.config.URL+req.URI, bytes.NewBuffer(req.Body))
+	httpRequest, err := makeUpstreamRequest(ctx, req, ep.config.URL+req.URI, body)
 	if err != nil {
-		log.Printf("Failed to build request for %s to %s: %v", req.Method, ep.config.URL+req.URI, err)
+		logger.Warnf("Failed to build request for %s to %s: %v", req.Method, ep.config.URL+req.URI, err)
 		dataflow <- makeBadGatewayResponse(req.Id)
 		return
 	}
@@ -212,7 +303,9 @@ func (ep *GenericEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToContr
 		httpRequest.Header.Set("Authorization", "Bearer "+creds.rawToken)
 	case "token":
 		httpRequest.Header.Set("Authorization", "Token "+creds.rawToken)
+	case "header":
+		httpRequest.Header.Set(creds.HeaderName, creds.rawToken)
 	}
 
-	runHTTPRequest(client, req, httpRequest, dataflow, ep.config.URL)
+	runHTTPRequest(ep.client, req, httpRequest, dataflow, ep.config.URL)
 }
@@ -17,9 +17,16 @@ package main
  */
 
 import (
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
 )
 
 func makeMap(username *string, password *string, token *string) *map[string][]byte {
@@ -161,6 +168,26 @@ func TestGenericEndpoint_loadBase64Secrets(t *testing.T) {
 			"", "", "",
 			true,
 		},
+
+		// Type 'header'
+		{
+			"credential type header, headerName missing",
+			genericEndpointCredentials{Type: "header", Token: bazString},
+			"", "", "",
+			true,
+		},
+		{
+			"credential type header, token missing",
+			genericEndpointCredentials{Type: "header", HeaderName: "X-JFrog-Art-Api"},
+			"", "", "",
+			true,
+		},
+		{
+			"credential type header, headerName and token set",
+			genericEndpointCredentials{Type: "header", HeaderName: "X-JFrog-Art-Api", Token: bazString},
+			"", "", "baz",
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -254,6 +281,20 @@ func TestGenericEndpoint_loadKubernetesSecrets(t *testing.T) {
 			"", "", "",
 			"bearer: token missing in secret",
 		},
+
+		// Type 'header'
+		{
+			"credential type header, secretName has token",
+			genericEndpointCredentials{Type: "header", HeaderName: "X-JFrog-Art-Api", SecretName: "__t"},
+			"", "", "baz",
+			"",
+		},
+		{
+			"credential type header, headerName missing",
+			genericEndpointCredentials{Type: "header", SecretName: "__t"},
+			"", "", "",
+			"header: headerName missing",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -284,3 +325,112 @@ func TestGenericEndpoint_loadKubernetesSecrets(t *testing.T) {
 		})
 	}
 }
+
+func TestGenericEndpoint_executeHTTPRequest(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		w.Header().Set("X-Test", "yes")
+		fmt.Fprintf(w, "%s %s %s:%s %s", r.Method, r.URL.Path, username, password, r.Header.Get("X-JFrog-Art-Api"))
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(handler))
+	defer tlsServer.Close()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+
+	tests := []struct {
+		name         string
+		endpointType string
+		config       string
+		wantBody     string
+	}{
+		{
+			"jenkins with basic auth",
+			"jenkins",
+			"url: " + server.URL + "\ncredentials:\n  type: basic\n  username: " + fooString + "\n  password: " + barString + "\n",
+			"GET /job/foo foo:bar ",
+		},
+		{
+			"artifactory with header auth and custom CA",
+			"artifactory",
+			"url: " + tlsServer.URL + "\ncaCert64: " + base64.StdEncoding.EncodeToString(caCert) + "\ncredentials:\n  type: header\n  headerName: X-JFrog-Art-Api\n  token: " + bazString + "\n",
+			"GET /job/foo : baz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, configured, err := MakeGenericEndpoint(tt.endpointType, "ep1", []byte(tt.config), &FakeSecretLoader{})
+			if err != nil || !configured {
+				t.Fatalf("MakeGenericEndpoint() configured = %v, err = %v", configured, err)
+			}
+
+			dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+			req := &tunnel.HttpRequest{Id: "id1", Type: tt.endpointType, Name: "ep1", Method: "GET", URI: "/job/foo"}
+			ep.executeHTTPRequest(dataflow, req, ioutil.NopCloser(strings.NewReader("")))
+			close(dataflow)
+
+			response := (<-dataflow).GetHttpResponse()
+			if response == nil {
+				t.Fatalf("expected HttpResponse")
+			}
+			if response.Status != http.StatusOK {
+				t.Errorf("expected status 200, got %d", response.Status)
+			}
+			body := ""
+			for msg := range dataflow {
+				body += string(msg.GetHttpChunkedResponse().Body)
+			}
+			if body != tt.wantBody {
+				t.Errorf("expected body '%s', got '%s'", tt.wantBody, body)
+			}
+		})
+	}
+}
+
+func TestGenericEndpoint_makeClient_badCA(t *testing.T) {
+	config := "url: https://example.com\ncaCert64: " + base64.StdEncoding.EncodeToString([]byte("junk")) + "\n"
+	_, configured, err := MakeGenericEndpoint("jenkins", "ep1", []byte(config), &FakeSecretLoader{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if configured {
+		t.Errorf("expected endpoint with an invalid CA to be unconfigured")
+	}
+}
+
+func TestGenericEndpoint_tlsMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"verified", "url: https://example.com\n", tunnel.TLSModeVerified},
+		{"plaintext", "url: http://example.com\n", tunnel.TLSModePlaintext},
+		{"insecure", "url: https://example.com\ninsecure: true\n", tunnel.TLSModeInsecure},
+		{"server name", "url: https://example.com\nserverName: api.example.com\n", tunnel.TLSModeCustom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, _, err := MakeGenericEndpoint("jenkins", "ep1", []byte(tt.config), &FakeSecretLoader{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := ep.tlsMode(); got != tt.want {
+				t.Errorf("tlsMode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenericEndpoint_neverAllowInsecure(t *testing.T) {
+	*neverAllowInsecure = true
+	defer func() { *neverAllowInsecure = false }()
+
+	_, _, err := MakeGenericEndpoint("jenkins", "ep1", []byte("url: https://example.com\ninsecure: true\n"), &FakeSecretLoader{})
+	if err == nil {
+		t.Fatalf("expected an insecure endpoint to be rejected")
+	}
+	if _, _, err := MakeGenericEndpoint("jenkins", "ep1", []byte("url: https://example.com\n"), &FakeSecretLoader{}); err != nil {
+		t.Errorf("unexpected error for a verified endpoint: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How long a single probe of an endpoint's upstream may take.
+const probeTimeout = 10 * time.Second
+
+// endpointProber is implemented by endpoints which can check that their
+// upstream answers.  Those which do not implement it are always ready.
+type endpointProber interface {
+	probe(ctx context.Context) error
+}
+
+// probeResult is the outcome of the last probe of an endpoint.
+type probeResult struct {
+	at  time.Time
+	err error
+
+	// lastSuccess is when the endpoint last answered.
+	lastSuccess time.Time
+}
+
+// endpointProbes holds the last probe result of each endpoint, by type and
+// name.
+type endpointProbes struct {
+	sync.Mutex
+	results map[string]probeResult
+
+	now func() time.Time
+}
+
+func newEndpointProbes() *endpointProbes {
+	return &endpointProbes{
+		results: map[string]probeResult{},
+		now:     time.Now,
+	}
+}
+
+func probeKey(ep configuredEndpoint) string {
+	return ep.Type + "/" + ep.Name
+}
+
+func (p *endpointProbes) record(ep configuredEndpoint, err error) {
+	p.Lock()
+	defer p.Unlock()
+	key := probeKey(ep)
+	result := p.results[key]
+	result.at = p.now()
+	result.err = err
+	if err == nil {
+		result.lastSuccess = result.at
+	}
+	p.results[key] = result
+}
+
+func (p *endpointProbes) get(ep configuredEndpoint) (probeResult, bool) {
+	p.Lock()
+	defer p.Unlock()
+	result, found := p.results[probeKey(ep)]
+	return result, found
+}
+
+// probeAll probes each configured endpoint once.  Endpoints which share an
+// instance share its result.
+func (p *endpointProbes) probeAll(ctx context.Context, endpoints []configuredEndpoint) {
+	results := map[endpointProber]error{}
+	for _, ep := range endpoints {
+		prober, ok := ep.instance.(endpointProber)
+		if !ok || !ep.Configured {
+			continue
+		}
+		err, done := results[prober]
+		if !done {
+			err = runProbe(ctx, prober)
+			results[prober] = err
+			if err != nil {
+				util.Warnf("Probe of endpoint type %s, name %s failed: %v", ep.Type, ep.Name, err)
+			}
+		}
+		p.record(ep, err)
+	}
+}
+
+func runProbe(ctx context.Context, prober endpointProber) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return prober.probe(ctx)
+}
+
+// run probes the endpoints every interval, and whenever they are replaced,
+// until ctx is done.
+func (p *endpointProbes) run(ctx context.Context, endpoints *endpointTable, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		current, changed := endpoints.get()
+		p.probeAll(ctx, current)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+	}
+}
+
+// endpointReadiness is the state of one endpoint, as reported by /readyz.
+type endpointReadiness struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Ready       bool   `json:"ready"`
+	Error       string `json:"error,omitempty"`
+	LastSuccess string `json:"lastSuccess,omitempty"`
+}
+
+type readiness struct {
+	Ready     bool                `json:"ready"`
+	Connected bool                `json:"connected"`
+	Endpoints []endpointReadiness `json:"endpoints"`
+}
+
+// readiness reports the agent ready if it is connected to the controller,
+// and every configured endpoint which can be probed answered within maxAge.
+func (p *endpointProbes) readiness(connected bool, endpoints []configuredEndpoint, maxAge time.Duration) readiness {
+	ret := readiness{Ready: connected, Connected: connected, Endpoints: []endpointReadiness{}}
+	now := p.now()
+	for _, ep := range endpoints {
+		if _, ok := ep.instance.(endpointProber); !ok || !ep.Configured {
+			continue
+		}
+		state := endpointReadiness{Type: ep.Type, Name: ep.Name}
+		result, found := p.get(ep)
+		switch {
+		case !found:
+			state.Error = "not probed yet"
+		case result.err != nil:
+			state.Error = result.err.Error()
+		case now.Sub(result.lastSuccess) > maxAge:
+			state.Error = fmt.Sprintf("no successful probe since %s", result.lastSuccess.UTC().Format(time.RFC3339))
+		default:
+			state.Ready = true
+		}
+		if !result.lastSuccess.IsZero() {
+			state.LastSuccess = result.lastSuccess.UTC().Format(time.RFC3339)
+		}
+		if !state.Ready {
+			ret.Ready = false
+		}
+		ret.Endpoints = append(ret.Endpoints, state)
+	}
+	return ret
+}
+
+// livenessHandler returns 200 as long as the process is serving.
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"alive":true}`))
+}
+
+// readinessHandler returns 200 while the agent is connected to the
+// controller and its endpoints' upstreams answer, and 503 otherwise.  The
+// body says which check failed.
+func readinessHandler(probes *endpointProbes, endpoints *endpointTable, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ret := probes.readiness(tunnelConnected.IsSet(), endpoints.current(), maxAge)
+		buf, err := json.Marshal(ret)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		if ret.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(buf)
+	}
+}
+
+func runHealthHTTPServer(port uint16, probes *endpointProbes, endpoints *endpointTable, maxAge time.Duration) {
+	util.Infof("Running HTTP listener for health checks on port %d", port)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", livenessHandler)
+	mux.Handle("/readyz", readinessHandler(probes, endpoints, maxAge))
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
+	}
+	util.Fatalf("%v", server.ListenAndServe())
+}
+
+// probeRequest sends req with client, and returns an error if no response
+// arrives, or its status is maxStatus or above.
+func probeRequest(client *http.Client, req *http.Request, maxStatus int) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= maxStatus {
+		return fmt.Errorf("%s returned %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+// probe checks that the server answers.  Any response short of a server
+// error will do, as the base URL may need credentials or not exist.
+func (ep *GenericEndpoint) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.config.URL, nil)
+	if err != nil {
+		return err
+	}
+	return probeRequest(ep.client, req, http.StatusInternalServerError)
+}
+
+// probe fetches /version from the current context's API server, with its
+// credentials, so a credential which no longer works is caught too.
+func (ke *KubernetesEndpoint) probe(ctx context.Context) error {
+	return ke.probeContext(ctx, "")
+}
+
+func (kce *kubernetesContextEndpoint) probe(ctx context.Context) error {
+	return kce.ke.probeContext(ctx, kce.contextName)
+}
+
+func (ke *KubernetesEndpoint) probeContext(ctx context.Context, contextName string) error {
+	req := &tunnel.HttpRequest{Method: http.MethodGet, URI: "/version"}
+	c, httpRequest, err := ke.makeContextRequest(ctx, contextName, req, http.NoBody)
+	if err != nil {
+		return err
+	}
+	return probeRequest(c.client, httpRequest, http.StatusBadRequest)
+}
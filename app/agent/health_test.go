@@ -0,0 +1,202 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// fakeProber returns err from each probe, and counts them.
+type fakeProber struct {
+	err   error
+	calls int
+}
+
+func (p *fakeProber) executeHTTPRequest(chan *tunnel.AgentToControllerWrapper, *tunnel.HttpRequest, io.ReadCloser) {
+}
+
+func (p *fakeProber) probe(ctx context.Context) error {
+	p.calls++
+	return p.err
+}
+
+func TestEndpointProbes_readiness(t *testing.T) {
+	shared := &fakeProber{}
+	failing := &fakeProber{err: errors.New("connection refused")}
+	endpoints := []configuredEndpoint{
+		{Type: "kubernetes", Name: "ns1", Configured: true, instance: shared},
+		{Type: "kubernetes", Name: "ns2", Configured: true, instance: shared},
+		{Type: "jenkins", Name: "j1", Configured: true, instance: failing},
+		{Type: "jenkins", Name: "j2", Configured: false, instance: failing},
+		{Type: "aws", Name: "a1", Configured: true, instance: &closeCounter{}},
+	}
+
+	probes := newEndpointProbes()
+	now := time.Now()
+	probes.now = func() time.Time { return now }
+
+	states := func(r readiness) map[string]bool {
+		ret := map[string]bool{}
+		for _, ep := range r.Endpoints {
+			ret[ep.Type+"/"+ep.Name] = ep.Ready
+		}
+		return ret
+	}
+
+	got := probes.readiness(true, endpoints, time.Minute)
+	if got.Ready || len(got.Endpoints) != 3 || got.Endpoints[0].Error != "not probed yet" {
+		t.Errorf("before probing, readiness = %+v", got)
+	}
+
+	probes.probeAll(context.Background(), endpoints)
+	if shared.calls != 1 || failing.calls != 1 {
+		t.Errorf("probed shared %d times and failing %d times, want once each", shared.calls, failing.calls)
+	}
+	got = probes.readiness(true, endpoints, time.Minute)
+	want := map[string]bool{"kubernetes/ns1": true, "kubernetes/ns2": true, "jenkins/j1": false}
+	if got.Ready || len(states(got)) != len(want) {
+		t.Errorf("with a failing endpoint, readiness = %+v", got)
+	}
+	for name, ready := range want {
+		if states(got)[name] != ready {
+			t.Errorf("%s ready = %v, want %v", name, !ready, ready)
+		}
+	}
+
+	failing.err = nil
+	probes.probeAll(context.Background(), endpoints)
+	if got := probes.readiness(true, endpoints, time.Minute); !got.Ready {
+		t.Errorf("with every endpoint answering, readiness = %+v", got)
+	}
+	if got := probes.readiness(false, endpoints, time.Minute); got.Ready || got.Connected {
+		t.Errorf("while disconnected, readiness = %+v", got)
+	}
+
+	// A success too long ago does not count.
+	now = now.Add(2 * time.Minute)
+	got = probes.readiness(true, endpoints, time.Minute)
+	if got.Ready || got.Endpoints[0].LastSuccess == "" {
+		t.Errorf("with stale probes, readiness = %+v", got)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	prober := &fakeProber{}
+	table := newEndpointTable([]configuredEndpoint{{Type: "jenkins", Name: "j1", Configured: true, instance: prober}})
+	probes := newEndpointProbes()
+	probes.probeAll(context.Background(), table.current())
+
+	tests := []struct {
+		name       string
+		connected  bool
+		wantStatus int
+	}{
+		{"disconnected", false, http.StatusServiceUnavailable},
+		{"connected", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnelConnected.SetTo(tt.connected)
+			defer tunnelConnected.UnSet()
+
+			w := httptest.NewRecorder()
+			readinessHandler(probes, table, time.Minute)(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			var body readiness
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+			}
+			if body.Connected != tt.connected || len(body.Endpoints) != 1 || !body.Endpoints[0].Ready {
+				t.Errorf("unexpected body %s", w.Body.String())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	livenessHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected /healthz to return 200, got %d", w.Code)
+	}
+}
+
+func TestGenericEndpoint_probe(t *testing.T) {
+	status := http.StatusUnauthorized
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	ep := &GenericEndpoint{config: genericEndpointConfig{URL: srv.URL}, client: srv.Client()}
+	if err := ep.probe(context.Background()); err != nil {
+		t.Errorf("a 401 should count as answering, got %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := ep.probe(context.Background()); err == nil {
+		t.Errorf("expected a 503 to fail the probe")
+	}
+	srv.Close()
+	if err := ep.probe(context.Background()); err == nil {
+		t.Errorf("expected a closed server to fail the probe")
+	}
+}
+
+func TestKubernetesEndpoint_probe(t *testing.T) {
+	var paths, auths []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		auths = append(auths, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"gitVersion":"v1.21.0"}`))
+	}))
+	defer srv.Close()
+
+	ke := &KubernetesEndpoint{config: kubernetesConfig{MaxIdleConnsPerHost: 1, IdleConnTimeout: 30}}
+	kcs := &kubeContexts{
+		current: "ctx1",
+		contexts: map[string]*kubeContext{
+			"ctx1": {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}, token: "good"},
+			"ctx2": {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}, token: "bad"},
+		},
+	}
+	ke.attachClients(kcs, nil)
+	ke.f = *kcs
+
+	if err := ke.probe(context.Background()); err != nil {
+		t.Errorf("probe of the current context failed: %v", err)
+	}
+	if err := ke.contextEndpoint("ctx2").probe(context.Background()); err == nil {
+		t.Errorf("expected a rejected credential to fail the probe")
+	}
+	if len(paths) != 2 || paths[0] != "/version" || auths[1] != "Bearer bad" {
+		t.Errorf("unexpected requests: paths %v, credentials %v", paths, auths)
+	}
+}
@@ -18,13 +18,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 )
 
+// responseFlushInterval is how long part of a chunk may wait for more of
+// a response body before it is sent, so a body written slowly, such as a
+// followed log, still arrives promptly.
+const responseFlushInterval = 20 * time.Millisecond
+
 func makeHeaders(headers map[string][]string) []*tunnel.HttpHeader {
 	ret := make([]*tunnel.HttpHeader, 0)
 	for name, values := range headers {
@@ -66,6 +74,47 @@ func makeBadGatewayResponse(id string) *tunnel.AgentToControllerWrapper {
 	}
 }
 
+// statusForError maps an error from an upstream HTTP request into the
+// status code the controller should return to its client.  Timeouts
+// become 504, everything else (connection refused, DNS and TLS failures)
+// is a 502.
+func statusForError(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func makeHTTPErrorResponse(id string, err error) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpError{
+			HttpError: &tunnel.HttpError{
+				Id:      id,
+				Status:  int32(statusForError(err)),
+				Message: err.Error(),
+			},
+		},
+	}
+}
+
+// makeHTTPStatusResponse reports a request the agent refused to run,
+// with the status the controller should return to its client.
+func makeHTTPStatusResponse(id string, status int, message string) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpError{
+			HttpError: &tunnel.HttpError{
+				Id:      id,
+				Status:  int32(status),
+				Message: message,
+			},
+		},
+	}
+}
+
 func makeResponse(id string, response *http.Response) *tunnel.AgentToControllerWrapper {
 	return &tunnel.AgentToControllerWrapper{
 		Event: &tunnel.AgentToControllerWrapper_HttpResponse{
@@ -79,41 +128,150 @@ func makeResponse(id string, response *http.Response) *tunnel.AgentToControllerW
 	}
 }
 
+// makeUpstreamRequest builds the request to send to the upstream service.
+// The body is streamed as it arrives from the controller.
+func makeUpstreamRequest(ctx context.Context, req *tunnel.HttpRequest, url string, body io.ReadCloser) (*http.Request, error) {
+	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if req.ContentLength > 0 {
+		httpRequest.ContentLength = req.ContentLength
+	}
+	return httpRequest, nil
+}
+
 func runHTTPRequest(client *http.Client, req *tunnel.HttpRequest, httpRequest *http.Request, dataflow chan *tunnel.AgentToControllerWrapper, baseURL string) {
-	log.Printf("Sending HTTP request: %s to %v", req.Method, baseURL+req.URI)
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	logger.Debugf("Sending HTTP request: %s to %v", req.Method, baseURL+req.URI)
+	start := time.Now()
 	httpResponse, err := client.Do(httpRequest)
+	upstreamLatency.WithLabelValues(req.Type).Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.Printf("Failed to execute request for %s to %s: %v", req.Method, baseURL+req.URI, err)
-		dataflow <- makeBadGatewayResponse(req.Id)
+		logger.Warnf("Failed to execute request for %s to %s: %v", req.Method, baseURL+req.URI, err)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
 		return
 	}
+	sendHTTPResponse(req, httpResponse, dataflow)
+}
+
+// sendHTTPResponse sends the response headers and then the body in
+// chunks, closing the body when done.
+func sendHTTPResponse(req *tunnel.HttpRequest, httpResponse *http.Response, dataflow chan *tunnel.AgentToControllerWrapper) {
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	defer httpResponse.Body.Close()
 
-	// First, send the headers.
+	// First, send the headers.  A response which cannot have a body is
+	// complete with them, so no chunks follow, though any Content-Length
+	// header is still passed on.
 	resp := makeResponse(req.Id, httpResponse)
+	if !tunnel.ResponseHasBody(req.Method, httpResponse.StatusCode) {
+		resp.GetHttpResponse().ContentLength = 0
+		dataflow <- resp
+		return
+	}
 	dataflow <- resp
 
-	// Now, send one or more data packet.
+	// Now, send one or more data packets.  Reads are made in the
+	// background, so small ones can be combined until a chunk is full or
+	// responseFlushInterval passes.  Each buffer is returned to the pool
+	// once its message has been sent.
+	pool := responseChunks
+	defer pool.finish(req.Id)
+	reads := make(chan bodyRead)
+	done := make(chan struct{})
+	defer close(done)
+	go readBody(pool, httpResponse.Body, reads, done)
+
+	var pending []byte
+	var flush <-chan time.Time
+	var timer *time.Timer
+	sendPending := func() {
+		if timer != nil {
+			timer.Stop()
+			flush = nil
+		}
+		if len(pending) == 0 {
+			return
+		}
+		pool.reserve(req.Id)
+		dataflow <- makeChunkedResponse(req.Id, pending)
+		pending = nil
+	}
 	for {
-		buf := make([]byte, 10240)
-		n, err := httpResponse.Body.Read(buf)
-		if n > 0 {
-			resp := makeChunkedResponse(req.Id, buf[:n])
-			dataflow <- resp
+		var r bodyRead
+		select {
+		case <-flush:
+			sendPending()
+			continue
+		case r = <-reads:
+		}
+
+		data := r.buf[:r.n]
+		if len(pending) == 0 && len(data) == pool.size {
+			pending = data
+			sendPending()
+		} else {
+			for len(data) > 0 {
+				if pending == nil {
+					pending = pool.get()[:0]
+				}
+				n := copy(pending[len(pending):cap(pending)], data)
+				pending = pending[:len(pending)+n]
+				data = data[n:]
+				if len(pending) == cap(pending) {
+					sendPending()
+				}
+			}
+			pool.put(r.buf)
+			if len(pending) > 0 && flush == nil {
+				timer = time.NewTimer(responseFlushInterval)
+				flush = timer.C
+			}
 		}
-		if err == io.EOF {
-			resp := makeChunkedResponse(req.Id, emptyBytes)
-			dataflow <- resp
+
+		if r.err == io.EOF {
+			sendPending()
+			dataflow <- makeChunkedResponse(req.Id, emptyBytes)
+			return
+		}
+		if r.err == context.Canceled {
+			logger.Debugf("Context cancelled")
+			if timer != nil {
+				timer.Stop()
+			}
+			pool.put(pending)
 			return
 		}
-		if err == context.Canceled {
-			log.Printf("Context cancelled, request ID %s", req.Id)
+		if r.err != nil {
+			logger.Warnf("Got error on HTTP read: %v", r.err)
+			sendPending()
+			dataflow <- makeHTTPErrorResponse(req.Id, r.err)
+			return
+		}
+	}
+}
+
+// bodyRead is one read from a response body into a pooled buffer.
+type bodyRead struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// readBody reads body into buffers from pool, passing each read on until
+// one fails, or done is closed.
+func readBody(pool *chunkPool, body io.Reader, reads chan<- bodyRead, done <-chan struct{}) {
+	for {
+		buf := pool.get()
+		n, err := body.Read(buf)
+		select {
+		case reads <- bodyRead{buf, n, err}:
+		case <-done:
+			pool.put(buf)
 			return
 		}
 		if err != nil {
-			log.Printf("Got error on HTTP read: %v", err)
-			// todo: send an error message somehow.  For now, just send EOF
-			resp := makeChunkedResponse(req.Id, emptyBytes)
-			dataflow <- resp
 			return
 		}
 	}
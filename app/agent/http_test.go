@@ -0,0 +1,155 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func refusedURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func TestRunHTTPRequest_errors(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slowServer.Close()
+
+	tests := []struct {
+		name        string
+		url         string
+		timeout     time.Duration
+		wantStatus  int32
+		wantMessage string
+	}{
+		{"connection refused", refusedURL(t), 0, http.StatusBadGateway, "connection refused"},
+		{"tls handshake failure", tlsServer.URL, 0, http.StatusBadGateway, "certificate"},
+		{"dns failure", "http://nonexistent.invalid", 0, http.StatusBadGateway, "nonexistent.invalid"},
+		{"timeout", slowServer.URL, 50 * time.Millisecond, http.StatusGatewayTimeout, "Timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Timeout: tt.timeout}
+			req := &tunnel.HttpRequest{Id: "id1", Method: "GET", URI: "/"}
+			httpRequest, err := http.NewRequest("GET", tt.url+"/", nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+			runHTTPRequest(client, req, httpRequest, dataflow, tt.url)
+			close(dataflow)
+
+			msg := <-dataflow
+			if msg == nil {
+				t.Fatalf("expected a message, got none")
+			}
+			httpError := msg.GetHttpError()
+			if httpError == nil {
+				t.Fatalf("expected HttpError, got %T", msg.Event)
+			}
+			if httpError.Id != "id1" {
+				t.Errorf("expected id 'id1', got '%s'", httpError.Id)
+			}
+			if httpError.Status != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, httpError.Status)
+			}
+			if !strings.Contains(httpError.Message, tt.wantMessage) {
+				t.Errorf("expected message '%s' to contain '%s'", httpError.Message, tt.wantMessage)
+			}
+			if extra := <-dataflow; extra != nil {
+				t.Errorf("unexpected additional message: %v", extra)
+			}
+		})
+	}
+}
+
+func TestRunHTTPRequest_noBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		method   string
+		status   int
+		wantBody bool
+	}{
+		{"GET", http.StatusOK, true},
+		{"HEAD", http.StatusOK, false},
+		{"GET", http.StatusNoContent, false},
+		{"GET", http.StatusNotModified, false},
+		{"OPTIONS", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.method, tt.status), func(t *testing.T) {
+			uri := fmt.Sprintf("/?status=%d", tt.status)
+			req := &tunnel.HttpRequest{Id: "id1", Method: tt.method, URI: uri}
+			httpRequest, err := http.NewRequest(tt.method, server.URL+uri, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+			runHTTPRequest(server.Client(), req, httpRequest, dataflow, server.URL)
+			close(dataflow)
+
+			resp := (<-dataflow).GetHttpResponse()
+			if resp == nil {
+				t.Fatalf("expected HttpResponse first")
+			}
+			if int(resp.Status) != tt.status {
+				t.Errorf("status = %d, want %d", resp.Status, tt.status)
+			}
+			body := ""
+			chunks := 0
+			for msg := range dataflow {
+				body += string(msg.GetHttpChunkedResponse().Body)
+				chunks++
+			}
+			if !tt.wantBody {
+				if resp.ContentLength != 0 || chunks != 0 {
+					t.Errorf("expected ContentLength 0 and no chunks, got %d and %d chunks", resp.ContentLength, chunks)
+				}
+				return
+			}
+			if body != "hello" {
+				t.Errorf("body = '%s', want 'hello'", body)
+			}
+		})
+	}
+}
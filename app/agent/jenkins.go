@@ -0,0 +1,297 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/secrets"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// jenkinsEndpointConfig is the per-service configuration of a Jenkins
+// endpoint, in addition to the URL and TLS settings of a generic endpoint.
+// Requests are sent as Username, with the API token read from
+// APITokenFile or the environment variable APITokenEnv, so callers never
+// hold a Jenkins credential.  If CSRFCrumb is set, a crumb is fetched from
+// the crumb issuer and sent with each request which may change something.
+//
+// Without a Username, the endpoint is configured as a generic one, with
+// its credentials section.
+type jenkinsEndpointConfig struct {
+	Username     string `yaml:"username,omitempty"`
+	APITokenFile string `yaml:"apiTokenFile,omitempty"`
+	APITokenEnv  string `yaml:"apiTokenEnv,omitempty"`
+	CSRFCrumb    bool   `yaml:"csrfCrumb,omitempty"`
+}
+
+// JenkinsEndpoint is a generic HTTP endpoint which adds the Jenkins
+// credential, and a CSRF crumb if needed, to each request.
+type JenkinsEndpoint struct {
+	*GenericEndpoint
+	username string
+	apiToken string
+	crumbs   *jenkinsCrumbs
+}
+
+// MakeJenkinsEndpoint returns a Jenkins endpoint.
+func MakeJenkinsEndpoint(endpointName string, configBytes []byte, secretsLoader secrets.SecretLoader) (*JenkinsEndpoint, bool, error) {
+	generic, configured, err := MakeGenericEndpoint("jenkins", endpointName, configBytes, secretsLoader)
+	if err != nil || !configured {
+		return nil, configured, err
+	}
+	ep := &JenkinsEndpoint{GenericEndpoint: generic}
+
+	var config jenkinsEndpointConfig
+	if err := yaml.Unmarshal(configBytes, &config); err != nil {
+		return nil, false, err
+	}
+	if config.Username == "" {
+		return ep, true, nil
+	}
+	if generic.config.Credentials.Type != "none" {
+		util.Warnf("jenkins/%s: credentials cannot be set with username", endpointName)
+		return nil, false, nil
+	}
+	token, err := loadJenkinsAPIToken(config)
+	if err != nil {
+		util.Warnf("jenkins/%s: %v", endpointName, err)
+		return nil, false, nil
+	}
+	ep.username = config.Username
+	ep.apiToken = token
+	if config.CSRFCrumb {
+		ep.crumbs = &jenkinsCrumbs{endpoint: ep}
+	}
+	return ep, true, nil
+}
+
+func loadJenkinsAPIToken(config jenkinsEndpointConfig) (string, error) {
+	switch {
+	case config.APITokenFile != "" && config.APITokenEnv != "":
+		return "", fmt.Errorf("only one of apiTokenFile and apiTokenEnv may be set")
+	case config.APITokenFile != "":
+		buf, err := ioutil.ReadFile(config.APITokenFile)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(buf))
+		if token == "" {
+			return "", fmt.Errorf("%s is empty", config.APITokenFile)
+		}
+		return token, nil
+	case config.APITokenEnv != "":
+		token := strings.TrimSpace(os.Getenv(config.APITokenEnv))
+		if token == "" {
+			return "", fmt.Errorf("environment variable %s is not set", config.APITokenEnv)
+		}
+		return token, nil
+	}
+	return "", fmt.Errorf("apiTokenFile or apiTokenEnv is required with username")
+}
+
+// needsCrumb returns true for the methods Jenkins checks a crumb on.
+func needsCrumb(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// makeRequest builds the upstream request with the Jenkins credential in
+// place of whatever the caller sent.
+func (ep *JenkinsEndpoint) makeRequest(ctx context.Context, req *tunnel.HttpRequest, body io.ReadCloser) (*http.Request, error) {
+	httpRequest, err := makeUpstreamRequest(ctx, req, ep.config.URL+req.URI, body)
+	if err != nil {
+		return nil, err
+	}
+	copyHeaders(req, httpRequest)
+	httpRequest.Header.Del("Authorization")
+	httpRequest.SetBasicAuth(ep.username, ep.apiToken)
+	return httpRequest, nil
+}
+
+func (ep *JenkinsEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, body io.ReadCloser) {
+	if ep.username == "" {
+		ep.GenericEndpoint.executeHTTPRequest(dataflow, req, body)
+		return
+	}
+
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	defer body.Close()
+	logger.Debugf("Running request %s", req.LogString())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	registerCancelFunction(req.Id, cancel)
+	defer unregisterCancelFunction(req.Id)
+
+	httpRequest, err := ep.makeRequest(ctx, req, body)
+	if err != nil {
+		logger.Warnf("Failed to build request for %s to %s: %v", req.Method, ep.config.URL+req.URI, err)
+		dataflow <- makeBadGatewayResponse(req.Id)
+		return
+	}
+	if ep.crumbs == nil || !needsCrumb(req.Method) {
+		runHTTPRequest(ep.client, req, httpRequest, dataflow, ep.config.URL)
+		return
+	}
+
+	crumb, err := ep.crumbs.get(ctx)
+	if err != nil {
+		logger.Warnf("Failed to get a CSRF crumb: %v", err)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
+		return
+	}
+	crumb.apply(httpRequest)
+
+	start := time.Now()
+	httpResponse, err := ep.client.Do(httpRequest)
+	upstreamLatency.WithLabelValues(req.Type).Observe(time.Since(start).Seconds())
+
+	// A crumb expires with the Jenkins session it was issued in.  If it is
+	// refused, a new one is fetched for the next request, and this one is
+	// retried if it had no body to send again.
+	if err == nil && httpResponse.StatusCode == http.StatusForbidden {
+		ep.crumbs.invalidate(crumb)
+		if req.ContentLength == 0 {
+			httpResponse.Body.Close()
+			logger.Infof("CSRF crumb refused, retrying with a new one")
+			httpResponse, err = ep.retryWithNewCrumb(ctx, req)
+		}
+	}
+	if err != nil {
+		logger.Warnf("Failed to execute request for %s to %s: %v", req.Method, ep.config.URL+req.URI, err)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
+		return
+	}
+	sendHTTPResponse(req, httpResponse, dataflow)
+}
+
+func (ep *JenkinsEndpoint) retryWithNewCrumb(ctx context.Context, req *tunnel.HttpRequest) (*http.Response, error) {
+	crumb, err := ep.crumbs.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := ep.makeRequest(ctx, req, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	crumb.apply(httpRequest)
+	return ep.client.Do(httpRequest)
+}
+
+// jenkinsCrumb is a CSRF crumb, and the session cookies it belongs to.
+// If the crumb issuer is not enabled, field is empty and nothing is sent.
+type jenkinsCrumb struct {
+	field   string
+	value   string
+	cookies []*http.Cookie
+}
+
+func (c *jenkinsCrumb) apply(r *http.Request) {
+	if c.field == "" {
+		return
+	}
+	r.Header.Set(c.field, c.value)
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+}
+
+// jenkinsCrumbs fetches a crumb when one is first needed, and keeps it
+// until Jenkins refuses it.
+type jenkinsCrumbs struct {
+	sync.Mutex
+	endpoint *JenkinsEndpoint
+	current  *jenkinsCrumb
+}
+
+func (c *jenkinsCrumbs) get(ctx context.Context) (*jenkinsCrumb, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.current != nil {
+		return c.current, nil
+	}
+	crumb, err := c.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.current = crumb
+	return crumb, nil
+}
+
+// invalidate discards crumb, unless another has already replaced it.
+func (c *jenkinsCrumbs) invalidate(crumb *jenkinsCrumb) {
+	c.Lock()
+	defer c.Unlock()
+	if c.current == crumb {
+		c.current = nil
+	}
+}
+
+type jenkinsCrumbResponse struct {
+	Crumb             string `json:"crumb"`
+	CrumbRequestField string `json:"crumbRequestField"`
+}
+
+func (c *jenkinsCrumbs) fetch(ctx context.Context) (*jenkinsCrumb, error) {
+	ep := c.endpoint
+	url := ep.config.URL + "/crumbIssuer/api/json"
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.SetBasicAuth(ep.username, ep.apiToken)
+	resp, err := ep.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		util.Infof("jenkins/%s: the crumb issuer is not enabled, sending requests without a crumb", ep.endpointName)
+		return &jenkinsCrumb{}, nil
+	default:
+		return nil, fmt.Errorf("crumb issuer returned status %d", resp.StatusCode)
+	}
+	var crumb jenkinsCrumbResponse
+	if err := json.NewDecoder(resp.Body).Decode(&crumb); err != nil {
+		return nil, fmt.Errorf("while decoding crumb: %v", err)
+	}
+	if crumb.Crumb == "" || crumb.CrumbRequestField == "" {
+		return nil, fmt.Errorf("crumb issuer returned no crumb")
+	}
+	return &jenkinsCrumb{
+		field:   crumb.CrumbRequestField,
+		value:   crumb.Crumb,
+		cookies: resp.Cookies(),
+	}, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// fakeJenkins issues a crumb tied to a session cookie, and accepts a POST
+// only with the crumb of the current session.  Expiring the session
+// makes Jenkins refuse the crumb already issued.
+type fakeJenkins struct {
+	sync.Mutex
+	session      int
+	crumbsIssued int
+	noCrumbs     bool
+}
+
+func (j *fakeJenkins) expireSession() {
+	j.Lock()
+	defer j.Unlock()
+	j.session++
+}
+
+func (j *fakeJenkins) issued() int {
+	j.Lock()
+	defer j.Unlock()
+	return j.crumbsIssued
+}
+
+func (j *fakeJenkins) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.Lock()
+	defer j.Unlock()
+	username, password, _ := r.BasicAuth()
+	if username != "admin" || password != "api-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	session := fmt.Sprintf("s%d", j.session)
+	if r.URL.Path == "/crumbIssuer/api/json" {
+		if j.noCrumbs {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		j.crumbsIssued++
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: session})
+		fmt.Fprintf(w, `{"crumb":"crumb-%s","crumbRequestField":"Jenkins-Crumb"}`, session)
+		return
+	}
+	if r.Method == "POST" && !j.noCrumbs {
+		cookie, err := r.Cookie("JSESSIONID")
+		if err != nil || cookie.Value != session || r.Header.Get("Jenkins-Crumb") != "crumb-"+session {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+}
+
+// runJenkinsRequest sends a request through the endpoint, and returns the
+// status and body of the response.
+func runJenkinsRequest(t *testing.T, ep *JenkinsEndpoint, method string, body string) (int, string) {
+	t.Helper()
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	req := &tunnel.HttpRequest{
+		Id:            "id1",
+		Type:          "jenkins",
+		Name:          "ep1",
+		Method:        method,
+		URI:           "/job/foo/build",
+		ContentLength: int64(len(body)),
+		Headers:       []*tunnel.HttpHeader{{Name: "Authorization", Values: []string{"Basic Y2FsbGVyOnRva2Vu"}}},
+	}
+	ep.executeHTTPRequest(dataflow, req, ioutil.NopCloser(strings.NewReader(body)))
+	close(dataflow)
+
+	response := (<-dataflow).GetHttpResponse()
+	if response == nil {
+		t.Fatalf("expected HttpResponse")
+	}
+	ret := ""
+	for msg := range dataflow {
+		ret += string(msg.GetHttpChunkedResponse().Body)
+	}
+	return int(response.Status), ret
+}
+
+func TestJenkinsEndpoint_crumbs(t *testing.T) {
+	jenkins := &fakeJenkins{}
+	server := httptest.NewServer(jenkins)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("api-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := "url: " + server.URL + "\nusername: admin\napiTokenFile: " + tokenFile + "\ncsrfCrumb: true\n"
+	ep, configured, err := MakeJenkinsEndpoint("ep1", []byte(config), &FakeSecretLoader{})
+	if err != nil || !configured {
+		t.Fatalf("MakeJenkinsEndpoint() configured = %v, err = %v", configured, err)
+	}
+
+	// A GET needs no crumb.
+	if status, body := runJenkinsRequest(t, ep, "GET", ""); status != http.StatusOK || body != "GET /job/foo/build" {
+		t.Errorf("GET returned %d '%s'", status, body)
+	}
+	if n := jenkins.issued(); n != 0 {
+		t.Errorf("expected no crumb fetched for a GET, got %d", n)
+	}
+
+	// The first POST fetches a crumb, which later ones reuse.
+	for i := 0; i < 2; i++ {
+		if status, body := runJenkinsRequest(t, ep, "POST", ""); status != http.StatusOK || body != "POST /job/foo/build" {
+			t.Errorf("POST %d returned %d '%s'", i, status, body)
+		}
+	}
+	if n := jenkins.issued(); n != 1 {
+		t.Errorf("expected 1 crumb fetched, got %d", n)
+	}
+
+	// Once the session expires, the crumb is refused, and a request
+	// without a body is retried with a new one.
+	jenkins.expireSession()
+	if status, body := runJenkinsRequest(t, ep, "POST", ""); status != http.StatusOK || body != "POST /job/foo/build" {
+		t.Errorf("POST after the session expired returned %d '%s'", status, body)
+	}
+	if n := jenkins.issued(); n != 2 {
+		t.Errorf("expected 2 crumbs fetched, got %d", n)
+	}
+
+	// A request with a body cannot be sent again, so the refusal is
+	// returned, and the next request fetches a new crumb.
+	jenkins.expireSession()
+	if status, _ := runJenkinsRequest(t, ep, "POST", "json={}"); status != http.StatusForbidden {
+		t.Errorf("POST with a body after the session expired returned %d, want 403", status)
+	}
+	if status, _ := runJenkinsRequest(t, ep, "POST", "json={}"); status != http.StatusOK {
+		t.Errorf("POST with a body and a new crumb returned %d", status)
+	}
+	if n := jenkins.issued(); n != 3 {
+		t.Errorf("expected 3 crumbs fetched, got %d", n)
+	}
+}
+
+func TestJenkinsEndpoint_crumbIssuerDisabled(t *testing.T) {
+	jenkins := &fakeJenkins{noCrumbs: true}
+	server := httptest.NewServer(jenkins)
+	defer server.Close()
+
+	os.Setenv("TEST_JENKINS_API_TOKEN", "api-token")
+	defer os.Unsetenv("TEST_JENKINS_API_TOKEN")
+	config := "url: " + server.URL + "\nusername: admin\napiTokenEnv: TEST_JENKINS_API_TOKEN\ncsrfCrumb: true\n"
+	ep, configured, err := MakeJenkinsEndpoint("ep1", []byte(config), &FakeSecretLoader{})
+	if err != nil || !configured {
+		t.Fatalf("MakeJenkinsEndpoint() configured = %v, err = %v", configured, err)
+	}
+	if status, body := runJenkinsRequest(t, ep, "POST", ""); status != http.StatusOK || body != "POST /job/foo/build" {
+		t.Errorf("POST returned %d '%s'", status, body)
+	}
+}
+
+func TestMakeJenkinsEndpoint(t *testing.T) {
+	os.Setenv("TEST_JENKINS_API_TOKEN", "api-token")
+	defer os.Unsetenv("TEST_JENKINS_API_TOKEN")
+
+	tests := []struct {
+		name           string
+		config         string
+		wantConfigured bool
+		wantUsername   string
+	}{
+		{"generic credentials", "url: https://jenkins\ncredentials:\n  type: basic\n  username: " + fooString + "\n  password: " + barString + "\n", true, ""},
+		{"token from the environment", "url: https://jenkins\nusername: admin\napiTokenEnv: TEST_JENKINS_API_TOKEN\n", true, "admin"},
+		{"no token", "url: https://jenkins\nusername: admin\n", false, ""},
+		{"unset environment variable", "url: https://jenkins\nusername: admin\napiTokenEnv: TEST_JENKINS_UNSET\n", false, ""},
+		{"missing token file", "url: https://jenkins\nusername: admin\napiTokenFile: /nonexistent\n", false, ""},
+		{"both token sources", "url: https://jenkins\nusername: admin\napiTokenFile: /nonexistent\napiTokenEnv: TEST_JENKINS_API_TOKEN\n", false, ""},
+		{"username and credentials", "url: https://jenkins\nusername: admin\napiTokenEnv: TEST_JENKINS_API_TOKEN\ncredentials:\n  type: bearer\n  token: " + bazString + "\n", false, ""},
+		{"no url", "username: admin\napiTokenEnv: TEST_JENKINS_API_TOKEN\n", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, configured, err := MakeJenkinsEndpoint("ep1", []byte(tt.config), &FakeSecretLoader{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if configured != tt.wantConfigured {
+				t.Fatalf("configured = %v, want %v", configured, tt.wantConfigured)
+			}
+			if configured && ep.username != tt.wantUsername {
+				t.Errorf("username = '%s', want '%s'", ep.username, tt.wantUsername)
+			}
+		})
+	}
+}
+
+func TestJenkinsEndpoint_replacesAuthorization(t *testing.T) {
+	jenkins := &fakeJenkins{}
+	server := httptest.NewServer(jenkins)
+	defer server.Close()
+
+	os.Setenv("TEST_JENKINS_API_TOKEN", "api-token")
+	defer os.Unsetenv("TEST_JENKINS_API_TOKEN")
+	config := "url: " + server.URL + "\nusername: admin\napiTokenEnv: TEST_JENKINS_API_TOKEN\n"
+	ep, configured, err := MakeJenkinsEndpoint("ep1", []byte(config), &FakeSecretLoader{})
+	if err != nil || !configured {
+		t.Fatalf("MakeJenkinsEndpoint() configured = %v, err = %v", configured, err)
+	}
+	// The fake refuses anything but the configured credential, so the
+	// caller's Authorization header must have been replaced.
+	if status, _ := runJenkinsRequest(t, ep, "GET", ""); status != http.StatusOK {
+		t.Errorf("GET returned %d", status)
+	}
+}
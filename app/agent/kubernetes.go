@@ -21,40 +21,122 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/opsmx/oes-birger/app/agent/cfg"
+	"github.com/opsmx/oes-birger/pkg/ca"
 	"github.com/opsmx/oes-birger/pkg/kubeconfig"
 	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 	"golang.org/x/net/context"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 30
+	defaultKubeConfig          = "/app/config/kubeconfig.yaml"
+)
+
+// kubernetesConfig is the per-service configuration.  The connection
+// settings apply to the transport shared by all requests to each context;
+// idleConnTimeout is in seconds.  KubeConfig may list several files,
+// separated by colons, which are merged as kubectl does.  TLS adjusts how
+// the API server of every context is verified, unless ContextTLS has an
+// entry for the context's name.  ProxyURL, an http, https, or socks5 URL,
+// is the proxy used to reach the API server of every context, unless
+// ContextProxyURL has an entry for the context's name; if neither is set,
+// the proxy is taken from the environment.  DiscoveryCache optionally
+// caches the API discovery responses kubectl asks for before every command.
 type kubernetesConfig struct {
-	KubeConfig string `yaml:"kubeConfig,omitempty"`
+	KubeConfig          string                       `yaml:"kubeConfig,omitempty"`
+	MaxIdleConnsPerHost int                          `yaml:"maxIdleConnsPerHost,omitempty"`
+	IdleConnTimeout     int                          `yaml:"idleConnTimeout,omitempty"`
+	TLS                 upstreamTLSConfig            `yaml:"tls,omitempty"`
+	ContextTLS          map[string]upstreamTLSConfig `yaml:"contextTLS,omitempty"`
+	ProxyURL            string                       `yaml:"proxyURL,omitempty"`
+	ContextProxyURL     map[string]string            `yaml:"contextProxyURL,omitempty"`
+	DiscoveryCache      discoveryCacheConfig         `yaml:"discoveryCache,omitempty"`
+}
+
+// tlsFor returns the TLS settings for the named context.
+func (c kubernetesConfig) tlsFor(name string) upstreamTLSConfig {
+	if override, found := c.ContextTLS[name]; found {
+		return override
+	}
+	return c.TLS
+}
+
+// proxyFor returns the proxy for the named context, or nil to use the
+// environment's.
+func (c kubernetesConfig) proxyFor(name string) (*url.URL, error) {
+	if override, found := c.ContextProxyURL[name]; found {
+		return cfg.ParseProxyURL(override)
+	}
+	return cfg.ParseProxyURL(c.ProxyURL)
 }
 
 // KubernetesEndpoint implements a kubernetes endpoint state, including the credentials and namespaces
 // defined in the configuration.
 type KubernetesEndpoint struct {
 	sync.RWMutex
-	f      kubeContext
+	f      kubeContexts
 	config kubernetesConfig
+
+	// discovery is nil unless the discovery cache is enabled.
+	discovery *discoveryCache
+
+	// stop is closed when the endpoint is replaced by a reload.
+	stop chan struct{}
+}
+
+// kubernetesContextEndpoint routes requests to one named context of a
+// KubernetesEndpoint, rather than to the kubeconfig's current context.
+type kubernetesContextEndpoint struct {
+	ke          *KubernetesEndpoint
+	contextName string
+}
+
+// kubeContexts holds every usable context from the kubeconfig, along with
+// the name of the current (default) one.
+type kubeContexts struct {
+	current  string
+	contexts map[string]*kubeContext
 }
 
+// kubeContext holds the server and credentials for one context.  Requests
+// are authenticated with the client certificate if there is one, and with
+// the first of tokenFile, exec, token, or the basic auth username and
+// password which is set.
 type kubeContext struct {
-	username   string
-	serverURL  string
-	serverCA   *x509.Certificate
-	clientCert *tls.Certificate
-	token      string
-	insecure   bool
+	username      string
+	serverURL     string
+	serverCAs     []*x509.Certificate
+	clientCert    *tls.Certificate
+	token         string
+	tokenFile     *tokenFile
+	exec          *execCredential
+	basicUsername string
+	basicPassword string
+	insecure      bool
+	extraCAs      []byte
+	serverName    string
+	proxyURL      *url.URL
+
+	// client is built once per context and shared by all requests, so
+	// upstream connections are reused.
+	client *http.Client
 }
 
 // MakeKubernetesEndpoint creates a new Kubernetes endpoint based on the provided config.
@@ -67,94 +149,361 @@ func MakeKubernetesEndpoint(name string, configBytes []byte) (*KubernetesEndpoin
 		return nil, false, err
 	}
 
-	if config.KubeConfig == "" {
-		config.KubeConfig = "/app/config/kubeconfig.yaml"
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if config.DiscoveryCache.TTL == 0 {
+		config.DiscoveryCache.TTL = defaultDiscoveryCacheTTL
+	}
+	if config.DiscoveryCache.Enabled {
+		k.discovery = newDiscoveryCache(time.Duration(config.DiscoveryCache.TTL) * time.Second)
 	}
 
 	k.config = config
-	k.f = *k.loadKubernetesSecurity()
+	saf, err := k.loadKubernetesSecurity()
+	if err != nil {
+		return nil, false, err
+	}
+	k.attachClients(saf, nil)
+	k.f = *saf
 
+	k.stop = make(chan struct{})
 	go k.updateServerContextTicker()
 
 	return k, true, nil
 }
 
-func (ke *KubernetesEndpoint) makeServerContextFields() *kubeContext {
+// ContextNames returns the names of all contexts loaded from the kubeconfig.
+// When running with a service account, this is empty.
+func (ke *KubernetesEndpoint) ContextNames() []string {
+	ke.RLock()
+	defer ke.RUnlock()
+	names := []string{}
+	for name := range ke.f.contexts {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tlsMode reports the TLS mode of the current context.
+func (ke *KubernetesEndpoint) tlsMode() string {
+	return ke.contextTLSMode("")
+}
+
+// contextTLSMode returns the TLS mode of the named context, or of the
+// current context if name is empty.
+func (ke *KubernetesEndpoint) contextTLSMode(name string) string {
+	ke.RLock()
+	defer ke.RUnlock()
+	if name == "" {
+		name = ke.f.current
+	}
+	if c, found := ke.f.contexts[name]; found {
+		return c.tlsMode()
+	}
+	return ""
+}
+
+func (kce *kubernetesContextEndpoint) tlsMode() string {
+	return kce.ke.contextTLSMode(kce.contextName)
+}
+
+// contextEndpoint returns a request processor bound to the named context.
+func (ke *KubernetesEndpoint) contextEndpoint(name string) *kubernetesContextEndpoint {
+	return &kubernetesContextEndpoint{ke: ke, contextName: name}
+}
+
+// resolveContextName returns name, or the name of the current context if
+// name is empty.
+func (ke *KubernetesEndpoint) resolveContextName(name string) string {
+	ke.RLock()
+	defer ke.RUnlock()
+	if name == "" {
+		return ke.f.current
+	}
+	return name
+}
+
+// makeServerContextFields returns a copy of the named context, or of the
+// current context if name is empty.
+func (ke *KubernetesEndpoint) makeServerContextFields(name string) (*kubeContext, error) {
 	ke.RLock()
 	defer ke.RUnlock()
+	if name == "" {
+		name = ke.f.current
+	}
+	f, found := ke.f.contexts[name]
+	if !found {
+		return nil, fmt.Errorf("unknown kubernetes context '%s'", name)
+	}
 	return &kubeContext{
-		username:   ke.f.username,
-		serverURL:  ke.f.serverURL,
-		serverCA:   ke.f.serverCA,
-		clientCert: ke.f.clientCert,
-		token:      ke.f.token,
-		insecure:   ke.f.insecure,
+		username:      f.username,
+		serverURL:     f.serverURL,
+		serverCAs:     f.serverCAs,
+		clientCert:    f.clientCert,
+		token:         f.token,
+		tokenFile:     f.tokenFile,
+		exec:          f.exec,
+		basicUsername: f.basicUsername,
+		basicPassword: f.basicPassword,
+		insecure:      f.insecure,
+		extraCAs:      f.extraCAs,
+		serverName:    f.serverName,
+		proxyURL:      f.proxyURL,
+		client:        f.client,
+	}, nil
+}
+
+// makeClient builds the HTTP client used for every request to a context.
+func (ke *KubernetesEndpoint) makeClient(c *kubeContext) *http.Client {
+	// TODO: A ServerCA is technically optional, but we might want to fail if it's not present...
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.insecure,
+		ServerName:         c.serverName,
+		RootCAs:            c.rootCAs(),
+	}
+	if c.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+	}
+	tr := &http.Transport{
+		MaxIdleConnsPerHost: ke.config.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(ke.config.IdleConnTimeout) * time.Second,
+		DisableCompression:  true,
+		TLSClientConfig:     tlsConfig,
+		Proxy:               upstreamProxy(c.proxyURL),
+	}
+	return &http.Client{
+		Transport: tr,
 	}
 }
 
-func (ke *KubernetesEndpoint) serverContextFromKubeconfig(kconfig *kubeconfig.KubeConfig) *kubeContext {
-	names := kconfig.GetContextNames()
-	for _, name := range names {
-		if name != kconfig.CurrentContext {
-			continue
+// attachClients gives each context in kcs a client.  Contexts which are
+// unchanged from previous keep their existing client and its connections,
+// along with any cached exec plugin token, and the idle connections of any
+// clients no longer used are closed.
+func (ke *KubernetesEndpoint) attachClients(kcs *kubeContexts, previous *kubeContexts) {
+	reused := map[*http.Client]bool{}
+	for name, c := range kcs.contexts {
+		if previous != nil {
+			if old, found := previous.contexts[name]; found && old.client != nil && c.isSameAs(old) {
+				c.client = old.client
+				c.exec = old.exec
+				reused[old.client] = true
+				continue
+			}
 		}
-		user, cluster, err := kconfig.FindContext(name)
-		if err != nil {
-			log.Fatalf("Unable to retrieve cluster and user info for context %s: %v", name, err)
+		c.client = ke.makeClient(c)
+	}
+	if previous == nil {
+		return
+	}
+	for _, old := range previous.contexts {
+		if old.client != nil && !reused[old.client] {
+			old.client.CloseIdleConnections()
 		}
+	}
+}
+
+// rootCAs returns the CAs trusted for the server, or nil to use the system
+// roots.  Any extra CAs are trusted along with the kubeconfig's CAs, or the
+// system roots if it has none.
+func (scf *kubeContext) rootCAs() *x509.CertPool {
+	if len(scf.serverCAs) == 0 && scf.extraCAs == nil {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if len(scf.serverCAs) > 0 {
+		for _, cert := range scf.serverCAs {
+			pool.AddCert(cert)
+		}
+	} else if system, err := x509.SystemCertPool(); err == nil {
+		pool = system
+	}
+	pool.AppendCertsFromPEM(scf.extraCAs)
+	return pool
+}
+
+// applyTLS applies the configured TLS settings.  A context given a CA
+// bundle is verified with it, even if the kubeconfig skips verification.
+func (scf *kubeContext) applyTLS(c upstreamTLSConfig) error {
+	extraCAs, err := c.loadCAFile()
+	if err != nil {
+		return err
+	}
+	if extraCAs != nil {
+		scf.extraCAs = extraCAs
+		scf.insecure = false
+	}
+	scf.serverName = c.ServerName
+	return nil
+}
 
+// tlsMode returns the TLS mode of the connection to the API server.
+func (scf *kubeContext) tlsMode() string {
+	switch {
+	case strings.HasPrefix(scf.serverURL, "http:"):
+		return tunnel.TLSModePlaintext
+	case scf.insecure:
+		return tunnel.TLSModeInsecure
+	case scf.extraCAs != nil || scf.serverName != "":
+		return tunnel.TLSModeCustom
+	}
+	return tunnel.TLSModeVerified
+}
+
+func contextFromKubeconfig(kconfig *kubeconfig.KubeConfig, name string, tlsOverride upstreamTLSConfig) (*kubeContext, error) {
+	user, cluster, err := kconfig.FindContext(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve cluster and user info for context %s: %v", name, err)
+	}
+
+	saf := &kubeContext{
+		username:      user.Name,
+		token:         user.User.Token,
+		basicUsername: user.User.Username,
+		basicPassword: user.User.Password,
+		serverURL:     cluster.Cluster.Server,
+		insecure:      cluster.Cluster.InsecureSkipTLSVerify,
+	}
+
+	if user.User.HasClientCertificate() {
 		certData, err := base64.StdEncoding.DecodeString(user.User.ClientCertificateData)
 		if err != nil {
-			log.Fatalf("Error decoding user cert from base64 (%s): %v", user.Name, err)
+			return nil, fmt.Errorf("error decoding user cert from base64 (%s): %v", user.Name, err)
 		}
 		keyData, err := base64.StdEncoding.DecodeString(user.User.ClientKeyData)
 		if err != nil {
-			log.Fatalf("Error decoding user key from base64 (%s): %v", user.Name, err)
+			return nil, fmt.Errorf("error decoding user key from base64 (%s): %v", user.Name, err)
 		}
-
 		clientKeypair, err := tls.X509KeyPair(certData, keyData)
 		if err != nil {
-			log.Fatalf("Error loading client cert/key: %v", err)
+			return nil, fmt.Errorf("error loading client cert/key: %v", err)
+		}
+		saf.clientCert = &clientKeypair
+	}
+
+	// The plugin is not run until a request needs a token, so one which
+	// fails only affects requests to this context.
+	if user.User.Exec != nil {
+		saf.exec, err = newExecCredential(name, *user.User.Exec)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", user.Name, err)
 		}
+	}
+
+	if saf.clientCert == nil && saf.token == "" && saf.basicUsername == "" && saf.exec == nil {
+		return nil, fmt.Errorf("user %s has no client certificate, token, username, or exec plugin", user.Name)
+	}
 
-		saf := &kubeContext{
-			username:   user.Name,
-			clientCert: &clientKeypair,
-			serverURL:  cluster.Cluster.Server,
-			insecure:   cluster.Cluster.InsecureSkipTLSVerify,
+	if len(cluster.Cluster.CertificateAuthorityData) > 0 {
+		serverCA, err := base64.StdEncoding.DecodeString(cluster.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding server CA cert from base64 (%s): %v", cluster.Name, err)
 		}
+		// During a CA rotation this holds both the old and new CAs.
+		saf.serverCAs, err = ca.ParseCertificates(serverCA)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing server CA certificates (%s): %v", cluster.Name, err)
+		}
+	}
 
-		if len(cluster.Cluster.CertificateAuthorityData) > 0 {
-			serverCA, err := base64.StdEncoding.DecodeString(cluster.Cluster.CertificateAuthorityData)
+	if err := saf.applyTLS(tlsOverride); err != nil {
+		return nil, fmt.Errorf("context %s: %v", name, err)
+	}
+
+	return saf, nil
+}
+
+// serverContextFromKubeconfig loads every context.  The current context must
+// be usable, but others which fail to load are logged and skipped.
+func (ke *KubernetesEndpoint) serverContextFromKubeconfig(kconfig *kubeconfig.KubeConfig) (*kubeContexts, error) {
+	ret := &kubeContexts{
+		current:  kconfig.CurrentContext,
+		contexts: map[string]*kubeContext{},
+	}
+	for _, name := range kconfig.GetContextNames() {
+		saf, err := contextFromKubeconfig(kconfig, name, ke.config.tlsFor(name))
+		if err == nil {
+			saf.proxyURL, err = ke.config.proxyFor(name)
 			if err != nil {
-				log.Fatalf("Error decoding server CA cert from base64 (%s): %v", cluster.Name, err)
+				err = fmt.Errorf("context %s: %v", name, err)
 			}
-			pemBlock, _ := pem.Decode(serverCA)
-			serverCert, err := x509.ParseCertificate(pemBlock.Bytes)
-			if err != nil {
-				log.Fatalf("Error parsing server certificate: %v", err)
+		}
+		if err != nil {
+			if name == kconfig.CurrentContext {
+				return nil, err
 			}
-			saf.serverCA = serverCert
+			util.Warnf("Skipping kubernetes context %s: %v", name, err)
+			continue
 		}
+		if saf.insecure {
+			if err := checkInsecure("kubernetes context " + name); err != nil {
+				return nil, err
+			}
+		}
+		ret.contexts[name] = saf
+	}
 
-		return saf
+	if _, found := ret.contexts[kconfig.CurrentContext]; !found {
+		return nil, fmt.Errorf("default context not found in kubeconfig")
 	}
 
-	log.Fatalf("Default context not found in kubeconfig")
+	return ret, nil
+}
 
-	return nil
+func (kcs *kubeContexts) isSameAs(kcs2 *kubeContexts) bool {
+	if kcs.current != kcs2.current || len(kcs.contexts) != len(kcs2.contexts) {
+		return false
+	}
+	for name, c := range kcs.contexts {
+		c2, found := kcs2.contexts[name]
+		if !found || !c.isSameAs(c2) {
+			return false
+		}
+	}
+	return true
 }
 
 func (scf *kubeContext) isSameAs(scf2 *kubeContext) bool {
 	if scf.username != scf2.username || scf.serverURL != scf2.serverURL || scf.token != scf2.token || scf.insecure != scf2.insecure {
 		return false
 	}
+	if scf.basicUsername != scf2.basicUsername || scf.basicPassword != scf2.basicPassword {
+		return false
+	}
+	if scf.serverName != scf2.serverName || !bytes.Equal(scf.extraCAs, scf2.extraCAs) {
+		return false
+	}
+	if (scf.proxyURL == nil) != (scf2.proxyURL == nil) || (scf.proxyURL != nil && scf.proxyURL.String() != scf2.proxyURL.String()) {
+		return false
+	}
+
+	if (scf.exec == nil) != (scf2.exec == nil) {
+		return false
+	}
+	if scf.exec != nil && !reflect.DeepEqual(scf.exec.config, scf2.exec.config) {
+		return false
+	}
+
+	if (scf.tokenFile == nil) != (scf2.tokenFile == nil) {
+		return false
+	}
+	if scf.tokenFile != nil && scf.tokenFile.path != scf2.tokenFile.path {
+		return false
+	}
 
-	if (scf.serverCA == nil && scf2.serverCA != nil) || (scf.serverCA != nil && scf2.serverCA == nil) {
+	if len(scf.serverCAs) != len(scf2.serverCAs) {
 		return false
 	}
-	if scf.serverCA != nil && scf2.serverCA != nil {
-		if !scf.serverCA.Equal(scf2.serverCA) {
+	for i, cert := range scf.serverCAs {
+		if !cert.Equal(scf2.serverCAs[i]) {
 			return false
 		}
 	}
@@ -171,20 +520,21 @@ func (scf *kubeContext) isSameAs(scf2 *kubeContext) bool {
 	return true
 }
 
+// loadServiceAccount builds a context from the in-cluster service account.
+// The token is not cached here; it is re-read from disk as it rotates.
 func (ke *KubernetesEndpoint) loadServiceAccount() (*kubeContext, error) {
-	token, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
-	if err != nil {
+	token := newTokenFile(serviceAccountPath + "/token")
+	if _, err := token.Token(); err != nil {
 		return nil, err
 	}
 
-	serverCA, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+	serverCA, err := ioutil.ReadFile(serviceAccountPath + "/ca.crt")
 	if err != nil {
 		return nil, err
 	}
-	pemBlock, _ := pem.Decode(serverCA)
-	serverCert, err := x509.ParseCertificate(pemBlock.Bytes)
+	serverCerts, err := ca.ParseCertificates(serverCA)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to parse service account CA certificates: %v", err)
 	}
 
 	servicePort := os.Getenv("KUBERNETES_SERVICE_PORT")
@@ -196,87 +546,216 @@ func (ke *KubernetesEndpoint) loadServiceAccount() (*kubeContext, error) {
 		return nil, fmt.Errorf("unable to locate API server from KUBERNETES_SERVICE_HOST environment variable")
 	}
 
-	return &kubeContext{
+	sa := &kubeContext{
 		username:  "ServiceAccount",
-		serverURL: "https://" + serviceHost + ":" + servicePort,
-		serverCA:  serverCert,
-		token:     string(token),
-		insecure:  true,
-	}, nil
+		serverURL: "https://" + net.JoinHostPort(serviceHost, servicePort),
+		serverCAs: serverCerts,
+		tokenFile: token,
+	}
+	if err := sa.applyTLS(ke.config.TLS); err != nil {
+		return nil, err
+	}
+	if sa.proxyURL, err = cfg.ParseProxyURL(ke.config.ProxyURL); err != nil {
+		return nil, err
+	}
+	return sa, nil
 }
 
-func (ke *KubernetesEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest) {
-	c := ke.makeServerContextFields()
+func (kce *kubernetesContextEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, body io.ReadCloser) {
+	kce.ke.executeContextHTTPRequest(kce.contextName, dataflow, req, body)
+}
 
-	// TODO: A ServerCA is technically optional, but we might want to fail if it's not present...
-	log.Printf("Running request %v", req)
-	tlsConfig := &tls.Config{
-		MinVersion:         tls.VersionTLS12,
-		InsecureSkipVerify: c.insecure,
+func (ke *KubernetesEndpoint) executeHTTPRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, body io.ReadCloser) {
+	ke.executeContextHTTPRequest("", dataflow, req, body)
+}
+
+func (kce *kubernetesContextEndpoint) executeStreamRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, in chan []byte) {
+	kce.ke.executeContextStreamRequest(kce.contextName, dataflow, req, in)
+}
+
+func (ke *KubernetesEndpoint) executeStreamRequest(dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, in chan []byte) {
+	ke.executeContextStreamRequest("", dataflow, req, in)
+}
+
+// makeContextRequest builds the upstream request for the named context,
+// with its credentials, and returns the context it was built from.
+func (ke *KubernetesEndpoint) makeContextRequest(ctx context.Context, contextName string, req *tunnel.HttpRequest, body io.ReadCloser) (*kubeContext, *http.Request, error) {
+	c, err := ke.makeServerContextFields(contextName)
+	if err != nil {
+		return nil, nil, err
 	}
-	if c.serverCA != nil {
-		caCertPool := x509.NewCertPool()
-		caCertPool.AddCert(c.serverCA)
-		tlsConfig.RootCAs = caCertPool
-		//tlsConfig.BuildNameToCertificate()
+
+	httpRequest, err := makeUpstreamRequest(ctx, req, c.serverURL+req.URI, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to build request for %s to %s: %v", req.Method, c.serverURL+req.URI, err)
 	}
-	if c.clientCert != nil {
-		tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+
+	copyHeaders(req, httpRequest)
+	token, err := c.bearerToken()
+	if err != nil {
+		return nil, nil, err
 	}
-	tr := &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
-		TLSClientConfig:    tlsConfig,
+	if len(token) > 0 {
+		httpRequest.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basicUsername != "" {
+		httpRequest.SetBasicAuth(c.basicUsername, c.basicPassword)
 	}
-	client := &http.Client{
-		Transport: tr,
+	return c, httpRequest, nil
+}
+
+// bearerToken returns the token to send, if any, from the service account
+// token file, the exec plugin, or the kubeconfig.
+func (c *kubeContext) bearerToken() (string, error) {
+	switch {
+	case c.tokenFile != nil:
+		token, err := c.tokenFile.Token()
+		if err != nil {
+			return "", fmt.Errorf("unable to read service account token: %v", err)
+		}
+		return token, nil
+	case c.exec != nil:
+		return c.exec.Token()
+	default:
+		return c.token, nil
 	}
+}
+
+func (ke *KubernetesEndpoint) executeContextHTTPRequest(contextName string, dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, body io.ReadCloser) {
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	defer body.Close()
+	logger.Debugf("Running request %s", req.LogString())
 
 	ctx, cancel := context.WithCancel(context.Background())
 	registerCancelFunction(req.Id, cancel)
 	defer unregisterCancelFunction(req.Id)
 
-	httpRequest, err := http.NewRequestWithContext(ctx, req.Method, c.serverURL+req.URI, bytes.NewBuffer(req.Body))
+	var cacheKey discoveryCacheKey
+	cacheable := false
+	if ke.discovery != nil {
+		resolved := ke.resolveContextName(contextName)
+		if wantsInvalidate(req) {
+			logger.Infof("Invalidating discovery cache for context '%s'", resolved)
+			ke.discovery.invalidate(resolved)
+		}
+		if isDiscoveryRequest(req) {
+			cacheKey = makeDiscoveryCacheKey(resolved, req)
+			if ke.discovery.serve(cacheKey, req, dataflow) {
+				return
+			}
+			cacheable = true
+		}
+	}
+
+	c, httpRequest, err := ke.makeContextRequest(ctx, contextName, req, body)
 	if err != nil {
-		log.Printf("Failed to build request for %s to %s: %v", req.Method, c.serverURL+req.URI, err)
-		dataflow <- makeBadGatewayResponse(req.Id)
+		logger.Warnf("%v", err)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
 		return
 	}
 
-	copyHeaders(req, httpRequest)
-	if len(c.token) > 0 {
-		httpRequest.Header.Set("Authorization", "Bearer "+c.token)
+	if ke.discovery != nil {
+		httpRequest.Header.Del(discoveryCacheHeader)
+	}
+	if cacheable {
+		ke.discovery.runRequest(cacheKey, c.client, req, httpRequest, dataflow, c.serverURL)
+		return
+	}
+	runHTTPRequest(c.client, req, httpRequest, dataflow, c.serverURL)
+}
+
+func (ke *KubernetesEndpoint) executeContextStreamRequest(contextName string, dataflow chan *tunnel.AgentToControllerWrapper, req *tunnel.HttpRequest, in chan []byte) {
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	logger.Debugf("Running stream request %s", req.LogString())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	registerCancelFunction(req.Id, cancel)
+	defer unregisterCancelFunction(req.Id)
+
+	c, httpRequest, err := ke.makeContextRequest(ctx, contextName, req, http.NoBody)
+	if err != nil {
+		logger.Warnf("%v", err)
+		closeStream(req.Id)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
+		return
 	}
 
-	runHTTPRequest(client, req, httpRequest, dataflow, c.serverURL)
+	runStreamRequest(ctx, c.client, req, httpRequest, dataflow, in)
 }
 
-func (ke *KubernetesEndpoint) loadKubernetesSecurity() *kubeContext {
-	yamlString, err := os.Open(ke.config.KubeConfig)
-	if err == nil {
-		kconfig, err := kubeconfig.ReadKubeConfig(yamlString)
+func (ke *KubernetesEndpoint) loadKubernetesSecurity() (*kubeContexts, error) {
+	if *inCluster {
+		sa, err := ke.loadServiceAccount()
 		if err != nil {
-			log.Fatalf("Unable to read kubeconfig: %v", err)
+			return nil, fmt.Errorf("unable to load in-cluster Kubernetes service account: %v", err)
 		}
+		return &kubeContexts{contexts: map[string]*kubeContext{"": sa}}, nil
+	}
+
+	kconfig, err := kubeconfig.ReadKubeConfigFiles(ke.kubeconfigPaths())
+	if err == nil {
 		return ke.serverContextFromKubeconfig(kconfig)
 	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read kubeconfig: %v", err)
+	}
 	sa, err := ke.loadServiceAccount()
 	if err != nil {
-		log.Fatalf("No kubeconfig and no Kubernetes account found: %v", err)
+		return nil, fmt.Errorf("no kubeconfig and no Kubernetes account found: %v", err)
+	}
+	return &kubeContexts{contexts: map[string]*kubeContext{"": sa}}, nil
+}
+
+// kubeconfigPaths returns the kubeconfig files to merge, from the first
+// of the endpoint's config, the -kubeconfig flag, or KUBECONFIG which is
+// set, or the default.
+func (ke *KubernetesEndpoint) kubeconfigPaths() []string {
+	for _, list := range []string{ke.config.KubeConfig, *kubeconfigFlag, os.Getenv("KUBECONFIG")} {
+		if paths := kubeconfig.SplitPaths(list); len(paths) > 0 {
+			return paths
+		}
 	}
-	return sa
+	return []string{defaultKubeConfig}
 }
 
+// updateServerContextTicker reloads the credentials every ten minutes, so
+// rotated ones are used, until the endpoint is closed.  If they cannot be
+// loaded, those already in use are kept.
 func (ke *KubernetesEndpoint) updateServerContextTicker() {
+	ticker := time.NewTicker(600 * time.Second)
+	defer ticker.Stop()
 	for {
-		saf := ke.loadKubernetesSecurity()
+		select {
+		case <-ke.stop:
+			return
+		case <-ticker.C:
+		}
+		saf, err := ke.loadKubernetesSecurity()
+		if err != nil {
+			util.Warnf("Keeping the current security context for Kubernetes: %v", err)
+			continue
+		}
 		ke.Lock()
 		if !ke.f.isSameAs(saf) {
-			log.Printf("Updating security context for API calls to Kubernetes")
+			util.Infof("Updating security context for API calls to Kubernetes")
+			ke.attachClients(saf, &ke.f)
 			ke.f = *saf
+			if ke.discovery != nil {
+				ke.discovery.clear()
+			}
 		}
 		ke.Unlock()
-		time.Sleep(time.Second * 600)
+	}
+}
+
+// close stops reloading the credentials, and closes idle connections.
+// Requests already running continue with the clients they have.
+func (ke *KubernetesEndpoint) close() {
+	close(ke.stop)
+	ke.RLock()
+	defer ke.RUnlock()
+	for _, c := range ke.f.contexts {
+		if c.client != nil {
+			c.client.CloseIdleConnections()
+		}
 	}
 }
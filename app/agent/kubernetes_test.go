@@ -0,0 +1,544 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/kubeconfig"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func makeTestKubernetesEndpoint() *KubernetesEndpoint {
+	return &KubernetesEndpoint{
+		f: kubeContexts{
+			current: "ctx1",
+			contexts: map[string]*kubeContext{
+				"ctx1": {username: "user1", serverURL: "https://ctx1.example.com"},
+				"ctx2": {username: "user2", serverURL: "https://ctx2.example.com"},
+			},
+		},
+	}
+}
+
+func TestKubernetesEndpoint_ContextNames(t *testing.T) {
+	ke := makeTestKubernetesEndpoint()
+	want := []string{"ctx1", "ctx2"}
+	if got := ke.ContextNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ContextNames() = %v, want %v", got, want)
+	}
+
+	sa := &KubernetesEndpoint{f: kubeContexts{contexts: map[string]*kubeContext{"": {username: "ServiceAccount"}}}}
+	if got := sa.ContextNames(); len(got) != 0 {
+		t.Errorf("ContextNames() for service account = %v, want none", got)
+	}
+}
+
+func TestKubernetesEndpoint_makeServerContextFields(t *testing.T) {
+	ke := makeTestKubernetesEndpoint()
+	tests := []struct {
+		name        string
+		contextName string
+		wantURL     string
+		wantErr     bool
+	}{
+		{"default", "", "https://ctx1.example.com", false},
+		{"current by name", "ctx1", "https://ctx1.example.com", false},
+		{"other context", "ctx2", "https://ctx2.example.com", false},
+		{"unknown context", "ctx3", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ke.makeServerContextFields(tt.contextName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("makeServerContextFields() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && c.serverURL != tt.wantURL {
+				t.Errorf("serverURL = %s, want %s", c.serverURL, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestKubernetesContextEndpoint_unknownContext(t *testing.T) {
+	ke := makeTestKubernetesEndpoint()
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 1)
+	req := &tunnel.HttpRequest{Id: "id1", Type: "kubernetes", Name: "ctx3", Method: "GET", URI: "/"}
+	ke.contextEndpoint("ctx3").executeHTTPRequest(dataflow, req, http.NoBody)
+
+	msg := <-dataflow
+	httpError := msg.GetHttpError()
+	if httpError == nil {
+		t.Fatalf("expected HttpError, got %T", msg.Event)
+	}
+	if httpError.Id != "id1" {
+		t.Errorf("expected id 'id1', got '%s'", httpError.Id)
+	}
+}
+
+func TestKubeContexts_isSameAs(t *testing.T) {
+	a := makeTestKubernetesEndpoint().f
+	b := makeTestKubernetesEndpoint().f
+	if !a.isSameAs(&b) {
+		t.Errorf("identical contexts should be the same")
+	}
+	b.current = "ctx2"
+	if a.isSameAs(&b) {
+		t.Errorf("different current context should differ")
+	}
+	c := makeTestKubernetesEndpoint().f
+	delete(c.contexts, "ctx2")
+	if a.isSameAs(&c) {
+		t.Errorf("missing context should differ")
+	}
+}
+
+func TestKubernetesEndpoint_reusesConnections(t *testing.T) {
+	var newConns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	ke := &KubernetesEndpoint{config: kubernetesConfig{MaxIdleConnsPerHost: 1, IdleConnTimeout: 30}}
+	kcs := &kubeContexts{
+		current:  "ctx1",
+		contexts: map[string]*kubeContext{"ctx1": {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}}},
+	}
+	ke.attachClients(kcs, nil)
+	ke.f = *kcs
+
+	for i := 0; i < 3; i++ {
+		dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+		req := &tunnel.HttpRequest{Id: "id1", Type: "kubernetes", Name: "ctx1", Method: "GET", URI: "/"}
+		ke.executeHTTPRequest(dataflow, req, http.NoBody)
+		msg := <-dataflow
+		if resp := msg.GetHttpResponse(); resp == nil || resp.Status != 200 {
+			t.Fatalf("request %d: expected a 200 response, got %v", i, msg.Event)
+		}
+	}
+	if n := atomic.LoadInt32(&newConns); n != 1 {
+		t.Errorf("expected sequential requests to share 1 connection, got %d", n)
+	}
+}
+
+func TestKubernetesEndpoint_attachClients(t *testing.T) {
+	ke := makeTestKubernetesEndpoint()
+	ke.attachClients(&ke.f, nil)
+	for name, c := range ke.f.contexts {
+		if c.client == nil {
+			t.Fatalf("context %s has no client", name)
+		}
+	}
+
+	updated := makeTestKubernetesEndpoint().f
+	updated.contexts["ctx2"].serverURL = "https://ctx2.example.net"
+	ke.attachClients(&updated, &ke.f)
+	if updated.contexts["ctx1"].client != ke.f.contexts["ctx1"].client {
+		t.Errorf("unchanged context should keep its client")
+	}
+	if updated.contexts["ctx2"].client == ke.f.contexts["ctx2"].client {
+		t.Errorf("changed context should get a new client")
+	}
+}
+
+func TestContextFromKubeconfig_credentials(t *testing.T) {
+	contents := `
+apiVersion: v1
+kind: Config
+clusters:
+- name: cluster
+  cluster:
+    server: https://k8s.example.com
+contexts:
+- name: token
+  context: {cluster: cluster, user: token}
+- name: basic
+  context: {cluster: cluster, user: basic}
+- name: exec
+  context: {cluster: cluster, user: exec}
+- name: bad-exec
+  context: {cluster: cluster, user: bad-exec}
+- name: none
+  context: {cluster: cluster, user: none}
+users:
+- name: token
+  user:
+    token: abc123
+- name: basic
+  user:
+    username: admin
+    password: s3cret
+- name: exec
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: aws
+      args: [eks, get-token]
+- name: bad-exec
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v2
+      command: aws
+- name: none
+  user: {}
+`
+	kconfig, err := kubeconfig.ReadKubeConfig(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		check   func(*kubeContext) bool
+		wantErr bool
+	}{
+		{"token", func(c *kubeContext) bool { return c.token == "abc123" }, false},
+		{"basic", func(c *kubeContext) bool { return c.basicUsername == "admin" && c.basicPassword == "s3cret" }, false},
+		{"exec", func(c *kubeContext) bool { return c.exec != nil && c.exec.config.Command == "aws" }, false},
+		{"bad-exec", nil, true},
+		{"none", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := contextFromKubeconfig(kconfig, tt.name, upstreamTLSConfig{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("contextFromKubeconfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(c) {
+				t.Errorf("unexpected context %#v", c)
+			}
+		})
+	}
+}
+
+func TestContextFromKubeconfig_caBundle(t *testing.T) {
+	// During a rotation, the cluster's CA data holds both CAs.
+	var bundle []byte
+	var authorities []*ca.CA
+	for i := 0; i < 2; i++ {
+		certPEM, keyPEM, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authority, err := ca.MakeCAFromData(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle = append(bundle, certPEM...)
+		authorities = append(authorities, authority)
+	}
+	contents := fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: ctx
+clusters:
+- name: cluster
+  cluster:
+    server: https://k8s.example.com
+    certificate-authority-data: %s
+contexts:
+- name: ctx
+  context: {cluster: cluster, user: token}
+users:
+- name: token
+  user:
+    token: abc123
+`, base64.StdEncoding.EncodeToString(bundle))
+	kconfig, err := kubeconfig.ReadKubeConfig(strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := contextFromKubeconfig(kconfig, "ctx", upstreamTLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.serverCAs) != 2 {
+		t.Fatalf("got %d server CAs, want 2", len(c.serverCAs))
+	}
+	for i, authority := range authorities {
+		serverCert, err := authority.MakeServerCert([]string{"k8s.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := x509.VerifyOptions{DNSName: "k8s.example.com", Roots: c.rootCAs()}
+		if _, err := leaf.Verify(opts); err != nil {
+			t.Errorf("server certificate from CA %d not trusted: %v", i, err)
+		}
+	}
+}
+
+func TestKubernetesEndpoint_requestCredentials(t *testing.T) {
+	authorization := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	failing, err := newExecCredential("failing", kubeconfig.ExecConfig{APIVersion: testExecAPIVersion, Command: "plugin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.run = func(ctx context.Context, config *kubeconfig.ExecConfig) ([]byte, error) {
+		return nil, errors.New("no credentials")
+	}
+	working, err := newExecCredential("working", kubeconfig.ExecConfig{APIVersion: testExecAPIVersion, Command: "plugin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	working.run = func(ctx context.Context, config *kubeconfig.ExecConfig) ([]byte, error) {
+		return []byte(`{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"exec-token"}}`), nil
+	}
+
+	ke := &KubernetesEndpoint{config: kubernetesConfig{MaxIdleConnsPerHost: 1, IdleConnTimeout: 30}}
+	kcs := &kubeContexts{
+		current: "token",
+		contexts: map[string]*kubeContext{
+			"token":   {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}, token: "abc123"},
+			"basic":   {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}, basicUsername: "admin", basicPassword: "s3cret"},
+			"working": {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}, exec: working},
+			"failing": {serverURL: srv.URL, serverCAs: []*x509.Certificate{srv.Certificate()}, exec: failing},
+		},
+	}
+	ke.attachClients(kcs, nil)
+	ke.f = *kcs
+
+	tests := []struct {
+		context           string
+		wantAuthorization string
+	}{
+		{"token", "Bearer abc123"},
+		{"basic", "Basic YWRtaW46czNjcmV0"},
+		{"working", "Bearer exec-token"},
+		{"failing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.context, func(t *testing.T) {
+			dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+			req := &tunnel.HttpRequest{Id: "id1", Type: "kubernetes", Name: tt.context, Method: "GET", URI: "/"}
+			ke.contextEndpoint(tt.context).executeHTTPRequest(dataflow, req, http.NoBody)
+			msg := <-dataflow
+			if tt.wantAuthorization == "" {
+				if msg.GetHttpError() == nil {
+					t.Fatalf("expected an HttpError when the plugin fails, got %T", msg.Event)
+				}
+				return
+			}
+			if resp := msg.GetHttpResponse(); resp == nil || resp.Status != 200 {
+				t.Fatalf("expected a 200 response, got %v", msg.Event)
+			}
+			if got := <-authorization; got != tt.wantAuthorization {
+				t.Errorf("expected Authorization '%s', got '%s'", tt.wantAuthorization, got)
+			}
+		})
+	}
+}
+
+func TestKubernetesEndpoint_kubeconfigPaths(t *testing.T) {
+	oldFlag := *kubeconfigFlag
+	oldEnv, envSet := os.LookupEnv("KUBECONFIG")
+	defer func() {
+		*kubeconfigFlag = oldFlag
+		if envSet {
+			os.Setenv("KUBECONFIG", oldEnv)
+		} else {
+			os.Unsetenv("KUBECONFIG")
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		config string
+		flag   string
+		env    string
+		want   []string
+	}{
+		{"default", "", "", "", []string{defaultKubeConfig}},
+		{"env", "", "", "/a:/b", []string{"/a", "/b"}},
+		{"flag overrides env", "", "/c", "/a:/b", []string{"/c"}},
+		{"endpoint config overrides both", "/d:/e", "/c", "/a:/b", []string{"/d", "/e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*kubeconfigFlag = tt.flag
+			os.Setenv("KUBECONFIG", tt.env)
+			ke := &KubernetesEndpoint{config: kubernetesConfig{KubeConfig: tt.config}}
+			if got := ke.kubeconfigPaths(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kubeconfigPaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeContext_applyTLS(t *testing.T) {
+	ca := makeTestCAFile(t)
+
+	tests := []struct {
+		name     string
+		context  kubeContext
+		tls      upstreamTLSConfig
+		wantMode string
+		wantErr  bool
+	}{
+		{"verified", kubeContext{serverURL: "https://k8s"}, upstreamTLSConfig{}, tunnel.TLSModeVerified, false},
+		{"plaintext", kubeContext{serverURL: "http://k8s"}, upstreamTLSConfig{}, tunnel.TLSModePlaintext, false},
+		{"insecure", kubeContext{serverURL: "https://k8s", insecure: true}, upstreamTLSConfig{}, tunnel.TLSModeInsecure, false},
+		{"server name", kubeContext{serverURL: "https://k8s"}, upstreamTLSConfig{ServerName: "api.example.com"}, tunnel.TLSModeCustom, false},
+		{"CA overrides insecure", kubeContext{serverURL: "https://k8s", insecure: true}, upstreamTLSConfig{CAFile: ca}, tunnel.TLSModeCustom, false},
+		{"missing CA", kubeContext{serverURL: "https://k8s"}, upstreamTLSConfig{CAFile: ca + ".missing"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.context
+			err := c.applyTLS(tt.tls)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyTLS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := c.tlsMode(); got != tt.wantMode {
+				t.Errorf("tlsMode() = %s, want %s", got, tt.wantMode)
+			}
+			if c.serverName != tt.tls.ServerName {
+				t.Errorf("serverName = %s, want %s", c.serverName, tt.tls.ServerName)
+			}
+			if tt.tls.CAFile != "" && c.rootCAs() == nil {
+				t.Errorf("rootCAs() = nil with a CA file")
+			}
+		})
+	}
+}
+
+func TestKubernetesConfig_tlsFor(t *testing.T) {
+	c := kubernetesConfig{
+		TLS: upstreamTLSConfig{ServerName: "default"},
+		ContextTLS: map[string]upstreamTLSConfig{
+			"ctx2": {ServerName: "ctx2"},
+		},
+	}
+	if got := c.tlsFor("ctx1").ServerName; got != "default" {
+		t.Errorf("tlsFor(ctx1) = %s, want default", got)
+	}
+	if got := c.tlsFor("ctx2").ServerName; got != "ctx2" {
+		t.Errorf("tlsFor(ctx2) = %s, want ctx2", got)
+	}
+}
+
+func TestKubernetesConfig_proxyFor(t *testing.T) {
+	c := kubernetesConfig{
+		ProxyURL: "http://proxy.example.com:3128",
+		ContextProxyURL: map[string]string{
+			"ctx2": "socks5://socks.example.com:1080",
+			"ctx3": "ftp://proxy.example.com",
+		},
+	}
+	if got, err := c.proxyFor("ctx1"); err != nil || got.String() != "http://proxy.example.com:3128" {
+		t.Errorf("proxyFor(ctx1) = %v, %v, want the default proxy", got, err)
+	}
+	if got, err := c.proxyFor("ctx2"); err != nil || got.String() != "socks5://socks.example.com:1080" {
+		t.Errorf("proxyFor(ctx2) = %v, %v, want the context's proxy", got, err)
+	}
+	if _, err := c.proxyFor("ctx3"); err == nil {
+		t.Errorf("proxyFor(ctx3) should fail for an ftp proxy")
+	}
+	if got, err := (kubernetesConfig{}).proxyFor("ctx1"); err != nil || got != nil {
+		t.Errorf("proxyFor() = %v, %v, want nil to use the environment", got, err)
+	}
+}
+
+func TestKubernetesEndpoint_proxy(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	proxy := startSOCKSProxy(t, "")
+
+	ke := &KubernetesEndpoint{config: kubernetesConfig{MaxIdleConnsPerHost: 1, IdleConnTimeout: 30}}
+	kcs := &kubeContexts{
+		current: "ctx1",
+		contexts: map[string]*kubeContext{"ctx1": {
+			serverURL: srv.URL,
+			serverCAs: []*x509.Certificate{srv.Certificate()},
+			proxyURL:  proxy.url(),
+		}},
+	}
+	ke.attachClients(kcs, nil)
+	ke.f = *kcs
+
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	req := &tunnel.HttpRequest{Id: "id1", Type: "kubernetes", Name: "ctx1", Method: "GET", URI: "/"}
+	ke.executeHTTPRequest(dataflow, req, http.NoBody)
+	msg := <-dataflow
+	if resp := msg.GetHttpResponse(); resp == nil || resp.Status != 200 {
+		t.Fatalf("expected a 200 response, got %v", msg.Event)
+	}
+	if got := proxy.connected(); len(got) != 1 || got[0] != srv.Listener.Addr().String() {
+		t.Errorf("proxy connected to %v, want %s", got, srv.Listener.Addr())
+	}
+
+	// Changing the proxy gives the context a new client.
+	updated := &kubeContexts{
+		current: "ctx1",
+		contexts: map[string]*kubeContext{"ctx1": {
+			serverURL: srv.URL,
+			serverCAs: []*x509.Certificate{srv.Certificate()},
+		}},
+	}
+	ke.attachClients(updated, kcs)
+	if updated.contexts["ctx1"].client == kcs.contexts["ctx1"].client {
+		t.Errorf("context with a new proxy should get a new client")
+	}
+}
+
+// makeTestCAFile writes the certificate of a test TLS server to a PEM file.
+func makeTestCAFile(t *testing.T) string {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(filename, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
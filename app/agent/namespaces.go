@@ -0,0 +1,84 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// kubernetesNamespaceFromURI returns the namespace a Kubernetes API request
+// targets, or "" for a cluster-scoped request such as /api/v1/nodes.  Both
+// the core group (/api/v1/...) and named groups (/apis/group/version/...)
+// are understood, as is the deprecated /watch/ path prefix.  A request for
+// a namespace object itself, /api/v1/namespaces/name, targets that
+// namespace.  Paths which are not in canonical form are an error, so
+// "/api/v1/namespaces/allowed/../../nodes" cannot slip past the check.
+func kubernetesNamespaceFromURI(uri string) (string, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", err
+	}
+	p := u.Path
+	if clean := path.Clean(p); p != clean && p != clean+"/" {
+		return "", fmt.Errorf("request path '%s' is not canonical", p)
+	}
+
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return "", nil
+	}
+	if len(parts) > 0 && parts[0] == "watch" {
+		parts = parts[1:]
+	}
+	if len(parts) >= 2 && parts[0] == "namespaces" && parts[1] != "" {
+		return parts[1], nil
+	}
+	return "", nil
+}
+
+// checkNamespace returns an error if the request is not allowed by the
+// endpoint's namespace list.  Only kubernetes endpoints with a non-empty
+// list are restricted.
+func checkNamespace(ep *configuredEndpoint, uri string) error {
+	if ep.Type != "kubernetes" || len(ep.Namespace) == 0 {
+		return nil
+	}
+	namespace, err := kubernetesNamespaceFromURI(uri)
+	if err != nil {
+		return err
+	}
+	if namespace == "" {
+		if ep.allowClusterScoped {
+			return nil
+		}
+		return fmt.Errorf("cluster-scoped requests are not allowed on endpoint %s", ep.Name)
+	}
+	for _, ns := range ep.Namespace {
+		if ns == namespace {
+			return nil
+		}
+	}
+	return fmt.Errorf("namespace '%s' is not allowed on endpoint %s", namespace, ep.Name)
+}
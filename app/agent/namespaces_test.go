@@ -0,0 +1,145 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/opsmx/oes-birger/app/agent/cfg"
+)
+
+func TestKubernetesNamespaceFromURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    string
+		wantErr bool
+	}{
+		{"core namespaced", "/api/v1/namespaces/ns1/pods", "ns1", false},
+		{"core named resource", "/api/v1/namespaces/ns1/pods/foo", "ns1", false},
+		{"core subresource", "/api/v1/namespaces/ns1/pods/foo/exec?command=ls&stdout=true", "ns1", false},
+		{"core log subresource", "/api/v1/namespaces/ns1/pods/foo/log?follow=true", "ns1", false},
+		{"group namespaced", "/apis/apps/v1/namespaces/ns2/deployments", "ns2", false},
+		{"group subresource", "/apis/apps/v1/namespaces/ns2/deployments/foo/scale", "ns2", false},
+		{"watch query", "/api/v1/namespaces/ns1/pods?watch=true&resourceVersion=10", "ns1", false},
+		{"legacy watch path", "/api/v1/watch/namespaces/ns1/pods", "ns1", false},
+		{"legacy group watch path", "/apis/apps/v1/watch/namespaces/ns2/deployments", "ns2", false},
+		{"namespace object", "/api/v1/namespaces/ns1", "ns1", false},
+		{"namespace status", "/api/v1/namespaces/ns1/status", "ns1", false},
+		{"trailing slash", "/api/v1/namespaces/ns1/pods/", "ns1", false},
+		{"namespace list", "/api/v1/namespaces", "", false},
+		{"cluster-scoped core", "/api/v1/nodes", "", false},
+		{"cluster-scoped watch", "/api/v1/nodes?watch=1", "", false},
+		{"cluster-scoped group", "/apis/rbac.authorization.k8s.io/v1/clusterroles", "", false},
+		{"all namespaces", "/apis/apps/v1/deployments", "", false},
+		{"discovery", "/apis", "", false},
+		{"version", "/version", "", false},
+		{"root", "/", "", false},
+		{"dot-dot", "/api/v1/namespaces/ns1/../../nodes", "", true},
+		{"double slash", "/api/v1/namespaces//pods", "", true},
+		{"relative", "api/v1/nodes", "", true},
+		{"empty", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := kubernetesNamespaceFromURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("kubernetesNamespaceFromURI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("kubernetesNamespaceFromURI() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckNamespace(t *testing.T) {
+	restricted := &configuredEndpoint{Type: "kubernetes", Name: "k1", Namespace: []string{"ns1", "ns2"}}
+	clusterOK := &configuredEndpoint{Type: "kubernetes", Name: "k2", Namespace: []string{"ns1"}, allowClusterScoped: true}
+	unrestricted := &configuredEndpoint{Type: "kubernetes", Name: "k3"}
+	generic := &configuredEndpoint{Type: "jenkins", Name: "j1", Namespace: []string{"ns1"}}
+
+	tests := []struct {
+		name    string
+		ep      *configuredEndpoint
+		uri     string
+		wantErr bool
+	}{
+		{"allowed namespace", restricted, "/api/v1/namespaces/ns2/pods", false},
+		{"other namespace", restricted, "/api/v1/namespaces/ns3/pods", true},
+		{"cluster-scoped denied", restricted, "/api/v1/nodes", true},
+		{"all namespaces denied", restricted, "/api/v1/pods", true},
+		{"cluster-scoped allowed", clusterOK, "/api/v1/nodes", false},
+		{"other namespace with cluster-scoped allowed", clusterOK, "/api/v1/namespaces/ns3/pods", true},
+		{"not canonical", restricted, "/api/v1/namespaces/ns1/../ns3/pods", true},
+		{"unrestricted", unrestricted, "/api/v1/namespaces/ns3/pods", false},
+		{"not kubernetes", generic, "/api/v1/namespaces/ns3/pods", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkNamespace(tt.ep, tt.uri); (err != nil) != tt.wantErr {
+				t.Errorf("checkNamespace() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildEndpoints_contextNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfigPath := filepath.Join(dir, "kubeconfig.yaml")
+	servicesPath := filepath.Join(dir, "services.yaml")
+	writeTestFile(t, kubeconfigPath, makeReloadKubeconfig("ctx1", "ctx2"))
+	writeTestFile(t, servicesPath, fmt.Sprintf(`services:
+- name: k8s
+  type: kubernetes
+  enabled: true
+  config:
+    kubeConfig: %s
+  namespaces:
+  - name: k8s-team
+    namespaces: [team]
+`, kubeconfigPath))
+	serviceConfig, err := cfg.LoadServiceConfig(servicesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := buildEndpoints(serviceConfig, &FakeSecretLoader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeEndpoints(endpoints)
+
+	// The kubeconfig contexts are as restricted as the service.
+	for _, name := range []string{"k8s-team", "ctx1", "ctx2"} {
+		ep := findEndpoint(endpoints, "kubernetes", name)
+		if ep == nil {
+			t.Errorf("no endpoint %s", name)
+			continue
+		}
+		if err := checkNamespace(ep, "/api/v1/namespaces/team/pods"); err != nil {
+			t.Errorf("%s: request for an allowed namespace: %v", name, err)
+		}
+		if err := checkNamespace(ep, "/api/v1/namespaces/other/pods"); err == nil {
+			t.Errorf("%s: request for another namespace was allowed", name)
+		}
+		if err := checkNamespace(ep, "/api/v1/nodes"); err == nil {
+			t.Errorf("%s: cluster-scoped request was allowed", name)
+		}
+	}
+}
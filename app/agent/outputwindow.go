@@ -0,0 +1,153 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"sync"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// outputWindow limits how much of a command's output may be sent before
+// the controller acknowledges it, so a command writing faster than the
+// command-tool reads is paused rather than filling memory along the way.
+// A nil window places no limit.
+type outputWindow struct {
+	sync.Mutex
+	cond     *sync.Cond
+	size     uint64
+	sent     uint64
+	consumed uint64
+	closed   bool
+}
+
+func newOutputWindow(size uint64) *outputWindow {
+	w := &outputWindow{size: size}
+	w.cond = sync.NewCond(&w.Mutex)
+	return w
+}
+
+// wait blocks until output may be sent, and returns how many bytes, up to
+// max, may be read.  Nothing is reserved, since the stdout and stderr
+// senders share a window and one may wait a long time in Read, so the
+// two may together overrun the window by up to its size.  Once the window
+// is closed there is no limit.
+func (w *outputWindow) wait(max int) int {
+	if w == nil {
+		return max
+	}
+	w.Lock()
+	defer w.Unlock()
+	for !w.closed && w.sent-w.consumed >= w.size {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return max
+	}
+	if available := w.size - (w.sent - w.consumed); uint64(max) > available {
+		max = int(available)
+	}
+	return max
+}
+
+// record counts n bytes read for sending.
+func (w *outputWindow) record(n int) {
+	if w == nil || n == 0 {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.sent += uint64(n)
+}
+
+// ack records that consumed bytes in total have been written by the
+// command-tool.
+func (w *outputWindow) ack(consumed uint64) {
+	w.Lock()
+	defer w.Unlock()
+	if consumed > w.sent {
+		consumed = w.sent
+	}
+	if consumed > w.consumed {
+		w.consumed = consumed
+		w.cond.Broadcast()
+	}
+}
+
+// close removes the limit, so nothing waiting for an ack is left blocked
+// once the command is cancelled or the tunnel closes.
+func (w *outputWindow) close() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+var outputWindowRegistry = struct {
+	sync.Mutex
+	m map[string]*outputWindow
+}{m: make(map[string]*outputWindow)}
+
+// commandOutputWindow registers the command to receive CommandAck
+// messages, and returns its window.  If the request has no window, nil is
+// returned.  This must be called from the tunnel receive loop, so no ack
+// can arrive before it is registered.
+func commandOutputWindow(req *tunnel.CommandRequest) *outputWindow {
+	return registerOutputWindow(req.Id, req.Window)
+}
+
+// fileOutputWindow registers a file transfer to receive CommandAck
+// messages, as commandOutputWindow does for a command.
+func fileOutputWindow(req *tunnel.FileRequest) *outputWindow {
+	return registerOutputWindow(req.Id, req.Window)
+}
+
+func registerOutputWindow(id string, size uint64) *outputWindow {
+	if size == 0 {
+		return nil
+	}
+	w := newOutputWindow(size)
+	outputWindowRegistry.Lock()
+	outputWindowRegistry.m[id] = w
+	outputWindowRegistry.Unlock()
+	return w
+}
+
+// ackCommandOutput is called from the tunnel receive loop with each
+// CommandAck message.
+func ackCommandOutput(ack *tunnel.CommandAck) {
+	outputWindowRegistry.Lock()
+	w, ok := outputWindowRegistry.m[ack.Id]
+	outputWindowRegistry.Unlock()
+	if ok {
+		w.ack(ack.Consumed)
+	}
+}
+
+// closeCommandOutputWindow closes and unregisters the window for the
+// command id.
+func closeCommandOutputWindow(id string) {
+	outputWindowRegistry.Lock()
+	defer outputWindowRegistry.Unlock()
+	if w, ok := outputWindowRegistry.m[id]; ok {
+		w.close()
+		delete(outputWindowRegistry.m, id)
+	}
+}
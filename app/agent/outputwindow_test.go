@@ -0,0 +1,117 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// waitAsync calls wait in the background, returning a channel which
+// receives its result.
+func waitAsync(w *outputWindow, max int) chan int {
+	c := make(chan int, 1)
+	go func() { c <- w.wait(max) }()
+	return c
+}
+
+func expectBlocked(t *testing.T, c chan int) {
+	t.Helper()
+	select {
+	case n := <-c:
+		t.Fatalf("wait returned %d, expected it to block", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func expectAllowed(t *testing.T, c chan int, want int) {
+	t.Helper()
+	select {
+	case n := <-c:
+		if n != want {
+			t.Errorf("wait returned %d, want %d", n, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("wait did not return")
+	}
+}
+
+func TestOutputWindow(t *testing.T) {
+	w := newOutputWindow(100)
+	if n := w.wait(60); n != 60 {
+		t.Errorf("wait(60) = %d, want 60", n)
+	}
+	w.record(60)
+	if n := w.wait(60); n != 40 {
+		t.Errorf("wait(60) = %d, want the 40 remaining", n)
+	}
+	w.record(40)
+
+	c := waitAsync(w, 60)
+	expectBlocked(t, c)
+	w.ack(50)
+	expectAllowed(t, c, 50)
+
+	// An ack never counts more than was sent, nor goes backwards.
+	w.ack(1000)
+	w.ack(10)
+	if n := w.wait(1000); n != 100 {
+		t.Errorf("wait(1000) = %d, want 100", n)
+	}
+	w.record(100)
+
+	c = waitAsync(w, 60)
+	expectBlocked(t, c)
+	w.close()
+	expectAllowed(t, c, 60)
+	if n := w.wait(1000); n != 1000 {
+		t.Errorf("wait(1000) = %d after close, want 1000", n)
+	}
+}
+
+func TestOutputWindow_nil(t *testing.T) {
+	var w *outputWindow
+	if n := w.wait(1000); n != 1000 {
+		t.Errorf("wait(1000) = %d, want 1000", n)
+	}
+	w.record(1000)
+	w.close()
+}
+
+func TestCommandOutputWindow(t *testing.T) {
+	if w := commandOutputWindow(&tunnel.CommandRequest{Id: "no-window"}); w != nil {
+		t.Errorf("expected no window when the request has none")
+	}
+
+	w := commandOutputWindow(&tunnel.CommandRequest{Id: "window", Window: 10})
+	defer closeCommandOutputWindow("window")
+	w.record(10)
+	c := waitAsync(w, 10)
+	expectBlocked(t, c)
+	ackCommandOutput(&tunnel.CommandAck{Id: "other", Consumed: 10})
+	expectBlocked(t, c)
+	ackCommandOutput(&tunnel.CommandAck{Id: "window", Consumed: 4})
+	expectAllowed(t, c, 4)
+
+	w.record(4)
+	c = waitAsync(w, 10)
+	expectBlocked(t, c)
+	closeCommandOutputWindow("window")
+	expectAllowed(t, c, 10)
+}
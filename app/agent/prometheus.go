@@ -0,0 +1,162 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tevino/abool"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+var (
+	reconnectAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "agent_reconnect_attempts_total",
+		Help: "The number of times the agent has tried to reconnect to the controller",
+	})
+
+	requestsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_requests_total",
+		Help: "The number of HTTP requests received from the controller",
+	}, []string{"type"})
+
+	upstreamLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "agent_upstream_request_duration_seconds",
+		Help:    "Time until the upstream service returned response headers",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+
+	tunnelBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_tunnel_bytes_total",
+		Help: "The number of message bytes sent and received over the tunnel",
+	}, []string{"direction"})
+
+	kubernetesContextHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "agent_kubernetes_context_healthy",
+		Help: "Set to 0 if the exec credential plugin for a kubeconfig context last failed, and 1 if it succeeded",
+	}, []string{"context"})
+
+	discoveryCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_kubernetes_discovery_cache_requests_total",
+		Help: "The number of Kubernetes discovery requests served from the cache (hit) or sent upstream (miss)",
+	}, []string{"result"})
+
+	cancelsAcked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "agent_cancels_acked_total",
+		Help: "The number of cancel requests from the controller which were acknowledged, excluding duplicates",
+	})
+
+	lateMessagesDiscarded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "agent_late_messages_discarded_total",
+		Help: "The number of messages from the controller discarded because their request was already cancelled",
+	})
+
+	requestsRefusedDraining = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "agent_requests_refused_draining_total",
+		Help: "The number of requests from the controller refused because the agent was shutting down",
+	})
+
+	certificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "agent_certificate_expiry_timestamp_seconds",
+		Help: "When the certificate the agent presents to the controller expires, in seconds since the Unix epoch",
+	})
+
+	certificateRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_certificate_renewals_total",
+		Help: "The number of attempts to renew the agent certificate, by result: renewed or failed",
+	}, []string{"result"})
+
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "agent_config_reloads_total",
+		Help: "The number of times the endpoints were rebuilt after the configuration changed, by whether it succeeded or the new configuration was rejected",
+	}, []string{"result"})
+
+	pingRoundTrip = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "agent_ping_rtt_seconds",
+		Help: "The round-trip time of the most recent ping to the controller",
+	})
+
+	// tunnelConnected is set while a tunnel to the controller is
+	// established and the hello has been sent.
+	tunnelConnected = abool.New()
+)
+
+func countSent(m proto.Message) {
+	tunnelBytes.WithLabelValues("sent").Add(float64(proto.Size(m)))
+}
+
+func countReceived(m proto.Message) {
+	tunnelBytes.WithLabelValues("received").Add(float64(proto.Size(m)))
+}
+
+// recordPingResponse updates the round-trip time from the timestamp
+// the controller echoes back from our PingRequest.
+func recordPingResponse(resp *tunnel.PingResponse, now time.Time) {
+	if rtt, ok := tunnel.RoundTripTime(resp, now); ok {
+		pingRoundTrip.Set(rtt.Seconds())
+	}
+}
+
+// debugVars returns the agent's state for /debug/vars.  It holds only
+// counts, so it stays small and cheap to serve.
+func debugVars() map[string]interface{} {
+	return map[string]interface{}{
+		"connectedSessions":  atomic.LoadInt32(&connectedSessions),
+		"runningRequests":    atomic.LoadInt64(&runningRequests),
+		"streamingResponses": responseChunks.streaming(),
+		"pausedResponses":    responseChunks.paused(),
+	}
+}
+
+// healthcheck returns 200 only while the tunnel to the controller is up.
+func healthcheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if tunnelConnected.IsNotSet() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"connected":false}`))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"connected":true}`))
+}
+
+func runPrometheusHTTPServer(port uint16) {
+	util.Infof("Running HTTP listener for Prometheus on port %d", port)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health", healthcheck)
+	if *enableDebugEndpoints {
+		util.Warnf("Debug endpoints are enabled on port %d", port)
+		mux.Handle("/debug/", util.DebugHandler(debugVars))
+	}
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
+	}
+	util.Fatalf("%v", server.ListenAndServe())
+}
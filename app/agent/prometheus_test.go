@@ -0,0 +1,68 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestHealthcheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		connected  bool
+		wantStatus int
+	}{
+		{"disconnected", false, http.StatusServiceUnavailable},
+		{"connected", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnelConnected.SetTo(tt.connected)
+			defer tunnelConnected.UnSet()
+
+			w := httptest.NewRecorder()
+			healthcheck(w, httptest.NewRequest("GET", "/health", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestRecordPingResponse(t *testing.T) {
+	now := time.Now()
+	sent := now.Add(-250 * time.Millisecond)
+
+	pingRoundTrip.Set(0)
+	recordPingResponse(&tunnel.PingResponse{Ts: uint64(now.UnixNano()), EchoedTs: uint64(sent.UnixNano())}, now)
+	if got := testutil.ToFloat64(pingRoundTrip); got != 0.25 {
+		t.Errorf("expected rtt 0.25, got %v", got)
+	}
+
+	// A response without an echoed timestamp leaves the last value alone.
+	recordPingResponse(&tunnel.PingResponse{Ts: uint64(now.UnixNano())}, now)
+	if got := testutil.ToFloat64(pingRoundTrip); got != 0.25 {
+		t.Errorf("expected rtt 0.25, got %v", got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc dials an address, as gRPC's context dialer does.
+type dialFunc func(ctx context.Context, address string) (net.Conn, error)
+
+// upstreamProxy returns the Proxy for a transport to an upstream service:
+// proxyURL if set, otherwise the one from HTTPS_PROXY, HTTP_PROXY, and
+// NO_PROXY.  http.Transport handles socks5 proxies itself.
+func upstreamProxy(proxyURL *url.URL) func(*http.Request) (*url.URL, error) {
+	if proxyURL == nil {
+		return http.ProxyFromEnvironment
+	}
+	return http.ProxyURL(proxyURL)
+}
+
+// controllerDialer returns the dialer for the gRPC connection to the
+// controller.  It connects through proxyURL if set, otherwise through the
+// proxy the environment gives for an https URL to the address, if any.
+// The environment is read on each dial, unlike http.ProxyFromEnvironment.
+func controllerDialer(proxyURL *url.URL) dialFunc {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		p := proxyURL
+		if p == nil {
+			var err error
+			p, err = httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: address})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return dialThroughProxy(ctx, p, address)
+	}
+}
+
+// dialThroughProxy connects to address through p, or directly if p is nil.
+func dialThroughProxy(ctx context.Context, p *url.URL, address string) (net.Conn, error) {
+	direct := &net.Dialer{}
+	if p == nil {
+		return direct.DialContext(ctx, "tcp", address)
+	}
+	switch p.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if p.User != nil {
+			password, _ := p.User.Password()
+			auth = &proxy.Auth{User: p.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", p.Host, auth, direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	case "http", "https":
+		return dialConnect(ctx, direct, p, address)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme '%s'", p.Scheme)
+}
+
+// dialConnect connects to address through an HTTP proxy with CONNECT.
+func dialConnect(ctx context.Context, direct *net.Dialer, p *url.URL, address string) (net.Conn, error) {
+	proxyAddress := p.Host
+	if p.Port() == "" {
+		port := "80"
+		if p.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddress = net.JoinHostPort(p.Hostname(), port)
+	}
+	conn, err := direct.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if p.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{MinVersion: tls.VersionTLS12, ServerName: p.Hostname()})
+	}
+
+	// The handshake must not outlive the context's deadline.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", p.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", p.Host, err)
+	}
+	// The body of a successful response is the tunnel itself, so it is
+	// left unread.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT to %s: %s", p.Host, address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection some of whose input has already been read
+// into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,278 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// socksProxy is a minimal SOCKS5 server, without authentication, which
+// records the address of each CONNECT.  If backend is set, every
+// connection goes there instead, so names need not resolve.
+type socksProxy struct {
+	sync.Mutex
+	listener net.Listener
+	backend  string
+	targets  []string
+}
+
+func startSOCKSProxy(t *testing.T, backend string) *socksProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &socksProxy{listener: l, backend: backend}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *socksProxy) url() *url.URL {
+	return &url.URL{Scheme: "socks5", Host: p.listener.Addr().String()}
+}
+
+func (p *socksProxy) connected() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.targets...)
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	// Greeting: version, method count, methods.  Only "no auth" is offered.
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Request: version, CONNECT, reserved, address type, address, port.
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		n := buf[0]
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return
+		}
+		host = string(buf[:n])
+	case 4:
+		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
+			return
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	p.Lock()
+	p.targets = append(p.targets, target)
+	p.Unlock()
+
+	if p.backend != "" {
+		target = p.backend
+	}
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		upstream.Close()
+		return
+	}
+	relay(conn, upstream)
+}
+
+// relay copies between a and b until either closes, then closes both.
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { _, _ = io.Copy(a, b); done <- struct{}{} }()
+	go func() { _, _ = io.Copy(b, a); done <- struct{}{} }()
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// startGRPCServer starts a gRPC server with no services, which is enough
+// for a blocking dial to complete.
+func startGRPCServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(s.Stop)
+	return l.Addr().String()
+}
+
+func dialGRPC(t *testing.T, address string, dial dialFunc) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithContextDialer(dial))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestControllerDialer_socks5(t *testing.T) {
+	address := startGRPCServer(t)
+	proxy := startSOCKSProxy(t, "")
+
+	if err := dialGRPC(t, address, controllerDialer(proxy.url())); err != nil {
+		t.Fatal(err)
+	}
+	if got := proxy.connected(); len(got) == 0 || got[0] != address {
+		t.Errorf("proxy connected to %v, want %s", got, address)
+	}
+}
+
+func TestControllerDialer_environment(t *testing.T) {
+	address := startGRPCServer(t)
+	proxy := startSOCKSProxy(t, address)
+
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		old, found := os.LookupEnv(name)
+		os.Unsetenv(name)
+		if found {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	os.Setenv("HTTPS_PROXY", proxy.url().String())
+
+	// Loopback addresses are never proxied, so the controller is named.
+	if err := dialGRPC(t, "controller.example.com:9001", controllerDialer(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := proxy.connected(); len(got) == 0 || got[0] != "controller.example.com:9001" {
+		t.Errorf("proxy connected to %v, want controller.example.com:9001", got)
+	}
+
+	// A configured proxy is used over the environment's.
+	other := startSOCKSProxy(t, address)
+	if err := dialGRPC(t, "controller.example.com:9001", controllerDialer(other.url())); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.connected()) != 1 || len(proxy.connected()) != 1 {
+		t.Errorf("expected only the configured proxy to be used")
+	}
+}
+
+func TestControllerDialer_connect(t *testing.T) {
+	address := startGRPCServer(t)
+	var mu sync.Mutex
+	var targets, auths []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		targets = append(targets, r.Host)
+		auths = append(auths, r.Header.Get("Proxy-Authorization"))
+		mu.Unlock()
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+		relay(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("agent", "s3cret")
+	if err := dialGRPC(t, address, controllerDialer(proxyURL)); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(targets) == 0 || targets[0] != address {
+		t.Errorf("proxy connected to %v, want %s", targets, address)
+	}
+	if len(auths) == 0 || auths[0] != "Basic YWdlbnQ6czNjcmV0" {
+		t.Errorf("Proxy-Authorization = %v, want agent's credentials", auths)
+	}
+}
+
+func TestControllerDialer_connectRefused(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := controllerDialer(proxyURL)(ctx, "controller.example.com:9001")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/opsmx/oes-birger/app/agent/cfg"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How long to wait after a change before reloading, so a file written in
+// several steps, or a volume update touching several files, is loaded once.
+const defaultConfigReloadDelay = 2 * time.Second
+
+// endpointTable holds the endpoints requests are routed to.  A reload
+// replaces them all at once, and requests already running carry on with
+// the instance they were given.
+type endpointTable struct {
+	sync.RWMutex
+	endpoints []configuredEndpoint
+
+	// changed is closed and replaced whenever the endpoints are.
+	changed chan struct{}
+}
+
+func newEndpointTable(endpoints []configuredEndpoint) *endpointTable {
+	return &endpointTable{
+		endpoints: endpoints,
+		changed:   make(chan struct{}),
+	}
+}
+
+// current returns the endpoints in use.  The slice is never modified.
+func (t *endpointTable) current() []configuredEndpoint {
+	t.RLock()
+	defer t.RUnlock()
+	return t.endpoints
+}
+
+// get returns the endpoints in use, and a channel which is closed when
+// they are next replaced.
+func (t *endpointTable) get() ([]configuredEndpoint, <-chan struct{}) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.endpoints, t.changed
+}
+
+// replace puts new endpoints in use, and returns those they replaced.
+func (t *endpointTable) replace(endpoints []configuredEndpoint) []configuredEndpoint {
+	t.Lock()
+	defer t.Unlock()
+	old := t.endpoints
+	t.endpoints = endpoints
+	close(t.changed)
+	t.changed = make(chan struct{})
+	return old
+}
+
+// endpointCloser is implemented by endpoints which have something to stop
+// once they are replaced.
+type endpointCloser interface {
+	close()
+}
+
+// closeEndpoints closes each instance once, as several endpoints may
+// share one.
+func closeEndpoints(endpoints []configuredEndpoint) {
+	closed := map[endpointCloser]bool{}
+	for _, ep := range endpoints {
+		c, ok := ep.instance.(endpointCloser)
+		if !ok || closed[c] {
+			continue
+		}
+		closed[c] = true
+		c.close()
+	}
+}
+
+// advertiseEndpoints sends the endpoints to the controller each time they
+// are replaced, until ctx is done.  changed is from the get the hello was
+// built from, so no change is missed.
+func advertiseEndpoints(ctx context.Context, endpoints *endpointTable, changed <-chan struct{}, dataflow chan *tunnel.AgentToControllerWrapper) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+		var current []configuredEndpoint
+		current, changed = endpoints.get()
+		dataflow <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_EndpointsUpdate{
+				EndpointsUpdate: &tunnel.EndpointsUpdate{Endpoints: endpointsToPB(current)},
+			},
+		}
+	}
+}
+
+// configWatcher rebuilds the endpoints when the services config, or a
+// kubeconfig they read, changes.  The directories holding the files are
+// watched rather than the files themselves, as Kubernetes updates a
+// mounted ConfigMap or Secret by replacing a symlink beside them.  Other
+// files there may change too, so the endpoints are only rebuilt if the
+// contents of the files they came from did.
+type configWatcher struct {
+	path      string
+	endpoints *endpointTable
+	build     func(*cfg.AgentServiceConfig) ([]configuredEndpoint, error)
+	delay     time.Duration
+
+	// files are those the endpoints in use came from, and fingerprint
+	// hashes their contents.  rejected is the fingerprint of the last
+	// invalid configuration, so it is not tried again.
+	files       []string
+	fingerprint string
+	rejected    string
+
+	// watched holds the directories being watched.
+	watched map[string]bool
+}
+
+func newConfigWatcher(path string, endpoints *endpointTable, build func(*cfg.AgentServiceConfig) ([]configuredEndpoint, error)) *configWatcher {
+	files := configFiles(path, endpoints.current())
+	return &configWatcher{
+		path:        path,
+		endpoints:   endpoints,
+		build:       build,
+		delay:       defaultConfigReloadDelay,
+		files:       files,
+		fingerprint: fingerprintFiles(files),
+		watched:     map[string]bool{},
+	}
+}
+
+// configFiles returns the services config file, followed by the
+// kubeconfig files the endpoints read.
+func configFiles(path string, endpoints []configuredEndpoint) []string {
+	files := []string{path}
+	seen := map[string]bool{path: true}
+	for _, ep := range endpoints {
+		ke, ok := ep.instance.(*KubernetesEndpoint)
+		if !ok || *inCluster {
+			continue
+		}
+		for _, f := range ke.kubeconfigPaths() {
+			if !seen[f] {
+				seen[f] = true
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
+
+// fingerprintFiles returns a hash of the names and contents of the files.
+// One which cannot be read is hashed as missing.
+func fingerprintFiles(files []string) string {
+	h := sha256.New()
+	for _, f := range files {
+		buf, err := ioutil.ReadFile(f)
+		if err != nil {
+			fmt.Fprintf(h, "%s\x00missing\x00", f)
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f, len(buf))
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// run reloads the endpoints after changes until ctx is done.
+func (w *configWatcher) run(ctx context.Context) {
+	watcher, err := w.start()
+	if err != nil {
+		util.Errorf("Unable to watch the configuration for changes: %v", err)
+		return
+	}
+	w.loop(ctx, watcher)
+}
+
+// start begins watching the directories of the files in use.
+func (w *configWatcher) start() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w.watch(watcher)
+	return watcher, nil
+}
+
+// loop handles changes seen by the watcher until ctx is done, and then
+// closes it.
+func (w *configWatcher) loop(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			util.Debugf("Configuration changed: %s", event)
+			reload = time.After(w.delay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			util.Warnf("While watching the configuration: %v", err)
+		case <-reload:
+			reload = nil
+			w.reload()
+			w.watch(watcher)
+		}
+	}
+}
+
+// watch adds the directories of the files in use to the watcher, and
+// removes those no longer needed.
+func (w *configWatcher) watch(watcher *fsnotify.Watcher) {
+	dirs := map[string]bool{}
+	for _, f := range w.files {
+		dirs[filepath.Dir(f)] = true
+	}
+	for dir := range dirs {
+		if w.watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			util.Warnf("Unable to watch %s for configuration changes: %v", dir, err)
+			continue
+		}
+		w.watched[dir] = true
+	}
+	for dir := range w.watched {
+		if !dirs[dir] {
+			_ = watcher.Remove(dir)
+			delete(w.watched, dir)
+		}
+	}
+}
+
+// reload rebuilds the endpoints if the files they came from changed, and
+// puts them in use.  If the new configuration is invalid, the endpoints
+// in use are kept.
+func (w *configWatcher) reload() {
+	fingerprint := fingerprintFiles(w.files)
+	if fingerprint == w.fingerprint || fingerprint == w.rejected {
+		return
+	}
+	serviceConfig, err := cfg.LoadServiceConfig(w.path)
+	if err != nil {
+		w.reject(fingerprint, err)
+		return
+	}
+	built, err := w.build(serviceConfig)
+	if err != nil {
+		w.reject(fingerprint, err)
+		return
+	}
+
+	files := configFiles(w.path, built)
+	if !reflect.DeepEqual(files, w.files) {
+		fingerprint = fingerprintFiles(files)
+	}
+	w.files = files
+	w.fingerprint = fingerprint
+	w.rejected = ""
+	// Counted first, so the reload is seen in the metric by the time
+	// anything waiting on the table wakes.
+	configReloads.WithLabelValues("success").Inc()
+	closeEndpoints(w.endpoints.replace(built))
+	util.Infof("Reloaded the configuration from %s, now at %d endpoints", w.path, len(built))
+}
+
+func (w *configWatcher) reject(fingerprint string, err error) {
+	w.rejected = fingerprint
+	configReloads.WithLabelValues("failure").Inc()
+	util.Errorf("Keeping the current endpoints, as the changed configuration is invalid: %v", err)
+}
@@ -0,0 +1,266 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/opsmx/oes-birger/app/agent/cfg"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func endpointNames(endpoints []configuredEndpoint) []string {
+	names := make([]string, len(endpoints))
+	for i, ep := range endpoints {
+		names[i] = ep.Type + "/" + ep.Name
+	}
+	return names
+}
+
+func writeTestFile(t *testing.T, path string, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeReloadKubeconfig(contexts ...string) string {
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\nkind: Config\ncurrent-context: ctx1\n")
+	b.WriteString("clusters:\n- name: cluster\n  cluster: {server: https://k8s.example.com}\n")
+	b.WriteString("users:\n- name: token\n  user: {token: abc123}\n")
+	b.WriteString("contexts:\n")
+	for _, name := range contexts {
+		fmt.Fprintf(&b, "- name: %s\n  context: {cluster: cluster, user: token}\n", name)
+	}
+	return b.String()
+}
+
+func makeReloadServices(kubeconfigPath string, urls ...string) string {
+	var b strings.Builder
+	b.WriteString("services:\n")
+	fmt.Fprintf(&b, "- name: k8s\n  type: kubernetes\n  enabled: true\n  config:\n    kubeConfig: %s\n", kubeconfigPath)
+	for i, url := range urls {
+		fmt.Fprintf(&b, "- name: argo%d\n  type: argocd\n  enabled: true\n  config:\n    url: %s\n", i+1, url)
+	}
+	return b.String()
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "kube"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfigPath := filepath.Join(dir, "kube", "config.yaml")
+	servicesPath := filepath.Join(dir, "services.yaml")
+	writeTestFile(t, kubeconfigPath, makeReloadKubeconfig("ctx1"))
+	writeTestFile(t, servicesPath, makeReloadServices(kubeconfigPath, "https://argo1"))
+
+	build := func(c *cfg.AgentServiceConfig) ([]configuredEndpoint, error) {
+		return buildEndpoints(c, &FakeSecretLoader{})
+	}
+	serviceConfig, err := cfg.LoadServiceConfig(servicesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, err := build(serviceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := newEndpointTable(initial)
+	defer func() { closeEndpoints(table.current()) }()
+
+	w := newConfigWatcher(servicesPath, table, build)
+	w.delay = 50 * time.Millisecond
+	watcher, err := w.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.loop(ctx, watcher)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	reloaded := func(result string) float64 {
+		return testutil.ToFloat64(configReloads.WithLabelValues(result))
+	}
+	// change writes a file, and waits for the endpoints to be replaced.
+	change := func(path string, contents string) []string {
+		t.Helper()
+		_, changed := table.get()
+		writeTestFile(t, path, contents)
+		select {
+		case <-changed:
+			return endpointNames(table.current())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("endpoints were not reloaded after %s changed", path)
+			return nil
+		}
+	}
+	// reject writes a file, and waits for the change to be rejected.
+	reject := func(path string, contents string) {
+		t.Helper()
+		before := endpointNames(table.current())
+		_, changed := table.get()
+		failures := reloaded("failure")
+		writeTestFile(t, path, contents)
+		deadline := time.Now().Add(5 * time.Second)
+		for reloaded("failure") == failures {
+			if time.Now().After(deadline) {
+				t.Fatalf("invalid change to %s was not rejected", path)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		select {
+		case <-changed:
+			t.Errorf("endpoints were replaced by an invalid configuration")
+		default:
+		}
+		if got := endpointNames(table.current()); !reflect.DeepEqual(got, before) {
+			t.Errorf("endpoints = %v, want %v", got, before)
+		}
+	}
+
+	successes := reloaded("success")
+	oldKubernetes := initial[0].instance.(*KubernetesEndpoint)
+	got := change(servicesPath, makeReloadServices(kubeconfigPath, "https://argo1", "https://argo2"))
+	want := []string{"kubernetes/k8s", "kubernetes/ctx1", "argocd/argo1", "argocd/argo2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after adding a service, endpoints = %v, want %v", got, want)
+	}
+	select {
+	case <-oldKubernetes.stop:
+	default:
+		t.Errorf("replaced kubernetes endpoint was not closed")
+	}
+
+	got = change(kubeconfigPath, makeReloadKubeconfig("ctx1", "ctx2"))
+	want = []string{"kubernetes/k8s", "kubernetes/ctx1", "kubernetes/ctx2", "argocd/argo1", "argocd/argo2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after adding a context, endpoints = %v, want %v", got, want)
+	}
+
+	reject(servicesPath, "services: [")
+	reject(servicesPath, makeReloadServices(kubeconfigPath, "[not, a, url]"))
+	reject(kubeconfigPath, makeReloadKubeconfig("ctx2"))
+
+	// Other files beside those in use do not cause a reload.
+	_, changed := table.get()
+	writeTestFile(t, filepath.Join(dir, "unrelated.yaml"), "hello")
+	time.Sleep(10 * w.delay)
+	select {
+	case <-changed:
+		t.Errorf("endpoints were reloaded when an unrelated file changed")
+	default:
+	}
+
+	writeTestFile(t, kubeconfigPath, makeReloadKubeconfig("ctx1", "ctx2"))
+	got = change(servicesPath, makeReloadServices(kubeconfigPath))
+	want = []string{"kubernetes/k8s", "kubernetes/ctx1", "kubernetes/ctx2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after fixing the configuration, endpoints = %v, want %v", got, want)
+	}
+	if got := reloaded("success") - successes; got != 3 {
+		t.Errorf("successful reloads = %v, want 3", got)
+	}
+}
+
+// closeCounter counts how often it is closed.
+type closeCounter struct {
+	closed int
+}
+
+func (c *closeCounter) executeHTTPRequest(chan *tunnel.AgentToControllerWrapper, *tunnel.HttpRequest, io.ReadCloser) {
+}
+
+func (c *closeCounter) close() {
+	c.closed++
+}
+
+func TestCloseEndpoints(t *testing.T) {
+	shared := &closeCounter{}
+	other := &closeCounter{}
+	closeEndpoints([]configuredEndpoint{
+		{Name: "ns1", instance: shared},
+		{Name: "ns2", instance: shared},
+		{Name: "other", instance: other},
+		{Name: "plain", instance: &GenericEndpoint{}},
+		{Name: "unconfigured"},
+	})
+	if shared.closed != 1 || other.closed != 1 {
+		t.Errorf("closed shared %d times and other %d times, want once each", shared.closed, other.closed)
+	}
+}
+
+func TestAdvertiseEndpoints(t *testing.T) {
+	table := newEndpointTable([]configuredEndpoint{{Type: "jenkins", Name: "j1", Configured: true}})
+	_, changed := table.get()
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		advertiseEndpoints(ctx, table, changed, dataflow)
+	}()
+
+	for _, names := range [][]string{{"j2"}, {"j2", "j3"}} {
+		endpoints := []configuredEndpoint{}
+		for _, name := range names {
+			endpoints = append(endpoints, configuredEndpoint{Type: "jenkins", Name: name, Configured: true})
+		}
+		table.replace(endpoints)
+		select {
+		case msg := <-dataflow:
+			update := msg.GetEndpointsUpdate()
+			if update == nil {
+				t.Fatalf("expected an EndpointsUpdate, got %v", msg.Event)
+			}
+			got := []string{}
+			for _, ep := range update.Endpoints {
+				got = append(got, ep.Name)
+			}
+			if !reflect.DeepEqual(got, names) {
+				t.Errorf("advertised %v, want %v", got, names)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("endpoints were not advertised")
+		}
+	}
+
+	cancel()
+	<-done
+	if len(dataflow) != 0 {
+		t.Errorf("unexpected messages after the last change: %d", len(dataflow))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How often to check whether the agent certificate is due for renewal.
+const certCheckInterval = time.Hour
+
+// agentCredentials holds the certificate the agent presents to the
+// controller.  It is read on each handshake, so once it is renewed new
+// connections use the new certificate.
+type agentCredentials struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+// loadAgentCredentials reads the agent's certificate and key.
+func loadAgentCredentials(certFile string, keyFile string) (*agentCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load agent certificate or key: %v", err)
+	}
+	c := &agentCredentials{}
+	if err := c.set(&cert); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// set replaces the certificate, parsing it first if needed.
+func (c *agentCredentials) set(cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("unable to parse agent certificate: %v", err)
+		}
+		cert.Leaf = leaf
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.cert = cert
+	certificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	return nil
+}
+
+func (c *agentCredentials) get() *tls.Certificate {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert
+}
+
+// getClientCertificate is installed in the TLS config used to connect to
+// the controller.
+func (c *agentCredentials) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.get(), nil
+}
+
+// certRenewer asks the controller for a new certificate once the current
+// one is within before of expiring.  The new certificate and key are
+// written over the old files, so they are used after a restart, and
+// renewed is signalled so a new tunnel can take over using them.
+type certRenewer struct {
+	creds    *agentCredentials
+	certFile string
+	keyFile  string
+	before   time.Duration
+	renew    func(ctx context.Context) (*tunnel.CertificateRenewalResponse, error)
+	now      func() time.Time
+	renewed  chan struct{}
+}
+
+func newCertRenewer(creds *agentCredentials, certFile string, keyFile string, before time.Duration, renew func(ctx context.Context) (*tunnel.CertificateRenewalResponse, error)) *certRenewer {
+	return &certRenewer{
+		creds:    creds,
+		certFile: certFile,
+		keyFile:  keyFile,
+		before:   before,
+		renew:    renew,
+		now:      time.Now,
+		renewed:  make(chan struct{}, 1),
+	}
+}
+
+// due returns how long until the certificate should be renewed, or zero
+// if it is already due.
+func (r *certRenewer) due() time.Duration {
+	d := r.creds.get().Leaf.NotAfter.Add(-r.before).Sub(r.now())
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// run renews the certificate each time it becomes due, until ctx is done.
+// A failed renewal is retried with backoff, while the certificate is still
+// valid.
+func (r *certRenewer) run(ctx context.Context) {
+	retry := newBackoff(time.Minute, certCheckInterval)
+	for {
+		wait := r.due()
+		if wait == 0 {
+			if err := r.renewOnce(ctx); err != nil {
+				certificateRenewals.WithLabelValues("failed").Inc()
+				wait = retry.Next()
+				util.Warnf("Unable to renew agent certificate, which expires %s: %v, retrying in %s",
+					r.creds.get().Leaf.NotAfter.UTC().Format(time.RFC3339), err, wait)
+			} else {
+				certificateRenewals.WithLabelValues("renewed").Inc()
+				retry.Reset()
+				select {
+				case r.renewed <- struct{}{}:
+				default:
+				}
+				continue
+			}
+		}
+		if wait > certCheckInterval {
+			wait = certCheckInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renewOnce asks the controller for a new certificate, and installs it.
+// It must be for the same name as the current one, and last longer.
+func (r *certRenewer) renewOnce(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := r.renew(ctx)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(resp.Certificate, resp.Key)
+	if err != nil {
+		return fmt.Errorf("controller sent an unusable certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("controller sent an unusable certificate: %v", err)
+	}
+	cert.Leaf = leaf
+	current := r.creds.get().Leaf
+	oldName, err := ca.GetCertificateNameFromCert(current)
+	if err != nil {
+		return err
+	}
+	newName, err := ca.GetCertificateNameFromCert(leaf)
+	if err != nil {
+		return fmt.Errorf("controller sent an unusable certificate: %v", err)
+	}
+	if *newName != *oldName {
+		return fmt.Errorf("controller sent a certificate for %+v, not %+v", *newName, *oldName)
+	}
+	if !leaf.NotAfter.After(current.NotAfter) {
+		return fmt.Errorf("controller sent a certificate expiring %s, no later than the current one", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	// The files may be on a read-only volume, such as a mounted secret,
+	// so failing to save them only means the renewal is repeated after a
+	// restart.
+	if err := writeCertificateFiles(r.certFile, resp.Certificate, r.keyFile, resp.Key); err != nil {
+		util.Warnf("Renewed agent certificate will not survive a restart: %v", err)
+	}
+	if err := r.creds.set(&cert); err != nil {
+		return err
+	}
+	util.Infof("Renewed agent certificate, serial %s, now expires %s", leaf.SerialNumber, leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// writeCertificateFiles replaces the certificate and key files.  Both are
+// written to temporary files first, and only once both are written are
+// they renamed over the old ones, so a failure does not leave a key which
+// does not match the certificate.
+func writeCertificateFiles(certFile string, certPEM []byte, keyFile string, keyPEM []byte) error {
+	keyTmp, err := writeTempFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyTmp)
+	certTmp, err := writeTempFile(certFile, certPEM, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(certTmp)
+	if err := os.Rename(keyTmp, keyFile); err != nil {
+		return fmt.Errorf("unable to write %s: %v", keyFile, err)
+	}
+	if err := os.Rename(certTmp, certFile); err != nil {
+		return fmt.Errorf("unable to write %s: %v", certFile, err)
+	}
+	return nil
+}
+
+// writeTempFile writes data to a new file beside path, returning its name.
+func writeTempFile(path string, data []byte, mode os.FileMode) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return "", fmt.Errorf("unable to write %s: %v", path, err)
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("unable to write %s: %v", path, err)
+	}
+	return tmp.Name(), nil
+}
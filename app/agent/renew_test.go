@@ -0,0 +1,122 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// issueTestCertificate returns a PEM certificate and key for the name.
+func issueTestCertificate(t *testing.T, authority *ca.CA, name ca.CertificateName, validity time.Duration) ([]byte, []byte) {
+	_, cert64, key64, err := authority.GenerateCertificate(name, ca.KeyTypeECDSAP256, validity)
+	if err != nil {
+		t.Fatalf("GenerateCertificate() = %v", err)
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(key64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM
+}
+
+func TestCertRenewer_renewOnce(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := ca.MakeCAFromData(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentName := ca.CertificateName{Agent: "agent1", Purpose: ca.CertificatePurposeAgent}
+	otherName := ca.CertificateName{Agent: "agent2", Purpose: ca.CertificatePurposeAgent}
+
+	tests := []struct {
+		name     string
+		issue    ca.CertificateName
+		validity time.Duration
+		wantErr  bool
+	}{
+		{"renewed", agentName, 48 * time.Hour, false},
+		{"other agent", otherName, 48 * time.Hour, true},
+		{"expires sooner", agentName, 30 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile := filepath.Join(dir, "tls.crt")
+			keyFile := filepath.Join(dir, "tls.key")
+			certPEM, keyPEM := issueTestCertificate(t, authority, agentName, time.Hour)
+			if err := writeCertificateFiles(certFile, certPEM, keyFile, keyPEM); err != nil {
+				t.Fatal(err)
+			}
+			creds, err := loadAgentCredentials(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			original := creds.get()
+
+			newCertPEM, newKeyPEM := issueTestCertificate(t, authority, tt.issue, tt.validity)
+			r := newCertRenewer(creds, certFile, keyFile, 2*time.Hour, func(ctx context.Context) (*tunnel.CertificateRenewalResponse, error) {
+				return &tunnel.CertificateRenewalResponse{Certificate: newCertPEM, Key: newKeyPEM}, nil
+			})
+			if r.due() != 0 {
+				t.Errorf("due() = %s, want 0 for a certificate expiring within the window", r.due())
+			}
+
+			err = r.renewOnce(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renewOnce() = %v, wantErr %v", err, tt.wantErr)
+			}
+			wantCert := newCertPEM
+			if tt.wantErr {
+				wantCert = certPEM
+				if creds.get() != original {
+					t.Errorf("certificate replaced after a failed renewal")
+				}
+			} else if creds.get() == original {
+				t.Errorf("certificate not replaced")
+			}
+			got, err := ioutil.ReadFile(certFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, wantCert) {
+				t.Errorf("certificate file was not as expected after renewOnce() = %v", err)
+			}
+			if _, err := loadAgentCredentials(certFile, keyFile); err != nil {
+				t.Errorf("files do not load after renewOnce(): %v", err)
+			}
+			if !tt.wantErr && r.due() == 0 {
+				t.Errorf("due() = 0 after renewing")
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// connectedSessions counts the tunnels which are connected, so the agent
+// stays connected while one takes over from another.
+var connectedSessions int32
+
+func sessionConnected() {
+	atomic.AddInt32(&connectedSessions, 1)
+	tunnelConnected.Set()
+}
+
+func sessionDisconnected() {
+	if atomic.AddInt32(&connectedSessions, -1) == 0 {
+		tunnelConnected.UnSet()
+	}
+}
+
+// sessionFunc runs a single tunnel session, as connectAndRun does.
+type sessionFunc func(ctx context.Context, connected func(), drain *drainer) error
+
+// tunnelSession is one tunnel to the controller.  Each has its own drainer,
+// so it can be closed while another takes over from it.
+type tunnelSession struct {
+	drain     *drainer
+	connected chan struct{}
+	done      chan error
+}
+
+func startSession(ctx context.Context, run sessionFunc) *tunnelSession {
+	s := &tunnelSession{
+		drain:     newDrainer(),
+		connected: make(chan struct{}),
+		done:      make(chan error, 1),
+	}
+	var once sync.Once
+	go func() {
+		s.done <- run(ctx, func() { once.Do(func() { close(s.connected) }) }, s.drain)
+	}()
+	return s
+}
+
+// runSessions keeps a tunnel to the controller running until drain starts,
+// reconnecting with backoff when one fails.  A connected tunnel which loses
+// its connection is replaced at once, and only later attempts back off.
+// Each time renewed is signalled, a new tunnel is started alongside the
+// current one, and once it is connected the old one is drained, so requests
+// are not dropped when the agent's certificate changes.  If the new one
+// cannot connect, the old one is kept.
+func runSessions(ctx context.Context, run sessionFunc, drain *drainer, renewed <-chan struct{}, retry *backoff) {
+	var retiring sync.WaitGroup
+	defer retiring.Wait()
+	retire := func(s *tunnelSession) {
+		s.drain.start()
+		retiring.Add(1)
+		go func() {
+			defer retiring.Done()
+			if err := <-s.done; err != errDrained {
+				util.Warnf("Old tunnel failed while draining: %v", err)
+			}
+		}()
+	}
+
+	current := startSession(ctx, run)
+	currentConnected := current.connected
+	var next *tunnelSession
+	for {
+		var nextConnected <-chan struct{}
+		var nextDone <-chan error
+		if next != nil {
+			nextConnected = next.connected
+			nextDone = next.done
+		}
+
+		select {
+		case <-drain.started():
+			if next != nil {
+				retire(next)
+			}
+			retire(current)
+			return
+		case <-currentConnected:
+			currentConnected = nil
+			retry.Reset()
+		case <-renewed:
+			if next == nil {
+				util.Infof("Starting a new tunnel with the renewed certificate")
+				next = startSession(ctx, run)
+			}
+		case <-nextConnected:
+			util.Infof("New tunnel connected, draining the old one")
+			retire(current)
+			current, next = next, nil
+			currentConnected = nil
+			retry.Reset()
+		case err := <-nextDone:
+			util.Warnf("New tunnel failed, keeping the current one: %v", err)
+			next = nil
+		case err := <-current.done:
+			if next != nil {
+				util.Warnf("Tunnel failed: %v, waiting for the new one", err)
+				current, next = next, nil
+				currentConnected = current.connected
+				continue
+			}
+			reconnectAttempts.Inc()
+			if currentConnected == nil && errors.Is(err, errConnectionLost) {
+				// The controller was reachable until just now, so the
+				// first attempt is made without waiting.
+				util.Warnf("Tunnel failed: %v, reconnecting", err)
+				current = startSession(ctx, run)
+				currentConnected = current.connected
+				continue
+			}
+			delay := retry.Next()
+			util.Warnf("Tunnel failed: %v, reconnecting in %s", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-drain.started():
+				util.Infof("Not connected while draining, exiting")
+				return
+			}
+			current = startSession(ctx, run)
+			currentConnected = current.connected
+		}
+	}
+}
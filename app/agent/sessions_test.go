@@ -0,0 +1,156 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSession is started by fakeSessions in place of a tunnel.  It connects
+// unless fail is set, and runs until it is drained or an error is sent on
+// lost.
+type fakeSession struct {
+	drain *drainer
+}
+
+type fakeSessions struct {
+	started chan *fakeSession
+	fail    chan error
+	lost    chan error
+}
+
+func (f *fakeSessions) run(ctx context.Context, connected func(), drain *drainer) error {
+	f.started <- &fakeSession{drain: drain}
+	select {
+	case err := <-f.fail:
+		return err
+	default:
+	}
+	connected()
+	select {
+	case <-drain.started():
+		return errDrained
+	case err := <-f.lost:
+		return err
+	}
+}
+
+func waitSession(t *testing.T, started chan *fakeSession) *fakeSession {
+	select {
+	case s := <-started:
+		return s
+	case <-time.After(time.Second):
+		t.Fatalf("session not started")
+	}
+	return nil
+}
+
+func isDraining(s *fakeSession) bool {
+	select {
+	case <-s.drain.started():
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func TestRunSessions_handover(t *testing.T) {
+	f := &fakeSessions{started: make(chan *fakeSession), fail: make(chan error, 1)}
+	drain := newDrainer()
+	renewed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runSessions(context.Background(), f.run, drain, renewed, newBackoff(time.Millisecond, time.Millisecond))
+		close(done)
+	}()
+
+	first := waitSession(t, f.started)
+
+	// A new session which fails leaves the current one running.
+	f.fail <- errors.New("failed")
+	renewed <- struct{}{}
+	waitSession(t, f.started)
+	if isDraining(first) {
+		t.Fatalf("current session drained when the new one failed")
+	}
+
+	// One which connects takes over.
+	renewed <- struct{}{}
+	second := waitSession(t, f.started)
+	if !isDraining(first) {
+		t.Fatalf("old session not drained once the new one connected")
+	}
+	if isDraining(second) {
+		t.Fatalf("new session drained")
+	}
+
+	drain.start()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("runSessions() did not return once drained")
+	}
+	if !isDraining(second) {
+		t.Errorf("session not drained when the agent was")
+	}
+}
+
+func TestRunSessions_connectionLost(t *testing.T) {
+	f := &fakeSessions{started: make(chan *fakeSession), fail: make(chan error, 1), lost: make(chan error)}
+	drain := newDrainer()
+	done := make(chan struct{})
+	go func() {
+		runSessions(context.Background(), f.run, drain, nil, newBackoff(time.Hour, time.Hour))
+		close(done)
+	}()
+
+	// A connected tunnel which loses its connection is replaced at once,
+	// without waiting out the backoff.
+	waitSession(t, f.started)
+	f.lost <- receiveError(status.Error(codes.Unavailable, "keepalive ping failed to receive ACK within timeout"))
+	waitSession(t, f.started)
+
+	// Other failures back off.
+	f.lost <- receiveError(status.Error(codes.Internal, "stream terminated"))
+	select {
+	case <-f.started:
+		t.Fatalf("reconnected without backing off")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	drain.start()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("runSessions() did not return once drained")
+	}
+}
+
+func TestReceiveError(t *testing.T) {
+	if err := receiveError(status.Error(codes.Unavailable, "transport is closing")); !errors.Is(err, errConnectionLost) {
+		t.Errorf("receiveError(Unavailable) = %v, want errConnectionLost", err)
+	}
+	if err := receiveError(status.Error(codes.Canceled, "context canceled")); errors.Is(err, errConnectionLost) {
+		t.Errorf("receiveError(Canceled) = %v, should not be errConnectionLost", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"io"
+	"sync"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How many chunks of standard input may be queued for a command.  The
+// tunnel receive loop never waits for the command to consume them, as that
+// would hold up every other request on the tunnel, so a command which
+// falls further behind is cancelled.
+const commandStdinQueueLength = 256
+
+var stdinRegistry = struct {
+	sync.Mutex
+	m map[string]chan []byte
+}{m: make(map[string]chan []byte)}
+
+// commandStdin registers the command to receive standard input from
+// CommandData messages, and returns the channel they will arrive on.  If the
+// request does not use stdin, nil is returned.  This must be called from the
+// tunnel receive loop, so no data can arrive before it is registered.
+func commandStdin(req *tunnel.CommandRequest) chan []byte {
+	if !req.Stdin {
+		return nil
+	}
+	c := make(chan []byte, commandStdinQueueLength)
+	stdinRegistry.Lock()
+	stdinRegistry.m[req.Id] = c
+	stdinRegistry.Unlock()
+	return c
+}
+
+// writePump copies queued data to w, such as a command's standard input,
+// until the channel is closed, and then closes w.  If writing fails, usually
+// because the command has exited, remaining data is discarded so the tunnel
+// receive loop never blocks on it.  A nil writer discards everything.
+func writePump(c chan []byte, w io.WriteCloser) {
+	for data := range c {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(data); err != nil {
+			_ = w.Close()
+			w = nil
+		}
+	}
+	if w != nil {
+		_ = w.Close()
+	}
+}
+
+// appendCommandStdin is called from the tunnel receive loop with each
+// CommandData message for the STDIN channel.
+func appendCommandStdin(data *tunnel.CommandData) {
+	if !queueCommandStdin(data) {
+		util.Warnf("Command %s is not reading its standard input, cancelling it", data.Id)
+		callCancelFunction(data.Id)
+	}
+}
+
+// queueCommandStdin queues the data for the command, returning false if its
+// queue was full, in which case no more is accepted.
+func queueCommandStdin(data *tunnel.CommandData) bool {
+	stdinRegistry.Lock()
+	defer stdinRegistry.Unlock()
+	c, ok := stdinRegistry.m[data.Id]
+	if !ok {
+		return true
+	}
+	if len(data.Body) > 0 {
+		select {
+		case c <- data.Body:
+		default:
+			close(c)
+			delete(stdinRegistry.m, data.Id)
+			return false
+		}
+	}
+	if data.Closed {
+		close(c)
+		delete(stdinRegistry.m, data.Id)
+	}
+	return true
+}
+
+// cancelCommandStdin stops any pending standard input for the command id.
+func cancelCommandStdin(id string) {
+	stdinRegistry.Lock()
+	defer stdinRegistry.Unlock()
+	if c, ok := stdinRegistry.m[id]; ok {
+		close(c)
+		delete(stdinRegistry.m, id)
+	}
+}
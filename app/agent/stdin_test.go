@@ -0,0 +1,181 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+type failingWriter struct {
+	closed bool
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func (w *failingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestWritePump_writeFails(t *testing.T) {
+	req := &tunnel.CommandRequest{Id: "pump-fails", Stdin: true}
+	c := commandStdin(req)
+	w := &failingWriter{}
+	done := make(chan struct{})
+	go func() {
+		writePump(c, w)
+		close(done)
+	}()
+
+	// None of these should block, even though nothing can be written.
+	for i := 0; i < commandStdinQueueLength*4; i++ {
+		appendCommandStdin(&tunnel.CommandData{Id: req.Id, Channel: tunnel.ChannelDirection_STDIN, Body: []byte("data")})
+	}
+	appendCommandStdin(&tunnel.CommandData{Id: req.Id, Channel: tunnel.ChannelDirection_STDIN, Closed: true})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writePump did not return")
+	}
+	if !w.closed {
+		t.Errorf("expected writer to be closed")
+	}
+}
+
+func TestCommandStdin_overflow(t *testing.T) {
+	req := &tunnel.CommandRequest{Id: "stdin-overflow", Stdin: true}
+	c := commandStdin(req)
+	cancelled := make(chan struct{})
+	registerCancelFunction(req.Id, func() { close(cancelled) })
+	defer unregisterCancelFunction(req.Id)
+
+	// Nothing is reading, so the queue fills, and the command is then
+	// cancelled instead of blocking the tunnel.
+	for i := 0; i <= commandStdinQueueLength; i++ {
+		appendCommandStdin(&tunnel.CommandData{Id: req.Id, Channel: tunnel.ChannelDirection_STDIN, Body: []byte("data")})
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("expected the command to be cancelled")
+	}
+	appendCommandStdin(&tunnel.CommandData{Id: req.Id, Channel: tunnel.ChannelDirection_STDIN, Body: []byte("late")})
+	n := 0
+	for range c {
+		n++
+	}
+	if n != commandStdinQueueLength {
+		t.Errorf("queued %d chunks, want %d", n, commandStdinQueueLength)
+	}
+}
+
+func TestCommandStdin_notRequested(t *testing.T) {
+	if c := commandStdin(&tunnel.CommandRequest{Id: "no-stdin"}); c != nil {
+		t.Errorf("expected no stdin channel")
+	}
+	// data for an unknown id is ignored
+	appendCommandStdin(&tunnel.CommandData{Id: "no-stdin", Body: []byte("data")})
+}
+
+// runCommandWithStdin runs the command, feeding it the chunks of input, and
+// returns its stdout and exit code.
+func runCommandWithStdin(t *testing.T, id string, script string, chunks [][]byte) (string, int32) {
+	req := &tunnel.CommandRequest{Id: id, Name: "sh", Stdin: true}
+	command := &allowedCommand{path: "/bin/sh", arguments: []string{"-c", script}}
+	stdin := commandStdin(req)
+
+	dataflow := make(chan *tunnel.AgentToControllerWrapper)
+	finished := make(chan struct{})
+	go func() {
+		runCommand(dataflow, req, command, stdin, nil)
+		close(dataflow)
+	}()
+	go func() {
+		for _, chunk := range chunks {
+			appendCommandStdin(&tunnel.CommandData{Id: id, Channel: tunnel.ChannelDirection_STDIN, Body: chunk})
+		}
+		appendCommandStdin(&tunnel.CommandData{Id: id, Channel: tunnel.ChannelDirection_STDIN, Closed: true})
+		close(finished)
+	}()
+
+	var stdout bytes.Buffer
+	exitCode := int32(-1)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg, more := <-dataflow:
+			if !more {
+				select {
+				case <-finished:
+				case <-timeout:
+					t.Fatal("sending stdin blocked after the command exited")
+				}
+				return stdout.String(), exitCode
+			}
+			if data := msg.GetCommandData(); data != nil && data.Channel == tunnel.ChannelDirection_STDOUT {
+				stdout.Write(data.Body)
+			}
+			if term := msg.GetCommandTermination(); term != nil {
+				exitCode = term.ExitCode
+			}
+		case <-timeout:
+			t.Fatal("command did not complete")
+		}
+	}
+}
+
+func TestRunCommand_stdin(t *testing.T) {
+	// commands are run as nobody, which requires root
+	if os.Geteuid() != 0 {
+		t.Skip("must be root to run commands")
+	}
+
+	big := make([][]byte, 200)
+	for i := range big {
+		big[i] = bytes.Repeat([]byte("x"), 10240)
+	}
+
+	tests := []struct {
+		name       string
+		script     string
+		chunks     [][]byte
+		wantStdout string
+	}{
+		{"copied", "cat", [][]byte{[]byte("foo"), []byte("bar")}, "foobar"},
+		{"empty", "cat", nil, ""},
+		{"exits before reading", "echo done", big, "done\n"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, exitCode := runCommandWithStdin(t, fmt.Sprintf("stdin-%d", i), tt.script, tt.chunks)
+			if stdout != tt.wantStdout {
+				t.Errorf("expected stdout '%s', got '%s'", tt.wantStdout, stdout)
+			}
+			if exitCode != 0 {
+				t.Errorf("expected exit code 0, got %d", exitCode)
+			}
+		})
+	}
+}
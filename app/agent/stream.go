@@ -0,0 +1,162 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How many chunks of stream data from the controller may be queued.  The
+// tunnel receive loop never waits for the upstream connection to take them,
+// as that would hold up every other request on the tunnel, so a stream
+// which falls further behind is closed.
+const streamQueueLength = 256
+
+// The maximum size of each StreamData message sent to the controller.
+const streamChunkSize = 10240
+
+var streamRegistry = struct {
+	sync.Mutex
+	m map[string]chan []byte
+}{m: make(map[string]chan []byte)}
+
+// streamRequestProcessor is implemented by endpoints which can upgrade a
+// request into a bidirectional stream.
+type streamRequestProcessor interface {
+	executeStreamRequest(chan *tunnel.AgentToControllerWrapper, *tunnel.HttpRequest, chan []byte)
+}
+
+// openStream registers a stream to receive StreamData messages, and returns
+// the channel they will arrive on.  This must be called from the tunnel
+// receive loop, so no data can arrive before it is registered.
+func openStream(id string) chan []byte {
+	c := make(chan []byte, streamQueueLength)
+	streamRegistry.Lock()
+	streamRegistry.m[id] = c
+	streamRegistry.Unlock()
+	return c
+}
+
+// appendStreamData is called from the tunnel receive loop with each
+// StreamData message.  If the stream's queue is full, it is closed, which
+// closes the upstream connection once the queued data is written, and so
+// the stream.
+func appendStreamData(data *tunnel.StreamData) {
+	streamRegistry.Lock()
+	defer streamRegistry.Unlock()
+	c, ok := streamRegistry.m[data.Id]
+	if !ok || len(data.Data) == 0 {
+		return
+	}
+	select {
+	case c <- data.Data:
+	default:
+		util.Warnf("Stream %s is not taking its data upstream quickly enough, closing it", data.Id)
+		close(c)
+		delete(streamRegistry.m, data.Id)
+	}
+}
+
+// closeStream stops any further data for the stream id.  Once the queued
+// data is written, the upstream connection is closed.
+func closeStream(id string) {
+	streamRegistry.Lock()
+	defer streamRegistry.Unlock()
+	if c, ok := streamRegistry.m[id]; ok {
+		close(c)
+		delete(streamRegistry.m, id)
+	}
+}
+
+func makeStreamData(id string, data []byte) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_StreamData{
+			StreamData: &tunnel.StreamData{Id: id, Data: data},
+		},
+	}
+}
+
+func makeStreamClose(id string, err error) *tunnel.AgentToControllerWrapper {
+	message := ""
+	if err != nil && err != io.EOF {
+		message = err.Error()
+	}
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_StreamClose{
+			StreamClose: &tunnel.StreamClose{Id: id, Message: message},
+		},
+	}
+}
+
+// runStreamRequest sends a request asking for a connection upgrade.  If the
+// upstream server switches protocols, bytes are copied in both directions
+// until either side closes: data from the controller arrives on in, and
+// data from upstream is sent as StreamData.  If the upstream connection
+// closes first a StreamClose is sent, but if ctx is cancelled the
+// controller has already gone away and nothing more is sent.  Any other
+// response is returned as for an ordinary request.
+func runStreamRequest(ctx context.Context, client *http.Client, req *tunnel.HttpRequest, httpRequest *http.Request, dataflow chan *tunnel.AgentToControllerWrapper, in chan []byte) {
+	logger := util.LogWith("transaction", req.Id, "type", req.Type, "endpoint", req.Name)
+	defer closeStream(req.Id)
+
+	logger.Debugf("Opening stream: %s to %v", req.Method, httpRequest.URL)
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		logger.Warnf("Failed to open stream for %s to %s: %v", req.Method, httpRequest.URL, err)
+		dataflow <- makeHTTPErrorResponse(req.Id, err)
+		return
+	}
+	if httpResponse.StatusCode != http.StatusSwitchingProtocols {
+		closeStream(req.Id)
+		sendHTTPResponse(req, httpResponse, dataflow)
+		return
+	}
+	rwc, ok := httpResponse.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = httpResponse.Body.Close()
+		dataflow <- makeHTTPErrorResponse(req.Id, fmt.Errorf("upstream connection cannot be written to"))
+		return
+	}
+	defer rwc.Close()
+
+	dataflow <- makeResponse(req.Id, httpResponse)
+
+	go writePump(in, rwc)
+
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := rwc.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			dataflow <- makeStreamData(req.Id, data)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				dataflow <- makeStreamClose(req.Id, err)
+			}
+			return
+		}
+	}
+}
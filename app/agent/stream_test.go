@@ -0,0 +1,232 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// makeUpgradeServer switches protocols for requests asking for it and then
+// echoes everything back until the client closes, or until it receives
+// "bye".  Other requests get a 400.  serverDone is closed when the upgraded
+// connection is finished.
+func makeUpgradeServer(t *testing.T) (*httptest.Server, chan struct{}) {
+	serverDone := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "test" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("no upgrade"))
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer close(serverDone)
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		_ = rw.Flush()
+		buf := make([]byte, 100)
+		for {
+			n, err := rw.Read(buf)
+			if n > 0 {
+				if string(buf[:n]) == "bye" {
+					return
+				}
+				_, _ = conn.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	return srv, serverDone
+}
+
+// startStream runs a stream request against the URL, returning the tunnel
+// messages it sends and a channel closed when it returns.
+func startStream(t *testing.T, ctx context.Context, id string, url string, upgrade bool) (chan *tunnel.AgentToControllerWrapper, chan struct{}) {
+	req := &tunnel.HttpRequest{Id: id, Type: "kubernetes", Name: "ctx1", Method: "GET", URI: "/"}
+	if upgrade {
+		req.Headers = []*tunnel.HttpHeader{
+			{Name: "Connection", Values: []string{"Upgrade"}},
+			{Name: "Upgrade", Values: []string{"test"}},
+		}
+	}
+	httpRequest, err := makeUpstreamRequest(ctx, req, url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyHeaders(req, httpRequest)
+
+	in := openStream(id)
+	dataflow := make(chan *tunnel.AgentToControllerWrapper, 10)
+	done := make(chan struct{})
+	go func() {
+		runStreamRequest(ctx, http.DefaultClient, req, httpRequest, dataflow, in)
+		close(done)
+	}()
+	return dataflow, done
+}
+
+func nextMessage(t *testing.T, dataflow chan *tunnel.AgentToControllerWrapper) *tunnel.AgentToControllerWrapper {
+	select {
+	case msg := <-dataflow:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a tunnel message")
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, c chan struct{}, what string) {
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func isStreamRegistered(id string) bool {
+	streamRegistry.Lock()
+	defer streamRegistry.Unlock()
+	_, found := streamRegistry.m[id]
+	return found
+}
+
+func TestRunStreamRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		upstreamCloses bool
+	}{
+		{"upstream closes", true},
+		{"controller closes", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, serverDone := makeUpgradeServer(t)
+			defer srv.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			id := "stream-" + tt.name
+			dataflow, done := startStream(t, ctx, id, srv.URL, true)
+
+			resp := nextMessage(t, dataflow).GetHttpResponse()
+			if resp == nil || resp.Status != http.StatusSwitchingProtocols {
+				t.Fatalf("expected a 101 response, got %v", resp)
+			}
+
+			appendStreamData(&tunnel.StreamData{Id: id, Data: []byte("ping")})
+			data := nextMessage(t, dataflow).GetStreamData()
+			if data == nil || string(data.Data) != "ping" {
+				t.Fatalf("expected echoed 'ping', got %v", data)
+			}
+
+			if tt.upstreamCloses {
+				appendStreamData(&tunnel.StreamData{Id: id, Data: []byte("bye")})
+				if nextMessage(t, dataflow).GetStreamClose() == nil {
+					t.Errorf("expected a StreamClose")
+				}
+			} else {
+				// As the tunnel receive loop does for a StreamClose.
+				cancel()
+				closeStream(id)
+				waitFor(t, serverDone, "the upstream connection to close")
+			}
+			waitFor(t, done, "runStreamRequest to return")
+			waitFor(t, serverDone, "the upstream connection to close")
+
+			if !tt.upstreamCloses {
+				select {
+				case msg := <-dataflow:
+					t.Errorf("expected nothing more to be sent, got %T", msg.Event)
+				default:
+				}
+			}
+			if isStreamRegistered(id) {
+				t.Errorf("expected the stream to be unregistered")
+			}
+		})
+	}
+}
+
+func TestAppendStreamData_overflow(t *testing.T) {
+	const id = "stream-overflow"
+	c := openStream(id)
+
+	// Nothing is taking the data upstream, so the queue fills, and the
+	// stream is then closed instead of blocking the tunnel.
+	for i := 0; i <= streamQueueLength; i++ {
+		appendStreamData(&tunnel.StreamData{Id: id, Data: []byte("data")})
+	}
+	if isStreamRegistered(id) {
+		t.Errorf("expected the stream to be unregistered")
+	}
+	appendStreamData(&tunnel.StreamData{Id: id, Data: []byte("late")})
+	n := 0
+	for range c {
+		n++
+	}
+	if n != streamQueueLength {
+		t.Errorf("queued %d chunks, want %d", n, streamQueueLength)
+	}
+}
+
+func TestRunStreamRequest_notUpgraded(t *testing.T) {
+	srv, _ := makeUpgradeServer(t)
+	defer srv.Close()
+
+	id := "stream-not-upgraded"
+	dataflow, done := startStream(t, context.Background(), id, srv.URL, false)
+
+	resp := nextMessage(t, dataflow).GetHttpResponse()
+	if resp == nil || resp.Status != http.StatusBadRequest {
+		t.Fatalf("expected a 400 response, got %v", resp)
+	}
+	var body []byte
+	for {
+		chunk := nextMessage(t, dataflow).GetHttpChunkedResponse()
+		if chunk == nil {
+			t.Fatalf("expected a chunked response")
+		}
+		if len(chunk.Body) == 0 {
+			break
+		}
+		body = append(body, chunk.Body...)
+	}
+	if string(body) != "no upgrade" {
+		t.Errorf("expected body 'no upgrade', got '%s'", body)
+	}
+	waitFor(t, done, "runStreamRequest to return")
+	if isStreamRegistered(id) {
+		t.Errorf("expected the stream to be unregistered")
+	}
+}
+
+func TestAppendStreamData_unknownStream(t *testing.T) {
+	// data for an unknown id is ignored, and closing it is harmless
+	appendStreamData(&tunnel.StreamData{Id: "no-stream", Data: []byte("data")})
+	closeStream("no-stream")
+}
@@ -0,0 +1,64 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// Where Kubernetes mounts the pod's service account credentials.
+const serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// How long a token read from disk is used before it is read again.  Projected
+// service account tokens are rotated by the kubelet well before they expire,
+// so this only needs to be short compared to their lifetime.
+const tokenRefreshInterval = time.Minute
+
+// tokenFile holds a bearer token which is periodically re-read from disk.
+type tokenFile struct {
+	sync.Mutex
+	path     string
+	token    string
+	loadedAt time.Time
+}
+
+func newTokenFile(path string) *tokenFile {
+	return &tokenFile{path: path}
+}
+
+// Token returns the current token, reading it from disk if the cached copy
+// is stale.  If a re-read fails, the previous token is returned.
+func (tf *tokenFile) Token() (string, error) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.token != "" && time.Since(tf.loadedAt) < tokenRefreshInterval {
+		return tf.token, nil
+	}
+	data, err := ioutil.ReadFile(tf.path)
+	if err != nil {
+		if tf.token != "" {
+			return tf.token, nil
+		}
+		return "", err
+	}
+	tf.token = string(bytes.TrimSpace(data))
+	tf.loadedAt = time.Now()
+	return tf.token, nil
+}
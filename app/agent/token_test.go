@@ -0,0 +1,65 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenFile_Token(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	tf := newTokenFile(path)
+	if _, err := tf.Token(); err == nil {
+		t.Errorf("expected an error for a missing token file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("token1\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if token, err := tf.Token(); err != nil || token != "token1" {
+		t.Errorf("Token() = %s, %v, want token1", token, err)
+	}
+
+	// A rotated token is not seen until the cached one is stale.
+	if err := ioutil.WriteFile(path, []byte("token2"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if token, _ := tf.Token(); token != "token1" {
+		t.Errorf("Token() = %s, want cached token1", token)
+	}
+	tf.loadedAt = time.Now().Add(-2 * tokenRefreshInterval)
+	if token, _ := tf.Token(); token != "token2" {
+		t.Errorf("Token() = %s, want rotated token2", token)
+	}
+
+	// If the file goes away, the last known token is kept.
+	os.Remove(path)
+	tf.loadedAt = time.Now().Add(-2 * tokenRefreshInterval)
+	if token, err := tf.Token(); err != nil || token != "token2" {
+		t.Errorf("Token() = %s, %v, want token2", token, err)
+	}
+}
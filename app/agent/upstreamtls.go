@@ -0,0 +1,62 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// upstreamTLSConfig adjusts how the agent verifies an upstream server.
+// CAFile names a PEM bundle of CAs trusted along with the usual ones, and
+// ServerName overrides the name sent in SNI and checked against the
+// server's certificate.
+type upstreamTLSConfig struct {
+	CAFile     string `yaml:"caFile,omitempty"`
+	ServerName string `yaml:"serverName,omitempty"`
+}
+
+// loadCAFile returns the CA bundle, or nil if none is configured.
+func (c upstreamTLSConfig) loadCAFile() ([]byte, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	pemData, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+	}
+	return pemData, nil
+}
+
+// checkInsecure returns an error if -neverAllowInsecure forbids what from
+// skipping verification of its server's certificate.
+func checkInsecure(what string) error {
+	if *neverAllowInsecure {
+		return fmt.Errorf("%s skips TLS certificate verification, which -neverAllowInsecure forbids", what)
+	}
+	return nil
+}
+
+// tlsModeReporter is implemented by endpoints which report the TLS mode of
+// their upstream connection to the controller.
+type tlsModeReporter interface {
+	tlsMode() string
+}
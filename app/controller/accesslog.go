@@ -0,0 +1,409 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// Formats of the access log.
+const (
+	accessLogFormatCombined = "combined"
+	accessLogFormatJSON     = "json"
+)
+
+// What redacted parts of a URI are replaced with.
+const redacted = "REDACTED"
+
+// accessLog records each request to an agent, or is nil if the access log
+// is disabled.
+var accessLog *accessLogger
+
+// accessLogEntry is one line of the access log.  The middleware fills in
+// what it can see of the request and response, and the handlers what they
+// learn while authenticating and routing it.
+type accessLogEntry struct {
+	Time          time.Time `json:"time"`
+	ClientIP      string    `json:"clientIP"`
+	Identity      string    `json:"identity,omitempty"`
+	Agent         string    `json:"agent,omitempty"`
+	EndpointType  string    `json:"endpointType,omitempty"`
+	EndpointName  string    `json:"endpointName,omitempty"`
+	Method        string    `json:"method"`
+	URI           string    `json:"uri"`
+	Protocol      string    `json:"protocol"`
+	Status        int       `json:"status"`
+	BytesIn       int64     `json:"bytesIn"`
+	BytesOut      int64     `json:"bytesOut"`
+	DurationMS    float64   `json:"durationMs"`
+	TransactionID string    `json:"transactionId,omitempty"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"userAgent,omitempty"`
+}
+
+type accessLogKey struct{}
+
+// accessLogEntryFor returns the entry being built for the request, or nil
+// if it is not being logged.
+func accessLogEntryFor(r *http.Request) *accessLogEntry {
+	entry, _ := r.Context().Value(accessLogKey{}).(*accessLogEntry)
+	return entry
+}
+
+// setAccessLogIdentity records who sent the request, once it is
+// authenticated.
+func setAccessLogIdentity(r *http.Request, identity string) {
+	if entry := accessLogEntryFor(r); entry != nil {
+		entry.Identity = identity
+	}
+}
+
+// setAccessLogEndpoint records the endpoint the request is for.
+func setAccessLogEndpoint(r *http.Request, ep agent.Search) {
+	if entry := accessLogEntryFor(r); entry != nil {
+		entry.Agent, entry.EndpointType, entry.EndpointName = ep.Name, ep.EndpointType, ep.EndpointName
+	}
+}
+
+// setAccessLogTransaction records the ID the request is logged with.
+func setAccessLogTransaction(r *http.Request, transactionID string) {
+	if entry := accessLogEntryFor(r); entry != nil {
+		entry.TransactionID = transactionID
+	}
+}
+
+// certificateIdentity returns the common name of the client certificate,
+// if there is one.
+func certificateIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// serviceIdentity returns the identity of the service credential a request
+// authenticated with: the common name of a service certificate, or the
+// subject of a token or access key, which is the endpoint and agent names.
+func serviceIdentity(r *http.Request, endpointName string, agentName string) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		if names, err := ca.GetCertificateNameFromCert(cert); err == nil && names.Purpose == ca.CertificatePurposeService {
+			return cert.Subject.CommonName
+		}
+	}
+	return endpointName + "." + agentName
+}
+
+// uriRedactor hides secrets in URIs before they are logged.  If query is
+// set, the value of each query parameter is replaced.  Each pattern is then
+// applied to the whole URI: if it has groups, the text each matched is
+// replaced, and otherwise the whole match is.
+type uriRedactor struct {
+	query    bool
+	patterns []*regexp.Regexp
+}
+
+func newURIRedactor(query bool, patterns []string) (*uriRedactor, error) {
+	ret := &uriRedactor{query: query}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		ret.patterns = append(ret.patterns, re)
+	}
+	return ret, nil
+}
+
+func (u *uriRedactor) redact(uri string) string {
+	if u.query {
+		uri = redactQuery(uri)
+	}
+	for _, re := range u.patterns {
+		uri = redactMatches(re, uri)
+	}
+	return uri
+}
+
+// redactQuery replaces the value of each parameter in the query string,
+// keeping the names and their order.
+func redactQuery(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+	params := strings.Split(uri[i+1:], "&")
+	for j, param := range params {
+		if k := strings.IndexByte(param, '='); k >= 0 && k < len(param)-1 {
+			params[j] = param[:k+1] + redacted
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
+func redactMatches(re *regexp.Regexp, s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		spans := [][]int{{m[0], m[1]}}
+		if re.NumSubexp() > 0 {
+			spans = spans[:0]
+			for g := 1; g <= re.NumSubexp(); g++ {
+				if m[2*g] >= 0 {
+					spans = append(spans, []int{m[2*g], m[2*g+1]})
+				}
+			}
+		}
+		for _, span := range spans {
+			if span[0] < last {
+				continue
+			}
+			b.WriteString(s[last:span[0]])
+			b.WriteString(redacted)
+			last = span[1]
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// accessLogger writes an entry for each request to its output, in the
+// combined log format or as JSON.
+type accessLogger struct {
+	sync.Mutex
+	out      io.Writer
+	format   string
+	redactor *uriRedactor
+	now      func() time.Time
+}
+
+// newAccessLogger returns the access logger for the configuration, or nil
+// if it is disabled.
+func newAccessLogger(c accessLogConfig) (*accessLogger, error) {
+	if c.File == "" {
+		return nil, nil
+	}
+	redactor, err := newURIRedactor(c.RedactQuery, c.RedactPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("accessLog.redactPatterns: %v", err)
+	}
+	var out io.Writer = os.Stdout
+	if c.File != "-" {
+		out, err = util.OpenRotatingFile(c.File, int64(c.MaxSizeMB)*1024*1024, c.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %v", err)
+		}
+	}
+	return &accessLogger{out: out, format: c.GetFormat(), redactor: redactor, now: time.Now}, nil
+}
+
+// handler logs each request to next.  If l is nil, next is returned.
+func (l *accessLogger) handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &accessLogEntry{
+			Time:      l.now(),
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			URI:       l.redactor.redact(r.RequestURI),
+			Protocol:  r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		}
+		body := &accessLogBody{ReadCloser: r.Body}
+		r.Body = body
+		lw := &accessLogWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+
+		next.ServeHTTP(lw, r)
+
+		entry.Status = lw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.BytesIn = atomic.LoadInt64(&body.n)
+		entry.BytesOut = lw.n
+		entry.DurationMS = float64(l.now().Sub(entry.Time).Microseconds()) / 1000
+		l.write(entry)
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (l *accessLogger) write(entry *accessLogEntry) {
+	var line []byte
+	if l.format == accessLogFormatJSON {
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			util.Warnf("Unable to write access log: %v", err)
+			return
+		}
+		line = append(buf, '\n')
+	} else {
+		line = []byte(formatCombined(entry))
+	}
+	l.Lock()
+	defer l.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		util.Warnf("Unable to write access log: %v", err)
+	}
+}
+
+// formatCombined returns the entry in the combined log format, followed by
+// the agent, the endpoint as type/name, the request body size, the
+// duration in seconds, and the transaction ID.
+func formatCombined(e *accessLogEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"",
+		logField(e.ClientIP),
+		logField(e.Identity),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogValue(e.Method), escapeLogValue(e.URI), escapeLogValue(e.Protocol),
+		e.Status,
+		logSize(e.BytesOut),
+		escapeLogValue(e.Referer),
+		escapeLogValue(e.UserAgent))
+	endpoint := ""
+	if e.EndpointType != "" || e.EndpointName != "" {
+		endpoint = e.EndpointType + "/" + e.EndpointName
+	}
+	fmt.Fprintf(&b, " %s %s %s %.3f %s\n",
+		logField(e.Agent),
+		logField(endpoint),
+		logSize(e.BytesIn),
+		e.DurationMS/1000,
+		logField(e.TransactionID))
+	return b.String()
+}
+
+// logField returns "-" for an empty field, and the field with spaces and
+// anything unprintable escaped otherwise.
+func logField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(escapeLogValue(s), " ", `\x20`)
+}
+
+// logSize returns "-" for a size of zero, as the combined format does.
+func logSize(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// escapeLogValue escapes quotes, backslashes, and anything unprintable, so
+// a value cannot break up or forge a log line.
+func escapeLogValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// accessLogBody counts the bytes read from a request body.  The body may
+// be read by a goroutine other than the handler's, so n is only accessed
+// atomically.
+type accessLogBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *accessLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// accessLogWriter records the status and size of a response.  Once the
+// connection is hijacked, the status is taken to be 101, and what is sent
+// over it is not counted.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,149 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+)
+
+func TestURIRedactor(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    bool
+		patterns []string
+		uri      string
+		want     string
+	}{
+		{"nothing to redact", true, nil, "/api/v1/pods", "/api/v1/pods"},
+		{"query", true, nil, "/x?token=abc&flag&empty=&b=2", "/x?token=REDACTED&flag&empty=&b=REDACTED"},
+		{"query kept", false, nil, "/x?token=abc", "/x?token=abc"},
+		{"whole match", false, []string{`secret-[a-z]+`}, "/a/secret-abc/b", "/a/REDACTED/b"},
+		{"groups", false, []string{`/users/([^/]+)/keys/([^/]+)`}, "/users/bob/keys/k1/x", "/users/REDACTED/keys/REDACTED/x"},
+		{"query then pattern", true, []string{`/job/([^/?]+)`}, "/job/deploy?token=abc", "/job/REDACTED?token=REDACTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := newURIRedactor(tt.query, tt.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.redact(tt.uri); got != tt.want {
+				t.Errorf("redact(%q) = %q, want %q", tt.uri, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newURIRedactor(false, []string{"("}); err == nil {
+		t.Errorf("expected a bad pattern to fail")
+	}
+}
+
+func TestFormatCombined(t *testing.T) {
+	entry := &accessLogEntry{
+		Time:          time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		ClientIP:      "10.1.2.3",
+		Identity:      "ep1.agent1",
+		Agent:         "agent1",
+		EndpointType:  "kubernetes",
+		EndpointName:  "ep1",
+		Method:        "GET",
+		URI:           `/api/"x"`,
+		Protocol:      "HTTP/1.1",
+		Status:        200,
+		BytesOut:      1234,
+		DurationMS:    1500,
+		TransactionID: "01F",
+		UserAgent:     "kubectl/v1.21.0\n",
+	}
+	want := `10.1.2.3 - ep1.agent1 [04/Mar/2021:05:06:07 +0000] "GET /api/\"x\" HTTP/1.1" 200 1234 "" "kubectl/v1.21.0\x0a" agent1 kubernetes/ep1 - 1.500 01F` + "\n"
+	if got := formatCombined(entry); got != want {
+		t.Errorf("formatCombined() =\n%s\nwant\n%s", got, want)
+	}
+
+	want = `- - - [04/Mar/2021:05:06:07 +0000] "GET / HTTP/1.1" 401 - "" "" - - - 0.000 -` + "\n"
+	if got := formatCombined(&accessLogEntry{Time: entry.Time, Method: "GET", URI: "/", Protocol: "HTTP/1.1", Status: 401}); got != want {
+		t.Errorf("formatCombined() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAccessLogger_handler(t *testing.T) {
+	if h := (*accessLogger)(nil).handler(http.NotFoundHandler()); h == nil {
+		t.Errorf("a disabled access log should return the handler")
+	}
+
+	var out bytes.Buffer
+	redactor, _ := newURIRedactor(true, nil)
+	start := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	now := start
+	l := &accessLogger{out: &out, format: accessLogFormatJSON, redactor: redactor, now: func() time.Time {
+		defer func() { now = now.Add(25 * time.Millisecond) }()
+		return now
+	}}
+
+	h := l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		setAccessLogIdentity(r, "ep1.agent1")
+		setAccessLogEndpoint(r, agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"})
+		setAccessLogTransaction(r, "01F")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	r := httptest.NewRequest("POST", "/api/v1/pods?token=abc", strings.NewReader("request body"))
+	r.RemoteAddr = "10.1.2.3:45678"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated || w.Body.String() != "hello" {
+		t.Errorf("response was %d %q", w.Code, w.Body.String())
+	}
+	var got accessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", out.String(), err)
+	}
+	want := accessLogEntry{
+		Time:          start,
+		ClientIP:      "10.1.2.3",
+		Identity:      "ep1.agent1",
+		Agent:         "agent1",
+		EndpointType:  "kubernetes",
+		EndpointName:  "ep1",
+		Method:        "POST",
+		URI:           "/api/v1/pods?token=REDACTED",
+		Protocol:      "HTTP/1.1",
+		Status:        http.StatusCreated,
+		BytesIn:       12,
+		BytesOut:      5,
+		DurationMS:    25,
+		TransactionID: "01F",
+	}
+	if !got.Time.Equal(want.Time) {
+		t.Errorf("time = %v, want %v", got.Time, want.Time)
+	}
+	got.Time = want.Time
+	if got != want {
+		t.Errorf("entry = %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+const (
+	// sessionAffinityHeader may carry a client's own affinity key, used in
+	// place of the cookie.
+	sessionAffinityHeader = "X-Birger-Session"
+
+	// sessionAffinityCookie carries the affinity key given to a client
+	// which did not send one of its own.
+	sessionAffinityCookie = "birger-session"
+
+	// sessionFailoverHeader is set in a response served by another session
+	// because the one the client was bound to could not take the request.
+	sessionFailoverHeader = "X-Birger-Session-Failover"
+
+	// maxAffinityKeyLength limits the keys clients may choose.
+	maxAffinityKeyLength = 128
+)
+
+// sessionAffinity binds clients to agent sessions.  If nil, it is disabled.
+var sessionAffinity *affinityTable
+
+// configureSessionAffinity sets up session affinity from the config.  The
+// cookie signing key is made here, so cookies issued before a restart are
+// ignored, as are the sessions they named.
+func configureSessionAffinity(c sessionAffinityConfig) error {
+	if len(c.Endpoints) == 0 {
+		sessionAffinity = nil
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	sessionAffinity = newAffinityTable(c, key)
+	return nil
+}
+
+// affinityKey identifies a client's binding for one endpoint.
+type affinityKey struct {
+	agent        string
+	endpointType string
+	endpointName string
+	client       string
+}
+
+type affinityEntry struct {
+	key     affinityKey
+	session string
+	expires time.Time
+}
+
+// affinityTable holds the session each client is bound to.  Entries are
+// kept in order of use, so the least recently used is at the front, and
+// as every entry has the same TTL, so is the next to expire.
+type affinityTable struct {
+	sync.Mutex
+	endpoints  []affinityEndpoint
+	ttl        time.Duration
+	maxEntries int
+	signingKey []byte
+	entries    map[affinityKey]*list.Element
+	lru        *list.List
+	now        func() time.Time
+}
+
+func newAffinityTable(c sessionAffinityConfig, signingKey []byte) *affinityTable {
+	return &affinityTable{
+		endpoints:  c.Endpoints,
+		ttl:        c.GetTTL(),
+		maxEntries: c.GetMaxEntries(),
+		signingKey: signingKey,
+		entries:    map[affinityKey]*list.Element{},
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+func (t *affinityTable) enabled(ep agent.Search) bool {
+	for _, e := range t.endpoints {
+		if e.Type == ep.EndpointType && (e.Name == "" || e.Name == ep.EndpointName) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the cookie value for client.
+func (t *affinityTable) sign(client string) string {
+	mac := hmac.New(sha256.New, t.signingKey)
+	mac.Write([]byte(client))
+	return client + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the client key from a cookie value, if it was signed by
+// this controller.
+func (t *affinityTable) verify(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i <= 0 {
+		return "", false
+	}
+	client := value[:i]
+	if !hmac.Equal([]byte(t.sign(client)), []byte(value)) {
+		return "", false
+	}
+	return client, true
+}
+
+// clientKey returns the client's affinity key from the request header or
+// cookie, or makes a new one.  isNew is set if the client must be sent a
+// cookie carrying it.
+func (t *affinityTable) clientKey(r *http.Request) (client string, isNew bool, err error) {
+	if client := r.Header.Get(sessionAffinityHeader); client != "" && len(client) <= maxAffinityKeyLength {
+		return client, false, nil
+	}
+	if cookie, err := r.Cookie(sessionAffinityCookie); err == nil {
+		if client, ok := t.verify(cookie.Value); ok {
+			return client, false, nil
+		}
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", false, err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), true, nil
+}
+
+// expireLocked removes the entries which have expired.  It must be called
+// with the lock held.
+func (t *affinityTable) expireLocked(now time.Time) {
+	for e := t.lru.Front(); e != nil; e = t.lru.Front() {
+		if e.Value.(*affinityEntry).expires.After(now) {
+			return
+		}
+		t.removeLocked(e)
+	}
+}
+
+func (t *affinityTable) removeLocked(e *list.Element) {
+	t.lru.Remove(e)
+	delete(t.entries, e.Value.(*affinityEntry).key)
+}
+
+// lookup returns the session the client is bound to, if any.
+func (t *affinityTable) lookup(key affinityKey) string {
+	t.Lock()
+	defer t.Unlock()
+	t.expireLocked(t.now())
+	if e, found := t.entries[key]; found {
+		return e.Value.(*affinityEntry).session
+	}
+	return ""
+}
+
+// bind binds the client to session, or refreshes its binding, dropping the
+// least recently used binding if the table is full.
+func (t *affinityTable) bind(key affinityKey, session string) {
+	t.Lock()
+	defer t.Unlock()
+	now := t.now()
+	t.expireLocked(now)
+	if e, found := t.entries[key]; found {
+		entry := e.Value.(*affinityEntry)
+		entry.session = session
+		entry.expires = now.Add(t.ttl)
+		t.lru.MoveToBack(e)
+		return
+	}
+	for t.lru.Len() >= t.maxEntries {
+		t.removeLocked(t.lru.Front())
+	}
+	t.entries[key] = t.lru.PushBack(&affinityEntry{key: key, session: session, expires: now.Add(t.ttl)})
+}
+
+func (t *affinityTable) size() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.lru.Len()
+}
+
+// affinityRequest is one request's use of session affinity.  A nil
+// affinityRequest, for an endpoint without affinity, does nothing.
+type affinityRequest struct {
+	table     *affinityTable
+	key       affinityKey
+	newClient bool
+	bound     string
+}
+
+// startAffinity returns the request's affinity, or nil if session affinity
+// is not enabled for the endpoint.
+func startAffinity(ep agent.Search, r *http.Request) (*affinityRequest, error) {
+	if sessionAffinity == nil || !sessionAffinity.enabled(ep) {
+		return nil, nil
+	}
+	client, isNew, err := sessionAffinity.clientKey(r)
+	if err != nil {
+		return nil, err
+	}
+	key := affinityKey{agent: ep.Name, endpointType: ep.EndpointType, endpointName: ep.EndpointName, client: client}
+	return &affinityRequest{
+		table:     sessionAffinity,
+		key:       key,
+		newClient: isNew,
+		bound:     sessionAffinity.lookup(key),
+	}, nil
+}
+
+// search returns ep preferring the session the client is bound to.
+func (a *affinityRequest) search(ep agent.Search) agent.Search {
+	if a != nil {
+		ep.PreferSession = a.bound
+	}
+	return ep
+}
+
+// routed binds the client to the session the request was sent to.
+func (a *affinityRequest) routed(ep agent.Search) {
+	if a == nil {
+		return
+	}
+	a.table.bind(a.key, ep.Session)
+	if a.bound != "" && a.bound != ep.Session {
+		sessionFailoverCounter.WithLabelValues(ep.Name).Inc()
+	}
+}
+
+// setHeaders adds the cookie for a new client, and notes in the response
+// if it was not served by the session the client was bound to.
+func (a *affinityRequest) setHeaders(resp *tunnel.HttpResponse, ep agent.Search) {
+	if a == nil {
+		return
+	}
+	if a.newClient {
+		cookie := &http.Cookie{
+			Name:     sessionAffinityCookie,
+			Value:    a.table.sign(a.key.client),
+			Path:     "/",
+			MaxAge:   int(a.table.ttl.Seconds()),
+			Secure:   true,
+			HttpOnly: true,
+		}
+		resp.Headers = append(resp.Headers, &tunnel.HttpHeader{Name: "Set-Cookie", Values: []string{cookie.String()}})
+	}
+	if a.bound != "" && a.bound != ep.Session {
+		resp.Headers = append(resp.Headers, &tunnel.HttpHeader{Name: sessionFailoverHeader, Values: []string{"true"}})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestAffinityTable_clientKey(t *testing.T) {
+	table := newAffinityTable(sessionAffinityConfig{}, []byte("key"))
+	other := newAffinityTable(sessionAffinityConfig{}, []byte("other key"))
+	tests := []struct {
+		name       string
+		header     string
+		cookie     string
+		want       string
+		wantIsNew  bool
+		wantUnique bool
+	}{
+		{"header", "client1", "", "client1", false, false},
+		{"header over cookie", "client1", table.sign("client2"), "client1", false, false},
+		{"cookie", "", table.sign("client2"), "client2", false, false},
+		{"unsigned cookie", "", "client2", "", true, true},
+		{"tampered cookie", "", "client3" + strings.TrimPrefix(table.sign("client2"), "client2"), "", true, true},
+		{"cookie from another controller", "", other.sign("client2"), "", true, true},
+		{"header too long", strings.Repeat("x", maxAffinityKeyLength+1), "", "", true, true},
+		{"none", "", "", "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			if tt.header != "" {
+				r.Header.Set(sessionAffinityHeader, tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: sessionAffinityCookie, Value: tt.cookie})
+			}
+			got, isNew, err := table.clientKey(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isNew != tt.wantIsNew {
+				t.Errorf("isNew = %v, want %v", isNew, tt.wantIsNew)
+			}
+			if tt.wantUnique {
+				if got == "" || got == "client2" {
+					t.Errorf("clientKey() = %q, want a new key", got)
+				}
+			} else if got != tt.want {
+				t.Errorf("clientKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAffinityTable_expiry(t *testing.T) {
+	now := time.Now()
+	table := newAffinityTable(sessionAffinityConfig{TTL: 60, MaxEntries: 2}, []byte("key"))
+	table.now = func() time.Time { return now }
+	key := func(client string) affinityKey {
+		return affinityKey{agent: "agent1", endpointType: "kubernetes", endpointName: "ep1", client: client}
+	}
+
+	table.bind(key("a"), "session1")
+	table.bind(key("b"), "session2")
+	if got := table.lookup(key("a")); got != "session1" {
+		t.Errorf("lookup(a) = %q, want session1", got)
+	}
+	if got := table.lookup(affinityKey{agent: "agent1", endpointType: "kubernetes", endpointName: "ep2", client: "a"}); got != "" {
+		t.Errorf("binding for ep1 was used for ep2")
+	}
+
+	// Using a binding keeps it, so the least recently used is dropped
+	// when the table is full.
+	now = now.Add(30 * time.Second)
+	table.bind(key("a"), "session1")
+	table.bind(key("c"), "session3")
+	if table.size() != 2 {
+		t.Errorf("table has %d entries, want 2", table.size())
+	}
+	if got := table.lookup(key("b")); got != "" {
+		t.Errorf("lookup(b) = %q, want it dropped", got)
+	}
+
+	// Bindings expire once unused for the TTL.
+	now = now.Add(30 * time.Second)
+	table.bind(key("c"), "session3")
+	now = now.Add(35 * time.Second)
+	if got := table.lookup(key("a")); got != "" {
+		t.Errorf("lookup(a) = %q, want it expired", got)
+	}
+	if got := table.lookup(key("c")); got != "session3" {
+		t.Errorf("lookup(c) = %q, want session3", got)
+	}
+	now = now.Add(time.Minute)
+	if got := table.lookup(key("c")); got != "" || table.size() != 0 {
+		t.Errorf("lookup(c) = %q with %d entries, want all expired", got, table.size())
+	}
+}
+
+func TestRunAPIHandler_sessionAffinity(t *testing.T) {
+	config = &ControllerConfig{}
+	sessionAffinity = newAffinityTable(sessionAffinityConfig{Endpoints: []affinityEndpoint{{Type: "kubernetes"}}}, []byte("key"))
+	agents.SetSelectionStrategy("agent1", agent.SelectRoundRobin)
+	defer func() {
+		config = nil
+		sessionAffinity = nil
+		agents.SetSelectionStrategy("agent1", agent.SelectRandom)
+	}()
+
+	respond := func(session string) func(*HTTPMessage) {
+		return func(msg *HTTPMessage) {
+			go func() {
+				msg.Out <- &tunnel.AgentToControllerWrapper{
+					Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+						HttpResponse: &tunnel.HttpResponse{
+							Id:      msg.Cmd.Id,
+							Status:  http.StatusNoContent,
+							Headers: []*tunnel.HttpHeader{{Name: "X-Session", Values: []string{session}}},
+						},
+					},
+				}
+			}()
+		}
+	}
+	state1, _ := startFakeAgentSession("session1", respond("session1"))
+	state2, _ := startFakeAgentSession("session2", respond("session2"))
+	var gone *agent.DirectlyConnectedAgent
+	defer func() {
+		for _, state := range []*agent.DirectlyConnectedAgent{state1, state2} {
+			if state != gone {
+				_ = agents.RemoveAgent(state)
+			}
+		}
+	}()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	get := func(setup func(*http.Request)) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "https://localhost/api", nil)
+		setup(r)
+		w := httptest.NewRecorder()
+		runAPIHandler(ep, w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+		}
+		return w
+	}
+
+	// A new client is given a cookie binding it to the session which
+	// served it, despite round robin selection.
+	w := get(func(*http.Request) {})
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionAffinityCookie || !cookies[0].Secure || !cookies[0].HttpOnly {
+		t.Fatalf("expected a secure affinity cookie, got %v", cookies)
+	}
+	bound := w.Header().Get("X-Session")
+	for i := 0; i < 4; i++ {
+		w := get(func(r *http.Request) { r.AddCookie(cookies[0]) })
+		if got := w.Header().Get("X-Session"); got != bound {
+			t.Errorf("request %d served by %s, want %s", i, got, bound)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("request %d was given another cookie", i)
+		}
+	}
+
+	// A client may name itself instead.
+	byHeader := func(r *http.Request) { r.Header.Set(sessionAffinityHeader, "client1") }
+	bound = get(byHeader).Header().Get("X-Session")
+	for i := 0; i < 4; i++ {
+		if got := get(byHeader).Header().Get("X-Session"); got != bound {
+			t.Errorf("request %d served by %s, want %s", i, got, bound)
+		}
+	}
+
+	// Once the session is gone, another serves the client, which is told
+	// of the failover once and then bound to the new session.
+	gone = state1
+	remaining := "session2"
+	if bound == "session2" {
+		gone = state2
+		remaining = "session1"
+	}
+	_ = agents.RemoveAgent(gone)
+	w = get(byHeader)
+	if got := w.Header().Get("X-Session"); got != remaining {
+		t.Errorf("served by %s, want %s", got, remaining)
+	}
+	if w.Header().Get(sessionFailoverHeader) != "true" {
+		t.Errorf("expected %s to be set", sessionFailoverHeader)
+	}
+	if w := get(byHeader); w.Header().Get(sessionFailoverHeader) != "" {
+		t.Errorf("expected %s to be unset once rebound", sessionFailoverHeader)
+	}
+
+	// Endpoints without affinity are unaffected.
+	ep.EndpointType = "jenkins"
+	a, err := startAffinity(ep, httptest.NewRequest("GET", "https://localhost/api", nil))
+	if err != nil || a != nil {
+		t.Errorf("startAffinity() = %v, %v for an endpoint without affinity", a, err)
+	}
+}
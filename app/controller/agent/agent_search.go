@@ -19,15 +19,27 @@ package agent
 import (
 	"fmt"
 	"strings"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
 )
 
 // Search defines the parameters to narrow down an agent.  Each field is required
-// other than Session, which may be empty when "any session" is fine.
+// other than Session, which may be empty when "any session" is fine.  A Name of
+// fwdapi.AnyAgent searches every agent.
 type Search struct {
 	Name         string // The agent name
 	EndpointType string // the endpoint type, eg "jenkins", "kubernetes", "remote-command"
 	EndpointName string // the endpoint name, eg "jenkins1" or "kubernetes1"
 	Session      string // the session ID for a specific agent, used to cancel.
+	DirectOnly   bool   // only consider agents directly connected to this controller
+
+	// ExcludeSessions lists sessions not to consider, such as those which
+	// refused a request because they are shutting down.
+	ExcludeSessions []string
+
+	// PreferSession is chosen over the selection strategy while it can
+	// take the request, such as when a client is bound to it.
+	PreferSession string
 }
 
 func (a Search) String() string {
@@ -37,6 +49,12 @@ func (a Search) String() string {
 	if len(a.Session) > 0 {
 		l = append(l, fmt.Sprintf("session=%s", a.Session))
 	}
+	if len(a.ExcludeSessions) > 0 {
+		l = append(l, fmt.Sprintf("excluding=%s", strings.Join(a.ExcludeSessions, ",")))
+	}
+	if len(a.PreferSession) > 0 {
+		l = append(l, fmt.Sprintf("prefer=%s", a.PreferSession))
+	}
 	if len(a.EndpointType) > 0 {
 		l = append(l, fmt.Sprintf("endpointType=%s", a.EndpointType))
 	}
@@ -50,3 +68,17 @@ func (a Search) String() string {
 func (a *Search) MatchesAgent(t Agent) bool {
 	return a.Name == t.GetName() && (len(a.Session) == 0 || a.Session == t.GetSession())
 }
+
+// AnyAgent returns true if any agent with the endpoint will do.
+func (a *Search) AnyAgent() bool {
+	return a.Name == fwdapi.AnyAgent
+}
+
+func (a *Search) excludes(session string) bool {
+	for _, s := range a.ExcludeSessions {
+		if s == session {
+			return true
+		}
+	}
+	return false
+}
@@ -20,7 +20,16 @@
 //
 package agent
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
 
 // DirectlyConnectedAgent holds all the magic needed to implement a directly connected agent.
 type DirectlyConnectedAgent struct {
@@ -28,14 +37,43 @@ type DirectlyConnectedAgent struct {
 	Session         string
 	Endpoints       []Endpoint
 	Version         string
+	Commit          string
+	BuildDate       string
 	Hostname        string
+	RemoteAddress   string
 	InRequest       chan interface{}
 	InCancelRequest chan string
 	ConnectedAt     uint64
 	LastPing        uint64
 	LastUse         uint64
+
+	// LastReceived is when anything was last received from the agent.
+	LastReceived uint64
+
+	// Traffic counts the HTTP data through this session's tunnel.
+	Traffic Traffic
+
+	// Pings follows the pings the controller sends the agent.
+	Pings Pings
+
+	// Replaced, if set, is closed by Replace when a newer session of the
+	// same agent takes over from this one.
+	Replaced chan struct{}
+
+	// Disconnected, if set, is closed by Disconnect when the session is
+	// disconnected through the control API.
+	Disconnected chan struct{}
+
+	// queueLock is held to queue a message, and exclusively to close the
+	// queues, so nothing is queued once they are closed.
+	queueLock sync.RWMutex
+	closed    bool
 }
 
+// ErrSessionClosed is returned when a message is sent to a session which
+// has disconnected since it was chosen.
+var ErrSessionClosed = errors.New("the agent session has disconnected")
+
 // GetSession returns the randomly assigned session ID.  This is assigned each time
 // an agent connects, and allows routing of cancellation and other messages to the
 // correct instance of an agent.
@@ -53,29 +91,77 @@ func (s *DirectlyConnectedAgent) GetEndpoints() []Endpoint {
 	return s.Endpoints
 }
 
-func (s DirectlyConnectedAgent) String() string {
+func (s *DirectlyConnectedAgent) String() string {
 	return fmt.Sprintf("(name=%s, session=%s)", s.Name, s.Session)
 }
 
-// Close will shut down an agent's requests channels.
+// Close will shut down an agent's requests channels.  The session calls
+// this itself as it shuts down, after it has been removed, waiting for
+// any message being queued.  Later messages fail with ErrSessionClosed.
 func (s *DirectlyConnectedAgent) Close() {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
 	close(s.InRequest)
 	close(s.InCancelRequest)
 }
 
+// Replace tells the session's tunnel that a newer session has taken over,
+// so it should disconnect.  It must be called only once, after the session
+// has been removed.
+func (s *DirectlyConnectedAgent) Replace() {
+	if s.Replaced != nil {
+		close(s.Replaced)
+	}
+}
+
+// Disconnect tells the session's tunnel to disconnect.  It must be called
+// only once, after the session has been removed.
+func (s *DirectlyConnectedAgent) Disconnect() {
+	if s.Disconnected != nil {
+		close(s.Disconnected)
+	}
+}
+
 //
-// Send sends a message to a specific Agent
+// Send queues a message for a specific Agent, waiting up to timeout for
+// room in its queue.
 //
-func (s *DirectlyConnectedAgent) Send(message interface{}) string {
-	s.InRequest <- message
-	return s.Session
+func (s *DirectlyConnectedAgent) Send(message interface{}, timeout time.Duration) error {
+	s.queueLock.RLock()
+	defer s.queueLock.RUnlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if err := enqueue(s.InRequest, message, timeout, s.Name, s.Session); err != nil {
+		return err
+	}
+	queueDepthGauge.WithLabelValues(s.Name).Inc()
+	return nil
+}
+
+//
+// Dequeued must be called as each message sent is taken from InRequest,
+// so the queue depth is tracked.
+//
+func (s *DirectlyConnectedAgent) Dequeued() {
+	queueDepthGauge.WithLabelValues(s.Name).Dec()
 }
 
 //
-// Cancel cancels a specific stream
+// Cancel cancels a specific stream, waiting up to timeout for room in the
+// session's cancel queue.
 //
-func (s *DirectlyConnectedAgent) Cancel(id string) {
-	s.InCancelRequest <- id
+func (s *DirectlyConnectedAgent) Cancel(id string, timeout time.Duration) error {
+	s.queueLock.RLock()
+	defer s.queueLock.RUnlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	return enqueueCancel(s.InCancelRequest, id, timeout, s.Name, s.Session)
 }
 
 //
@@ -90,14 +176,107 @@ func (s *DirectlyConnectedAgent) HasEndpoint(endpointType string, endpointName s
 	return false
 }
 
+//
+// Traffic counts the HTTP data sent to and received from an agent since it
+// connected.  Request bytes are request bodies, and response bytes are the
+// headers and bodies of responses.  It is updated for every chunk, so the
+// fields are only accessed atomically.
+//
+type Traffic struct {
+	RequestBytes   uint64 `json:"requestBytes"`
+	RequestChunks  uint64 `json:"requestChunks"`
+	ResponseBytes  uint64 `json:"responseBytes"`
+	ResponseChunks uint64 `json:"responseChunks"`
+}
+
+// AddRequestChunk counts n bytes of request body sent in one message.
+func (t *Traffic) AddRequestChunk(n int) {
+	atomic.AddUint64(&t.RequestBytes, uint64(n))
+	atomic.AddUint64(&t.RequestChunks, 1)
+}
+
+// AddResponseHeaders counts n bytes of response headers.
+func (t *Traffic) AddResponseHeaders(n int) {
+	atomic.AddUint64(&t.ResponseBytes, uint64(n))
+}
+
+// AddResponseChunk counts n bytes of response body received in one message.
+func (t *Traffic) AddResponseChunk(n int) {
+	atomic.AddUint64(&t.ResponseBytes, uint64(n))
+	atomic.AddUint64(&t.ResponseChunks, 1)
+}
+
+// Snapshot returns the current totals.
+func (t *Traffic) Snapshot() Traffic {
+	return Traffic{
+		RequestBytes:   atomic.LoadUint64(&t.RequestBytes),
+		RequestChunks:  atomic.LoadUint64(&t.RequestChunks),
+		ResponseBytes:  atomic.LoadUint64(&t.ResponseBytes),
+		ResponseChunks: atomic.LoadUint64(&t.ResponseChunks),
+	}
+}
+
+//
+// Pings follows the PingRequests the controller sends an agent which
+// answers them.  They are sent and answered in different goroutines, so
+// the fields are only accessed atomically.  Times are Unix nanoseconds.
+//
+type Pings struct {
+	enabled  uint32
+	sent     uint64 // the Ts of the most recent ping sent
+	answered uint64 // the Ts echoed by the most recent answer
+	rtt      uint64 // the round-trip time of that answer
+}
+
+// Enable records that the agent answers pings.
+func (p *Pings) Enable() {
+	atomic.StoreUint32(&p.enabled, 1)
+}
+
+// Enabled returns true if the agent answers pings.
+func (p *Pings) Enabled() bool {
+	return atomic.LoadUint32(&p.enabled) != 0
+}
+
+// Sent records a ping sent with ts, and returns true if the one before it
+// went unanswered.
+func (p *Pings) Sent(ts uint64) bool {
+	previous := atomic.SwapUint64(&p.sent, ts)
+	return previous != 0 && atomic.LoadUint64(&p.answered) != previous
+}
+
+// Answered records an answer which arrived at now, returning the round-trip
+// time.  False is returned if it cannot be measured.
+func (p *Pings) Answered(resp *tunnel.PingResponse, now time.Time) (time.Duration, bool) {
+	rtt, ok := tunnel.RoundTripTime(resp, now)
+	if !ok {
+		return 0, false
+	}
+	atomic.StoreUint64(&p.answered, resp.EchoedTs)
+	atomic.StoreUint64(&p.rtt, uint64(rtt))
+	return rtt, true
+}
+
+// RTT returns the round-trip time of the most recently answered ping, or
+// zero if none has been.
+func (p *Pings) RTT() time.Duration {
+	return time.Duration(atomic.LoadUint64(&p.rtt))
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
 //
 // DirectlyConnectedAgentStatistics describes statistics for a directly connected agent.
 //
 type DirectlyConnectedAgentStatistics struct {
 	BaseStatistics
-	ConnectedAt uint64 `json:"connectedAt"`
-	LastPing    uint64 `json:"lastPing"`
-	LastUse     uint64 `json:"lastUse"`
+	ConnectedAt uint64  `json:"connectedAt"`
+	LastPing    uint64  `json:"lastPing"`
+	LastUse     uint64  `json:"lastUse"`
+	RTTMillis   float64 `json:"rttMillis,omitempty"`
+	Traffic     Traffic `json:"traffic"`
 }
 
 //
@@ -108,12 +287,61 @@ func (s *DirectlyConnectedAgent) GetStatistics() interface{} {
 		ConnectedAt: s.ConnectedAt,
 		LastPing:    s.LastPing,
 		LastUse:     s.LastUse,
+		RTTMillis:   millis(s.Pings.RTT()),
+		Traffic:     s.Traffic.Snapshot(),
 	}
 	ret.Name = s.Name
 	ret.Session = s.Session
 	ret.ConnectionType = "direct"
 	ret.Endpoints = s.Endpoints
 	ret.Version = s.Version
+	ret.Commit = s.Commit
+	ret.BuildDate = s.BuildDate
 	ret.Hostname = s.Hostname
 	return ret
 }
+
+//
+// GetSessionStatistics returns the statistics for this session used by the
+// control API.  InFlight is left for the caller to fill in.
+//
+func (s *DirectlyConnectedAgent) GetSessionStatistics() fwdapi.SessionStatistics {
+	traffic := s.Traffic.Snapshot()
+	return fwdapi.SessionStatistics{
+		Session:        s.Session,
+		ConnectionType: fwdapi.ConnectionTypeDirect,
+		ConnectedAt:    s.ConnectedAt,
+		LastPing:       atomic.LoadUint64(&s.LastPing),
+		LastUse:        atomic.LoadUint64(&s.LastUse),
+		RTTMillis:      millis(s.Pings.RTT()),
+		Version:        s.Version,
+		Commit:         s.Commit,
+		BuildDate:      s.BuildDate,
+		Hostname:       s.Hostname,
+		Endpoints:      apiEndpoints(s.Endpoints),
+		Traffic: &fwdapi.TrafficStatistics{
+			RequestBytes:   traffic.RequestBytes,
+			RequestChunks:  traffic.RequestChunks,
+			ResponseBytes:  traffic.ResponseBytes,
+			ResponseChunks: traffic.ResponseChunks,
+		},
+	}
+}
+
+//
+// GetAgentInfo returns the description of this agent used by the control API.
+//
+func (s *DirectlyConnectedAgent) GetAgentInfo() fwdapi.AgentInfo {
+	return fwdapi.AgentInfo{
+		Name:          s.Name,
+		Session:       s.Session,
+		ConnectedAt:   s.ConnectedAt,
+		LastPing:      atomic.LoadUint64(&s.LastPing),
+		RTTMillis:     millis(s.Pings.RTT()),
+		RemoteAddress: s.RemoteAddress,
+		Version:       s.Version,
+		Commit:        s.Commit,
+		BuildDate:     s.BuildDate,
+		Endpoints:     apiEndpoints(s.Endpoints),
+	}
+}
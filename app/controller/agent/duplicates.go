@@ -0,0 +1,58 @@
+package agent
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"errors"
+	"fmt"
+)
+
+//
+// DuplicatePolicy decides what happens when an agent connects while
+// another session with the same name is already connected to this
+// controller.  Sessions relayed by peer controllers are not counted.
+//
+type DuplicatePolicy string
+
+// Available duplicate policies.
+const (
+	// DuplicateAllow keeps every session, and requests are spread among them.
+	DuplicateAllow DuplicatePolicy = "allow"
+	// DuplicateReplace removes the existing sessions in favor of the new one.
+	DuplicateReplace DuplicatePolicy = "replace"
+	// DuplicateReject refuses the new session.
+	DuplicateReject DuplicatePolicy = "reject"
+)
+
+// ErrDuplicateAgent is returned when a session is refused because another
+// with the same name is connected.
+var ErrDuplicateAgent = errors.New("another session of this agent is already connected")
+
+//
+// ParseDuplicatePolicy validates a policy name from configuration.  An
+// empty name selects the default, DuplicateAllow.
+//
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch DuplicatePolicy(name) {
+	case "":
+		return DuplicateAllow, nil
+	case DuplicateAllow, DuplicateReplace, DuplicateReject:
+		return DuplicatePolicy(name), nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy '%s', must be one of %s, %s, or %s",
+		name, DuplicateAllow, DuplicateReplace, DuplicateReject)
+}
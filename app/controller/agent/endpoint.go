@@ -16,7 +16,11 @@ package agent
  * limitations under the License.
  */
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
 
 // Endpoint defines the configuration and description provided by the
 // agent.  This describes a service endpoint of a specific type.
@@ -28,8 +32,24 @@ type Endpoint struct {
 	Type       string   `json:"type,omitempty"`
 	Configured bool     `json:"configured,omitempty"`
 	Namespaces []string `json:"namespaces,omitempty"`
+	TLSMode    string   `json:"tlsMode,omitempty"`
 }
 
 func (e *Endpoint) String() string {
 	return fmt.Sprintf("(%s, %s, %v)", e.Type, e.Name, e.Configured)
 }
+
+// apiEndpoints returns the endpoints as described by the control API.
+func apiEndpoints(endpoints []Endpoint) []fwdapi.Endpoint {
+	ret := make([]fwdapi.Endpoint, len(endpoints))
+	for i, ep := range endpoints {
+		ret[i] = fwdapi.Endpoint{
+			Name:       ep.Name,
+			Type:       ep.Type,
+			Configured: ep.Configured,
+			Namespaces: ep.Namespaces,
+			TLSMode:    ep.TLSMode,
+		}
+	}
+	return ret
+}
@@ -0,0 +1,85 @@
+package agent
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+)
+
+//
+// Limits caps the transactions outstanding at once, so a slow agent cannot
+// pile up waiting requests without bound.  MaxPerSession applies to each
+// agent session, and MaxTotal to all of them together.  Zero is unlimited.
+//
+type Limits struct {
+	MaxPerSession int
+	MaxTotal      int
+}
+
+//
+// BusyError is returned by Send when a transaction would exceed the
+// Limits.  Global is set if the limit for all sessions was reached,
+// rather than that of every session which could handle the request.
+//
+type BusyError struct {
+	Search Search
+	Global bool
+	Limit  int
+}
+
+func (e *BusyError) Error() string {
+	if e.Global {
+		return fmt.Sprintf("the controller has its limit of %d requests outstanding", e.Limit)
+	}
+	return fmt.Sprintf("every session for %s has its limit of %d requests outstanding", e.Search, e.Limit)
+}
+
+//
+// SetLimits replaces the limits on outstanding transactions.  Those already
+// outstanding are not affected, but no more are started until they fall
+// below the new limits.
+//
+func (s *ConnectedAgents) SetLimits(limits Limits) {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	s.limits = limits
+	outstandingLimitGauge.WithLabelValues("session").Set(float64(limits.MaxPerSession))
+	outstandingLimitGauge.WithLabelValues("total").Set(float64(limits.MaxTotal))
+}
+
+// GetLimits returns the limits on outstanding transactions.
+func (s *ConnectedAgents) GetLimits() Limits {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	return s.limits
+}
+
+//
+// TotalOutstanding returns the number of transactions outstanding on all
+// sessions.
+//
+func (s *ConnectedAgents) TotalOutstanding() int {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	return s.totalOutstanding
+}
+
+// sessionFull returns true if the session has as many transactions
+// outstanding as it may.  It must be called with the selection lock held.
+func (s *ConnectedAgents) sessionFull(session string) bool {
+	return s.limits.MaxPerSession > 0 && len(s.outstanding[session]) >= s.limits.MaxPerSession
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+// PeerAgent is an agent session connected to a peer controller.  Messages
+// sent to it are handed to the tunnel to that controller, which is shared
+// by every agent the peer advertised.
+type PeerAgent struct {
+	Name          string
+	Session       string
+	RemoteSession string
+	Peer          string
+	Endpoints     []Endpoint
+	Version       string
+	Commit        string
+	BuildDate     string
+	ConnectedAt   uint64
+	Out           *PeerQueue
+}
+
+// PeerQueue carries the messages for every agent a peer controller
+// advertised to the tunnel to that controller.
+type PeerQueue struct {
+	C chan interface{}
+
+	// lock is held to queue a message, and exclusively to close C, so
+	// nothing is queued once it is closed.
+	lock   sync.RWMutex
+	closed bool
+}
+
+// NewPeerQueue returns a queue with room for size messages.
+func NewPeerQueue(size int) *PeerQueue {
+	return &PeerQueue{C: make(chan interface{}, size)}
+}
+
+// Close closes the queue, once any message on its way is in it.  Later
+// messages fail with ErrSessionClosed.
+func (q *PeerQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.C)
+	}
+}
+
+func (q *PeerQueue) send(message interface{}, timeout time.Duration, name string, session string) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return ErrSessionClosed
+	}
+	return enqueue(q.C, message, timeout, name, session)
+}
+
+// PeerRequest is a message for an agent connected to a peer controller.
+type PeerRequest struct {
+	Agent   *PeerAgent
+	Message interface{}
+}
+
+// PeerCancel cancels a transaction sent to a peer controller.
+type PeerCancel struct {
+	ID string
+}
+
+// GetSession returns the session assigned when the peer advertised the agent.
+// This is distinct from the session on the peer, so the same agent advertised
+// over two tunnels is tracked separately.
+func (s *PeerAgent) GetSession() string {
+	return s.Session
+}
+
+// GetName returns the agent name.
+func (s *PeerAgent) GetName() string {
+	return s.Name
+}
+
+// GetEndpoints returns the list of endpoints.
+func (s *PeerAgent) GetEndpoints() []Endpoint {
+	return s.Endpoints
+}
+
+func (s PeerAgent) String() string {
+	return fmt.Sprintf("(name=%s, session=%s, peer=%s)", s.Name, s.Session, s.Peer)
+}
+
+// Close does nothing, as the queue belongs to the peer's tunnel.
+func (s *PeerAgent) Close() {
+}
+
+// Send passes a message to the peer's tunnel, waiting up to timeout for
+// room in its queue.
+func (s *PeerAgent) Send(message interface{}, timeout time.Duration) error {
+	return s.Out.send(&PeerRequest{Agent: s, Message: message}, timeout, s.Name, s.Session)
+}
+
+// Cancel passes a cancellation to the peer's tunnel, waiting up to timeout
+// for room in its queue.
+func (s *PeerAgent) Cancel(id string, timeout time.Duration) error {
+	return s.Out.send(&PeerCancel{ID: id}, timeout, s.Name, s.Session)
+}
+
+// HasEndpoint returns true if the endpoint is present and configured.
+func (s *PeerAgent) HasEndpoint(endpointType string, endpointName string) bool {
+	for _, ep := range s.Endpoints {
+		if ep.Type == endpointType && ep.Name == endpointName {
+			return ep.Configured
+		}
+	}
+	return false
+}
+
+// PeerAgentStatistics describes statistics for an agent connected to a peer.
+type PeerAgentStatistics struct {
+	BaseStatistics
+	Peer        string `json:"peer"`
+	ConnectedAt uint64 `json:"connectedAt"`
+}
+
+// GetStatistics returns a set of stats for the agent.
+func (s *PeerAgent) GetStatistics() interface{} {
+	ret := &PeerAgentStatistics{
+		Peer:        s.Peer,
+		ConnectedAt: s.ConnectedAt,
+	}
+	ret.Name = s.Name
+	ret.Session = s.Session
+	ret.ConnectionType = "peer"
+	ret.Endpoints = s.Endpoints
+	ret.Version = s.Version
+	ret.Commit = s.Commit
+	ret.BuildDate = s.BuildDate
+	return ret
+}
+
+// GetSessionStatistics returns the statistics for this session used by the
+// control API.  InFlight is left for the caller to fill in.
+func (s *PeerAgent) GetSessionStatistics() fwdapi.SessionStatistics {
+	return fwdapi.SessionStatistics{
+		Session:        s.Session,
+		ConnectionType: fwdapi.ConnectionTypePeer,
+		Peer:           s.Peer,
+		ConnectedAt:    s.ConnectedAt,
+		Version:        s.Version,
+		Commit:         s.Commit,
+		BuildDate:      s.BuildDate,
+		Endpoints:      apiEndpoints(s.Endpoints),
+	}
+}
+
+// GetAgentInfo returns the description of this agent used by the control API.
+func (s *PeerAgent) GetAgentInfo() fwdapi.AgentInfo {
+	return fwdapi.AgentInfo{
+		Name:        s.Name,
+		Session:     s.Session,
+		ConnectedAt: s.ConnectedAt,
+		Version:     s.Version,
+		Commit:      s.Commit,
+		BuildDate:   s.BuildDate,
+		Peer:        s.Peer,
+		Endpoints:   apiEndpoints(s.Endpoints),
+	}
+}
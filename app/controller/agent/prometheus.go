@@ -26,4 +26,44 @@ var (
 		Name: "agents_connected",
 		Help: "The currently connected agents",
 	}, []string{"agent"})
+
+	orphanedTransactionsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "controller_orphaned_transactions_total",
+		Help: "The total number of transactions closed because their agent session went away",
+	})
+
+	agentRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_agent_requests_total",
+		Help: "The total number of requests sent to agents, by whether the agent is local or on a peer controller",
+	}, []string{"agent", "route"})
+
+	duplicateAgentsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_duplicate_agent_sessions_total",
+		Help: "The total number of agent sessions which connected while another with the same name was connected, by the policy applied",
+	}, []string{"agent", "policy"})
+
+	sessionOutstandingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_session_outstanding_transactions",
+		Help: "The transactions outstanding on each agent session",
+	}, []string{"agent", "session"})
+
+	outstandingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "controller_outstanding_transactions",
+		Help: "The transactions outstanding on all agent sessions",
+	})
+
+	queueFullCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_agent_queue_full_total",
+		Help: "The total number of messages not sent to an agent session because its queue stayed full for the send timeout",
+	}, []string{"agent"})
+
+	queueDepthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_agent_queue_depth",
+		Help: "The messages queued for each agent's directly connected sessions and not yet written to their tunnels",
+	}, []string{"agent"})
+
+	outstandingLimitGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_outstanding_transactions_limit",
+		Help: "The limit on outstanding transactions for each session, or in total, or zero if unlimited",
+	}, []string{"scope"})
 )
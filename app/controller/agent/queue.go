@@ -0,0 +1,98 @@
+package agent
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+//
+// QueueFullError is returned when a message could not be queued for an
+// agent session within the send timeout, because the goroutine writing
+// to its tunnel is not keeping up or is stuck.
+//
+type QueueFullError struct {
+	Name    string
+	Session string
+	Timeout time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("the queue to session %s of agent %s stayed full for %s", e.Session, e.Name, e.Timeout)
+}
+
+//
+// SetSendTimeout sets how long a message may wait for room in a session's
+// queue.  Zero waits forever.
+//
+func (s *ConnectedAgents) SetSendTimeout(timeout time.Duration) {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	s.sendTimeout = timeout
+}
+
+func (s *ConnectedAgents) getSendTimeout() time.Duration {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	return s.sendTimeout
+}
+
+// enqueue puts message on queue, waiting up to timeout for room, or
+// forever if it is zero.  If it cannot, a *QueueFullError is returned.
+func enqueue(queue chan<- interface{}, message interface{}, timeout time.Duration, name string, session string) error {
+	select {
+	case queue <- message:
+		return nil
+	default:
+	}
+	if timeout == 0 {
+		queue <- message
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case queue <- message:
+		return nil
+	case <-timer.C:
+		queueFullCounter.WithLabelValues(name).Inc()
+		return &QueueFullError{Name: name, Session: session, Timeout: timeout}
+	}
+}
+
+// enqueueCancel is enqueue for a queue of cancellations.
+func enqueueCancel(queue chan<- string, id string, timeout time.Duration, name string, session string) error {
+	select {
+	case queue <- id:
+		return nil
+	default:
+	}
+	if timeout == 0 {
+		queue <- id
+		return nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case queue <- id:
+		return nil
+	case <-timer.C:
+		queueFullCounter.WithLabelValues(name).Inc()
+		return &QueueFullError{Name: name, Session: session, Timeout: timeout}
+	}
+}
@@ -0,0 +1,62 @@
+package agent
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+)
+
+//
+// SelectionStrategy chooses which session handles a request when more
+// than one session of an agent can serve the endpoint.
+//
+type SelectionStrategy string
+
+// Available selection strategies.
+const (
+	SelectRandom           SelectionStrategy = "random"
+	SelectRoundRobin       SelectionStrategy = "roundRobin"
+	SelectLeastOutstanding SelectionStrategy = "leastOutstanding"
+)
+
+//
+// ParseSelectionStrategy validates a strategy name from configuration.  An
+// empty name selects the default, SelectRandom.
+//
+func ParseSelectionStrategy(name string) (SelectionStrategy, error) {
+	switch SelectionStrategy(name) {
+	case "":
+		return SelectRandom, nil
+	case SelectRandom, SelectRoundRobin, SelectLeastOutstanding:
+		return SelectionStrategy(name), nil
+	}
+	return "", fmt.Errorf("unknown selection strategy '%s', must be one of %s, %s, or %s",
+		name, SelectRandom, SelectRoundRobin, SelectLeastOutstanding)
+}
+
+//
+// Transaction is implemented by messages which start a request on an agent
+// session.  These are counted as outstanding against the session until
+// completed or cancelled.  If the session is removed first, the transaction
+// is closed so whatever is waiting on it sees the agent is gone.  Close may
+// be called after the transaction has already ended, and must be safe to
+// call more than once.
+//
+type Transaction interface {
+	TransactionID() string
+	Close()
+}
@@ -18,10 +18,13 @@ package agent
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/util"
 )
 
 var (
@@ -34,11 +37,14 @@ var (
 // such as "directly connected" or "on other controller" agent connections.
 //
 type BaseStatistics struct {
+	Event          string     `json:"event,omitempty"`
 	Name           string     `json:"name,omitempty"`
 	Session        string     `json:"session,omitempty"`
 	ConnectionType string     `json:"connectionType,omitempty"`
 	Endpoints      []Endpoint `json:"endpoints,omitempty"`
 	Version        string     `json:"version,omitempty"`
+	Commit         string     `json:"commit,omitempty"`
+	BuildDate      string     `json:"buildDate,omitempty"`
 	Hostname       string     `json:"hostname,omitempty"`
 }
 
@@ -48,14 +54,16 @@ type BaseStatistics struct {
 //
 type Agent interface {
 	Close()
-	Send(interface{}) string
-	Cancel(string)
+	Send(interface{}, time.Duration) error
+	Cancel(string, time.Duration) error
 	HasEndpoint(string, string) bool
 	GetSession() string
 	GetName() string
 	GetEndpoints() []Endpoint
 
 	GetStatistics() interface{}
+	GetSessionStatistics() fwdapi.SessionStatistics
+	GetAgentInfo() fwdapi.AgentInfo
 }
 
 //
@@ -64,12 +72,33 @@ type Agent interface {
 type ConnectedAgents struct {
 	sync.RWMutex
 	m map[string][]Agent
+
+	strategy        SelectionStrategy
+	agentStrategies map[string]SelectionStrategy
+
+	duplicatePolicy        DuplicatePolicy
+	agentDuplicatePolicies map[string]DuplicatePolicy
+
+	// selection protects the state below, which is updated while only
+	// holding the read lock.
+	selection        sync.Mutex
+	roundRobin       map[string]int
+	outstanding      map[string]map[string]Transaction
+	totalOutstanding int
+	limits           Limits
+	sendTimeout      time.Duration
+
+	// changed is closed and replaced whenever an agent is added or removed,
+	// or its endpoints change.
+	changed chan struct{}
 }
 
 //
 // GetStatistics returns statistics for all agents currently connected.
 // The statistics returned is an opaque object, intended to be rendered to JSON or some
-// other output format using a system that uses introspection.
+// other output format using a system that uses introspection.  It is only kept for
+// controllers configured for the legacy statistics response, and GetAgentStatistics
+// should be used instead.
 //
 func (s *ConnectedAgents) GetStatistics() interface{} {
 	ret := make([]interface{}, 0)
@@ -83,16 +112,216 @@ func (s *ConnectedAgents) GetStatistics() interface{} {
 	return ret
 }
 
+//
+// GetAgentStatistics returns statistics for each connected agent and its
+// sessions, sorted by agent name and then session.
+//
+func (s *ConnectedAgents) GetAgentStatistics() []fwdapi.AgentStatistics {
+	s.RLock()
+	defer s.RUnlock()
+	ret := make([]fwdapi.AgentStatistics, 0, len(s.m))
+	for name, agentList := range s.m {
+		if len(agentList) == 0 {
+			continue
+		}
+		sessions := make([]fwdapi.SessionStatistics, len(agentList))
+		for i, agent := range agentList {
+			sessions[i] = agent.GetSessionStatistics()
+		}
+		s.selection.Lock()
+		for i := range sessions {
+			sessions[i].InFlight = len(s.outstanding[sessions[i].Session])
+		}
+		s.selection.Unlock()
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].Session < sessions[j].Session })
+		ret = append(ret, fwdapi.AgentStatistics{Name: name, Sessions: sessions})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+//
+// GetAgents returns a description of every agent session currently connected,
+// sorted by agent name and then session.
+//
+func (s *ConnectedAgents) GetAgents() []fwdapi.AgentInfo {
+	ret := []fwdapi.AgentInfo{}
+	s.RLock()
+	for _, agentList := range s.m {
+		for _, agent := range agentList {
+			ret = append(ret, agent.GetAgentInfo())
+		}
+	}
+	s.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].Session < ret[j].Session
+	})
+	return ret
+}
+
 //
 // MakeAgents returns a new agent object which will manage (safely) agents
 // connected directly or indirectly.
 //
 func MakeAgents() *ConnectedAgents {
 	return &ConnectedAgents{
-		m: make(map[string][]Agent),
+		m:                      make(map[string][]Agent),
+		strategy:               SelectRandom,
+		agentStrategies:        make(map[string]SelectionStrategy),
+		duplicatePolicy:        DuplicateAllow,
+		agentDuplicatePolicies: make(map[string]DuplicatePolicy),
+		roundRobin:             make(map[string]int),
+		outstanding:            make(map[string]map[string]Transaction),
+		changed:                make(chan struct{}),
 	}
 }
 
+//
+// Changed returns a channel which is closed the next time an agent is
+// added or removed, or its endpoints change.
+//
+func (s *ConnectedAgents) Changed() <-chan struct{} {
+	s.RLock()
+	defer s.RUnlock()
+	return s.changed
+}
+
+// notifyChanged must be called with the write lock held.
+func (s *ConnectedAgents) notifyChanged() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+//
+// SetSelectionStrategy sets how a session is chosen for the named agent.
+// If name is empty, the default for all agents is set.
+//
+func (s *ConnectedAgents) SetSelectionStrategy(name string, strategy SelectionStrategy) {
+	s.Lock()
+	defer s.Unlock()
+	if name == "" {
+		s.strategy = strategy
+		return
+	}
+	s.agentStrategies[name] = strategy
+}
+
+func (s *ConnectedAgents) selectionStrategy(name string) SelectionStrategy {
+	if strategy, found := s.agentStrategies[name]; found {
+		return strategy
+	}
+	return s.strategy
+}
+
+//
+// SetDuplicatePolicy sets what AdmitAgent does with a second session of
+// the named agent.  If name is empty, the default for all agents is set.
+//
+func (s *ConnectedAgents) SetDuplicatePolicy(name string, policy DuplicatePolicy) {
+	s.Lock()
+	defer s.Unlock()
+	if name == "" {
+		s.duplicatePolicy = policy
+		return
+	}
+	s.agentDuplicatePolicies[name] = policy
+}
+
+func (s *ConnectedAgents) duplicatePolicyFor(name string) DuplicatePolicy {
+	if policy, found := s.agentDuplicatePolicies[name]; found {
+		return policy
+	}
+	return s.duplicatePolicy
+}
+
+//
+// Outstanding returns the number of transactions sent to the agent session
+// which have not yet completed or been cancelled.
+//
+func (s *ConnectedAgents) Outstanding(session string) int {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	return len(s.outstanding[session])
+}
+
+//
+// OutstandingByAgent returns, for each connected agent, the number of
+// transactions outstanding across all of its sessions.
+//
+func (s *ConnectedAgents) OutstandingByAgent() map[string]int {
+	s.RLock()
+	defer s.RUnlock()
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	ret := make(map[string]int, len(s.m))
+	for name, agentList := range s.m {
+		n := 0
+		for _, agent := range agentList {
+			n += len(s.outstanding[agent.GetSession()])
+		}
+		ret[name] = n
+	}
+	return ret
+}
+
+// startTransaction must be called with the selection lock held.
+func (s *ConnectedAgents) startTransaction(name string, session string, t Transaction) {
+	ids, found := s.outstanding[session]
+	if !found {
+		ids = make(map[string]Transaction)
+		s.outstanding[session] = ids
+	}
+	if _, found := ids[t.TransactionID()]; !found {
+		s.totalOutstanding++
+	}
+	ids[t.TransactionID()] = t
+	sessionOutstandingGauge.WithLabelValues(name, session).Set(float64(len(ids)))
+	outstandingGauge.Set(float64(s.totalOutstanding))
+}
+
+// orphanTransactions forgets every transaction still outstanding on a
+// session which is going away.  They are not closed here, as the session
+// may be delivering a reply to one of them; the session closes them as it
+// shuts down, so their handlers fail rather than wait for replies which
+// will never arrive.
+func (s *ConnectedAgents) orphanTransactions(name string, session string) {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	orphanedTransactionsCounter.Add(float64(len(s.outstanding[session])))
+	s.totalOutstanding -= len(s.outstanding[session])
+	delete(s.outstanding, session)
+	sessionOutstandingGauge.DeleteLabelValues(name, session)
+	outstandingGauge.Set(float64(s.totalOutstanding))
+}
+
+func (s *ConnectedAgents) endTransaction(name string, session string, id string) {
+	s.selection.Lock()
+	defer s.selection.Unlock()
+	ids, found := s.outstanding[session]
+	if !found {
+		return
+	}
+	if _, found := ids[id]; !found {
+		return
+	}
+	delete(ids, id)
+	s.totalOutstanding--
+	sessionOutstandingGauge.WithLabelValues(name, session).Set(float64(len(ids)))
+	outstandingGauge.Set(float64(s.totalOutstanding))
+}
+
+//
+// Complete marks a transaction sent with Send as finished, so it no longer
+// counts against the session.  The search must have the Session set.  It is
+// safe to call this more than once, or after Cancel.
+//
+func (s *ConnectedAgents) Complete(ep Search, id string) {
+	s.endTransaction(ep.Name, ep.Session, id)
+}
+
 func sliceIndex(limit int, predicate func(i int) bool) int {
 	for i := 0; i < limit; i++ {
 		if predicate(i) {
@@ -108,28 +337,132 @@ func sliceIndex(limit int, predicate func(i int) bool) int {
 func (s *ConnectedAgents) AddAgent(state Agent) {
 	s.Lock()
 	defer s.Unlock()
+	s.addLocked(state)
+}
+
+//
+// AdmitAgent adds a directly connected agent, applying the duplicate
+// policy for its name if other sessions are already connected here.  With
+// DuplicateReject, ErrDuplicateAgent is returned and nothing changes.  With
+// DuplicateReplace, the existing sessions are removed and returned, so the
+// caller can tell them they were replaced.  Their transactions are left
+// for them to close as they disconnect.
+//
+func (s *ConnectedAgents) AdmitAgent(state Agent) ([]Agent, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	duplicates := []Agent{}
+	for _, a := range s.m[state.GetName()] {
+		if a == state {
+			return nil, nil
+		}
+		if _, ok := a.(*PeerAgent); !ok {
+			duplicates = append(duplicates, a)
+		}
+	}
+
+	if len(duplicates) > 0 {
+		switch s.duplicatePolicyFor(state.GetName()) {
+		case DuplicateReject:
+			duplicateAgentsCounter.WithLabelValues(state.GetName(), string(DuplicateReject)).Inc()
+			return nil, ErrDuplicateAgent
+		case DuplicateReplace:
+			duplicateAgentsCounter.WithLabelValues(state.GetName(), string(DuplicateReplace)).Inc()
+			for _, a := range duplicates {
+				if err := s.removeLocked(a); err != nil {
+					return nil, err
+				}
+			}
+			s.addLocked(state)
+			return duplicates, nil
+		default:
+			duplicateAgentsCounter.WithLabelValues(state.GetName(), string(DuplicateAllow)).Inc()
+		}
+	}
+
+	s.addLocked(state)
+	return nil, nil
+}
+
+// addLocked must be called with the write lock held.
+func (s *ConnectedAgents) addLocked(state Agent) {
 	agentList, ok := s.m[state.GetName()]
 	if !ok {
 		agentList = make([]Agent, 0)
 	}
 	agentList = append(agentList, state)
 	s.m[state.GetName()] = agentList
-	log.Printf("Agent %s added, now at %d paths, %d endpoints", state, len(agentList), len(state.GetEndpoints()))
+	util.Infof("Agent %s added, now at %d paths, %d endpoints", state, len(agentList), len(state.GetEndpoints()))
 	for _, endpoint := range state.GetEndpoints() {
-		log.Printf("  agent %s, endpoint: %s", state, &endpoint)
+		util.Infof("  agent %s, endpoint: %s", state, &endpoint)
 	}
 	connectedAgentsGauge.WithLabelValues(state.GetName()).Inc()
+	s.notifyChanged()
 }
 
 //
-// RemoveAgent will remove an agent and signal to it that closing down is started.
+// SetEndpoints replaces the endpoints of a directly connected session, as
+// when the agent reloads its configuration.  Requests are routed using the
+// new list from then on.
+//
+func (s *ConnectedAgents) SetEndpoints(state *DirectlyConnectedAgent, endpoints []Endpoint) {
+	s.Lock()
+	defer s.Unlock()
+	state.Endpoints = endpoints
+	util.Infof("Agent %s updated, now at %d endpoints", state, len(endpoints))
+	for _, endpoint := range endpoints {
+		util.Infof("  agent %s, endpoint: %s", state, &endpoint)
+	}
+	s.notifyChanged()
+}
+
+//
+// RemoveAgent will remove an agent, so no more requests are routed to it.
+// Any transactions still outstanding on the session are left for it to close,
+// as are its queues.
 //
 func (s *ConnectedAgents) RemoveAgent(state Agent) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.removeLocked(state)
+}
 
-	state.Close()
+//
+// RemoveSessions removes the sessions of the named agent connected directly
+// to this controller, or only the one with the given ID if session is not
+// empty.  The sessions removed are returned, so the caller can disconnect
+// them, and they close any transactions still outstanding on them.
+//
+func (s *ConnectedAgents) RemoveSessions(name string, session string) []Agent {
+	s.Lock()
+	defer s.Unlock()
 
+	matched := []Agent{}
+	for _, a := range s.m[name] {
+		if _, ok := a.(*PeerAgent); ok {
+			continue
+		}
+		if session == "" || a.GetSession() == session {
+			matched = append(matched, a)
+		}
+	}
+
+	removed := []Agent{}
+	for _, a := range matched {
+		if err := s.removeLocked(a); err != nil {
+			util.Warnf("while removing agent: %v", err)
+			continue
+		}
+		removed = append(removed, a)
+	}
+	return removed
+}
+
+// removeLocked must be called with the write lock held.  The session's
+// queues are not closed here, as a message may still be on its way to
+// them; the session closes them itself.
+func (s *ConnectedAgents) removeLocked(state Agent) error {
 	agentList, ok := s.m[state.GetName()]
 	if !ok {
 		// This should not be possible.
@@ -147,67 +480,256 @@ func (s *ConnectedAgents) RemoveAgent(state Agent) error {
 	agentList[len(agentList)-1] = nil
 	agentList = agentList[:len(agentList)-1]
 	s.m[state.GetName()] = agentList
+	s.orphanTransactions(state.GetName(), state.GetSession())
 	connectedAgentsGauge.WithLabelValues(state.GetName()).Dec()
-	log.Printf("agent %s removed, now at %d paths", state, len(agentList))
+	s.notifyChanged()
+	util.Infof("agent %s removed, now at %d paths", state, len(agentList))
 	return nil
 }
 
+//
+// NoAgentError is returned when no connected agent can handle a request
+// for an endpoint.  ErrorDetails names the agent and endpoint, so a
+// client refused one can tell what was missing.
+//
+type NoAgentError struct {
+	Search  Search
+	message string
+}
+
+func (e *NoAgentError) Error() string {
+	return e.message
+}
+
+// ErrorDetails returns the agent and endpoint searched for.
+func (e *NoAgentError) ErrorDetails() map[string]string {
+	return map[string]string{
+		"agentName":    e.Search.Name,
+		"endpointType": e.Search.EndpointType,
+		"endpointName": e.Search.EndpointName,
+	}
+}
+
+// allAgents returns every session of every agent.
+func (s *ConnectedAgents) allAgents() []Agent {
+	ret := []Agent{}
+	for _, agentList := range s.m {
+		ret = append(ret, agentList...)
+	}
+	return ret
+}
+
 func (s *ConnectedAgents) findService(ep Search) (Agent, error) {
 	agentList, ok := s.m[ep.Name]
+	strategy := s.selectionStrategy(ep.Name)
+	if ep.AnyAgent() {
+		// Any agent will do, so the least loaded session is chosen.
+		agentList = s.allAgents()
+		ok = true
+		strategy = SelectLeastOutstanding
+	}
 	if !ok || len(agentList) == 0 {
-		return nil, fmt.Errorf("no agents connected for %s", ep)
+		return nil, &NoAgentError{Search: ep, message: fmt.Sprintf("no agents connected for %s", ep)}
 	}
+	// Agents connected directly are preferred over those on a peer.  Sessions
+	// with as many transactions outstanding as they may have are skipped.
 	possibleAgents := []int{}
+	peerAgents := []int{}
+	busy := false
 	for i, a := range agentList {
-		if a.HasEndpoint(ep.EndpointType, ep.EndpointName) {
+		if !a.HasEndpoint(ep.EndpointType, ep.EndpointName) || ep.excludes(a.GetSession()) {
+			continue
+		}
+		if s.sessionFull(a.GetSession()) {
+			busy = true
+			continue
+		}
+		if _, ok := a.(*PeerAgent); ok {
+			peerAgents = append(peerAgents, i)
+		} else {
 			possibleAgents = append(possibleAgents, i)
 		}
 	}
+	if len(possibleAgents) == 0 && !ep.DirectOnly {
+		possibleAgents = peerAgents
+	}
+	if len(possibleAgents) == 0 && busy {
+		return nil, &BusyError{Search: ep, Limit: s.limits.MaxPerSession}
+	}
 	if len(possibleAgents) == 0 {
-		return nil, fmt.Errorf("request for %s, no such path exists or all are unconfigured", ep)
+		return nil, &NoAgentError{Search: ep, message: fmt.Sprintf("request for %s, no such path exists or all are unconfigured", ep)}
+	}
+	for _, i := range possibleAgents {
+		if ep.PreferSession != "" && agentList[i].GetSession() == ep.PreferSession {
+			return agentList[i], nil
+		}
+	}
+	selected := possibleAgents[0]
+	switch strategy {
+	case SelectRoundRobin:
+		next := s.roundRobin[ep.Name]
+		selected = possibleAgents[next%len(possibleAgents)]
+		s.roundRobin[ep.Name] = next + 1
+	case SelectLeastOutstanding:
+		// Ties are broken at random, so idle sessions share the load.
+		least := -1
+		ties := 0
+		for _, i := range possibleAgents {
+			n := len(s.outstanding[agentList[i].GetSession()])
+			switch {
+			case least == -1 || n < least:
+				least = n
+				selected = i
+				ties = 1
+			case n == least:
+				ties++
+				if rnd.Intn(ties) == 0 {
+					selected = i
+				}
+			}
+		}
+	default:
+		selected = possibleAgents[rnd.Intn(len(possibleAgents))]
 	}
-	selected := possibleAgents[rnd.Intn(len(possibleAgents))]
 	return agentList[selected], nil
 }
 
 //
-// Send will search for the specific agent and endpoint. send a message to an agent, and return true if an agent
-// was found.
+// Send will search for the specific agent and endpoint, send a message to an agent, and return
+// the session it was sent to.  Only sessions which advertised the endpoint as configured in
+// their hello are considered; if there are none, an error is returned and nothing is sent.
+// If more than one session can handle the endpoint, the search's PreferSession is chosen if
+// it is one of them, and otherwise one is chosen using the agent's SelectionStrategy.
+// Messages which implement Transaction are counted against the session until
+// Complete or Cancel is called.  Sessions at their Limits are passed over, and if every one is,
+// or the controller as a whole is, a *BusyError is returned.  If the chosen session's queue
+// stays full for the send timeout, a *QueueFullError is returned and nothing is counted.
+//
+func (s *ConnectedAgents) Send(ep Search, message interface{}) (string, error) {
+	routed, err := s.Route(ep, message)
+	if err != nil {
+		return "", err
+	}
+	return routed.Session, nil
+}
+
+//
+// Route is Send, but returns the search with the session it was sent to
+// set, and the name of the agent it was sent to, which differs from the
+// one searched for if the search was for any agent.  Later messages for a
+// transaction use it to follow the first.
 //
-func (s *ConnectedAgents) Send(ep Search, message interface{}) (string, bool) {
+func (s *ConnectedAgents) Route(ep Search, message interface{}) (Search, error) {
 	s.RLock()
-	defer s.RUnlock()
+	s.selection.Lock()
+	t, isTransaction := message.(Transaction)
+	if isTransaction && s.limits.MaxTotal > 0 && s.totalOutstanding >= s.limits.MaxTotal {
+		s.selection.Unlock()
+		s.RUnlock()
+		err := &BusyError{Search: ep, Global: true, Limit: s.limits.MaxTotal}
+		util.Warnf("%v", err)
+		return Search{}, err
+	}
 	agent, err := s.findService(ep)
 	if err != nil {
-		log.Printf("%v", err)
-		return "", false
+		s.selection.Unlock()
+		s.RUnlock()
+		util.Warnf("%v", err)
+		return Search{}, err
+	}
+	if isTransaction {
+		s.startTransaction(agent.GetName(), agent.GetSession(), t)
 	}
-	session := agent.Send(message)
-	return session, true
+	timeout := s.sendTimeout
+	s.selection.Unlock()
+	// The send may wait for room in a stalled session's queue, which must
+	// not hold up changes to the registry.
+	s.RUnlock()
+	if err := agent.Send(message, timeout); err != nil {
+		if isTransaction {
+			s.endTransaction(agent.GetName(), agent.GetSession(), t.TransactionID())
+		}
+		util.Warnf("%v", err)
+		return Search{}, err
+	}
+	if isTransaction {
+		route := "local"
+		if _, ok := agent.(*PeerAgent); ok {
+			route = "peer"
+		}
+		agentRequestsCounter.WithLabelValues(agent.GetName(), route).Inc()
+	}
+	ep.Name = agent.GetName()
+	ep.Session = agent.GetSession()
+	return ep, nil
 }
 
 //
-// Cancel will cancel an ongoing request.
+// SendToSession will send a message to the specific agent session named in
+// the search, which must have the Session set.  This is used when later
+// messages for a transaction must follow the first one to the same agent.
 //
-func (s *ConnectedAgents) Cancel(ep Search, id string) error {
-	// The session must be set, if not this is an error.
+func (s *ConnectedAgents) SendToSession(ep Search, message interface{}) error {
 	if len(ep.Session) == 0 {
 		return fmt.Errorf("session is not set (coding error)")
 	}
 
+	a, err := s.findSession(ep)
+	if err != nil {
+		return err
+	}
+	return a.Send(message, s.getSendTimeout())
+}
+
+// findSession returns the session named in the search.
+func (s *ConnectedAgents) findSession(ep Search) (Agent, error) {
 	s.RLock()
 	defer s.RUnlock()
 	agentList, ok := s.m[ep.Name]
 	if !ok || len(agentList) == 0 {
-		return fmt.Errorf("no agents connected for: %s (likely coding error)", ep)
+		return nil, fmt.Errorf("no agents connected for: %s", ep)
 	}
 
 	for _, a := range agentList {
 		if ep.MatchesAgent(a) {
-			a.Cancel(id)
-			return nil
+			return a, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no agents with specific session exist for %s", ep)
+}
+
+//
+// SendAll will send a message to every connected agent session.  Sessions
+// whose queues stay full for the send timeout are skipped.
+//
+func (s *ConnectedAgents) SendAll(message interface{}) {
+	timeout := s.getSendTimeout()
+	s.RLock()
+	sessions := s.allAgents()
+	s.RUnlock()
+	for _, a := range sessions {
+		if err := a.Send(message, timeout); err != nil {
+			util.Warnf("%v", err)
 		}
 	}
+}
 
-	return fmt.Errorf("no agents with specific session exist for %s (likely coding error)", ep)
+//
+// Cancel will cancel an ongoing request.  If the session's queue stays full
+// for the send timeout, a *QueueFullError is returned and the cancel is
+// dropped, though the transaction no longer counts against the session.
+//
+func (s *ConnectedAgents) Cancel(ep Search, id string) error {
+	// The session must be set, if not this is an error.
+	if len(ep.Session) == 0 {
+		return fmt.Errorf("session is not set (coding error)")
+	}
+
+	a, err := s.findSession(ep)
+	if err != nil {
+		return fmt.Errorf("%v (likely coding error)", err)
+	}
+	s.endTransaction(a.GetName(), a.GetSession(), id)
+	return a.Cancel(id, s.getSendTimeout())
 }
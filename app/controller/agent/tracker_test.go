@@ -18,8 +18,12 @@ package agent
 
 import (
 	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
 	. "gopkg.in/check.v1"
 )
 
@@ -62,17 +66,22 @@ type FakeAgent struct {
 
 	lastCancelled string
 	lastMessage   int
+	sent          int
 }
 
 func (a *FakeAgent) Close() {}
 
-func (a *FakeAgent) Send(m interface{}) string {
-	a.lastMessage = m.(int)
-	return a.session
+func (a *FakeAgent) Send(m interface{}, timeout time.Duration) error {
+	if i, ok := m.(int); ok {
+		a.lastMessage = i
+	}
+	a.sent++
+	return nil
 }
 
-func (a *FakeAgent) Cancel(id string) {
+func (a *FakeAgent) Cancel(id string, timeout time.Duration) error {
 	a.lastCancelled = id
+	return nil
 }
 
 func (a *FakeAgent) HasEndpoint(endpointType string, endpointName string) bool {
@@ -97,6 +106,14 @@ func (a *FakeAgent) GetStatistics() interface{} {
 	return FakeStats{Name: a.name, Session: a.session, ConnectionType: "fake"}
 }
 
+func (a *FakeAgent) GetSessionStatistics() fwdapi.SessionStatistics {
+	return fwdapi.SessionStatistics{Session: a.session, ConnectionType: "fake"}
+}
+
+func (a *FakeAgent) GetAgentInfo() fwdapi.AgentInfo {
+	return fwdapi.AgentInfo{Name: a.name, Session: a.session}
+}
+
 func (a *FakeAgent) GetEndpoints() []Endpoint {
 	return a.endpoints
 }
@@ -146,6 +163,7 @@ func (s *MySuite) TestConnectedAgents(c *C) {
 	// Try to find an agent that does not exist
 	_, err = agents.findService(Search{Name: "agent99", EndpointType: "type1", EndpointName: "ep1"})
 	c.Assert(err, ErrorMatches, "no agents connected for.*")
+	c.Assert(err.(*NoAgentError).ErrorDetails(), DeepEquals, map[string]string{"agentName": "agent99", "endpointType": "type1", "endpointName": "ep1"})
 
 	// Try to find a service on an agent, where the agent exists but the service does not.
 	_, err = agents.findService(Search{Name: "agent1", EndpointType: "type99", EndpointName: "ep1"})
@@ -156,16 +174,42 @@ func (s *MySuite) TestConnectedAgents(c *C) {
 	///
 
 	// send to non-existent agent
-	session, found := agents.Send(Search{Name: "agent19", EndpointType: "type1", EndpointName: "ep1"}, 5)
-	c.Assert(found, Equals, false)
+	session, err := agents.Send(Search{Name: "agent19", EndpointType: "type1", EndpointName: "ep1"}, 5)
+	c.Assert(err, ErrorMatches, ".*no agents connected.*")
+	c.Assert(session, Equals, "")
+
+	// send to an endpoint the agent did not advertise
+	session, err = agents.Send(Search{Name: "agent1", EndpointType: "type99", EndpointName: "ep1"}, 5)
+	c.Assert(err, ErrorMatches, ".*no such path exists.*")
 	c.Assert(session, Equals, "")
 
 	// working
-	session, found = agents.Send(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1"}, 5)
-	c.Assert(found, Equals, true)
+	session, err = agents.Send(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1"}, 5)
+	c.Assert(err, IsNil)
 	c.Assert(session, Equals, "agent1.session2")
 	c.Assert(agent1Session2.lastMessage, Equals, 5)
 
+	///
+	/// SendToSession()
+	///
+
+	// Session not set
+	err = agents.SendToSession(Search{Name: "agent1", EndpointType: "type1", EndpointName: "ep1"}, 6)
+	c.Assert(err, ErrorMatches, ".*session is not set.*")
+
+	// No agent
+	err = agents.SendToSession(Search{Session: "nosession", Name: "agent99"}, 6)
+	c.Assert(err, ErrorMatches, ".*no agents connected for.*")
+
+	// Agent exists, session does not
+	err = agents.SendToSession(Search{Session: "nosession", Name: "agent1"}, 6)
+	c.Assert(err, ErrorMatches, ".*with specific session.*")
+
+	// working
+	err = agents.SendToSession(Search{Session: "agent1.session2", Name: "agent1"}, 6)
+	c.Assert(err, IsNil)
+	c.Assert(agent1Session2.lastMessage, Equals, 6)
+
 	///
 	/// Cancel()
 	///
@@ -195,6 +239,85 @@ func (s *MySuite) TestConnectedAgents(c *C) {
 	j, err := json.Marshal(stats)
 	c.Assert(err, IsNil) // json should not fail...
 	c.Assert(string(j), Equals, `[{"name":"agent1","session":"agent1.session2","connectionType":"fake"}]`)
+
+	///
+	/// SendAll
+	///
+
+	agents.SendAll(7)
+	c.Assert(agent1Session2.lastMessage, Equals, 7)
+
+	///
+	/// GetAgents
+	///
+
+	agents.AddAgent(bogusagent)
+	agents.AddAgent(agent1Session1)
+	info := agents.GetAgents()
+	c.Assert(info, HasLen, 3)
+	c.Assert(info[0].Session, Equals, "agent1.session1")
+	c.Assert(info[1].Session, Equals, "agent1.session2")
+	c.Assert(info[2].Session, Equals, "agent99.session1")
+}
+
+func (s *MySuite) TestDirectlyConnectedAgent_GetAgentInfo(c *C) {
+	a := &DirectlyConnectedAgent{
+		Name:          "agent1",
+		Session:       "session1",
+		Version:       "1.2.3",
+		Commit:        "abc123",
+		BuildDate:     "2021-06-01T00:00:00Z",
+		RemoteAddress: "10.0.0.1:1234",
+		ConnectedAt:   100,
+		LastPing:      200,
+		Endpoints: []Endpoint{
+			{Name: "ep1", Type: "kubernetes", Configured: true, Namespaces: []string{"ns1"}},
+		},
+	}
+	info := a.GetAgentInfo()
+	c.Assert(info, DeepEquals, fwdapi.AgentInfo{
+		Name:          "agent1",
+		Session:       "session1",
+		ConnectedAt:   100,
+		LastPing:      200,
+		RemoteAddress: "10.0.0.1:1234",
+		Version:       "1.2.3",
+		Commit:        "abc123",
+		BuildDate:     "2021-06-01T00:00:00Z",
+		Endpoints: []fwdapi.Endpoint{
+			{Name: "ep1", Type: "kubernetes", Configured: true, Namespaces: []string{"ns1"}},
+		},
+	})
+}
+
+func (s *MySuite) TestDirectlyConnectedAgent_GetSessionStatistics(c *C) {
+	a := &DirectlyConnectedAgent{
+		Name:        "agent1",
+		Session:     "session1",
+		Version:     "1.2.3",
+		Hostname:    "host1",
+		ConnectedAt: 100,
+		LastPing:    200,
+		LastUse:     300,
+		Endpoints: []Endpoint{
+			{Name: "ep1", Type: "kubernetes", Configured: true},
+		},
+	}
+	a.Traffic.AddRequestChunk(10)
+	a.Traffic.AddResponseChunk(20)
+	c.Assert(a.GetSessionStatistics(), DeepEquals, fwdapi.SessionStatistics{
+		Session:        "session1",
+		ConnectionType: fwdapi.ConnectionTypeDirect,
+		ConnectedAt:    100,
+		LastPing:       200,
+		LastUse:        300,
+		Version:        "1.2.3",
+		Hostname:       "host1",
+		Endpoints: []fwdapi.Endpoint{
+			{Name: "ep1", Type: "kubernetes", Configured: true},
+		},
+		Traffic: &fwdapi.TrafficStatistics{RequestBytes: 10, RequestChunks: 1, ResponseBytes: 20, ResponseChunks: 1},
+	})
 }
 
 func (s *MySuite) TestConnectedAgents_sliceIndex(c *C) {
@@ -203,3 +326,576 @@ func (s *MySuite) TestConnectedAgents_sliceIndex(c *C) {
 	c.Assert(sliceIndex(len(ints), func(i int) bool { return ints[i] == 8 }), Equals, 1)
 	c.Assert(sliceIndex(len(ints), func(i int) bool { return ints[i] == -99 }), Equals, -1)
 }
+
+type fakeTransaction string
+
+func (t fakeTransaction) TransactionID() string { return string(t) }
+
+func (t fakeTransaction) Close() {}
+
+// closeCountingTransaction counts how often it is closed.
+type closeCountingTransaction struct {
+	id     string
+	closed int
+}
+
+func (t *closeCountingTransaction) TransactionID() string { return t.id }
+
+func (t *closeCountingTransaction) Close() { t.closed++ }
+
+func makeFakeSessions(agents *ConnectedAgents, count int) []*FakeAgent {
+	sessions := make([]*FakeAgent, count)
+	for i := range sessions {
+		sessions[i] = &FakeAgent{
+			name:      "lb",
+			session:   fmt.Sprintf("lb.session%d", i),
+			endpoints: []Endpoint{{Name: "ep1", Type: "type1", Configured: true}},
+		}
+		agents.AddAgent(sessions[i])
+	}
+	return sessions
+}
+
+var lbSearch = Search{Name: "lb", EndpointType: "type1", EndpointName: "ep1"}
+
+func (s *MySuite) TestConnectedAgents_roundRobin(c *C) {
+	agents := MakeAgents()
+	agents.SetSelectionStrategy("lb", SelectRoundRobin)
+	sessions := makeFakeSessions(agents, 3)
+
+	for i := 0; i < 30; i++ {
+		_, err := agents.Send(lbSearch, i)
+		c.Assert(err, IsNil)
+	}
+	for _, a := range sessions {
+		c.Assert(a.sent, Equals, 10)
+	}
+}
+
+func (s *MySuite) TestConnectedAgents_random(c *C) {
+	agents := MakeAgents()
+	sessions := makeFakeSessions(agents, 3)
+
+	for i := 0; i < 300; i++ {
+		_, err := agents.Send(lbSearch, i)
+		c.Assert(err, IsNil)
+	}
+	for _, a := range sessions {
+		c.Assert(a.sent > 0, Equals, true)
+	}
+}
+
+func (s *MySuite) TestConnectedAgents_leastOutstanding(c *C) {
+	agents := MakeAgents()
+	agents.SetSelectionStrategy("", SelectLeastOutstanding)
+	sessions := makeFakeSessions(agents, 3)
+
+	// Transactions which are never completed spread evenly.
+	sessionFor := map[string]string{}
+	for i := 0; i < 9; i++ {
+		id := fmt.Sprintf("t%d", i)
+		session, err := agents.Send(lbSearch, fakeTransaction(id))
+		c.Assert(err, IsNil)
+		sessionFor[id] = session
+	}
+	for _, a := range sessions {
+		c.Assert(a.sent, Equals, 3)
+		c.Assert(agents.Outstanding(a.session), Equals, 3)
+	}
+
+	// Completing or cancelling transactions on one session makes it the
+	// least loaded, so it receives the next requests.
+	target := sessions[1].session
+	finished := 0
+	for id, session := range sessionFor {
+		if session != target {
+			continue
+		}
+		ep := lbSearch
+		ep.Session = session
+		if finished == 0 {
+			agents.Complete(ep, id)
+			// completing twice has no further effect
+			agents.Complete(ep, id)
+		} else {
+			c.Assert(agents.Cancel(ep, id), IsNil)
+		}
+		finished++
+	}
+	c.Assert(agents.Outstanding(target), Equals, 0)
+
+	for i := 0; i < 3; i++ {
+		session, err := agents.Send(lbSearch, fakeTransaction(fmt.Sprintf("n%d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(session, Equals, target)
+	}
+	c.Assert(agents.Outstanding(target), Equals, 3)
+
+	// Non-transaction messages are not counted.
+	agents.Send(lbSearch, 5)
+	total := 0
+	for _, a := range sessions {
+		total += agents.Outstanding(a.session)
+	}
+	c.Assert(total, Equals, 9)
+
+	// Removing a session forgets its transactions.
+	c.Assert(agents.RemoveAgent(sessions[0]), IsNil)
+	c.Assert(agents.Outstanding(sessions[0].session), Equals, 0)
+}
+
+func (s *MySuite) TestConnectedAgents_anyAgent(c *C) {
+	agents := MakeAgents()
+	for _, name := range []string{"agent1", "agent2"} {
+		agents.AddAgent(&FakeAgent{
+			name:      name,
+			session:   name + ".session",
+			endpoints: []Endpoint{{Name: "ep1", Type: "type1", Configured: true}},
+		})
+	}
+	search := Search{Name: fwdapi.AnyAgent, EndpointType: "type1", EndpointName: "ep1"}
+
+	// Outstanding transactions spread across agents of any name, and the
+	// route names the agent chosen.
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		routed, err := agents.Route(search, fakeTransaction(fmt.Sprintf("t%d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(routed.Session, Equals, routed.Name+".session")
+		counts[routed.Name]++
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"agent1": 2, "agent2": 2})
+
+	search.EndpointName = "ep2"
+	_, err := agents.Route(search, fakeTransaction("t5"))
+	c.Assert(err, FitsTypeOf, &NoAgentError{})
+}
+
+func (s *MySuite) TestConnectedAgents_excludeSessions(c *C) {
+	agents := MakeAgents()
+	sessions := makeFakeSessions(agents, 3)
+
+	search := lbSearch
+	search.ExcludeSessions = []string{sessions[0].session, sessions[2].session}
+	for i := 0; i < 10; i++ {
+		session, err := agents.Send(search, i)
+		c.Assert(err, IsNil)
+		c.Assert(session, Equals, sessions[1].session)
+	}
+
+	search.ExcludeSessions = append(search.ExcludeSessions, sessions[1].session)
+	_, err := agents.Send(search, 0)
+	c.Assert(err, NotNil)
+}
+
+func (s *MySuite) TestConnectedAgents_limits(c *C) {
+	agents := MakeAgents()
+	agents.SetSelectionStrategy("", SelectLeastOutstanding)
+	sessions := makeFakeSessions(agents, 2)
+	agents.SetLimits(Limits{MaxPerSession: 2, MaxTotal: 4})
+
+	// Sessions at their limit are passed over.
+	first := ""
+	for i := 0; i < 2; i++ {
+		id := fmt.Sprintf("t%d", i)
+		session, err := agents.Send(lbSearch, fakeTransaction(id))
+		c.Assert(err, IsNil)
+		if session == sessions[0].session {
+			first = id
+		}
+	}
+	search := lbSearch
+	search.ExcludeSessions = []string{sessions[1].session}
+	_, err := agents.Send(search, fakeTransaction("t2"))
+	c.Assert(err, IsNil)
+	_, err = agents.Send(search, fakeTransaction("t3"))
+	c.Assert(err, FitsTypeOf, &BusyError{})
+	c.Assert(err.(*BusyError).Global, Equals, false)
+	c.Assert(err, ErrorMatches, ".*limit of 2 requests outstanding.*")
+
+	// The other session still has room, until the total is reached.
+	session, err := agents.Send(lbSearch, fakeTransaction("t4"))
+	c.Assert(err, IsNil)
+	c.Assert(session, Equals, sessions[1].session)
+	c.Assert(agents.TotalOutstanding(), Equals, 4)
+	agents.SetLimits(Limits{MaxPerSession: 3, MaxTotal: 4})
+	_, err = agents.Send(lbSearch, fakeTransaction("t5"))
+	c.Assert(err, FitsTypeOf, &BusyError{})
+	c.Assert(err.(*BusyError).Global, Equals, true)
+
+	// Messages which are not transactions are not limited.
+	_, err = agents.Send(lbSearch, 5)
+	c.Assert(err, IsNil)
+
+	// Completing, cancelling, or removing the session each free their
+	// transactions exactly once.
+	ep := lbSearch
+	ep.Session = sessions[0].session
+	agents.Complete(ep, first)
+	agents.Complete(ep, first)
+	c.Assert(agents.TotalOutstanding(), Equals, 3)
+	c.Assert(agents.Cancel(ep, "t2"), IsNil)
+	c.Assert(agents.Cancel(ep, "t2"), IsNil)
+	c.Assert(agents.TotalOutstanding(), Equals, 2)
+	c.Assert(agents.RemoveAgent(sessions[1]), IsNil)
+	c.Assert(agents.TotalOutstanding(), Equals, 0)
+
+	// Lifting the limits allows more.
+	agents.SetLimits(Limits{})
+	c.Assert(agents.GetLimits(), Equals, Limits{})
+	for i := 0; i < 5; i++ {
+		_, err := agents.Send(lbSearch, fakeTransaction(fmt.Sprintf("n%d", i)))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(agents.TotalOutstanding(), Equals, 5)
+}
+
+func (s *MySuite) TestConnectedAgents_queueFull(c *C) {
+	agents := MakeAgents()
+	agents.SetSendTimeout(20 * time.Millisecond)
+	stalled := &DirectlyConnectedAgent{
+		Name:      "lb",
+		Session:   "stalled",
+		Endpoints: []Endpoint{{Type: "type1", Name: "ep1", Configured: true}},
+		InRequest: make(chan interface{}, 1),
+	}
+	agents.AddAgent(stalled)
+
+	// The first message fills the queue, and nothing reads it.
+	session, err := agents.Send(lbSearch, fakeTransaction("t1"))
+	c.Assert(err, IsNil)
+	c.Assert(session, Equals, "stalled")
+
+	start := time.Now()
+	_, err = agents.Send(lbSearch, fakeTransaction("t2"))
+	c.Assert(err, FitsTypeOf, &QueueFullError{})
+	c.Assert(err, ErrorMatches, ".*session stalled of agent lb stayed full for 20ms")
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(agents.TotalOutstanding(), Equals, 1)
+
+	ep := lbSearch
+	ep.Session = "stalled"
+	c.Assert(agents.SendToSession(ep, 5), FitsTypeOf, &QueueFullError{})
+
+	// Once the session reads its queue, there is room again.
+	<-stalled.InRequest
+	stalled.Dequeued()
+	_, err = agents.Send(lbSearch, fakeTransaction("t3"))
+	c.Assert(err, IsNil)
+	c.Assert(agents.TotalOutstanding(), Equals, 2)
+}
+
+func (s *MySuite) TestConnectedAgents_stalledCancel(c *C) {
+	agents := MakeAgents()
+	agents.SetSendTimeout(20 * time.Millisecond)
+	stalled := &DirectlyConnectedAgent{
+		Name:            "lb",
+		Session:         "stalled",
+		Endpoints:       []Endpoint{{Type: "type1", Name: "ep1", Configured: true}},
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 1),
+	}
+	agents.AddAgent(stalled)
+	ep := lbSearch
+	ep.Session = "stalled"
+
+	// The first cancel fills the queue, and nothing reads it.
+	c.Assert(agents.Cancel(ep, "t1"), IsNil)
+	start := time.Now()
+	c.Assert(agents.Cancel(ep, "t2"), FitsTypeOf, &QueueFullError{})
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *MySuite) TestConnectedAgents_waitOutsideLock(c *C) {
+	agents := MakeAgents()
+	stalled := &DirectlyConnectedAgent{
+		Name:            "lb",
+		Session:         "stalled",
+		Endpoints:       []Endpoint{{Type: "type1", Name: "ep1", Configured: true}},
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 1),
+	}
+	agents.AddAgent(stalled)
+	ep := lbSearch
+	ep.Session = "stalled"
+	_, err := agents.Send(lbSearch, 1)
+	c.Assert(err, IsNil)
+	c.Assert(agents.Cancel(ep, "t1"), IsNil)
+
+	// With no send timeout, these wait until the session reads its
+	// queues, which does not hold up changes to the registry.
+	waiting := make(chan error, 2)
+	go func() {
+		_, err := agents.Send(lbSearch, 2)
+		waiting <- err
+	}()
+	go func() { waiting <- agents.Cancel(ep, "t2") }()
+	time.Sleep(50 * time.Millisecond)
+	removed := make(chan error, 1)
+	go func() { removed <- agents.RemoveAgent(stalled) }()
+	select {
+	case err := <-removed:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("removing the session waited for a send to it")
+	}
+
+	<-stalled.InRequest
+	<-stalled.InCancelRequest
+	for i := 0; i < 2; i++ {
+		c.Assert(<-waiting, IsNil)
+	}
+
+	// Once the session closes its queues, nothing more is queued.
+	stalled.Close()
+	c.Assert(stalled.Send(3, 0), Equals, ErrSessionClosed)
+	c.Assert(stalled.Cancel("t3", 0), Equals, ErrSessionClosed)
+}
+
+func (s *MySuite) TestParseSelectionStrategy(c *C) {
+	strategy, err := ParseSelectionStrategy("")
+	c.Assert(err, IsNil)
+	c.Assert(strategy, Equals, SelectRandom)
+
+	strategy, err = ParseSelectionStrategy("leastOutstanding")
+	c.Assert(err, IsNil)
+	c.Assert(strategy, Equals, SelectLeastOutstanding)
+
+	_, err = ParseSelectionStrategy("bogus")
+	c.Assert(err, ErrorMatches, ".*unknown selection strategy 'bogus'.*")
+}
+
+func (s *MySuite) TestConnectedAgents_peerAgents(c *C) {
+	agents := MakeAgents()
+	changed := agents.Changed()
+
+	out := NewPeerQueue(10)
+	peer := &PeerAgent{
+		Name:          "lb",
+		Session:       "lb.peer1",
+		RemoteSession: "remote1",
+		Peer:          "controller2",
+		Endpoints:     []Endpoint{{Name: "ep1", Type: "type1", Configured: true}},
+		Out:           out,
+	}
+	agents.AddAgent(peer)
+	select {
+	case <-changed:
+	default:
+		c.Fatal("expected Changed to be closed when an agent is added")
+	}
+
+	// Only the peer has the agent.
+	session, err := agents.Send(lbSearch, 5)
+	c.Assert(err, IsNil)
+	c.Assert(session, Equals, "lb.peer1")
+	req := (<-out.C).(*PeerRequest)
+	c.Assert(req.Agent, Equals, peer)
+	c.Assert(req.Message, Equals, 5)
+
+	direct := lbSearch
+	direct.DirectOnly = true
+	_, err = agents.Send(direct, 5)
+	c.Assert(err, ErrorMatches, ".*no such path exists.*")
+
+	// A local session is always preferred.
+	sessions := makeFakeSessions(agents, 1)
+	for i := 0; i < 10; i++ {
+		session, err := agents.Send(lbSearch, i)
+		c.Assert(err, IsNil)
+		c.Assert(session, Equals, sessions[0].session)
+	}
+	c.Assert(out.C, HasLen, 0)
+
+	ep := lbSearch
+	ep.Session = "lb.peer1"
+	c.Assert(agents.Cancel(ep, "t1"), IsNil)
+	c.Assert((<-out.C).(*PeerCancel).ID, Equals, "t1")
+
+	info := peer.GetAgentInfo()
+	c.Assert(info.Peer, Equals, "controller2")
+}
+
+func (s *MySuite) TestParseDuplicatePolicy(c *C) {
+	policy, err := ParseDuplicatePolicy("")
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, DuplicateAllow)
+
+	policy, err = ParseDuplicatePolicy("replace")
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, DuplicateReplace)
+
+	_, err = ParseDuplicatePolicy("bogus")
+	c.Assert(err, ErrorMatches, ".*unknown duplicate policy 'bogus'.*")
+}
+
+// admitConcurrently signs in two sessions of agent "dup" at the same time,
+// returning the sessions, what each replaced, and any errors.
+func admitConcurrently(agents *ConnectedAgents) ([]*FakeAgent, [][]Agent, []error) {
+	endpoints := []Endpoint{{Name: "ep1", Type: "type1", Configured: true}}
+	sessions := []*FakeAgent{
+		{name: "dup", session: "dup.session1", endpoints: endpoints},
+		{name: "dup", session: "dup.session2", endpoints: endpoints},
+	}
+	replaced := make([][]Agent, len(sessions))
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replaced[i], errs[i] = agents.AdmitAgent(sessions[i])
+		}(i)
+	}
+	wg.Wait()
+	return sessions, replaced, errs
+}
+
+func (s *MySuite) TestAdmitAgent_allow(c *C) {
+	agents := MakeAgents()
+	_, replaced, errs := admitConcurrently(agents)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+	c.Assert(replaced[0], HasLen, 0)
+	c.Assert(replaced[1], HasLen, 0)
+	c.Assert(agents.m["dup"], HasLen, 2)
+}
+
+func (s *MySuite) TestAdmitAgent_reject(c *C) {
+	agents := MakeAgents()
+	agents.SetDuplicatePolicy("dup", DuplicateReject)
+	sessions, _, errs := admitConcurrently(agents)
+
+	// Whichever signed in first is kept.
+	c.Assert(agents.m["dup"], HasLen, 1)
+	winner := 0
+	if agents.m["dup"][0] == sessions[1] {
+		winner = 1
+	}
+	c.Assert(errs[winner], IsNil)
+	c.Assert(errs[1-winner], Equals, ErrDuplicateAgent)
+}
+
+func (s *MySuite) TestAdmitAgent_replace(c *C) {
+	agents := MakeAgents()
+	agents.SetDuplicatePolicy("", DuplicateReplace)
+	sessions, replaced, errs := admitConcurrently(agents)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+
+	// Whichever signed in last is kept, and replaced the other.
+	c.Assert(agents.m["dup"], HasLen, 1)
+	winner := 0
+	if agents.m["dup"][0] == sessions[1] {
+		winner = 1
+	}
+	c.Assert(replaced[winner], DeepEquals, []Agent{sessions[1-winner]})
+	c.Assert(replaced[1-winner], HasLen, 0)
+
+	// A transaction on a replaced session is left for it to close.
+	t := &closeCountingTransaction{id: "t1"}
+	session, err := agents.Send(Search{Name: "dup", EndpointType: "type1", EndpointName: "ep1"}, t)
+	c.Assert(err, IsNil)
+	newer := &FakeAgent{
+		name:      "dup",
+		session:   "dup.session3",
+		endpoints: []Endpoint{{Name: "ep1", Type: "type1", Configured: true}},
+	}
+	replacedNow, err := agents.AdmitAgent(newer)
+	c.Assert(err, IsNil)
+	c.Assert(replacedNow, DeepEquals, []Agent{sessions[winner]})
+	c.Assert(agents.Outstanding(session), Equals, 0)
+	c.Assert(t.closed, Equals, 0)
+}
+
+func (s *MySuite) TestAdmitAgent_peersIgnored(c *C) {
+	agents := MakeAgents()
+	agents.SetDuplicatePolicy("", DuplicateReject)
+	agents.AddAgent(&PeerAgent{Name: "dup", Session: "dup.peer1", Out: NewPeerQueue(1)})
+
+	replaced, err := agents.AdmitAgent(&FakeAgent{name: "dup", session: "dup.session1"})
+	c.Assert(err, IsNil)
+	c.Assert(replaced, HasLen, 0)
+	c.Assert(agents.m["dup"], HasLen, 2)
+}
+
+func (s *MySuite) TestRemoveSessions(c *C) {
+	agents := MakeAgents()
+	agents.AddAgent(&FakeAgent{name: "kick", session: "kick.session1"})
+	agents.AddAgent(&FakeAgent{
+		name:      "kick",
+		session:   "kick.session2",
+		endpoints: []Endpoint{{Name: "ep1", Type: "type1", Configured: true}},
+	})
+	agents.AddAgent(&PeerAgent{Name: "kick", Session: "kick.peer1", Out: NewPeerQueue(1)})
+	agents.AddAgent(&FakeAgent{name: "other", session: "other.session1"})
+
+	t := &closeCountingTransaction{id: "t1"}
+	session, err := agents.Send(Search{Name: "kick", EndpointType: "type1", EndpointName: "ep1"}, t)
+	c.Assert(err, IsNil)
+	c.Assert(session, Equals, "kick.session2")
+
+	// The transaction is forgotten, but left for the session to close.
+	removed := agents.RemoveSessions("kick", "kick.session2")
+	c.Assert(removed, HasLen, 1)
+	c.Assert(removed[0].GetSession(), Equals, "kick.session2")
+	c.Assert(agents.m["kick"], HasLen, 2)
+	c.Assert(agents.Outstanding("kick.session2"), Equals, 0)
+	c.Assert(t.closed, Equals, 0)
+
+	c.Assert(agents.RemoveSessions("kick", "kick.unknown"), HasLen, 0)
+
+	// Sessions on a peer are left for the peer to disconnect.
+	removed = agents.RemoveSessions("kick", "")
+	c.Assert(removed, HasLen, 1)
+	c.Assert(removed[0].GetSession(), Equals, "kick.session1")
+	c.Assert(agents.m["kick"], HasLen, 1)
+	c.Assert(agents.m["other"], HasLen, 1)
+}
+
+func (s *MySuite) TestConnectedAgents_preferSession(c *C) {
+	agents := MakeAgents()
+	agents.SetSelectionStrategy("lb", SelectRoundRobin)
+	sessions := makeFakeSessions(agents, 3)
+	agents.SetLimits(Limits{MaxPerSession: 2})
+
+	search := lbSearch
+	search.PreferSession = sessions[1].session
+	for i := 0; i < 2; i++ {
+		session, err := agents.Send(search, fakeTransaction(fmt.Sprintf("t%d", i)))
+		c.Assert(err, IsNil)
+		c.Assert(session, Equals, sessions[1].session)
+	}
+
+	// Once the preferred session is full, or gone, another is chosen.
+	session, err := agents.Send(search, fakeTransaction("t2"))
+	c.Assert(err, IsNil)
+	c.Assert(session, Not(Equals), sessions[1].session)
+	c.Assert(agents.RemoveAgent(sessions[1]), IsNil)
+	session, err = agents.Send(search, 3)
+	c.Assert(err, IsNil)
+	c.Assert(session, Not(Equals), sessions[1].session)
+}
+
+func (s *MySuite) TestConnectedAgents_GetAgentStatistics(c *C) {
+	agents := MakeAgents()
+	c.Assert(agents.GetAgentStatistics(), HasLen, 0)
+
+	sessions := makeFakeSessions(agents, 2)
+	agents.AddAgent(&FakeAgent{name: "agent1", session: "agent1.session1"})
+	ep := lbSearch
+	ep.PreferSession = sessions[1].session
+	for i := 0; i < 2; i++ {
+		_, err := agents.Send(ep, fakeTransaction(fmt.Sprintf("t%d", i)))
+		c.Assert(err, IsNil)
+	}
+
+	stats := agents.GetAgentStatistics()
+	c.Assert(stats, HasLen, 2)
+	c.Assert(stats[0].Name, Equals, "agent1")
+	c.Assert(stats[0].Sessions, HasLen, 1)
+	c.Assert(stats[1].Name, Equals, "lb")
+	c.Assert(stats[1].Sessions, HasLen, 2)
+	c.Assert(stats[1].Sessions[0].Session, Equals, sessions[0].session)
+	c.Assert(stats[1].Sessions[0].InFlight, Equals, 0)
+	c.Assert(stats[1].Sessions[1].Session, Equals, sessions[1].session)
+	c.Assert(stats[1].Sessions[1].InFlight, Equals, 2)
+}
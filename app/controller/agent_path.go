@@ -0,0 +1,124 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// parseAgentPath splits a path of the form
+// /agents/<agent>/<type>/<name>/<path> into the endpoint it names, the
+// prefix which identifies that endpoint, and the remaining path to send to
+// it.  The path should be escaped, so the remainder is forwarded unchanged.
+func parseAgentPath(escapedPath string) (ep agent.Search, prefix string, rest string, err error) {
+	if !strings.HasPrefix(escapedPath, fwdapi.AgentProxyPrefix) {
+		return agent.Search{}, "", "", fmt.Errorf("path must start with %s", fwdapi.AgentProxyPrefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(escapedPath, fwdapi.AgentProxyPrefix), "/", 4)
+	if len(parts) < 3 {
+		return agent.Search{}, "", "", fmt.Errorf("path must be %s<agent>/<type>/<name>/<path>", fwdapi.AgentProxyPrefix)
+	}
+	names := make([]string, 3)
+	for i, part := range parts[:3] {
+		names[i], err = url.PathUnescape(part)
+		if err != nil {
+			return agent.Search{}, "", "", err
+		}
+		if names[i] == "" {
+			return agent.Search{}, "", "", fmt.Errorf("path must be %s<agent>/<type>/<name>/<path>", fwdapi.AgentProxyPrefix)
+		}
+	}
+	rest = "/"
+	if len(parts) == 4 {
+		rest += parts[3]
+	}
+	ep = agent.Search{Name: names[0], EndpointType: names[1], EndpointName: names[2]}
+	prefix = fwdapi.AgentProxyPrefix + strings.Join(parts[:3], "/")
+	return ep, prefix, rest, nil
+}
+
+// agentPathHandler forwards a request on the control port to the endpoint
+// named in its path, with the prefix removed.  The caller is expected to
+// have checked the client has a control certificate.
+func agentPathHandler(w http.ResponseWriter, r *http.Request) {
+	ep, prefix, rest, err := parseAgentPath(r.URL.EscapedPath())
+	if err != nil {
+		util.FailRequest(w, err, http.StatusBadRequest)
+		return
+	}
+
+	r.URL.RawPath = rest
+	r.URL.Path, err = url.PathUnescape(rest)
+	if err != nil {
+		util.FailRequest(w, err, http.StatusBadRequest)
+		return
+	}
+	r.RequestURI = r.URL.RequestURI()
+
+	setAccessLogIdentity(r, certificateIdentity(r))
+	runAPIHandler(ep, &locationRewriter{ResponseWriter: w, prefix: prefix}, r)
+}
+
+// locationRewriter adds prefix to any Location header which is an
+// absolute path on the endpoint, so redirects keep going through the
+// controller.  Absolute URLs are left alone, as the endpoint's own
+// address is not known here.
+type locationRewriter struct {
+	http.ResponseWriter
+	prefix      string
+	wroteHeader bool
+}
+
+func (l *locationRewriter) WriteHeader(code int) {
+	if !l.wroteHeader {
+		l.wroteHeader = true
+		if location := l.Header().Get("Location"); strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+			l.Header().Set("Location", l.prefix+location)
+		}
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *locationRewriter) Write(p []byte) (int, error) {
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusOK)
+	}
+	return l.ResponseWriter.Write(p)
+}
+
+func (l *locationRewriter) Flush() {
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (l *locationRewriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := l.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
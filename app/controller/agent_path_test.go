@@ -0,0 +1,170 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestParseAgentPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantEp     agent.Search
+		wantPrefix string
+		wantRest   string
+		wantErr    bool
+	}{
+		{
+			"with path",
+			"/agents/agent1/kubernetes/ep1/api/v1/pods",
+			agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"},
+			"/agents/agent1/kubernetes/ep1",
+			"/api/v1/pods",
+			false,
+		},
+		{
+			"no trailing slash",
+			"/agents/agent1/kubernetes/ep1",
+			agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"},
+			"/agents/agent1/kubernetes/ep1",
+			"/",
+			false,
+		},
+		{
+			"trailing slash",
+			"/agents/agent1/kubernetes/ep1/",
+			agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"},
+			"/agents/agent1/kubernetes/ep1",
+			"/",
+			false,
+		},
+		{
+			"escaped names and path",
+			"/agents/agent%201/jenkins/ep1/job/a%2Fb",
+			agent.Search{Name: "agent 1", EndpointType: "jenkins", EndpointName: "ep1"},
+			"/agents/agent%201/jenkins/ep1",
+			"/job/a%2Fb",
+			false,
+		},
+		{"missing name", "/agents/agent1/kubernetes", agent.Search{}, "", "", true},
+		{"empty type", "/agents/agent1//ep1/x", agent.Search{}, "", "", true},
+		{"wrong prefix", "/api/v1/agents", agent.Search{}, "", "", true},
+		{"bad escape", "/agents/agent%zz/kubernetes/ep1/", agent.Search{}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, prefix, rest, err := parseAgentPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAgentPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(ep, tt.wantEp) {
+				t.Errorf("parseAgentPath() ep = %#v, want %#v", ep, tt.wantEp)
+			}
+			if prefix != tt.wantPrefix {
+				t.Errorf("parseAgentPath() prefix = %s, want %s", prefix, tt.wantPrefix)
+			}
+			if rest != tt.wantRest {
+				t.Errorf("parseAgentPath() rest = %s, want %s", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestAgentPathHandler(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	uris := make(chan string, 1)
+	location := ""
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		uris <- msg.Cmd.URI
+		go func() {
+			msg.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+					HttpResponse: &tunnel.HttpResponse{
+						Id:      msg.Cmd.Id,
+						Status:  http.StatusFound,
+						Headers: []*tunnel.HttpHeader{{Name: "Location", Values: []string{location}}},
+					},
+				},
+			}
+		}()
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	tests := []struct {
+		name         string
+		target       string
+		location     string
+		wantURI      string
+		wantLocation string
+	}{
+		{
+			"relative location",
+			"https://localhost/agents/agent1/kubernetes/ep1/api/v1/pods?watch=1",
+			"/login?next=%2Fapi",
+			"/api/v1/pods?watch=1",
+			"/agents/agent1/kubernetes/ep1/login?next=%2Fapi",
+		},
+		{
+			"absolute location",
+			"https://localhost/agents/agent1/kubernetes/ep1/",
+			"https://elsewhere.example.com/login",
+			"/",
+			"https://elsewhere.example.com/login",
+		},
+		{
+			"scheme relative location",
+			"https://localhost/agents/agent1/kubernetes/ep1/x",
+			"//elsewhere.example.com/login",
+			"/x",
+			"//elsewhere.example.com/login",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location = tt.location
+			w := httptest.NewRecorder()
+			agentPathHandler(w, httptest.NewRequest("GET", tt.target, nil))
+
+			if w.Code != http.StatusFound {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusFound, w.Code, w.Body.String())
+			}
+			if uri := <-uris; uri != tt.wantURI {
+				t.Errorf("expected URI '%s', got '%s'", tt.wantURI, uri)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("expected Location '%s', got '%s'", tt.wantLocation, got)
+			}
+		})
+	}
+}
+
+func TestAgentPathHandler_badPath(t *testing.T) {
+	w := httptest.NewRecorder()
+	agentPathHandler(w, httptest.NewRequest("GET", "https://localhost/agents/agent1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
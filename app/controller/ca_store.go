@@ -0,0 +1,92 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/secrets"
+)
+
+// certificateAuthority is either our own CA, or a ca.ReadOnlyCA for
+// certificates issued by an external PKI.
+type certificateAuthority interface {
+	ca.CertificateIssuer
+	ca.CertPoolGenerator
+	ca.CertificateRevoker
+	IsRevoked(cert *x509.Certificate) bool
+	GetCACertificate() []byte
+}
+
+// secretCAStore keeps the CA in a Kubernetes TLS secret, in the same
+// form make-ca generates.
+type secretCAStore struct {
+	loader    *secrets.KubernetesSecretLoader
+	namespace string
+	name      string
+}
+
+func (s *secretCAStore) Load() ([]byte, []byte, error) {
+	data, err := s.loader.GetSecret(s.name)
+	if secrets.IsNotFound(err) {
+		return nil, nil, ca.ErrCANotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, foundCert := (*data)["tls.crt"]
+	keyPEM, foundKey := (*data)["tls.key"]
+	if !foundCert || !foundKey {
+		return nil, nil, fmt.Errorf("secret must contain tls.crt and tls.key")
+	}
+	return certPEM, keyPEM, nil
+}
+
+func (s *secretCAStore) Save(certPEM []byte, keyPEM []byte) error {
+	return s.loader.CreateSecret(s.name, "kubernetes.io/tls", map[string][]byte{
+		"tls.crt": certPEM,
+		"tls.key": keyPEM,
+	})
+}
+
+func (s *secretCAStore) String() string {
+	return fmt.Sprintf("secret %s/%s", s.namespace, s.name)
+}
+
+// loadAuthority loads the CA from the configured Kubernetes secret, or
+// from the certificate and key files if no secret is named.  The secret's
+// namespace defaults to the controller's own.
+func loadAuthority(c ca.Config) (*ca.CA, error) {
+	if c.SecretName == "" {
+		return ca.LoadCAFromFile(c)
+	}
+	namespace := c.SecretNamespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("caConfig.secretNamespace not set, and POD_NAMESPACE is not set to the pod's namespace")
+	}
+	loader, err := secrets.MakeKubernetesSecretLoader(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return ca.LoadCA(c, &secretCAStore{loader: loader, namespace: namespace, name: c.SecretName})
+}
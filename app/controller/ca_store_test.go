@@ -0,0 +1,99 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/secrets"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretCAStore(t *testing.T) {
+	certPEM, keyPEM, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := func(name string, data map[string][]byte) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns1"},
+			Type:       v1.SecretTypeTLS,
+			Data:       data,
+		}
+	}
+	objs := []runtime.Object{
+		secret("ca", map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}),
+		secret("corrupt", map[string][]byte{"tls.crt": certPEM, "tls.key": []byte("garbage")}),
+		secret("incomplete", map[string][]byte{"tls.crt": certPEM}),
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		bootstrap bool
+		wantErr   string
+	}{
+		{"load", "ca", false, ""},
+		{"missing", "missing", false, "create one with make-ca"},
+		{"corrupted key", "corrupt", true, "unable to load CA"},
+		{"incomplete", "incomplete", true, "must contain tls.crt and tls.key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := secrets.MakeKubernetesSecretLoaderFromClientset("ns1", fake.NewSimpleClientset(objs...))
+			store := &secretCAStore{loader: loader, namespace: "ns1", name: tt.secret}
+			c, err := ca.LoadCA(ca.Config{RevocationListFile: t.TempDir() + "/revocations.json", BootstrapCA: tt.bootstrap}, store)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing '%s', got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if block, _ := pem.Decode(certPEM); !bytes.Equal(block.Bytes, c.GetCACertificate()) {
+				t.Errorf("loaded a different CA")
+			}
+		})
+	}
+}
+
+func TestSecretCAStore_bootstrap(t *testing.T) {
+	loader := secrets.MakeKubernetesSecretLoaderFromClientset("ns1", fake.NewSimpleClientset())
+	store := &secretCAStore{loader: loader, namespace: "ns1", name: "ca"}
+	config := ca.Config{RevocationListFile: t.TempDir() + "/revocations.json", BootstrapCA: true}
+
+	first, err := ca.LoadCA(config, store)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := ca.LoadCA(config, store)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(first.GetCACertificate(), second.GetCACertificate()) {
+		t.Errorf("expected the saved CA to be loaded, but a different one was used")
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/util"
+	"github.com/opsmx/oes-birger/pkg/webhook"
+)
+
+// Kinds of credential recorded in an AuditRecord.
+const (
+	AuditKindCertificate = "certificate"
+	AuditKindToken       = "token"
+)
+
+// AuditRecord describes one credential issued by the CNC server, and the
+// control client which asked for it.
+type AuditRecord struct {
+	Event           string `json:"event"`
+	Time            string `json:"time"`
+	Endpoint        string `json:"endpoint"`
+	Requester       string `json:"requester,omitempty"`
+	RequesterSerial string `json:"requesterSerial,omitempty"`
+	Kind            string `json:"kind"`
+	Purpose         string `json:"purpose,omitempty"`
+	Agent           string `json:"agent,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Type            string `json:"type,omitempty"`
+	Serial          string `json:"serial,omitempty"`
+	ExpiresAt       string `json:"expiresAt,omitempty"`
+}
+
+// CloudEventType implements webhook.Event, as "certificate.issued" or
+// "token.issued".
+func (r *AuditRecord) CloudEventType() string {
+	return r.Kind + ".issued"
+}
+
+// CloudEventSubject implements webhook.Event.  It is the agent the
+// credential is for, or its name if it is for no agent.
+func (r *AuditRecord) CloudEventSubject() string {
+	if r.Agent != "" {
+		return r.Agent
+	}
+	return r.Name
+}
+
+// Auditor records each credential the CNC server issues.
+type Auditor interface {
+	Audit(record *AuditRecord) error
+}
+
+// MultiAuditor sends each record to every auditor in turn, returning the
+// first error.
+type MultiAuditor []Auditor
+
+// Audit implements Auditor.
+func (m MultiAuditor) Audit(record *AuditRecord) error {
+	var ret error
+	for _, a := range m {
+		if err := a.Audit(record); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// WebhookAuditor queues each record on a webhook runner.  Delivery happens
+// later, so only queueing can be audited.
+type WebhookAuditor struct {
+	Runner *webhook.Runner
+}
+
+// Audit implements Auditor.
+func (a *WebhookAuditor) Audit(record *AuditRecord) error {
+	a.Runner.Send(record)
+	return nil
+}
+
+// FileAuditor appends each record to a file as a line of JSON.  Once the
+// file would grow past maxBytes it is renamed with a ".1" suffix, older
+// files moving up to ".maxBackups", and a new file started.
+type FileAuditor struct {
+	f *util.RotatingFile
+}
+
+// NewFileAuditor opens, or creates, the audit file.  A maxBytes of zero
+// disables rotation.
+func NewFileAuditor(path string, maxBytes int64, maxBackups int) (*FileAuditor, error) {
+	f, err := util.OpenRotatingFile(path, maxBytes, maxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("audit file: %v", err)
+	}
+	return &FileAuditor{f: f}, nil
+}
+
+// Audit implements Auditor.  The record is synced to disk before
+// returning.
+func (a *FileAuditor) Audit(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := a.f.WriteSync(line); err != nil {
+		return fmt.Errorf("unable to write audit record: %v", err)
+	}
+	return nil
+}
+
+// Close closes the audit file.
+func (a *FileAuditor) Close() error {
+	return a.f.Close()
+}
+
+// newAuditRecord starts a record for the request, identifying the control
+// client by its certificate.
+func newAuditRecord(r *http.Request, endpoint string, kind string) *AuditRecord {
+	record := &AuditRecord{
+		Event:    "credentialIssued",
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Endpoint: endpoint,
+		Kind:     kind,
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		record.Requester = cert.Subject.CommonName
+		record.RequesterSerial = cert.SerialNumber.String()
+	}
+	return record
+}
+
+// newCertificateAuditRecord describes a certificate issued by the
+// authority, which returns it as base64 encoded PEM.
+func newCertificateAuditRecord(r *http.Request, endpoint string, name ca.CertificateName, cert64 string) *AuditRecord {
+	record := newAuditRecord(r, endpoint, AuditKindCertificate)
+	record.Purpose = name.Purpose
+	record.Agent = name.Agent
+	record.Name = name.Name
+	record.Type = name.Type
+	if cert, err := parseCertificate64(cert64); err == nil {
+		record.Serial = cert.SerialNumber.String()
+		record.ExpiresAt = cert.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return record
+}
+
+func parseCertificate64(cert64 string) (*x509.Certificate, error) {
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
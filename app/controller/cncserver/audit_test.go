@@ -0,0 +1,194 @@
+package cncserver
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+type recordingAuditor struct {
+	records []*AuditRecord
+	err     error
+}
+
+func (a *recordingAuditor) Audit(record *AuditRecord) error {
+	a.records = append(a.records, record)
+	return a.err
+}
+
+// revokingAuthority issues real certificates, with serial 77, and
+// remembers the serials revoked.
+type revokingAuthority struct {
+	mockAuthority
+	revoked []string
+}
+
+func (a *revokingAuthority) GenerateCertificate(name ca.CertificateName, keyType ca.KeyType, validity time.Duration) (string, string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(77),
+		Subject:      pkix.Name{CommonName: name.Name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", "", err
+	}
+	cert64 := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return cert64, cert64, "key", nil
+}
+
+func (a *revokingAuthority) Revoke(serial *big.Int) error {
+	a.revoked = append(a.revoked, serial.String())
+	return nil
+}
+
+type laxConfig struct {
+	mockConfig
+}
+
+func (*laxConfig) GetAuditStrict() bool { return false }
+
+func TestCNCServer_audit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      cncConfig
+		auditErr    error
+		wantStatus  int
+		wantRevoked bool
+	}{
+		{"recorded", &mockConfig{}, nil, http.StatusOK, false},
+		{"strict failure", &mockConfig{}, fmt.Errorf("disk full"), http.StatusInternalServerError, true},
+		{"lax failure", &laxConfig{}, fmt.Errorf("disk full"), http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auditor := &recordingAuditor{err: tt.auditErr}
+			authority := &revokingAuthority{}
+			c := MakeCNCServer(tt.config, authority, nil, nil, "", auditor)
+
+			body, _ := json.Marshal(fwdapi.KubeConfigRequest{AgentName: "smith", Name: "alice"})
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{
+				Subject:      pkix.Name{CommonName: "operator"},
+				SerialNumber: big.NewInt(4242),
+			}}}
+			w := httptest.NewRecorder()
+			c.generateKubectlComponents().ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			if len(auditor.records) != 1 {
+				t.Fatalf("Expected 1 audit record, got %d", len(auditor.records))
+			}
+			record := auditor.records[0]
+			stringEquals(t, "Requester", record.Requester, "operator")
+			stringEquals(t, "RequesterSerial", record.RequesterSerial, "4242")
+			stringEquals(t, "Endpoint", record.Endpoint, fwdapi.KubeconfigEndpoint)
+			stringEquals(t, "Kind", record.Kind, AuditKindCertificate)
+			stringEquals(t, "Purpose", record.Purpose, "service")
+			stringEquals(t, "Agent", record.Agent, "smith")
+			stringEquals(t, "Name", record.Name, "alice")
+			stringEquals(t, "Serial", record.Serial, "77")
+			if record.ExpiresAt == "" {
+				t.Errorf("Expected ExpiresAt to be set")
+			}
+			if (len(authority.revoked) > 0) != tt.wantRevoked {
+				t.Errorf("Expected revoked %v, got %v", tt.wantRevoked, authority.revoked)
+			}
+		})
+	}
+}
+
+func TestFileAuditor_rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	record := &AuditRecord{Event: "credentialIssued", Kind: AuditKindToken, Name: "alice"}
+	line, _ := json.Marshal(record)
+	// Room for two records per file.
+	a, err := NewFileAuditor(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	for i := 0; i < 7; i++ {
+		if err := a.Audit(record); err != nil {
+			t.Fatalf("Audit() error = %v", err)
+		}
+	}
+
+	wantLines := map[string]int{path: 1, path + ".1": 2, path + ".2": 2, path + ".3": -1}
+	for name, want := range wantLines {
+		f, err := os.Open(name)
+		if want < 0 {
+			if err == nil {
+				f.Close()
+				t.Errorf("%s should not exist", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		lines := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var got AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+				t.Errorf("%s: line is not JSON: %v", name, err)
+			}
+			lines++
+		}
+		f.Close()
+		if lines != want {
+			t.Errorf("%s: expected %d lines, got %d", name, want, lines)
+		}
+	}
+}
@@ -22,11 +22,16 @@
 package cncserver
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/oklog/ulid/v2"
@@ -39,6 +44,13 @@ import (
 type cncCertificateAuthority interface {
 	ca.CertificateIssuer
 	ca.CertPoolGenerator
+	ca.CertificateRevoker
+}
+
+// cncExternalIssuer is implemented by an authority whose certificates come
+// from an external PKI, which this server cannot issue.
+type cncExternalIssuer interface {
+	IssuanceError() error
 }
 
 type cncConfig interface {
@@ -47,10 +59,52 @@ type cncConfig interface {
 	GetServiceURL() string
 	GetControlURL() string
 	GetControlListenPort() uint16
+	GetShutdownGracePeriod() time.Duration
+	GetServiceTokenTTL() time.Duration
+	GetServiceTokenIdentity() jwtutil.Identity
+	GetAgentImage() string
+	GetAgentNamespace() string
+	GetAgentHelmValuesKeys() HelmValuesKeys
+	GetAgentKustomizeKeys() KustomizeKeys
+	GetServiceSecretDefaults() (namePrefix string, namespace string)
+	GetAuditStrict() bool
+	GetTLSConfig() util.TLSConfig
+	IsControlCredentialAllowed(requester string, name string) bool
+	GetAllowAnyAgent() bool
+	GetLegacyStatistics() bool
+}
+
+// cncServiceKeys supplies the key service tokens are signed with, which
+// may change while the server runs.
+type cncServiceKeys interface {
+	CurrentKey() (jwk.Key, error)
+}
+
+// cncServerCertificate renews the certificate the controller's listeners
+// present.
+type cncServerCertificate interface {
+	Renew() (*x509.Certificate, error)
+}
+
+// cncTokenRevoker revokes service tokens by their ID.
+type cncTokenRevoker interface {
+	TokenID(token string) (id string, expires time.Time, err error)
+	Revoke(ctx context.Context, id string, expires time.Time) error
 }
 
 type cncAgentStatsReporter interface {
 	GetStatistics() interface{}
+	GetAgentStatistics() []fwdapi.AgentStatistics
+	GetAgents() []fwdapi.AgentInfo
+}
+
+// legacyStatisticsResponse is the untyped statistics response sent before
+// fwdapi.StatisticsAPIVersion, whose shape is whatever the agent registry
+// marshals to.  It is only sent if the controller is configured to.
+type legacyStatisticsResponse struct {
+	ServerTime      uint64      `json:"serverTime,omitempty"`
+	Version         string      `json:"version,omitempty"`
+	ConnectedAgents interface{} `json:"connectedAgents,omitempty"`
 }
 
 // CNCServer holds the context for a specific instance of a command and control http server.
@@ -58,30 +112,115 @@ type CNCServer struct {
 	cfg           cncConfig
 	authority     cncCertificateAuthority
 	agentReporter cncAgentStatsReporter
-	jwkKeyset     jwk.Set
-	jwtCurrentKey string
+	serviceKeys   cncServiceKeys
 	version       string
+	auditor       Auditor
+	agentProxy    http.Handler
+	serverCert    cncServerCertificate
+	disconnect    func(name string, session string) int
+	limits        func(fwdapi.LimitsRequest) fwdapi.LimitsResponse
+	tokenRevoker  cncTokenRevoker
+	setListening  func(bool)
+	setOptions    func(*http.Server)
 }
 
 //
 // MakeCNCServer will return a server that implenets the endpoints for command and control,
-// and and
+// and and records each credential issued with auditor, if it is not nil.
 func MakeCNCServer(
 	config cncConfig,
 	authority cncCertificateAuthority,
 	agents cncAgentStatsReporter,
-	jwkset jwk.Set,
-	currentKey string,
+	serviceKeys cncServiceKeys,
 	vers string,
+	auditor Auditor,
 ) *CNCServer {
 	return &CNCServer{
 		cfg:           config,
 		authority:     authority,
 		agentReporter: agents,
-		jwkKeyset:     jwkset,
-		jwtCurrentKey: currentKey,
+		serviceKeys:   serviceKeys,
 		version:       vers,
+		auditor:       auditor,
+	}
+}
+
+// days converts a requested certificate lifetime into a duration.  Zero
+// means the authority's default for the certificate's purpose.
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// audit records an issued credential.  If the record cannot be written and
+// auditing is strict, the request fails and false is returned.  Any
+// certificate issued is then revoked, so it cannot be used unrecorded.
+func (s *CNCServer) audit(w http.ResponseWriter, record *AuditRecord) bool {
+	if s.auditor == nil {
+		return true
+	}
+	err := s.auditor.Audit(record)
+	if err == nil {
+		return true
+	}
+	if !s.cfg.GetAuditStrict() {
+		util.Errorf("Unable to audit %s issued by %s: %v", record.Kind, record.Endpoint, err)
+		return true
 	}
+	if serial, ok := new(big.Int).SetString(record.Serial, 10); ok {
+		if err := s.authority.Revoke(serial); err != nil {
+			util.Errorf("Unable to revoke unaudited certificate %s: %v", record.Serial, err)
+		}
+	}
+	util.FailRequest(w, fmt.Errorf("unable to audit the issued credential: %v", err), http.StatusInternalServerError)
+	return false
+}
+
+// SetAgentProxy enables forwarding requests under fwdapi.AgentProxyPrefix
+// to h, for clients with a control certificate.  It must be called before
+// the server is run.
+func (s *CNCServer) SetAgentProxy(h http.Handler) {
+	s.agentProxy = h
+}
+
+// SetServerCertificate enables forced renewal of the server certificate at
+// fwdapi.RenewEndpoint.  It must be called before the server is run.
+func (s *CNCServer) SetServerCertificate(c cncServerCertificate) {
+	s.serverCert = c
+}
+
+// SetDisconnectFunc enables disconnecting agents at
+// fwdapi.DisconnectEndpoint.  f disconnects the sessions of the named agent,
+// or only the one with the given ID if session is not empty, and returns
+// how many it disconnected.  It must be called before the server is run.
+func (s *CNCServer) SetDisconnectFunc(f func(name string, session string) int) {
+	s.disconnect = f
+}
+
+// SetLimitsFunc enables changing the limits on outstanding requests at
+// fwdapi.LimitsEndpoint.  f applies the limits given in the request, and
+// returns those now in force.  It must be called before the server is run.
+func (s *CNCServer) SetLimitsFunc(f func(fwdapi.LimitsRequest) fwdapi.LimitsResponse) {
+	s.limits = f
+}
+
+// SetServiceTokenRevoker enables revoking service tokens at
+// fwdapi.RevokeServiceTokenEndpoint.  It must be called before the server
+// is run.
+func (s *CNCServer) SetServiceTokenRevoker(r cncTokenRevoker) {
+	s.tokenRevoker = r
+}
+
+// SetListeningFunc arranges for f to be called with true once the server
+// is bound to its port, and false once it stops.  It must be called before
+// the server is run.
+func (s *CNCServer) SetListeningFunc(f func(bool)) {
+	s.setListening = f
+}
+
+// SetServerOptions arranges for f to adjust the http.Server, such as its
+// timeouts, before it starts.  It must be called before the server is run.
+func (s *CNCServer) SetServerOptions(f func(*http.Server)) {
+	s.setOptions = f
 }
 
 func (s *CNCServer) authenticate(method string, h http.HandlerFunc) http.HandlerFunc {
@@ -92,6 +231,26 @@ func (s *CNCServer) authenticate(method string, h http.HandlerFunc) http.Handler
 			return
 		}
 
+		s.requireControl(h)(w, r)
+	}
+}
+
+// issuesCertificates fails the request with 501 Not Implemented if the
+// authority cannot issue certificates.
+func (s *CNCServer) issuesCertificates(h http.HandlerFunc) http.HandlerFunc {
+	external, ok := s.authority.(cncExternalIssuer)
+	if !ok {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		util.FailRequest(w, external.IssuanceError(), http.StatusNotImplemented)
+	}
+}
+
+// requireControl allows only clients whose certificate has the control
+// purpose to reach h.
+func (s *CNCServer) requireControl(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		names, err := ca.GetCertificateNameFromCert(r.TLS.PeerCertificates[0])
 		if err != nil {
 			util.FailRequest(w, err, http.StatusForbidden)
@@ -107,6 +266,19 @@ func (s *CNCServer) authenticate(method string, h http.HandlerFunc) http.Handler
 	}
 }
 
+// peerName returns the name in the client's certificate, or an empty string
+// if there is none.
+func peerName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	names, err := ca.GetCertificateNameFromCert(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return ""
+	}
+	return names.Name
+}
+
 func (s *CNCServer) generateKubectlComponents() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
@@ -124,17 +296,31 @@ func (s *CNCServer) generateKubectlComponents() http.HandlerFunc {
 			return
 		}
 
+		if req.CredentialMode == fwdapi.KubeConfigCredentialModeExec {
+			s.writeExecKubeconfig(w, req)
+			return
+		}
+
+		keyType, err := ca.ParseKeyType(req.KeyType)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
 		name := ca.CertificateName{
 			Name:    req.Name,
 			Type:    "kubernetes",
 			Agent:   req.AgentName,
 			Purpose: ca.CertificatePurposeService,
 		}
-		ca64, user64, key64, err := s.authority.GenerateCertificate(name)
+		ca64, user64, key64, err := s.authority.GenerateCertificate(name, keyType, days(req.ValidityDays))
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
 			return
 		}
+		if !s.audit(w, newCertificateAuditRecord(r, fwdapi.KubeconfigEndpoint, name, user64)) {
+			return
+		}
 		ret := fwdapi.KubeConfigResponse{
 			AgentName:       req.AgentName,
 			Name:            req.Name,
@@ -143,20 +329,66 @@ func (s *CNCServer) generateKubectlComponents() http.HandlerFunc {
 			UserKey:         key64,
 			CACert:          ca64,
 		}
-		json, err := json.Marshal(ret)
-		if err != nil {
-			util.FailRequest(w, err, http.StatusBadRequest)
-			return
-		}
-		n, err := w.Write(json)
-		if err != nil {
-			log.Printf("generateKubectlComponents: error while writing: %v", err)
-			return
-		}
-		if n != len(json) {
-			log.Printf("generateKubectlComponents: failed to write entire message: %d of %d written", n, len(json))
-			return
-		}
+		s.writeKubectlComponents(w, req.Format, ret)
+	}
+}
+
+// writeExecKubeconfig responds with the components of a kubeconfig whose
+// user runs the credential plugin.  No certificate is issued, so nothing
+// is audited here; each token the plugin fetches is.
+func (s *CNCServer) writeExecKubeconfig(w http.ResponseWriter, req fwdapi.KubeConfigRequest) {
+	cacert, err := s.authority.GetCACert()
+	if err != nil {
+		util.FailRequest(w, err, http.StatusBadRequest)
+		return
+	}
+	ret := fwdapi.KubeConfigResponse{
+		AgentName:      req.AgentName,
+		Name:           req.Name,
+		ServerURL:      s.cfg.GetServiceURL(),
+		CACert:         cacert,
+		CredentialMode: fwdapi.KubeConfigCredentialModeExec,
+		ControlURL:     s.cfg.GetControlURL(),
+	}
+	s.writeKubectlComponents(w, req.Format, ret)
+}
+
+func (s *CNCServer) writeKubectlComponents(w http.ResponseWriter, format string, ret fwdapi.KubeConfigResponse) {
+	if format == fwdapi.KubeConfigFormatKubeconfig {
+		s.writeKubeconfig(w, ret)
+		return
+	}
+	json, err := json.Marshal(ret)
+	if err != nil {
+		util.FailRequest(w, err, http.StatusBadRequest)
+		return
+	}
+	n, err := w.Write(json)
+	if err != nil {
+		util.Warnf("generateKubectlComponents: error while writing: %v", err)
+		return
+	}
+	if n != len(json) {
+		util.Warnf("generateKubectlComponents: failed to write entire message: %d of %d written", n, len(json))
+		return
+	}
+}
+
+func (s *CNCServer) writeKubeconfig(w http.ResponseWriter, components fwdapi.KubeConfigResponse) {
+	kubeconfig, err := renderKubeconfig(components)
+	if err != nil {
+		util.FailRequest(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/yaml")
+	n, err := w.Write(kubeconfig)
+	if err != nil {
+		util.Warnf("generateKubectlComponents: error while writing: %v", err)
+		return
+	}
+	if n != len(kubeconfig) {
+		util.Warnf("generateKubectlComponents: failed to write entire message: %d of %d written", n, len(kubeconfig))
+		return
 	}
 }
 
@@ -177,15 +409,24 @@ func (s *CNCServer) generateAgentManifestComponents() http.HandlerFunc {
 			return
 		}
 
+		keyType, err := ca.ParseKeyType(req.KeyType)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
 		name := ca.CertificateName{
 			Agent:   req.AgentName,
 			Purpose: ca.CertificatePurposeAgent,
 		}
-		ca64, user64, key64, err := s.authority.GenerateCertificate(name)
+		ca64, user64, key64, err := s.authority.GenerateCertificate(name, keyType, days(req.ValidityDays))
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
 			return
 		}
+		if !s.audit(w, newCertificateAuditRecord(r, fwdapi.ManifestEndpoint, name, user64)) {
+			return
+		}
 		ret := fwdapi.ManifestResponse{
 			AgentName:        req.AgentName,
 			ServerHostname:   s.cfg.GetAgentHostname(),
@@ -194,6 +435,23 @@ func (s *CNCServer) generateAgentManifestComponents() http.HandlerFunc {
 			AgentKey:         key64,
 			CACert:           ca64,
 		}
+		switch req.Format {
+		case fwdapi.ManifestFormatYAML:
+			s.writeAgentManifestYAML(w, req, ret)
+			return
+		case fwdapi.ManifestFormatHelmValues:
+			values, err := renderAgentHelmValues(s.cfg.GetAgentHelmValuesKeys(), ret)
+			writeAgentManifestDocument(w, values, err)
+			return
+		case fwdapi.ManifestFormatKustomize:
+			namespace := s.cfg.GetAgentNamespace()
+			if req.Namespace != "" {
+				namespace = req.Namespace
+			}
+			patch, err := renderAgentKustomization(s.cfg.GetAgentKustomizeKeys(), namespace, ret)
+			writeAgentManifestDocument(w, patch, err)
+			return
+		}
 		json, err := json.Marshal(ret)
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
@@ -201,16 +459,56 @@ func (s *CNCServer) generateAgentManifestComponents() http.HandlerFunc {
 		}
 		n, err := w.Write(json)
 		if err != nil {
-			log.Printf("generateAgentManifestComponents: error while writing: %v", err)
+			util.Warnf("generateAgentManifestComponents: error while writing: %v", err)
 			return
 		}
 		if n != len(json) {
-			log.Printf("generateAgentManifestComponents: failed to write entire message: %d of %d written", n, len(json))
+			util.Warnf("generateAgentManifestComponents: failed to write entire message: %d of %d written", n, len(json))
 			return
 		}
 	}
 }
 
+func (s *CNCServer) writeAgentManifestYAML(w http.ResponseWriter, req fwdapi.ManifestRequest, components fwdapi.ManifestResponse) {
+	values := agentManifestValues{
+		AgentName:          req.AgentName,
+		Namespace:          s.cfg.GetAgentNamespace(),
+		Image:              s.cfg.GetAgentImage(),
+		ControllerHostname: net.JoinHostPort(components.ServerHostname, strconv.Itoa(int(components.ServerPort))),
+		AgentCertificate:   components.AgentCertificate,
+		AgentKey:           components.AgentKey,
+		CACert:             components.CACert,
+	}
+	if req.Namespace != "" {
+		values.Namespace = req.Namespace
+	}
+	if req.Image != "" {
+		values.Image = req.Image
+	}
+
+	manifest, err := renderAgentManifest(values)
+	writeAgentManifestDocument(w, manifest, err)
+}
+
+// writeAgentManifestDocument writes a rendered YAML document, or fails the
+// request if rendering failed.
+func writeAgentManifestDocument(w http.ResponseWriter, doc []byte, err error) {
+	if err != nil {
+		util.FailRequest(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "text/vnd.yaml")
+	n, err := w.Write(doc)
+	if err != nil {
+		util.Warnf("generateAgentManifestComponents: error while writing: %v", err)
+		return
+	}
+	if n != len(doc) {
+		util.Warnf("generateAgentManifestComponents: failed to write entire message: %d of %d written", n, len(doc))
+		return
+	}
+}
+
 func (s *CNCServer) generateServiceCredentials() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
@@ -222,25 +520,54 @@ func (s *CNCServer) generateServiceCredentials() http.HandlerFunc {
 			return
 		}
 
-		err = req.Validate()
+		// With no agent named, the credential is for any agent.
+		allowAnyAgent := s.cfg.GetAllowAnyAgent()
+		if allowAnyAgent && req.AgentName == "" {
+			req.AgentName = fwdapi.AnyAgent
+		}
+		err = req.ValidateAnyAgent(allowAnyAgent)
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
 			return
 		}
 
-		var key jwk.Key
-		var ok bool
-		if key, ok = s.jwkKeyset.LookupKeyID(s.jwtCurrentKey); !ok {
-			err := fmt.Errorf("unable to find service key '%s'", s.jwtCurrentKey)
+		var secretName, secretNamespace string
+		if req.Format == fwdapi.ServiceCredentialFormatSecret {
+			secretName, secretNamespace, err = s.serviceSecretName(req)
+			if err != nil {
+				util.FailRequest(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		key, err := s.serviceKeys.CurrentKey()
+		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
 			return
 		}
 
-		token, err := jwtutil.MakeJWT(key, req.Type, req.Name, req.AgentName)
+		ttl := s.cfg.GetServiceTokenTTL()
+		if req.ExpiresIn > 0 {
+			ttl = time.Duration(req.ExpiresIn) * time.Second
+		}
+
+		issuedAt := time.Now()
+		token, err := jwtutil.MakeJWT(key, s.cfg.GetServiceTokenIdentity(), req.Type, req.Name, req.AgentName, ttl)
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
 			return
 		}
+		record := newAuditRecord(r, fwdapi.ServiceEndpoint, AuditKindToken)
+		record.Purpose = ca.CertificatePurposeService
+		record.Agent = req.AgentName
+		record.Name = req.Name
+		record.Type = req.Type
+		if ttl > 0 {
+			record.ExpiresAt = issuedAt.Add(ttl).UTC().Format(time.RFC3339)
+		}
+		if !s.audit(w, record) {
+			return
+		}
 
 		cacert, err := s.authority.GetCACert()
 		if err != nil {
@@ -264,6 +591,7 @@ func (s *CNCServer) generateServiceCredentials() http.HandlerFunc {
 			ret.Credential = fwdapi.AwsCredentialResponse{
 				AwsAccessKey:       username,
 				AwsSecretAccessKey: token,
+				AwsSessionToken:    token,
 			}
 		default:
 			ret.Username = username // deprecated
@@ -274,6 +602,10 @@ func (s *CNCServer) generateServiceCredentials() http.HandlerFunc {
 				Password: token,
 			}
 		}
+		if req.Format == fwdapi.ServiceCredentialFormatSecret {
+			s.writeServiceSecret(w, secretName, secretNamespace, ret)
+			return
+		}
 		json, err := json.Marshal(ret)
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
@@ -281,16 +613,51 @@ func (s *CNCServer) generateServiceCredentials() http.HandlerFunc {
 		}
 		n, err := w.Write(json)
 		if err != nil {
-			log.Printf("generateServiceCredentials: error while writing: %v", err)
+			util.Warnf("generateServiceCredentials: error while writing: %v", err)
 			return
 		}
 		if n != len(json) {
-			log.Printf("generateServiceCredentials: failed to write entire message: %d of %d written", n, len(json))
+			util.Warnf("generateServiceCredentials: failed to write entire message: %d of %d written", n, len(json))
 			return
 		}
 	}
 }
 
+// serviceSecretName returns the name and namespace of the Secret to render
+// for req, using the controller's defaults for any not requested.
+func (s *CNCServer) serviceSecretName(req fwdapi.ServiceCredentialRequest) (string, string, error) {
+	namePrefix, namespace := s.cfg.GetServiceSecretDefaults()
+	if req.Namespace != "" {
+		namespace = req.Namespace
+	}
+	if req.SecretName != "" {
+		return req.SecretName, namespace, nil
+	}
+	name := fmt.Sprintf("%s%s-%s", namePrefix, req.AgentName, req.Name)
+	if !fwdapi.KubernetesNameValid(name) {
+		return "", "", fmt.Errorf("'secretName' is required, as '%s' is not a valid Kubernetes name", name)
+	}
+	return name, namespace, nil
+}
+
+func (s *CNCServer) writeServiceSecret(w http.ResponseWriter, name string, namespace string, components fwdapi.ServiceCredentialResponse) {
+	secret, err := renderServiceSecret(name, namespace, components)
+	if err != nil {
+		util.FailRequest(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "text/vnd.yaml")
+	n, err := w.Write(secret)
+	if err != nil {
+		util.Warnf("generateServiceCredentials: error while writing: %v", err)
+		return
+	}
+	if n != len(secret) {
+		util.Warnf("generateServiceCredentials: failed to write entire message: %d of %d written", n, len(secret))
+		return
+	}
+}
+
 func (s *CNCServer) generateControlCredentials() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
@@ -308,15 +675,25 @@ func (s *CNCServer) generateControlCredentials() http.HandlerFunc {
 			return
 		}
 
+		requester := peerName(r)
+		if !s.cfg.IsControlCredentialAllowed(requester, req.Name) {
+			err := fmt.Errorf("'%s' is not allowed to create control credentials for '%s'", requester, req.Name)
+			util.FailRequest(w, err, http.StatusForbidden)
+			return
+		}
+
 		name := ca.CertificateName{
 			Name:    req.Name,
-			Purpose: ca.CertificatePurposeAgent,
+			Purpose: ca.CertificatePurposeControl,
 		}
-		ca64, user64, key64, err := s.authority.GenerateCertificate(name)
+		ca64, user64, key64, err := s.authority.GenerateCertificate(name, "", days(req.ValidityDays))
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
 			return
 		}
+		if !s.audit(w, newCertificateAuditRecord(r, fwdapi.ControlEndpoint, name, user64)) {
+			return
+		}
 		ret := fwdapi.ControlCredentialsResponse{
 			Name:        req.Name,
 			URL:         s.cfg.GetControlURL(),
@@ -331,11 +708,11 @@ func (s *CNCServer) generateControlCredentials() http.HandlerFunc {
 		}
 		n, err := w.Write(json)
 		if err != nil {
-			log.Printf("generateControlCredentials: error while writing: %v", err)
+			util.Warnf("generateControlCredentials: error while writing: %v", err)
 			return
 		}
 		if n != len(json) {
-			log.Printf("generateControlCredentials: failed to write entire message: %d of %d written", n, len(json))
+			util.Warnf("generateControlCredentials: failed to write entire message: %d of %d written", n, len(json))
 			return
 		}
 	}
@@ -345,11 +722,106 @@ func (s *CNCServer) getStatistics() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
 
-		ret := fwdapi.StatisticsResponse{
+		var ret interface{} = fwdapi.StatisticsResponse{
+			APIVersion:      fwdapi.StatisticsAPIVersion,
 			ServerTime:      ulid.Now(),
 			Version:         s.version,
-			ConnectedAgents: s.agentReporter.GetStatistics(),
+			ConnectedAgents: s.agentReporter.GetAgentStatistics(),
+		}
+		if s.cfg.GetLegacyStatistics() {
+			ret = legacyStatisticsResponse{
+				ServerTime:      ulid.Now(),
+				Version:         s.version,
+				ConnectedAgents: s.agentReporter.GetStatistics(),
+			}
+		}
+		json, err := json.Marshal(ret)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			util.Warnf("getStatistics: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			util.Warnf("getStatistics: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
+
+func (s *CNCServer) listAgents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		ret := fwdapi.AgentsResponse{
+			ServerTime: ulid.Now(),
+			Agents:     s.agentReporter.GetAgents(),
+		}
+		json, err := json.Marshal(ret)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			util.Warnf("listAgents: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			util.Warnf("listAgents: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
+
+func (s *CNCServer) revokeCertificate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		var req fwdapi.RevokeCertificateRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		err = req.Validate()
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		ret := fwdapi.RevokeCertificateResponse{}
+		if req.Serial != "" {
+			serial, ok := new(big.Int).SetString(req.Serial, 0)
+			if !ok {
+				util.FailRequest(w, fmt.Errorf("'serial' is invalid"), http.StatusBadRequest)
+				return
+			}
+			err = s.authority.Revoke(serial)
+			ret.Serial = serial.String()
+		} else {
+			name := ca.CertificateName{
+				Name:    req.Name,
+				Type:    req.Type,
+				Agent:   req.AgentName,
+				Purpose: req.Purpose,
+			}
+			err = s.authority.RevokeName(name)
+			ret.AgentName = req.AgentName
+			ret.Type = req.Type
+			ret.Name = req.Name
+			ret.Purpose = req.Purpose
 		}
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+		util.Infof("revokeCertificate: revoked %+v", ret)
+
 		json, err := json.Marshal(ret)
 		if err != nil {
 			util.FailRequest(w, err, http.StatusBadRequest)
@@ -357,11 +829,192 @@ func (s *CNCServer) getStatistics() http.HandlerFunc {
 		}
 		n, err := w.Write(json)
 		if err != nil {
-			log.Printf("getStatistics: error while writing: %v", err)
+			util.Warnf("revokeCertificate: error while writing: %v", err)
 			return
 		}
 		if n != len(json) {
-			log.Printf("getStatistics: failed to write entire message: %d of %d written", n, len(json))
+			util.Warnf("revokeCertificate: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
+
+// renewServerCertificate replaces the server certificate now, such as when
+// it may have been compromised.  Connections already open keep the old one.
+func (s *CNCServer) renewServerCertificate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		cert, err := s.serverCert.Renew()
+		if err != nil {
+			util.FailRequest(w, err, http.StatusInternalServerError)
+			return
+		}
+		ret := fwdapi.RenewServerCertificateResponse{
+			Serial:   cert.SerialNumber.String(),
+			NotAfter: ulid.Timestamp(cert.NotAfter),
+		}
+		util.Infof("renewServerCertificate: renewed %+v", ret)
+
+		json, err := json.Marshal(ret)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			util.Warnf("renewServerCertificate: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			util.Warnf("renewServerCertificate: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
+
+// disconnectAgent closes an agent's sessions, such as when it misbehaves
+// or may be compromised.  Its certificates are revoked first if asked, so
+// it cannot simply reconnect.
+func (s *CNCServer) disconnectAgent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		var req fwdapi.DisconnectAgentRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		err = req.Validate()
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		ret := fwdapi.DisconnectAgentResponse{AgentName: req.AgentName}
+		if req.Revoke {
+			name := ca.CertificateName{
+				Agent:   req.AgentName,
+				Purpose: ca.CertificatePurposeAgent,
+			}
+			if err := s.authority.RevokeName(name); err != nil {
+				util.FailRequest(w, err, http.StatusInternalServerError)
+				return
+			}
+			ret.Revoked = true
+		}
+		ret.SessionsClosed = s.disconnect(req.AgentName, req.Session)
+		util.Infof("disconnectAgent: %+v", ret)
+
+		json, err := json.Marshal(ret)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			util.Warnf("disconnectAgent: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			util.Warnf("disconnectAgent: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
+
+// updateLimits changes the limits on outstanding requests, such as when an
+// agent's cluster is slow and requests for it are piling up.
+func (s *CNCServer) updateLimits() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		var req fwdapi.LimitsRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		err = req.Validate()
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		ret := s.limits(req)
+		if req.MaxOutstandingPerSession != nil || req.MaxOutstanding != nil {
+			util.Infof("updateLimits: %s set %+v", peerName(r), ret)
+		}
+
+		json, err := json.Marshal(ret)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			util.Warnf("updateLimits: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			util.Warnf("updateLimits: failed to write entire message: %d of %d written", n, len(json))
+			return
+		}
+	}
+}
+
+// revokeServiceToken refuses a service token from now on, such as when it
+// has leaked.  The token may be given whole, or by its ID.
+func (s *CNCServer) revokeServiceToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+
+		var req fwdapi.RevokeServiceTokenRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		err = req.Validate()
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+
+		ret := fwdapi.RevokeServiceTokenResponse{ID: req.ID}
+		var expires time.Time
+		if req.Token != "" {
+			ret.ID, expires, err = s.tokenRevoker.TokenID(req.Token)
+			if err != nil {
+				util.FailRequest(w, err, http.StatusBadRequest)
+				return
+			}
+			if !expires.IsZero() {
+				ret.ExpiresAt = ulid.Timestamp(expires)
+			}
+		}
+		if err := s.tokenRevoker.Revoke(r.Context(), ret.ID, expires); err != nil {
+			util.FailRequest(w, err, http.StatusInternalServerError)
+			return
+		}
+		util.Infof("revokeServiceToken: %s revoked %+v", peerName(r), ret)
+
+		json, err := json.Marshal(ret)
+		if err != nil {
+			util.FailRequest(w, err, http.StatusBadRequest)
+			return
+		}
+		n, err := w.Write(json)
+		if err != nil {
+			util.Warnf("revokeServiceToken: error while writing: %v", err)
+			return
+		}
+		if n != len(json) {
+			util.Warnf("revokeServiceToken: failed to write entire message: %d of %d written", n, len(json))
 			return
 		}
 	}
@@ -369,38 +1022,71 @@ func (s *CNCServer) getStatistics() http.HandlerFunc {
 
 func (s *CNCServer) routes(mux *http.ServeMux) {
 	mux.HandleFunc(fwdapi.KubeconfigEndpoint,
-		s.authenticate("POST", s.generateKubectlComponents()))
+		s.authenticate("POST", s.issuesCertificates(s.generateKubectlComponents())))
 
 	mux.HandleFunc(fwdapi.ManifestEndpoint,
-		s.authenticate("POST", s.generateAgentManifestComponents()))
+		s.authenticate("POST", s.issuesCertificates(s.generateAgentManifestComponents())))
 
 	mux.HandleFunc(fwdapi.ServiceEndpoint,
 		s.authenticate("POST", s.generateServiceCredentials()))
 
 	mux.HandleFunc(fwdapi.ControlEndpoint,
-		s.authenticate("POST", s.generateControlCredentials()))
+		s.authenticate("POST", s.issuesCertificates(s.generateControlCredentials())))
 
 	mux.HandleFunc(fwdapi.StatisticsEndpoint,
 		s.authenticate("GET", s.getStatistics()))
 
+	mux.HandleFunc(fwdapi.AgentsEndpoint,
+		s.authenticate("GET", s.listAgents()))
+
+	mux.HandleFunc(fwdapi.RevokeEndpoint,
+		s.authenticate("POST", s.revokeCertificate()))
+
+	if s.serverCert != nil {
+		mux.HandleFunc(fwdapi.RenewEndpoint,
+			s.authenticate("POST", s.renewServerCertificate()))
+	}
+
+	if s.disconnect != nil {
+		mux.HandleFunc(fwdapi.DisconnectEndpoint,
+			s.authenticate("POST", s.disconnectAgent()))
+	}
+
+	if s.limits != nil {
+		mux.HandleFunc(fwdapi.LimitsEndpoint,
+			s.authenticate("POST", s.updateLimits()))
+	}
+
+	if s.tokenRevoker != nil {
+		mux.HandleFunc(fwdapi.RevokeServiceTokenEndpoint,
+			s.authenticate("POST", s.revokeServiceToken()))
+	}
+
+	if s.agentProxy != nil {
+		mux.HandleFunc(fwdapi.AgentProxyPrefix,
+			s.requireControl(s.agentProxy.ServeHTTP))
+	}
 }
 
-// RunServer will start the HTTPS server and serve requests.
-func (s *CNCServer) RunServer(serverCert tls.Certificate) {
-	log.Printf("Running Command and Control API HTTPS listener on port %d",
+// RunServer will start the HTTPS server and serve requests until ctx is
+// cancelled.
+func (s *CNCServer) RunServer(ctx context.Context, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	util.Infof("Running Command and Control API HTTPS listener on port %d",
 		s.cfg.GetControlListenPort())
 
 	certPool, err := s.authority.MakeCertPool()
 	if err != nil {
-		log.Fatalf("While making certpool: %v", err)
+		return fmt.Errorf("while making certpool: %v", err)
 	}
 
 	tlsConfig := &tls.Config{
-		ClientCAs:    certPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		Certificates: []tls.Certificate{serverCert},
-		MinVersion:   tls.VersionTLS12,
+		ClientCAs:             certPool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		GetCertificate:        getCertificate,
+		MinVersion:            tls.VersionTLS12,
+		VerifyPeerCertificate: s.authority.VerifyPeerCertificate,
 	}
+	s.cfg.GetTLSConfig().Apply(tlsConfig)
 
 	mux := http.NewServeMux()
 
@@ -411,6 +1097,19 @@ func (s *CNCServer) RunServer(serverCert tls.Certificate) {
 		TLSConfig: tlsConfig,
 		Handler:   mux,
 	}
+	if s.setOptions != nil {
+		s.setOptions(srv)
+	}
+
+	lis, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	if s.setListening != nil {
+		s.setListening(true)
+		defer s.setListening(false)
+	}
 
-	log.Fatal(srv.ListenAndServeTLS("", ""))
+	serve := func() error { return srv.ServeTLS(lis, "", "") }
+	return util.RunHTTPServer(ctx, srv, serve, s.cfg.GetShutdownGracePeriod())
 }
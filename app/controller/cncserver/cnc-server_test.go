@@ -18,20 +18,30 @@ package cncserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/lestrrat-go/jwx/jwa"
-	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/opsmx/oes-birger/pkg/ca"
 	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/util"
+	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 type handlerTracker struct {
@@ -44,7 +54,9 @@ func (h *handlerTracker) handler() http.HandlerFunc {
 	}
 }
 
-type mockConfig struct{}
+type mockConfig struct {
+	legacyStatistics bool
+}
 
 func (*mockConfig) GetAgentAdvertisePort() uint16 { return 1234 }
 
@@ -56,10 +68,55 @@ func (*mockConfig) GetServiceURL() string { return "https://service.local" }
 
 func (*mockConfig) GetAgentHostname() string { return "agent.local" }
 
+func (*mockConfig) GetShutdownGracePeriod() time.Duration { return time.Second }
+
+func (*mockConfig) GetServiceTokenTTL() time.Duration { return time.Hour }
+
+func (*mockConfig) GetServiceTokenIdentity() jwtutil.Identity {
+	return jwtutil.Identity{Issuer: "opsmx", Audience: "opsmx-forwarder"}
+}
+
+func (*mockConfig) GetAgentImage() string { return "agent-image:latest" }
+
+func (*mockConfig) GetAgentNamespace() string { return "agent-ns" }
+
+func (*mockConfig) GetAgentHelmValuesKeys() HelmValuesKeys { return HelmValuesKeys{} }
+
+func (*mockConfig) GetAgentKustomizeKeys() KustomizeKeys { return KustomizeKeys{} }
+
+func (*mockConfig) GetServiceSecretDefaults() (string, string) { return "svc-", "secret-ns" }
+
+func (*mockConfig) GetAuditStrict() bool { return true }
+
+func (*mockConfig) GetTLSConfig() util.TLSConfig { return util.TLSConfig{} }
+
+func (*mockConfig) IsControlCredentialAllowed(requester string, name string) bool { return true }
+
+func (*mockConfig) GetAllowAnyAgent() bool { return false }
+
+func (c *mockConfig) GetLegacyStatistics() bool { return c.legacyStatistics }
+
+// anyAgentConfig allows service credentials for any agent.
+type anyAgentConfig struct {
+	mockConfig
+}
+
+func (*anyAgentConfig) GetAllowAnyAgent() bool { return true }
+
 type mockAuthority struct{}
 
-func (*mockAuthority) GenerateCertificate(name ca.CertificateName) (string, string, string, error) {
-	return "a", "b", "c", nil
+func (*mockAuthority) GenerateCertificate(name ca.CertificateName, keyType ca.KeyType, validity time.Duration) (string, string, string, error) {
+	if validity > 30*24*time.Hour {
+		return "", "", "", fmt.Errorf("requested validity exceeds the maximum")
+	}
+	cert := "b"
+	if validity > 0 {
+		cert = "b-" + validity.String()
+	}
+	if keyType != "" {
+		return "a", cert, "c-" + string(keyType), nil
+	}
+	return "a", cert, "c", nil
 }
 
 func (*mockAuthority) GetCACert() (string, error) {
@@ -70,8 +127,56 @@ func (*mockAuthority) MakeCertPool() (*x509.CertPool, error) {
 	return nil, nil
 }
 
+func (*mockAuthority) Revoke(serial *big.Int) error {
+	if serial.Sign() <= 0 {
+		return fmt.Errorf("invalid serial number")
+	}
+	return nil
+}
+
+func (*mockAuthority) RevokeName(name ca.CertificateName) error {
+	return nil
+}
+
+func (*mockAuthority) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return nil
+}
+
 type mockAgents struct{}
 
+func (*mockAgents) GetAgents() []fwdapi.AgentInfo {
+	return []fwdapi.AgentInfo{
+		{
+			Name:          "agent1",
+			Session:       "session1",
+			ConnectedAt:   100,
+			LastPing:      200,
+			RemoteAddress: "10.0.0.1:1234",
+			Version:       "1.2.3",
+			Endpoints: []fwdapi.Endpoint{
+				{Name: "ep1", Type: "kubernetes", Configured: true, Namespaces: []string{"ns1"}},
+			},
+		},
+	}
+}
+
+func (*mockAgents) GetAgentStatistics() []fwdapi.AgentStatistics {
+	return []fwdapi.AgentStatistics{
+		{
+			Name: "agent1",
+			Sessions: []fwdapi.SessionStatistics{
+				{
+					Session:        "session1",
+					ConnectionType: fwdapi.ConnectionTypeDirect,
+					ConnectedAt:    100,
+					InFlight:       2,
+					Endpoints:      []fwdapi.Endpoint{{Name: "ep1", Type: "kubernetes", Configured: true}},
+				},
+			},
+		},
+	}
+}
+
 func (*mockAgents) GetStatistics() interface{} {
 	return struct {
 		Foo string `json:"foo"`
@@ -151,7 +256,7 @@ func TestCNCServer_authenticate(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := MakeCNCServer(nil, nil, nil, nil, "", "")
+			c := MakeCNCServer(nil, nil, nil, nil, "", nil)
 			h := handlerTracker{}
 			r := httptest.NewRequest("GET", "https://localhost/statistics", nil)
 			r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
@@ -164,6 +269,77 @@ func TestCNCServer_authenticate(t *testing.T) {
 	}
 }
 
+func TestCNCServer_agentProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		method  string
+		cert    *x509.Certificate
+		want    bool
+	}{
+		{"disabled", false, "GET", &goodCert, false},
+		{"wrong purpose", true, "GET", &wrongTypeCert, false},
+		{"GET", true, "GET", &goodCert, true},
+		{"DELETE", true, "DELETE", &goodCert, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(nil, nil, nil, nil, "", nil)
+			h := handlerTracker{}
+			if tt.enabled {
+				c.SetAgentProxy(h.handler())
+			}
+			mux := http.NewServeMux()
+			c.routes(mux)
+			r := httptest.NewRequest(tt.method, "https://localhost/agents/agent1/kubernetes/ep1/api", nil)
+			r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if h.called != tt.want {
+				t.Errorf("agent proxy called = %v, want %v, status %d", h.called, tt.want, w.Code)
+			}
+		})
+	}
+}
+
+// externalAuthority cannot issue certificates, as an external PKI does.
+type externalAuthority struct {
+	mockAuthority
+}
+
+func (*externalAuthority) IssuanceError() error {
+	return &ca.ExternalPKIError{URL: "https://pki.example.com/"}
+}
+
+func TestCNCServer_externalPKI(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     int
+	}{
+		{fwdapi.KubeconfigEndpoint, http.StatusNotImplemented},
+		{fwdapi.ManifestEndpoint, http.StatusNotImplemented},
+		{fwdapi.ControlEndpoint, http.StatusNotImplemented},
+		{fwdapi.RevokeEndpoint, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			c := MakeCNCServer(nil, &externalAuthority{}, nil, nil, "", nil)
+			mux := http.NewServeMux()
+			c.routes(mux)
+			r := httptest.NewRequest("POST", "https://localhost"+tt.endpoint, strings.NewReader("{}"))
+			r.TLS.PeerCertificates = []*x509.Certificate{&goodCert}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusNotImplemented && !strings.Contains(w.Body.String(), "https://pki.example.com/") {
+				t.Errorf("body does not point at the external PKI: %s", w.Body.String())
+			}
+		})
+	}
+}
+
 func TestCNCServer_generateKubectlComponents(t *testing.T) {
 	checkFunc := func(t *testing.T, body []byte) {
 		var response fwdapi.KubeConfigResponse
@@ -205,11 +381,72 @@ func TestCNCServer_generateKubectlComponents(t *testing.T) {
 			},
 			checkFunc,
 			http.StatusOK,
+		}, {
+			"badKeyType",
+			fwdapi.KubeConfigRequest{
+				AgentName: "agent smith",
+				Name:      "alice smith",
+				KeyType:   "dsa",
+			},
+			requireError("unknown key type 'dsa'"),
+			http.StatusBadRequest,
+		},
+		{
+			"keyType",
+			fwdapi.KubeConfigRequest{
+				AgentName: "agent smith",
+				Name:      "alice smith",
+				KeyType:   "ecdsa-p256",
+			},
+			func(t *testing.T, body []byte) {
+				var response fwdapi.KubeConfigResponse
+				if err := json.Unmarshal(body, &response); err != nil {
+					panic(err)
+				}
+				stringEquals(t, "UserKey", response.UserKey, "c-ecdsa-p256")
+			},
+			http.StatusOK,
+		},
+		{
+			"validityDays",
+			fwdapi.KubeConfigRequest{
+				AgentName:    "agent smith",
+				Name:         "alice smith",
+				ValidityDays: 7,
+			},
+			func(t *testing.T, body []byte) {
+				var response fwdapi.KubeConfigResponse
+				if err := json.Unmarshal(body, &response); err != nil {
+					panic(err)
+				}
+				stringEquals(t, "UserCertificate", response.UserCertificate, "b-168h0m0s")
+			},
+			http.StatusOK,
+		},
+		{
+			"validityTooLong",
+			fwdapi.KubeConfigRequest{
+				AgentName:    "agent smith",
+				Name:         "alice smith",
+				ValidityDays: 90,
+			},
+			requireError("exceeds the maximum"),
+			http.StatusBadRequest,
+		},
+		{
+			"negativeValidity",
+			fwdapi.KubeConfigRequest{
+				AgentName:    "agent smith",
+				Name:         "alice smith",
+				ValidityDays: -1,
+			},
+			requireError("'validityDays' is invalid"),
+			http.StatusBadRequest,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", "")
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", nil)
 
 			body, err := json.Marshal(tt.request)
 			if err != nil {
@@ -240,6 +477,120 @@ func TestCNCServer_generateKubectlComponents(t *testing.T) {
 	}
 }
 
+// pemAuthority returns base64 encoded PEM, as the real authority does.
+type pemAuthority struct {
+	mockAuthority
+}
+
+func (*pemAuthority) GenerateCertificate(name ca.CertificateName, keyType ca.KeyType, validity time.Duration) (string, string, string, error) {
+	encode := func(pemType string, data string) string {
+		block := pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: []byte(data)})
+		return base64.StdEncoding.EncodeToString(block)
+	}
+	return encode("CERTIFICATE", "ca"), encode("CERTIFICATE", "user"), encode("EC PRIVATE KEY", "key"), nil
+}
+
+func (*pemAuthority) GetCACert() (string, error) {
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("ca")})
+	return base64.StdEncoding.EncodeToString(block), nil
+}
+
+func TestCNCServer_generateKubectlComponents_kubeconfig(t *testing.T) {
+	c := MakeCNCServer(&mockConfig{}, &pemAuthority{}, nil, nil, "", nil)
+
+	t.Run("badFormat", func(t *testing.T) {
+		body, _ := json.Marshal(fwdapi.KubeConfigRequest{AgentName: "smith", Name: "alice", Format: "toml"})
+		r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		c.generateKubectlComponents().ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("kubeconfig", func(t *testing.T) {
+		body, _ := json.Marshal(fwdapi.KubeConfigRequest{AgentName: "smith", Name: "alice", Format: "kubeconfig"})
+		r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		c.generateKubectlComponents().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if ct := w.Result().Header.Get("content-type"); ct != "application/yaml" {
+			t.Errorf("Expected content-type to be application/yaml, not %s", ct)
+		}
+
+		kc, err := clientcmd.Load(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("kubeconfig does not load: %v\n%s", err, w.Body.String())
+		}
+		if err := clientcmd.Validate(*kc); err != nil {
+			t.Errorf("kubeconfig is not valid: %v", err)
+		}
+		stringEquals(t, "CurrentContext", kc.CurrentContext, "alice@smith")
+		context := kc.Contexts["alice@smith"]
+		if context == nil {
+			t.Fatalf("context alice@smith not found")
+		}
+		cluster := kc.Clusters[context.Cluster]
+		user := kc.AuthInfos[context.AuthInfo]
+		if cluster == nil || user == nil {
+			t.Fatalf("context refers to missing cluster or user")
+		}
+		stringEquals(t, "Server", cluster.Server, "https://service.local")
+		if !strings.Contains(string(cluster.CertificateAuthorityData), "BEGIN CERTIFICATE") {
+			t.Errorf("CA data is not PEM: %s", cluster.CertificateAuthorityData)
+		}
+		if !strings.Contains(string(user.ClientCertificateData), "BEGIN CERTIFICATE") {
+			t.Errorf("client certificate data is not PEM: %s", user.ClientCertificateData)
+		}
+		if !strings.Contains(string(user.ClientKeyData), "BEGIN EC PRIVATE KEY") {
+			t.Errorf("client key data is not PEM: %s", user.ClientKeyData)
+		}
+	})
+
+	t.Run("exec with validityDays", func(t *testing.T) {
+		body, _ := json.Marshal(fwdapi.KubeConfigRequest{AgentName: "smith", Name: "alice", CredentialMode: "exec", ValidityDays: 2})
+		r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		c.generateKubectlComponents().ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("exec", func(t *testing.T) {
+		body, _ := json.Marshal(fwdapi.KubeConfigRequest{AgentName: "smith", Name: "alice", Format: "kubeconfig", CredentialMode: "exec"})
+		r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		c.generateKubectlComponents().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		kc, err := clientcmd.Load(w.Body.Bytes())
+		if err != nil {
+			t.Fatalf("kubeconfig does not load: %v\n%s", err, w.Body.String())
+		}
+		if err := clientcmd.Validate(*kc); err != nil {
+			t.Errorf("kubeconfig is not valid: %v", err)
+		}
+		user := kc.AuthInfos["alice@smith"]
+		if user == nil || user.Exec == nil {
+			t.Fatalf("user alice@smith has no exec plugin:\n%s", w.Body.String())
+		}
+		if len(user.ClientCertificateData) != 0 || len(user.ClientKeyData) != 0 {
+			t.Errorf("exec kubeconfig should not hold a client certificate")
+		}
+		stringEquals(t, "Command", user.Exec.Command, fwdapi.KubeConfigCredentialPlugin)
+		wantArgs := []string{"-url", "https://control.local", "-agent", "smith", "-name", "alice"}
+		if !reflect.DeepEqual(user.Exec.Args, wantArgs) {
+			t.Errorf("Args = %v, want %v", user.Exec.Args, wantArgs)
+		}
+		stringEquals(t, "Server", kc.Clusters["alice@smith"].Server, "https://service.local")
+	})
+}
+
 func TestCNCServer_generateAgentManifestComponents(t *testing.T) {
 	checkFunc := func(t *testing.T, body []byte) {
 		var response fwdapi.ManifestResponse
@@ -278,11 +629,34 @@ func TestCNCServer_generateAgentManifestComponents(t *testing.T) {
 			fwdapi.ManifestRequest{AgentName: "agent smith"},
 			checkFunc,
 			http.StatusOK,
+		}, {
+			"badKeyType",
+			fwdapi.ManifestRequest{AgentName: "agent smith", KeyType: "dsa"},
+			requireError("unknown key type 'dsa'"),
+			http.StatusBadRequest,
+		},
+		{
+			"validityTooLong",
+			fwdapi.ManifestRequest{AgentName: "agent smith", ValidityDays: 90},
+			requireError("exceeds the maximum"),
+			http.StatusBadRequest,
+		},
+		{
+			"keyType",
+			fwdapi.ManifestRequest{AgentName: "agent smith", KeyType: "ecdsa-p384"},
+			func(t *testing.T, body []byte) {
+				var response fwdapi.ManifestResponse
+				if err := json.Unmarshal(body, &response); err != nil {
+					panic(err)
+				}
+				stringEquals(t, "AgentKey", response.AgentKey, "c-ecdsa-p384")
+			},
+			http.StatusOK,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", "")
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", nil)
 
 			body, err := json.Marshal(tt.request)
 			if err != nil {
@@ -313,6 +687,165 @@ func TestCNCServer_generateAgentManifestComponents(t *testing.T) {
 	}
 }
 
+func TestCNCServer_generateAgentManifestComponents_yaml(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    fwdapi.ManifestRequest
+		wantStatus int
+		wantType   string
+		want       []string
+	}{
+		{
+			"badFormat",
+			fwdapi.ManifestRequest{AgentName: "smith", Format: "xml"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'format' must be one of"},
+		},
+		{
+			"badAgentName",
+			fwdapi.ManifestRequest{AgentName: "agent smith", Format: "yaml"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'agentName' must be a valid Kubernetes name"},
+		},
+		{
+			"badAgentNameKustomize",
+			fwdapi.ManifestRequest{AgentName: "agent smith", Format: "kustomize"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'agentName' must be a valid Kubernetes name for kustomize format"},
+		},
+		{
+			"badNamespace",
+			fwdapi.ManifestRequest{AgentName: "smith", Format: "yaml", Namespace: "Bad_NS"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'namespace' is invalid"},
+		},
+		{
+			"defaults",
+			fwdapi.ManifestRequest{AgentName: "smith", Format: "yaml"},
+			http.StatusOK,
+			"text/vnd.yaml",
+			[]string{
+				"kind: Secret",
+				"kind: ConfigMap",
+				"kind: Deployment",
+				"name: forwarder-agent-smith",
+				`namespace: "agent-ns"`,
+				`image: "agent-image:latest"`,
+				`controllerHostname: "agent.local:1234"`,
+				`tls.crt: "b"`,
+				`tls.key: "c"`,
+				`ca.pem: "a"`,
+			},
+		},
+		{
+			"overrides",
+			fwdapi.ManifestRequest{AgentName: "smith", Format: "yaml", Namespace: "other", Image: "my/agent:v1"},
+			http.StatusOK,
+			"text/vnd.yaml",
+			[]string{
+				`namespace: "other"`,
+				`image: "my/agent:v1"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", nil)
+
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				panic(err)
+			}
+
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			h := c.generateAgentManifestComponents()
+			h.ServeHTTP(w, r)
+
+			if w.Result().StatusCode != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+
+			ct := w.Result().Header.Get("content-type")
+			if ct != tt.wantType {
+				t.Errorf("Expected content-type to be %s, not %s", tt.wantType, ct)
+			}
+
+			resultBody, err := ioutil.ReadAll(w.Result().Body)
+			if err != nil {
+				panic(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(resultBody), want) {
+					t.Errorf("Expected body to contain '%s':\n%s", want, string(resultBody))
+				}
+			}
+
+			if tt.wantStatus == http.StatusOK {
+				decoder := yaml.NewDecoder(bytes.NewReader(resultBody))
+				docs := 0
+				for {
+					var doc map[string]interface{}
+					if err := decoder.Decode(&doc); err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatalf("manifest is not valid YAML: %v", err)
+					}
+					docs++
+				}
+				if docs != 3 {
+					t.Errorf("Expected 3 YAML documents, got %d", docs)
+				}
+			}
+		})
+	}
+}
+
+func TestCNCServer_generateAgentManifestComponents_values(t *testing.T) {
+	tests := []struct {
+		name    string
+		request fwdapi.ManifestRequest
+		golden  string
+	}{
+		{
+			"helm-values",
+			fwdapi.ManifestRequest{AgentName: "smith", Format: "helm-values"},
+			"agent-helm-values.yaml",
+		},
+		{
+			"kustomize",
+			fwdapi.ManifestRequest{AgentName: "smith", Format: "kustomize", Namespace: "default"},
+			"agent-kustomization.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &pemAuthority{}, nil, nil, "", nil)
+
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				panic(err)
+			}
+
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			c.generateAgentManifestComponents().ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			if ct := w.Result().Header.Get("content-type"); ct != "text/vnd.yaml" {
+				t.Errorf("Expected content-type to be text/vnd.yaml, not %s", ct)
+			}
+			checkGolden(t, tt.golden, w.Body.Bytes())
+		})
+	}
+}
+
 func MakeServiceCheckFunc() func(*testing.T, []byte) {
 	return func(t *testing.T, body []byte) {
 		var response fwdapi.ServiceCredentialResponse
@@ -353,7 +886,7 @@ func MakeAWSCheckFunc() func(*testing.T, []byte) {
 		stringEquals(t, "CACert", response.CACert, "base64-cacert")
 		stringEquals(t, "CredentialType", response.CredentialType, "aws")
 		creds := response.Credential.(map[string]interface{})
-		if len(creds) != 2 {
+		if len(creds) != 3 {
 			t.Errorf("Unexpected keys: %#v", creds)
 		}
 		if _, found := creds["awsAccessKey"]; !found {
@@ -362,6 +895,9 @@ func MakeAWSCheckFunc() func(*testing.T, []byte) {
 		if _, found := creds["awsSecretAccessKey"]; !found {
 			t.Errorf("Credential does not have key 'awsSecretAccessKey': %#v", creds)
 		}
+		if creds["awsSessionToken"] != creds["awsSecretAccessKey"] {
+			t.Errorf("Credential 'awsSessionToken' should match 'awsSecretAccessKey': %#v", creds)
+		}
 	}
 }
 
@@ -401,6 +937,30 @@ func TestCNCServer_generateServiceCredentials(t *testing.T) {
 			serviceCheckFunc,
 			http.StatusOK,
 		},
+		{
+			"working with expiresIn",
+			fwdapi.ServiceCredentialRequest{
+				AgentName: "agent smith",
+				Type:      "jenkins",
+				Name:      "service smith",
+				ExpiresIn: 3600,
+			},
+			"key1",
+			serviceCheckFunc,
+			http.StatusOK,
+		},
+		{
+			"negative expiresIn",
+			fwdapi.ServiceCredentialRequest{
+				AgentName: "agent smith",
+				Type:      "jenkins",
+				Name:      "service smith",
+				ExpiresIn: -1,
+			},
+			"key1",
+			requireError("'expiresIn' is invalid"),
+			http.StatusBadRequest,
+		},
 		{
 			"bad-jwt-key",
 			fwdapi.ServiceCredentialRequest{
@@ -426,21 +986,143 @@ func TestCNCServer_generateServiceCredentials(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			key1, err := jwk.New([]byte("key 1"))
-			if err != nil {
-				panic(err)
-			}
-			err = key1.Set(jwk.KeyIDKey, "key1")
+			keys := jwtutil.NewKeyset(tt.jwkKey)
+			_ = keys.Load(map[string][]byte{"key1": []byte("key 1")})
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, keys, "", nil)
+
+			body, err := json.Marshal(tt.request)
 			if err != nil {
 				panic(err)
 			}
-			err = key1.Set(jwk.AlgorithmKey, jwa.HS256)
-			if err != nil {
+
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			h := c.generateServiceCredentials()
+			h.ServeHTTP(w, r)
+
+			if w.Result().StatusCode != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+
+			ct := w.Result().Header.Get("content-type")
+			if ct != "application/json" {
+				t.Errorf("Expected content-type to be application/json, not %s", ct)
+			}
+
+			resultBody, err := ioutil.ReadAll(w.Result().Body)
+			if err != nil {
+				panic(err)
+			}
+
+			tt.validateBody(t, resultBody)
+		})
+	}
+}
+
+func TestCNCServer_generateServiceCredentials_anyAgent(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        cncConfig
+		agentName     string
+		wantStatus    int
+		wantAgentName string
+	}{
+		{"wildcard not allowed", &mockConfig{}, fwdapi.AnyAgent, http.StatusBadRequest, ""},
+		{"empty not allowed", &mockConfig{}, "", http.StatusBadRequest, ""},
+		{"wildcard allowed", &anyAgentConfig{}, fwdapi.AnyAgent, http.StatusOK, fwdapi.AnyAgent},
+		{"empty allowed", &anyAgentConfig{}, "", http.StatusOK, fwdapi.AnyAgent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := jwtutil.NewKeyset("key1")
+			_ = keys.Load(map[string][]byte{"key1": []byte("key 1")})
+			c := MakeCNCServer(tt.config, &mockAuthority{}, nil, keys, "", nil)
+
+			body, err := json.Marshal(fwdapi.ServiceCredentialRequest{
+				AgentName: tt.agentName,
+				Type:      "jenkins",
+				Name:      "service smith",
+			})
+			if err != nil {
 				panic(err)
 			}
-			keys := jwk.NewSet()
-			keys.Add(key1)
-			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, keys, tt.jwkKey, "")
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			c.generateServiceCredentials().ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var response fwdapi.ServiceCredentialResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.AgentName != tt.wantAgentName {
+				t.Errorf("agentName = %q, want %q", response.AgentName, tt.wantAgentName)
+			}
+		})
+	}
+}
+
+func TestCNCServer_generateServiceCredentials_secret(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    fwdapi.ServiceCredentialRequest
+		wantStatus int
+		wantType   string
+		want       []string
+	}{
+		{
+			"badFormat",
+			fwdapi.ServiceCredentialRequest{AgentName: "smith", Type: "jenkins", Name: "j1", Format: "xml"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'format' must be one of"},
+		},
+		{
+			"badSecretName",
+			fwdapi.ServiceCredentialRequest{AgentName: "smith", Type: "jenkins", Name: "j1", Format: "secret", SecretName: "Bad_Name"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'secretName' is invalid"},
+		},
+		{
+			"badNamespace",
+			fwdapi.ServiceCredentialRequest{AgentName: "smith", Type: "jenkins", Name: "j1", Format: "secret", Namespace: "Bad_NS"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'namespace' is invalid"},
+		},
+		{
+			"defaultNameInvalid",
+			fwdapi.ServiceCredentialRequest{AgentName: "agent smith", Type: "jenkins", Name: "j1", Format: "secret"},
+			http.StatusBadRequest,
+			"application/json",
+			[]string{"'secretName' is required, as 'svc-agent smith-j1' is not a valid Kubernetes name"},
+		},
+		{
+			"defaults",
+			fwdapi.ServiceCredentialRequest{AgentName: "smith", Type: "jenkins", Name: "j1", Format: "secret"},
+			http.StatusOK,
+			"text/vnd.yaml",
+			[]string{"name: svc-smith-j1", "namespace: secret-ns", "username: ", "password: ", "ca.pem: base64-cacert"},
+		},
+		{
+			"overrides",
+			fwdapi.ServiceCredentialRequest{AgentName: "agent smith", Type: "aws", Name: "s3", Format: "secret", SecretName: "s3-creds", Namespace: "spinnaker"},
+			http.StatusOK,
+			"text/vnd.yaml",
+			[]string{"name: s3-creds", "namespace: spinnaker", "awsAccessKey: ", "awsSecretAccessKey: "},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := jwtutil.NewKeyset("key1")
+			_ = keys.Load(map[string][]byte{"key1": []byte("key 1")})
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, keys, "", nil)
 
 			body, err := json.Marshal(tt.request)
 			if err != nil {
@@ -457,20 +1139,77 @@ func TestCNCServer_generateServiceCredentials(t *testing.T) {
 			}
 
 			ct := w.Result().Header.Get("content-type")
-			if ct != "application/json" {
-				t.Errorf("Expected content-type to be application/json, not %s", ct)
+			if ct != tt.wantType {
+				t.Errorf("Expected content-type to be %s, not %s", tt.wantType, ct)
 			}
 
 			resultBody, err := ioutil.ReadAll(w.Result().Body)
 			if err != nil {
 				panic(err)
 			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(resultBody), want) {
+					t.Errorf("Expected body to contain '%s':\n%s", want, string(resultBody))
+				}
+			}
 
-			tt.validateBody(t, resultBody)
+			if tt.wantStatus == http.StatusOK {
+				var secret serviceSecret
+				if err := yaml.Unmarshal(resultBody, &secret); err != nil {
+					t.Fatalf("secret is not valid YAML: %v", err)
+				}
+				username := secret.Data["username"]
+				if tt.request.Type == "aws" {
+					username = secret.Data["awsAccessKey"]
+				}
+				decoded, err := base64.StdEncoding.DecodeString(username)
+				if err != nil {
+					t.Fatalf("value is not base64 encoded: %v", err)
+				}
+				stringEquals(t, "username", string(decoded), tt.request.Name+"."+tt.request.AgentName)
+			}
 		})
 	}
 }
 
+func requireFieldErrors(want map[string]string) verifierFunc {
+	return func(t *testing.T, body []byte) {
+		var msg struct {
+			Error struct {
+				Fields map[string]string `json:"fields"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(msg.Error.Fields, want) {
+			t.Errorf("Expected field errors %v, got %v", want, msg.Error.Fields)
+		}
+	}
+}
+
+// namingAuthority records the names of the certificates it issues.
+type namingAuthority struct {
+	mockAuthority
+	names []ca.CertificateName
+}
+
+func (a *namingAuthority) GenerateCertificate(name ca.CertificateName, keyType ca.KeyType, validity time.Duration) (string, string, string, error) {
+	a.names = append(a.names, name)
+	return a.mockAuthority.GenerateCertificate(name, keyType, validity)
+}
+
+// allowlistConfig allows only the requests in allowed, keyed by requester
+// and name.
+type allowlistConfig struct {
+	mockConfig
+	allowed map[string]bool
+}
+
+func (c *allowlistConfig) IsControlCredentialAllowed(requester string, name string) bool {
+	return c.allowed[requester+"/"+name]
+}
+
 func TestCNCServer_generateControlCredentials(t *testing.T) {
 	checkFunc := func(t *testing.T, body []byte) {
 		var response fwdapi.ControlCredentialsResponse
@@ -478,12 +1217,18 @@ func TestCNCServer_generateControlCredentials(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		stringEquals(t, "Name", response.Name, "contra smith")
+		stringEquals(t, "Name", response.Name, "contra-smith")
 		stringEquals(t, "URL", response.URL, "https://control.local")
 		stringEquals(t, "Certificate", response.Certificate, "b")
 		stringEquals(t, "Key", response.Key, "c")
 		stringEquals(t, "CACert", response.CACert, "a")
 	}
+	both := func(a verifierFunc, b verifierFunc) verifierFunc {
+		return func(t *testing.T, body []byte) {
+			a(t, body)
+			b(t, body)
+		}
+	}
 
 	tests := []struct {
 		name         string
@@ -500,19 +1245,58 @@ func TestCNCServer_generateControlCredentials(t *testing.T) {
 		{
 			"missingName",
 			fwdapi.ControlCredentialsRequest{},
-			requireError("'name' is invalid"),
+			both(requireError("'name' is required"), requireFieldErrors(map[string]string{"name": "is required"})),
 			http.StatusBadRequest,
 		},
 		{
-			"working",
+			"badCharacters",
 			fwdapi.ControlCredentialsRequest{Name: "contra smith"},
+			requireFieldErrors(map[string]string{
+				"name": "must contain only letters, digits, '-', '.', and '_', and start and end with a letter or digit",
+			}),
+			http.StatusBadRequest,
+		},
+		{
+			"tooLong",
+			fwdapi.ControlCredentialsRequest{Name: strings.Repeat("a", fwdapi.MaxControlNameLength+1)},
+			requireFieldErrors(map[string]string{"name": "must be at most 64 characters"}),
+			http.StatusBadRequest,
+		},
+		{
+			"everyField",
+			fwdapi.ControlCredentialsRequest{Name: "-contra", ValidityDays: -1},
+			both(
+				requireError("'name' must contain only letters"),
+				requireFieldErrors(map[string]string{
+					"name":         "must contain only letters, digits, '-', '.', and '_', and start and end with a letter or digit",
+					"validityDays": "must not be negative",
+				}),
+			),
+			http.StatusBadRequest,
+		},
+		{
+			"working",
+			fwdapi.ControlCredentialsRequest{Name: "contra-smith"},
 			checkFunc,
 			http.StatusOK,
 		},
+		{
+			"validityDays",
+			fwdapi.ControlCredentialsRequest{Name: "contra-smith", ValidityDays: 1},
+			func(t *testing.T, body []byte) {
+				var response fwdapi.ControlCredentialsResponse
+				if err := json.Unmarshal(body, &response); err != nil {
+					panic(err)
+				}
+				stringEquals(t, "Certificate", response.Certificate, "b-24h0m0s")
+			},
+			http.StatusOK,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", "")
+			authority := &namingAuthority{}
+			c := MakeCNCServer(&mockConfig{}, authority, nil, nil, "", nil)
 
 			body, err := json.Marshal(tt.request)
 			if err != nil {
@@ -539,13 +1323,61 @@ func TestCNCServer_generateControlCredentials(t *testing.T) {
 			}
 
 			tt.validateBody(t, resultBody)
+
+			for _, name := range authority.names {
+				if name.Purpose != ca.CertificatePurposeControl {
+					t.Errorf("Expected a control certificate, got purpose '%s'", name.Purpose)
+				}
+			}
+		})
+	}
+}
+
+func TestCNCServer_generateControlCredentials_allowlist(t *testing.T) {
+	cfg := &allowlistConfig{allowed: map[string]bool{"admin/ci-runner": true}}
+	tests := []struct {
+		requester  string
+		name       string
+		wantStatus int
+	}{
+		{"admin", "ci-runner", http.StatusOK},
+		{"admin", "other", http.StatusForbidden},
+		{"ci-runner", "ci-runner", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.requester+"/"+tt.name, func(t *testing.T) {
+			c := MakeCNCServer(cfg, &mockAuthority{}, nil, nil, "", nil)
+			body, err := json.Marshal(fwdapi.ControlCredentialsRequest{Name: tt.name})
+			if err != nil {
+				panic(err)
+			}
+			cert := x509.Certificate{
+				Subject: pkix.Name{
+					Names: []pkix.AttributeTypeAndValue{
+						{
+							Type:  []int{2, 5, 4, ca.OpsMxOIDValue},
+							Value: fmt.Sprintf(`{"name":"%s","purpose":"control"}`, tt.requester),
+						},
+					},
+				},
+			}
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{&cert}}
+			w := httptest.NewRecorder()
+			c.generateControlCredentials().ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusForbidden {
+				requireError("is not allowed to create control credentials")(t, w.Body.Bytes())
+			}
 		})
 	}
 }
 
 func TestCNCServer_getStatistics(t *testing.T) {
-	t.Run("getCredentials", func(t *testing.T) {
-		c := MakeCNCServer(nil, nil, &mockAgents{}, nil, "", "")
+	t.Run("typed", func(t *testing.T) {
+		c := MakeCNCServer(&mockConfig{}, nil, &mockAgents{}, nil, "1.0", nil)
 
 		r := httptest.NewRequest("GET", "https://localhost/foo", nil)
 		w := httptest.NewRecorder()
@@ -561,6 +1393,34 @@ func TestCNCServer_getStatistics(t *testing.T) {
 			t.Errorf("Expected content-type to be application/json, not %s", ct)
 		}
 
+		var response fwdapi.StatisticsResponse
+		if err := json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+			t.Fatalf("unable to decode response: %v", err)
+		}
+		if response.APIVersion != fwdapi.StatisticsAPIVersion || response.Version != "1.0" {
+			t.Errorf("apiVersion %s and version %s incorrect", response.APIVersion, response.Version)
+		}
+		if len(response.ConnectedAgents) != 1 || len(response.ConnectedAgents[0].Sessions) != 1 {
+			t.Fatalf("Expected 1 agent with 1 session, got %#v", response.ConnectedAgents)
+		}
+		session := response.ConnectedAgents[0].Sessions[0]
+		if session.Session != "session1" || session.InFlight != 2 || len(session.Endpoints) != 1 {
+			t.Errorf("session fields incorrect: %#v", session)
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		c := MakeCNCServer(&mockConfig{legacyStatistics: true}, nil, &mockAgents{}, nil, "", nil)
+
+		r := httptest.NewRequest("GET", "https://localhost/foo", nil)
+		w := httptest.NewRecorder()
+		h := c.getStatistics()
+		h.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+
 		resultBody, err := ioutil.ReadAll(w.Result().Body)
 		if err != nil {
 			panic(err)
@@ -568,5 +1428,462 @@ func TestCNCServer_getStatistics(t *testing.T) {
 		if !strings.Contains(string(resultBody), `"connectedAgents":{"foo":"foostring"}`) {
 			t.Errorf("body invalid: %s", string(resultBody))
 		}
+		if strings.Contains(string(resultBody), "apiVersion") {
+			t.Errorf("legacy body has an apiVersion: %s", string(resultBody))
+		}
 	})
 }
+
+func TestCNCServer_listAgents(t *testing.T) {
+	c := MakeCNCServer(nil, nil, &mockAgents{}, nil, "", nil)
+
+	r := httptest.NewRequest("GET", "https://localhost/foo", nil)
+	w := httptest.NewRecorder()
+	h := c.listAgents()
+	h.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	ct := w.Result().Header.Get("content-type")
+	if ct != "application/json" {
+		t.Errorf("Expected content-type to be application/json, not %s", ct)
+	}
+
+	var response fwdapi.AgentsResponse
+	err := json.NewDecoder(w.Result().Body).Decode(&response)
+	if err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	if len(response.Agents) != 1 {
+		t.Fatalf("Expected 1 agent, got %d", len(response.Agents))
+	}
+	a := response.Agents[0]
+	if a.Name != "agent1" || a.Session != "session1" || a.RemoteAddress != "10.0.0.1:1234" || a.Version != "1.2.3" {
+		t.Errorf("agent fields incorrect: %#v", a)
+	}
+	if a.ConnectedAt != 100 || a.LastPing != 200 {
+		t.Errorf("agent times incorrect: %#v", a)
+	}
+	if len(a.Endpoints) != 1 || a.Endpoints[0].Name != "ep1" || !a.Endpoints[0].Configured {
+		t.Errorf("agent endpoints incorrect: %#v", a.Endpoints)
+	}
+}
+
+func TestCNCServer_revokeCertificate(t *testing.T) {
+	checkSerial := func(t *testing.T, body []byte) {
+		var response fwdapi.RevokeCertificateResponse
+		err := json.Unmarshal(body, &response)
+		if err != nil {
+			panic(err)
+		}
+		stringEquals(t, "Serial", response.Serial, "255")
+		stringEquals(t, "Purpose", response.Purpose, "")
+	}
+
+	checkName := func(t *testing.T, body []byte) {
+		var response fwdapi.RevokeCertificateResponse
+		err := json.Unmarshal(body, &response)
+		if err != nil {
+			panic(err)
+		}
+		stringEquals(t, "Serial", response.Serial, "")
+		stringEquals(t, "AgentName", response.AgentName, "agent smith")
+		stringEquals(t, "Type", response.Type, "kubernetes")
+		stringEquals(t, "Name", response.Name, "bob")
+		stringEquals(t, "Purpose", response.Purpose, "service")
+	}
+
+	tests := []struct {
+		name         string
+		request      interface{}
+		validateBody verifierFunc
+		wantStatus   int
+	}{
+		{
+			"badJSON",
+			"badjson",
+			requireError("json: cannot unmarshal"),
+			http.StatusBadRequest,
+		},
+		{
+			"empty",
+			fwdapi.RevokeCertificateRequest{},
+			requireError("'serial' or 'purpose' is required"),
+			http.StatusBadRequest,
+		},
+		{
+			"both",
+			fwdapi.RevokeCertificateRequest{Serial: "1", Purpose: "service"},
+			requireError("only one of"),
+			http.StatusBadRequest,
+		},
+		{
+			"badSerial",
+			fwdapi.RevokeCertificateRequest{Serial: "bob"},
+			requireError("'serial' is invalid"),
+			http.StatusBadRequest,
+		},
+		{
+			"negativeSerial",
+			fwdapi.RevokeCertificateRequest{Serial: "-1"},
+			requireError("invalid serial number"),
+			http.StatusBadRequest,
+		},
+		{
+			"serial",
+			fwdapi.RevokeCertificateRequest{Serial: "0xff"},
+			checkSerial,
+			http.StatusOK,
+		},
+		{
+			"name",
+			fwdapi.RevokeCertificateRequest{AgentName: "agent smith", Type: "kubernetes", Name: "bob", Purpose: "service"},
+			checkName,
+			http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", nil)
+
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				panic(err)
+			}
+
+			r := httptest.NewRequest("POST", "https://localhost/foo", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			h := c.revokeCertificate()
+			h.ServeHTTP(w, r)
+
+			if w.Result().StatusCode != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+
+			resultBody, err := ioutil.ReadAll(w.Result().Body)
+			if err != nil {
+				panic(err)
+			}
+
+			tt.validateBody(t, resultBody)
+		})
+	}
+}
+
+type mockServerCertificate struct {
+	renewals int
+	err      error
+}
+
+func (m *mockServerCertificate) Renew() (*x509.Certificate, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.renewals++
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		NotAfter:     time.Unix(1700000000, 0),
+	}, nil
+}
+
+func TestCNCServer_renewServerCertificate(t *testing.T) {
+	checkRenewed := func(t *testing.T, body []byte) {
+		var response fwdapi.RenewServerCertificateResponse
+		err := json.Unmarshal(body, &response)
+		if err != nil {
+			panic(err)
+		}
+		stringEquals(t, "Serial", response.Serial, "42")
+		if response.NotAfter != 1700000000000 {
+			t.Errorf("Expected NotAfter to be 1700000000000, not %d", response.NotAfter)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		cert         *mockServerCertificate
+		method       string
+		validateBody verifierFunc
+		wantStatus   int
+		wantRenewals int
+	}{
+		{"disabled", nil, "POST", func(*testing.T, []byte) {}, http.StatusNotFound, 0},
+		{"renewed", &mockServerCertificate{}, "POST", checkRenewed, http.StatusOK, 1},
+		{"GET", &mockServerCertificate{}, "GET", requireError("only 'POST' is accepted"), http.StatusMethodNotAllowed, 0},
+		{"authority fails", &mockServerCertificate{err: fmt.Errorf("no key")}, "POST", requireError("no key"), http.StatusInternalServerError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(nil, nil, nil, nil, "", nil)
+			if tt.cert != nil {
+				c.SetServerCertificate(tt.cert)
+			}
+			mux := http.NewServeMux()
+			c.routes(mux)
+			r := httptest.NewRequest(tt.method, "https://localhost"+fwdapi.RenewEndpoint, nil)
+			r.TLS.PeerCertificates = []*x509.Certificate{&goodCert}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			tt.validateBody(t, w.Body.Bytes())
+			if tt.cert != nil && tt.cert.renewals != tt.wantRenewals {
+				t.Errorf("Expected %d renewals, got %d", tt.wantRenewals, tt.cert.renewals)
+			}
+		})
+	}
+}
+
+// nameRevokingAuthority records the names revoked.
+type nameRevokingAuthority struct {
+	mockAuthority
+	revoked []ca.CertificateName
+	err     error
+}
+
+func (a *nameRevokingAuthority) RevokeName(name ca.CertificateName) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.revoked = append(a.revoked, name)
+	return nil
+}
+
+func TestCNCServer_disconnectAgent(t *testing.T) {
+	checkClosed := func(closed int, revoked bool) verifierFunc {
+		return func(t *testing.T, body []byte) {
+			var response fwdapi.DisconnectAgentResponse
+			if err := json.Unmarshal(body, &response); err != nil {
+				panic(err)
+			}
+			want := fwdapi.DisconnectAgentResponse{AgentName: "agent1", SessionsClosed: closed, Revoked: revoked}
+			if response != want {
+				t.Errorf("Expected %+v, got %+v", want, response)
+			}
+		}
+	}
+
+	tests := []struct {
+		name           string
+		cert           *x509.Certificate
+		request        interface{}
+		revokeErr      error
+		validateBody   verifierFunc
+		wantStatus     int
+		wantSession    string
+		wantRevoked    bool
+		wantDisconnect bool
+	}{
+		{"all sessions", &goodCert, fwdapi.DisconnectAgentRequest{AgentName: "agent1"}, nil, checkClosed(2, false), http.StatusOK, "", false, true},
+		{"one session", &goodCert, fwdapi.DisconnectAgentRequest{AgentName: "agent1", Session: "s1"}, nil, checkClosed(1, false), http.StatusOK, "s1", false, true},
+		{"revoke", &goodCert, fwdapi.DisconnectAgentRequest{AgentName: "agent1", Revoke: true}, nil, checkClosed(2, true), http.StatusOK, "", true, true},
+		{"revoke fails", &goodCert, fwdapi.DisconnectAgentRequest{AgentName: "agent1", Revoke: true}, fmt.Errorf("no store"), requireError("no store"), http.StatusInternalServerError, "", false, false},
+		{"missing name", &goodCert, fwdapi.DisconnectAgentRequest{}, nil, requireFieldErrors(map[string]string{"agentName": "is required"}), http.StatusBadRequest, "", false, false},
+		{"badJSON", &goodCert, "badjson", nil, requireError("json: cannot unmarshal"), http.StatusBadRequest, "", false, false},
+		{"not control", &wrongTypeCert, fwdapi.DisconnectAgentRequest{AgentName: "agent1"}, nil, requireError("not authorized for 'control'"), http.StatusForbidden, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authority := &nameRevokingAuthority{err: tt.revokeErr}
+			c := MakeCNCServer(&mockConfig{}, authority, nil, nil, "", nil)
+			disconnected := false
+			c.SetDisconnectFunc(func(name string, session string) int {
+				disconnected = true
+				if name != "agent1" || session != tt.wantSession {
+					t.Errorf("Expected to disconnect agent1 session '%s', got %s session '%s'", tt.wantSession, name, session)
+				}
+				if session != "" {
+					return 1
+				}
+				return 2
+			})
+			mux := http.NewServeMux()
+			c.routes(mux)
+
+			body, err := json.Marshal(tt.request)
+			if err != nil {
+				panic(err)
+			}
+			r := httptest.NewRequest("POST", "https://localhost"+fwdapi.DisconnectEndpoint, bytes.NewReader(body))
+			r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			tt.validateBody(t, w.Body.Bytes())
+			if disconnected != tt.wantDisconnect {
+				t.Errorf("Expected disconnected to be %v", tt.wantDisconnect)
+			}
+			wantRevoked := []ca.CertificateName(nil)
+			if tt.wantRevoked {
+				wantRevoked = []ca.CertificateName{{Agent: "agent1", Purpose: ca.CertificatePurposeAgent}}
+			}
+			if !reflect.DeepEqual(authority.revoked, wantRevoked) {
+				t.Errorf("Expected %v revoked, got %v", wantRevoked, authority.revoked)
+			}
+		})
+	}
+}
+
+func TestCNCServer_updateLimits(t *testing.T) {
+	checkLimits := func(perSession int, total int) verifierFunc {
+		return func(t *testing.T, body []byte) {
+			var response fwdapi.LimitsResponse
+			if err := json.Unmarshal(body, &response); err != nil {
+				panic(err)
+			}
+			want := fwdapi.LimitsResponse{MaxOutstandingPerSession: perSession, MaxOutstanding: total, Outstanding: 7}
+			if response != want {
+				t.Errorf("Expected %+v, got %+v", want, response)
+			}
+		}
+	}
+
+	tests := []struct {
+		name         string
+		cert         *x509.Certificate
+		request      string
+		validateBody verifierFunc
+		wantStatus   int
+	}{
+		{"read", &goodCert, `{}`, checkLimits(5, 100), http.StatusOK},
+		{"per session", &goodCert, `{"maxOutstandingPerSession":10}`, checkLimits(10, 100), http.StatusOK},
+		{"both", &goodCert, `{"maxOutstandingPerSession":0,"maxOutstanding":50}`, checkLimits(0, 50), http.StatusOK},
+		{
+			"negative",
+			&goodCert,
+			`{"maxOutstandingPerSession":-1,"maxOutstanding":-2}`,
+			requireFieldErrors(map[string]string{"maxOutstandingPerSession": "must not be negative", "maxOutstanding": "must not be negative"}),
+			http.StatusBadRequest,
+		},
+		{"badJSON", &goodCert, `"badjson"`, requireError("json: cannot unmarshal"), http.StatusBadRequest},
+		{"not control", &wrongTypeCert, `{}`, requireError("not authorized for 'control'"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", nil)
+			limits := fwdapi.LimitsResponse{MaxOutstandingPerSession: 5, MaxOutstanding: 100, Outstanding: 7}
+			c.SetLimitsFunc(func(req fwdapi.LimitsRequest) fwdapi.LimitsResponse {
+				if req.MaxOutstandingPerSession != nil {
+					limits.MaxOutstandingPerSession = *req.MaxOutstandingPerSession
+				}
+				if req.MaxOutstanding != nil {
+					limits.MaxOutstanding = *req.MaxOutstanding
+				}
+				return limits
+			})
+			mux := http.NewServeMux()
+			c.routes(mux)
+
+			r := httptest.NewRequest("POST", "https://localhost"+fwdapi.LimitsEndpoint, strings.NewReader(tt.request))
+			r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			tt.validateBody(t, w.Body.Bytes())
+		})
+	}
+}
+
+// mockTokenRevoker accepts the token "token1", whose ID is "jti1", and
+// records the IDs revoked.
+type mockTokenRevoker struct {
+	revoked []string
+	err     error
+}
+
+var mockTokenExpiry = time.Unix(1700000000, 0)
+
+func (m *mockTokenRevoker) TokenID(token string) (string, time.Time, error) {
+	if token != "token1" {
+		return "", time.Time{}, fmt.Errorf("signature not valid")
+	}
+	return "jti1", mockTokenExpiry, nil
+}
+
+func (m *mockTokenRevoker) Revoke(ctx context.Context, id string, expires time.Time) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.revoked = append(m.revoked, id)
+	return nil
+}
+
+func TestCNCServer_revokeServiceToken(t *testing.T) {
+	checkRevoked := func(want fwdapi.RevokeServiceTokenResponse) verifierFunc {
+		return func(t *testing.T, body []byte) {
+			var response fwdapi.RevokeServiceTokenResponse
+			if err := json.Unmarshal(body, &response); err != nil {
+				panic(err)
+			}
+			if response != want {
+				t.Errorf("Expected %+v, got %+v", want, response)
+			}
+		}
+	}
+
+	tests := []struct {
+		name         string
+		cert         *x509.Certificate
+		request      string
+		revokeErr    error
+		validateBody verifierFunc
+		wantStatus   int
+		wantRevoked  []string
+	}{
+		{"by id", &goodCert, `{"jti":"01F4R9T4G0TESTTOKEN0000000"}`, nil, checkRevoked(fwdapi.RevokeServiceTokenResponse{ID: "01F4R9T4G0TESTTOKEN0000000"}), http.StatusOK, []string{"01F4R9T4G0TESTTOKEN0000000"}},
+		{"by token", &goodCert, `{"token":"token1"}`, nil, checkRevoked(fwdapi.RevokeServiceTokenResponse{ID: "jti1", ExpiresAt: 1700000000000}), http.StatusOK, []string{"jti1"}},
+		{"bad token", &goodCert, `{"token":"token2"}`, nil, requireError("signature not valid"), http.StatusBadRequest, nil},
+		{"both", &goodCert, `{"jti":"jti1","token":"token1"}`, nil, requireError("only one of"), http.StatusBadRequest, nil},
+		{"neither", &goodCert, `{}`, nil, requireError("'jti' or 'token' is required"), http.StatusBadRequest, nil},
+		{"bad id", &goodCert, `{"jti":"a/b"}`, nil, requireError("'jti' is invalid"), http.StatusBadRequest, nil},
+		{"store fails", &goodCert, `{"jti":"jti1"}`, fmt.Errorf("no store"), requireError("no store"), http.StatusInternalServerError, nil},
+		{"badJSON", &goodCert, `"badjson"`, nil, requireError("json: cannot unmarshal"), http.StatusBadRequest, nil},
+		{"not control", &wrongTypeCert, `{"jti":"jti1"}`, nil, requireError("not authorized for 'control'"), http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", nil)
+			revoker := &mockTokenRevoker{err: tt.revokeErr}
+			c.SetServiceTokenRevoker(revoker)
+			mux := http.NewServeMux()
+			c.routes(mux)
+
+			r := httptest.NewRequest("POST", "https://localhost"+fwdapi.RevokeServiceTokenEndpoint, strings.NewReader(tt.request))
+			r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status code %d, got %d", tt.wantStatus, w.Code)
+			}
+			tt.validateBody(t, w.Body.Bytes())
+			if !reflect.DeepEqual(revoker.revoked, tt.wantRevoked) {
+				t.Errorf("Expected %v revoked, got %v", tt.wantRevoked, revoker.revoked)
+			}
+		})
+	}
+}
+
+func TestCNCServer_revokeServiceToken_notConfigured(t *testing.T) {
+	c := MakeCNCServer(&mockConfig{}, &mockAuthority{}, nil, nil, "", nil)
+	mux := http.NewServeMux()
+	c.routes(mux)
+
+	r := httptest.NewRequest("POST", "https://localhost"+fwdapi.RevokeServiceTokenEndpoint, strings.NewReader(`{"jti":"jti1"}`))
+	r.TLS.PeerCertificates = []*x509.Certificate{&goodCert}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d without a deny list, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"fmt"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/kubeconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// execCredentialAPIVersion is the ExecCredential version the credential
+// plugin is asked for.
+const execCredentialAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// renderKubeconfig builds a kubeconfig with a single context, named
+// "name@agent", which is also the current context.  The cluster is the
+// controller's service URL, and the user authenticates with the service
+// certificate, or by running the credential plugin for a token.
+func renderKubeconfig(components fwdapi.KubeConfigResponse) ([]byte, error) {
+	name := components.Name + "@" + components.AgentName
+	user := kubeconfig.UserDetails{
+		ClientCertificateData: components.UserCertificate,
+		ClientKeyData:         components.UserKey,
+	}
+	if components.CredentialMode == fwdapi.KubeConfigCredentialModeExec {
+		user = kubeconfig.UserDetails{
+			Exec: &kubeconfig.ExecConfig{
+				APIVersion: execCredentialAPIVersion,
+				Command:    fwdapi.KubeConfigCredentialPlugin,
+				Args: []string{
+					"-url", components.ControlURL,
+					"-agent", components.AgentName,
+					"-name", components.Name,
+				},
+			},
+		}
+	}
+	kc := kubeconfig.KubeConfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		CurrentContext: name,
+		Clusters: []kubeconfig.Cluster{{
+			Name: name,
+			Cluster: kubeconfig.ClusterDetails{
+				CertificateAuthorityData: components.CACert,
+				Server:                   components.ServerURL,
+			},
+		}},
+		Contexts: []kubeconfig.Context{{
+			Name: name,
+			Context: kubeconfig.ContextDetails{
+				Cluster: name,
+				User:    name,
+			},
+		}},
+		Users: []kubeconfig.User{{
+			Name: name,
+			User: user,
+		}},
+	}
+	b, err := yaml.Marshal(kc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render kubeconfig: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+)
+
+// agentManifestTemplate renders the Secret, ConfigMap, and Deployment needed
+// to run an agent.  The agent uses its in-cluster service account to reach
+// the Kubernetes API.  String values are quoted with `quote` so they are
+// always valid YAML scalars.
+var agentManifestTemplate = template.Must(template.New("agent-manifest").
+	Funcs(template.FuncMap{"quote": yamlQuote}).
+	Parse(`---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: forwarder-agent-{{ .AgentName }}
+  namespace: {{ quote .Namespace }}
+type: Opaque
+data:
+  tls.crt: {{ quote .AgentCertificate }}
+  tls.key: {{ quote .AgentKey }}
+  ca.pem: {{ quote .CACert }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: forwarder-agent-{{ .AgentName }}
+  namespace: {{ quote .Namespace }}
+data:
+  config.yaml: |
+    controllerHostname: {{ quote .ControllerHostname }}
+  services.yaml: |
+    services:
+      - name: kubernetes
+        type: kubernetes
+        enabled: true
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: forwarder-agent-{{ .AgentName }}
+  namespace: {{ quote .Namespace }}
+  labels:
+    app: forwarder-agent
+    agent: {{ .AgentName }}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: forwarder-agent
+      agent: {{ .AgentName }}
+  template:
+    metadata:
+      labels:
+        app: forwarder-agent
+        agent: {{ .AgentName }}
+    spec:
+      containers:
+        - name: agent
+          image: {{ quote .Image }}
+          args:
+            - -in-cluster
+            - -caCertFile=/app/secrets/agent/ca.pem
+          env:
+            - name: POD_NAMESPACE
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.namespace
+          ports:
+            - name: metrics
+              containerPort: 9102
+          volumeMounts:
+            - name: config
+              mountPath: /app/config
+              readOnly: true
+            - name: secrets
+              mountPath: /app/secrets/agent
+              readOnly: true
+      volumes:
+        - name: config
+          configMap:
+            name: forwarder-agent-{{ .AgentName }}
+        - name: secrets
+          secret:
+            secretName: forwarder-agent-{{ .AgentName }}
+`))
+
+type agentManifestValues struct {
+	AgentName          string
+	Namespace          string
+	Image              string
+	ControllerHostname string
+	AgentCertificate   string
+	AgentKey           string
+	CACert             string
+}
+
+// yamlQuote returns s as a double-quoted scalar.  JSON strings are valid YAML.
+func yamlQuote(s string) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func renderAgentManifest(values agentManifestValues) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := agentManifestTemplate.Execute(&buf, values); err != nil {
+		return nil, fmt.Errorf("unable to render agent manifest: %v", err)
+	}
+	return buf.Bytes(), nil
+}
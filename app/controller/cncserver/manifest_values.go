@@ -0,0 +1,269 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"gopkg.in/yaml.v3"
+)
+
+// HelmValuesKeys are the paths in the agent Helm chart's values under
+// which a generated values snippet places each setting.  Each is a
+// dot-separated list of keys, so "controller.port" becomes a port key
+// within a controller map.  Zero values use the defaults.
+type HelmValuesKeys struct {
+	AgentName          string `yaml:"agentName,omitempty"`
+	ControllerHostname string `yaml:"controllerHostname,omitempty"`
+	ControllerPort     string `yaml:"controllerPort,omitempty"`
+	Certificate        string `yaml:"certificate,omitempty"`
+	Key                string `yaml:"key,omitempty"`
+	CACert             string `yaml:"caCert,omitempty"`
+}
+
+func (k HelmValuesKeys) withDefaults() HelmValuesKeys {
+	setDefault(&k.AgentName, "agent.name")
+	setDefault(&k.ControllerHostname, "controller.hostname")
+	setDefault(&k.ControllerPort, "controller.port")
+	setDefault(&k.Certificate, "agent.tls.certificate")
+	setDefault(&k.Key, "agent.tls.key")
+	setDefault(&k.CACert, "agent.tls.caCert")
+	return k
+}
+
+// Validate checks that each path, with the defaults filled in, is well
+// formed and that no value would be placed inside another.
+func (k HelmValuesKeys) Validate() error {
+	k = k.withDefaults()
+	paths := []struct {
+		name string
+		path string
+	}{
+		{"agentName", k.AgentName},
+		{"controllerHostname", k.ControllerHostname},
+		{"controllerPort", k.ControllerPort},
+		{"certificate", k.Certificate},
+		{"key", k.Key},
+		{"caCert", k.CACert},
+	}
+	for i, p := range paths {
+		for _, key := range strings.Split(p.path, ".") {
+			if key == "" {
+				return fmt.Errorf("%s: '%s' has an empty key", p.name, p.path)
+			}
+		}
+		for _, other := range paths[:i] {
+			if p.path == other.path || strings.HasPrefix(p.path, other.path+".") || strings.HasPrefix(other.path, p.path+".") {
+				return fmt.Errorf("%s: '%s' conflicts with %s '%s'", p.name, p.path, other.name, other.path)
+			}
+		}
+	}
+	return nil
+}
+
+// KustomizeKeys control the secretGenerator a generated kustomization
+// snippet holds.  The Secret is named SecretNamePrefix followed by the
+// agent name, and holds the agent's certificate, key, and the CA
+// certificate under the keys given.  Behavior is the generator's
+// behavior, and is left out if empty, so the Secret is created; "replace"
+// overrides one a base already defines.  Zero values use the defaults,
+// which match the Secret in the yaml format's manifest.
+type KustomizeKeys struct {
+	SecretNamePrefix string `yaml:"secretNamePrefix,omitempty"`
+	Behavior         string `yaml:"behavior,omitempty"`
+	Certificate      string `yaml:"certificate,omitempty"`
+	Key              string `yaml:"key,omitempty"`
+	CACert           string `yaml:"caCert,omitempty"`
+}
+
+func (k KustomizeKeys) withDefaults() KustomizeKeys {
+	setDefault(&k.SecretNamePrefix, "forwarder-agent-")
+	setDefault(&k.Certificate, "tls.crt")
+	setDefault(&k.Key, "tls.key")
+	setDefault(&k.CACert, "ca.pem")
+	return k
+}
+
+// secretKeyRegexp matches the keys allowed in a Secret's data.
+var secretKeyRegexp = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// Validate checks the behavior, and that the keys, with the defaults
+// filled in, are distinct keys a Secret may hold.
+func (k KustomizeKeys) Validate() error {
+	k = k.withDefaults()
+	switch k.Behavior {
+	case "", "create", "merge", "replace":
+	default:
+		return fmt.Errorf("behavior: unknown behavior '%s', must be create, merge, or replace", k.Behavior)
+	}
+	if !fwdapi.KubernetesNameValid(k.SecretNamePrefix + "x") {
+		return fmt.Errorf("secretNamePrefix: '%s' cannot begin a Kubernetes name", k.SecretNamePrefix)
+	}
+	keys := []struct {
+		name string
+		key  string
+	}{
+		{"certificate", k.Certificate},
+		{"key", k.Key},
+		{"caCert", k.CACert},
+	}
+	for i, key := range keys {
+		if !secretKeyRegexp.MatchString(key.key) {
+			return fmt.Errorf("%s: '%s' is not a valid Secret key", key.name, key.key)
+		}
+		for _, other := range keys[:i] {
+			if key.key == other.key {
+				return fmt.Errorf("%s: '%s' is also used for %s", key.name, key.key, other.name)
+			}
+		}
+	}
+	return nil
+}
+
+func setDefault(s *string, value string) {
+	if *s == "" {
+		*s = value
+	}
+}
+
+// encodeYAML renders v as a YAML document indented as kubectl does.
+func encodeYAML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setValue sets the value at a dotted path in values, creating maps as
+// needed.
+func setValue(values map[string]interface{}, path string, value interface{}) error {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, found := values[key]
+		if !found {
+			next = map[string]interface{}{}
+			values[key] = next
+		}
+		m, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("'%s' is set inside another value", path)
+		}
+		values = m
+	}
+	last := keys[len(keys)-1]
+	if _, found := values[last]; found {
+		return fmt.Errorf("'%s' is set more than once", path)
+	}
+	values[last] = value
+	return nil
+}
+
+// renderAgentHelmValues builds a values.yaml snippet for the agent's Helm
+// chart.  The certificates and key are left base64 encoded, as a chart
+// places them in a Secret's data.
+func renderAgentHelmValues(keys HelmValuesKeys, components fwdapi.ManifestResponse) ([]byte, error) {
+	keys = keys.withDefaults()
+	values := map[string]interface{}{}
+	for _, v := range []struct {
+		path  string
+		value interface{}
+	}{
+		{keys.AgentName, components.AgentName},
+		{keys.ControllerHostname, components.ServerHostname},
+		{keys.ControllerPort, components.ServerPort},
+		{keys.Certificate, components.AgentCertificate},
+		{keys.Key, components.AgentKey},
+		{keys.CACert, components.CACert},
+	} {
+		if err := setValue(values, v.path, v.value); err != nil {
+			return nil, fmt.Errorf("unable to render helm values: %v", err)
+		}
+	}
+	ret, err := encodeYAML(values)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render helm values: %v", err)
+	}
+	return ret, nil
+}
+
+// kustomization is the part of a kustomization.yaml a generated snippet
+// holds.
+type kustomization struct {
+	SecretGenerator []secretGenerator `yaml:"secretGenerator"`
+}
+
+type secretGenerator struct {
+	Name      string                 `yaml:"name"`
+	Namespace string                 `yaml:"namespace"`
+	Behavior  string                 `yaml:"behavior,omitempty"`
+	Type      string                 `yaml:"type"`
+	Literals  []string               `yaml:"literals"`
+	Options   secretGeneratorOptions `yaml:"options"`
+}
+
+type secretGeneratorOptions struct {
+	DisableNameSuffixHash bool `yaml:"disableNameSuffixHash"`
+}
+
+// renderAgentKustomization builds a kustomization snippet whose
+// secretGenerator holds the agent's credentials.  Literals are encoded by
+// kustomize, so the PEM blocks are decoded first.  The name hash suffix
+// is disabled so the agent's Deployment can name the Secret.
+func renderAgentKustomization(keys KustomizeKeys, namespace string, components fwdapi.ManifestResponse) ([]byte, error) {
+	keys = keys.withDefaults()
+	var literals []string
+	for _, v := range []struct {
+		key   string
+		value string
+	}{
+		{keys.Certificate, components.AgentCertificate},
+		{keys.Key, components.AgentKey},
+		{keys.CACert, components.CACert},
+	} {
+		decoded, err := base64.StdEncoding.DecodeString(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render kustomization: %s: %v", v.key, err)
+		}
+		literals = append(literals, v.key+"="+string(decoded))
+	}
+	doc := kustomization{
+		SecretGenerator: []secretGenerator{{
+			Name:      keys.SecretNamePrefix + components.AgentName,
+			Namespace: namespace,
+			Behavior:  keys.Behavior,
+			Type:      "Opaque",
+			Literals:  literals,
+			Options:   secretGeneratorOptions{DisableNameSuffixHash: true},
+		}},
+	}
+	ret, err := encodeYAML(doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render kustomization: %v", err)
+	}
+	return ret, nil
+}
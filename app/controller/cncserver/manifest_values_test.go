@@ -0,0 +1,185 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+// testManifestComponents returns what the handler would render for the
+// agent smith, with pemAuthority's certificates and mockConfig's address.
+func testManifestComponents() fwdapi.ManifestResponse {
+	ca64, user64, key64, _ := (&pemAuthority{}).GenerateCertificate(ca.CertificateName{}, "", 0)
+	return fwdapi.ManifestResponse{
+		AgentName:        "smith",
+		ServerHostname:   "agent.local",
+		ServerPort:       1234,
+		AgentCertificate: user64,
+		AgentKey:         key64,
+		CACert:           ca64,
+	}
+}
+
+func checkGolden(t *testing.T, golden string, got []byte) {
+	path := filepath.Join("testdata", golden)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("rendered document does not match %s:\n%s", path, got)
+	}
+}
+
+func TestRenderAgentHelmValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		golden string
+		keys   HelmValuesKeys
+	}{
+		{"defaults", "agent-helm-values.yaml", HelmValuesKeys{}},
+		{
+			"configured",
+			"agent-helm-values-configured.yaml",
+			HelmValuesKeys{
+				ControllerHostname: "forwarder.controllerHost",
+				ControllerPort:     "forwarder.controllerPort",
+				Certificate:        "secrets.cert",
+				Key:                "secrets.key",
+				CACert:             "secrets.ca",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderAgentHelmValues(tt.keys, testManifestComponents())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkGolden(t, tt.golden, got)
+		})
+	}
+
+	t.Run("conflicting keys", func(t *testing.T) {
+		_, err := renderAgentHelmValues(HelmValuesKeys{Key: "agent.tls"}, testManifestComponents())
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func TestRenderAgentKustomization(t *testing.T) {
+	tests := []struct {
+		name      string
+		golden    string
+		keys      KustomizeKeys
+		namespace string
+	}{
+		{"defaults", "agent-kustomization.yaml", KustomizeKeys{}, "default"},
+		{
+			"configured",
+			"agent-kustomization-configured.yaml",
+			KustomizeKeys{SecretNamePrefix: "agent-", Behavior: "replace", Certificate: "cert.pem", Key: "key.pem"},
+			"agents",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderAgentKustomization(tt.keys, tt.namespace, testManifestComponents())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkGolden(t, tt.golden, got)
+		})
+	}
+
+	t.Run("not base64", func(t *testing.T) {
+		components := testManifestComponents()
+		components.AgentKey = "not base64!"
+		if _, err := renderAgentKustomization(KustomizeKeys{}, "default", components); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func TestHelmValuesKeys_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    HelmValuesKeys
+		wantErr string
+	}{
+		{"defaults", HelmValuesKeys{}, ""},
+		{"single key", HelmValuesKeys{AgentName: "agentName"}, ""},
+		{"empty key", HelmValuesKeys{Certificate: "agent..cert"}, "certificate: 'agent..cert' has an empty key"},
+		{"duplicate", HelmValuesKeys{Key: "agent.tls.certificate"}, "key: 'agent.tls.certificate' conflicts with certificate"},
+		{"inside another", HelmValuesKeys{AgentName: "controller.hostname.name"}, "controllerHostname: 'controller.hostname' conflicts with agentName"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.keys.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKustomizeKeys_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    KustomizeKeys
+		wantErr string
+	}{
+		{"defaults", KustomizeKeys{}, ""},
+		{"replace", KustomizeKeys{Behavior: "replace"}, ""},
+		{"bad behavior", KustomizeKeys{Behavior: "upsert"}, "behavior: unknown behavior 'upsert'"},
+		{"bad prefix", KustomizeKeys{SecretNamePrefix: "Agent_"}, "secretNamePrefix: 'Agent_' cannot begin"},
+		{"bad key", KustomizeKeys{Key: "tls key"}, "key: 'tls key' is not a valid Secret key"},
+		{"duplicate", KustomizeKeys{CACert: "tls.crt"}, "caCert: 'tls.crt' is also used for certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.keys.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
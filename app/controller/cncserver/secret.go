@@ -0,0 +1,75 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+// serviceSecret is a Kubernetes Secret holding service credentials.
+type serviceSecret struct {
+	APIVersion string                `yaml:"apiVersion"`
+	Kind       string                `yaml:"kind"`
+	Metadata   serviceSecretMetadata `yaml:"metadata"`
+	Type       string                `yaml:"type"`
+	Data       map[string]string     `yaml:"data"`
+}
+
+type serviceSecretMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+// renderServiceSecret builds a Secret holding the credential, the service
+// URL, and the CA certificate.  Every value is base64 encoded under data,
+// as the CA certificate already is, so tokens and names need no escaping.
+func renderServiceSecret(name string, namespace string, components fwdapi.ServiceCredentialResponse) ([]byte, error) {
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	data := map[string]string{
+		"url":    encode(components.URL),
+		"ca.pem": components.CACert,
+	}
+	switch creds := components.Credential.(type) {
+	case fwdapi.BasicCredentialResponse:
+		data["username"] = encode(creds.Username)
+		data["password"] = encode(creds.Password)
+	case fwdapi.AwsCredentialResponse:
+		data["awsAccessKey"] = encode(creds.AwsAccessKey)
+		data["awsSecretAccessKey"] = encode(creds.AwsSecretAccessKey)
+		data["awsSessionToken"] = encode(creds.AwsSessionToken)
+	default:
+		return nil, fmt.Errorf("unable to render secret for credential type '%s'", components.CredentialType)
+	}
+
+	secret := serviceSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   serviceSecretMetadata{Name: name, Namespace: namespace},
+		Type:       "Opaque",
+		Data:       data,
+	}
+	ret, err := encodeYAML(secret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render secret: %v", err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncserver
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestRenderServiceSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		golden     string
+		components fwdapi.ServiceCredentialResponse
+	}{
+		{
+			"basic",
+			"service-secret-basic.yaml",
+			fwdapi.ServiceCredentialResponse{
+				URL:            "https://service.local",
+				CACert:         "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCg==",
+				CredentialType: "basic",
+				Credential: fwdapi.BasicCredentialResponse{
+					Username: "jenkins1.agent1",
+					Password: "eyJhbGciOiJIUzI1NiJ9.e30.sig: #\"'\n",
+				},
+			},
+		},
+		{
+			"aws",
+			"service-secret-aws.yaml",
+			fwdapi.ServiceCredentialResponse{
+				URL:            "https://service.local",
+				CACert:         "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0tCg==",
+				CredentialType: "aws",
+				Credential: fwdapi.AwsCredentialResponse{
+					AwsAccessKey:       "s3.agent1",
+					AwsSecretAccessKey: "token",
+					AwsSessionToken:    "token",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderServiceSecret("forwarder-service-agent1-"+tt.name, "spinnaker", tt.components)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			path := filepath.Join("testdata", tt.golden)
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("rendered secret does not match %s:\n%s", path, got)
+			}
+		})
+	}
+
+	t.Run("unknown credential", func(t *testing.T) {
+		if _, err := renderServiceSecret("name", "ns", fwdapi.ServiceCredentialResponse{CredentialType: "other"}); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// complianceUpstream responds with the status in the query, a body if one
+// is allowed, and CORS headers answering any preflight headers sent.
+func complianceUpstream(w http.ResponseWriter, r *http.Request) {
+	status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Upstream-Method", r.Method)
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", "5")
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte("hello"))
+}
+
+// startComplianceAgent connects an agent which runs each request against
+// upstream, and relays the response as an older agent did: whatever body
+// the upstream client returns is sent in chunks, and a response which may
+// not have one gets a stray chunk anyway, which must not reach the client.
+func startComplianceAgent(upstream string) (*agent.DirectlyConnectedAgent, chan string) {
+	state := &agent.DirectlyConnectedAgent{
+		Name:            "agent1",
+		Session:         "session1",
+		Endpoints:       []agent.Endpoint{{Name: "ep1", Type: "jenkins", Configured: true}},
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 100),
+	}
+	send := func(msg *HTTPMessage, body []byte) {
+		msg.Out <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{
+				HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: msg.Cmd.Id, Body: body},
+			},
+		}
+	}
+	relay := func(msg *HTTPMessage) {
+		req, err := http.NewRequest(msg.Cmd.Method, upstream+msg.Cmd.URI, nil)
+		if err != nil {
+			panic(err)
+		}
+		for _, h := range msg.Cmd.Headers {
+			req.Header[h.Name] = h.Values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		defer resp.Body.Close()
+		headers := []*tunnel.HttpHeader{}
+		for name, values := range resp.Header {
+			headers = append(headers, &tunnel.HttpHeader{Name: name, Values: values})
+		}
+		msg.Out <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+				HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: int32(resp.StatusCode), ContentLength: resp.ContentLength, Headers: headers},
+			},
+		}
+		if resp.ContentLength == 0 {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if len(body) > 0 {
+			send(msg, body)
+		}
+		if !tunnel.ResponseHasBody(msg.Cmd.Method, resp.StatusCode) {
+			send(msg, []byte("stray"))
+		}
+		send(msg, []byte{})
+	}
+	go func() {
+		for m := range state.InRequest {
+			if msg, ok := m.(*HTTPMessage); ok {
+				go relay(msg)
+			}
+		}
+	}()
+	agents.AddAgent(state)
+	return state, state.InCancelRequest
+}
+
+// bodyWriteRecorder records whether the handler tried to write a body.
+type bodyWriteRecorder struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *bodyWriteRecorder) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.wrote = true
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *bodyWriteRecorder) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+type complianceResult struct {
+	status int
+	header http.Header
+	body   string
+}
+
+func doComplianceRequest(t *testing.T, base string, method string, uri string) complianceResult {
+	t.Helper()
+	req, err := http.NewRequest(method, base+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://ui.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-Custom")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	header := resp.Header.Clone()
+	header.Del("Date")
+	return complianceResult{status: resp.StatusCode, header: header, body: string(body)}
+}
+
+// TestRunAPIHandler_compliance compares responses relayed through an agent
+// with those from httputil.ReverseProxy, for a matrix of methods and
+// statuses.
+func TestRunAPIHandler_compliance(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	upstream := httptest.NewServer(http.HandlerFunc(complianceUpstream))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := httptest.NewServer(httputil.NewSingleHostReverseProxy(upstreamURL))
+	defer baseline.Close()
+
+	state, cancelled := startComplianceAgent(upstream.URL)
+	defer func() { _ = agents.RemoveAgent(state) }()
+	ep := agent.Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "ep1"}
+	wroteBody := make(chan bool, 1)
+	tunnelled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &bodyWriteRecorder{ResponseWriter: w}
+		runAPIHandler(ep, recorder, r)
+		wroteBody <- recorder.wrote
+	}))
+	defer tunnelled.Close()
+
+	methods := []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}
+	statuses := []int{200, 201, 204, 304, 404, 500}
+	for _, method := range methods {
+		for _, status := range statuses {
+			t.Run(fmt.Sprintf("%s %d", method, status), func(t *testing.T) {
+				uri := fmt.Sprintf("/job/test?status=%d", status)
+				want := doComplianceRequest(t, baseline.URL, method, uri)
+				got := doComplianceRequest(t, tunnelled.URL, method, uri)
+				if got.status != want.status {
+					t.Errorf("status = %d, want %d", got.status, want.status)
+				}
+				if got.body != want.body {
+					t.Errorf("body = %q, want %q", got.body, want.body)
+				}
+				if !reflect.DeepEqual(got.header, want.header) {
+					t.Errorf("headers differ:\n got  %v\n want %v", got.header, want.header)
+				}
+				if <-wroteBody && !tunnel.ResponseHasBody(method, status) {
+					t.Errorf("tried to write a body which is not allowed")
+				}
+				select {
+				case id := <-cancelled:
+					t.Errorf("request %s was cancelled", id)
+				default:
+				}
+			})
+		}
+	}
+}
@@ -20,42 +20,539 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/app/controller/cncserver"
 	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/util"
+	"github.com/opsmx/oes-birger/pkg/webhook"
 )
 
 // ControllerConfig holds all the configuration for the controller.  The
 // configuration file is loaded from disk first, and then any
 // environment variables are applied.
 type ControllerConfig struct {
-	Agents                  map[string]*agentConfig `yaml:"agents,omitempty"`
-	ServiceAuth             serviceAuthConfig       `yaml:"serviceAuth,omitempty"`
-	Webhook                 string                  `yaml:"webhook,omitempty"`
-	ServerNames             []string                `yaml:"serverNames,omitempty"`
-	CAConfig                ca.Config               `yaml:"caConfig,omitempty"`
-	PrometheusListenPort    uint16                  `yaml:"prometheusListenPort"`
-	ServiceHostname         *string                 `yaml:"serviceHostname"`
-	ServiceListenPort       uint16                  `yaml:"serviceListenPort"`
-	ControlHostname         *string                 `yaml:"controlHostname"`
-	ControlListenPort       uint16                  `yaml:"controlListenPort"`
-	AgentHostname           *string                 `yaml:"agentHostname"`
-	AgentListenPort         uint16                  `yaml:"agentListenPort"`
-	AgentAdvertisePort      uint16                  `yaml:"agentAdvertisePort"`
-	RemoteCommandHostname   *string                 `yaml:"remoteCommandHostname"`
-	RemoteCommandListenPort uint16                  `yaml:"remoteCommandListenPort"`
+	Agents                  map[string]*agentConfig  `yaml:"agents,omitempty"`
+	ServiceAuth             serviceAuthConfig        `yaml:"serviceAuth,omitempty"`
+	Webhook                 string                   `yaml:"webhook,omitempty"`
+	WebhookDelivery         webhook.Config           `yaml:"webhookDelivery,omitempty"`
+	ServerNames             []string                 `yaml:"serverNames,omitempty"`
+	CAConfig                ca.Config                `yaml:"caConfig,omitempty"`
+	ExternalPKI             *ca.ExternalConfig       `yaml:"externalPKI,omitempty"`
+	PrometheusListenPort    uint16                   `yaml:"prometheusListenPort"`
+	EnableDebugEndpoints    bool                     `yaml:"enableDebugEndpoints,omitempty"`
+	DebugRequireControlCert bool                     `yaml:"debugRequireControlCert,omitempty"`
+	ServiceHostname         *string                  `yaml:"serviceHostname"`
+	ServiceListenPort       uint16                   `yaml:"serviceListenPort"`
+	ControlHostname         *string                  `yaml:"controlHostname"`
+	ControlListenPort       uint16                   `yaml:"controlListenPort"`
+	AgentHostname           *string                  `yaml:"agentHostname"`
+	AgentListenPort         uint16                   `yaml:"agentListenPort"`
+	AgentAdvertisePort      uint16                   `yaml:"agentAdvertisePort"`
+	RemoteCommandHostname   *string                  `yaml:"remoteCommandHostname"`
+	RemoteCommandListenPort uint16                   `yaml:"remoteCommandListenPort"`
+	ShutdownGracePeriod     int                      `yaml:"shutdownGracePeriod"`
+	Timeouts                timeoutConfig            `yaml:"timeouts,omitempty"`
+	EndpointTimeouts        map[string]timeoutConfig `yaml:"endpointTimeouts,omitempty"`
+	AgentManifest           agentManifestConfig      `yaml:"agentManifest,omitempty"`
+	ServiceSecret           serviceSecretConfig      `yaml:"serviceSecret,omitempty"`
+	SelectionStrategy       string                   `yaml:"selectionStrategy,omitempty"`
+	DuplicateAgentPolicy    string                   `yaml:"duplicateAgentPolicy,omitempty"`
+	ForwardedHeaders        forwardedHeadersConfig   `yaml:"forwardedHeaders,omitempty"`
+	MaxRequestBodyBytes     int64                    `yaml:"maxRequestBodyBytes,omitempty"`
+	RequestLimits           requestLimits            `yaml:"requestLimits,omitempty"`
+	ResponseHeaderLimits    responseHeaderLimits     `yaml:"responseHeaderLimits,omitempty"`
+	ResponseBuffer          responseBufferConfig     `yaml:"responseBuffer,omitempty"`
+	PeerListenPort          uint16                   `yaml:"peerListenPort,omitempty"`
+	Peers                   []peerConfig             `yaml:"peers,omitempty"`
+	Metrics                 metricsConfig            `yaml:"metrics,omitempty"`
+	Keepalive               keepaliveConfig          `yaml:"keepalive,omitempty"`
+	Audit                   auditConfig              `yaml:"audit,omitempty"`
+	AccessLog               accessLogConfig          `yaml:"accessLog,omitempty"`
+	AgentPathRouting        bool                     `yaml:"agentPathRouting,omitempty"`
+	RateLimits              rateLimitConfig          `yaml:"rateLimits,omitempty"`
+	SessionAffinity         sessionAffinityConfig    `yaml:"sessionAffinity,omitempty"`
+	TLS                     util.TLSConfig           `yaml:"tls,omitempty"`
+	HTTPServer              httpServerConfig         `yaml:"httpServer,omitempty"`
+	ControlCredentials      controlCredentialsConfig `yaml:"controlCredentials,omitempty"`
+	LegacyStatistics        bool                     `yaml:"legacyStatistics,omitempty"`
+	RedactHeaders           []string                 `yaml:"redactHeaders,omitempty"`
 }
 
-type agentConfig struct {
+// controlCredentialsConfig limits which control certificates may be issued
+// through the control API, and to whom.  If Allow is empty, any control
+// certificate may request one with any name.  Otherwise a request is
+// allowed only if an entry's Requester matches the name of the requesting
+// certificate, and one of its Names matches the name asked for.  Both are
+// patterns as for path.Match, so "*" matches any name.
+type controlCredentialsConfig struct {
+	Allow []controlCredentialRule `yaml:"allow,omitempty"`
+}
+
+type controlCredentialRule struct {
+	Requester string   `yaml:"requester"`
+	Names     []string `yaml:"names"`
+}
+
+func (c *controlCredentialsConfig) validate(problems *validationError) {
+	for i, rule := range c.Allow {
+		if rule.Requester == "" || len(rule.Names) == 0 {
+			problems.add("controlCredentials.allow[%d]: requester and names must be set", i)
+		}
+		for _, pattern := range append([]string{rule.Requester}, rule.Names...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				problems.add("controlCredentials.allow[%d]: bad pattern '%s'", i, pattern)
+			}
+		}
+	}
+}
+
+func (c *controlCredentialsConfig) allows(requester string, name string) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, rule := range c.Allow {
+		if matched, _ := path.Match(rule.Requester, requester); !matched {
+			continue
+		}
+		for _, pattern := range rule.Names {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpServerConfig holds the timeouts, in seconds, for the controller's HTTP
+// listeners.  ReadHeaderTimeout limits how long a client may take to send
+// the request headers, and IdleTimeout how long a kept-alive connection may
+// wait for its next request.  WriteTimeout limits how long a response may
+// take to write, except where responses are relayed from agents; a watch
+// may run indefinitely, so there it limits each write instead.  Zero uses
+// the default, and a negative value disables the timeout.
+type httpServerConfig struct {
+	ReadHeaderTimeout int `yaml:"readHeaderTimeout,omitempty"`
+	IdleTimeout       int `yaml:"idleTimeout,omitempty"`
+	WriteTimeout      int `yaml:"writeTimeout,omitempty"`
+}
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultHTTPIdleTimeout   = 120 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+)
+
+// requestLimits caps the URI and headers of a service API request, which
+// are copied into the request sent to the agent.  MaxURIBytes is the length
+// of the request URI, MaxHeaderBytes the size of any one header line, and
+// MaxTotalHeaderBytes the size of all of them, as they would be written.  A
+// request over the URI limit is refused with a 414, and one over a header
+// limit with a 431.  Zero uses the default.
+type requestLimits struct {
+	MaxURIBytes         int `yaml:"maxURIBytes,omitempty"`
+	MaxHeaderBytes      int `yaml:"maxHeaderBytes,omitempty"`
+	MaxTotalHeaderBytes int `yaml:"maxTotalHeaderBytes,omitempty"`
+}
+
+const (
+	defaultMaxRequestURIBytes         = 8 * 1024
+	defaultMaxRequestHeaderBytes      = 8 * 1024
+	defaultMaxRequestTotalHeaderBytes = 64 * 1024
+)
+
+// responseHeaderLimits caps the headers of a response relayed from an
+// agent.  MaxBytes is the total size of the headers as they would be
+// written, and MaxCount the number of header lines.  A response over either
+// limit is replaced by a 502 error.  Zero uses the default.
+type responseHeaderLimits struct {
+	MaxBytes int `yaml:"maxBytes,omitempty"`
+	MaxCount int `yaml:"maxCount,omitempty"`
+}
+
+const (
+	defaultMaxResponseHeaderBytes = 64 * 1024
+	defaultMaxResponseHeaders     = 100
+)
+
+// responseBufferConfig bounds how much of each response may wait for a
+// client reading it more slowly than the agent sends it.  Once PauseBytes
+// of its body are waiting, agents which allow it are asked to pause the
+// response until half as much is left.  A response with more than
+// MaxBytes, or more than MaxChunks messages, waiting is cancelled, as
+// agents which cannot be paused keep sending.  They default to 1 MiB,
+// 16 MiB, and 1024.
+type responseBufferConfig struct {
+	PauseBytes int64 `yaml:"pauseBytes,omitempty"`
+	MaxBytes   int64 `yaml:"maxBytes,omitempty"`
+	MaxChunks  int   `yaml:"maxChunks,omitempty"`
+}
+
+// GetPauseBytes returns how much may wait before a response is paused,
+// with the default filled in.
+func (c responseBufferConfig) GetPauseBytes() int64 {
+	if c.PauseBytes <= 0 {
+		return 1024 * 1024
+	}
+	return c.PauseBytes
+}
+
+// GetMaxBytes returns how much may wait before a response is cancelled,
+// with the default filled in.
+func (c responseBufferConfig) GetMaxBytes() int64 {
+	if c.MaxBytes <= 0 {
+		return 16 * 1024 * 1024
+	}
+	return c.MaxBytes
+}
+
+// GetMaxChunks returns how many messages may wait before a response is
+// cancelled, with the default filled in.
+func (c responseBufferConfig) GetMaxChunks() int {
+	if c.MaxChunks <= 0 {
+		return 1024
+	}
+	return c.MaxChunks
+}
+
+func (c responseBufferConfig) validate(problems *validationError) {
+	if c.PauseBytes < 0 || c.MaxBytes < 0 || c.MaxChunks < 0 {
+		problems.add("responseBuffer: pauseBytes, maxBytes, and maxChunks cannot be negative")
+		return
+	}
+	if c.GetPauseBytes() > c.GetMaxBytes() {
+		problems.add("responseBuffer: pauseBytes (%d) is more than maxBytes (%d)", c.GetPauseBytes(), c.GetMaxBytes())
+	}
+}
+
+// rateLimitConfig limits service API requests.  Requests made with each
+// service credential, identified by its agent, endpoint type, and endpoint
+// name, are limited to RequestsPerSecond with bursts of up to Burst, unless
+// an entry in Credentials overrides it.  MaxConcurrentPerAgent caps the
+// requests in progress to each agent, however they authenticated.
+// MaxOutstandingPerSession and MaxOutstanding cap the transactions waiting
+// on each agent session and on all of them, including those relayed for
+// peers and remote commands, and may be changed through the control API.
+// Zero disables each limit, and Burst defaults to one second's worth.
+// SessionQueueSize is how many messages may wait to be written to each
+// agent session's tunnel, and SessionSendTimeoutMs how long, in
+// milliseconds, a request waits for room in the queue before it fails
+// with 503 Service Unavailable.  They default to 64 and 2000.
+type rateLimitConfig struct {
+	RequestsPerSecond        float64               `yaml:"requestsPerSecond,omitempty"`
+	Burst                    int                   `yaml:"burst,omitempty"`
+	Credentials              []credentialRateLimit `yaml:"credentials,omitempty"`
+	MaxConcurrentPerAgent    int                   `yaml:"maxConcurrentPerAgent,omitempty"`
+	MaxOutstandingPerSession int                   `yaml:"maxOutstandingPerSession,omitempty"`
+	MaxOutstanding           int                   `yaml:"maxOutstanding,omitempty"`
+	SessionQueueSize         int                   `yaml:"sessionQueueSize,omitempty"`
+	SessionSendTimeoutMs     int                   `yaml:"sessionSendTimeoutMs,omitempty"`
+}
+
+// GetSessionQueueSize returns the size of each agent session's queue,
+// with the default filled in.
+func (c rateLimitConfig) GetSessionQueueSize() int {
+	if c.SessionQueueSize <= 0 {
+		return 64
+	}
+	return c.SessionQueueSize
+}
+
+// GetSessionSendTimeout returns how long to wait for room in an agent
+// session's queue, with the default filled in.
+func (c rateLimitConfig) GetSessionSendTimeout() time.Duration {
+	if c.SessionSendTimeoutMs <= 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(c.SessionSendTimeoutMs) * time.Millisecond
+}
+
+// sessionAffinityConfig binds a client to the agent session which served
+// its first request to one of Endpoints, so later requests go to the same
+// session while it is connected and has room.  A client is identified by
+// the X-Birger-Session header if it sends one, and otherwise by a signed
+// cookie set on its first response.  Each binding expires after TTL
+// seconds unused, and at most MaxEntries are kept, dropping the least
+// recently used.  They default to 600 and 10000.
+type sessionAffinityConfig struct {
+	Endpoints  []affinityEndpoint `yaml:"endpoints,omitempty"`
+	TTL        int                `yaml:"ttl,omitempty"`
+	MaxEntries int                `yaml:"maxEntries,omitempty"`
+}
+
+// affinityEndpoint enables session affinity for endpoints of Type, and
+// only the one called Name if it is set.
+type affinityEndpoint struct {
+	Type string `yaml:"type"`
 	Name string `yaml:"name,omitempty"`
 }
 
+// GetTTL returns how long an unused binding is kept, with the default
+// filled in.
+func (c sessionAffinityConfig) GetTTL() time.Duration {
+	if c.TTL <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.TTL) * time.Second
+}
+
+// GetMaxEntries returns the most bindings kept, with the default filled in.
+func (c sessionAffinityConfig) GetMaxEntries() int {
+	if c.MaxEntries <= 0 {
+		return 10000
+	}
+	return c.MaxEntries
+}
+
+func (c sessionAffinityConfig) validate(problems *validationError) {
+	for i, e := range c.Endpoints {
+		if e.Type == "" {
+			problems.add("sessionAffinity.endpoints[%d]: type must be set", i)
+		}
+	}
+	if c.TTL < 0 || c.MaxEntries < 0 {
+		problems.add("sessionAffinity: ttl and maxEntries cannot be negative")
+	}
+}
+
+// credentialRateLimit overrides the default rate limit for one credential.
+type credentialRateLimit struct {
+	Agent             string  `yaml:"agent"`
+	Type              string  `yaml:"type"`
+	Name              string  `yaml:"name"`
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	Burst             int     `yaml:"burst,omitempty"`
+}
+
+// auditConfig controls the record kept of each certificate and token issued
+// by the control API.  Records are appended to File, which is rotated once
+// it reaches MaxSizeMB, and are sent to the webhook if Webhook is set.  If
+// Strict is set, a credential whose record cannot be written is not
+// returned, and a certificate is revoked.
+type auditConfig struct {
+	File       string `yaml:"file,omitempty"`
+	MaxSizeMB  int    `yaml:"maxSizeMB,omitempty"`
+	MaxBackups int    `yaml:"maxBackups,omitempty"`
+	Webhook    bool   `yaml:"webhook,omitempty"`
+	Strict     bool   `yaml:"strict,omitempty"`
+}
+
+// accessLogConfig controls the log of each request to an agent through the
+// service port, or the control port with agentPathRouting.  It is kept
+// apart from the controller's own log, so it can be shipped on its own.
+// Entries are appended to File, or written to stdout if it is "-", which
+// is rotated once it reaches MaxSizeMB.  Format is "combined" (the
+// default) or "json".  If RedactQuery is set, query parameter values are
+// replaced in logged URIs.  Each of RedactPatterns is a regular expression
+// applied to the URI: the text matched by each of its groups, or the whole
+// match if it has none, is replaced too.
+type accessLogConfig struct {
+	File           string   `yaml:"file,omitempty"`
+	Format         string   `yaml:"format,omitempty"`
+	MaxSizeMB      int      `yaml:"maxSizeMB,omitempty"`
+	MaxBackups     int      `yaml:"maxBackups,omitempty"`
+	RedactQuery    bool     `yaml:"redactQuery,omitempty"`
+	RedactPatterns []string `yaml:"redactPatterns,omitempty"`
+}
+
+// GetFormat returns the access log format, with the default filled in.
+func (c accessLogConfig) GetFormat() string {
+	if c.Format == "" {
+		return accessLogFormatCombined
+	}
+	return c.Format
+}
+
+func (c accessLogConfig) validate(problems *validationError) {
+	switch c.Format {
+	case "", accessLogFormatCombined, accessLogFormatJSON:
+	default:
+		problems.add("accessLog.format: unknown format '%s', must be %s or %s", c.Format, accessLogFormatCombined, accessLogFormatJSON)
+	}
+	for i, p := range c.RedactPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			problems.add("accessLog.redactPatterns[%d]: %v", i, err)
+		}
+	}
+}
+
+// keepaliveConfig controls how agents which vanish without closing their
+// connection are noticed.  Times are in seconds.  An agent which sends no
+// PingRequest for MissedPings times PingInterval is disconnected, and the
+// gRPC server also sends its own keepalive pings every PingInterval on an
+// otherwise idle connection.  Agents sending gRPC keepalive pings more
+// often than MinPingInterval are disconnected.  An agent which answers
+// pings is sent one whenever it has sent nothing for IdlePingInterval, and
+// is disconnected if MissedPings of them in a row go unanswered.
+type keepaliveConfig struct {
+	PingInterval     int `yaml:"pingInterval,omitempty"`
+	MissedPings      int `yaml:"missedPings,omitempty"`
+	MinPingInterval  int `yaml:"minPingInterval,omitempty"`
+	IdlePingInterval int `yaml:"idlePingInterval,omitempty"`
+}
+
+// metricsConfig controls the labels on per-request metrics.  Endpoint names
+// are chosen by each agent's configuration, so labelling by them is opt-in
+// to keep the number of series bounded.
+type metricsConfig struct {
+	EndpointNameLabel bool `yaml:"endpointNameLabel,omitempty"`
+}
+
+// peerConfig names a peer controller to connect to by the address of its
+// peer listener.  Peers must share a CA, and each authenticates the other
+// with a control certificate.  Requests for agents not connected to this
+// controller are forwarded to a peer which has them.
+type peerConfig struct {
+	Address string `yaml:"address"`
+}
+
+// forwardedHeadersConfig controls the Via and X-Forwarded-* headers added to
+// requests sent to an agent.  Disabled adds none of them.  HideClientAddress
+// keeps the client's address from reaching the agent's services, removing any
+// X-Forwarded-For or Forwarded header the client sent as well.
+type forwardedHeadersConfig struct {
+	Disabled          bool `yaml:"disabled,omitempty"`
+	HideClientAddress bool `yaml:"hideClientAddress,omitempty"`
+}
+
+// agentManifestConfig holds the defaults used when rendering a Kubernetes
+// manifest for an agent.  Each may be overridden per request.  HelmValues
+// and Kustomize name the keys used in the helm-values and kustomize
+// formats, to match the chart or overlay they are used with.
+type agentManifestConfig struct {
+	Image     string `yaml:"image,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+
+	HelmValues cncserver.HelmValuesKeys `yaml:"helmValues,omitempty"`
+	Kustomize  cncserver.KustomizeKeys  `yaml:"kustomize,omitempty"`
+}
+
+func (c agentManifestConfig) validate(problems *validationError) {
+	if err := c.HelmValues.Validate(); err != nil {
+		problems.add("agentManifest.helmValues.%v", err)
+	}
+	if err := c.Kustomize.Validate(); err != nil {
+		problems.add("agentManifest.kustomize.%v", err)
+	}
+}
+
+// serviceSecretConfig holds the defaults used when rendering service
+// credentials as a Kubernetes Secret.  Unless a name is requested, the
+// Secret is named NamePrefix followed by "<agent>-<name>".
+type serviceSecretConfig struct {
+	NamePrefix string `yaml:"namePrefix,omitempty"`
+	Namespace  string `yaml:"namespace,omitempty"`
+}
+
+// timeoutConfig holds the timeouts, in seconds, applied to requests sent
+// through an agent.  RequestTimeout runs from when the request is sent
+// until the response header arrives.  IdleTimeout then applies between
+// body chunks, and is disabled if zero.
+type timeoutConfig struct {
+	RequestTimeout int `yaml:"requestTimeout,omitempty"`
+	IdleTimeout    int `yaml:"idleTimeout,omitempty"`
+}
+
+// agentConfig holds per-agent settings, keyed by agent name.
+// SelectionStrategy overrides the controller's default for choosing among
+// multiple connected sessions of the agent, and DuplicatePolicy overrides
+// what is done when another session connects.
+type agentConfig struct {
+	Name              string `yaml:"name,omitempty"`
+	SelectionStrategy string `yaml:"selectionStrategy,omitempty"`
+	DuplicatePolicy   string `yaml:"duplicatePolicy,omitempty"`
+}
+
+// serviceAuthConfig controls the JWTs issued for service access.  TokenTTL is
+// the default lifetime in seconds.  RequireExpiration rejects older tokens
+// which were issued without an expiry.  HeaderName is the request header
+// which may carry the token, as an alternative to a Bearer Authorization
+// header or HTTP basic auth.  Issuer names this controller, and Audience
+// the deployment, in issued tokens, and a token must match both to be
+// accepted.  AcceptLegacyTokens accepts tokens issued before tokens carried
+// an issuer and audience, logging a warning each time one is used.
+//
+// AllowAnyAgent allows tokens for fwdapi.AnyAgent, whose requests are
+// served by whichever connected agent with the endpoint has the fewest
+// requests outstanding.
+//
+// Mode is "optional" by default, where a request without acceptable
+// credentials fails with a 400.  If it is "required", such a request fails
+// with a 401 and a WWW-Authenticate header, and a client certificate which
+// is not for service access is refused outright.  Either way, a credential
+// which is found but has expired is a 401.
+//
+// The keys are read from the files in /app/secrets/serviceAuth, one key per
+// file named for its key ID, which are checked for changes every
+// ReloadInterval seconds.  If SecretName is set, they are read from the
+// items in that Kubernetes secret instead, and reloaded when it changes,
+// so replicas share the same keys.  A change which removes the current key
+// is rejected, and the keys already loaded are kept.
+//
+// DenyList is where the IDs of revoked tokens are kept.  Unless it is set,
+// tokens cannot be revoked.
 type serviceAuthConfig struct {
-	CurrentKeyName string `yaml:"currentKeyName,omitempty"`
+	CurrentKeyName     string `yaml:"currentKeyName,omitempty"`
+	TokenTTL           int64  `yaml:"tokenTTL,omitempty"`
+	RequireExpiration  bool   `yaml:"requireExpiration,omitempty"`
+	HeaderName         string `yaml:"headerName,omitempty"`
+	Issuer             string `yaml:"issuer,omitempty"`
+	Audience           string `yaml:"audience,omitempty"`
+	AcceptLegacyTokens bool   `yaml:"acceptLegacyTokens,omitempty"`
+	SecretName         string `yaml:"secretName,omitempty"`
+	SecretNamespace    string `yaml:"secretNamespace,omitempty"`
+	ReloadInterval     int64  `yaml:"reloadInterval,omitempty"`
+	Mode               string `yaml:"mode,omitempty"`
+	AllowAnyAgent      bool   `yaml:"allowAnyAgent,omitempty"`
+
+	DenyList denyListConfig `yaml:"denyList,omitempty"`
 }
 
+// denyListConfig names where the IDs of revoked service tokens are kept,
+// so revocations survive a restart.  File is a JSON file, which is checked
+// for changes every serviceAuth.reloadInterval seconds; replicas may share
+// it on a volume, but revocations made through two of them at once may
+// overwrite one another.  ConfigMapName is a Kubernetes ConfigMap instead,
+// in Namespace or the controller's own, which is watched for changes and
+// is safe for replicas to update at once.
+type denyListConfig struct {
+	File          string `yaml:"file,omitempty"`
+	ConfigMapName string `yaml:"configMapName,omitempty"`
+	Namespace     string `yaml:"namespace,omitempty"`
+}
+
+func (c denyListConfig) validate(problems *validationError) {
+	if c.File != "" && c.ConfigMapName != "" {
+		problems.add("serviceAuth.denyList: only one of file or configMapName may be set")
+	}
+	if c.Namespace != "" && c.ConfigMapName == "" {
+		problems.add("serviceAuth.denyList.namespace: set without configMapName")
+	}
+}
+
+// The service authentication modes.
+const (
+	serviceAuthOptional = "optional"
+	serviceAuthRequired = "required"
+)
+
+const (
+	defaultServiceAuthHeaderName = "X-Opsmx-Token"
+	defaultServiceTokenIssuer    = "opsmx"
+	defaultServiceTokenAudience  = "opsmx-forwarder"
+	defaultServiceKeyReload      = 30 * time.Second
+)
+
 // LoadConfig will load YAML configuration from the provided filename,
 // and then apply environment variables to override some subset of
 // available options.
@@ -65,6 +562,11 @@ func LoadConfig(f io.Reader) (*ControllerConfig, error) {
 		return nil, err
 	}
 
+	buf, err = expandEnvironment(buf, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
 	config := &ControllerConfig{}
 	err = yaml.Unmarshal(buf, config)
 	if err != nil {
@@ -77,40 +579,340 @@ func LoadConfig(f io.Reader) (*ControllerConfig, error) {
 	if config.AgentAdvertisePort == 0 {
 		config.AgentAdvertisePort = config.AgentListenPort
 	}
-	if config.AgentHostname == nil {
-		return nil, fmt.Errorf("agentHostname not set")
-	}
 
 	if config.ServiceListenPort == 0 {
 		config.ServiceListenPort = 9002
 	}
-	if config.ServiceHostname == nil {
-		return nil, fmt.Errorf("serviceHostname not set")
-	}
 
 	if config.ControlListenPort == 0 {
 		config.ControlListenPort = 9003
 	}
-	if config.ControlHostname == nil {
-		return nil, fmt.Errorf("controlHostname not set")
-	}
 
 	if config.RemoteCommandListenPort == 0 {
 		config.RemoteCommandListenPort = 9004
 	}
-	if config.RemoteCommandHostname == nil {
-		return nil, fmt.Errorf("remoteCommandHostname not set")
-	}
 
 	if config.PrometheusListenPort == 0 {
 		config.PrometheusListenPort = 9102
 	}
 
+	if config.ShutdownGracePeriod <= 0 {
+		config.ShutdownGracePeriod = 30
+	}
+
+	if config.MaxRequestBodyBytes <= 0 {
+		config.MaxRequestBodyBytes = 10 * 1024 * 1024
+	}
+
+	if config.ServiceAuth.TokenTTL <= 0 {
+		config.ServiceAuth.TokenTTL = 30 * 24 * 60 * 60
+	}
+	if config.ServiceAuth.HeaderName == "" {
+		config.ServiceAuth.HeaderName = defaultServiceAuthHeaderName
+	}
+	if config.ServiceAuth.Issuer == "" {
+		config.ServiceAuth.Issuer = defaultServiceTokenIssuer
+	}
+	if config.ServiceAuth.Audience == "" {
+		config.ServiceAuth.Audience = defaultServiceTokenAudience
+	}
+
+	if config.Timeouts.RequestTimeout <= 0 {
+		config.Timeouts.RequestTimeout = 60
+	}
+
+	if config.Keepalive.PingInterval <= 0 {
+		config.Keepalive.PingInterval = 30
+	}
+	if config.Keepalive.MissedPings <= 0 {
+		config.Keepalive.MissedPings = 3
+	}
+	if config.Keepalive.MinPingInterval <= 0 {
+		config.Keepalive.MinPingInterval = 10
+	}
+	if config.Keepalive.IdlePingInterval <= 0 {
+		config.Keepalive.IdlePingInterval = 15
+	}
+
+	if config.Audit.MaxSizeMB <= 0 {
+		config.Audit.MaxSizeMB = 100
+	}
+	if config.Audit.MaxBackups <= 0 {
+		config.Audit.MaxBackups = 5
+	}
+	if config.AccessLog.MaxSizeMB <= 0 {
+		config.AccessLog.MaxSizeMB = 100
+	}
+	if config.AccessLog.MaxBackups <= 0 {
+		config.AccessLog.MaxBackups = 5
+	}
+
+	if config.AgentManifest.Image == "" {
+		config.AgentManifest.Image = "docker.flame.org/library/forwarder-agent:latest"
+	}
+	if config.AgentManifest.Namespace == "" {
+		config.AgentManifest.Namespace = "default"
+	}
+	if config.ServiceSecret.NamePrefix == "" {
+		config.ServiceSecret.NamePrefix = "forwarder-service-"
+	}
+	if config.ServiceSecret.Namespace == "" {
+		config.ServiceSecret.Namespace = "default"
+	}
+
 	config.addAllHostnames()
 
+	// CloudEvents name the controller by its control API.
+	if config.WebhookDelivery.Source == "" && config.ControlHostname != nil {
+		config.WebhookDelivery.Source = config.GetControlURL()
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
+var environmentReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvironment replaces each ${NAME} in the configuration with the
+// value of the environment variable NAME, so secrets need not be stored
+// in the file itself.  Any other use of '$' is left alone.  It is an error
+// to reference a variable which is not set.
+func expandEnvironment(buf []byte, lookupEnv func(string) (string, bool)) ([]byte, error) {
+	missing := []string{}
+	ret := environmentReference.ReplaceAllFunc(buf, func(match []byte) []byte {
+		name := string(environmentReference.FindSubmatch(match)[1])
+		value, found := lookupEnv(name)
+		if !found {
+			missing = append(missing, name)
+			return match
+		}
+		return []byte(value)
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables referenced in config are not set: %s", strings.Join(missing, ", "))
+	}
+	return ret, nil
+}
+
+// validationError holds every problem found in the configuration, so
+// they can all be reported at once.
+type validationError struct {
+	problems []string
+}
+
+func (e *validationError) add(format string, args ...interface{}) {
+	e.problems = append(e.problems, fmt.Sprintf(format, args...))
+}
+
+func (e *validationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.problems, "\n  ")
+}
+
+// Validate checks the configuration for missing required fields and
+// values which conflict with one another.  Defaults are expected to have
+// been applied already.
+func (c *ControllerConfig) Validate() error {
+	problems := &validationError{}
+
+	for _, h := range []struct {
+		name  string
+		value *string
+	}{
+		{"agentHostname", c.AgentHostname},
+		{"serviceHostname", c.ServiceHostname},
+		{"controlHostname", c.ControlHostname},
+		{"remoteCommandHostname", c.RemoteCommandHostname},
+	} {
+		if h.value == nil || *h.value == "" {
+			problems.add("%s not set", h.name)
+		}
+	}
+	if len(c.ServerNames) == 0 {
+		problems.add("serverNames not set")
+	}
+
+	if err := c.CAConfig.Validate(); err != nil {
+		problems.add("caConfig: %v", err)
+	}
+	if c.ExternalPKI != nil {
+		if err := c.ExternalPKI.Validate(); err != nil {
+			problems.add("externalPKI: %v", err)
+		}
+		if c.CAConfig.BootstrapCA || c.CAConfig.SecretName != "" || c.CAConfig.CACertFile != "" || c.CAConfig.CAKeyFile != "" {
+			problems.add("externalPKI cannot be used with caConfig's bootstrapCA, secretName, caCertFile, or caKeyFile")
+		}
+		if len(c.Peers) > 0 && c.ExternalPKI.PeerCertFile == "" {
+			problems.add("externalPKI.peerCertFile must be set to connect to peers")
+		}
+	}
+
+	ports := map[uint16]string{}
+	for _, p := range []struct {
+		name string
+		port uint16
+	}{
+		{"agentListenPort", c.AgentListenPort},
+		{"serviceListenPort", c.ServiceListenPort},
+		{"controlListenPort", c.ControlListenPort},
+		{"remoteCommandListenPort", c.RemoteCommandListenPort},
+		{"prometheusListenPort", c.PrometheusListenPort},
+		{"peerListenPort", c.PeerListenPort},
+	} {
+		if p.port == 0 {
+			continue
+		}
+		if other, found := ports[p.port]; found {
+			problems.add("%s and %s are both set to port %d", other, p.name, p.port)
+			continue
+		}
+		ports[p.port] = p.name
+	}
+
+	if c.DebugRequireControlCert && !c.EnableDebugEndpoints {
+		problems.add("debugRequireControlCert is set, but enableDebugEndpoints is not")
+	}
+
+	if c.Webhook != "" {
+		u, err := url.Parse(c.Webhook)
+		if err != nil {
+			problems.add("webhook: %v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems.add("webhook: %s is not an absolute http or https URL", c.Webhook)
+		}
+	}
+	if err := c.WebhookDelivery.Validate(); err != nil {
+		problems.add("webhookDelivery: %v", err)
+	}
+	if c.Audit.Webhook && c.Webhook == "" {
+		problems.add("audit.webhook is set, but no webhook is configured")
+	}
+
+	for i, peer := range c.Peers {
+		if peer.Address == "" {
+			problems.add("peers[%d]: address not set", i)
+		}
+	}
+
+	c.RateLimits.validate(problems)
+	c.SessionAffinity.validate(problems)
+	c.AccessLog.validate(problems)
+	c.ControlCredentials.validate(problems)
+	c.ServiceAuth.DenyList.validate(problems)
+	c.AgentManifest.validate(problems)
+	c.ResponseBuffer.validate(problems)
+
+	switch c.ServiceAuth.Mode {
+	case "", serviceAuthOptional, serviceAuthRequired:
+	default:
+		problems.add("serviceAuth.mode: unknown mode '%s', must be %s or %s", c.ServiceAuth.Mode, serviceAuthOptional, serviceAuthRequired)
+	}
+
+	if err := c.TLS.Validate(); err != nil {
+		problems.add("tls: %v", err)
+	}
+
+	if err := util.ValidateHeaderNames(c.RedactHeaders); err != nil {
+		problems.add("redactHeaders%v", err)
+	}
+
+	if _, err := agent.ParseSelectionStrategy(c.SelectionStrategy); err != nil {
+		problems.add("%v", err)
+	}
+	if _, err := agent.ParseDuplicatePolicy(c.DuplicateAgentPolicy); err != nil {
+		problems.add("%v", err)
+	}
+	names := []string{}
+	for name := range c.Agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := c.Agents[name]
+		if a == nil {
+			continue
+		}
+		if _, err := agent.ParseSelectionStrategy(a.SelectionStrategy); err != nil {
+			problems.add("agent %s: %v", name, err)
+		}
+		if _, err := agent.ParseDuplicatePolicy(a.DuplicatePolicy); err != nil {
+			problems.add("agent %s: %v", name, err)
+		}
+	}
+
+	if len(problems.problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func (c *rateLimitConfig) validate(problems *validationError) {
+	if c.RequestsPerSecond < 0 || c.Burst < 0 {
+		problems.add("rateLimits: requestsPerSecond and burst cannot be negative")
+	}
+	if c.MaxConcurrentPerAgent < 0 {
+		problems.add("rateLimits: maxConcurrentPerAgent cannot be negative")
+	}
+	if c.MaxOutstandingPerSession < 0 || c.MaxOutstanding < 0 {
+		problems.add("rateLimits: maxOutstandingPerSession and maxOutstanding cannot be negative")
+	}
+	if c.SessionQueueSize < 0 || c.SessionSendTimeoutMs < 0 {
+		problems.add("rateLimits: sessionQueueSize and sessionSendTimeoutMs cannot be negative")
+	}
+	for i, o := range c.Credentials {
+		if o.Agent == "" || o.Type == "" || o.Name == "" {
+			problems.add("rateLimits.credentials[%d]: agent, type, and name must be set", i)
+		}
+		if o.RequestsPerSecond < 0 || o.Burst < 0 {
+			problems.add("rateLimits.credentials[%d]: requestsPerSecond and burst cannot be negative", i)
+		}
+	}
+}
+
+// configureSelectionStrategies applies the configured strategies for
+// choosing among multiple sessions of the same agent.
+func configureSelectionStrategies(c *ControllerConfig) error {
+	strategy, err := agent.ParseSelectionStrategy(c.SelectionStrategy)
+	if err != nil {
+		return err
+	}
+	agents.SetSelectionStrategy("", strategy)
+	for name, a := range c.Agents {
+		if a == nil || a.SelectionStrategy == "" {
+			continue
+		}
+		strategy, err := agent.ParseSelectionStrategy(a.SelectionStrategy)
+		if err != nil {
+			return fmt.Errorf("agent %s: %v", name, err)
+		}
+		agents.SetSelectionStrategy(name, strategy)
+	}
+	return nil
+}
+
+// configureDuplicatePolicies applies the configured policies for agents
+// which connect while another session of the same agent is connected.
+func configureDuplicatePolicies(c *ControllerConfig) error {
+	policy, err := agent.ParseDuplicatePolicy(c.DuplicateAgentPolicy)
+	if err != nil {
+		return err
+	}
+	agents.SetDuplicatePolicy("", policy)
+	for name, a := range c.Agents {
+		if a == nil || a.DuplicatePolicy == "" {
+			continue
+		}
+		policy, err := agent.ParseDuplicatePolicy(a.DuplicatePolicy)
+		if err != nil {
+			return fmt.Errorf("agent %s: %v", name, err)
+		}
+		agents.SetDuplicatePolicy(name, policy)
+	}
+	return nil
+}
+
 func (c *ControllerConfig) hasServerName(target string) bool {
 	for _, a := range c.ServerNames {
 		if a == target {
@@ -123,7 +925,7 @@ func (c *ControllerConfig) hasServerName(target string) bool {
 func (c *ControllerConfig) addIfMissing(target *string, reason string) {
 	if target != nil && !c.hasServerName(*target) {
 		c.ServerNames = append(c.ServerNames, *target)
-		log.Printf("Adding %s to ServerNames (for %s configuration setting)", *target, reason)
+		util.Infof("Adding %s to ServerNames (for %s configuration setting)", *target, reason)
 	}
 }
 
@@ -160,23 +962,272 @@ func (c *ControllerConfig) GetControlListenPort() uint16 {
 	return c.ControlListenPort
 }
 
+// GetShutdownGracePeriod returns how long in-flight requests are given to
+// complete when the controller is shutting down.
+func (c *ControllerConfig) GetShutdownGracePeriod() time.Duration {
+	return time.Duration(c.ShutdownGracePeriod) * time.Second
+}
+
+// GetAgentPingInterval returns how often agents are expected to ping.
+func (c *ControllerConfig) GetAgentPingInterval() time.Duration {
+	return time.Duration(c.Keepalive.PingInterval) * time.Second
+}
+
+// GetAgentIdlePingInterval returns how long an agent may send nothing
+// before the controller pings it.
+func (c *ControllerConfig) GetAgentIdlePingInterval() time.Duration {
+	if c.Keepalive.IdlePingInterval <= 0 {
+		return c.GetAgentPingInterval()
+	}
+	return time.Duration(c.Keepalive.IdlePingInterval) * time.Second
+}
+
+// GetAgentLivenessTimeout returns how long an agent may go without pinging
+// before it is disconnected.
+func (c *ControllerConfig) GetAgentLivenessTimeout() time.Duration {
+	return time.Duration(c.Keepalive.MissedPings) * c.GetAgentPingInterval()
+}
+
+// GetServiceTokenTTL returns the default lifetime of issued service tokens.
+func (c *ControllerConfig) GetServiceTokenTTL() time.Duration {
+	return time.Duration(c.ServiceAuth.TokenTTL) * time.Second
+}
+
+// GetServiceAuthHeaderName returns the header which may carry a service token.
+func (c *ControllerConfig) GetServiceAuthHeaderName() string {
+	if c.ServiceAuth.HeaderName == "" {
+		return defaultServiceAuthHeaderName
+	}
+	return c.ServiceAuth.HeaderName
+}
+
+// GetServiceAuthRequired returns true if every service request must carry
+// acceptable credentials, and is refused with a 401 otherwise.
+func (c *ControllerConfig) GetServiceAuthRequired() bool {
+	return c.ServiceAuth.Mode == serviceAuthRequired
+}
+
+// GetRequestLimits returns the limits on the URI and headers of a service
+// API request, with defaults filled in.
+func (c *ControllerConfig) GetRequestLimits() requestLimits {
+	limits := c.RequestLimits
+	if limits.MaxURIBytes <= 0 {
+		limits.MaxURIBytes = defaultMaxRequestURIBytes
+	}
+	if limits.MaxHeaderBytes <= 0 {
+		limits.MaxHeaderBytes = defaultMaxRequestHeaderBytes
+	}
+	if limits.MaxTotalHeaderBytes <= 0 {
+		limits.MaxTotalHeaderBytes = defaultMaxRequestTotalHeaderBytes
+	}
+	return limits
+}
+
+// GetResponseHeaderLimits returns the maximum size and number of headers
+// in a response relayed from an agent.
+func (c *ControllerConfig) GetResponseHeaderLimits() (maxBytes int, maxCount int) {
+	maxBytes, maxCount = c.ResponseHeaderLimits.MaxBytes, c.ResponseHeaderLimits.MaxCount
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxResponseHeaderBytes
+	}
+	if maxCount <= 0 {
+		maxCount = defaultMaxResponseHeaders
+	}
+	return maxBytes, maxCount
+}
+
+// GetServiceTokenIdentity returns the issuer and audience of service tokens.
+func (c *ControllerConfig) GetServiceTokenIdentity() jwtutil.Identity {
+	id := jwtutil.Identity{Issuer: c.ServiceAuth.Issuer, Audience: c.ServiceAuth.Audience}
+	if id.Issuer == "" {
+		id.Issuer = defaultServiceTokenIssuer
+	}
+	if id.Audience == "" {
+		id.Audience = defaultServiceTokenAudience
+	}
+	return id
+}
+
+// GetServiceKeyReloadInterval returns how often the service key files are
+// checked for changes.
+func (c *ControllerConfig) GetServiceKeyReloadInterval() time.Duration {
+	if c.ServiceAuth.ReloadInterval <= 0 {
+		return defaultServiceKeyReload
+	}
+	return time.Duration(c.ServiceAuth.ReloadInterval) * time.Second
+}
+
+// GetServiceTokenValidation returns what a service token must have to be
+// accepted.
+func (c *ControllerConfig) GetServiceTokenValidation() jwtutil.Validation {
+	return jwtutil.Validation{
+		Identity:          c.GetServiceTokenIdentity(),
+		RequireExpiration: c.ServiceAuth.RequireExpiration,
+		AcceptLegacy:      c.ServiceAuth.AcceptLegacyTokens,
+	}
+}
+
+// GetAgentImage returns the default agent image used in generated manifests.
+func (c *ControllerConfig) GetAgentImage() string {
+	return c.AgentManifest.Image
+}
+
+// GetAgentNamespace returns the default namespace used in generated manifests.
+func (c *ControllerConfig) GetAgentNamespace() string {
+	return c.AgentManifest.Namespace
+}
+
+// GetAgentHelmValuesKeys returns the paths used in generated Helm values.
+func (c *ControllerConfig) GetAgentHelmValuesKeys() cncserver.HelmValuesKeys {
+	return c.AgentManifest.HelmValues
+}
+
+// GetAgentKustomizeKeys returns the names used in generated kustomizations.
+func (c *ControllerConfig) GetAgentKustomizeKeys() cncserver.KustomizeKeys {
+	return c.AgentManifest.Kustomize
+}
+
+// GetServiceSecretDefaults returns the default name prefix and namespace
+// of Secrets rendered for service credentials.
+func (c *ControllerConfig) GetServiceSecretDefaults() (namePrefix string, namespace string) {
+	return c.ServiceSecret.NamePrefix, c.ServiceSecret.Namespace
+}
+
+// GetAuditStrict returns true if credentials must not be issued unless
+// they can be audited.
+func (c *ControllerConfig) GetAuditStrict() bool {
+	return c.Audit.Strict
+}
+
+// GetAllowAnyAgent returns true if service credentials may be for any agent.
+func (c *ControllerConfig) GetAllowAnyAgent() bool {
+	return c.ServiceAuth.AllowAnyAgent
+}
+
+// GetLegacyStatistics returns true if the control API should send the
+// untyped statistics response used before it had an apiVersion, for
+// clients which have not been updated.  It will be removed in the next
+// release.
+func (c *ControllerConfig) GetLegacyStatistics() bool {
+	return c.LegacyStatistics
+}
+
+// IsControlCredentialAllowed returns true if the control certificate named
+// requester may be used to issue a control certificate named name.
+func (c *ControllerConfig) IsControlCredentialAllowed(requester string, name string) bool {
+	return c.ControlCredentials.allows(requester, name)
+}
+
+// GetTLSConfig returns the TLS versions and cipher suites to use on every
+// listener.
+func (c *ControllerConfig) GetTLSConfig() util.TLSConfig {
+	return c.TLS
+}
+
+// GetHTTPServerTimeouts returns the read header, idle, and write timeouts
+// for HTTP listeners.  A zero duration means there is no timeout.
+func (c *ControllerConfig) GetHTTPServerTimeouts() (readHeader time.Duration, idle time.Duration, write time.Duration) {
+	seconds := func(configured int, defaultValue time.Duration) time.Duration {
+		switch {
+		case configured < 0:
+			return 0
+		case configured == 0:
+			return defaultValue
+		}
+		return time.Duration(configured) * time.Second
+	}
+	return seconds(c.HTTPServer.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		seconds(c.HTTPServer.IdleTimeout, defaultHTTPIdleTimeout),
+		seconds(c.HTTPServer.WriteTimeout, defaultWriteTimeout)
+}
+
+// GetRequestTimeouts returns the request and idle timeouts to use for the
+// endpoint type, applying any per-type overrides to the global settings.
+func (c *ControllerConfig) GetRequestTimeouts(endpointType string) (request time.Duration, idle time.Duration) {
+	t := c.Timeouts
+	if override, found := c.EndpointTimeouts[endpointType]; found {
+		if override.RequestTimeout > 0 {
+			t.RequestTimeout = override.RequestTimeout
+		}
+		if override.IdleTimeout > 0 {
+			t.IdleTimeout = override.IdleTimeout
+		}
+	}
+	return time.Duration(t.RequestTimeout) * time.Second, time.Duration(t.IdleTimeout) * time.Second
+}
+
 //
 // Dump will display MOST of the controller's configuration.
 //
 func (c *ControllerConfig) Dump() {
-	log.Println("ControllerConfig:")
-	log.Printf("ServerNames:")
+	util.Infof("ControllerConfig:")
+	util.Infof("ServerNames:")
 	for _, n := range config.ServerNames {
-		log.Printf("  %s", n)
+		util.Infof("  %s", n)
 	}
-	log.Printf("Service hostname: %s, port: %d",
+	util.Infof("Service hostname: %s, port: %d",
 		*c.ServiceHostname, c.ServiceListenPort)
-	log.Printf("URL returned for kubectl components: %s",
+	util.Infof("URL returned for kubectl components: %s",
 		c.GetServiceURL())
-	log.Printf("Agent hostname: %s, port %d (advertised %d)",
+	util.Infof("Agent hostname: %s, port %d (advertised %d)",
 		*c.AgentHostname, c.AgentListenPort, c.AgentAdvertisePort)
-	log.Printf("Control hostname: %s, port %d",
+	util.Infof("Control hostname: %s, port %d",
 		*c.ControlHostname, c.ControlListenPort)
-	log.Printf("RemoteCommand hostname: %s, port %d",
+	util.Infof("RemoteCommand hostname: %s, port %d",
 		*c.RemoteCommandHostname, c.RemoteCommandListenPort)
+	util.Infof("Shutdown grace period: %s", c.GetShutdownGracePeriod())
+	id := c.GetServiceTokenIdentity()
+	util.Infof("Service token issuer: %s, audience: %s, legacy tokens accepted: %v",
+		id.Issuer, id.Audience, c.ServiceAuth.AcceptLegacyTokens)
+	util.Infof("Service authentication required: %v", c.GetServiceAuthRequired())
+	if c.ServiceAuth.SecretName != "" {
+		util.Infof("Service keys: secret %s (namespace %s)", c.ServiceAuth.SecretName, c.ServiceAuth.SecretNamespace)
+	} else {
+		util.Infof("Service keys: %s, checked every %s", serviceAuthPath, c.GetServiceKeyReloadInterval())
+	}
+	requestLimits := c.GetRequestLimits()
+	util.Infof("Request limits: URI %d bytes, header %d bytes, all headers %d bytes",
+		requestLimits.MaxURIBytes, requestLimits.MaxHeaderBytes, requestLimits.MaxTotalHeaderBytes)
+	maxHeaderBytes, maxHeaders := c.GetResponseHeaderLimits()
+	util.Infof("Response header limits: %d bytes, %d headers", maxHeaderBytes, maxHeaders)
+	readHeader, idle, write := c.GetHTTPServerTimeouts()
+	util.Infof("HTTP read header timeout: %s, idle timeout: %s, write timeout: %s",
+		readHeader, idle, write)
+	util.Infof("Agent ping interval: %s, liveness timeout: %s, idle ping interval: %s",
+		c.GetAgentPingInterval(), c.GetAgentLivenessTimeout(), c.GetAgentIdlePingInterval())
+	if c.PeerListenPort != 0 {
+		util.Infof("Peer port %d", c.PeerListenPort)
+	}
+	if c.AgentPathRouting {
+		util.Infof("Agent path routing enabled on the control port")
+	}
+	for _, peer := range c.Peers {
+		util.Infof("Peer: %s", peer.Address)
+	}
+	if c.Audit.File != "" {
+		util.Infof("Audit file: %s (strict %v)", c.Audit.File, c.Audit.Strict)
+	}
+	if c.AccessLog.File != "" {
+		util.Infof("Access log: %s (%s)", c.AccessLog.File, c.AccessLog.GetFormat())
+	}
+
+	if c.RateLimits.RequestsPerSecond > 0 || len(c.RateLimits.Credentials) > 0 {
+		util.Infof("Service rate limit: %g requests per second, burst %d, %d credential overrides",
+			c.RateLimits.RequestsPerSecond, c.RateLimits.Burst, len(c.RateLimits.Credentials))
+	}
+	if c.RateLimits.MaxConcurrentPerAgent > 0 {
+		util.Infof("Maximum concurrent requests per agent: %d", c.RateLimits.MaxConcurrentPerAgent)
+	}
+	if c.RateLimits.MaxOutstandingPerSession > 0 || c.RateLimits.MaxOutstanding > 0 {
+		util.Infof("Maximum outstanding requests: %d per session, %d in total",
+			c.RateLimits.MaxOutstandingPerSession, c.RateLimits.MaxOutstanding)
+	}
+	util.Infof("Agent session queues: %d messages, send timeout %s",
+		c.RateLimits.GetSessionQueueSize(), c.RateLimits.GetSessionSendTimeout())
+	if c.TLS.MinVersion != "" || c.TLS.MaxVersion != "" {
+		util.Infof("TLS versions: min %s, max %s", c.TLS.MinVersion, c.TLS.MaxVersion)
+	}
+	if len(c.TLS.CipherSuites) > 0 {
+		util.Infof("TLS cipher suites: %s", strings.Join(c.TLS.CipherSuites, ", "))
+	}
 }
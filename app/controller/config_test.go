@@ -0,0 +1,274 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+const minimalConfig = `
+agentHostname: agent.example.com
+serviceHostname: service.example.com
+controlHostname: control.example.com
+remoteCommandHostname: cmd.example.com
+`
+
+func TestLoadConfig_minimal(t *testing.T) {
+	c, err := LoadConfig(strings.NewReader(minimalConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.AgentListenPort != 9001 || c.ServiceListenPort != 9002 || c.ControlListenPort != 9003 {
+		t.Errorf("default ports not applied: %d %d %d", c.AgentListenPort, c.ServiceListenPort, c.ControlListenPort)
+	}
+	if len(c.ServerNames) != 4 {
+		t.Errorf("expected 4 server names, got %v", c.ServerNames)
+	}
+	if c.WebhookDelivery.Source != "https://control.example.com:9003" {
+		t.Errorf("webhook source = %q, want the control URL", c.WebhookDelivery.Source)
+	}
+}
+
+func TestLoadConfig_errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantError []string
+	}{
+		{
+			"malformed yaml",
+			"agentHostname: [",
+			[]string{"yaml"},
+		},
+		{
+			"empty",
+			"",
+			[]string{
+				"agentHostname not set",
+				"serviceHostname not set",
+				"controlHostname not set",
+				"remoteCommandHostname not set",
+				"serverNames not set",
+			},
+		},
+		{
+			"port collision",
+			minimalConfig + "serviceListenPort: 9001\nprometheusListenPort: 9003\n",
+			[]string{
+				"agentListenPort and serviceListenPort are both set to port 9001",
+				"controlListenPort and prometheusListenPort are both set to port 9003",
+			},
+		},
+		{
+			"webhook not a URL",
+			minimalConfig + "webhook: example.com/hook\n",
+			[]string{"webhook: example.com/hook is not an absolute http or https URL"},
+		},
+		{
+			"bad CA config",
+			minimalConfig + "caConfig:\n  keyType: bogus\n",
+			[]string{"caConfig: unknown key type 'bogus'"},
+		},
+		{
+			"external PKI with a CA",
+			minimalConfig + "caConfig:\n  bootstrapCA: true\nexternalPKI:\n  serverCertFile: /tls/tls.crt\n  clientCAFile: /tls/ca.crt\n",
+			[]string{
+				"externalPKI: serverKeyFile not set",
+				"externalPKI cannot be used with caConfig's bootstrapCA, secretName, caCertFile, or caKeyFile",
+			},
+		},
+		{
+			"external PKI without a peer certificate",
+			minimalConfig + "externalPKI:\n  serverCertFile: /tls/tls.crt\n  serverKeyFile: /tls/tls.key\n  clientCAFile: /tls/ca.crt\npeers:\n- address: peer.example.com:9005\n",
+			[]string{"externalPKI.peerCertFile must be set to connect to peers"},
+		},
+		{
+			"unknown webhook format",
+			minimalConfig + "webhookDelivery:\n  format: xml\n",
+			[]string{"webhookDelivery: format: unknown format 'xml', must be legacy or cloudevents"},
+		},
+		{
+			"debug certificate without debug endpoints",
+			minimalConfig + "debugRequireControlCert: true\n",
+			[]string{"debugRequireControlCert is set, but enableDebugEndpoints is not"},
+		},
+		{
+			"audit webhook without webhook",
+			minimalConfig + "audit:\n  webhook: true\n",
+			[]string{"audit.webhook is set, but no webhook is configured"},
+		},
+		{
+			"bad rate limits",
+			minimalConfig + "rateLimits:\n  requestsPerSecond: -1\n  credentials:\n  - agent: agent1\n    requestsPerSecond: 5\n",
+			[]string{
+				"rateLimits: requestsPerSecond and burst cannot be negative",
+				"rateLimits.credentials[0]: agent, type, and name must be set",
+			},
+		},
+		{
+			"bad session affinity",
+			minimalConfig + "sessionAffinity:\n  ttl: -1\n  endpoints:\n  - name: ep1\n",
+			[]string{
+				"sessionAffinity.endpoints[0]: type must be set",
+				"sessionAffinity: ttl and maxEntries cannot be negative",
+			},
+		},
+		{
+			"bad redacted header",
+			minimalConfig + "redactHeaders:\n- Authorization\n- \"X Token\"\n",
+			[]string{"redactHeaders[1]: 'X Token' is not a valid header name"},
+		},
+		{
+			"bad control credential rules",
+			minimalConfig + "controlCredentials:\n  allow:\n  - requester: admin\n  - requester: \"[\"\n    names: [\"ci-*\"]\n",
+			[]string{
+				"controlCredentials.allow[0]: requester and names must be set",
+				"controlCredentials.allow[1]: bad pattern '['",
+			},
+		},
+		{
+			"unknown service auth mode",
+			minimalConfig + "serviceAuth:\n  mode: always\n",
+			[]string{"serviceAuth.mode: unknown mode 'always', must be optional or required"},
+		},
+		{
+			"two deny lists",
+			minimalConfig + "serviceAuth:\n  denyList:\n    file: /app/revocations/tokens.json\n    configMapName: revoked-tokens\n",
+			[]string{"serviceAuth.denyList: only one of file or configMapName may be set"},
+		},
+		{
+			"deny list namespace without a configmap",
+			minimalConfig + "serviceAuth:\n  denyList:\n    namespace: ns1\n",
+			[]string{"serviceAuth.denyList.namespace: set without configMapName"},
+		},
+		{
+			"bad agent manifest keys",
+			minimalConfig + "agentManifest:\n  helmValues:\n    controllerPort: controller.hostname\n  kustomize:\n    behavior: upsert\n",
+			[]string{
+				"agentManifest.helmValues.controllerPort: 'controller.hostname' conflicts with controllerHostname",
+				"agentManifest.kustomize.behavior: unknown behavior 'upsert'",
+			},
+		},
+		{
+			"bad response buffer",
+			minimalConfig + "responseBuffer:\n  pauseBytes: 2048\n  maxBytes: 1024\n",
+			[]string{"responseBuffer: pauseBytes (2048) is more than maxBytes (1024)"},
+		},
+		{
+			"bad access log settings",
+			minimalConfig + "accessLog:\n  format: common\n  redactPatterns:\n  - \"token=(\"\n",
+			[]string{
+				"accessLog.format: unknown format 'common', must be combined or json",
+				"accessLog.redactPatterns[0]: ",
+			},
+		},
+		{
+			"bad TLS settings",
+			minimalConfig + "tls:\n  minVersion: \"1.3\"\n  maxVersion: \"1.1\"\n  cipherSuites:\n  - TLS_RSA_WITH_AES_128_CBC_SHA256\n",
+			[]string{
+				`tls: maxVersion "1.1" is not supported, use 1.2 or 1.3`,
+				`cipher suite "TLS_RSA_WITH_AES_128_CBC_SHA256" is not supported, use one of TLS_`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(strings.NewReader(tt.config))
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			for _, want := range tt.wantError {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error '%v' to contain '%s'", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandEnvironment(t *testing.T) {
+	env := map[string]string{
+		"HOOK_TOKEN": "s3cret",
+		"EMPTY":      "",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, found := env[name]
+		return v, found
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{"no references", "a: b", "a: b", ""},
+		{"reference", "webhook: https://x/?t=${HOOK_TOKEN}", "webhook: https://x/?t=s3cret", ""},
+		{"empty value", "a: '${EMPTY}'", "a: ''", ""},
+		{"bare dollar left alone", "a: $HOOK_TOKEN $", "a: $HOOK_TOKEN $", ""},
+		{"unset", "a: ${NOPE} ${NOPE2}", "", "not set: NOPE, NOPE2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnvironment([]byte(tt.in), lookupEnv)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing '%s', got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected '%s', got '%s'", tt.want, string(got))
+			}
+		})
+	}
+}
+
+func TestControlCredentialsConfig_allows(t *testing.T) {
+	open := controlCredentialsConfig{}
+	if !open.allows("anyone", "anything") {
+		t.Errorf("an empty allowlist should allow any request")
+	}
+
+	c := controlCredentialsConfig{
+		Allow: []controlCredentialRule{
+			{Requester: "admin", Names: []string{"*"}},
+			{Requester: "ci-*", Names: []string{"ci-*", "deployer"}},
+		},
+	}
+	tests := []struct {
+		requester string
+		name      string
+		want      bool
+	}{
+		{"admin", "anything", true},
+		{"ci-jenkins", "ci-runner", true},
+		{"ci-jenkins", "deployer", true},
+		{"ci-jenkins", "admin", false},
+		{"oes", "ci-runner", false},
+		{"", "ci-runner", false},
+	}
+	for _, tt := range tests {
+		if got := c.allows(tt.requester, tt.name); got != tt.want {
+			t.Errorf("allows(%q, %q) = %v, want %v", tt.requester, tt.name, got, tt.want)
+		}
+	}
+}
@@ -18,25 +18,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
-	"io/fs"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
-	"github.com/lestrrat-go/jwx/jwa"
-	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/opsmx/oes-birger/app/controller/agent"
 	"github.com/opsmx/oes-birger/app/controller/cncserver"
 	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
 	"github.com/opsmx/oes-birger/pkg/tunnel"
 	"github.com/opsmx/oes-birger/pkg/ulid"
 	"github.com/opsmx/oes-birger/pkg/util"
@@ -55,13 +56,18 @@ var (
 	version      = util.Versions{Major: 2, Minor: 2, Patch: 1, Build: versionBuild}
 
 	configFile = flag.String("configFile", "/app/config/config.yaml", "The file with the controller config")
+	logLevel   = flag.String("logLevel", "info", "The minimum level to log: debug, info, warn, or error")
+	logFormat  = flag.String("logFormat", "console", "The log format: console or json")
 
-	jwtKeyset     = jwk.NewSet()
-	jwtCurrentKey string
+	showVersion = flag.Bool("version", false, "Print the version and exit")
+
+	jwtKeyset = jwtutil.NewKeyset("")
+
+	serviceTokenDenyList = jwtutil.NewDenyList()
 
 	config *ControllerConfig
 
-	authority *ca.CA
+	authority certificateAuthority
 
 	ulidContext = ulid.NewContext()
 
@@ -70,25 +76,199 @@ var (
 	agents = agent.MakeAgents()
 
 	// metrics
+	apiMetricLabelNames = []string{"agent", "endpointType", "endpointName"}
+
 	apiRequestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "controller_api_requests_total",
 		Help: "The total numbe of API requests",
 	}, []string{"agent"})
+	apiRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "controller_api_request_duration_seconds",
+		Help:    "The time from receiving an API request until the response is complete, excluding upgraded connections",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, apiMetricLabelNames)
+	apiResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "controller_api_response_size_bytes",
+		Help:    "The size of API response bodies relayed from agents, excluding upgraded connections",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	}, apiMetricLabelNames)
+	apiRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_api_requests_in_flight",
+		Help: "The number of API requests currently being handled",
+	}, apiMetricLabelNames)
+	apiRequestTooLargeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_api_requests_too_large_total",
+		Help: "The total number of API requests rejected because the body exceeded maxRequestBodyBytes",
+	}, []string{"agent"})
+	apiRequestLimitRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_api_requests_limit_rejected_total",
+		Help: "The total number of API requests rejected because their URI or headers exceeded requestLimits",
+	}, []string{"agent", "reason"})
+	apiResponseHeadersRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_api_response_headers_rejected_total",
+		Help: "The total number of agent responses rejected because their headers exceeded responseHeaderLimits",
+	}, []string{"agent"})
+	apiRequestsRetriedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_api_requests_retried_total",
+		Help: "The total number of API requests retried on another session because the agent session was shutting down",
+	}, []string{"agent"})
+	sessionFailoverCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_session_affinity_failovers_total",
+		Help: "The total number of API requests sent to another session because the one the client was bound to could not take them",
+	}, []string{"agent"})
+	apiRequestsThrottledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_api_requests_throttled_total",
+		Help: "The total number of API requests rejected by the rate limit, the per-agent concurrency limit, the outstanding request limits, or a full agent session queue",
+	}, []string{"agent", "reason"})
+	rateLimitTokensGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_rate_limit_tokens",
+		Help: "The requests each rate limited service credential may make before being throttled",
+	}, []string{"agent", "endpointType", "endpointName"})
+	agentLastPingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_agent_last_ping_seconds",
+		Help: "The Unix time of the most recent ping from each connected agent",
+	}, []string{"agent"})
+	agentRTTGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_agent_rtt_seconds",
+		Help: "The round-trip time of the most recent ping the controller sent each connected agent",
+	}, []string{"agent"})
+	connectedAgentInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_connected_agent_info",
+		Help: "Set to 1 for each directly connected agent session, labeled with the agent's version",
+	}, []string{"agent", "session", "version"})
+	certificateRenewalsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_agent_certificate_renewals_total",
+		Help: "The total number of agent certificate renewals requested, by result: issued, revoked, or failed",
+	}, []string{"agent", "result"})
+	cancelsIssuedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_cancels_issued_total",
+		Help: "The total number of cancel requests sent to agents, excluding duplicates",
+	}, []string{"agent"})
+	cancelsAckedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_cancels_acked_total",
+		Help: "The total number of cancel requests acknowledged by agents",
+	}, []string{"agent"})
+	lateMessagesDiscardedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_late_messages_discarded_total",
+		Help: "The total number of messages from agents discarded because their request was already cancelled",
+	}, []string{"agent"})
+	grpcServerStartedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_grpc_server_started_total",
+		Help: "The total number of RPCs started on the controller's gRPC servers",
+	}, []string{"grpc_service", "grpc_method"})
+	grpcServerHandledCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_grpc_server_handled_total",
+		Help: "The total number of RPCs completed on the controller's gRPC servers, by status code",
+	}, []string{"grpc_service", "grpc_method", "grpc_code"})
+	grpcServerStreamsOpenGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_grpc_server_streams_open",
+		Help: "The number of streams currently open on the controller's gRPC servers",
+	}, []string{"grpc_service", "grpc_method"})
+	grpcServerMsgReceivedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_grpc_server_msg_received_total",
+		Help: "The total number of messages received on the controller's gRPC servers",
+	}, []string{"grpc_service", "grpc_method"})
+	grpcServerMsgSentCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_grpc_server_msg_sent_total",
+		Help: "The total number of messages sent on the controller's gRPC servers",
+	}, []string{"grpc_service", "grpc_method"})
+	serviceKeysetReloadsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_service_keyset_reloads_total",
+		Help: "The total number of times the service keys changed, by whether they were reloaded, rejected, or could not be read",
+	}, []string{"result"})
+	serviceAuthFailuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_service_auth_failures_total",
+		Help: "The total number of service requests refused because their credentials were missing or not accepted, by reason",
+	}, []string{"reason"})
+	serverCertRenewalsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_server_certificate_renewals_total",
+		Help: "The total number of attempts to renew the server certificate, by whether it was scheduled or forced, and the result",
+	}, []string{"trigger", "result"})
+	tunnelMessagesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_tunnel_messages_total",
+		Help: "The total number of messages on each agent's tunnel, by direction and message type",
+	}, []string{"agent", "direction", "type"})
+	tunnelRequestBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_tunnel_request_bytes_total",
+		Help: "The total number of HTTP request body bytes sent to each agent, by endpoint type",
+	}, []string{"agent", "endpointType"})
+	tunnelRequestChunksCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_tunnel_request_chunks_total",
+		Help: "The total number of messages carrying HTTP request body sent to each agent, by endpoint type",
+	}, []string{"agent", "endpointType"})
+	tunnelResponseBytesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_tunnel_response_bytes_total",
+		Help: "The total number of HTTP response header and body bytes received from each agent, by endpoint type",
+	}, []string{"agent", "endpointType"})
+	tunnelResponseChunksCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_tunnel_response_chunks_total",
+		Help: "The total number of messages carrying HTTP response body received from each agent, by endpoint type",
+	}, []string{"agent", "endpointType"})
+	responsePausesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_response_pauses_total",
+		Help: "The total number of times a response from each agent was paused because the client read it too slowly",
+	}, []string{"agent"})
+	responsePausedSecondsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_response_paused_seconds_total",
+		Help: "The total time responses from each agent spent paused, counted as each pause ends",
+	}, []string{"agent"})
+	responsesPausedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "controller_responses_paused",
+		Help: "The number of responses from each agent currently paused",
+	}, []string{"agent"})
+	responseBufferOverflowsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_response_buffer_overflows_total",
+		Help: "The total number of responses from each agent cancelled because too much waited for the client",
+	}, []string{"agent"})
 )
 
-func getAgentNameFromContext(ctx context.Context) (string, error) {
+// makeAuditor returns the auditor for the configured destinations, or nil
+// if there are none.
+func makeAuditor(c auditConfig) (cncserver.Auditor, error) {
+	auditors := cncserver.MultiAuditor{}
+	if c.File != "" {
+		a, err := cncserver.NewFileAuditor(c.File, int64(c.MaxSizeMB)*1024*1024, c.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		auditors = append(auditors, a)
+	}
+	if c.Webhook {
+		auditors = append(auditors, &cncserver.WebhookAuditor{Runner: hook})
+	}
+	if len(auditors) == 0 {
+		return nil, nil
+	}
+	return auditors, nil
+}
+
+// getPeerCertificateFromContext returns the verified certificate of the
+// gRPC client.
+func getPeerCertificateFromContext(ctx context.Context) (*x509.Certificate, error) {
 	p, ok := peer.FromContext(ctx)
 	if !ok {
-		return "", status.Error(codes.Unauthenticated, "no peer found")
+		return nil, status.Error(codes.Unauthenticated, "no peer found")
 	}
 	tlsAuth, ok := p.AuthInfo.(credentials.TLSInfo)
 	if !ok {
-		return "", status.Error(codes.Unauthenticated, "unexpected peer transport credentials")
+		return nil, status.Error(codes.Unauthenticated, "unexpected peer transport credentials")
 	}
 	if len(tlsAuth.State.VerifiedChains) == 0 || len(tlsAuth.State.VerifiedChains[0]) == 0 {
-		return "", status.Error(codes.Unauthenticated, "could not verify peer certificate")
+		return nil, status.Error(codes.Unauthenticated, "could not verify peer certificate")
+	}
+	return tlsAuth.State.VerifiedChains[0][0], nil
+}
+
+func getCertificateNameFromContext(ctx context.Context) (*ca.CertificateName, error) {
+	cert, err := getPeerCertificateFromContext(ctx)
+	if err != nil {
+		return nil, err
 	}
-	names, err := ca.GetCertificateNameFromCert(tlsAuth.State.VerifiedChains[0][0])
+	return ca.GetCertificateNameFromCert(cert)
+}
+
+func getAgentNameFromContext(ctx context.Context) (string, error) {
+	names, err := getCertificateNameFromContext(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -134,81 +314,101 @@ func makeHeaders(headers map[string][]string) []*tunnel.HttpHeader {
 type HTTPMessage struct {
 	Out chan *tunnel.AgentToControllerWrapper
 	Cmd *tunnel.HttpRequest
+
+	// Upgrade is set when the client asked for a connection upgrade, so
+	// the request is sent to the agent as a StreamOpen.
+	Upgrade bool
+
+	// buffer tracks the response body waiting in Out, which is buffered
+	// if this is set.  See newHTTPMessage.
+	buffer *responseBuffer
+
+	closeOnce sync.Once
 }
 
-func healthcheck(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("content-type", "application/json")
-	w.WriteHeader(200)
-	n, err := w.Write([]byte("{}"))
-	if err != nil {
-		log.Printf("Error writing healthcheck response: %v", err)
-		return
-	}
-	if n != 2 {
-		log.Printf("Failed to write 2 bytes: %d written", n)
-	}
+// TransactionID implements agent.Transaction.
+func (m *HTTPMessage) TransactionID() string {
+	return m.Cmd.Id
 }
 
-func runPrometheusHTTPServer(port uint16) {
-	log.Printf("Running HTTP listener for Prometheus on port %d", port)
+// Close implements agent.Transaction, closing Out.  Either the tunnel or the
+// agent registry may end the transaction first, so this may be called more
+// than once.
+func (m *HTTPMessage) Close() {
+	m.closeOnce.Do(func() {
+		if m.buffer != nil {
+			m.buffer.stop()
+		}
+		close(m.Out)
+	})
+}
+
+func (m *HTTPMessage) replies() chan *tunnel.AgentToControllerWrapper {
+	return m.Out
+}
+
+// runPrometheusHTTPServer serves metrics and health checks, and the debug
+// endpoints if they are enabled.  If the debug endpoints require a control
+// certificate, the listener uses TLS, though a client certificate is only
+// needed for them.
+func runPrometheusHTTPServer(ctx context.Context, port uint16, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	util.Infof("Running HTTP listener for Prometheus on port %d", port)
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/", healthcheck)
-	mux.HandleFunc("/health", healthcheck)
+	mux.HandleFunc("/", livenessHandler)
+	mux.HandleFunc("/health", livenessHandler)
+	mux.HandleFunc("/health/liveness", livenessHandler)
+	mux.HandleFunc("/health/readiness", readinessHandler)
+	if config.EnableDebugEndpoints {
+		util.Warnf("Debug endpoints are enabled on port %d", port)
+		mux.Handle("/debug/", debugHandler())
+	}
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: mux,
 	}
-	log.Fatal(server.ListenAndServe())
-}
-
-func loadKeyset() {
-	if config.ServiceAuth.CurrentKeyName == "" {
-		log.Fatalf("No primary serviceAuth key name provided")
+	configureHTTPServer("prometheus", server, false)
+	if !config.DebugRequireControlCert {
+		return util.RunHTTPServer(ctx, server, server.ListenAndServe, config.GetShutdownGracePeriod())
 	}
-	jwtCurrentKey = config.ServiceAuth.CurrentKeyName
 
-	err := filepath.WalkDir(serviceAuthPath, func(path string, info fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.Type().IsRegular() {
-			return nil
-		}
-		content, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		key, err := jwk.New(content)
-		if err != nil {
-			return err
-		}
-		err = key.Set(jwk.KeyIDKey, info.Name())
-		if err != nil {
-			return err
-		}
-		err = key.Set(jwk.AlgorithmKey, jwa.HS256)
-		if err != nil {
-			return err
-		}
-		jwtKeyset.Add(key)
-		log.Printf("Loaded service key name %s, length %d", info.Name(), len(content))
-		return nil
-	})
+	certPool, err := authority.MakeCertPool()
 	if err != nil {
-		log.Fatalf("cannot load key serviceAuth keys: %v", err)
+		return fmt.Errorf("while making certpool: %v", err)
+	}
+	server.TLSConfig = &tls.Config{
+		ClientCAs:             certPool,
+		ClientAuth:            tls.VerifyClientCertIfGiven,
+		GetCertificate:        getCertificate,
+		MinVersion:            tls.VersionTLS12,
+		VerifyPeerCertificate: authority.VerifyPeerCertificate,
 	}
+	config.TLS.Apply(server.TLSConfig)
+	serve := func() error { return server.ListenAndServeTLS("", "") }
+	return util.RunHTTPServer(ctx, server, serve, config.GetShutdownGracePeriod())
+}
 
-	log.Printf("Loaded %d serviceKeys", jwtKeyset.Len())
+// registerCertificateExpiry exports the number of days until the
+// certificate returned by current expires, computed each time metrics are
+// collected.
+func registerCertificateExpiry(name string, current func() *x509.Certificate) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "controller_certificate_expiry_days",
+		Help:        "The number of days until the certificate expires",
+		ConstLabels: prometheus.Labels{"certificate": name},
+	}, func() float64 {
+		return time.Until(current().NotAfter).Hours() / 24
+	})
 }
 
 func parseConfig(filename string) (*ControllerConfig, error) {
-	f, err := os.Open(*configFile)
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("while opening configfile: %w", err)
 	}
+	defer f.Close()
 
 	c, err := LoadConfig(f)
 	if err != nil {
@@ -219,51 +419,185 @@ func parseConfig(filename string) (*ControllerConfig, error) {
 }
 
 func main() {
-	log.Printf("Controller version %s starting", version.String())
-
 	flag.Parse()
+	if *showVersion {
+		fmt.Printf("controller %s\n", version.Detailed())
+		return
+	}
+	if err := util.SetupLogging(*logLevel, *logFormat); err != nil {
+		util.Fatalf("%v", err)
+	}
+
+	util.Infof("Controller version %s starting", version.Detailed())
 
 	var err error
 
 	config, err = parseConfig(*configFile)
 	if err != nil {
-		log.Fatalf("%v", err)
+		util.Fatalf("%v", err)
 	}
+	util.SetRedactedHeaders(config.RedactHeaders)
 	config.Dump()
 
-	loadKeyset()
+	if err := configureSelectionStrategies(config); err != nil {
+		util.Fatalf("%v", err)
+	}
+	if err := configureDuplicatePolicies(config); err != nil {
+		util.Fatalf("%v", err)
+	}
+	configureRateLimits(config.RateLimits)
+	if err := configureSessionAffinity(config.SessionAffinity); err != nil {
+		util.Fatalf("Cannot set up session affinity: %v", err)
+	}
+
+	if config.ServiceAuth.CurrentKeyName == "" {
+		util.Fatalf("No primary serviceAuth key name provided")
+	}
+	keys, err := makeKeySource(config)
+	if err != nil {
+		util.Fatalf("Cannot read service keys: %v", err)
+	}
+	jwtKeyset = jwtutil.NewKeyset(config.ServiceAuth.CurrentKeyName)
+	loadedKeys, err := loadKeyset(jwtKeyset, keys)
+	if err != nil {
+		util.Fatalf("%v", err)
+	}
+	denied, err := makeDenyListStore(config)
+	if err != nil {
+		util.Fatalf("Cannot read revoked service tokens: %v", err)
+	}
+	if denied != nil {
+		if err := loadDenyList(serviceTokenDenyList, denied); err != nil {
+			util.Fatalf("%v", err)
+		}
+		util.Infof("Loaded %d revoked service tokens from %s", serviceTokenDenyList.Len(), denied)
+	}
 
 	if len(config.Webhook) > 0 {
-		hook = webhook.NewRunner(config.Webhook)
+		hook, err = webhook.NewRunner(config.Webhook, config.WebhookDelivery)
+		if err != nil {
+			util.Fatalf("%v", err)
+		}
 		go hook.Run()
 	}
 
 	//
-	// Make a new CA, for our use to generate server and other certificates.
+	// Make a new CA, for our use to generate server and other certificates,
+	// or load the certificates an external PKI issued.  The server
+	// certificate is renewed while we run.
 	//
-	caLocal, err := ca.LoadCAFromFile(config.CAConfig)
+	var issueServerCert func() (*tls.Certificate, error)
+	if config.ExternalPKI != nil {
+		external, err := ca.LoadReadOnlyCA(*config.ExternalPKI)
+		if err != nil {
+			util.Fatalf("Cannot load external PKI certificates: %v", err)
+		}
+		authority = external
+		issueServerCert = external.LoadServerCert
+		util.Infof("Loading the server certificate issued by the external PKI...")
+	} else {
+		caLocal, err := loadAuthority(config.CAConfig)
+		if err != nil {
+			util.Fatalf("Cannot create authority: %v", err)
+		}
+		authority = caLocal
+		issueServerCert = func() (*tls.Certificate, error) {
+			return caLocal.MakeServerCert(config.ServerNames)
+		}
+		util.Infof("Generating a server certificate...")
+	}
+	serverCert, err := newServerCertificate(issueServerCert)
 	if err != nil {
-		log.Fatalf("Cannot create authority: %v", err)
+		util.Fatalf("Cannot make server certificate: %v", err)
 	}
-	authority = caLocal
 
-	//
-	// Make a server certificate.
-	//
-	log.Println("Generating a server certificate...")
-	serverCert, err := authority.MakeServerCert(config.ServerNames)
+	caCert, err := x509.ParseCertificate(authority.GetCACertificate())
 	if err != nil {
-		log.Fatalf("Cannot make server certificate: %v", err)
+		util.Fatalf("Cannot parse CA certificate: %v", err)
 	}
+	registerCertificateExpiry("ca", func() *x509.Certificate { return caCert })
+	registerCertificateExpiry("server", serverCert.Leaf)
+	ready.set(subsystemCA, true)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	go runHTTPSServer(*serverCert)
+	go watchKeyset(ctx, jwtKeyset, keys, loadedKeys)
+	if denied != nil {
+		go watchDenyList(ctx, serviceTokenDenyList, denied)
+	}
+	go serverCert.run(ctx)
 
-	cnc := cncserver.MakeCNCServer(config, authority, agents, jwtKeyset, jwtCurrentKey, version.String())
-	go cnc.RunServer(*serverCert)
+	auditor, err := makeAuditor(config.Audit)
+	if err != nil {
+		util.Fatalf("%v", err)
+	}
+	accessLog, err = newAccessLogger(config.AccessLog)
+	if err != nil {
+		util.Fatalf("%v", err)
+	}
+	cnc := cncserver.MakeCNCServer(config, authority, agents, jwtKeyset, version.String(), auditor)
+	if config.AgentPathRouting {
+		cnc.SetAgentProxy(accessLog.handler(http.HandlerFunc(agentPathHandler)))
+	}
+	cnc.SetServerCertificate(serverCert)
+	cnc.SetDisconnectFunc(disconnectAgent)
+	cnc.SetLimitsFunc(updateLimits)
+	if denied != nil {
+		cnc.SetServiceTokenRevoker(&serviceTokenRevoker{keyset: jwtKeyset, list: serviceTokenDenyList, store: denied})
+	}
+	cnc.SetListeningFunc(func(up bool) { ready.set(subsystemControl, up) })
+	cnc.SetServerOptions(func(srv *http.Server) { configureHTTPServer("control", srv, true) })
+
+	servers := map[string]func(context.Context) error{
+		"service":        func(ctx context.Context) error { return runHTTPSServer(ctx, serverCert.GetCertificate) },
+		"control":        func(ctx context.Context) error { return cnc.RunServer(ctx, serverCert.GetCertificate) },
+		"remote command": func(ctx context.Context) error { return runCmdToolGRPCServer(ctx, serverCert.GetCertificate) },
+		"agent":          func(ctx context.Context) error { return runAgentGRPCServer(ctx, serverCert.GetCertificate) },
+	}
+	if config.PeerListenPort != 0 {
+		servers["peer"] = func(ctx context.Context) error { return runPeerGRPCServer(ctx, serverCert.GetCertificate) }
+	}
+	if len(config.Peers) > 0 {
+		servers["peer connections"] = runPeerConnections
+	}
 
-	go runCmdToolGRPCServer(*serverCert)
+	// If any server fails, shut the others down as well.
+	failed := make(chan error, len(servers)+1)
+	start := func(ctx context.Context, wg *sync.WaitGroup, name string, run func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(ctx); err != nil {
+				failed <- fmt.Errorf("%s server: %v", name, err)
+				stop()
+			}
+		}()
+	}
+	var wg sync.WaitGroup
+	for name, run := range servers {
+		start(ctx, &wg, name, run)
+	}
 
-	go runAgentGRPCServer(*serverCert)
+	// The health check listener stays up until the others have finished,
+	// so readiness reports the drain rather than refusing connections.
+	var healthWg sync.WaitGroup
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	start(healthCtx, &healthWg, "prometheus", func(ctx context.Context) error {
+		return runPrometheusHTTPServer(ctx, config.PrometheusListenPort, serverCert.GetCertificate)
+	})
 
-	runPrometheusHTTPServer(config.PrometheusListenPort)
+	<-ctx.Done()
+	ready.drain()
+	util.Infof("Shutting down, waiting up to %s for in-flight requests", config.GetShutdownGracePeriod())
+	wg.Wait()
+	stopHealth()
+	healthWg.Wait()
+
+	select {
+	case err := <-failed:
+		util.Fatalf("%v", err)
+	default:
+	}
+	util.Infof("Shutdown complete")
 }
@@ -0,0 +1,73 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// debugVars returns the controller's state for /debug/vars.  It has one
+// entry per connected agent, and nothing per transaction, so it stays
+// small and cheap to serve.
+func debugVars() map[string]interface{} {
+	outstanding := agents.OutstandingByAgent()
+	ret := map[string]interface{}{
+		"connectedAgents":         len(outstanding),
+		"outstandingTransactions": outstanding,
+		"activeTransactions":      atomic.LoadInt64(&activeTransactions),
+	}
+	if hook != nil {
+		ret["webhookQueueDepth"] = hook.QueueDepth()
+	}
+	return ret
+}
+
+// requireControlCert allows only clients presenting a control certificate
+// to reach h.
+func requireControlCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			util.FailRequest(w, fmt.Errorf("a control certificate is required"), http.StatusForbidden)
+			return
+		}
+		names, err := ca.GetCertificateNameFromCert(r.TLS.PeerCertificates[0])
+		if err != nil {
+			util.FailRequest(w, err, http.StatusForbidden)
+			return
+		}
+		if names.Purpose != ca.CertificatePurposeControl {
+			util.FailRequest(w, fmt.Errorf("certificate is not authorized for 'control': %s", names.Purpose), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// debugHandler returns the handler for /debug/, which requires a control
+// certificate if configured to.
+func debugHandler() http.Handler {
+	h := util.DebugHandler(debugVars)
+	if config.DebugRequireControlCert {
+		h = requireControlCert(h)
+	}
+	return h
+}
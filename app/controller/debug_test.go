@@ -0,0 +1,105 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func certWithName(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject: pkix.Name{
+			Names: []pkix.AttributeTypeAndValue{
+				{Type: asn1.ObjectIdentifier{2, 5, 4, ca.OpsMxOIDValue}, Value: name},
+			},
+		},
+	}
+}
+
+func TestDebugHandler_requireControlCert(t *testing.T) {
+	tests := []struct {
+		name       string
+		require    bool
+		cert       *x509.Certificate
+		wantStatus int
+	}{
+		{"open", false, nil, http.StatusOK},
+		{"no certificate", true, nil, http.StatusForbidden},
+		{"service certificate", true, certWithName(`{"purpose":"service","agent":"agent1","type":"jenkins","name":"ep1"}`), http.StatusForbidden},
+		{"control certificate", true, certWithName(`{"purpose":"control","name":"admin"}`), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &ControllerConfig{EnableDebugEndpoints: true, DebugRequireControlCert: tt.require}
+			defer func() { config = nil }()
+
+			r := httptest.NewRequest("GET", "https://localhost/debug/vars", nil)
+			if tt.cert != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.cert}}
+			}
+			w := httptest.NewRecorder()
+			debugHandler().ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDebugVars(t *testing.T) {
+	state, _ := startFakeAgent(func(*HTTPMessage) {})
+	defer func() { _ = agents.RemoveAgent(state) }()
+	message := &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper), Cmd: &tunnel.HttpRequest{Id: "txn1"}}
+	ep, err := agents.Route(agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agents.Complete(ep, "txn1")
+
+	buf, err := json.Marshal(debugVars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ConnectedAgents         int            `json:"connectedAgents"`
+		OutstandingTransactions map[string]int `json:"outstandingTransactions"`
+		WebhookQueueDepth       *int           `json:"webhookQueueDepth"`
+	}
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ConnectedAgents != 1 {
+		t.Errorf("connectedAgents = %d, want 1", got.ConnectedAgents)
+	}
+	if got.OutstandingTransactions["agent1"] != 1 {
+		t.Errorf("outstandingTransactions = %v, want agent1 to have 1", got.OutstandingTransactions)
+	}
+	if got.WebhookQueueDepth != nil {
+		t.Errorf("webhookQueueDepth present with no webhook")
+	}
+}
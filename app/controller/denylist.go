@@ -0,0 +1,276 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/secrets"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How long after a revoked token expires its ID is kept.  The token is
+// rejected as expired by then, so the deny list need not grow forever.
+const denyListRetention = 24 * time.Hour
+
+// denyListStore keeps the IDs of revoked service tokens where they
+// survive a restart, and are seen by every replica sharing the store.  It
+// holds each ID with the time its token expires, as RFC 3339, or an empty
+// string if it never does.
+type denyListStore interface {
+	IDs() (map[string]string, error)
+
+	// Add adds id to the stored IDs, and drops those whose tokens
+	// expired more than denyListRetention ago.
+	Add(ctx context.Context, id string, expires time.Time) error
+
+	// Changes returns a channel which receives whenever the IDs may
+	// have changed, until ctx is done.
+	Changes(ctx context.Context) <-chan struct{}
+
+	String() string
+}
+
+// addDeniedID adds id to stored, dropping the IDs of tokens which expired
+// more than denyListRetention before now.
+func addDeniedID(stored map[string]string, id string, expires time.Time, now time.Time) {
+	for oldID, value := range stored {
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err == nil && now.Sub(t) > denyListRetention {
+			delete(stored, oldID)
+		}
+	}
+	stored[id] = ""
+	if !expires.IsZero() {
+		stored[id] = expires.UTC().Format(time.RFC3339)
+	}
+}
+
+// parseDeniedIDs converts the stored IDs for jwtutil.DenyList.
+func parseDeniedIDs(stored map[string]string) (map[string]time.Time, error) {
+	ids := make(map[string]time.Time, len(stored))
+	for id, value := range stored {
+		var expires time.Time
+		if value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("token %s: %v", id, err)
+			}
+			expires = t
+		}
+		ids[id] = expires
+	}
+	return ids, nil
+}
+
+// fileDenyList keeps the IDs in a JSON object in a file, which is checked
+// for changes every interval.  A missing file holds no IDs.
+type fileDenyList struct {
+	sync.Mutex
+	path     string
+	interval time.Duration
+}
+
+func (s *fileDenyList) IDs() (map[string]string, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored := map[string]string{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", s.path, err)
+	}
+	return stored, nil
+}
+
+func (s *fileDenyList) Add(ctx context.Context, id string, expires time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	stored, err := s.IDs()
+	if err != nil {
+		return err
+	}
+	addDeniedID(stored, id, expires, time.Now())
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file is replaced atomically, so readers never see part of it.
+	dir := filepath.Dir(s.path)
+	tmp, err := ioutil.TempFile(dir, ".denylist")
+	if err != nil {
+		return fmt.Errorf("unable to save %s: %v", s.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to save %s: %v", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to save %s: %v", s.path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("unable to save %s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *fileDenyList) Changes(ctx context.Context) <-chan struct{} {
+	return pollChanges(ctx, s.interval)
+}
+
+func (s *fileDenyList) String() string {
+	return fmt.Sprintf("file %s", s.path)
+}
+
+// configMapDenyList keeps each ID as an item in a Kubernetes ConfigMap,
+// which is watched for changes.  Updates which conflict with another
+// replica's are retried, so none is lost.  A missing ConfigMap holds no
+// IDs, and is created by the first revocation.
+type configMapDenyList struct {
+	loader    *secrets.KubernetesSecretLoader
+	namespace string
+	name      string
+	retry     time.Duration
+}
+
+func (s *configMapDenyList) IDs() (map[string]string, error) {
+	data, err := s.loader.GetConfigMap(s.name)
+	if secrets.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *configMapDenyList) Add(ctx context.Context, id string, expires time.Time) error {
+	return s.loader.UpdateConfigMap(ctx, s.name, func(data map[string]string) error {
+		addDeniedID(data, id, expires, time.Now())
+		return nil
+	})
+}
+
+func (s *configMapDenyList) Changes(ctx context.Context) <-chan struct{} {
+	return watchChanges(ctx, s, s.retry, func(ctx context.Context) (watch.Interface, error) {
+		return s.loader.WatchConfigMap(ctx, s.name)
+	})
+}
+
+func (s *configMapDenyList) String() string {
+	return fmt.Sprintf("configmap %s/%s", s.namespace, s.name)
+}
+
+// makeDenyListStore returns where the IDs of revoked service tokens are
+// kept, or nil if tokens cannot be revoked.  The ConfigMap's namespace
+// defaults to the controller's own.
+func makeDenyListStore(config *ControllerConfig) (denyListStore, error) {
+	c := config.ServiceAuth.DenyList
+	if c.File != "" {
+		return &fileDenyList{path: c.File, interval: config.GetServiceKeyReloadInterval()}, nil
+	}
+	if c.ConfigMapName == "" {
+		return nil, nil
+	}
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("serviceAuth.denyList.namespace not set, and POD_NAMESPACE is not set to the pod's namespace")
+	}
+	loader, err := secrets.MakeKubernetesSecretLoader(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &configMapDenyList{loader: loader, namespace: namespace, name: c.ConfigMapName, retry: secretWatchRetry}, nil
+}
+
+// loadDenyList replaces the IDs in list with those in store.
+func loadDenyList(list *jwtutil.DenyList, store denyListStore) error {
+	stored, err := store.IDs()
+	if err != nil {
+		return fmt.Errorf("while reading revoked service tokens from %s: %v", store, err)
+	}
+	ids, err := parseDeniedIDs(stored)
+	if err != nil {
+		return fmt.Errorf("while loading revoked service tokens from %s: %v", store, err)
+	}
+	list.Load(ids)
+	return nil
+}
+
+// watchDenyList reloads the IDs in list whenever store changes, until ctx
+// is done.  A reload which fails leaves the IDs as they were.
+func watchDenyList(ctx context.Context, list *jwtutil.DenyList, store denyListStore) {
+	changes := store.Changes(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		}
+		before := list.Len()
+		if err := loadDenyList(list, store); err != nil {
+			util.Errorf("Unable to reload revoked service tokens: %v", err)
+			continue
+		}
+		if n := list.Len(); n != before {
+			util.Infof("Reloaded %d revoked service tokens from %s", n, store)
+		}
+	}
+}
+
+// serviceTokenRevoker revokes service tokens by adding their IDs to a
+// deny list store.
+type serviceTokenRevoker struct {
+	keyset *jwtutil.Keyset
+	list   *jwtutil.DenyList
+	store  denyListStore
+}
+
+// TokenID returns the ID and expiry of a token this controller issued.
+func (r *serviceTokenRevoker) TokenID(token string) (string, time.Time, error) {
+	return jwtutil.ParseTokenID(r.keyset.Set(), token)
+}
+
+// Revoke stores id, and reloads the deny list so the token is refused
+// from now on, without waiting for the store to report the change.
+func (r *serviceTokenRevoker) Revoke(ctx context.Context, id string, expires time.Time) error {
+	if err := r.store.Add(ctx, id, expires); err != nil {
+		return fmt.Errorf("unable to store the revocation in %s: %v", r.store, err)
+	}
+	return loadDenyList(r.list, r.store)
+}
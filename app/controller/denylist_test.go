@@ -0,0 +1,142 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/secrets"
+)
+
+func TestAddDeniedID(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	stored := map[string]string{
+		"forever": "",
+		"recent":  now.Add(-time.Hour).Format(time.RFC3339),
+		"old":     now.Add(-denyListRetention - time.Hour).Format(time.RFC3339),
+	}
+	addDeniedID(stored, "new", now.Add(time.Hour), now)
+	want := map[string]string{
+		"forever": "",
+		"recent":  "2021-06-01T11:00:00Z",
+		"new":     "2021-06-01T13:00:00Z",
+	}
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("addDeniedID() = %v, want %v", stored, want)
+	}
+
+	ids, err := parseDeniedIDs(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ids["forever"].IsZero() || !ids["new"].Equal(now.Add(time.Hour)) {
+		t.Errorf("parseDeniedIDs() = %v", ids)
+	}
+	if _, err := parseDeniedIDs(map[string]string{"bad": "tomorrow"}); err == nil {
+		t.Errorf("parseDeniedIDs() accepted a bad expiry")
+	}
+}
+
+func TestFileDenyList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.json")
+	store := &fileDenyList{path: path, interval: time.Minute}
+
+	// A missing file holds no IDs.
+	ids, err := store.IDs()
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("IDs() = %v, %v, want no IDs", ids, err)
+	}
+
+	list := jwtutil.NewDenyList()
+	revoker := &serviceTokenRevoker{keyset: jwtutil.NewKeyset(""), list: list, store: store}
+	if err := revoker.Revoke(context.Background(), "jti1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if !list.Contains("jti1") {
+		t.Errorf("revoked ID not denied at once")
+	}
+
+	// Another controller sharing the file sees the revocation.
+	other := jwtutil.NewDenyList()
+	if err := loadDenyList(other, &fileDenyList{path: path}); err != nil {
+		t.Fatal(err)
+	}
+	if !other.Contains("jti1") {
+		t.Errorf("revoked ID not loaded from %s", path)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDenyList(other, store); err == nil {
+		t.Errorf("loadDenyList() accepted a corrupt file")
+	}
+	if !other.Contains("jti1") {
+		t.Errorf("a failed load should leave the IDs as they were")
+	}
+}
+
+func TestWatchDenyList_configMap(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	store := func() *configMapDenyList {
+		return &configMapDenyList{
+			loader:    secrets.MakeKubernetesSecretLoaderFromClientset("ns1", client),
+			namespace: "ns1",
+			name:      "revoked-tokens",
+			retry:     10 * time.Millisecond,
+		}
+	}
+
+	// A replica watching the ConfigMap before it exists.
+	watched := jwtutil.NewDenyList()
+	if err := loadDenyList(watched, store()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchDenyList(ctx, watched, store())
+
+	// Another revokes a token, creating the ConfigMap, then another.
+	list := jwtutil.NewDenyList()
+	revoker := &serviceTokenRevoker{keyset: jwtutil.NewKeyset(""), list: list, store: store()}
+	expires := time.Now().Add(time.Hour)
+	if err := revoker.Revoke(ctx, "jti1", expires); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !watched.Contains("jti1") || !watched.Contains("jti2") {
+		if time.Now().After(deadline) {
+			t.Fatalf("revocations were not seen by the other replica")
+		}
+		// The watch may not have started before the first update.
+		if err := revoker.Revoke(ctx, "jti2", expires); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !list.Contains("jti1") || !list.Contains("jti2") {
+		t.Errorf("revoking replica does not deny both tokens")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// grpcMetricsOptions returns the server options which record metrics for
+// every RPC on a gRPC server.
+func grpcMetricsOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(unaryMetricsInterceptor),
+		grpc.StreamInterceptor(streamMetricsInterceptor),
+	}
+}
+
+// splitMethodName splits "/package.Service/Method" into its service and
+// method.
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+func unaryMetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	service, method := splitMethodName(info.FullMethod)
+	grpcServerStartedCounter.WithLabelValues(service, method).Inc()
+	grpcServerMsgReceivedCounter.WithLabelValues(service, method).Inc()
+	resp, err := handler(ctx, req)
+	if err == nil {
+		grpcServerMsgSentCounter.WithLabelValues(service, method).Inc()
+	}
+	grpcServerHandledCounter.WithLabelValues(service, method, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func streamMetricsInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	service, method := splitMethodName(info.FullMethod)
+	grpcServerStartedCounter.WithLabelValues(service, method).Inc()
+	open := grpcServerStreamsOpenGauge.WithLabelValues(service, method)
+	open.Inc()
+	defer open.Dec()
+	err := handler(srv, &meteredServerStream{
+		ServerStream: ss,
+		received:     grpcServerMsgReceivedCounter.WithLabelValues(service, method),
+		sent:         grpcServerMsgSentCounter.WithLabelValues(service, method),
+	})
+	grpcServerHandledCounter.WithLabelValues(service, method, status.Code(err).String()).Inc()
+	return err
+}
+
+// meteredServerStream counts the messages sent and received on a stream.
+type meteredServerStream struct {
+	grpc.ServerStream
+	received interface{ Inc() }
+	sent     interface{ Inc() }
+}
+
+func (s *meteredServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Inc()
+	}
+	return err
+}
+
+func (s *meteredServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received.Inc()
+	}
+	return err
+}
+
+// meteredAgentStream counts each message on an agent's tunnel by its
+// type, so chatty agents can be found.  Messages are sent from several
+// goroutines, so sends are serialized, as gRPC requires.
+type meteredAgentStream struct {
+	tunnel.AgentTunnelService_EventTunnelServer
+	agentName string
+	sendLock  sync.Mutex
+}
+
+func (s *meteredAgentStream) Send(m *tunnel.ControllerToAgentWrapper) error {
+	s.sendLock.Lock()
+	err := s.AgentTunnelService_EventTunnelServer.Send(m)
+	s.sendLock.Unlock()
+	if err == nil {
+		tunnelMessagesCounter.WithLabelValues(s.agentName, "sent", tunnelEventType(m.Event)).Inc()
+	}
+	return err
+}
+
+func (s *meteredAgentStream) Recv() (*tunnel.AgentToControllerWrapper, error) {
+	m, err := s.AgentTunnelService_EventTunnelServer.Recv()
+	if err == nil {
+		tunnelMessagesCounter.WithLabelValues(s.agentName, "received", tunnelEventType(m.Event)).Inc()
+	}
+	return m, err
+}
+
+// tunnelEventType names a tunnel message by its event, for example
+// "HttpRequest" for a *tunnel.ControllerToAgentWrapper_HttpRequest.
+func tunnelEventType(event interface{}) string {
+	if event == nil {
+		return "none"
+	}
+	name := reflect.TypeOf(event).Elem().Name()
+	if i := strings.LastIndex(name, "_"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,176 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestSplitMethodName(t *testing.T) {
+	tests := []struct {
+		fullMethod  string
+		wantService string
+		wantMethod  string
+	}{
+		{"/tunnel.AgentTunnelService/EventTunnel", "tunnel.AgentTunnelService", "EventTunnel"},
+		{"Method", "unknown", "Method"},
+	}
+	for _, tt := range tests {
+		service, method := splitMethodName(tt.fullMethod)
+		if service != tt.wantService || method != tt.wantMethod {
+			t.Errorf("splitMethodName(%q) = %q, %q, want %q, %q", tt.fullMethod, service, method, tt.wantService, tt.wantMethod)
+		}
+	}
+}
+
+func TestTunnelEventType(t *testing.T) {
+	tests := []struct {
+		event interface{}
+		want  string
+	}{
+		{&tunnel.ControllerToAgentWrapper_HttpRequest{}, "HttpRequest"},
+		{&tunnel.AgentToControllerWrapper_HttpChunkedResponse{}, "HttpChunkedResponse"},
+		{&tunnel.AgentToControllerWrapper_PingRequest{}, "PingRequest"},
+		{nil, "none"},
+	}
+	for _, tt := range tests {
+		if got := tunnelEventType(tt.event); got != tt.want {
+			t.Errorf("tunnelEventType(%T) = %q, want %q", tt.event, got, tt.want)
+		}
+	}
+}
+
+// fakeServerStream receives count messages, and then io.EOF.
+type fakeServerStream struct {
+	grpc.ServerStream
+	count int
+}
+
+func (f *fakeServerStream) SendMsg(m interface{}) error { return nil }
+
+func (f *fakeServerStream) RecvMsg(m interface{}) error {
+	if f.count == 0 {
+		return io.EOF
+	}
+	f.count--
+	return nil
+}
+
+func TestStreamMetricsInterceptor(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream"}
+	started := grpcServerStartedCounter.WithLabelValues("test.Service", "Stream")
+	failed := grpcServerHandledCounter.WithLabelValues("test.Service", "Stream", codes.PermissionDenied.String())
+	received := grpcServerMsgReceivedCounter.WithLabelValues("test.Service", "Stream")
+	sent := grpcServerMsgSentCounter.WithLabelValues("test.Service", "Stream")
+	open := grpcServerStreamsOpenGauge.WithLabelValues("test.Service", "Stream")
+	startedBefore, failedBefore := testutil.ToFloat64(started), testutil.ToFloat64(failed)
+	receivedBefore, sentBefore := testutil.ToFloat64(received), testutil.ToFloat64(sent)
+
+	err := streamMetricsInterceptor(nil, &fakeServerStream{count: 2}, info, func(srv interface{}, ss grpc.ServerStream) error {
+		if got := testutil.ToFloat64(open); got != 1 {
+			t.Errorf("expected 1 open stream, got %v", got)
+		}
+		for ss.RecvMsg(nil) == nil {
+		}
+		for i := 0; i < 3; i++ {
+			if err := ss.SendMsg(nil); err != nil {
+				return err
+			}
+		}
+		return status.Error(codes.PermissionDenied, "denied")
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected the handler's error, got %v", err)
+	}
+
+	if got := testutil.ToFloat64(started) - startedBefore; got != 1 {
+		t.Errorf("started increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(failed) - failedBefore; got != 1 {
+		t.Errorf("handled with PermissionDenied increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(received) - receivedBefore; got != 2 {
+		t.Errorf("received increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(sent) - sentBefore; got != 3 {
+		t.Errorf("sent increased by %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(open); got != 0 {
+		t.Errorf("expected no open streams, got %v", got)
+	}
+}
+
+func TestUnaryMetricsInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Unary"}
+	ok := grpcServerHandledCounter.WithLabelValues("test.Service", "Unary", codes.OK.String())
+	unknown := grpcServerHandledCounter.WithLabelValues("test.Service", "Unary", codes.Unknown.String())
+	okBefore, unknownBefore := testutil.ToFloat64(ok), testutil.ToFloat64(unknown)
+
+	succeed := func(ctx context.Context, req interface{}) (interface{}, error) { return req, nil }
+	fail := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, errors.New("failed") }
+	if _, err := unaryMetricsInterceptor(context.Background(), nil, info, succeed); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := unaryMetricsInterceptor(context.Background(), nil, info, fail); err == nil {
+		t.Errorf("expected the handler's error")
+	}
+
+	if got := testutil.ToFloat64(ok) - okBefore; got != 1 {
+		t.Errorf("handled with OK increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(unknown) - unknownBefore; got != 1 {
+		t.Errorf("handled with Unknown increased by %v, want 1", got)
+	}
+}
+
+func TestMeteredAgentStream(t *testing.T) {
+	in := make(chan *tunnel.AgentToControllerWrapper, 2)
+	in <- &tunnel.AgentToControllerWrapper{Event: &tunnel.AgentToControllerWrapper_PingRequest{PingRequest: &tunnel.PingRequest{}}}
+	in <- &tunnel.AgentToControllerWrapper{Event: &tunnel.AgentToControllerWrapper_PingRequest{PingRequest: &tunnel.PingRequest{}}}
+	close(in)
+	stream := &meteredAgentStream{AgentTunnelService_EventTunnelServer: &fakeAgentStream{in: in}, agentName: "metered"}
+
+	pings := tunnelMessagesCounter.WithLabelValues("metered", "received", "PingRequest")
+	requests := tunnelMessagesCounter.WithLabelValues("metered", "sent", "HttpRequest")
+	pingsBefore, requestsBefore := testutil.ToFloat64(pings), testutil.ToFloat64(requests)
+
+	for {
+		if _, err := stream.Recv(); err != nil {
+			break
+		}
+	}
+	if err := stream.Send(&tunnel.ControllerToAgentWrapper{Event: &tunnel.ControllerToAgentWrapper_HttpRequest{}}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if got := testutil.ToFloat64(pings) - pingsBefore; got != 2 {
+		t.Errorf("received pings increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(requests) - requestsBefore; got != 1 {
+		t.Errorf("sent requests increased by %v, want 1", got)
+	}
+}
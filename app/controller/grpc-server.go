@@ -17,100 +17,333 @@ package main
  */
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/opsmx/oes-birger/app/controller/agent"
 	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
-func (s *agentTunnelServer) sendWebhook(state agent.Agent, endpoints []*tunnel.EndpointHealth) {
+// Webhook events sent as agents come and go, or change their endpoints.
+const (
+	webhookAgentConnected    = "connected"
+	webhookAgentDisconnected = "disconnected"
+	webhookAgentReplaced     = "replaced"
+	webhookAgentUpdated      = "updated"
+
+	webhookCommandExecuted = "executed"
+)
+
+// agentEvent is sent to the webhook for an agent session.  Reason says
+// why a session ended.
+type agentEvent struct {
+	agent.BaseStatistics
+	RemoteAddress string `json:"remoteAddress,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// CloudEventType implements webhook.Event.
+func (e *agentEvent) CloudEventType() string {
+	return "agent." + e.Event
+}
+
+// CloudEventSubject implements webhook.Event.
+func (e *agentEvent) CloudEventSubject() string {
+	return e.Name
+}
+
+// commandEvent is sent to the webhook when a remote command finishes.
+type commandEvent struct {
+	Event    string `json:"event"`
+	Agent    string `json:"agent"`
+	Session  string `json:"session"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ExitCode int32  `json:"exitCode"`
+}
+
+// CloudEventType implements webhook.Event.
+func (e *commandEvent) CloudEventType() string {
+	return "command." + e.Event
+}
+
+// CloudEventSubject implements webhook.Event.
+func (e *commandEvent) CloudEventSubject() string {
+	return e.Agent
+}
+
+func makeAgentEvent(state *agent.DirectlyConnectedAgent, event string, reason string) *agentEvent {
+	return &agentEvent{
+		BaseStatistics: agent.BaseStatistics{
+			Event:     event,
+			Name:      state.GetName(),
+			Session:   state.GetSession(),
+			Endpoints: state.GetEndpoints(),
+		},
+		RemoteAddress: state.RemoteAddress,
+		Reason:        reason,
+	}
+}
+
+func (s *agentTunnelServer) sendWebhook(state *agent.DirectlyConnectedAgent, event string, reason string) {
 	if hook == nil {
 		return
 	}
-	eh := make([]agent.Endpoint, len(endpoints))
-	for i, ep := range endpoints {
-		eh[i] = agent.Endpoint{
-			Name:       ep.Name,
-			Type:       ep.Type,
-			Configured: ep.Configured,
-			Namespaces: ep.Namespaces,
-		}
+	hook.Send(makeAgentEvent(state, event, reason))
+}
+
+// disconnectReason describes why a session ended with err.
+func disconnectReason(err error) string {
+	if err == nil {
+		return "closed by the agent"
 	}
-	req := &agent.BaseStatistics{
-		Name:      state.GetName(),
-		Session:   state.GetSession(),
-		Endpoints: eh,
+	return status.Convert(err).Message()
+}
+
+func (s *agentTunnelServer) sendCommandWebhook(state *agent.DirectlyConnectedAgent, cmd *tunnel.CommandRequest, exitCode int32) {
+	if hook == nil {
+		return
 	}
-	hook.Send(req)
+	hook.Send(&commandEvent{
+		Event:    webhookCommandExecuted,
+		Agent:    state.GetName(),
+		Session:  state.GetSession(),
+		ID:       cmd.Id,
+		Name:     cmd.Name,
+		ExitCode: exitCode,
+	})
 }
 
-func (s *agentTunnelServer) makePingResponse(req *tunnel.PingRequest) *tunnel.ControllerToAgentWrapper {
+func (s *agentTunnelServer) makePingResponse(req *tunnel.PingRequest, received time.Time) *tunnel.ControllerToAgentWrapper {
 	resp := &tunnel.ControllerToAgentWrapper{
 		Event: &tunnel.ControllerToAgentWrapper_PingResponse{
-			PingResponse: &tunnel.PingResponse{Ts: uint64(time.Now().UnixNano()), EchoedTs: req.Ts},
+			PingResponse: tunnel.MakePingResponse(req, received),
 		},
 	}
 	return resp
 }
 
+func (s *agentTunnelServer) makePingRequest(ts uint64) *tunnel.ControllerToAgentWrapper {
+	return &tunnel.ControllerToAgentWrapper{
+		Event: &tunnel.ControllerToAgentWrapper_PingRequest{
+			PingRequest: &tunnel.PingRequest{Ts: ts},
+		},
+	}
+}
+
+func (s *agentTunnelServer) makeDrainingNotification() *tunnel.ControllerToAgentWrapper {
+	return &tunnel.ControllerToAgentWrapper{
+		Event: &tunnel.ControllerToAgentWrapper_ControllerDraining{
+			ControllerDraining: &tunnel.ControllerDraining{Ts: tunnel.Now()},
+		},
+	}
+}
+
+func (s *agentTunnelServer) makeReplacedNotification() *tunnel.ControllerToAgentWrapper {
+	return &tunnel.ControllerToAgentWrapper{
+		Event: &tunnel.ControllerToAgentWrapper_AgentReplaced{
+			AgentReplaced: &tunnel.AgentReplaced{Ts: tunnel.Now()},
+		},
+	}
+}
+
+// drainingMessage is sent to every agent when the controller begins shutting down.
+type drainingMessage struct{}
+
+// pendingTransaction is a message whose replies from the agent are routed
+// back to the handler which sent it.
+type pendingTransaction interface {
+	agent.Transaction
+	replies() chan *tunnel.AgentToControllerWrapper
+}
+
 type sessionList struct {
 	sync.RWMutex
-	m map[string]chan *tunnel.AgentToControllerWrapper
+	m map[string]pendingTransaction
+
+	// cancelled holds the IDs recently cancelled on this session, so
+	// replies the agent sent before it saw the cancel are dropped quietly.
+	cancelled *tunnel.Tombstones
+
+	// closed is set once the session has shut down, after which
+	// transactions still queued for it are closed as they are added.
+	closed bool
+}
+
+func newSessionList() *sessionList {
+	return &sessionList{
+		m:         make(map[string]pendingTransaction),
+		cancelled: tunnel.NewTombstones(tunnel.DefaultTombstoneTTL),
+	}
 }
 
+// discardLate returns true, counting the message, if id belongs to a
+// transaction cancelled on this session.
+func (l *sessionList) discardLate(agentName string, id string) bool {
+	if !l.cancelled.Contains(id) {
+		return false
+	}
+	lateMessagesDiscardedCounter.WithLabelValues(agentName).Inc()
+	return true
+}
+
+// removeHTTPId forgets a transaction, closing its channel so the handler
+// (or whatever is draining it) sees no further messages.
 func (s *agentTunnelServer) removeHTTPId(httpids *sessionList, id string) {
 	httpids.Lock()
 	defer httpids.Unlock()
-	delete(httpids.m, id)
+	if t, found := httpids.m[id]; found {
+		t.Close()
+		delete(httpids.m, id)
+	}
 }
 
-func (s *agentTunnelServer) addHTTPId(httpids *sessionList, id string, c chan *tunnel.AgentToControllerWrapper) {
+func (s *agentTunnelServer) addHTTPId(httpids *sessionList, t pendingTransaction) {
 	httpids.Lock()
 	defer httpids.Unlock()
-	httpids.m[id] = c
+	if httpids.closed {
+		t.Close()
+		return
+	}
+	httpids.m[t.TransactionID()] = t
 }
 
-func (s *agentTunnelServer) handleHTTPRequests(session string, requestChan chan interface{}, httpids *sessionList, stream tunnel.AgentTunnelService_EventTunnelServer) {
-	for interfacedRequest := range requestChan {
+// handleHTTPRequests writes each message queued for the session to its
+// tunnel, until the queue is closed.
+func (s *agentTunnelServer) handleHTTPRequests(state *agent.DirectlyConnectedAgent, httpids *sessionList, traffic *tunnelTraffic, stream tunnel.AgentTunnelService_EventTunnelServer) {
+	session := state.Session
+	for interfacedRequest := range state.InRequest {
+		state.Dequeued()
 		switch value := interfacedRequest.(type) {
 		case *HTTPMessage:
-			s.addHTTPId(httpids, value.Cmd.Id, value.Out)
+			s.addHTTPId(httpids, value)
 			resp := &tunnel.ControllerToAgentWrapper{
 				Event: &tunnel.ControllerToAgentWrapper_HttpRequest{
 					HttpRequest: value.Cmd,
 				},
 			}
+			if value.Upgrade {
+				resp.Event = &tunnel.ControllerToAgentWrapper_StreamOpen{
+					StreamOpen: &tunnel.StreamOpen{Request: value.Cmd},
+				}
+			}
+			if err := stream.Send(resp); err != nil {
+				util.Warnf("Unable to send to agent %s for HTTP request %s", session, value.Cmd.Id)
+				continue
+			}
+			traffic.requestChunk(value.Cmd.Type, value.Cmd.Body)
+		case *httpRequestChunkMessage:
+			resp := &tunnel.ControllerToAgentWrapper{
+				Event: &tunnel.ControllerToAgentWrapper_HttpRequestChunk{
+					HttpRequestChunk: value.chunk,
+				},
+			}
 			if err := stream.Send(resp); err != nil {
-				log.Printf("Unable to send to agent %s for HTTP request %s", session, value.Cmd.Id)
+				util.Warnf("Unable to send to agent %s for HTTP request body %s", session, value.chunk.Id)
+				continue
+			}
+			traffic.requestChunk(value.endpointType, value.chunk.Body)
+		case *streamDataMessage:
+			resp := &tunnel.ControllerToAgentWrapper{
+				Event: &tunnel.ControllerToAgentWrapper_StreamData{
+					StreamData: value.data,
+				},
+			}
+			if err := stream.Send(resp); err != nil {
+				util.Warnf("Unable to send to agent %s for stream data %s", session, value.data.Id)
+			}
+		case *streamCloseMessage:
+			s.removeHTTPId(httpids, value.id)
+			resp := &tunnel.ControllerToAgentWrapper{
+				Event: &tunnel.ControllerToAgentWrapper_StreamClose{
+					StreamClose: &tunnel.StreamClose{Id: value.id},
+				},
+			}
+			if err := stream.Send(resp); err != nil {
+				util.Warnf("Unable to send to agent %s for stream close %s", session, value.id)
+			}
+		case *drainingMessage:
+			if err := stream.Send(s.makeDrainingNotification()); err != nil {
+				util.Warnf("Unable to send draining notification to agent %s", session)
 			}
 		case *runCmdMessage:
-			log.Printf("cmd %s %s %v %v running", value.cmd.Id, value.cmd.Name, value.cmd.Arguments, value.cmd.Environment)
-			s.addHTTPId(httpids, value.cmd.Id, value.out)
+			util.Debugf("cmd %s running", value.cmd.LogString())
+			s.addHTTPId(httpids, value)
 			resp := &tunnel.ControllerToAgentWrapper{
 				Event: &tunnel.ControllerToAgentWrapper_CommandRequest{
 					CommandRequest: value.cmd,
 				},
 			}
 			if err := stream.Send(resp); err != nil {
-				log.Printf("Unable to send to agent %s for CMD request %s", session, value.cmd.Id)
+				util.Warnf("Unable to send to agent %s for CMD request %s", session, value.cmd.Id)
+			}
+		case *fetchFileMessage:
+			util.Debugf("file %s %s fetching", value.req.Id, value.req.Path)
+			s.addHTTPId(httpids, value)
+			resp := &tunnel.ControllerToAgentWrapper{
+				Event: &tunnel.ControllerToAgentWrapper_FileRequest{
+					FileRequest: value.req,
+				},
+			}
+			if err := stream.Send(resp); err != nil {
+				util.Warnf("Unable to send to agent %s for file request %s", session, value.req.Id)
+			}
+		case *cmdDataMessage:
+			resp := &tunnel.ControllerToAgentWrapper{
+				Event: &tunnel.ControllerToAgentWrapper_CommandData{
+					CommandData: value.data,
+				},
+			}
+			if err := stream.Send(resp); err != nil {
+				util.Warnf("Unable to send to agent %s for CMD data %s", session, value.data.Id)
+			}
+		case *cmdAckMessage:
+			resp := &tunnel.ControllerToAgentWrapper{
+				Event: &tunnel.ControllerToAgentWrapper_CommandAck{
+					CommandAck: value.ack,
+				},
+			}
+			if err := stream.Send(resp); err != nil {
+				util.Warnf("Unable to send to agent %s for CMD ack %s", session, value.ack.Id)
+			}
+		case *cmdCancelMessage:
+			resp := &tunnel.ControllerToAgentWrapper{
+				Event: &tunnel.ControllerToAgentWrapper_CommandCancel{
+					CommandCancel: &tunnel.CommandCancel{Id: value.id},
+				},
+			}
+			if err := stream.Send(resp); err != nil {
+				util.Warnf("Unable to send to agent %s for CMD cancel %s", session, value.id)
 			}
 		default:
-			log.Printf("Got unexpected message type: %T", interfacedRequest)
+			util.Warnf("Got unexpected message type: %T", interfacedRequest)
 		}
 	}
 }
 
-func (s *agentTunnelServer) handleHTTPCancelRequest(session string, cancelChan chan string, httpids *sessionList, stream tunnel.AgentTunnelService_EventTunnelServer) {
+// handleHTTPCancelRequest sends each cancel to the agent.  A transaction may
+// be cancelled by more than one path, so only the first cancel for an ID is
+// sent.
+func (s *agentTunnelServer) handleHTTPCancelRequest(agentName string, session string, cancelChan chan string, httpids *sessionList, stream tunnel.AgentTunnelService_EventTunnelServer) {
 	for id := range cancelChan {
+		if !httpids.cancelled.Add(id) {
+			util.Debugf("Ignoring duplicate cancel for %s on agent %s", id, session)
+			continue
+		}
 		s.removeHTTPId(httpids, id)
 		resp := &tunnel.ControllerToAgentWrapper{
 			Event: &tunnel.ControllerToAgentWrapper_CancelRequest{
@@ -118,18 +351,56 @@ func (s *agentTunnelServer) handleHTTPCancelRequest(session string, cancelChan c
 			},
 		}
 		if err := stream.Send(resp); err != nil {
-			log.Printf("Unable to send to agent %s for cancel request %s", session, id)
+			util.Warnf("Unable to send to agent %s for cancel request %s", session, id)
+			continue
 		}
+		cancelsIssuedCounter.WithLabelValues(agentName).Inc()
 	}
-	log.Printf("cancel channel closed for agent %s", session)
+	util.Infof("cancel channel closed for agent %s", session)
 }
 
+// closeAllHTTP closes every transaction on a session which is shutting
+// down, and any queued for it later.  Only the session closes its
+// transactions, as only it knows when none is being delivered to.
 func (s *agentTunnelServer) closeAllHTTP(httpids *sessionList) {
 	httpids.Lock()
 	defer httpids.Unlock()
-	for _, v := range httpids.m {
-		close(v)
+	httpids.closed = true
+	for id, t := range httpids.m {
+		t.Close()
+		delete(httpids.m, id)
+	}
+}
+
+// errAgentTimedOut is returned when an agent is disconnected for not
+// sending pings.
+var errAgentTimedOut = status.Error(codes.DeadlineExceeded, "agent stopped sending pings")
+
+// errAgentPingsMissed is returned when an agent is disconnected for not
+// answering the controller's pings.
+var errAgentPingsMissed = status.Error(codes.DeadlineExceeded, "agent stopped answering pings")
+
+// errAgentReplaced is returned when a session is disconnected because a
+// newer session of the same agent replaced it.
+var errAgentReplaced = status.Error(codes.Aborted, "replaced by a newer session of the same agent")
+
+// errAgentDisconnected is returned when a session is disconnected through
+// the control API.
+var errAgentDisconnected = status.Error(codes.Aborted, "disconnected by the controller's administrator")
+
+// disconnectAgent disconnects the sessions of the named agent connected to
+// this controller, or only the one with the given ID if session is not
+// empty, and returns how many were disconnected.  Requests in progress on
+// them fail.
+func disconnectAgent(name string, session string) int {
+	removed := agents.RemoveSessions(name, session)
+	for _, a := range removed {
+		util.Warnf("Agent %s disconnected through the control API", a)
+		if d, ok := a.(*agent.DirectlyConnectedAgent); ok {
+			d.Disconnect()
+		}
 	}
+	return len(removed)
 }
 
 // This runs in its own goroutine, one per GRPC connection from an agent.
@@ -138,12 +409,13 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 	if err != nil {
 		return err
 	}
+	stream = &meteredAgentStream{AgentTunnelService_EventTunnelServer: stream, agentName: agentIdentity}
 
 	sessionIdentity := ulidContext.Ulid()
 
-	inRequest := make(chan interface{}, 1)
+	inRequest := make(chan interface{}, config.RateLimits.GetSessionQueueSize())
 	inCancelRequest := make(chan string, 1)
-	httpids := &sessionList{m: make(map[string]chan *tunnel.AgentToControllerWrapper)}
+	httpids := newSessionList()
 
 	state := &agent.DirectlyConnectedAgent{
 		Name:            agentIdentity,
@@ -151,75 +423,276 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 		InRequest:       inRequest,
 		InCancelRequest: inCancelRequest,
 		ConnectedAt:     tunnel.Now(),
+		Replaced:        make(chan struct{}),
+		Disconnected:    make(chan struct{}),
+	}
+	state.LastPing = state.ConnectedAt
+	state.LastReceived = state.ConnectedAt
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		state.RemoteAddress = p.Addr.String()
 	}
 
-	log.Printf("Agent %s connected, awaiting hello message", state)
+	util.Infof("Agent %s connected, awaiting hello message", state)
+
+	go s.handleHTTPRequests(state, httpids, newTunnelTraffic(agentIdentity, &state.Traffic), stream)
+
+	go s.handleHTTPCancelRequest(agentIdentity, sessionIdentity, inCancelRequest, httpids, stream)
+
+	// The stream can only be abandoned by returning, so messages are
+	// received in another goroutine while this one watches for the agent
+	// to stop pinging.
+	hello := make(chan struct{})
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- s.receive(stream, state, httpids, hello)
+	}()
+
+	select {
+	case err = <-recvErr:
+		if err != nil {
+			util.Warnf("Agent closed connection: %s: %v", state, err)
+		} else {
+			util.Infof("Closing %s", state)
+		}
+	case <-s.watchLiveness(stream.Context(), state):
+		util.Warnf("Agent %s sent no ping for %s, disconnecting", state, config.GetAgentLivenessTimeout())
+		err = errAgentTimedOut
+	case <-s.pingWhenIdle(stream.Context(), stream, state):
+		util.Warnf("Agent %s did not answer %d pings, disconnecting", state, config.Keepalive.MissedPings)
+		err = errAgentPingsMissed
+	case <-state.Replaced:
+		util.Warnf("Agent %s replaced by a newer session, disconnecting", state)
+		if err := stream.Send(s.makeReplacedNotification()); err != nil {
+			util.Warnf("Unable to send replaced notification to agent %s", state)
+		}
+		err = errAgentReplaced
+	case <-state.Disconnected:
+		err = errAgentDisconnected
+	}
+
+	s.closeAllHTTP(httpids)
+	switch {
+	case isClosed(state.Replaced):
+		// A replaced session was already removed, and its name is in
+		// use by the session which replaced it.
+		connectedAgentInfoGauge.DeleteLabelValues(state.Name, state.Session, state.Version)
+		s.sendWebhook(state, webhookAgentReplaced, disconnectReason(err))
+	case isClosed(state.Disconnected):
+		// A disconnected session was already removed.
+		agentLastPingGauge.DeleteLabelValues(state.Name)
+		agentRTTGauge.DeleteLabelValues(state.Name)
+		connectedAgentInfoGauge.DeleteLabelValues(state.Name, state.Session, state.Version)
+		s.sendWebhook(state, webhookAgentDisconnected, disconnectReason(err))
+	case isClosed(hello):
+		if err2 := agents.RemoveAgent(state); err2 != nil {
+			util.Warnf("while removing agent: %v", err2)
+		}
+		agentLastPingGauge.DeleteLabelValues(state.Name)
+		agentRTTGauge.DeleteLabelValues(state.Name)
+		connectedAgentInfoGauge.DeleteLabelValues(state.Name, state.Session, state.Version)
+		s.sendWebhook(state, webhookAgentDisconnected, disconnectReason(err))
+	default:
+		// The session never registered, or was rejected, so the
+		// gauge may belong to another session of the agent.
+	}
+	// Nothing more is routed here, so once any message on its way to the
+	// queues is in them, they are closed and drained.
+	state.Close()
+	return err
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchLiveness returns a channel which is closed if the agent goes longer
+// than the liveness timeout without pinging.  Watching stops when ctx is done.
+func (s *agentTunnelServer) watchLiveness(ctx context.Context, state *agent.DirectlyConnectedAgent) <-chan struct{} {
+	interval := config.GetAgentPingInterval()
+	timeout := config.GetAgentLivenessTimeout()
+	dead := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				lastPing := atomic.LoadUint64(&state.LastPing)
+				if tunnel.Now()-lastPing > uint64(timeout.Milliseconds()) {
+					close(dead)
+					return
+				}
+			}
+		}
+	}()
+	return dead
+}
+
+// pingWhenIdle pings an agent which answers pings each time it has sent
+// nothing for the idle ping interval.  The returned channel is closed if
+// the agent leaves MissedPings in a row unanswered.  Pinging stops when
+// ctx is done.
+func (s *agentTunnelServer) pingWhenIdle(ctx context.Context, stream tunnel.AgentTunnelService_EventTunnelServer, state *agent.DirectlyConnectedAgent) <-chan struct{} {
+	interval := config.GetAgentIdlePingInterval()
+	dead := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !state.Pings.Enabled() {
+				continue
+			}
+			if tunnel.Now()-atomic.LoadUint64(&state.LastReceived) < uint64(interval.Milliseconds()) {
+				continue
+			}
+			ts := uint64(time.Now().UnixNano())
+			if state.Pings.Sent(ts) {
+				missed++
+			} else {
+				missed = 0
+			}
+			if missed >= config.Keepalive.MissedPings {
+				close(dead)
+				return
+			}
+			if err := stream.Send(s.makePingRequest(ts)); err != nil {
+				// The receive loop will see the stream fail.
+				return
+			}
+		}
+	}()
+	return dead
+}
 
-	go s.handleHTTPRequests(sessionIdentity, inRequest, httpids, stream)
+// endpointsFromPB converts the endpoints an agent sent, warning about any
+// which do not verify their server's certificate.
+func endpointsFromPB(state *agent.DirectlyConnectedAgent, pbEndpoints []*tunnel.EndpointHealth) []agent.Endpoint {
+	endpoints := make([]agent.Endpoint, len(pbEndpoints))
+	for i, ep := range pbEndpoints {
+		endpoints[i] = agent.Endpoint{
+			Name:       ep.Name,
+			Type:       ep.Type,
+			Configured: ep.Configured,
+			Namespaces: ep.Namespaces,
+			TLSMode:    ep.TlsMode,
+		}
+		if ep.TlsMode == tunnel.TLSModeInsecure {
+			util.Warnf("Agent %s endpoint %s/%s does not verify its server's TLS certificate", state, ep.Type, ep.Name)
+		}
+	}
+	return endpoints
+}
 
-	go s.handleHTTPCancelRequest(sessionIdentity, inCancelRequest, httpids, stream)
+// checkResponseChunking logs how the agent chunks response bodies, and
+// warns if its chunks may be larger than we expect.  Older agents do not
+// report this.
+func checkResponseChunking(state *agent.DirectlyConnectedAgent, hello *tunnel.AgentHello) {
+	if hello.ResponseChunkSize == 0 {
+		util.Debugf("Agent %s did not report its response chunk settings", state)
+		return
+	}
+	if hello.ResponseChunkSize > tunnel.MaxResponseChunkSize {
+		util.Warnf("Agent %s sends response chunks of up to %d bytes, more than the %d expected",
+			state, hello.ResponseChunkSize, tunnel.MaxResponseChunkSize)
+		return
+	}
+	util.Debugf("Agent %s sends response chunks of up to %d bytes, with up to %d in flight per response",
+		state, hello.ResponseChunkSize, hello.ResponseChunksInFlight)
+}
 
+// receive handles messages from the agent until the stream ends, which
+// returns nil if the agent closed it.  hello is closed once the agent has
+// registered.
+func (s *agentTunnelServer) receive(stream tunnel.AgentTunnelService_EventTunnelServer, state *agent.DirectlyConnectedAgent, httpids *sessionList, hello chan struct{}) error {
+	agentIdentity := state.Name
+	traffic := newTunnelTraffic(agentIdentity, &state.Traffic)
+	flowControl := false
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
-			log.Printf("Closing %s", state)
-			s.closeAllHTTP(httpids)
-			err2 := agents.RemoveAgent(state)
-			if err2 != nil {
-				log.Printf("while removing agent: %v", err2)
-			}
 			return nil
 		}
 		if err != nil {
-			log.Printf("Agent closed connection: %s", state)
-			s.closeAllHTTP(httpids)
-			err2 := agents.RemoveAgent(state)
-			if err2 != nil {
-				log.Printf("while removing agent: %v", err2)
-			}
 			return err
 		}
+		received := time.Now()
+		atomic.StoreUint64(&state.LastReceived, tunnel.Now())
 
 		switch x := in.Event.(type) {
 		case *tunnel.AgentToControllerWrapper_PingRequest:
 			req := in.GetPingRequest()
-			atomic.StoreUint64(&state.LastPing, tunnel.Now())
-			if err := stream.Send(s.makePingResponse(req)); err != nil {
-				log.Printf("Unable to respond to %s with ping response: %v", state, err)
-				err2 := agents.RemoveAgent(state)
-				if err2 != nil {
-					log.Printf("while removing agent: %v", err2)
-				}
-				return err
+			now := tunnel.Now()
+			atomic.StoreUint64(&state.LastPing, now)
+			agentLastPingGauge.WithLabelValues(state.Name).Set(float64(now) / 1000)
+			if err := stream.Send(s.makePingResponse(req, received)); err != nil {
+				return fmt.Errorf("unable to send ping response: %v", err)
+			}
+		case *tunnel.AgentToControllerWrapper_PingResponse:
+			now := tunnel.Now()
+			atomic.StoreUint64(&state.LastPing, now)
+			agentLastPingGauge.WithLabelValues(state.Name).Set(float64(now) / 1000)
+			if rtt, ok := state.Pings.Answered(in.GetPingResponse(), received); ok {
+				agentRTTGauge.WithLabelValues(state.Name).Set(rtt.Seconds())
 			}
 		case *tunnel.AgentToControllerWrapper_AgentHello:
 			req := in.GetAgentHello()
-			endpoints := make([]agent.Endpoint, len(req.Endpoints))
-			for i, ep := range req.Endpoints {
-				endpoints[i] = agent.Endpoint{
-					Name:       ep.Name,
-					Type:       ep.Type,
-					Configured: ep.Configured,
-					Namespaces: ep.Namespaces,
-				}
-			}
-			state.Endpoints = endpoints
+			state.Endpoints = endpointsFromPB(state, req.Endpoints)
 			state.Version = req.Version
+			state.Commit = req.Commit
+			state.BuildDate = req.BuildDate
 			state.Hostname = req.Hostname
-			agents.AddAgent(state)
-			s.sendWebhook(state, req.Endpoints)
+			if req.AnswersPings {
+				state.Pings.Enable()
+			}
+			flowControl = req.AcceptsFlowControl
+			checkResponseChunking(state, req)
+			replaced, err := agents.AdmitAgent(state)
+			if err != nil {
+				return status.Errorf(codes.AlreadyExists, "agent %s: %v", agentIdentity, err)
+			}
+			connectedAgentInfoGauge.WithLabelValues(state.Name, state.Session, state.Version).Set(1)
+			select {
+			case <-hello:
+			default:
+				close(hello)
+			}
+			s.sendWebhook(state, webhookAgentConnected, "")
+			for _, old := range replaced {
+				util.Infof("Agent %s replaced %s", state, old)
+				if d, ok := old.(*agent.DirectlyConnectedAgent); ok {
+					d.Replace()
+				}
+			}
+		case *tunnel.AgentToControllerWrapper_EndpointsUpdate:
+			req := in.GetEndpointsUpdate()
+			agents.SetEndpoints(state, endpointsFromPB(state, req.Endpoints))
+			s.sendWebhook(state, webhookAgentUpdated, "")
 		case *tunnel.AgentToControllerWrapper_HttpResponse:
 			resp := in.GetHttpResponse()
 			atomic.StoreUint64(&state.LastUse, tunnel.Now())
 			httpids.Lock()
 			dest := httpids.m[resp.Id]
 			if dest != nil {
-				dest <- in
-				if resp.ContentLength == 0 {
+				traffic.responseHeaders(transactionEndpointType(dest), resp.Headers)
+				s.deliverHTTPReply(stream, state, httpids, dest, in, flowControl)
+				if resp.ContentLength == 0 && resp.Status != http.StatusSwitchingProtocols {
 					delete(httpids.m, resp.Id)
 				}
-			} else {
-				log.Printf("Got response to unknown HTTP request id %s from %s", resp.Id, agentIdentity)
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got response to unknown HTTP request id %s from %s", resp.Id, agentIdentity)
 			}
 			httpids.Unlock()
 		case *tunnel.AgentToControllerWrapper_HttpChunkedResponse:
@@ -228,12 +701,26 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 			httpids.Lock()
 			dest := httpids.m[resp.Id]
 			if dest != nil {
-				dest <- in
+				traffic.responseChunk(transactionEndpointType(dest), resp.Body)
+				s.deliverHTTPReply(stream, state, httpids, dest, in, flowControl)
 				if len(resp.Body) == 0 {
 					delete(httpids.m, resp.Id)
 				}
-			} else {
-				log.Printf("Got response to unknown HTTP request id %s from %s", resp.Id, state)
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got response to unknown HTTP request id %s from %s", resp.Id, state)
+			}
+			httpids.Unlock()
+		case *tunnel.AgentToControllerWrapper_HttpError:
+			resp := in.GetHttpError()
+			atomic.StoreUint64(&state.LastUse, tunnel.Now())
+			httpids.Lock()
+			dest := httpids.m[resp.Id]
+			if dest != nil {
+				s.deliverHTTPReply(stream, state, httpids, dest, in, flowControl)
+				dest.Close()
+				delete(httpids.m, resp.Id)
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got error for unknown HTTP request id %s from %s", resp.Id, state)
 			}
 			httpids.Unlock()
 		case *tunnel.AgentToControllerWrapper_CommandTermination:
@@ -242,11 +729,14 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 			httpids.Lock()
 			dest := httpids.m[resp.Id]
 			if dest != nil {
-				dest <- in
-				close(dest)
+				dest.replies() <- in
+				dest.Close()
 				delete(httpids.m, resp.Id)
-			} else {
-				log.Printf("Got response to unknown CMD request id %s from %s", resp.Id, state)
+				if m, ok := dest.(*runCmdMessage); ok {
+					s.sendCommandWebhook(state, m.cmd, resp.ExitCode)
+				}
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got response to unknown CMD request id %s from %s", resp.Id, state)
 			}
 			httpids.Unlock()
 		case *tunnel.AgentToControllerWrapper_CommandData:
@@ -255,15 +745,66 @@ func (s *agentTunnelServer) EventTunnel(stream tunnel.AgentTunnelService_EventTu
 			httpids.Lock()
 			dest := httpids.m[resp.Id]
 			if dest != nil {
-				dest <- in
+				dest.replies() <- in
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got response to unknown CMD request id %s from %s", resp.Id, state)
+			}
+			httpids.Unlock()
+		case *tunnel.AgentToControllerWrapper_FileTermination:
+			resp := in.GetFileTermination()
+			atomic.StoreUint64(&state.LastUse, tunnel.Now())
+			httpids.Lock()
+			dest := httpids.m[resp.Id]
+			if dest != nil {
+				dest.replies() <- in
+				dest.Close()
+				delete(httpids.m, resp.Id)
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got response to unknown file request id %s from %s", resp.Id, state)
+			}
+			httpids.Unlock()
+		case *tunnel.AgentToControllerWrapper_FileChunk:
+			resp := in.GetFileChunk()
+			atomic.StoreUint64(&state.LastUse, tunnel.Now())
+			httpids.Lock()
+			dest := httpids.m[resp.Id]
+			if dest != nil {
+				dest.replies() <- in
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got data for unknown file request id %s from %s", resp.Id, state)
+			}
+			httpids.Unlock()
+		case *tunnel.AgentToControllerWrapper_StreamData:
+			resp := in.GetStreamData()
+			atomic.StoreUint64(&state.LastUse, tunnel.Now())
+			httpids.Lock()
+			dest := httpids.m[resp.Id]
+			if dest != nil {
+				dest.replies() <- in
+			} else if !httpids.discardLate(agentIdentity, resp.Id) {
+				util.Warnf("Got data for unknown stream id %s from %s", resp.Id, state)
+			}
+			httpids.Unlock()
+		case *tunnel.AgentToControllerWrapper_StreamClose:
+			resp := in.GetStreamClose()
+			atomic.StoreUint64(&state.LastUse, tunnel.Now())
+			httpids.Lock()
+			dest := httpids.m[resp.Id]
+			if dest != nil {
+				dest.replies() <- in
+				dest.Close()
+				delete(httpids.m, resp.Id)
 			} else {
-				log.Printf("Got response to unknown CMD request id %s from %s", resp.Id, state)
+				httpids.discardLate(agentIdentity, resp.Id)
 			}
 			httpids.Unlock()
+		case *tunnel.AgentToControllerWrapper_CancelAck:
+			util.Debugf("Agent %s acknowledged cancel of %s", state, in.GetCancelAck().Id)
+			cancelsAckedCounter.WithLabelValues(agentIdentity).Inc()
 		case nil:
 			// ignore for now
 		default:
-			log.Printf("Received unknown message: %s: %T", state, x)
+			util.Warnf("Received unknown message: %s: %T", state, x)
 		}
 	}
 }
@@ -276,31 +817,75 @@ func newAgentServer() *agentTunnelServer {
 	return &agentTunnelServer{}
 }
 
-func runAgentGRPCServer(serverCert tls.Certificate) {
+// runGRPCServer serves until ctx is cancelled.  New connections are then
+// refused, drain is called, and any remaining streams are closed.
+func runGRPCServer(ctx context.Context, name string, grpcServer *grpc.Server, lis net.Listener, drain func()) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- grpcServer.Serve(lis)
+	}()
+
+	select {
+	case err := <-errc:
+		return fmt.Errorf("%s GRPC server failed: %v", name, err)
+	case <-ctx.Done():
+	}
+
+	util.Infof("Shutting down %s GRPC server", name)
+	_ = lis.Close()
+	drain()
+	grpcServer.Stop()
+	return nil
+}
+
+func runAgentGRPCServer(ctx context.Context, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
 	//
 	// Set up GRPC server
 	//
-	log.Printf("Starting Agent GRPC server on port %d...", config.AgentListenPort)
+	util.Infof("Starting Agent GRPC server on port %d...", config.AgentListenPort)
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.AgentListenPort))
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		return fmt.Errorf("failed to listen: %v", err)
 	}
+	ready.set(subsystemAgent, true)
+	defer ready.set(subsystemAgent, false)
 
 	certPool, err := authority.MakeCertPool()
 	if err != nil {
-		log.Fatalf("While making certpool: %v", err)
+		return fmt.Errorf("while making certpool: %v", err)
 	}
-	creds := credentials.NewTLS(&tls.Config{
-		ClientCAs:    certPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		Certificates: []tls.Certificate{serverCert},
-		MinVersion:   tls.VersionTLS13,
-	})
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	tlsConfig := &tls.Config{
+		ClientCAs:             certPool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		GetCertificate:        getCertificate,
+		MinVersion:            tls.VersionTLS13,
+		VerifyPeerCertificate: authority.VerifyPeerCertificate,
+	}
+	config.TLS.Apply(tlsConfig)
+	creds := credentials.NewTLS(tlsConfig)
+	pingInterval := config.GetAgentPingInterval()
+	grpcServer := grpc.NewServer(append(grpcMetricsOptions(),
+		grpc.Creds(creds),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             time.Duration(config.Keepalive.MinPingInterval) * time.Second,
+			PermitWithoutStream: true,
+		}),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    pingInterval,
+			Timeout: pingInterval,
+		}),
+	)...)
 	tunnel.RegisterAgentTunnelServiceServer(grpcServer, newAgentServer())
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatalf("Failed to start Agent GRPC server: %v", err)
+
+	// Agents are told we are going away, and then given the grace period
+	// to finish any requests they are handling.
+	drain := func() {
+		agents.SendAll(&drainingMessage{})
+		if n := waitForTransactions(config.GetShutdownGracePeriod()); n > 0 {
+			util.Errorf("Grace period expired with %d requests in flight", n)
+		}
 	}
+	return runGRPCServer(ctx, "Agent", grpcServer, lis, drain)
 }
 
 type cmdToolTunnelServer struct {
@@ -324,6 +909,63 @@ func (s *cmdToolTunnelServer) makeCommandTermination(exitstatus int) *tunnel.Con
 type runCmdMessage struct {
 	out chan *tunnel.AgentToControllerWrapper
 	cmd *tunnel.CommandRequest
+
+	closeOnce sync.Once
+}
+
+// TransactionID implements agent.Transaction.
+func (m *runCmdMessage) TransactionID() string {
+	return m.cmd.Id
+}
+
+// Close implements agent.Transaction.
+func (m *runCmdMessage) Close() {
+	m.closeOnce.Do(func() { close(m.out) })
+}
+
+func (m *runCmdMessage) replies() chan *tunnel.AgentToControllerWrapper {
+	return m.out
+}
+
+// fetchFileMessage asks an agent session for a file.  Its chunks and
+// termination are delivered to out, as a command's output is.
+type fetchFileMessage struct {
+	out chan *tunnel.AgentToControllerWrapper
+	req *tunnel.FileRequest
+
+	closeOnce sync.Once
+}
+
+// TransactionID implements agent.Transaction.
+func (m *fetchFileMessage) TransactionID() string {
+	return m.req.Id
+}
+
+// Close implements agent.Transaction.
+func (m *fetchFileMessage) Close() {
+	m.closeOnce.Do(func() { close(m.out) })
+}
+
+func (m *fetchFileMessage) replies() chan *tunnel.AgentToControllerWrapper {
+	return m.out
+}
+
+// cmdDataMessage carries a command's standard input to the agent session
+// running it.
+type cmdDataMessage struct {
+	data *tunnel.CommandData
+}
+
+// cmdAckMessage tells the agent session running a command how much of its
+// output the command-tool has written.
+type cmdAckMessage struct {
+	ack *tunnel.CommandAck
+}
+
+// cmdCancelMessage asks the agent session running a command to stop it.
+// The transaction stays open so the command's termination is delivered.
+type cmdCancelMessage struct {
+	id string
 }
 
 func (s *cmdToolTunnelServer) EventTunnel(stream tunnel.CmdToolTunnelService_EventTunnelServer) error {
@@ -331,7 +973,7 @@ func (s *cmdToolTunnelServer) EventTunnel(stream tunnel.CmdToolTunnelService_Eve
 	if err != nil {
 		return err
 	}
-	log.Printf("CmdTool %s connected", agentIdentity)
+	util.Infof("CmdTool %s connected", agentIdentity)
 
 	sessionIdentity := ulidContext.Ulid()
 	agentResponseChan := make(chan *tunnel.AgentToControllerWrapper)
@@ -341,9 +983,9 @@ func (s *cmdToolTunnelServer) EventTunnel(stream tunnel.CmdToolTunnelService_Eve
 			switch x := in.Event.(type) {
 			case *tunnel.AgentToControllerWrapper_CommandTermination:
 				resp := in.GetCommandTermination()
-				log.Printf("Got command exit code %d", resp.ExitCode)
+				util.Debugf("Got command exit code %d", resp.ExitCode)
 				if err := stream.Send(s.makeCommandTermination(int(resp.ExitCode))); err != nil {
-					log.Printf("While sending: %v", err)
+					util.Warnf("While sending: %v", err)
 				}
 			case *tunnel.AgentToControllerWrapper_CommandData:
 				resp := in.GetCommandData()
@@ -357,12 +999,35 @@ func (s *cmdToolTunnelServer) EventTunnel(stream tunnel.CmdToolTunnelService_Eve
 					},
 				}
 				if err := stream.Send(msg); err != nil {
-					log.Printf("Sending CommandData to tool: %v", err)
+					util.Warnf("Sending CommandData to tool: %v", err)
+				}
+			case *tunnel.AgentToControllerWrapper_FileChunk:
+				msg := &tunnel.ControllerToCmdToolWrapper{
+					Event: &tunnel.ControllerToCmdToolWrapper_FileChunk{
+						FileChunk: &tunnel.CmdToolFileChunk{Body: in.GetFileChunk().Body},
+					},
+				}
+				if err := stream.Send(msg); err != nil {
+					util.Warnf("Sending FileChunk to tool: %v", err)
+				}
+			case *tunnel.AgentToControllerWrapper_FileTermination:
+				resp := in.GetFileTermination()
+				msg := &tunnel.ControllerToCmdToolWrapper{
+					Event: &tunnel.ControllerToCmdToolWrapper_FileTermination{
+						FileTermination: &tunnel.CmdToolFileTermination{
+							Size:   resp.Size,
+							Sha256: resp.Sha256,
+							Error:  resp.Error,
+						},
+					},
+				}
+				if err := stream.Send(msg); err != nil {
+					util.Warnf("Sending FileTermination to tool: %v", err)
 				}
 			case nil:
 				// ignore for now
 			default:
-				log.Printf("CmdTool %s unknown message from agent: %s: %T", agentIdentity, sessionIdentity, x)
+				util.Warnf("CmdTool %s unknown message from agent: %s: %T", agentIdentity, sessionIdentity, x)
 			}
 		}
 	}()
@@ -376,18 +1041,18 @@ func (s *cmdToolTunnelServer) EventTunnel(stream tunnel.CmdToolTunnelService_Eve
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
-			log.Printf("CmdTool %s closed connection %s", agentIdentity, sessionIdentity)
+			util.Warnf("CmdTool %s closed connection %s", agentIdentity, sessionIdentity)
 			err2 := agents.Cancel(ep, operationID)
 			if err2 != nil {
-				log.Printf("while cancelling operation: %v", err2)
+				util.Warnf("while cancelling operation: %v", err2)
 			}
 			return nil
 		}
 		if err != nil {
-			log.Printf("CmdTool %s closed connection: %s", agentIdentity, sessionIdentity)
+			util.Warnf("CmdTool %s closed connection: %s", agentIdentity, sessionIdentity)
 			err2 := agents.Cancel(ep, operationID)
 			if err2 != nil {
-				log.Printf("while cancelling operation: %v", err2)
+				util.Warnf("while cancelling operation: %v", err2)
 			}
 			return err
 		}
@@ -395,52 +1060,121 @@ func (s *cmdToolTunnelServer) EventTunnel(stream tunnel.CmdToolTunnelService_Eve
 		switch x := in.Event.(type) {
 		case *tunnel.CmdToolToControllerWrapper_CommandRequest:
 			req := in.GetCommandRequest()
-			log.Printf("CmdTool %s request: %v", agentIdentity, req)
+			util.Debugf("CmdTool %s request: %s", agentIdentity, req.LogString())
 			ep.EndpointName = req.Name
 			cmd := &tunnel.CommandRequest{
 				Id:          operationID,
 				Name:        req.Name,
 				Arguments:   req.Arguments,
 				Environment: req.Environment,
+				Stdin:       req.Stdin,
+				Window:      req.Window,
+
+				WorkingDirectory: req.WorkingDirectory,
 			}
 			message := &runCmdMessage{out: agentResponseChan, cmd: cmd}
-			sessionID, found := agents.Send(ep, message)
+			sessionID, err := agents.Send(ep, message)
+			if err != nil {
+				message.Close()
+				return err
+			}
 			ep.Session = sessionID
-			if !found {
-				close(agentResponseChan)
-				return fmt.Errorf("unknown agent: %s", agentIdentity)
+		case *tunnel.CmdToolToControllerWrapper_FileRequest:
+			req := in.GetFileRequest()
+			util.Infof("CmdTool %s fetching %s", agentIdentity, req.Path)
+			ep.EndpointType = tunnel.FileEndpointType
+			ep.EndpointName = tunnel.FileEndpointName
+			message := &fetchFileMessage{out: agentResponseChan, req: &tunnel.FileRequest{
+				Id:     operationID,
+				Path:   req.Path,
+				Window: req.Window,
+			}}
+			sessionID, err := agents.Send(ep, message)
+			if err != nil {
+				message.Close()
+				return err
+			}
+			ep.Session = sessionID
+		case *tunnel.CmdToolToControllerWrapper_CommandData:
+			req := in.GetCommandData()
+			if ep.Session == "" || req.Channel != tunnel.ChannelDirection_STDIN {
+				util.Warnf("CmdTool %s sent unexpected command data: %s", agentIdentity, sessionIdentity)
+				continue
+			}
+			message := &cmdDataMessage{data: &tunnel.CommandData{
+				Id:      operationID,
+				Body:    req.Body,
+				Channel: req.Channel,
+				Closed:  req.Closed,
+			}}
+			if err := agents.SendToSession(ep, message); err != nil {
+				util.Warnf("CmdTool %s: while sending stdin: %v", agentIdentity, err)
+			}
+		case *tunnel.CmdToolToControllerWrapper_CommandAck:
+			if ep.Session == "" {
+				util.Warnf("CmdTool %s sent an ack with no command running: %s", agentIdentity, sessionIdentity)
+				continue
+			}
+			message := &cmdAckMessage{ack: &tunnel.CommandAck{
+				Id:       operationID,
+				Consumed: in.GetCommandAck().Consumed,
+			}}
+			if err := agents.SendToSession(ep, message); err != nil {
+				util.Warnf("CmdTool %s: while sending ack: %v", agentIdentity, err)
+			}
+		case *tunnel.CmdToolToControllerWrapper_CommandCancel:
+			if ep.Session == "" {
+				util.Warnf("CmdTool %s sent cancel with no command running: %s", agentIdentity, sessionIdentity)
+				continue
+			}
+			util.Infof("CmdTool %s cancelled command %s", agentIdentity, operationID)
+			if err := agents.SendToSession(ep, &cmdCancelMessage{id: operationID}); err != nil {
+				util.Warnf("CmdTool %s: while sending cancel: %v", agentIdentity, err)
 			}
 		case nil:
 			// ignore for now
 		default:
-			log.Printf("CmdTool %s unknown message: %s: %T", agentIdentity, sessionIdentity, x)
+			util.Warnf("CmdTool %s unknown message: %s: %T", agentIdentity, sessionIdentity, x)
 		}
 	}
 }
 
-func runCmdToolGRPCServer(serverCert tls.Certificate) {
+func runCmdToolGRPCServer(ctx context.Context, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
 	//
 	// Set up GRPC server
 	//
-	log.Printf("Starting CmdTool GRPC server on port %d...", config.RemoteCommandListenPort)
+	util.Infof("Starting CmdTool GRPC server on port %d...", config.RemoteCommandListenPort)
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.RemoteCommandListenPort))
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		return fmt.Errorf("failed to listen: %v", err)
 	}
 
 	certPool, err := authority.MakeCertPool()
 	if err != nil {
-		log.Fatalf("While making certpool: %v", err)
+		return fmt.Errorf("while making certpool: %v", err)
 	}
-	creds := credentials.NewTLS(&tls.Config{
-		ClientCAs:    certPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		Certificates: []tls.Certificate{serverCert},
-		MinVersion:   tls.VersionTLS13,
-	})
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	tlsConfig := &tls.Config{
+		ClientCAs:             certPool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		GetCertificate:        getCertificate,
+		MinVersion:            tls.VersionTLS13,
+		VerifyPeerCertificate: authority.VerifyPeerCertificate,
+	}
+	config.TLS.Apply(tlsConfig)
+	creds := credentials.NewTLS(tlsConfig)
+	grpcServer := grpc.NewServer(append(grpcMetricsOptions(), grpc.Creds(creds))...)
 	tunnel.RegisterCmdToolTunnelServiceServer(grpcServer, newCmdToolServer())
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatalf("Failed to start CmdTool GRPC server: %v", err)
+
+	drain := func() {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(config.GetShutdownGracePeriod()):
+		}
 	}
+	return runGRPCServer(ctx, "CmdTool", grpcServer, lis, drain)
 }
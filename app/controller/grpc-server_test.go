@@ -0,0 +1,528 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestWatchLiveness(t *testing.T) {
+	config = &ControllerConfig{Keepalive: keepaliveConfig{PingInterval: 1, MissedPings: 1}}
+	defer func() { config = nil }()
+	s := newAgentServer()
+
+	tests := []struct {
+		name     string
+		lastPing uint64
+		wantDead bool
+	}{
+		{"stale", tunnel.Now() - 60000, true},
+		{"pinging", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			state := &agent.DirectlyConnectedAgent{Name: "agent1", LastPing: tt.lastPing}
+			if tt.lastPing == 0 {
+				// Keep pinging, as a live agent would.
+				stop := make(chan struct{})
+				defer close(stop)
+				go func() {
+					for {
+						atomic.StoreUint64(&state.LastPing, tunnel.Now())
+						select {
+						case <-stop:
+							return
+						case <-time.After(100 * time.Millisecond):
+						}
+					}
+				}()
+			}
+			dead := s.watchLiveness(ctx, state)
+			select {
+			case <-dead:
+				if !tt.wantDead {
+					t.Errorf("agent declared dead while pinging")
+				}
+			case <-time.After(2500 * time.Millisecond):
+				if tt.wantDead {
+					t.Errorf("agent not declared dead")
+				}
+			}
+		})
+	}
+}
+
+func TestPingWhenIdle(t *testing.T) {
+	config = &ControllerConfig{Keepalive: keepaliveConfig{IdlePingInterval: 1, MissedPings: 2}}
+	defer func() { config = nil }()
+	s := newAgentServer()
+
+	t.Run("unanswered", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream := &fakeAgentStream{}
+		state := &agent.DirectlyConnectedAgent{Name: "agent1"}
+		state.Pings.Enable()
+		select {
+		case <-s.pingWhenIdle(ctx, stream, state):
+		case <-time.After(5 * time.Second):
+			t.Fatalf("agent not declared dead")
+		}
+		stream.Lock()
+		defer stream.Unlock()
+		if len(stream.sent) != 2 {
+			t.Fatalf("sent %d pings, want 2", len(stream.sent))
+		}
+		if stream.sent[0].GetPingRequest().GetTs() == 0 {
+			t.Errorf("ping sent without a timestamp")
+		}
+	})
+
+	t.Run("answered", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream := &fakeAgentStream{}
+		state := &agent.DirectlyConnectedAgent{Name: "agent1"}
+		state.Pings.Enable()
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			// Answer each ping, as a live agent would.
+			answered := 0
+			for {
+				stream.Lock()
+				for ; answered < len(stream.sent); answered++ {
+					req := stream.sent[answered].GetPingRequest()
+					state.Pings.Answered(tunnel.MakePingResponse(req, time.Now()), time.Now())
+				}
+				stream.Unlock()
+				select {
+				case <-stop:
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		}()
+		select {
+		case <-s.pingWhenIdle(ctx, stream, state):
+			t.Errorf("agent declared dead while answering")
+		case <-time.After(3500 * time.Millisecond):
+		}
+		if state.Pings.RTT() <= 0 {
+			t.Errorf("RTT = %s, want it measured", state.Pings.RTT())
+		}
+	})
+
+	t.Run("not answering pings", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream := &fakeAgentStream{}
+		state := &agent.DirectlyConnectedAgent{Name: "agent1"}
+		select {
+		case <-s.pingWhenIdle(ctx, stream, state):
+			t.Errorf("agent which does not answer pings declared dead")
+		case <-time.After(2500 * time.Millisecond):
+		}
+		stream.Lock()
+		defer stream.Unlock()
+		if len(stream.sent) != 0 {
+			t.Errorf("sent %d pings to an agent which does not answer them", len(stream.sent))
+		}
+	})
+}
+
+// fakeAgentStream is the controller's side of an agent tunnel, fed from in.
+type fakeAgentStream struct {
+	grpc.ServerStream
+	in chan *tunnel.AgentToControllerWrapper
+
+	sync.Mutex
+	sent []*tunnel.ControllerToAgentWrapper
+}
+
+func (f *fakeAgentStream) Send(m *tunnel.ControllerToAgentWrapper) error {
+	f.Lock()
+	defer f.Unlock()
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func (f *fakeAgentStream) Recv() (*tunnel.AgentToControllerWrapper, error) {
+	m, ok := <-f.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return m, nil
+}
+
+func makeChunk(id string) *tunnel.AgentToControllerWrapper {
+	return &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{
+			HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: id, Body: []byte("data")},
+		},
+	}
+}
+
+// TestCancel_lateMessages cancels every request twice while the agent is
+// still sending chunks for it.  It is most useful under -race.
+func TestCancel_lateMessages(t *testing.T) {
+	const agentName = "cancel-race"
+	const requests = 50
+	const chunks = 5
+
+	s := newAgentServer()
+	stream := &fakeAgentStream{in: make(chan *tunnel.AgentToControllerWrapper)}
+	state := &agent.DirectlyConnectedAgent{Name: agentName}
+	httpids := newSessionList()
+	issued := testutil.ToFloat64(cancelsIssuedCounter.WithLabelValues(agentName))
+	acked := testutil.ToFloat64(cancelsAckedCounter.WithLabelValues(agentName))
+	late := testutil.ToFloat64(lateMessagesDiscardedCounter.WithLabelValues(agentName))
+
+	ids := make([]string, requests)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("req-%d", i)
+		s.addHTTPId(httpids, &HTTPMessage{
+			Out: make(chan *tunnel.AgentToControllerWrapper, chunks+1),
+			Cmd: &tunnel.HttpRequest{Id: ids[i]},
+		})
+	}
+
+	recvDone := make(chan error, 1)
+	go func() { recvDone <- s.receive(stream, state, httpids, make(chan struct{})) }()
+	cancelChan := make(chan string)
+	cancelDone := make(chan struct{})
+	go func() {
+		defer close(cancelDone)
+		s.handleHTTPCancelRequest(agentName, "session", cancelChan, httpids, stream)
+	}()
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		id := id
+		wg.Add(3)
+		go func() { defer wg.Done(); cancelChan <- id }()
+		go func() { defer wg.Done(); cancelChan <- id }()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < chunks; i++ {
+				stream.in <- makeChunk(id)
+			}
+		}()
+	}
+	wg.Wait()
+	close(cancelChan)
+	<-cancelDone
+
+	// Everything is cancelled now, so these are all late.
+	for _, id := range ids {
+		stream.in <- makeChunk(id)
+		stream.in <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_CancelAck{
+				CancelAck: &tunnel.CancelAck{Id: id},
+			},
+		}
+	}
+	close(stream.in)
+	if err := <-recvDone; err != nil {
+		t.Fatalf("receive() = %v", err)
+	}
+
+	cancels := map[string]int{}
+	for _, m := range stream.sent {
+		if req := m.GetCancelRequest(); req != nil {
+			cancels[req.Id]++
+		}
+	}
+	for _, id := range ids {
+		if cancels[id] != 1 {
+			t.Errorf("%s: sent %d cancel requests, want 1", id, cancels[id])
+		}
+	}
+	if got := testutil.ToFloat64(cancelsIssuedCounter.WithLabelValues(agentName)) - issued; got != requests {
+		t.Errorf("cancels issued = %v, want %d", got, requests)
+	}
+	if got := testutil.ToFloat64(cancelsAckedCounter.WithLabelValues(agentName)) - acked; got != requests {
+		t.Errorf("cancels acked = %v, want %d", got, requests)
+	}
+	if got := testutil.ToFloat64(lateMessagesDiscardedCounter.WithLabelValues(agentName)) - late; got < requests {
+		t.Errorf("late messages discarded = %v, want at least %d", got, requests)
+	}
+}
+
+// TestCloseAllHTTP checks that a session which has shut down closes the
+// requests it had, and those dequeued for it afterwards.
+func TestCloseAllHTTP(t *testing.T) {
+	s := newAgentServer()
+	httpids := newSessionList()
+	before := &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper, 1), Cmd: &tunnel.HttpRequest{Id: "before"}}
+	s.addHTTPId(httpids, before)
+	s.closeAllHTTP(httpids)
+	after := &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper, 1), Cmd: &tunnel.HttpRequest{Id: "after"}}
+	s.addHTTPId(httpids, after)
+
+	for _, msg := range []*HTTPMessage{before, after} {
+		if _, more := <-msg.Out; more {
+			t.Errorf("request %s was not closed", msg.Cmd.Id)
+		}
+	}
+	if len(httpids.m) != 0 {
+		t.Errorf("%d requests still tracked", len(httpids.m))
+	}
+}
+
+// peerAgentStream is a fakeAgentStream whose context carries the verified
+// certificate of the named agent, as the gRPC server would set.
+type peerAgentStream struct {
+	*fakeAgentStream
+	ctx context.Context
+}
+
+func (s *peerAgentStream) Context() context.Context { return s.ctx }
+
+func newPeerAgentStream(agentName string) *peerAgentStream {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			Names: []pkix.AttributeTypeAndValue{
+				{
+					Type:  []int{2, 5, 4, ca.OpsMxOIDValue},
+					Value: fmt.Sprintf(`{"agent":"%s","purpose":"agent"}`, agentName),
+				},
+			},
+		},
+	}
+	p := &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	}
+	return &peerAgentStream{
+		fakeAgentStream: &fakeAgentStream{in: make(chan *tunnel.AgentToControllerWrapper, 10)},
+		ctx:             peer.NewContext(context.Background(), p),
+	}
+}
+
+func TestAgentEvent(t *testing.T) {
+	state := &agent.DirectlyConnectedAgent{
+		Name:          "agent1",
+		Session:       "session1",
+		RemoteAddress: "10.1.2.3:4567",
+	}
+	e := makeAgentEvent(state, webhookAgentDisconnected, disconnectReason(errAgentDisconnected))
+	if e.CloudEventType() != "agent.disconnected" || e.CloudEventSubject() != "agent1" {
+		t.Errorf("CloudEvent type %q, subject %q", e.CloudEventType(), e.CloudEventSubject())
+	}
+	got, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"event":"disconnected","name":"agent1","session":"session1","remoteAddress":"10.1.2.3:4567","reason":"disconnected by the controller's administrator"}`
+	if string(got) != want {
+		t.Errorf("event = %s, want %s", got, want)
+	}
+	if r := disconnectReason(nil); r != "closed by the agent" {
+		t.Errorf("disconnectReason(nil) = %q", r)
+	}
+}
+
+func TestDisconnectAgent(t *testing.T) {
+	const agentName = "kicked"
+	config = &ControllerConfig{Keepalive: keepaliveConfig{PingInterval: 60, MissedPings: 3}}
+	defer func() { config = nil }()
+	s := newAgentServer()
+
+	stream := newPeerAgentStream(agentName)
+	defer close(stream.in)
+	changed := agents.Changed()
+	done := make(chan error, 1)
+	go func() { done <- s.EventTunnel(stream) }()
+	stream.in <- &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_AgentHello{
+			AgentHello: &tunnel.AgentHello{Endpoints: []*tunnel.EndpointHealth{{Name: "ep1", Type: "jenkins", Configured: true}}},
+		},
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not register")
+	}
+
+	// A request in progress when the agent is disconnected fails.
+	msg := &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper, 1), Cmd: &tunnel.HttpRequest{Id: "inflight", Type: "jenkins"}}
+	if _, err := agents.Send(agent.Search{Name: agentName, EndpointType: "jenkins", EndpointName: "ep1"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := disconnectAgent(agentName, "no-such-session"); n != 0 {
+		t.Errorf("disconnected %d sessions with an unknown session ID", n)
+	}
+	if n := disconnectAgent(agentName, ""); n != 1 {
+		t.Errorf("disconnected %d sessions, want 1", n)
+	}
+	select {
+	case err := <-done:
+		if err != errAgentDisconnected {
+			t.Errorf("EventTunnel() = %v, want %v", err, errAgentDisconnected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not closed")
+	}
+	if _, more := <-msg.Out; more {
+		t.Errorf("request in progress was not closed")
+	}
+	for _, a := range agents.GetAgents() {
+		if a.Name == agentName {
+			t.Errorf("session %s is still connected", a.Session)
+		}
+	}
+	if n := disconnectAgent(agentName, ""); n != 0 {
+		t.Errorf("disconnected %d sessions after all were gone", n)
+	}
+}
+
+func TestReplaceAgent(t *testing.T) {
+	const agentName = "replaced"
+	config = &ControllerConfig{Keepalive: keepaliveConfig{PingInterval: 60, MissedPings: 3}}
+	defer func() { config = nil }()
+	agents.SetDuplicatePolicy(agentName, agent.DuplicateReplace)
+	s := newAgentServer()
+	hello := &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_AgentHello{
+			AgentHello: &tunnel.AgentHello{Endpoints: []*tunnel.EndpointHealth{{Name: "ep1", Type: "jenkins", Configured: true}}},
+		},
+	}
+	connect := func() (*peerAgentStream, chan error) {
+		t.Helper()
+		stream := newPeerAgentStream(agentName)
+		changed := agents.Changed()
+		done := make(chan error, 1)
+		go func() { done <- s.EventTunnel(stream) }()
+		stream.in <- hello
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("agent did not register")
+		}
+		return stream, done
+	}
+
+	oldStream, oldDone := connect()
+	defer close(oldStream.in)
+	msg := &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper, 1), Cmd: &tunnel.HttpRequest{Id: "inflight", Type: "jenkins"}}
+	if _, err := agents.Send(agent.Search{Name: agentName, EndpointType: "jenkins", EndpointName: "ep1"}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replaced session closes its own request in progress as it
+	// disconnects.
+	newStream, newDone := connect()
+	select {
+	case err := <-oldDone:
+		if err != errAgentReplaced {
+			t.Errorf("EventTunnel() = %v, want %v", err, errAgentReplaced)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaced tunnel was not closed")
+	}
+	if _, more := <-msg.Out; more {
+		t.Errorf("request in progress was not closed")
+	}
+
+	close(newStream.in)
+	select {
+	case <-newDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not closed")
+	}
+}
+
+func TestEndpointsUpdate(t *testing.T) {
+	const agentName = "reloaded"
+	config = &ControllerConfig{Keepalive: keepaliveConfig{PingInterval: 60, MissedPings: 3}}
+	defer func() { config = nil }()
+	s := newAgentServer()
+
+	stream := newPeerAgentStream(agentName)
+	defer close(stream.in)
+	done := make(chan error, 1)
+	send := func(m *tunnel.AgentToControllerWrapper) {
+		t.Helper()
+		changed := agents.Changed()
+		stream.in <- m
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("agents did not change")
+		}
+	}
+	go func() { done <- s.EventTunnel(stream) }()
+	send(&tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_AgentHello{
+			AgentHello: &tunnel.AgentHello{Endpoints: []*tunnel.EndpointHealth{{Name: "ep1", Type: "jenkins", Configured: true}}},
+		},
+	})
+	send(&tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_EndpointsUpdate{
+			EndpointsUpdate: &tunnel.EndpointsUpdate{Endpoints: []*tunnel.EndpointHealth{{Name: "ep2", Type: "jenkins", Configured: true}}},
+		},
+	})
+
+	var noAgent *agent.NoAgentError
+	msg := &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper, 1), Cmd: &tunnel.HttpRequest{Id: "old", Type: "jenkins"}}
+	if _, err := agents.Send(agent.Search{Name: agentName, EndpointType: "jenkins", EndpointName: "ep1"}, msg); !errors.As(err, &noAgent) {
+		t.Errorf("request for a removed endpoint: got %v, want a NoAgentError", err)
+	}
+	msg = &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper, 1), Cmd: &tunnel.HttpRequest{Id: "new", Type: "jenkins"}}
+	if _, err := agents.Send(agent.Search{Name: agentName, EndpointType: "jenkins", EndpointName: "ep2"}, msg); err != nil {
+		t.Errorf("request for an added endpoint: %v", err)
+	}
+	for _, a := range agents.GetAgents() {
+		if a.Name == agentName && (len(a.Endpoints) != 1 || a.Endpoints[0].Name != "ep2") {
+			t.Errorf("endpoints = %v, want only ep2", a.Endpoints)
+		}
+	}
+
+	if n := disconnectAgent(agentName, ""); n != 1 {
+		t.Errorf("disconnected %d sessions, want 1", n)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not closed")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"golang.org/x/net/http/httpguts"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1, and the
+// common non-standard ones, which apply only to a single connection and
+// must not be passed on by a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// viaPseudonym names this controller in the Via header, rather than
+// exposing its hostname to the agent's services.
+const viaPseudonym = "opsmx-controller"
+
+// removeHopHeaders deletes the hop-by-hop headers, and any other headers
+// the Connection header names as such, from h.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				h.Del(textproto.CanonicalMIMEHeaderKey(token))
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// forwardedRequestHeaders returns the headers to send to the agent for r.
+// Hop-by-hop headers are removed, except that an upgrade request keeps its
+// Connection and Upgrade headers so the agent can upgrade the connection
+// to its service.  Via and X-Forwarded-* are added as configured.
+func forwardedRequestHeaders(r *http.Request, upgrade bool, c forwardedHeadersConfig) http.Header {
+	h := r.Header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	removeHopHeaders(h)
+	if upgrade {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+
+	if c.HideClientAddress {
+		h.Del("X-Forwarded-For")
+		h.Del("Forwarded")
+	}
+	if c.Disabled {
+		return h
+	}
+
+	h.Add("Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, viaPseudonym))
+	if !c.HideClientAddress {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+				ip = strings.Join(prior, ", ") + ", " + ip
+			}
+			h.Set("X-Forwarded-For", ip)
+		}
+	}
+	if r.TLS != nil {
+		h.Set("X-Forwarded-Proto", "https")
+	} else {
+		h.Set("X-Forwarded-Proto", "http")
+	}
+	return h
+}
+
+// sanitizeResponseHeaders removes from resp any header whose name is not a
+// valid field name, and any value containing CR, LF, or another character
+// not allowed in a field value, so headers from an agent cannot inject
+// others into the client's response.  The names of the headers changed are
+// returned.
+func sanitizeResponseHeaders(resp *tunnel.HttpResponse) []string {
+	dropped := []string{}
+	headers := make([]*tunnel.HttpHeader, 0, len(resp.Headers))
+	for _, header := range resp.Headers {
+		if !httpguts.ValidHeaderFieldName(header.Name) {
+			dropped = append(dropped, fmt.Sprintf("%q", header.Name))
+			continue
+		}
+		values := make([]string, 0, len(header.Values))
+		for _, value := range header.Values {
+			if httpguts.ValidHeaderFieldValue(value) {
+				values = append(values, value)
+			}
+		}
+		if len(values) != len(header.Values) {
+			dropped = append(dropped, header.Name)
+		}
+		if len(values) > 0 {
+			headers = append(headers, &tunnel.HttpHeader{Name: header.Name, Values: values})
+		}
+	}
+	resp.Headers = headers
+	return dropped
+}
+
+// Reasons a request is refused by checkRequestLimits, used as metric labels.
+const (
+	requestRejectedURI          = "uri"
+	requestRejectedHeader       = "header"
+	requestRejectedTotalHeaders = "total_headers"
+)
+
+// requestLimitError is returned by checkRequestLimits, with the status the
+// request is refused with.
+type requestLimitError struct {
+	reason string
+	status int
+	msg    string
+}
+
+func (e *requestLimitError) Error() string {
+	return e.msg
+}
+
+// checkRequestLimits returns an error if the URI of a request is longer
+// than the limit, or its headers, as they would be written, are larger.
+func checkRequestLimits(uri string, headers []*tunnel.HttpHeader, limits requestLimits) *requestLimitError {
+	if len(uri) > limits.MaxURIBytes {
+		return &requestLimitError{
+			reason: requestRejectedURI,
+			status: http.StatusRequestURITooLong,
+			msg:    fmt.Sprintf("request URI is %d bytes, limit is %d", len(uri), limits.MaxURIBytes),
+		}
+	}
+	size := 0
+	for _, header := range headers {
+		for _, value := range header.Values {
+			n := len(header.Name) + len(": ") + len(value) + len("\r\n")
+			if n > limits.MaxHeaderBytes {
+				return &requestLimitError{
+					reason: requestRejectedHeader,
+					status: http.StatusRequestHeaderFieldsTooLarge,
+					msg:    fmt.Sprintf("request header %s is %d bytes, limit is %d", header.Name, n, limits.MaxHeaderBytes),
+				}
+			}
+			size += n
+		}
+	}
+	if size > limits.MaxTotalHeaderBytes {
+		return &requestLimitError{
+			reason: requestRejectedTotalHeaders,
+			status: http.StatusRequestHeaderFieldsTooLarge,
+			msg:    fmt.Sprintf("request headers are %d bytes, limit is %d", size, limits.MaxTotalHeaderBytes),
+		}
+	}
+	return nil
+}
+
+// checkResponseHeaderLimits returns an error if the headers have more than
+// maxCount lines, or would take more than maxBytes to write.
+func checkResponseHeaderLimits(headers []*tunnel.HttpHeader, maxBytes int, maxCount int) error {
+	count, size := 0, 0
+	for _, header := range headers {
+		for _, value := range header.Values {
+			count++
+			size += len(header.Name) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	if count > maxCount {
+		return fmt.Errorf("response has %d headers, limit is %d", count, maxCount)
+	}
+	if size > maxBytes {
+		return fmt.Errorf("response headers are %d bytes, limit is %d", size, maxBytes)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    http.Header
+	}{
+		{
+			"standard hop headers",
+			http.Header{
+				"Connection":          {"close"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Authorization": {"Basic Zm9vOmJhcg=="},
+				"Te":                  {"trailers"},
+				"Transfer-Encoding":   {"chunked"},
+				"Upgrade":             {"websocket"},
+				"Accept":              {"*/*"},
+			},
+			http.Header{"Accept": {"*/*"}},
+		},
+		{
+			"connection names are canonicalized",
+			http.Header{
+				"Connection":   {"x-custom-hop, X-OTHER-HOP"},
+				"X-Custom-Hop": {"1"},
+				"X-Other-Hop":  {"2"},
+				"X-Kept":       {"3"},
+			},
+			http.Header{"X-Kept": {"3"}},
+		},
+		{
+			"multiple connection headers",
+			http.Header{
+				"Connection": {"x-first", " ,x-second ,"},
+				"X-First":    {"1"},
+				"X-Second":   {"2"},
+				"X-Kept":     {"3"},
+			},
+			http.Header{"X-Kept": {"3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removeHopHeaders(tt.headers)
+			if !reflect.DeepEqual(tt.headers, tt.want) {
+				t.Errorf("removeHopHeaders() = %#v, want %#v", tt.headers, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		upgrade bool
+		config  forwardedHeadersConfig
+		want    http.Header
+	}{
+		{
+			"defaults",
+			http.Header{"Connection": {"keep-alive"}, "Accept": {"*/*"}},
+			false,
+			forwardedHeadersConfig{},
+			http.Header{
+				"Accept":            {"*/*"},
+				"Via":               {"1.1 opsmx-controller"},
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Proto": {"https"},
+			},
+		},
+		{
+			"appends to prior proxies",
+			http.Header{"Via": {"1.0 lb"}, "X-Forwarded-For": {"198.51.100.7", "203.0.113.9"}},
+			false,
+			forwardedHeadersConfig{},
+			http.Header{
+				"Via":               {"1.0 lb", "1.1 opsmx-controller"},
+				"X-Forwarded-For":   {"198.51.100.7, 203.0.113.9, 192.0.2.1"},
+				"X-Forwarded-Proto": {"https"},
+			},
+		},
+		{
+			"upgrade keeps connection and upgrade",
+			http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}},
+			true,
+			forwardedHeadersConfig{Disabled: true},
+			http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+		},
+		{
+			"client address hidden",
+			http.Header{"X-Forwarded-For": {"198.51.100.7"}, "Forwarded": {"for=198.51.100.7"}},
+			false,
+			forwardedHeadersConfig{HideClientAddress: true},
+			http.Header{
+				"Via":               {"1.1 opsmx-controller"},
+				"X-Forwarded-Proto": {"https"},
+			},
+		},
+		{
+			"disabled",
+			http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			false,
+			forwardedHeadersConfig{Disabled: true},
+			http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			r.Header = tt.headers
+			got := forwardedRequestHeaders(r, tt.upgrade, tt.config)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("forwardedRequestHeaders() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyHeaders_removesHopHeaders(t *testing.T) {
+	resp := &tunnel.HttpResponse{
+		Headers: []*tunnel.HttpHeader{
+			{Name: "Connection", Values: []string{"close, X-Hop"}},
+			{Name: "X-Hop", Values: []string{"1"}},
+			{Name: "Transfer-Encoding", Values: []string{"chunked"}},
+			{Name: "Content-Type", Values: []string{"text/plain"}},
+		},
+	}
+	w := httptest.NewRecorder()
+	copyHeaders(resp, w)
+	want := http.Header{"Content-Type": {"text/plain"}}
+	if !reflect.DeepEqual(w.Header(), want) {
+		t.Errorf("copyHeaders() = %#v, want %#v", w.Header(), want)
+	}
+}
+
+func TestSanitizeResponseHeaders(t *testing.T) {
+	resp := &tunnel.HttpResponse{
+		Headers: []*tunnel.HttpHeader{
+			{Name: "Content-Type", Values: []string{"text/plain"}},
+			{Name: "X-Injected", Values: []string{"a\r\nSet-Cookie: session=evil"}},
+			{Name: "X-Mixed", Values: []string{"good", "bad\n"}},
+			{Name: "Bad Name", Values: []string{"1"}},
+			{Name: "X-Split\r\nSet-Cookie", Values: []string{"1"}},
+		},
+	}
+	dropped := sanitizeResponseHeaders(resp)
+	want := []*tunnel.HttpHeader{
+		{Name: "Content-Type", Values: []string{"text/plain"}},
+		{Name: "X-Mixed", Values: []string{"good"}},
+	}
+	if !reflect.DeepEqual(resp.Headers, want) {
+		t.Errorf("sanitizeResponseHeaders() left %v, want %v", resp.Headers, want)
+	}
+	wantDropped := []string{"X-Injected", "X-Mixed", `"Bad Name"`, `"X-Split\r\nSet-Cookie"`}
+	if !reflect.DeepEqual(dropped, wantDropped) {
+		t.Errorf("sanitizeResponseHeaders() = %v, want %v", dropped, wantDropped)
+	}
+}
+
+func TestCheckRequestLimits(t *testing.T) {
+	limits := requestLimits{MaxURIBytes: 10, MaxHeaderBytes: 20, MaxTotalHeaderBytes: 40}
+	// header returns a header which takes n bytes, as written with ": " and
+	// CRLF.
+	header := func(name string, n int) *tunnel.HttpHeader {
+		return &tunnel.HttpHeader{Name: name, Values: []string{strings.Repeat("x", n-len(name)-4)}}
+	}
+	tests := []struct {
+		name       string
+		uri        string
+		headers    []*tunnel.HttpHeader
+		wantReason string
+		wantStatus int
+	}{
+		{"within limits", "/api", []*tunnel.HttpHeader{header("A", 20)}, "", 0},
+		{"uri at limit", "/123456789", nil, "", 0},
+		{"uri over limit", "/1234567890", nil, requestRejectedURI, http.StatusRequestURITooLong},
+		{"header at limit", "/", []*tunnel.HttpHeader{header("A", 20), header("B", 20)}, "", 0},
+		{"header over limit", "/", []*tunnel.HttpHeader{header("A", 21)}, requestRejectedHeader, http.StatusRequestHeaderFieldsTooLarge},
+		{
+			"value over limit",
+			"/",
+			[]*tunnel.HttpHeader{{Name: "A", Values: []string{"short", strings.Repeat("x", 16)}}},
+			requestRejectedHeader,
+			http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			"total over limit",
+			"/",
+			[]*tunnel.HttpHeader{header("A", 20), header("B", 20), header("C", 5)},
+			requestRejectedTotalHeaders,
+			http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRequestLimits(tt.uri, tt.headers, limits)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Errorf("checkRequestLimits() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("checkRequestLimits() = nil, want %s", tt.wantReason)
+			}
+			if err.reason != tt.wantReason || err.status != tt.wantStatus {
+				t.Errorf("checkRequestLimits() = %s %d, want %s %d", err.reason, err.status, tt.wantReason, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckResponseHeaderLimits(t *testing.T) {
+	headers := []*tunnel.HttpHeader{
+		{Name: "Content-Type", Values: []string{"text/plain"}},
+		{Name: "Set-Cookie", Values: []string{"a=1", "b=2"}},
+	}
+	// 26 + 17 + 17 bytes, as written with ": " and CRLF.
+	tests := []struct {
+		name     string
+		maxBytes int
+		maxCount int
+		wantErr  bool
+	}{
+		{"within limits", 60, 3, false},
+		{"too many", 60, 2, true},
+		{"too large", 59, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResponseHeaderLimits(headers, tt.maxBytes, tt.maxCount)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkResponseHeaderLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
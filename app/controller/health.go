@@ -0,0 +1,115 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// Subsystems which must be up before the controller is ready.
+const (
+	subsystemCA      = "ca"
+	subsystemAgent   = "agent"
+	subsystemControl = "control"
+	subsystemService = "service"
+)
+
+// readiness tracks whether each subsystem the controller needs is up, and
+// whether the controller has begun shutting down.
+type readiness struct {
+	sync.RWMutex
+	subsystems map[string]bool
+	draining   bool
+}
+
+type readinessStatus struct {
+	Ready      bool            `json:"ready"`
+	Draining   bool            `json:"draining"`
+	Subsystems map[string]bool `json:"subsystems"`
+}
+
+var ready = newReadiness(subsystemCA, subsystemAgent, subsystemControl, subsystemService)
+
+func newReadiness(names ...string) *readiness {
+	r := &readiness{subsystems: map[string]bool{}}
+	for _, name := range names {
+		r.subsystems[name] = false
+	}
+	return r
+}
+
+func (r *readiness) set(name string, up bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.subsystems[name] = up
+}
+
+// drain marks the controller as shutting down, so it is no longer ready
+// whatever the state of its subsystems.
+func (r *readiness) drain() {
+	r.Lock()
+	defer r.Unlock()
+	r.draining = true
+}
+
+func (r *readiness) status() readinessStatus {
+	r.RLock()
+	defer r.RUnlock()
+	ret := readinessStatus{
+		Ready:      !r.draining,
+		Draining:   r.draining,
+		Subsystems: make(map[string]bool, len(r.subsystems)),
+	}
+	for name, up := range r.subsystems {
+		ret.Subsystems[name] = up
+		ret.Ready = ret.Ready && up
+	}
+	return ret
+}
+
+func writeHealth(w http.ResponseWriter, code int, body interface{}) {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		util.FailRequest(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(buf); err != nil {
+		util.Warnf("Error writing health check response: %v", err)
+	}
+}
+
+// livenessHandler returns 200 as long as the process can serve requests.
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readinessHandler returns 200 only if every subsystem is up and the
+// controller is not draining, with the state of each in the body.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	status := ready.status()
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, status)
+}
@@ -0,0 +1,82 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	saved := ready
+	ready = newReadiness(subsystemCA, subsystemAgent)
+	defer func() { ready = saved }()
+
+	check := func(wantCode int, want readinessStatus) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		readinessHandler(w, httptest.NewRequest("GET", "/health/readiness", nil))
+		if w.Code != wantCode {
+			t.Errorf("status = %d, want %d", w.Code, wantCode)
+		}
+		if ct := w.Header().Get("content-type"); ct != "application/json" {
+			t.Errorf("content-type = %q", ct)
+		}
+		var got readinessStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("unable to parse %q: %v", w.Body.String(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("body = %+v, want %+v", got, want)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, readinessStatus{
+		Subsystems: map[string]bool{subsystemCA: false, subsystemAgent: false},
+	})
+
+	ready.set(subsystemCA, true)
+	check(http.StatusServiceUnavailable, readinessStatus{
+		Subsystems: map[string]bool{subsystemCA: true, subsystemAgent: false},
+	})
+
+	ready.set(subsystemAgent, true)
+	check(http.StatusOK, readinessStatus{
+		Ready:      true,
+		Subsystems: map[string]bool{subsystemCA: true, subsystemAgent: true},
+	})
+
+	ready.drain()
+	check(http.StatusServiceUnavailable, readinessStatus{
+		Draining:   true,
+		Subsystems: map[string]bool{subsystemCA: true, subsystemAgent: true},
+	})
+}
+
+func TestLivenessHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	livenessHandler(w, httptest.NewRequest("GET", "/health/liveness", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Body.String() != `{"status":"ok"}` {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
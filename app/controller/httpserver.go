@@ -0,0 +1,95 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type connContextKey struct{}
+
+var httpConnectionsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "controller_http_connections",
+	Help: "The number of open connections to each HTTP listener, excluding upgraded connections",
+}, []string{"server"})
+
+// configureHTTPServer applies the configured timeouts to srv and counts its
+// connections.  A streaming server relays responses from agents, which may
+// run as long as a watch does, so it has no WriteTimeout; handlers use a
+// writeDeadline instead.
+func configureHTTPServer(name string, srv *http.Server, streaming bool) {
+	readHeader, idle, write := config.GetHTTPServerTimeouts()
+	srv.ReadHeaderTimeout = readHeader
+	srv.IdleTimeout = idle
+	if streaming {
+		srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		}
+	} else {
+		srv.WriteTimeout = write
+	}
+
+	gauge := httpConnectionsGauge.WithLabelValues(name)
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			gauge.Inc()
+		case http.StateHijacked, http.StateClosed:
+			gauge.Dec()
+		}
+	}
+}
+
+// writeDeadline limits each write of a streamed response, in place of the
+// server's WriteTimeout.  It does nothing if the request did not come from
+// a streaming server, or the write timeout is disabled.  It also does
+// nothing for HTTP/2, where the connection carries other streams, and the
+// server's own frames, which a deadline set for one would cut off.
+type writeDeadline struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func newWriteDeadline(r *http.Request) *writeDeadline {
+	_, _, write := config.GetHTTPServerTimeouts()
+	if r.ProtoMajor != 1 {
+		return &writeDeadline{timeout: write}
+	}
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return &writeDeadline{conn: conn, timeout: write}
+}
+
+// extend allows the next write up to the write timeout from now.
+func (d *writeDeadline) extend() {
+	if d.conn != nil && d.timeout > 0 {
+		_ = d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	}
+}
+
+// clear removes the deadline, so it does not apply to the next request on
+// a kept-alive connection.
+func (d *writeDeadline) clear() {
+	if d.conn != nil && d.timeout > 0 {
+		_ = d.conn.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestConfigureHTTPServer(t *testing.T) {
+	tests := []struct {
+		name                           string
+		config                         httpServerConfig
+		streaming                      bool
+		wantReadHeader, wantIdle, want time.Duration
+	}{
+		{"defaults", httpServerConfig{}, false, 10 * time.Second, 120 * time.Second, 60 * time.Second},
+		{"streaming", httpServerConfig{}, true, 10 * time.Second, 120 * time.Second, 0},
+		{"configured", httpServerConfig{ReadHeaderTimeout: 5, IdleTimeout: 30, WriteTimeout: 15}, false, 5 * time.Second, 30 * time.Second, 15 * time.Second},
+		{"disabled", httpServerConfig{ReadHeaderTimeout: -1, IdleTimeout: -1, WriteTimeout: -1}, false, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &ControllerConfig{HTTPServer: tt.config}
+			defer func() { config = nil }()
+
+			srv := &http.Server{}
+			configureHTTPServer("test", srv, tt.streaming)
+			if srv.ReadHeaderTimeout != tt.wantReadHeader || srv.IdleTimeout != tt.wantIdle || srv.WriteTimeout != tt.want {
+				t.Errorf("timeouts = %s, %s, %s, want %s, %s, %s",
+					srv.ReadHeaderTimeout, srv.IdleTimeout, srv.WriteTimeout,
+					tt.wantReadHeader, tt.wantIdle, tt.want)
+			}
+			if tt.streaming != (srv.ConnContext != nil) {
+				t.Errorf("ConnContext set = %v, want %v", srv.ConnContext != nil, tt.streaming)
+			}
+		})
+	}
+}
+
+func TestNewWriteDeadline(t *testing.T) {
+	config = &ControllerConfig{HTTPServer: httpServerConfig{WriteTimeout: 15}}
+	defer func() { config = nil }()
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	tests := []struct {
+		name       string
+		protoMajor int
+		want       net.Conn
+	}{
+		{"HTTP/1.1", 1, conn},
+		{"HTTP/2", 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			r.ProtoMajor = tt.protoMajor
+			r = r.WithContext(context.WithValue(r.Context(), connContextKey{}, conn))
+			if d := newWriteDeadline(r); d.conn != tt.want {
+				t.Errorf("deadline applies to %v, want %v", d.conn, tt.want)
+			}
+		})
+	}
+}
+
+// TestRunAPIHandler_longWatch streams a response for longer than the write
+// timeout, as a watch does, with each chunk arriving well within it.
+func TestRunAPIHandler_longWatch(t *testing.T) {
+	config = &ControllerConfig{
+		Timeouts:   timeoutConfig{RequestTimeout: 5},
+		HTTPServer: httpServerConfig{WriteTimeout: 1},
+	}
+	defer func() { config = nil }()
+
+	const chunks = 6
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		go func() {
+			msg.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+					HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: 200, ContentLength: -1},
+				},
+			}
+			for i := 0; i <= chunks; i++ {
+				body := []byte(fmt.Sprintf("event %d\n", i))
+				if i == chunks {
+					body = nil
+				}
+				msg.Out <- &tunnel.AgentToControllerWrapper{
+					Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{
+						HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: msg.Cmd.Id, Body: body},
+					},
+				}
+				time.Sleep(400 * time.Millisecond)
+			}
+		}()
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runAPIHandler(ep, w, r)
+	}))
+	configureHTTPServer("watch-test", srv.Config, true)
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/pods?watch=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("watch was cut off after %q: %v", body, err)
+	}
+	if n := strings.Count(string(body), "event"); n != chunks {
+		t.Errorf("got %d events, want %d: %q", n, chunks, body)
+	}
+	if got := testutil.ToFloat64(httpConnectionsGauge.WithLabelValues("watch-test")); got != 1 {
+		t.Errorf("open connections = %v, want 1", got)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/secrets"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How long to wait before watching a Kubernetes secret or ConfigMap again
+// after the watch fails or ends.
+const secretWatchRetry = 10 * time.Second
+
+// keySource reads the service keys, each named by its key ID.
+type keySource interface {
+	Keys() (map[string][]byte, error)
+
+	// Changes returns a channel which receives whenever the keys may
+	// have changed, until ctx is done.
+	Changes(ctx context.Context) <-chan struct{}
+
+	String() string
+}
+
+// dirKeySource reads each key from a file named for it, such as a mounted
+// Kubernetes secret.  The directory is checked for changes every interval.
+type dirKeySource struct {
+	path     string
+	interval time.Duration
+}
+
+func (s *dirKeySource) Keys() (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	err := filepath.WalkDir(s.path, func(path string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Type().IsRegular() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		keys[info.Name()] = content
+		return nil
+	})
+	return keys, err
+}
+
+func (s *dirKeySource) Changes(ctx context.Context) <-chan struct{} {
+	return pollChanges(ctx, s.interval)
+}
+
+func (s *dirKeySource) String() string {
+	return fmt.Sprintf("directory %s", s.path)
+}
+
+// secretKeySource reads each key from an item in a Kubernetes secret,
+// which is watched for changes.
+type secretKeySource struct {
+	loader    *secrets.KubernetesSecretLoader
+	namespace string
+	name      string
+	retry     time.Duration
+}
+
+func (s *secretKeySource) Keys() (map[string][]byte, error) {
+	data, err := s.loader.GetSecret(s.name)
+	if err != nil {
+		return nil, err
+	}
+	return *data, nil
+}
+
+func (s *secretKeySource) Changes(ctx context.Context) <-chan struct{} {
+	return watchChanges(ctx, s, s.retry, func(ctx context.Context) (watch.Interface, error) {
+		return s.loader.WatchSecret(ctx, s.name)
+	})
+}
+
+func (s *secretKeySource) String() string {
+	return fmt.Sprintf("secret %s/%s", s.namespace, s.name)
+}
+
+// pollChanges returns a channel which receives every interval, until ctx
+// is done, for a source which cannot be watched.
+func pollChanges(ctx context.Context, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				notify(changes)
+			}
+		}
+	}()
+	return changes
+}
+
+// watchChanges returns a channel which receives whenever the Kubernetes
+// object watched by startWatch changes, until ctx is done.  The watch is
+// started again retry after it fails or ends.
+func watchChanges(ctx context.Context, source fmt.Stringer, retry time.Duration, startWatch func(context.Context) (watch.Interface, error)) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		for {
+			w, err := startWatch(ctx)
+			if err != nil {
+				util.Warnf("Unable to watch %s: %v", source, err)
+			} else {
+				for event := range w.ResultChan() {
+					if event.Type != watch.Error {
+						notify(changes)
+					}
+				}
+				w.Stop()
+				// Anything missed while the watch is re-established
+				// is picked up by checking once it is.
+				notify(changes)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+		}
+	}()
+	return changes
+}
+
+// notify sends on changes unless a change is already waiting to be seen.
+func notify(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// makeKeySource returns where the service keys are read from: the
+// configured Kubernetes secret, or the files in serviceAuthPath if no
+// secret is named.  The secret's namespace defaults to the controller's own.
+func makeKeySource(config *ControllerConfig) (keySource, error) {
+	c := config.ServiceAuth
+	if c.SecretName == "" {
+		return &dirKeySource{path: serviceAuthPath, interval: config.GetServiceKeyReloadInterval()}, nil
+	}
+	namespace := c.SecretNamespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("serviceAuth.secretNamespace not set, and POD_NAMESPACE is not set to the pod's namespace")
+	}
+	loader, err := secrets.MakeKubernetesSecretLoader(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &secretKeySource{loader: loader, namespace: namespace, name: c.SecretName, retry: secretWatchRetry}, nil
+}
+
+// loadKeyset loads the service keys from source, returning them as they
+// were read.
+func loadKeyset(keyset *jwtutil.Keyset, source keySource) (map[string][]byte, error) {
+	keys, err := source.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("while reading service keys from %s: %v", source, err)
+	}
+	if err := keyset.Load(keys); err != nil {
+		return nil, fmt.Errorf("while loading service keys from %s: %v", source, err)
+	}
+	util.Infof("Loaded %d service keys from %s: %v", len(keys), source, keyset.Names())
+	return keys, nil
+}
+
+// watchKeyset reloads the service keys whenever they change, until ctx is
+// done.  loaded is the keys as last read.  A reload which fails, such as
+// one which would remove the current key, leaves the keys as they were.
+func watchKeyset(ctx context.Context, keyset *jwtutil.Keyset, source keySource, loaded map[string][]byte) {
+	changes := source.Changes(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+		}
+		loaded = reloadKeyset(keyset, source, loaded)
+	}
+}
+
+// reloadKeyset loads the keys from source if they differ from loaded,
+// returning the keys read.
+func reloadKeyset(keyset *jwtutil.Keyset, source keySource, loaded map[string][]byte) map[string][]byte {
+	keys, err := source.Keys()
+	if err != nil {
+		util.Errorf("Unable to reload service keys from %s: %v", source, err)
+		serviceKeysetReloadsCounter.WithLabelValues("error").Inc()
+		return loaded
+	}
+	if reflect.DeepEqual(keys, loaded) {
+		return loaded
+	}
+	if err := keyset.Load(keys); err != nil {
+		util.Errorf("Rejected service keys from %s: %v", source, err)
+		serviceKeysetReloadsCounter.WithLabelValues("rejected").Inc()
+		return keys
+	}
+	util.Infof("Reloaded %d service keys from %s: %v", len(keys), source, keyset.Names())
+	serviceKeysetReloadsCounter.WithLabelValues("success").Inc()
+	return keys
+}
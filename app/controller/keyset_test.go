@@ -0,0 +1,148 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/secrets"
+)
+
+func TestDirKeySource_Keys(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "key1"), []byte("key 1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "..2021_06_01"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "..2021_06_01", "key2"), []byte("key 2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := &dirKeySource{path: dir, interval: time.Minute}
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"key1": []byte("key 1"), "key2": []byte("key 2")}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+}
+
+// fakeKeySource returns keys, or err if it is set.
+type fakeKeySource struct {
+	keys map[string][]byte
+	err  error
+}
+
+func (s *fakeKeySource) Keys() (map[string][]byte, error)            { return s.keys, s.err }
+func (s *fakeKeySource) Changes(ctx context.Context) <-chan struct{} { return nil }
+func (s *fakeKeySource) String() string                              { return "fake" }
+
+func TestReloadKeyset(t *testing.T) {
+	keyset := jwtutil.NewKeyset("key1")
+	loaded := map[string][]byte{"key1": []byte("key 1")}
+	if err := keyset.Load(loaded); err != nil {
+		t.Fatal(err)
+	}
+	count := func(result string) float64 {
+		return testutil.ToFloat64(serviceKeysetReloadsCounter.WithLabelValues(result))
+	}
+
+	tests := []struct {
+		name       string
+		source     *fakeKeySource
+		wantResult string
+		wantNames  []string
+	}{
+		{"unchanged", &fakeKeySource{keys: map[string][]byte{"key1": []byte("key 1")}}, "", []string{"key1"}},
+		{"unreadable", &fakeKeySource{err: errors.New("gone")}, "error", []string{"key1"}},
+		{"key added", &fakeKeySource{keys: map[string][]byte{"key1": []byte("key 1"), "key2": []byte("key 2")}}, "success", []string{"key1", "key2"}},
+		{"current key removed", &fakeKeySource{keys: map[string][]byte{"key2": []byte("key 2")}}, "rejected", []string{"key1", "key2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]float64{}
+			for _, result := range []string{"success", "rejected", "error"} {
+				before[result] = count(result)
+			}
+			loaded = reloadKeyset(keyset, tt.source, loaded)
+			for result, n := range before {
+				want := 0.0
+				if result == tt.wantResult {
+					want = 1
+				}
+				if got := count(result) - n; got != want {
+					t.Errorf("%s reloads increased by %v, want %v", result, got, want)
+				}
+			}
+			if got := keyset.Names(); !reflect.DeepEqual(got, tt.wantNames) {
+				t.Errorf("Names() = %v, want %v", got, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestWatchKeyset_secret(t *testing.T) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "service-keys", Namespace: "ns1"},
+		Data:       map[string][]byte{"key1": []byte("key 1")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	source := &secretKeySource{
+		loader:    secrets.MakeKubernetesSecretLoaderFromClientset("ns1", client),
+		namespace: "ns1",
+		name:      "service-keys",
+		retry:     10 * time.Millisecond,
+	}
+	keyset := jwtutil.NewKeyset("key1")
+	loaded, err := loadKeyset(keyset, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchKeyset(ctx, keyset, source, loaded)
+
+	secret.Data = map[string][]byte{"key1": []byte("key 1"), "key2": []byte("key 2")}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(keyset.Names(), []string{"key1", "key2"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("keys were not reloaded, have %v", keyset.Names())
+		}
+		// The watch may not have started before the first update.
+		if _, err := client.CoreV1().Secrets("ns1").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
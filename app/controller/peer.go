@@ -0,0 +1,682 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/proto"
+)
+
+// Peer controllers exchange the list of agents directly connected to each,
+// and forward requests for agents which are not connected locally.  A peer
+// only delivers forwarded requests to its own agents, so a request crosses
+// at most one tunnel; maxPeerHops enforces this should a peer not.
+
+const (
+	maxPeerHops        = 1
+	peerReconnectDelay = 10 * time.Second
+)
+
+var (
+	errPeerTunnelClosed = errors.New("peer tunnel closed")
+
+	peerRequestsReceivedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_peer_requests_received_total",
+		Help: "The total number of requests forwarded to this controller by a peer",
+	}, []string{"peer"})
+)
+
+// peerStream is common to the server and client ends of a peer tunnel.
+type peerStream interface {
+	Send(*tunnel.PeerWrapper) error
+	Recv() (*tunnel.PeerWrapper, error)
+}
+
+// outboundRequest is a request sent to a peer, and the session of the
+// peer agent it was sent to.
+type outboundRequest struct {
+	t         pendingTransaction
+	session   string
+	agentName string
+}
+
+// peerTunnel is a connection to a peer controller.  Either end may forward
+// requests to the other.
+type peerTunnel struct {
+	name   string
+	stream peerStream
+
+	// sendLock serializes sends, and closed stops them once the tunnel
+	// has ended, as the stream may not be used after that.
+	sendLock sync.Mutex
+	closed   bool
+
+	// out carries messages for every agent the peer advertised.
+	out *agent.PeerQueue
+
+	// remote holds the agents the peer advertised, by their session on the
+	// peer.  It is only used by the receiving goroutine.
+	remote map[string]*agent.PeerAgent
+
+	// outbound holds the requests we sent to the peer.
+	outboundLock sync.Mutex
+	outbound     map[string]outboundRequest
+
+	// inbound holds the requests the peer sent to our agents.
+	inboundLock sync.Mutex
+	inbound     map[string]agent.Search
+}
+
+func newPeerTunnel(name string, stream peerStream) *peerTunnel {
+	return &peerTunnel{
+		name:     name,
+		stream:   stream,
+		out:      agent.NewPeerQueue(1),
+		remote:   make(map[string]*agent.PeerAgent),
+		outbound: make(map[string]outboundRequest),
+		inbound:  make(map[string]agent.Search),
+	}
+}
+
+func (t *peerTunnel) send(msg *tunnel.PeerWrapper) error {
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+	if t.closed {
+		return errPeerTunnelClosed
+	}
+	return t.stream.Send(msg)
+}
+
+func (t *peerTunnel) sendError(id string, status int, message string) {
+	msg := &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_HttpError{
+			HttpError: &tunnel.HttpError{Id: id, Status: int32(status), Message: message},
+		},
+	}
+	if err := t.send(msg); err != nil {
+		util.Warnf("Unable to send error to peer %s for HTTP request %s: %v", t.name, id, err)
+	}
+}
+
+// makePeerAdvertisement lists the agents directly connected to us.
+func makePeerAdvertisement(infos []fwdapi.AgentInfo) *tunnel.PeerWrapper {
+	adv := &tunnel.PeerAdvertisement{}
+	for _, info := range infos {
+		if info.Peer != "" {
+			continue
+		}
+		endpoints := make([]*tunnel.EndpointHealth, len(info.Endpoints))
+		for i, ep := range info.Endpoints {
+			endpoints[i] = &tunnel.EndpointHealth{
+				Name:       ep.Name,
+				Type:       ep.Type,
+				Configured: ep.Configured,
+				Namespaces: ep.Namespaces,
+				TlsMode:    ep.TLSMode,
+			}
+		}
+		adv.Agents = append(adv.Agents, &tunnel.PeerAgent{
+			Name:      info.Name,
+			Session:   info.Session,
+			Endpoints: endpoints,
+			Version:   info.Version,
+			Commit:    info.Commit,
+			BuildDate: info.BuildDate,
+		})
+	}
+	return &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_Advertisement{Advertisement: adv},
+	}
+}
+
+// advertiseAgents sends our directly connected agents to the peer, and
+// again whenever they change, until ctx is done.
+func (t *peerTunnel) advertiseAgents(ctx context.Context) {
+	var last *tunnel.PeerWrapper
+	for {
+		changed := agents.Changed()
+		msg := makePeerAdvertisement(agents.GetAgents())
+		if last == nil || !proto.Equal(msg, last) {
+			if err := t.send(msg); err != nil {
+				util.Warnf("Unable to advertise agents to peer %s: %v", t.name, err)
+				return
+			}
+			last = msg
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// updateAgents makes the agents the peer advertised available to route
+// requests to, and removes those it no longer has.
+func (t *peerTunnel) updateAgents(adv *tunnel.PeerAdvertisement) {
+	seen := map[string]bool{}
+	for _, a := range adv.Agents {
+		seen[a.Session] = true
+		if _, found := t.remote[a.Session]; found {
+			continue
+		}
+		endpoints := make([]agent.Endpoint, len(a.Endpoints))
+		for i, ep := range a.Endpoints {
+			endpoints[i] = agent.Endpoint{
+				Name:       ep.Name,
+				Type:       ep.Type,
+				Configured: ep.Configured,
+				Namespaces: ep.Namespaces,
+				TLSMode:    ep.TlsMode,
+			}
+		}
+		state := &agent.PeerAgent{
+			Name:          a.Name,
+			Session:       ulidContext.Ulid(),
+			RemoteSession: a.Session,
+			Peer:          t.name,
+			Endpoints:     endpoints,
+			Version:       a.Version,
+			Commit:        a.Commit,
+			BuildDate:     a.BuildDate,
+			ConnectedAt:   tunnel.Now(),
+			Out:           t.out,
+		}
+		t.remote[a.Session] = state
+		agents.AddAgent(state)
+	}
+	for session, state := range t.remote {
+		if !seen[session] {
+			t.removeAgent(state)
+			delete(t.remote, session)
+		}
+	}
+}
+
+// removeAgent stops routing to an agent on the peer, and closes the
+// requests sent to it.
+func (t *peerTunnel) removeAgent(state *agent.PeerAgent) {
+	if err := agents.RemoveAgent(state); err != nil {
+		util.Warnf("while removing agent: %v", err)
+	}
+	t.outboundLock.Lock()
+	defer t.outboundLock.Unlock()
+	for id, req := range t.outbound {
+		if req.session == state.Session {
+			req.t.Close()
+			delete(t.outbound, id)
+		}
+	}
+}
+
+func (t *peerTunnel) removeOutbound(id string) {
+	t.outboundLock.Lock()
+	defer t.outboundLock.Unlock()
+	if req, found := t.outbound[id]; found {
+		req.t.Close()
+		delete(t.outbound, id)
+	}
+}
+
+// handleRequests sends the messages for the peer's agents over the tunnel
+// until out is closed.
+func (t *peerTunnel) handleRequests() {
+	for m := range t.out.C {
+		switch value := m.(type) {
+		case *agent.PeerRequest:
+			t.forward(value)
+		case *agent.PeerCancel:
+			t.removeOutbound(value.ID)
+			msg := &tunnel.PeerWrapper{
+				Event: &tunnel.PeerWrapper_CancelRequest{
+					CancelRequest: &tunnel.CancelRequest{Id: value.ID},
+				},
+			}
+			if err := t.send(msg); err != nil {
+				util.Warnf("Unable to send to peer %s for cancel request %s", t.name, value.ID)
+			}
+		default:
+			util.Warnf("Got unexpected message type for peer %s: %T", t.name, m)
+		}
+	}
+}
+
+func (t *peerTunnel) forward(req *agent.PeerRequest) {
+	switch value := req.Message.(type) {
+	case *HTTPMessage:
+		if value.Upgrade {
+			value.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpError{
+					HttpError: &tunnel.HttpError{
+						Id:      value.Cmd.Id,
+						Status:  http.StatusBadGateway,
+						Message: "connection upgrades are not supported through a peer controller",
+					},
+				},
+			}
+			value.Close()
+			return
+		}
+		t.outboundLock.Lock()
+		t.outbound[value.Cmd.Id] = outboundRequest{t: value, session: req.Agent.Session, agentName: req.Agent.Name}
+		t.outboundLock.Unlock()
+		msg := &tunnel.PeerWrapper{
+			Event: &tunnel.PeerWrapper_HttpRequest{
+				HttpRequest: &tunnel.PeerHttpRequest{AgentName: req.Agent.Name, Request: value.Cmd, Hops: 1},
+			},
+		}
+		if err := t.send(msg); err != nil {
+			util.Warnf("Unable to send to peer %s for HTTP request %s", t.name, value.Cmd.Id)
+			t.removeOutbound(value.Cmd.Id)
+		}
+	case *httpRequestChunkMessage:
+		msg := &tunnel.PeerWrapper{
+			Event: &tunnel.PeerWrapper_HttpRequestChunk{HttpRequestChunk: value.chunk},
+		}
+		if err := t.send(msg); err != nil {
+			util.Warnf("Unable to send to peer %s for HTTP request body %s", t.name, value.chunk.Id)
+		}
+	case agent.Transaction:
+		// Commands are only run on directly connected agents.
+		util.Warnf("Not forwarding %T to peer %s", value, t.name)
+		value.Close()
+	default:
+		util.Debugf("Not forwarding %T to peer %s", value, t.name)
+	}
+}
+
+// deliver passes a reply from the peer to the handler waiting for it,
+// forgetting the request once the reply is the last.  The receive loop
+// never waits for the handler, so if more of the response is waiting than
+// may, the request is cancelled.
+func (t *peerTunnel) deliver(id string, in *tunnel.AgentToControllerWrapper, last bool) {
+	if t.queueReply(id, in, last) {
+		return
+	}
+	util.Warnf("Client is reading the response to HTTP request %s through peer %s too slowly, cancelling", id, t.name)
+	msg := &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_CancelRequest{
+			CancelRequest: &tunnel.CancelRequest{Id: id},
+		},
+	}
+	if err := t.send(msg); err != nil {
+		util.Warnf("Unable to send to peer %s for cancel request %s", t.name, id)
+	}
+}
+
+// queueReply queues a reply for the handler without waiting, returning
+// false if there was no room, in which case the handler's request is
+// closed.  Replies from a peer are never paused, but are counted, as the
+// handler counts them as it takes them.
+func (t *peerTunnel) queueReply(id string, in *tunnel.AgentToControllerWrapper, last bool) bool {
+	t.outboundLock.Lock()
+	defer t.outboundLock.Unlock()
+	req, found := t.outbound[id]
+	if !found {
+		util.Warnf("Got response to unknown HTTP request id %s from peer %s", id, t.name)
+		return true
+	}
+	queued := true
+	if m, ok := req.t.(*HTTPMessage); ok && m.buffer != nil {
+		queued = m.buffer.queued(len(in.GetHttpChunkedResponse().GetBody()), req.agentName, nil)
+	}
+	if queued {
+		select {
+		case req.t.replies() <- in:
+			if last {
+				delete(t.outbound, id)
+			}
+			return true
+		default:
+		}
+	}
+	responseBufferOverflowsCounter.WithLabelValues(req.agentName).Inc()
+	req.t.Close()
+	delete(t.outbound, id)
+	return false
+}
+
+// receiveRequest sends a request from the peer to one of our directly
+// connected agents, and relays the replies back.
+func (t *peerTunnel) receiveRequest(req *tunnel.PeerHttpRequest) {
+	peerRequestsReceivedCounter.WithLabelValues(t.name).Inc()
+	id := req.Request.Id
+	if req.Hops > maxPeerHops {
+		t.sendError(id, http.StatusLoopDetected, "request forwarded through too many controllers")
+		return
+	}
+	ep := agent.Search{
+		Name:         req.AgentName,
+		EndpointType: req.Request.Type,
+		EndpointName: req.Request.Name,
+		DirectOnly:   true,
+	}
+	message := newHTTPMessage(req.Request, false)
+	session, err := agents.Send(ep, message)
+	if err != nil {
+		status := http.StatusBadGateway
+		switch err.(type) {
+		case *agent.BusyError, *agent.QueueFullError:
+			status = http.StatusServiceUnavailable
+		}
+		t.sendError(id, status, err.Error())
+		return
+	}
+	ep.Session = session
+	t.inboundLock.Lock()
+	t.inbound[id] = ep
+	t.inboundLock.Unlock()
+	go t.relayReplies(ep, message)
+}
+
+func (t *peerTunnel) findInbound(id string) (agent.Search, bool) {
+	t.inboundLock.Lock()
+	defer t.inboundLock.Unlock()
+	ep, found := t.inbound[id]
+	return ep, found
+}
+
+// removeInbound forgets a request from the peer, returning false if it was
+// already gone.
+func (t *peerTunnel) removeInbound(id string) bool {
+	t.inboundLock.Lock()
+	defer t.inboundLock.Unlock()
+	_, found := t.inbound[id]
+	delete(t.inbound, id)
+	return found
+}
+
+func (t *peerTunnel) relayReplies(ep agent.Search, message *HTTPMessage) {
+	id := message.Cmd.Id
+	defer agents.Complete(ep, id)
+	finished := false
+	for !finished {
+		in, more := <-message.Out
+		if !more {
+			break
+		}
+		message.taken(in)
+		msg := &tunnel.PeerWrapper{}
+		switch x := in.Event.(type) {
+		case *tunnel.AgentToControllerWrapper_HttpResponse:
+			msg.Event = &tunnel.PeerWrapper_HttpResponse{HttpResponse: x.HttpResponse}
+			finished = x.HttpResponse.ContentLength == 0
+		case *tunnel.AgentToControllerWrapper_HttpChunkedResponse:
+			msg.Event = &tunnel.PeerWrapper_HttpChunkedResponse{HttpChunkedResponse: x.HttpChunkedResponse}
+			finished = len(x.HttpChunkedResponse.Body) == 0
+		case *tunnel.AgentToControllerWrapper_HttpError:
+			msg.Event = &tunnel.PeerWrapper_HttpError{HttpError: x.HttpError}
+			finished = true
+		default:
+			util.Warnf("Not relaying %T to peer %s", x, t.name)
+			continue
+		}
+		if err := t.send(msg); err != nil {
+			util.Warnf("Unable to relay response to peer %s for HTTP request %s: %v", t.name, id, err)
+		}
+	}
+	if t.removeInbound(id) && !finished {
+		t.sendError(id, http.StatusBadGateway, "agent went away before responding")
+	}
+}
+
+// run handles the tunnel until the stream fails or ctx is done.  The
+// peer's agents are then removed, and any requests in either direction
+// are ended.
+func (t *peerTunnel) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go t.handleRequests()
+	go t.advertiseAgents(ctx)
+	defer t.close()
+
+	for {
+		in, err := t.stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch x := in.Event.(type) {
+		case *tunnel.PeerWrapper_Advertisement:
+			t.updateAgents(x.Advertisement)
+		case *tunnel.PeerWrapper_HttpRequest:
+			t.receiveRequest(x.HttpRequest)
+		case *tunnel.PeerWrapper_HttpRequestChunk:
+			chunk := x.HttpRequestChunk
+			ep, found := t.findInbound(chunk.Id)
+			if !found {
+				util.Warnf("Got body for unknown HTTP request id %s from peer %s", chunk.Id, t.name)
+				continue
+			}
+			if err := agents.SendToSession(ep, &httpRequestChunkMessage{chunk: chunk, endpointType: ep.EndpointType}); err != nil {
+				util.Warnf("while sending request body: %v", err)
+			}
+		case *tunnel.PeerWrapper_CancelRequest:
+			id := x.CancelRequest.Id
+			ep, found := t.findInbound(id)
+			if found && t.removeInbound(id) {
+				if err := agents.Cancel(ep, id); err != nil {
+					util.Warnf("while cancelling http request: %v", err)
+				}
+			}
+		case *tunnel.PeerWrapper_HttpResponse:
+			resp := x.HttpResponse
+			reply := &tunnel.AgentToControllerWrapper{Event: &tunnel.AgentToControllerWrapper_HttpResponse{HttpResponse: resp}}
+			t.deliver(resp.Id, reply, resp.ContentLength == 0)
+		case *tunnel.PeerWrapper_HttpChunkedResponse:
+			resp := x.HttpChunkedResponse
+			reply := &tunnel.AgentToControllerWrapper{Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{HttpChunkedResponse: resp}}
+			t.deliver(resp.Id, reply, len(resp.Body) == 0)
+		case *tunnel.PeerWrapper_HttpError:
+			resp := x.HttpError
+			reply := &tunnel.AgentToControllerWrapper{Event: &tunnel.AgentToControllerWrapper_HttpError{HttpError: resp}}
+			t.deliver(resp.Id, reply, true)
+		case nil:
+			// ignore for now
+		default:
+			util.Warnf("Received unknown message from peer %s: %T", t.name, x)
+		}
+	}
+}
+
+func (t *peerTunnel) close() {
+	t.sendLock.Lock()
+	t.closed = true
+	t.sendLock.Unlock()
+
+	for session, state := range t.remote {
+		t.removeAgent(state)
+		delete(t.remote, session)
+	}
+	t.outboundLock.Lock()
+	for id, req := range t.outbound {
+		req.t.Close()
+		delete(t.outbound, id)
+	}
+	t.outboundLock.Unlock()
+
+	t.inboundLock.Lock()
+	inbound := t.inbound
+	t.inbound = make(map[string]agent.Search)
+	t.inboundLock.Unlock()
+	for id, ep := range inbound {
+		if err := agents.Cancel(ep, id); err != nil {
+			util.Warnf("while cancelling http request: %v", err)
+		}
+	}
+
+	// Nothing is routed to the peer's agents once they are removed.
+	t.out.Close()
+}
+
+type peerTunnelServer struct {
+	tunnel.UnimplementedPeerTunnelServiceServer
+}
+
+// EventTunnel runs in its own goroutine, one per GRPC connection from a peer.
+func (s *peerTunnelServer) EventTunnel(stream tunnel.PeerTunnelService_EventTunnelServer) error {
+	names, err := getCertificateNameFromContext(stream.Context())
+	if err != nil {
+		return err
+	}
+	if names.Purpose != ca.CertificatePurposeControl {
+		return fmt.Errorf("not a control certificate")
+	}
+	util.Infof("Peer %s connected", names.Name)
+	err = newPeerTunnel(names.Name, stream).run(stream.Context())
+	util.Infof("Peer %s disconnected: %v", names.Name, err)
+	return err
+}
+
+func runPeerGRPCServer(ctx context.Context, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	util.Infof("Starting Peer GRPC server on port %d...", config.PeerListenPort)
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.PeerListenPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+
+	certPool, err := authority.MakeCertPool()
+	if err != nil {
+		return fmt.Errorf("while making certpool: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		ClientCAs:             certPool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		GetCertificate:        getCertificate,
+		MinVersion:            tls.VersionTLS13,
+		VerifyPeerCertificate: authority.VerifyPeerCertificate,
+	}
+	config.TLS.Apply(tlsConfig)
+	creds := credentials.NewTLS(tlsConfig)
+	grpcServer := grpc.NewServer(append(grpcMetricsOptions(), grpc.Creds(creds))...)
+	tunnel.RegisterPeerTunnelServiceServer(grpcServer, &peerTunnelServer{})
+	return runGRPCServer(ctx, "Peer", grpcServer, lis, func() {})
+}
+
+// makePeerClientCert issues the control certificate this controller
+// presents to its peers, named for the host it runs on.  With an external
+// PKI, the configured peer certificate is loaded instead.
+func makePeerClientCert() (*tls.Certificate, error) {
+	if external, ok := authority.(*ca.ReadOnlyCA); ok {
+		return external.LoadPeerCert()
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	name := ca.CertificateName{Name: hostname, Purpose: ca.CertificatePurposeControl}
+	_, cert64, key64, err := authority.GenerateCertificate(name, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(key64)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// runPeerConnections keeps a tunnel open to each configured peer until
+// ctx is done.
+func runPeerConnections(ctx context.Context) error {
+	clientCert, err := makePeerClientCert()
+	if err != nil {
+		return fmt.Errorf("while making peer certificate: %v", err)
+	}
+	certPool, err := authority.MakeCertPool()
+	if err != nil {
+		return fmt.Errorf("while making certpool: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*clientCert},
+		RootCAs:      certPool,
+		MinVersion:   tls.VersionTLS13,
+	}
+	config.TLS.Apply(tlsConfig)
+	creds := credentials.NewTLS(tlsConfig)
+
+	var wg sync.WaitGroup
+	for _, peer := range config.Peers {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			for {
+				err := connectToPeer(ctx, address, creds)
+				if ctx.Err() != nil {
+					return
+				}
+				util.Warnf("Peer %s tunnel failed: %v, reconnecting in %s", address, err, peerReconnectDelay)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(peerReconnectDelay):
+				}
+			}
+		}(peer.Address)
+	}
+	wg.Wait()
+	return nil
+}
+
+// connectToPeer dials a peer and runs a single tunnel session.
+func connectToPeer(ctx context.Context, address string, creds credentials.TransportCredentials) error {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, address, grpc.WithTransportCredentials(creds), grpc.WithBlock())
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := tunnel.NewPeerTunnelServiceClient(conn).EventTunnel(ctx)
+	if err != nil {
+		return fmt.Errorf("EventTunnel(): %v", err)
+	}
+	util.Infof("Connected to peer %s", address)
+	return newPeerTunnel(address, stream).run(ctx)
+}
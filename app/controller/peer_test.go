@@ -0,0 +1,331 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+// fakePeerStream is the far end of a peer tunnel, driven by the test.
+type fakePeerStream struct {
+	in   chan *tunnel.PeerWrapper
+	sent chan *tunnel.PeerWrapper
+}
+
+func newFakePeerStream() *fakePeerStream {
+	return &fakePeerStream{
+		in:   make(chan *tunnel.PeerWrapper),
+		sent: make(chan *tunnel.PeerWrapper, 10),
+	}
+}
+
+func (s *fakePeerStream) Send(msg *tunnel.PeerWrapper) error {
+	s.sent <- msg
+	return nil
+}
+
+func (s *fakePeerStream) Recv() (*tunnel.PeerWrapper, error) {
+	msg, ok := <-s.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+// next returns the next message sent to the peer, other than advertisements.
+func (s *fakePeerStream) next(t *testing.T) *tunnel.PeerWrapper {
+	t.Helper()
+	for {
+		select {
+		case msg := <-s.sent:
+			if msg.GetAdvertisement() == nil {
+				return msg
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nothing sent to the peer")
+		}
+	}
+}
+
+func startPeerTunnel(t *testing.T) (*fakePeerStream, func()) {
+	stream := newFakePeerStream()
+	done := make(chan struct{})
+	go func() {
+		_ = newPeerTunnel("peer1", stream).run(context.Background())
+		close(done)
+	}()
+	return stream, func() {
+		close(stream.in)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("peer tunnel did not stop")
+		}
+	}
+}
+
+func peerAgentCount() int {
+	n := 0
+	for _, info := range agents.GetAgents() {
+		if info.Peer == "peer1" {
+			n++
+		}
+	}
+	return n
+}
+
+func waitForPeerAgents(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for peerAgentCount() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d peer agents, have %d", want, peerAgentCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeerTunnel_forward(t *testing.T) {
+	config = &ControllerConfig{MaxRequestBodyBytes: 1024}
+	defer func() { config = nil }()
+
+	stream, stop := startPeerTunnel(t)
+	stream.in <- &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_Advertisement{
+			Advertisement: &tunnel.PeerAdvertisement{
+				Agents: []*tunnel.PeerAgent{{
+					Name:      "agent1",
+					Session:   "remote1",
+					Endpoints: []*tunnel.EndpointHealth{{Name: "ep1", Type: "kubernetes", Configured: true}},
+				}},
+			},
+		},
+	}
+	waitForPeerAgents(t, 1)
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		runAPIHandler(ep, w, httptest.NewRequest("GET", "https://localhost/api", nil))
+		close(done)
+	}()
+
+	req := stream.next(t).GetHttpRequest()
+	if req == nil || req.AgentName != "agent1" || req.Hops != 1 {
+		t.Fatalf("expected a forwarded request for agent1, got %v", req)
+	}
+	stream.in <- &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_HttpResponse{
+			HttpResponse: &tunnel.HttpResponse{Id: req.Request.Id, Status: http.StatusTeapot},
+		},
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("runAPIHandler did not return")
+	}
+	if w.Code != http.StatusTeapot {
+		t.Errorf("expected status %d, got %d", http.StatusTeapot, w.Code)
+	}
+
+	// The agent is withdrawn when the peer stops advertising it, and
+	// everything is removed when the tunnel closes.
+	stream.in <- &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_Advertisement{Advertisement: &tunnel.PeerAdvertisement{}},
+	}
+	waitForPeerAgents(t, 0)
+	stream.in <- &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_Advertisement{
+			Advertisement: &tunnel.PeerAdvertisement{
+				Agents: []*tunnel.PeerAgent{{Name: "agent1", Session: "remote2"}},
+			},
+		},
+	}
+	waitForPeerAgents(t, 1)
+	stop()
+	waitForPeerAgents(t, 0)
+}
+
+func TestPeerTunnel_receive(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		go func() {
+			msg.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+					HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: http.StatusOK},
+				},
+			}
+		}()
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	stream, stop := startPeerTunnel(t)
+	defer stop()
+
+	tests := []struct {
+		name       string
+		agentName  string
+		hops       uint32
+		wantStatus int32
+	}{
+		{"delivered", "agent1", 1, http.StatusOK},
+		{"unknown agent", "agent2", 1, http.StatusBadGateway},
+		{"too many hops", "agent1", 2, http.StatusLoopDetected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := ulidContext.Ulid()
+			stream.in <- &tunnel.PeerWrapper{
+				Event: &tunnel.PeerWrapper_HttpRequest{
+					HttpRequest: &tunnel.PeerHttpRequest{
+						AgentName: tt.agentName,
+						Request:   &tunnel.HttpRequest{Id: id, Type: "kubernetes", Name: "ep1", Method: "GET", URI: "/api"},
+						Hops:      tt.hops,
+					},
+				},
+			}
+			msg := stream.next(t)
+			var status int32
+			switch x := msg.Event.(type) {
+			case *tunnel.PeerWrapper_HttpResponse:
+				if x.HttpResponse.Id != id {
+					t.Errorf("response for wrong request %s", x.HttpResponse.Id)
+				}
+				status = x.HttpResponse.Status
+			case *tunnel.PeerWrapper_HttpError:
+				if x.HttpError.Id != id {
+					t.Errorf("error for wrong request %s", x.HttpError.Id)
+				}
+				status = x.HttpError.Status
+			default:
+				t.Fatalf("unexpected reply %T", x)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, status)
+			}
+		})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for agents.Outstanding(state.Session) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no outstanding transactions, got %d", agents.Outstanding(state.Session))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMakePeerAdvertisement_buildInfo(t *testing.T) {
+	infos := []fwdapi.AgentInfo{
+		{Name: "agent1", Session: "session1", Version: "1.2.3", Commit: "abc123", BuildDate: "2021-06-01T00:00:00Z"},
+		{Name: "agent2", Session: "session2", Peer: "controller2"},
+	}
+	adv := makePeerAdvertisement(infos).GetAdvertisement()
+	if len(adv.Agents) != 1 {
+		t.Fatalf("expected only the directly connected agent, got %d", len(adv.Agents))
+	}
+	a := adv.Agents[0]
+	if a.Version != "1.2.3" || a.Commit != "abc123" || a.BuildDate != "2021-06-01T00:00:00Z" {
+		t.Errorf("build information not advertised: %v", a)
+	}
+}
+
+// stalledWriter is a ResponseWriter whose writes wait until unblock is
+// closed, as for a client which has stopped reading.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	unblock chan struct{}
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return w.ResponseRecorder.Write(b)
+}
+
+// TestPeerTunnel_stalledClient checks that a client which stops reading
+// does not hold up the peer tunnel, but has its request cancelled.
+func TestPeerTunnel_stalledClient(t *testing.T) {
+	config = &ControllerConfig{MaxRequestBodyBytes: 1024, ResponseBuffer: responseBufferConfig{MaxChunks: 2}}
+	defer func() { config = nil }()
+
+	stream, stop := startPeerTunnel(t)
+	defer stop()
+	stream.in <- &tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_Advertisement{
+			Advertisement: &tunnel.PeerAdvertisement{
+				Agents: []*tunnel.PeerAgent{{
+					Name:      "agent1",
+					Session:   "remote1",
+					Endpoints: []*tunnel.EndpointHealth{{Name: "ep1", Type: "kubernetes", Configured: true}},
+				}},
+			},
+		},
+	}
+	waitForPeerAgents(t, 1)
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	w := &stalledWriter{ResponseRecorder: httptest.NewRecorder(), unblock: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		runAPIHandler(ep, w, httptest.NewRequest("GET", "https://localhost/api", nil))
+		close(done)
+	}()
+
+	id := stream.next(t).GetHttpRequest().Request.Id
+	send := func(msg *tunnel.PeerWrapper) {
+		t.Helper()
+		select {
+		case stream.in <- msg:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("peer tunnel stopped receiving")
+		}
+	}
+	send(&tunnel.PeerWrapper{
+		Event: &tunnel.PeerWrapper_HttpResponse{
+			HttpResponse: &tunnel.HttpResponse{Id: id, Status: http.StatusOK, ContentLength: -1},
+		},
+	})
+	for i := 0; i < 10; i++ {
+		send(&tunnel.PeerWrapper{
+			Event: &tunnel.PeerWrapper_HttpChunkedResponse{
+				HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: id, Body: []byte("data")},
+			},
+		})
+	}
+	if cancel := stream.next(t).GetCancelRequest(); cancel == nil || cancel.Id != id {
+		t.Errorf("expected a cancel request for %s, got %v", id, cancel)
+	}
+
+	close(w.unblock)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("runAPIHandler did not return")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+var (
+	// serviceRateLimiter limits the rate of service API requests made with
+	// each credential.  If nil, there is no limit.
+	serviceRateLimiter *rateLimiter
+
+	// agentConcurrency limits the requests in progress to each agent.  If
+	// nil, there is no limit.
+	agentConcurrency *concurrencyLimiter
+)
+
+// configureRateLimits sets up the service API limits from the config.
+func configureRateLimits(c rateLimitConfig) {
+	serviceRateLimiter = newRateLimiter(c)
+	if c.MaxConcurrentPerAgent > 0 {
+		agentConcurrency = newConcurrencyLimiter(c.MaxConcurrentPerAgent)
+	}
+	agents.SetLimits(agent.Limits{MaxPerSession: c.MaxOutstandingPerSession, MaxTotal: c.MaxOutstanding})
+	agents.SetSendTimeout(c.GetSessionSendTimeout())
+}
+
+// updateLimits applies the limits on outstanding transactions given in
+// req, and returns those now in force.
+func updateLimits(req fwdapi.LimitsRequest) fwdapi.LimitsResponse {
+	limits := agents.GetLimits()
+	if req.MaxOutstandingPerSession != nil {
+		limits.MaxPerSession = *req.MaxOutstandingPerSession
+	}
+	if req.MaxOutstanding != nil {
+		limits.MaxTotal = *req.MaxOutstanding
+	}
+	agents.SetLimits(limits)
+	return fwdapi.LimitsResponse{
+		MaxOutstandingPerSession: limits.MaxPerSession,
+		MaxOutstanding:           limits.MaxTotal,
+		Outstanding:              agents.TotalOutstanding(),
+	}
+}
+
+// rateLimitKey identifies a service credential.
+type rateLimitKey struct {
+	agent        string
+	endpointType string
+	endpointName string
+}
+
+func makeRateLimitKey(ep agent.Search) rateLimitKey {
+	return rateLimitKey{agent: ep.Name, endpointType: ep.EndpointType, endpointName: ep.EndpointName}
+}
+
+// rateLimit is a rate in requests per second, and the largest burst
+// allowed.  A zero rate is unlimited.
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+func makeRateLimit(requestsPerSecond float64, burst int) rateLimit {
+	if burst <= 0 {
+		burst = int(math.Ceil(requestsPerSecond))
+	}
+	return rateLimit{rate: requestsPerSecond, burst: float64(burst)}
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.  Each
+// request takes one token.
+type tokenBucket struct {
+	rateLimit
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if one is available.  If not, it returns how long
+// until one will be.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter keeps a token bucket for each credential which has a limit.
+type rateLimiter struct {
+	sync.Mutex
+	defaults  rateLimit
+	overrides map[rateLimitKey]rateLimit
+	buckets   map[rateLimitKey]*tokenBucket
+	now       func() time.Time
+}
+
+func newRateLimiter(c rateLimitConfig) *rateLimiter {
+	l := &rateLimiter{
+		defaults:  makeRateLimit(c.RequestsPerSecond, c.Burst),
+		overrides: map[rateLimitKey]rateLimit{},
+		buckets:   map[rateLimitKey]*tokenBucket{},
+		now:       time.Now,
+	}
+	for _, o := range c.Credentials {
+		key := rateLimitKey{agent: o.Agent, endpointType: o.Type, endpointName: o.Name}
+		l.overrides[key] = makeRateLimit(o.RequestsPerSecond, o.Burst)
+	}
+	return l
+}
+
+// allow takes a token for the credential, returning false and how long to
+// wait before retrying if there are none.
+func (l *rateLimiter) allow(ep agent.Search) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	key := makeRateLimitKey(ep)
+	l.Lock()
+	defer l.Unlock()
+	b, found := l.buckets[key]
+	if !found {
+		limit, found := l.overrides[key]
+		if !found {
+			limit = l.defaults
+		}
+		if limit.rate <= 0 {
+			return true, 0
+		}
+		b = &tokenBucket{rateLimit: limit, tokens: limit.burst, last: l.now()}
+		l.buckets[key] = b
+	}
+	ok, wait := b.take(l.now())
+	rateLimitTokensGauge.WithLabelValues(key.agent, key.endpointType, key.endpointName).Set(b.tokens)
+	return ok, wait
+}
+
+// concurrencyLimiter counts the requests in progress to each agent.
+type concurrencyLimiter struct {
+	sync.Mutex
+	max    int
+	active map[string]int
+}
+
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	return &concurrencyLimiter{max: max, active: map[string]int{}}
+}
+
+// acquire counts a request to the agent, returning false if it already
+// has the maximum in progress.  If it returns true, release must be called
+// when the request completes.
+func (l *concurrencyLimiter) acquire(name string) bool {
+	if l == nil {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.active[name] >= l.max {
+		return false
+	}
+	l.active[name]++
+	return true
+}
+
+func (l *concurrencyLimiter) release(name string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.active[name]--
+	if l.active[name] <= 0 {
+		delete(l.active, name)
+	}
+}
+
+// failThrottled rejects a request with 429 Too Many Requests, asking the
+// client to retry after wait, rounded up to a whole second.
+func failThrottled(w http.ResponseWriter, ep agent.Search, reason string, wait time.Duration) {
+	apiRequestsThrottledCounter.WithLabelValues(ep.Name, reason).Inc()
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	util.FailRequest(w, fmt.Errorf("too many requests for agent %s: %s limit exceeded", ep.Name, reason), http.StatusTooManyRequests)
+}
+
+// failBusy rejects a request with 503 Service Unavailable, as too many are
+// already waiting on the agent or the controller.  As with failNoAgent, the
+// body is not read.
+func failBusy(w http.ResponseWriter, r *http.Request, ep agent.Search, err *agent.BusyError, transactionID string) {
+	reason := "session"
+	if err.Global {
+		reason = "total"
+	}
+	apiRequestsThrottledCounter.WithLabelValues(ep.Name, reason).Inc()
+	if r.ContentLength != 0 {
+		w.Header().Set("Connection", "close")
+	}
+	w.Header().Set("Retry-After", "1")
+	util.FailRequestWithID(w, err, http.StatusServiceUnavailable, transactionID)
+}
+
+// failQueueFull rejects a request with 503 Service Unavailable, as the
+// chosen agent session's queue stayed full for the send timeout.  As with
+// failBusy, the body is not read.
+func failQueueFull(w http.ResponseWriter, r *http.Request, ep agent.Search, err *agent.QueueFullError, transactionID string) {
+	apiRequestsThrottledCounter.WithLabelValues(ep.Name, "queue").Inc()
+	if r.ContentLength != 0 {
+		w.Header().Set("Connection", "close")
+	}
+	w.Header().Set("Retry-After", "1")
+	util.FailRequestWithID(w, err, http.StatusServiceUnavailable, transactionID)
+}
@@ -0,0 +1,377 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimiter_allow(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{
+		RequestsPerSecond: 2,
+		Burst:             2,
+		Credentials: []credentialRateLimit{
+			{Agent: "agent1", Type: "jenkins", Name: "unlimited"},
+			{Agent: "agent1", Type: "jenkins", Name: "slow", RequestsPerSecond: 0.5},
+		},
+	})
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	byDefault := agent.Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "ci"}
+	other := agent.Search{Name: "agent2", EndpointType: "jenkins", EndpointName: "ci"}
+	unlimited := agent.Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "unlimited"}
+	slow := agent.Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "slow"}
+
+	steps := []struct {
+		name     string
+		advance  time.Duration
+		ep       agent.Search
+		wantOK   bool
+		wantWait time.Duration
+	}{
+		{"burst 1", 0, byDefault, true, 0},
+		{"burst 2", 0, byDefault, true, 0},
+		{"empty", 0, byDefault, false, 500 * time.Millisecond},
+		{"other credential has its own bucket", 0, other, true, 0},
+		{"partly refilled", 250 * time.Millisecond, byDefault, false, 250 * time.Millisecond},
+		{"refilled", 250 * time.Millisecond, byDefault, true, 0},
+		{"unlimited override", 0, unlimited, true, 0},
+		{"unlimited override again", 0, unlimited, true, 0},
+		{"slow override, burst defaults to 1", 0, slow, true, 0},
+		{"slow override empty", 0, slow, false, 2 * time.Second},
+		{"burst is not exceeded after idling", time.Hour, byDefault, true, 0},
+		{"burst is not exceeded after idling 2", 0, byDefault, true, 0},
+		{"burst is not exceeded after idling 3", 0, byDefault, false, 500 * time.Millisecond},
+	}
+	for _, s := range steps {
+		now = now.Add(s.advance)
+		ok, wait := l.allow(s.ep)
+		if ok != s.wantOK || wait != s.wantWait {
+			t.Errorf("%s: allow() = %v, %s, want %v, %s", s.name, ok, wait, s.wantOK, s.wantWait)
+		}
+	}
+
+	if got := testutil.ToFloat64(rateLimitTokensGauge.WithLabelValues("agent1", "jenkins", "ci")); got != 0 {
+		t.Errorf("expected 0 tokens left, got %g", got)
+	}
+}
+
+func TestRateLimiter_nil(t *testing.T) {
+	var l *rateLimiter
+	if ok, _ := l.allow(agent.Search{Name: "agent1"}); !ok {
+		t.Errorf("a nil rateLimiter should not limit")
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := newConcurrencyLimiter(2)
+	if !l.acquire("agent1") || !l.acquire("agent1") {
+		t.Fatalf("expected the first two requests to be allowed")
+	}
+	if l.acquire("agent1") {
+		t.Errorf("expected a third concurrent request to be refused")
+	}
+	if !l.acquire("agent2") {
+		t.Errorf("expected another agent to have its own limit")
+	}
+	l.release("agent1")
+	if !l.acquire("agent1") {
+		t.Errorf("expected a request to be allowed after one completed")
+	}
+	l.release("agent1")
+	l.release("agent1")
+	l.release("agent2")
+	if len(l.active) != 0 {
+		t.Errorf("expected no active requests, got %v", l.active)
+	}
+}
+
+func TestServiceAPIHandler_rateLimited(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+	serviceRateLimiter = newRateLimiter(rateLimitConfig{RequestsPerSecond: 0.1, Burst: 1})
+	defer func() { serviceRateLimiter = nil }()
+
+	key := useTestKeyset(t)
+	token, err := jwtutil.MakeJWT(key, testServiceTokenIdentity, "jenkins", "ratelimited", "agent1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := testutil.ToFloat64(apiRequestsThrottledCounter.WithLabelValues("agent1", "rate"))
+	codes := []int{}
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "https://localhost/api", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w = httptest.NewRecorder()
+		serviceAPIHandler(w, r)
+		codes = append(codes, w.Code)
+	}
+
+	// The first request uses the burst, and fails as agent1 is not
+	// connected.  The second is throttled.
+	if codes[0] != http.StatusBadGateway || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("expected statuses 502 and 429, got %v", codes)
+	}
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("expected Retry-After 10, got '%s'", got)
+	}
+	if got := testutil.ToFloat64(apiRequestsThrottledCounter.WithLabelValues("agent1", "rate")); got != before+1 {
+		t.Errorf("expected the throttled counter to increase by 1, got %g", got-before)
+	}
+}
+
+func TestRunAPIHandler_concurrencyLimit(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+	agentConcurrency = newConcurrencyLimiter(1)
+	defer func() { agentConcurrency = nil }()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	if !agentConcurrency.acquire(ep.Name) {
+		t.Fatalf("acquire failed")
+	}
+	w := httptest.NewRecorder()
+	runAPIHandler(ep, w, httptest.NewRequest("GET", "https://localhost/api", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got '%s'", got)
+	}
+
+	agentConcurrency.release(ep.Name)
+	w = httptest.NewRecorder()
+	runAPIHandler(ep, w, httptest.NewRequest("GET", "https://localhost/api", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected the request to reach the agent lookup once released, got %d", w.Code)
+	}
+	if len(agentConcurrency.active) != 0 {
+		t.Errorf("expected the request to be released, got %v", agentConcurrency.active)
+	}
+}
+
+// TestRunAPIHandler_queueFull sends a request to a session whose tunnel
+// writer is stuck, so its queue never drains, and checks the handler gives
+// up with 503 once the send timeout passes rather than waiting forever.
+func TestRunAPIHandler_queueFull(t *testing.T) {
+	config = &ControllerConfig{RateLimits: rateLimitConfig{SessionSendTimeoutMs: 50}}
+	defer func() { config = nil }()
+	agents.SetSendTimeout(config.RateLimits.GetSessionSendTimeout())
+	defer agents.SetSendTimeout(0)
+
+	state := &agent.DirectlyConnectedAgent{
+		Name:            "agent1",
+		Session:         "stalled",
+		Endpoints:       []agent.Endpoint{{Name: "ep1", Type: "kubernetes", Configured: true}},
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 10),
+	}
+	state.InRequest <- &streamCloseMessage{id: "stuck"}
+	agents.AddAgent(state)
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	throttled := apiRequestsThrottledCounter.WithLabelValues(ep.Name, "queue")
+	before := testutil.ToFloat64(throttled)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		runAPIHandler(ep, w, httptest.NewRequest("GET", "https://localhost/api", nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler did not return after the send timeout")
+	}
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got '%s'", got)
+	}
+	checkErrorBody(t, w)
+	if got := testutil.ToFloat64(throttled) - before; got != 1 {
+		t.Errorf("expected the throttled counter to increase by 1, got %v", got)
+	}
+	if n := agents.Outstanding(state.Session); n != 0 {
+		t.Errorf("expected nothing outstanding on the stalled session, got %d", n)
+	}
+}
+
+// hammerAgent is an agent session which answers requests for "/fast" after
+// a short delay, and never answers others.  A cancelled request's channel
+// is closed, as the tunnel does.  It counts any request which arrived while
+// more transactions were outstanding than the limits allow.
+type hammerAgent struct {
+	state      *agent.DirectlyConnectedAgent
+	respond    bool
+	limits     agent.Limits
+	violations int64
+
+	sync.Mutex
+	pending map[string]*HTTPMessage
+}
+
+func startHammerAgent(session string, respond bool, limits agent.Limits) *hammerAgent {
+	a := &hammerAgent{
+		state: &agent.DirectlyConnectedAgent{
+			Name:            "agent1",
+			Session:         session,
+			Endpoints:       []agent.Endpoint{{Name: "ep1", Type: "kubernetes", Configured: true}},
+			InRequest:       make(chan interface{}, 1000),
+			InCancelRequest: make(chan string, 1000),
+		},
+		respond: respond,
+		limits:  limits,
+		pending: map[string]*HTTPMessage{},
+	}
+	go func() {
+		for {
+			select {
+			case m, ok := <-a.state.InRequest:
+				if !ok {
+					return
+				}
+				msg, ok := m.(*HTTPMessage)
+				if !ok {
+					continue
+				}
+				if agents.Outstanding(session) > limits.MaxPerSession || agents.TotalOutstanding() > limits.MaxTotal {
+					atomic.AddInt64(&a.violations, 1)
+				}
+				a.Lock()
+				a.pending[msg.Cmd.Id] = msg
+				a.Unlock()
+				if a.respond && msg.Cmd.URI == "/fast" {
+					go a.answer(msg)
+				}
+			case id, ok := <-a.state.InCancelRequest:
+				if !ok {
+					return
+				}
+				a.Lock()
+				if msg, found := a.pending[id]; found {
+					msg.Close()
+					delete(a.pending, id)
+				}
+				a.Unlock()
+			}
+		}
+	}()
+	agents.AddAgent(a.state)
+	return a
+}
+
+func (a *hammerAgent) answer(msg *HTTPMessage) {
+	time.Sleep(time.Duration(10+rand.Intn(20)) * time.Millisecond)
+	a.Lock()
+	defer a.Unlock()
+	if _, found := a.pending[msg.Cmd.Id]; !found {
+		return
+	}
+	delete(a.pending, msg.Cmd.Id)
+	msg.Out <- &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+			HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: http.StatusOK},
+		},
+	}
+}
+
+// TestOutstandingLimits_hammer sends many requests to a slow agent, which
+// end normally, by timing out, by the client going away, or by the agent
+// disconnecting, and checks the limits held throughout and every
+// transaction was accounted for.
+func TestOutstandingLimits_hammer(t *testing.T) {
+	config = &ControllerConfig{Timeouts: timeoutConfig{RequestTimeout: 1}}
+	defer func() { config = nil }()
+	limits := agent.Limits{MaxPerSession: 5, MaxTotal: 8}
+	agents.SetLimits(limits)
+	defer agents.SetLimits(agent.Limits{})
+
+	steady := startHammerAgent("steady", true, limits)
+	defer func() { _ = agents.RemoveAgent(steady.state) }()
+	doomed := startHammerAgent("doomed", false, limits)
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	var lock sync.Mutex
+	statuses := map[int]int{}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 20; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				uri := []string{"/fast", "/slow", "/cancel", "/fast"}[(worker+i)%4]
+				r := httptest.NewRequest("GET", uri, nil)
+				if uri == "/cancel" {
+					ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+					defer cancel()
+					r = r.WithContext(ctx)
+				}
+				w := httptest.NewRecorder()
+				runAPIHandler(ep, w, r)
+				if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+					t.Errorf("503 without Retry-After")
+				}
+				lock.Lock()
+				statuses[w.Code]++
+				lock.Unlock()
+				if w.Code == http.StatusServiceUnavailable {
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+		}(worker)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := agents.RemoveAgent(doomed.state); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt64(&steady.violations) + atomic.LoadInt64(&doomed.violations); n != 0 {
+		t.Errorf("%d requests arrived with more outstanding than the limits allow", n)
+	}
+	if n := agents.TotalOutstanding(); n != 0 {
+		t.Errorf("expected nothing outstanding, got %d", n)
+	}
+	if n := agents.Outstanding(steady.state.Session); n != 0 {
+		t.Errorf("expected nothing outstanding on the steady session, got %d", n)
+	}
+	for _, code := range []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		if statuses[code] == 0 {
+			t.Errorf("expected some requests to end with %d: %v", code, statuses)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// RenewCertificate issues a new certificate, for the same name, to an agent
+// whose connection is authenticated by its current one.  A certificate
+// revoked since the connection was made is refused, as it would be by a new
+// handshake.  The new certificate has the configured lifetime for agents.
+func (s *agentTunnelServer) RenewCertificate(ctx context.Context, req *tunnel.CertificateRenewalRequest) (*tunnel.CertificateRenewalResponse, error) {
+	cert, err := getPeerCertificateFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name, err := ca.GetCertificateNameFromCert(cert)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if name.Purpose != ca.CertificatePurposeAgent {
+		return nil, status.Error(codes.PermissionDenied, "not an agent certificate")
+	}
+	logger := util.LogWith("agent", name.Agent, "serial", cert.SerialNumber.String())
+	if authority.IsRevoked(cert) {
+		certificateRenewalsCounter.WithLabelValues(name.Agent, "revoked").Inc()
+		logger.Warnf("Refused to renew revoked agent certificate")
+		return nil, status.Error(codes.PermissionDenied, "certificate has been revoked")
+	}
+
+	ret, renewed, err := issueAgentCertificate(*name)
+	if e, ok := err.(*ca.ExternalPKIError); ok {
+		certificateRenewalsCounter.WithLabelValues(name.Agent, "failed").Inc()
+		return nil, status.Error(codes.Unimplemented, e.Error())
+	}
+	if err != nil {
+		certificateRenewalsCounter.WithLabelValues(name.Agent, "failed").Inc()
+		logger.Errorf("Unable to renew agent certificate: %v", err)
+		return nil, status.Error(codes.Internal, "unable to issue certificate")
+	}
+	certificateRenewalsCounter.WithLabelValues(name.Agent, "issued").Inc()
+	logger.Infof("Renewed agent certificate expiring %s, new serial %s expires %s",
+		cert.NotAfter.UTC().Format(time.RFC3339), renewed.SerialNumber, renewed.NotAfter.UTC().Format(time.RFC3339))
+	return ret, nil
+}
+
+// issueAgentCertificate makes a new certificate for the name, returning it
+// as PEM for the agent, and parsed.
+func issueAgentCertificate(name ca.CertificateName) (*tunnel.CertificateRenewalResponse, *x509.Certificate, error) {
+	ca64, cert64, key64, err := authority.GenerateCertificate(name, "", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var decoded [3][]byte
+	for i, s := range []string{ca64, cert64, key64} {
+		if decoded[i], err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, nil, err
+		}
+	}
+	block, _ := pem.Decode(decoded[1])
+	if block == nil {
+		return nil, nil, fmt.Errorf("issued certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tunnel.CertificateRenewalResponse{
+		CaCertificate: decoded[0],
+		Certificate:   decoded[1],
+		Key:           decoded[2],
+		NotAfter:      uint64(cert.NotAfter.UnixNano() / 1000000),
+	}, cert, nil
+}
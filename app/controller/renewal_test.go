@@ -0,0 +1,139 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func renewalContext(cert *x509.Certificate) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+}
+
+// externalAuthority verifies certificates, but issues none.
+type externalAuthority struct {
+	*ca.CA
+}
+
+func (*externalAuthority) GenerateCertificate(name ca.CertificateName, keyType ca.KeyType, validity time.Duration) (string, string, string, error) {
+	return "", "", "", &ca.ExternalPKIError{URL: "https://pki.example.com/"}
+}
+
+func TestRenewCertificate_externalPKI(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := ca.MakeCAFromData(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority = local
+	defer func() { authority = nil }()
+	_, current, err := issueAgentCertificate(ca.CertificateName{Agent: "external", Purpose: ca.CertificatePurposeAgent})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authority = &externalAuthority{CA: local}
+	_, err = newAgentServer().RenewCertificate(renewalContext(current), &tunnel.CertificateRenewalRequest{})
+	if status.Code(err) != codes.Unimplemented || !strings.Contains(err.Error(), "https://pki.example.com/") {
+		t.Errorf("RenewCertificate() = %v, want Unimplemented pointing at the external PKI", err)
+	}
+}
+
+func TestRenewCertificate(t *testing.T) {
+	caCert, caKey, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err = ca.MakeCAFromData(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { authority = nil }()
+	s := newAgentServer()
+
+	name := ca.CertificateName{Agent: "renewing", Purpose: ca.CertificatePurposeAgent}
+	_, current, err := issueAgentCertificate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.RenewCertificate(renewalContext(current), &tunnel.CertificateRenewalRequest{})
+	if err != nil {
+		t.Fatalf("RenewCertificate() = %v", err)
+	}
+	renewed, err := tls.X509KeyPair(resp.Certificate, resp.Key)
+	if err != nil {
+		t.Fatalf("renewed certificate and key do not match: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(renewed.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ca.GetCertificateNameFromCert(leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != name {
+		t.Errorf("renewed certificate is for %+v, want %+v", *got, name)
+	}
+	if leaf.SerialNumber.Cmp(current.SerialNumber) == 0 {
+		t.Errorf("renewed certificate has the same serial number")
+	}
+	if v := testutil.ToFloat64(certificateRenewalsCounter.WithLabelValues(name.Agent, "issued")); v != 1 {
+		t.Errorf("issued renewals = %v, want 1", v)
+	}
+
+	if err := authority.Revoke(current.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RenewCertificate(renewalContext(current), &tunnel.CertificateRenewalRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("RenewCertificate() with a revoked certificate = %v, want PermissionDenied", err)
+	}
+	if v := testutil.ToFloat64(certificateRenewalsCounter.WithLabelValues(name.Agent, "revoked")); v != 1 {
+		t.Errorf("revoked renewals = %v, want 1", v)
+	}
+
+	service := ca.CertificateName{Agent: "renewing", Name: "svc", Type: "jenkins", Purpose: ca.CertificatePurposeService}
+	_, serviceCert, err := issueAgentCertificate(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RenewCertificate(renewalContext(serviceCert), &tunnel.CertificateRenewalRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("RenewCertificate() with a service certificate = %v, want PermissionDenied", err)
+	}
+}
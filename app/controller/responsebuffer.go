@@ -0,0 +1,178 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// flowControlFunc asks the agent to pause or resume a response.
+type flowControlFunc func(paused bool)
+
+// responseBuffer counts the response body waiting in an HTTPMessage's Out
+// channel, between the tunnel's receive loop and the handler writing it
+// to the client, so a client reading slowly holds up only its own
+// response.  While a response is paused, flow is how to resume it.
+type responseBuffer struct {
+	sync.Mutex
+	pauseBytes int64
+	maxBytes   int64
+	waiting    int64
+	agentName  string
+	flow       flowControlFunc
+	pausedAt   time.Time
+}
+
+// newHTTPMessage returns a message for a request whose replies are
+// buffered as config.ResponseBuffer allows.
+func newHTTPMessage(cmd *tunnel.HttpRequest, upgrade bool) *HTTPMessage {
+	limits := config.ResponseBuffer
+	return &HTTPMessage{
+		Out:     make(chan *tunnel.AgentToControllerWrapper, limits.GetMaxChunks()),
+		Cmd:     cmd,
+		Upgrade: upgrade,
+		buffer: &responseBuffer{
+			pauseBytes: limits.GetPauseBytes(),
+			maxBytes:   limits.GetMaxBytes(),
+		},
+	}
+}
+
+// queued counts n more bytes of body waiting, returning false if that is
+// more than may wait.  Once pauseBytes are waiting, the response is
+// paused with flow, unless it is nil because the agent cannot pause it.
+// The lock is held while pausing and resuming, so the agent is told of
+// each in the order they happen.
+func (b *responseBuffer) queued(n int, agentName string, flow flowControlFunc) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.waiting += int64(n)
+	if b.waiting > b.maxBytes {
+		return false
+	}
+	if flow != nil && b.flow == nil && b.waiting >= b.pauseBytes {
+		b.agentName = agentName
+		b.flow = flow
+		b.pausedAt = time.Now()
+		responsePausesCounter.WithLabelValues(agentName).Inc()
+		responsesPausedGauge.WithLabelValues(agentName).Inc()
+		flow(true)
+	}
+	return true
+}
+
+// taken counts n bytes of body taken by the handler, resuming the response
+// once no more than half of pauseBytes are waiting.
+func (b *responseBuffer) taken(n int) {
+	b.Lock()
+	defer b.Unlock()
+	b.waiting -= int64(n)
+	if b.flow != nil && b.waiting <= b.pauseBytes/2 {
+		b.flow(false)
+		b.endPause()
+	}
+}
+
+// stop ends any pause once the transaction is over.  The agent is not
+// told, as it has finished with the response or been cancelled.
+func (b *responseBuffer) stop() {
+	b.Lock()
+	defer b.Unlock()
+	if b.flow != nil {
+		b.endPause()
+	}
+}
+
+func (b *responseBuffer) endPause() {
+	responsePausedSecondsCounter.WithLabelValues(b.agentName).Add(time.Since(b.pausedAt).Seconds())
+	responsesPausedGauge.WithLabelValues(b.agentName).Dec()
+	b.flow = nil
+}
+
+// taken must be called with each reply the handler takes from Out, so the
+// body waiting is counted.
+func (m *HTTPMessage) taken(in *tunnel.AgentToControllerWrapper) {
+	if m.buffer != nil {
+		m.buffer.taken(len(in.GetHttpChunkedResponse().GetBody()))
+	}
+}
+
+// makeFlowControl returns the function which pauses and resumes the
+// response to id on the agent's tunnel.
+func makeFlowControl(stream tunnel.AgentTunnelService_EventTunnelServer, state fmt.Stringer, id string) flowControlFunc {
+	return func(paused bool) {
+		msg := &tunnel.ControllerToAgentWrapper{
+			Event: &tunnel.ControllerToAgentWrapper_HttpFlowControl{
+				HttpFlowControl: &tunnel.HttpFlowControl{Id: id, Paused: paused},
+			},
+		}
+		if err := stream.Send(msg); err != nil {
+			util.Warnf("Unable to send flow control to agent %s for HTTP request %s", state, id)
+		}
+	}
+}
+
+// deliverHTTPReply passes a reply from the agent to the handler of an HTTP
+// transaction.  httpids must be locked.  Replies to an HTTPMessage are
+// buffered, so the receive loop never waits for the client.  If the
+// agent's hello said it accepts flow control, the response is paused while
+// too much waits; if more than may wait arrives regardless, the
+// transaction is cancelled.
+func (s *agentTunnelServer) deliverHTTPReply(stream tunnel.AgentTunnelService_EventTunnelServer, state *agent.DirectlyConnectedAgent, httpids *sessionList, dest pendingTransaction, in *tunnel.AgentToControllerWrapper, flowControl bool) {
+	m, ok := dest.(*HTTPMessage)
+	if !ok || m.buffer == nil {
+		dest.replies() <- in
+		return
+	}
+	id := m.Cmd.Id
+	var flow flowControlFunc
+	if flowControl {
+		flow = makeFlowControl(stream, state, id)
+	}
+	if m.buffer.queued(len(in.GetHttpChunkedResponse().GetBody()), state.Name, flow) {
+		select {
+		case m.Out <- in:
+			return
+		default:
+		}
+	}
+
+	util.Warnf("Client is reading the response to HTTP request %s from agent %s too slowly, with more than %d bytes or %d messages waiting, cancelling",
+		id, state, m.buffer.maxBytes, cap(m.Out))
+	responseBufferOverflowsCounter.WithLabelValues(state.Name).Inc()
+	m.Close()
+	delete(httpids.m, id)
+	if !httpids.cancelled.Add(id) {
+		return
+	}
+	resp := &tunnel.ControllerToAgentWrapper{
+		Event: &tunnel.ControllerToAgentWrapper_CancelRequest{
+			CancelRequest: &tunnel.CancelRequest{Id: id},
+		},
+	}
+	if err := stream.Send(resp); err != nil {
+		util.Warnf("Unable to send to agent %s for cancel request %s", state, id)
+		return
+	}
+	cancelsIssuedCounter.WithLabelValues(state.Name).Inc()
+}
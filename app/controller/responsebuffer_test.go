@@ -0,0 +1,166 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func flowControlSent(stream *fakeAgentStream) []bool {
+	stream.Lock()
+	defer stream.Unlock()
+	ret := []bool{}
+	for _, m := range stream.sent {
+		if fc := m.GetHttpFlowControl(); fc != nil {
+			ret = append(ret, fc.Paused)
+		}
+	}
+	return ret
+}
+
+func cancelsSent(stream *fakeAgentStream) int {
+	stream.Lock()
+	defer stream.Unlock()
+	n := 0
+	for _, m := range stream.sent {
+		if m.GetCancelRequest() != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestDeliverHTTPReply_pause(t *testing.T) {
+	const agentName = "slow-client"
+	config = &ControllerConfig{ResponseBuffer: responseBufferConfig{PauseBytes: 8, MaxBytes: 20, MaxChunks: 4}}
+	defer func() { config = nil }()
+	s := newAgentServer()
+	stream := &fakeAgentStream{}
+	state := &agent.DirectlyConnectedAgent{Name: agentName}
+	httpids := newSessionList()
+	pauses := testutil.ToFloat64(responsePausesCounter.WithLabelValues(agentName))
+
+	m := newHTTPMessage(&tunnel.HttpRequest{Id: "slow"}, false)
+	s.addHTTPId(httpids, m)
+	deliver := func() {
+		httpids.Lock()
+		defer httpids.Unlock()
+		s.deliverHTTPReply(stream, state, httpids, m, makeChunk("slow"), true)
+	}
+
+	deliver()
+	if got := flowControlSent(stream); len(got) != 0 {
+		t.Fatalf("flow control sent with 4 bytes waiting: %v", got)
+	}
+	deliver()
+	deliver()
+	if got := flowControlSent(stream); len(got) != 1 || !got[0] {
+		t.Fatalf("flow control sent = %v, want one pause", got)
+	}
+	if got := testutil.ToFloat64(responsesPausedGauge.WithLabelValues(agentName)); got != 1 {
+		t.Errorf("responses paused = %v, want 1", got)
+	}
+
+	// Resumed once no more than half of pauseBytes wait.
+	m.taken(<-m.Out)
+	if got := flowControlSent(stream); len(got) != 1 {
+		t.Fatalf("resumed with 8 bytes waiting: %v", got)
+	}
+	m.taken(<-m.Out)
+	if got := flowControlSent(stream); len(got) != 2 || got[1] {
+		t.Fatalf("flow control sent = %v, want a pause, then a resume", got)
+	}
+	if got := testutil.ToFloat64(responsesPausedGauge.WithLabelValues(agentName)); got != 0 {
+		t.Errorf("responses paused = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(responsePausesCounter.WithLabelValues(agentName)) - pauses; got != 1 {
+		t.Errorf("pauses = %v, want 1", got)
+	}
+
+	// Paused again, then ended by the transaction closing.
+	deliver()
+	m.Close()
+	if got := testutil.ToFloat64(responsesPausedGauge.WithLabelValues(agentName)); got != 0 {
+		t.Errorf("responses paused after close = %v, want 0", got)
+	}
+	if n := cancelsSent(stream); n != 0 {
+		t.Errorf("sent %d cancel requests, want 0", n)
+	}
+}
+
+func TestDeliverHTTPReply_overflow(t *testing.T) {
+	const agentName = "stalled-client"
+	config = &ControllerConfig{ResponseBuffer: responseBufferConfig{PauseBytes: 8, MaxBytes: 20, MaxChunks: 4}}
+	defer func() { config = nil }()
+	s := newAgentServer()
+	state := &agent.DirectlyConnectedAgent{Name: agentName}
+
+	bigChunk := &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{
+			HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: "big", Body: bytes.Repeat([]byte("x"), 21)},
+		},
+	}
+	tests := []struct {
+		name        string
+		id          string
+		replies     []*tunnel.AgentToControllerWrapper
+		flowControl bool
+	}{
+		{"too many bytes", "big", []*tunnel.AgentToControllerWrapper{bigChunk}, true},
+		{"too many chunks", "many", []*tunnel.AgentToControllerWrapper{
+			makeChunk("many"), makeChunk("many"), makeChunk("many"), makeChunk("many"), makeChunk("many"),
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &fakeAgentStream{}
+			httpids := newSessionList()
+			overflows := testutil.ToFloat64(responseBufferOverflowsCounter.WithLabelValues(agentName))
+
+			m := newHTTPMessage(&tunnel.HttpRequest{Id: tt.id}, false)
+			s.addHTTPId(httpids, m)
+			httpids.Lock()
+			for _, in := range tt.replies {
+				if dest := httpids.m[tt.id]; dest != nil {
+					s.deliverHTTPReply(stream, state, httpids, dest, in, tt.flowControl)
+				}
+			}
+			httpids.Unlock()
+
+			if n := cancelsSent(stream); n != 1 {
+				t.Errorf("sent %d cancel requests, want 1", n)
+			}
+			if got := testutil.ToFloat64(responseBufferOverflowsCounter.WithLabelValues(agentName)) - overflows; got != 1 {
+				t.Errorf("overflows = %v, want 1", got)
+			}
+			if _, found := httpids.m[tt.id]; found {
+				t.Errorf("cancelled transaction is still pending")
+			}
+			for range m.Out {
+			}
+			if got := testutil.ToFloat64(responsesPausedGauge.WithLabelValues(agentName)); got != 0 {
+				t.Errorf("responses paused = %v, want 0", got)
+			}
+		})
+	}
+}
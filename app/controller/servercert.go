@@ -0,0 +1,146 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync/atomic"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// How long to wait before trying again when the server certificate could
+// not be renewed.
+const serverCertRetry = time.Minute
+
+// serverCertificate is the certificate every listener presents, through
+// the GetCertificate callback of its tls.Config.  It is renewed in the
+// background once two thirds of its lifetime has passed, and may be
+// renewed early with Renew.
+type serverCertificate struct {
+	issue   func() (*tls.Certificate, error)
+	current atomic.Value // *tls.Certificate, with Leaf set
+	renewed chan struct{}
+	retry   time.Duration
+}
+
+// newServerCertificate issues the first certificate with issue, which is
+// called again for each renewal.
+func newServerCertificate(issue func() (*tls.Certificate, error)) (*serverCertificate, error) {
+	s := &serverCertificate{issue: issue, renewed: make(chan struct{}, 1), retry: serverCertRetry}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *serverCertificate) load() (*x509.Certificate, error) {
+	cert, err := s.issue()
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.current.Store(cert)
+	return cert.Leaf, nil
+}
+
+// GetCertificate returns the current certificate, for use in a tls.Config.
+func (s *serverCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current.Load().(*tls.Certificate), nil
+}
+
+// Leaf returns the current certificate.
+func (s *serverCertificate) Leaf() *x509.Certificate {
+	return s.current.Load().(*tls.Certificate).Leaf
+}
+
+// Renew replaces the certificate now, and returns the new one.
+func (s *serverCertificate) Renew() (*x509.Certificate, error) {
+	return s.renew("forced")
+}
+
+func (s *serverCertificate) renew(trigger string) (*x509.Certificate, error) {
+	leaf, err := s.load()
+	if err != nil {
+		serverCertRenewalsCounter.WithLabelValues(trigger, "error").Inc()
+		util.Errorf("Unable to renew the server certificate (%s): %v", trigger, err)
+		return nil, err
+	}
+	serverCertRenewalsCounter.WithLabelValues(trigger, "success").Inc()
+	util.Infof("Renewed the server certificate (%s): serial %s, expires %s",
+		trigger, leaf.SerialNumber, leaf.NotAfter.UTC().Format(time.RFC3339))
+	select {
+	case s.renewed <- struct{}{}:
+	default:
+	}
+	return leaf, nil
+}
+
+// renewalTime returns when a certificate should be renewed, once two
+// thirds of its lifetime has passed.
+func renewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// untilRenewal returns how long to wait before renewing the current
+// certificate, which is never less than the retry interval, so one issued
+// with a lifetime too short to matter is not renewed over and over.
+func (s *serverCertificate) untilRenewal() time.Duration {
+	wait := time.Until(renewalTime(s.Leaf()))
+	if wait < s.retry {
+		wait = s.retry
+	}
+	return wait
+}
+
+// run renews the certificate when it is due until ctx is done.  If
+// renewal fails, it is tried again after the retry interval, while the
+// current certificate remains in use.
+func (s *serverCertificate) run(ctx context.Context) {
+	wait := s.untilRenewal()
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.renewed:
+			timer.Stop()
+			wait = s.untilRenewal()
+		case <-timer.C:
+			if _, err := s.renew("scheduled"); err != nil {
+				wait = s.retry
+				continue
+			}
+			// Skip the notification of our own renewal.
+			select {
+			case <-s.renewed:
+			default:
+			}
+			wait = s.untilRenewal()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testIssuer issues self-signed certificates with the given lifetime,
+// numbered from 1, and fails while failing is set.
+type testIssuer struct {
+	sync.Mutex
+	lifetime time.Duration
+	serial   int64
+	failing  bool
+}
+
+func (ti *testIssuer) issue() (*tls.Certificate, error) {
+	ti.Lock()
+	defer ti.Unlock()
+	if ti.failing {
+		return nil, errors.New("authority unavailable")
+	}
+	ti.serial++
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	// Certificate times are kept to the second.
+	now := time.Now().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ti.serial),
+		NotBefore:    now,
+		NotAfter:     now.Add(ti.lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (ti *testIssuer) setFailing(failing bool) {
+	ti.Lock()
+	defer ti.Unlock()
+	ti.failing = failing
+}
+
+func currentSerial(t *testing.T, s *serverCertificate) int64 {
+	t.Helper()
+	cert, err := s.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil {
+		t.Fatalf("certificate has no Leaf")
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+// waitForSerial waits until the current certificate has the serial.
+func waitForSerial(t *testing.T, s *serverCertificate, serial int64, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for currentSerial(t, s) != serial {
+		if time.Now().After(deadline) {
+			t.Fatalf("serial is %d, want %d", currentSerial(t, s), serial)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	now := time.Now()
+	cert := &x509.Certificate{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}
+	if got, want := renewalTime(cert), now.Add(60*24*time.Hour); !got.Equal(want) {
+		t.Errorf("renewalTime() = %s, want %s", got, want)
+	}
+}
+
+func TestServerCertificate_run(t *testing.T) {
+	issuer := &testIssuer{lifetime: 3 * time.Second}
+	s, err := newServerCertificate(issuer.issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := currentSerial(t, s); serial != 1 {
+		t.Fatalf("first serial = %d, want 1", serial)
+	}
+	s.retry = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Renewed two seconds in, at two thirds of the lifetime, and not before.
+	time.Sleep(500 * time.Millisecond)
+	if serial := currentSerial(t, s); serial != 1 {
+		t.Errorf("renewed before two thirds of the lifetime")
+	}
+	waitForSerial(t, s, 2, 3*time.Second)
+
+	// When the next renewal fails, the current certificate is kept, and
+	// renewal is retried.
+	failures := serverCertRenewalsCounter.WithLabelValues("scheduled", "error")
+	before := testutil.ToFloat64(failures)
+	issuer.setFailing(true)
+	deadline := time.Now().Add(3 * time.Second)
+	for testutil.ToFloat64(failures)-before < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("failed renewal was not retried")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if serial := currentSerial(t, s); serial != 2 {
+		t.Errorf("serial = %d after failing to renew, want 2", serial)
+	}
+	issuer.setFailing(false)
+	waitForSerial(t, s, 3, time.Second)
+}
+
+func TestServerCertificate_Renew(t *testing.T) {
+	issuer := &testIssuer{lifetime: time.Hour}
+	s, err := newServerCertificate(issuer.issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forced := serverCertRenewalsCounter.WithLabelValues("forced", "success")
+	before := testutil.ToFloat64(forced)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	leaf, err := s.Renew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Int64() != 2 || currentSerial(t, s) != 2 {
+		t.Errorf("expected serial 2 after Renew, got %s", leaf.SerialNumber)
+	}
+	if got := testutil.ToFloat64(forced) - before; got != 1 {
+		t.Errorf("expected 1 forced renewal counted, got %v", got)
+	}
+
+	issuer.setFailing(true)
+	if _, err := s.Renew(); err == nil {
+		t.Errorf("expected an error when the authority fails")
+	}
+	if serial := currentSerial(t, s); serial != 2 {
+		t.Errorf("serial = %d after failing to renew, want 2", serial)
+	}
+}
@@ -17,104 +17,315 @@ package main
  */
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/opsmx/oes-birger/app/controller/agent"
 	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
 	"github.com/opsmx/oes-birger/pkg/jwtutil"
 	"github.com/opsmx/oes-birger/pkg/tunnel"
 	"github.com/opsmx/oes-birger/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tevino/abool"
 )
 
-func runHTTPSServer(serverCert tls.Certificate) {
-	log.Printf("Running service HTTPS listener on port %d", config.ServiceListenPort)
+// activeTransactions counts service API requests which are being handled
+// by an agent, so shutdown can wait for them.
+var activeTransactions int64
+
+// waitForTransactions waits until no service API requests are in flight,
+// or the timeout expires.  It returns the number still in flight.
+func waitForTransactions(timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := atomic.LoadInt64(&activeTransactions)
+		if n == 0 || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func runHTTPSServer(ctx context.Context, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	util.Infof("Running service HTTPS listener on port %d", config.ServiceListenPort)
 
 	certPool, err := authority.MakeCertPool()
 	if err != nil {
-		log.Fatalf("While making certpool: %v", err)
+		return fmt.Errorf("while making certpool: %v", err)
 	}
 
 	tlsConfig := &tls.Config{
-		ClientCAs:    certPool,
-		ClientAuth:   tls.VerifyClientCertIfGiven,
-		Certificates: []tls.Certificate{serverCert},
-		MinVersion:   tls.VersionTLS12,
+		ClientCAs:             certPool,
+		ClientAuth:            tls.VerifyClientCertIfGiven,
+		GetCertificate:        getCertificate,
+		MinVersion:            tls.VersionTLS12,
+		VerifyPeerCertificate: authority.VerifyPeerCertificate,
 	}
+	config.TLS.Apply(tlsConfig)
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/", serviceAPIHandler)
+	mux.Handle("/", accessLog.handler(http.HandlerFunc(serviceAPIHandler)))
 
 	server := &http.Server{
 		Addr:      fmt.Sprintf(":%d", config.ServiceListenPort),
 		TLSConfig: tlsConfig,
 		Handler:   mux,
 	}
+	configureHTTPServer("service", server, true)
+
+	lis, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	ready.set(subsystemService, true)
+	defer ready.set(subsystemService, false)
+
+	serve := func() error { return server.ServeTLS(lis, "", "") }
+	return util.RunHTTPServer(ctx, server, serve, config.GetShutdownGracePeriod())
+}
+
+// The reasons a service request is not authenticated, as counted in
+// serviceAuthFailuresCounter.
+const (
+	authReasonNoCredentials    = "no_credentials"
+	authReasonBadCertPurpose   = "bad_cert_purpose"
+	authReasonInvalidJWT       = "invalid_jwt"
+	authReasonExpiredJWT       = "expired_jwt"
+	authReasonRevokedJWT       = "revoked_jwt"
+	authReasonInvalidSignature = "invalid_signature"
+	authReasonAnyAgent         = "any_agent_not_allowed"
+)
+
+var (
+	errNoCredentials      = errors.New("no valid credentials or JWT found")
+	errNotServiceCert     = errors.New("client certificate is not for service access")
+	errAnyAgentNotAllowed = errors.New("credentials for any agent are not allowed")
+)
+
+// servedByHeader names the agent which served a request in its response.
+const servedByHeader = "X-Birger-Agent"
+
+// errUnauthorized wraps a credential which was found but is no longer
+// acceptable, such as an expired token.
+type errUnauthorized struct {
+	reason string
+	err    error
+}
+
+func (e *errUnauthorized) Error() string {
+	return e.err.Error()
+}
+
+// errNotAuthenticated wraps the reason a request had no acceptable
+// credentials.
+type errNotAuthenticated struct {
+	reason string
+	err    error
+}
 
-	log.Fatal(server.ListenAndServeTLS("", ""))
+func (e *errNotAuthenticated) Error() string {
+	return e.err.Error()
 }
 
-func extractEndpointFromCert(r *http.Request) (agentIdentity string, endpointType string, endpointName string, validated bool) {
+// authFailureReason returns the reason an error from extractEndpoint is
+// counted under.
+func authFailureReason(err error) string {
+	switch e := err.(type) {
+	case *errUnauthorized:
+		return e.reason
+	case *errNotAuthenticated:
+		return e.reason
+	}
+	return authReasonNoCredentials
+}
+
+// rejectedServiceToken returns the error for a service token which was not
+// accepted.  A token which has expired or been revoked, or has no expiry
+// when one is required, is unauthorized.
+func rejectedServiceToken(err error) error {
+	switch err {
+	case jwtutil.ErrTokenExpired:
+		return &errUnauthorized{reason: authReasonExpiredJWT, err: err}
+	case jwtutil.ErrTokenRevoked:
+		return &errUnauthorized{reason: authReasonRevokedJWT, err: err}
+	case jwtutil.ErrNoExpiration:
+		return &errUnauthorized{reason: authReasonInvalidJWT, err: err}
+	}
+	return &errNotAuthenticated{reason: authReasonInvalidJWT, err: err}
+}
+
+// extractEndpointFromCert returns the endpoint named by the client
+// certificate, if one was presented.  If the certificate is not for
+// service access, an error is returned.
+func extractEndpointFromCert(r *http.Request) (agentIdentity string, endpointType string, endpointName string, validated bool, err error) {
 	if len(r.TLS.PeerCertificates) == 0 {
-		return "", "", "", false
+		return "", "", "", false, nil
 	}
 
 	names, err := ca.GetCertificateNameFromCert(r.TLS.PeerCertificates[0])
 	if err != nil {
-		log.Printf("%v", err)
-		return "", "", "", false
+		util.Warnf("%v", err)
+		return "", "", "", false, &errNotAuthenticated{reason: authReasonBadCertPurpose, err: errNotServiceCert}
 	}
 
 	if names.Purpose != ca.CertificatePurposeService {
-		return "", "", "", false
+		return "", "", "", false, &errNotAuthenticated{reason: authReasonBadCertPurpose, err: errNotServiceCert}
 	}
 
-	return names.Agent, names.Type, names.Name, true
+	return names.Agent, names.Type, names.Name, true, nil
 }
 
-func extractEndpointFromJWT(r *http.Request) (agentIdentity string, endpointType string, endpointName string, validated bool) {
-	authPassword := r.Header.Get("X-Opsmx-Token")
-	r.Header.Del("X-Opsmx-Token")
+// extractServiceToken returns the JWT presented with the request, if any.
+// A Bearer Authorization header is preferred, then the configured token
+// header, and finally the password from HTTP basic auth.  The bearer and
+// custom headers are removed, as they are meant for us and not for the
+// service behind the agent.
+func extractServiceToken(r *http.Request) (string, error) {
+	headerName := config.GetServiceAuthHeaderName()
+	headerToken := r.Header.Get(headerName)
+	r.Header.Del(headerName)
 
-	if authPassword == "" {
-		var ok bool
-		if _, authPassword, ok = r.BasicAuth(); !ok {
-			return "", "", "", false
+	authorization := r.Header.Get("Authorization")
+	fields := strings.Fields(authorization)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "Bearer") {
+		if len(fields) != 2 {
+			return "", fmt.Errorf("malformed Bearer Authorization header")
 		}
+		r.Header.Del("Authorization")
+		return fields[1], nil
+	}
+
+	if headerToken != "" {
+		return headerToken, nil
 	}
 
-	endpointType, endpointName, agentIdentity, err := jwtutil.ValidateJWT(jwtKeyset, authPassword)
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, nil
+	}
+	return "", nil
+}
+
+func extractEndpointFromJWT(r *http.Request) (agentIdentity string, endpointType string, endpointName string, validated bool, err error) {
+	authPassword, err := extractServiceToken(r)
+	if err != nil {
+		return "", "", "", false, &errNotAuthenticated{reason: authReasonInvalidJWT, err: err}
+	}
+	if authPassword == "" {
+		return "", "", "", false, nil
+	}
+
+	claims, err := validateServiceToken(authPassword)
+	if err == jwtutil.ErrTokenExpired || err == jwtutil.ErrNoExpiration || err == jwtutil.ErrTokenRevoked {
+		return "", "", "", false, rejectedServiceToken(err)
+	}
 	if err != nil {
-		log.Printf("%v", err)
-		return "", "", "", false
+		util.Warnf("%v", err)
+		return "", "", "", false, &errNotAuthenticated{reason: authReasonInvalidJWT, err: errNoCredentials}
 	}
 
-	return agentIdentity, endpointType, endpointName, true
+	return claims.Agent, claims.EndpointType, claims.EndpointName, true, nil
+}
+
+// validateServiceToken validates a service token against the configured
+// issuer and audience, and the revoked tokens, warning when a legacy token
+// is used.
+func validateServiceToken(token string) (*jwtutil.Claims, error) {
+	v := config.GetServiceTokenValidation()
+	v.Denied = serviceTokenDenyList
+	claims, err := jwtutil.ValidateJWT(jwtKeyset.Set(), token, v)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Legacy {
+		util.LogWith("agent", claims.Agent, "type", claims.EndpointType, "endpoint", claims.EndpointName).
+			Warnf("Accepted a legacy service token without an issuer and audience, which is deprecated; issue a new token")
+	}
+	return claims, nil
 }
 
+// extractEndpoint authenticates the request, and returns the endpoint its
+// credentials are for.  A service certificate is preferred, then an AWS
+// signature, and finally a service token.  In the required mode, a client
+// certificate which is not for service access is refused without looking
+// further.
 func extractEndpoint(r *http.Request) (agentIdentity string, endpointType string, endpointName string, err error) {
-	agentIdentity, endpointType, endpointName, found := extractEndpointFromCert(r)
+	agentIdentity, endpointType, endpointName, found, certErr := extractEndpointFromCert(r)
 	if found {
 		return agentIdentity, endpointType, endpointName, nil
 	}
+	if certErr != nil && config.GetServiceAuthRequired() {
+		return "", "", "", certErr
+	}
 
-	agentIdentity, endpointType, endpointName, found = extractEndpointFromJWT(r)
+	if isSigV4Request(r) {
+		agentIdentity, endpointType, endpointName, err = extractEndpointFromSigV4(r)
+		switch err.(type) {
+		case nil, *errUnauthorized, *errNotAuthenticated:
+		default:
+			err = &errNotAuthenticated{reason: authReasonInvalidSignature, err: err}
+		}
+		return agentIdentity, endpointType, endpointName, err
+	}
+
+	agentIdentity, endpointType, endpointName, found, err = extractEndpointFromJWT(r)
+	if err != nil {
+		return "", "", "", err
+	}
 	if found {
 		return agentIdentity, endpointType, endpointName, nil
 	}
 
-	return "", "", "", fmt.Errorf("no valid credentials or JWT found")
+	if certErr != nil {
+		return "", "", "", certErr
+	}
+	return "", "", "", &errNotAuthenticated{reason: authReasonNoCredentials, err: errNoCredentials}
+}
+
+// failAuthentication refuses a request which extractEndpoint did not
+// authenticate, and counts it by reason.  The response carries a request
+// ID, which is logged with the reason so the two can be matched.
+func failAuthentication(w http.ResponseWriter, r *http.Request, err error) {
+	reason := authFailureReason(err)
+	serviceAuthFailuresCounter.WithLabelValues(reason).Inc()
+	requestID := ulidContext.Ulid()
+	setAccessLogTransaction(r, requestID)
+	util.LogWith("requestId", requestID, "reason", reason, "remoteAddr", r.RemoteAddr).
+		Warnf("Service request not authenticated: %v", err)
+
+	code := http.StatusBadRequest
+	if _, ok := err.(*errUnauthorized); ok || config.GetServiceAuthRequired() {
+		code = http.StatusUnauthorized
+		challenge := fmt.Sprintf("Bearer realm=%q", config.GetServiceTokenIdentity().Audience)
+		if reason == authReasonInvalidJWT || reason == authReasonExpiredJWT || reason == authReasonRevokedJWT {
+			challenge += `, error="invalid_token"`
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	util.FailRequestWithID(w, err, code, requestID)
 }
 
 func serviceAPIHandler(w http.ResponseWriter, r *http.Request) {
 	agentIdentity, endpointType, endpointName, err := extractEndpoint(r)
 	if err != nil {
-		util.FailRequest(w, err, http.StatusBadRequest)
+		failAuthentication(w, r, err)
+		return
+	}
+	setAccessLogIdentity(r, serviceIdentity(r, endpointName, agentIdentity))
+	if config.GetAllowAnyAgent() && agentIdentity == "" {
+		agentIdentity = fwdapi.AnyAgent
+	}
+	if agentIdentity == fwdapi.AnyAgent && !config.GetAllowAnyAgent() {
+		failAuthentication(w, r, &errUnauthorized{reason: authReasonAnyAgent, err: errAnyAgentNotAllowed})
 		return
 	}
 	ep := agent.Search{
@@ -122,9 +333,25 @@ func serviceAPIHandler(w http.ResponseWriter, r *http.Request) {
 		EndpointType: endpointType,
 		EndpointName: endpointName,
 	}
+	if ok, wait := serviceRateLimiter.allow(ep); !ok {
+		failThrottled(w, ep, "rate", wait)
+		return
+	}
 	runAPIHandler(ep, w, r)
 }
 
+// setServedBy names the agent which served a request for any agent in the
+// response, replacing any header of that name the agent sent.
+func setServedBy(resp *tunnel.HttpResponse, agentName string) {
+	headers := resp.Headers[:0]
+	for _, header := range resp.Headers {
+		if !strings.EqualFold(header.Name, servedByHeader) {
+			headers = append(headers, header)
+		}
+	}
+	resp.Headers = append(headers, &tunnel.HttpHeader{Name: servedByHeader, Values: []string{agentName}})
+}
+
 func copyHeaders(resp *tunnel.HttpResponse, w http.ResponseWriter) {
 	for name := range w.Header() {
 		w.Header().Del(name)
@@ -134,54 +361,327 @@ func copyHeaders(resp *tunnel.HttpResponse, w http.ResponseWriter) {
 			w.Header().Add(header.Name, value)
 		}
 	}
+	removeHopHeaders(w.Header())
+}
+
+// The maximum size of each request body chunk sent to an agent.
+const requestBodyChunkSize = 64 * 1024
+
+type httpRequestChunkMessage struct {
+	chunk        *tunnel.HttpRequestChunk
+	endpointType string
+}
+
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// requestBodyLimiter fails once more than remaining bytes are read from
+// body, and records that it did so the handler can report it.
+type requestBodyLimiter struct {
+	body      io.Reader
+	remaining int64
+	exceeded  *abool.AtomicBool
+}
+
+func (l *requestBodyLimiter) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.body.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		l.exceeded.Set()
+		return n, errRequestBodyTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// streamRequestBody reads the client's request body and sends it to the
+// agent session handling the transaction as a series of bounded chunks,
+// ending with an empty chunk to indicate EOF.  If reading fails, the
+// transaction is cancelled.  Once stop is closed, the handler is finished
+// with the transaction and nothing more is sent.
+func streamRequestBody(ep agent.Search, id string, body io.Reader, stop <-chan struct{}) {
+	logger := util.LogWith("transaction", id, "agent", ep.Name)
+	buf := make([]byte, requestBodyChunkSize)
+	for {
+		n, err := body.Read(buf)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			message := &httpRequestChunkMessage{chunk: &tunnel.HttpRequestChunk{Id: id, Body: data}, endpointType: ep.EndpointType}
+			if err := agents.SendToSession(ep, message); err != nil {
+				logger.Warnf("while sending request body: %v", err)
+				return
+			}
+		}
+		if err == io.EOF {
+			message := &httpRequestChunkMessage{chunk: &tunnel.HttpRequestChunk{Id: id, Body: []byte{}}, endpointType: ep.EndpointType}
+			if err := agents.SendToSession(ep, message); err != nil {
+				logger.Warnf("while sending request body: %v", err)
+			}
+			return
+		}
+		if err != nil {
+			logger.Warnf("while reading request body: %v", err)
+			if err := agents.Cancel(ep, id); err != nil {
+				logger.Warnf("while cancelling http request: %v", err)
+			}
+			return
+		}
+	}
 }
 
 func handleDone(n <-chan struct{}, cc *abool.AtomicBool, target agent.Search, id string) {
 	<-n
+	logger := util.LogWith("transaction", id, "agent", target.Name)
 	if cc.IsNotSet() {
 		err := agents.Cancel(target, id)
 		if err != nil {
-			log.Printf("while cancelling http request: %v", err)
+			logger.Warnf("while cancelling http request: %v", err)
 		}
 	}
 }
 
+// requestTimer is a timer which may be disabled with a zero duration, in
+// which case its channel never fires.
+type requestTimer struct {
+	t *time.Timer
+	C <-chan time.Time
+}
+
+func (rt *requestTimer) reset(d time.Duration) {
+	rt.stop()
+	if d > 0 {
+		rt.t = time.NewTimer(d)
+		rt.C = rt.t.C
+	}
+}
+
+func (rt *requestTimer) stop() {
+	if rt.t != nil {
+		rt.t.Stop()
+	}
+	rt.t = nil
+	rt.C = nil
+}
+
+// abandonRequest cancels a transaction the handler is giving up on.  The
+// cancel closes the message channel, which is drained until then so the
+// agent's stream is never blocked on it.
+func abandonRequest(ep agent.Search, id string, out chan *tunnel.AgentToControllerWrapper) {
+	logger := util.LogWith("transaction", id, "agent", ep.Name)
+	if err := agents.Cancel(ep, id); err != nil {
+		logger.Warnf("while cancelling http request: %v", err)
+	}
+	go func() {
+		for range out {
+		}
+	}()
+}
+
+// resendToAnotherSession sends a request which a session refused because it
+// is shutting down to another session found by search, if there is one.
+// ep, the session the request was sent to, is updated to the new session,
+// and the new message is returned.
+func resendToAnotherSession(search agent.Search, ep *agent.Search, message *HTTPMessage) (*HTTPMessage, error) {
+	agents.Complete(*ep, message.Cmd.Id)
+	search.ExcludeSessions = append(append([]string{}, ep.ExcludeSessions...), ep.Session)
+	search.Session = ""
+	next := newHTTPMessage(message.Cmd, message.Upgrade)
+	routed, err := agents.Route(search, next)
+	if err != nil {
+		return nil, err
+	}
+	*ep = routed
+	return next, nil
+}
+
+// apiMetricLabels returns the labels for per-request metrics, leaving the
+// endpoint name empty unless it is enabled.
+func apiMetricLabels(ep agent.Search) prometheus.Labels {
+	labels := prometheus.Labels{"agent": ep.Name, "endpointType": ep.EndpointType, "endpointName": ""}
+	if config.Metrics.EndpointNameLabel {
+		labels["endpointName"] = ep.EndpointName
+	}
+	return labels
+}
+
+// failNoAgent refuses a request no agent can handle.  Its body has not been
+// read, and the connection is closed rather than reading the body so it
+// could be reused.
+func failNoAgent(w http.ResponseWriter, r *http.Request, err error, transactionID string) {
+	if r.ContentLength != 0 {
+		w.Header().Set("Connection", "close")
+	}
+	util.FailRequestWithID(w, err, http.StatusBadGateway, transactionID)
+}
+
 func runAPIHandler(ep agent.Search, w http.ResponseWriter, r *http.Request) {
 	apiRequestCounter.WithLabelValues(ep.Name).Inc()
+	setAccessLogEndpoint(r, ep)
+
+	if !agentConcurrency.acquire(ep.Name) {
+		failThrottled(w, ep, "concurrency", 0)
+		return
+	}
+	defer agentConcurrency.release(ep.Name)
+
+	start := time.Now()
+	labels := apiMetricLabels(ep)
+	apiRequestsInFlight.With(labels).Inc()
+	defer apiRequestsInFlight.With(labels).Dec()
+	responseBytes := 0
+	streamed := false
+	defer func() {
+		if !streamed {
+			apiRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+			apiResponseSize.With(labels).Observe(float64(responseBytes))
+		}
+	}()
+
+	atomic.AddInt64(&activeTransactions, 1)
+	defer atomic.AddInt64(&activeTransactions, -1)
 
 	transactionID := ulidContext.Ulid()
+	setAccessLogTransaction(r, transactionID)
+	logger := util.LogWith("transaction", transactionID, "agent", ep.Name)
+	upgrade := isUpgradeRequest(r)
 
-	body, _ := ioutil.ReadAll(r.Body)
 	req := &tunnel.HttpRequest{
-		Id:      transactionID,
-		Type:    ep.EndpointType,
-		Name:    ep.EndpointName,
-		Method:  r.Method,
-		URI:     r.RequestURI,
-		Headers: makeHeaders(r.Header),
-		Body:    body,
-	}
-	message := &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper), Cmd: req}
-	sessionID, found := agents.Send(ep, message)
-	if !found {
-		w.WriteHeader(http.StatusBadGateway)
+		Id:            transactionID,
+		Type:          ep.EndpointType,
+		Name:          ep.EndpointName,
+		Method:        r.Method,
+		URI:           r.RequestURI,
+		Headers:       makeHeaders(forwardedRequestHeaders(r, upgrade, config.ForwardedHeaders)),
+		ContentLength: r.ContentLength,
+	}
+
+	if err := checkRequestLimits(req.URI, req.Headers, config.GetRequestLimits()); err != nil {
+		logger.Warnf("Request refused: %v", err)
+		apiRequestLimitRejectedCounter.WithLabelValues(ep.Name, err.reason).Inc()
+		util.FailRequestWithID(w, err, err.status, transactionID)
+		return
+	}
+
+	// A declared length is checked before anything is sent, and the body is
+	// limited as it is streamed in case it is chunked or lies.
+	maxBodyBytes := config.MaxRequestBodyBytes
+	if !upgrade && r.ContentLength > maxBodyBytes {
+		apiRequestTooLargeCounter.WithLabelValues(ep.Name).Inc()
+		util.FailRequestWithID(w, fmt.Errorf("%v: limit is %d bytes", errRequestBodyTooLarge, maxBodyBytes), http.StatusRequestEntityTooLarge, transactionID)
+		return
+	}
+	bodyTooLarge := abool.New()
+
+	affinity, err := startAffinity(ep, r)
+	if err != nil {
+		util.FailRequestWithID(w, err, http.StatusInternalServerError, transactionID)
+		return
+	}
+
+	message := newHTTPMessage(req, upgrade)
+	// The agent is chosen before the body is read, so a request no agent
+	// can handle is refused without reading it.
+	routed, err := agents.Route(affinity.search(ep), message)
+	if err != nil {
+		var busy *agent.BusyError
+		if errors.As(err, &busy) {
+			failBusy(w, r, ep, busy, transactionID)
+			return
+		}
+		var queueFull *agent.QueueFullError
+		if errors.As(err, &queueFull) {
+			failQueueFull(w, r, ep, queueFull, transactionID)
+			return
+		}
+		failNoAgent(w, r, err, transactionID)
 		return
 	}
-	ep.Session = sessionID
+	affinity.routed(routed)
+	// A search for any agent now names the one which was chosen.
+	search := ep
+	ep = routed
+	if search.AnyAgent() {
+		setAccessLogEndpoint(r, ep)
+		labels = apiMetricLabels(ep)
+		logger = util.LogWith("transaction", transactionID, "agent", ep.Name)
+	}
+	defer func() { agents.Complete(ep, transactionID) }()
+
+	// A request may be retried elsewhere as long as none of its body has
+	// been sent.
+	hasBody := r.ContentLength != 0 && !upgrade
+	if hasBody {
+		body := &requestBodyLimiter{body: r.Body, remaining: maxBodyBytes, exceeded: bodyTooLarge}
+		stop := make(chan struct{})
+		bodyDone := make(chan struct{})
+		go func() {
+			defer close(bodyDone)
+			streamRequestBody(ep, transactionID, body, stop)
+		}()
+		// The body may not be read once the handler returns, so closing
+		// it ends any read in progress, which is waited for.
+		defer func() {
+			close(stop)
+			_ = r.Body.Close()
+			<-bodyDone
+		}()
+	}
 
 	cleanClose := abool.New()
 	notify := r.Context().Done()
 	go handleDone(notify, cleanClose, ep, transactionID)
 
+	requestTimeout, idleTimeout := config.GetRequestTimeouts(ep.EndpointType)
+	timer := &requestTimer{}
+	timer.reset(requestTimeout)
+	defer timer.stop()
+
+	deadline := newWriteDeadline(r)
+	deadline.extend()
+	defer deadline.clear()
+
 	seenHeader := false
 	isChunked := false
+	hasResponseBody := true
 	flusher := w.(http.Flusher)
 	for {
-		in, more := <-message.Out
-		if !more {
+		var in *tunnel.AgentToControllerWrapper
+		var more bool
+		select {
+		case in, more = <-message.Out:
+			if more {
+				message.taken(in)
+			}
+		case <-timer.C:
+			cleanClose.Set()
+			abandonRequest(ep, transactionID, message.Out)
 			if !seenHeader {
-				log.Printf("Request timed out sending to agent")
-				w.WriteHeader(http.StatusBadGateway)
+				logger.Warnf("Timed out after %s waiting for agent response", requestTimeout)
+				util.FailRequestWithID(w, fmt.Errorf("timed out waiting for agent response"), http.StatusGatewayTimeout, transactionID)
+			} else {
+				logger.Infof("Idle for %s, closing", idleTimeout)
+			}
+			return
+		}
+		if !more {
+			switch {
+			case seenHeader:
+			case bodyTooLarge.IsSet():
+				logger.Warnf("Request body exceeded %d bytes", maxBodyBytes)
+				apiRequestTooLargeCounter.WithLabelValues(ep.Name).Inc()
+				util.FailRequestWithID(w, fmt.Errorf("%v: limit is %d bytes", errRequestBodyTooLarge, maxBodyBytes), http.StatusRequestEntityTooLarge, transactionID)
+			default:
+				logger.Warnf("Agent went away before responding")
+				util.FailRequestWithID(w, fmt.Errorf("agent went away before responding"), http.StatusBadGateway, transactionID)
 			}
 			cleanClose.Set()
 			return
@@ -190,38 +690,92 @@ func runAPIHandler(ep agent.Search, w http.ResponseWriter, r *http.Request) {
 		switch x := in.Event.(type) {
 		case *tunnel.AgentToControllerWrapper_HttpResponse:
 			resp := in.GetHttpResponse()
+			if dropped := sanitizeResponseHeaders(resp); len(dropped) > 0 {
+				logger.Warnf("Dropped invalid response headers from agent: %s", strings.Join(dropped, ", "))
+			}
+			maxHeaderBytes, maxHeaders := config.GetResponseHeaderLimits()
+			if err := checkResponseHeaderLimits(resp.Headers, maxHeaderBytes, maxHeaders); err != nil {
+				logger.Warnf("Rejected response from agent: %v", err)
+				apiResponseHeadersRejectedCounter.WithLabelValues(ep.Name).Inc()
+				cleanClose.Set()
+				abandonRequest(ep, transactionID, message.Out)
+				util.FailRequestWithID(w, fmt.Errorf("agent response headers exceed the limit"), http.StatusBadGateway, transactionID)
+				return
+			}
+			if search.AnyAgent() {
+				setServedBy(resp, ep.Name)
+			}
+			affinity.setHeaders(resp, ep)
+			if upgrade && resp.Status == http.StatusSwitchingProtocols {
+				cleanClose.Set()
+				timer.stop()
+				deadline.clear()
+				streamed = true
+				runStream(ep, transactionID, w, resp, message.Out)
+				return
+			}
 			seenHeader = true
 			isChunked = resp.ContentLength < 0
+			hasResponseBody = tunnel.ResponseHasBody(r.Method, int(resp.Status))
+			timer.reset(idleTimeout)
+			deadline.extend()
 			copyHeaders(resp, w)
 			w.WriteHeader(int(resp.Status))
 			if resp.ContentLength == 0 {
 				cleanClose.Set()
 				return
 			}
+		case *tunnel.AgentToControllerWrapper_HttpError:
+			resp := in.GetHttpError()
+			if resp.Draining && !seenHeader && !hasBody {
+				drained := ep.Session
+				if next, err := resendToAnotherSession(search, &ep, message); err == nil {
+					logger.Infof("Agent session %s is shutting down, retrying on session %s", drained, ep.Session)
+					affinity.routed(ep)
+					apiRequestsRetriedCounter.WithLabelValues(ep.Name).Inc()
+					message = next
+					go handleDone(notify, cleanClose, ep, transactionID)
+					continue
+				}
+			}
+			logger.Warnf("Agent reported error: %s", resp.Message)
+			if !seenHeader {
+				util.FailRequestWithID(w, fmt.Errorf("agent: %s", resp.Message), int(resp.Status), transactionID)
+			}
+			cleanClose.Set()
+			return
 		case *tunnel.AgentToControllerWrapper_HttpChunkedResponse:
 			resp := in.GetHttpChunkedResponse()
 			if !seenHeader {
-				log.Printf("Error: got ChunkedResponse before HttpResponse")
-				w.WriteHeader(http.StatusBadGateway)
+				logger.Errorf("Got ChunkedResponse before HttpResponse")
+				cleanClose.Set()
+				abandonRequest(ep, transactionID, message.Out)
+				util.FailRequestWithID(w, fmt.Errorf("agent sent a response body before its headers"), http.StatusBadGateway, transactionID)
 				return
 			}
 			if len(resp.Body) == 0 {
 				cleanClose.Set()
 				return
 			}
+			timer.reset(idleTimeout)
+			deadline.extend()
+			if !hasResponseBody {
+				// Older agents send whatever body upstream gave them,
+				// which cannot be written, until the empty chunk.
+				continue
+			}
 			n, err := w.Write(resp.Body)
+			responseBytes += n
 			if err != nil {
-				log.Printf("Error: cannot write: %v", err)
-				if !seenHeader {
-					w.WriteHeader(http.StatusBadGateway)
-				}
+				logger.Errorf("Cannot write: %v", err)
+				cleanClose.Set()
+				abandonRequest(ep, transactionID, message.Out)
 				return
 			}
 			if n != len(resp.Body) {
-				log.Printf("Error: did not write full message: %d of %d written", n, len(resp.Body))
-				if !seenHeader {
-					w.WriteHeader(http.StatusBadGateway)
-				}
+				logger.Errorf("Did not write full message: %d of %d written", n, len(resp.Body))
+				cleanClose.Set()
+				abandonRequest(ep, transactionID, message.Out)
 				return
 			}
 			if isChunked {
@@ -230,7 +784,7 @@ func runAPIHandler(ep agent.Search, w http.ResponseWriter, r *http.Request) {
 		case nil:
 			// ignore for now
 		default:
-			log.Printf("Received unknown message: %T", x)
+			logger.Warnf("Received unknown message: %T", x)
 		}
 	}
 }
@@ -0,0 +1,1276 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// startFakeAgent connects an agent which hands each request to respond,
+// and closes the request's channel when it is cancelled, as the tunnel does.
+// It returns a channel on which cancelled request IDs are reported.
+func startFakeAgent(respond func(*HTTPMessage)) (*agent.DirectlyConnectedAgent, chan string) {
+	return startFakeAgentSession("session1", respond)
+}
+
+// startFakeAgentSession is startFakeAgent for another session of the agent.
+func startFakeAgentSession(session string, respond func(*HTTPMessage)) (*agent.DirectlyConnectedAgent, chan string) {
+	state := &agent.DirectlyConnectedAgent{
+		Name:            "agent1",
+		Session:         session,
+		Endpoints:       []agent.Endpoint{{Name: "ep1", Type: "kubernetes", Configured: true}},
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 1),
+	}
+	cancelled := make(chan string, 1)
+	go func() {
+		// Like a real session, requests still pending when the session
+		// is removed are closed.
+		pending := map[string]*HTTPMessage{}
+		defer func() {
+			for _, msg := range pending {
+				msg.Close()
+			}
+		}()
+		for {
+			select {
+			case m, ok := <-state.InRequest:
+				if !ok {
+					return
+				}
+				msg, ok := m.(*HTTPMessage)
+				if !ok {
+					// Request body chunks are not needed by any test.
+					continue
+				}
+				pending[msg.Cmd.Id] = msg
+				respond(msg)
+			case id, ok := <-state.InCancelRequest:
+				if !ok {
+					return
+				}
+				pending[id].Close()
+				cancelled <- id
+			}
+		}
+	}()
+	agents.AddAgent(state)
+	return state, cancelled
+}
+
+// checkErrorBody fails the test unless the response is a JSON error
+// carrying its status code and a request ID.
+func checkErrorBody(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var body struct {
+		Error struct {
+			Code      int    `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"requestId"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+	}
+	if body.Error.Code != w.Code {
+		t.Errorf("error code = %d, want the status %d", body.Error.Code, w.Code)
+	}
+	if body.Error.Message == "" || body.Error.RequestID == "" {
+		t.Errorf("expected a message and request ID, got %s", w.Body.String())
+	}
+}
+
+func TestRunAPIHandler_timeouts(t *testing.T) {
+	config = &ControllerConfig{
+		Timeouts: timeoutConfig{RequestTimeout: 1},
+		EndpointTimeouts: map[string]timeoutConfig{
+			"kubernetes": {IdleTimeout: 1},
+		},
+	}
+	defer func() { config = nil }()
+
+	tests := []struct {
+		name       string
+		respond    func(*HTTPMessage)
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			"no response",
+			func(*HTTPMessage) {},
+			http.StatusGatewayTimeout,
+			"timed out waiting for agent response",
+		},
+		{
+			"idle after header",
+			func(msg *HTTPMessage) {
+				go func() {
+					msg.Out <- &tunnel.AgentToControllerWrapper{
+						Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+							HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: 200, ContentLength: -1},
+						},
+					}
+				}()
+			},
+			http.StatusOK,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, cancelled := startFakeAgent(tt.respond)
+			defer func() { _ = agents.RemoveAgent(state) }()
+
+			ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			w := httptest.NewRecorder()
+
+			done := make(chan struct{})
+			go func() {
+				runAPIHandler(ep, w, r)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("runAPIHandler did not time out")
+			}
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantBody != "" {
+				checkErrorBody(t, w)
+				if !strings.Contains(w.Body.String(), tt.wantBody) {
+					t.Errorf("expected body to contain '%s', got '%s'", tt.wantBody, w.Body.String())
+				}
+			}
+			select {
+			case <-cancelled:
+			case <-time.After(time.Second):
+				t.Errorf("expected the agent to receive a cancel")
+			}
+			if n := agents.Outstanding(state.Session); n != 0 {
+				t.Errorf("expected no outstanding transactions, got %d", n)
+			}
+		})
+	}
+}
+
+func TestRunAPIHandler_agentRemoved(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	state, _ := startFakeAgent(func(*HTTPMessage) {})
+	removed := false
+	defer func() {
+		if !removed {
+			_ = agents.RemoveAgent(state)
+		}
+	}()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	r := httptest.NewRequest("GET", "https://localhost/api", nil)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		runAPIHandler(ep, w, r)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for agents.Outstanding(state.Session) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request was never sent to the agent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A session which goes away removes itself, and then closes its queues.
+	if err := agents.RemoveAgent(state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	state.Close()
+	removed = true
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("runAPIHandler did not return after the agent was removed")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	checkErrorBody(t, w)
+	if !strings.Contains(w.Body.String(), "agent went away") {
+		t.Errorf("expected body to explain the failure, got '%s'", w.Body.String())
+	}
+	if n := agents.Outstanding(state.Session); n != 0 {
+		t.Errorf("expected no outstanding transactions, got %d", n)
+	}
+}
+
+func TestRunAPIHandler_chunkedResponse(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		go func() {
+			msg.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+					HttpResponse: &tunnel.HttpResponse{
+						Id:            msg.Cmd.Id,
+						Status:        http.StatusCreated,
+						ContentLength: -1,
+						Headers: []*tunnel.HttpHeader{
+							{Name: "Content-Type", Values: []string{"application/json"}},
+							{Name: "X-Multi", Values: []string{"a", "b"}},
+							{Name: "Connection", Values: []string{"X-Hop"}},
+							{Name: "X-Hop", Values: []string{"dropped"}},
+						},
+					},
+				},
+			}
+			for _, body := range []string{`{"a":`, `1}`, ``} {
+				msg.Out <- &tunnel.AgentToControllerWrapper{
+					Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{
+						HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: msg.Cmd.Id, Body: []byte(body)},
+					},
+				}
+			}
+		}()
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	r := httptest.NewRequest("GET", "https://localhost/api", nil)
+	w := httptest.NewRecorder()
+	runAPIHandler(ep, w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if got := w.Body.String(); got != `{"a":1}` {
+		t.Errorf("expected the chunks to be written in order, got '%s'", got)
+	}
+	want := http.Header{
+		"Content-Type": {"application/json"},
+		"X-Multi":      {"a", "b"},
+	}
+	if !reflect.DeepEqual(w.Header(), want) {
+		t.Errorf("headers = %v, want %v", w.Header(), want)
+	}
+	if !w.Flushed {
+		t.Errorf("expected a chunked response to be flushed")
+	}
+	if n := agents.Outstanding(state.Session); n != 0 {
+		t.Errorf("expected no outstanding transactions, got %d", n)
+	}
+}
+
+func TestRunAPIHandler_clientCancel(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	state, cancelled := startFakeAgent(func(*HTTPMessage) {})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := httptest.NewRequest("GET", "https://localhost/api", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		runAPIHandler(ep, w, r)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for agents.Outstanding(state.Session) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("request was never sent to the agent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("expected the agent to receive a cancel")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("runAPIHandler did not return after the client went away")
+	}
+	if n := agents.Outstanding(state.Session); n != 0 {
+		t.Errorf("expected no outstanding transactions, got %d", n)
+	}
+}
+
+func TestRunAPIHandler_endpointNotAdvertised(t *testing.T) {
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	sent := make(chan struct{}, 1)
+	state, _ := startFakeAgent(func(*HTTPMessage) { sent <- struct{}{} })
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	tests := []struct {
+		name string
+		ep   agent.Search
+	}{
+		{"unknown name", agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep2"}},
+		{"unknown type", agent.Search{Name: "agent1", EndpointType: "jenkins", EndpointName: "ep1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			w := httptest.NewRecorder()
+			runAPIHandler(tt.ep, w, r)
+
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("expected status %d, got %d", http.StatusBadGateway, w.Code)
+			}
+			checkErrorBody(t, w)
+			if !strings.Contains(w.Body.String(), "no such path exists") {
+				t.Errorf("expected body to explain the failure, got '%s'", w.Body.String())
+			}
+			select {
+			case <-sent:
+				t.Errorf("request was forwarded to the agent")
+			default:
+			}
+		})
+	}
+}
+
+// countingReadCloser counts the bytes read from a request body.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestRunAPIHandler_unknownAgentLargeBody(t *testing.T) {
+	config = &ControllerConfig{MaxRequestBodyBytes: 1 << 40}
+	defer func() { config = nil }()
+
+	var bodyRead int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		runAPIHandler(agent.Search{Name: "missing", EndpointType: "jenkins", EndpointName: "ep1"}, w, r)
+		atomic.StoreInt64(&bodyRead, atomic.LoadInt64(&body.n))
+	}))
+	defer srv.Close()
+
+	// Only the start of each body is sent, so the response arrives only
+	// if the server does not wait to read the rest.  A smaller body would
+	// otherwise be read after the handler returns, to reuse the connection.
+	for _, size := range []int{128 * 1024, 1 << 30} {
+		t.Run(fmt.Sprintf("%d bytes", size), func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "POST /job/build HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", size)
+			if _, err := conn.Write(make([]byte, 64*1024)); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("reading response: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+			}
+			if !resp.Close {
+				t.Errorf("expected the connection to be closed")
+			}
+			var got struct {
+				Error struct {
+					Message string            `json:"message"`
+					Details map[string]string `json:"details"`
+				} `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			want := map[string]string{"agentName": "missing", "endpointType": "jenkins", "endpointName": "ep1"}
+			if !reflect.DeepEqual(got.Error.Details, want) {
+				t.Errorf("details = %v, want %v", got.Error.Details, want)
+			}
+			if !strings.Contains(got.Error.Message, "no agents connected") {
+				t.Errorf("message = %q", got.Error.Message)
+			}
+			if n := atomic.LoadInt64(&bodyRead); n != 0 {
+				t.Errorf("handler read %d bytes of the body", n)
+			}
+		})
+	}
+}
+
+// startFakeBodyAgent connects an agent which reads each request's body,
+// responding with 200 once it has all arrived.  It reports the number of
+// body bytes received for each request on the returned channel.
+func startFakeBodyAgent() (*agent.DirectlyConnectedAgent, chan int) {
+	state := &agent.DirectlyConnectedAgent{
+		Name:            "agent1",
+		Session:         "session1",
+		Endpoints:       []agent.Endpoint{{Name: "ep1", Type: "kubernetes", Configured: true}},
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 1),
+	}
+	received := make(chan int, 1)
+	go func() {
+		pending := map[string]*HTTPMessage{}
+		length := map[string]int{}
+		for {
+			select {
+			case m, ok := <-state.InRequest:
+				if !ok {
+					return
+				}
+				switch msg := m.(type) {
+				case *HTTPMessage:
+					pending[msg.Cmd.Id] = msg
+				case *httpRequestChunkMessage:
+					id := msg.chunk.Id
+					length[id] += len(msg.chunk.Body)
+					if len(msg.chunk.Body) > 0 {
+						continue
+					}
+					received <- length[id]
+					pending[id].Out <- &tunnel.AgentToControllerWrapper{
+						Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+							HttpResponse: &tunnel.HttpResponse{Id: id, Status: 200},
+						},
+					}
+				}
+			case id, ok := <-state.InCancelRequest:
+				if !ok {
+					return
+				}
+				pending[id].Close()
+			}
+		}
+	}()
+	agents.AddAgent(state)
+	return state, received
+}
+
+func TestRunAPIHandler_maxRequestBodyBytes(t *testing.T) {
+	config = &ControllerConfig{MaxRequestBodyBytes: 10}
+	defer func() { config = nil }()
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+	}{
+		{"declared length within limit", "0123456789", 10, http.StatusOK},
+		{"declared length too large", "0123456789a", 11, http.StatusRequestEntityTooLarge},
+		{"chunked within limit", "0123456789", -1, http.StatusOK},
+		{"chunked too large", "0123456789a", -1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, received := startFakeBodyAgent()
+			defer func() { _ = agents.RemoveAgent(state) }()
+
+			ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+			r := httptest.NewRequest("POST", "https://localhost/api", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+
+			done := make(chan struct{})
+			go func() {
+				runAPIHandler(ep, w, r)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("runAPIHandler did not return")
+			}
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if n := <-received; n != len(tt.body) {
+					t.Errorf("expected agent to receive %d bytes, got %d", len(tt.body), n)
+				}
+			} else if !strings.Contains(w.Body.String(), "request body too large") {
+				t.Errorf("expected body to explain the failure, got '%s'", w.Body.String())
+			}
+			if n := agents.Outstanding(state.Session); n != 0 {
+				t.Errorf("expected no outstanding transactions, got %d", n)
+			}
+		})
+	}
+}
+
+// TestRunAPIHandler_bodyUnread checks that a client's body is no longer
+// read once the handler returns, even if the agent answers before it ends.
+func TestRunAPIHandler_bodyUnread(t *testing.T) {
+	config = &ControllerConfig{MaxRequestBodyBytes: 1024}
+	defer func() { config = nil }()
+
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		go func() {
+			msg.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+					HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: http.StatusAccepted},
+				},
+			}
+		}()
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	body, client := io.Pipe()
+	r := httptest.NewRequest("POST", "https://localhost/api", body)
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		runAPIHandler(ep, w, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("runAPIHandler did not return")
+	}
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if _, err := client.Write([]byte("late")); err != io.ErrClosedPipe {
+		t.Errorf("writing more of the body: got %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestRunAPIHandler_responseHeaderLimits(t *testing.T) {
+	config = &ControllerConfig{
+		Timeouts:             timeoutConfig{RequestTimeout: 5},
+		ResponseHeaderLimits: responseHeaderLimits{MaxCount: 2},
+	}
+	defer func() { config = nil }()
+
+	tests := []struct {
+		name       string
+		headers    []*tunnel.HttpHeader
+		wantStatus int
+		wantCancel bool
+	}{
+		{
+			"within limit",
+			[]*tunnel.HttpHeader{{Name: "X-Ok", Values: []string{"1", "2"}}},
+			http.StatusOK,
+			false,
+		},
+		{
+			"too many headers",
+			[]*tunnel.HttpHeader{{Name: "X-Many", Values: []string{"1", "2", "3"}}},
+			http.StatusBadGateway,
+			true,
+		},
+		{
+			"invalid headers dropped",
+			[]*tunnel.HttpHeader{
+				{Name: "X-Ok", Values: []string{"1"}},
+				{Name: "X-Bad", Values: []string{"1\r\nSet-Cookie: a=b", "2\n", "3\r"}},
+			},
+			http.StatusOK,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, cancelled := startFakeAgent(func(msg *HTTPMessage) {
+				msg.Out <- &tunnel.AgentToControllerWrapper{
+					Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+						HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: 200, Headers: tt.headers},
+					},
+				}
+			})
+			defer func() { _ = agents.RemoveAgent(state) }()
+			before := testutil.ToFloat64(apiResponseHeadersRejectedCounter.WithLabelValues("agent1"))
+
+			ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			w := httptest.NewRecorder()
+			runAPIHandler(ep, w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if _, found := w.Header()["X-Bad"]; found {
+				t.Errorf("invalid header was copied to the response")
+			}
+			rejected := testutil.ToFloat64(apiResponseHeadersRejectedCounter.WithLabelValues("agent1")) - before
+			if tt.wantCancel {
+				if rejected != 1 {
+					t.Errorf("rejected count increased by %v, want 1", rejected)
+				}
+				select {
+				case <-cancelled:
+				case <-time.After(5 * time.Second):
+					t.Errorf("request was not cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestRunAPIHandler_requestLimits(t *testing.T) {
+	config = &ControllerConfig{
+		Timeouts:      timeoutConfig{RequestTimeout: 5},
+		RequestLimits: requestLimits{MaxURIBytes: 100, MaxHeaderBytes: 100},
+	}
+	defer func() { config = nil }()
+
+	sent := make(chan struct{}, 10)
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		sent <- struct{}{}
+		msg.Out <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+				HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: 200},
+			},
+		}
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	tests := []struct {
+		name       string
+		uri        string
+		header     string
+		wantStatus int
+		wantReason string
+	}{
+		{"within limits", "/api", "ok", http.StatusOK, ""},
+		{"long uri", "/api?q=" + strings.Repeat("x", 100), "ok", http.StatusRequestURITooLong, requestRejectedURI},
+		{"large header", "/api", strings.Repeat("x", 100), http.StatusRequestHeaderFieldsTooLarge, requestRejectedHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before float64
+			if tt.wantReason != "" {
+				before = testutil.ToFloat64(apiRequestLimitRejectedCounter.WithLabelValues("agent1", tt.wantReason))
+			}
+
+			ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+			r := httptest.NewRequest("GET", tt.uri, nil)
+			r.Header.Set("X-Test", tt.header)
+			w := httptest.NewRecorder()
+			runAPIHandler(ep, w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantReason == "" {
+				<-sent
+				return
+			}
+			checkErrorBody(t, w)
+			if got := testutil.ToFloat64(apiRequestLimitRejectedCounter.WithLabelValues("agent1", tt.wantReason)) - before; got != 1 {
+				t.Errorf("rejected count increased by %v, want 1", got)
+			}
+			select {
+			case <-sent:
+				t.Errorf("request was forwarded to the agent")
+			default:
+			}
+		})
+	}
+}
+
+func TestRunAPIHandler_retryDraining(t *testing.T) {
+	config = &ControllerConfig{MaxRequestBodyBytes: 1024, Timeouts: timeoutConfig{RequestTimeout: 5}}
+	defer func() { config = nil }()
+
+	refuse := func(msg *HTTPMessage) {
+		msg.Out <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_HttpError{
+				HttpError: &tunnel.HttpError{Id: msg.Cmd.Id, Status: http.StatusServiceUnavailable, Message: "agent is shutting down", Draining: true},
+			},
+		}
+		msg.Close()
+	}
+	accept := func(msg *HTTPMessage) {
+		msg.Out <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+				HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: http.StatusOK},
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		respond2    func(*HTTPMessage)
+		body        string
+		wantStatus  int
+		wantRetries float64
+	}{
+		{"retried on the other session", accept, "", http.StatusOK, 1},
+		{"every session draining", refuse, "", http.StatusServiceUnavailable, 1},
+		{"request with a body", accept, "data", http.StatusServiceUnavailable, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Whichever session is asked first is shutting down.
+			var calls int32
+			respond := func(msg *HTTPMessage) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					refuse(msg)
+					return
+				}
+				tt.respond2(msg)
+			}
+			state1, _ := startFakeAgentSession("session1", respond)
+			state2, _ := startFakeAgentSession("session2", respond)
+			defer func() {
+				_ = agents.RemoveAgent(state1)
+				_ = agents.RemoveAgent(state2)
+			}()
+			before := testutil.ToFloat64(apiRequestsRetriedCounter.WithLabelValues("agent1"))
+
+			ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+			r := httptest.NewRequest("GET", "https://localhost/api", strings.NewReader(tt.body))
+			if tt.body == "" {
+				r.ContentLength = 0
+			}
+			w := httptest.NewRecorder()
+			runAPIHandler(ep, w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			retries := testutil.ToFloat64(apiRequestsRetriedCounter.WithLabelValues("agent1")) - before
+			if retries != tt.wantRetries {
+				t.Errorf("retries increased by %v, want %v", retries, tt.wantRetries)
+			}
+			for _, state := range []*agent.DirectlyConnectedAgent{state1, state2} {
+				if n := agents.Outstanding(state.Session); n != 0 {
+					t.Errorf("expected no outstanding transactions on %s, got %d", state.Session, n)
+				}
+			}
+		})
+	}
+}
+
+func TestApiMetricLabels(t *testing.T) {
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	tests := []struct {
+		name              string
+		endpointNameLabel bool
+		want              prometheus.Labels
+	}{
+		{"default", false, prometheus.Labels{"agent": "agent1", "endpointType": "kubernetes", "endpointName": ""}},
+		{"endpoint name enabled", true, prometheus.Labels{"agent": "agent1", "endpointType": "kubernetes", "endpointName": "ep1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &ControllerConfig{Metrics: metricsConfig{EndpointNameLabel: tt.endpointNameLabel}}
+			defer func() { config = nil }()
+			if got := apiMetricLabels(ep); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apiMetricLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAPIHandler_metrics(t *testing.T) {
+	config = &ControllerConfig{Metrics: metricsConfig{EndpointNameLabel: true}}
+	defer func() { config = nil }()
+
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		go func() {
+			msg.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+					HttpResponse: &tunnel.HttpResponse{Id: msg.Cmd.Id, Status: 200, ContentLength: 5},
+				},
+			}
+			for _, body := range []string{"hello", ""} {
+				msg.Out <- &tunnel.AgentToControllerWrapper{
+					Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{
+						HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: msg.Cmd.Id, Body: []byte(body)},
+					},
+				}
+			}
+		}()
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+	labels := apiMetricLabels(ep)
+	observations := func(h *prometheus.HistogramVec) (uint64, float64) {
+		var m dto.Metric
+		if err := h.With(labels).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+	}
+
+	durationsBefore, _ := observations(apiRequestDuration)
+	sizesBefore, bytesBefore := observations(apiResponseSize)
+	w := httptest.NewRecorder()
+	runAPIHandler(ep, w, httptest.NewRequest("GET", "https://localhost/api", nil))
+
+	if w.Body.String() != "hello" {
+		t.Errorf("expected body 'hello', got '%s'", w.Body.String())
+	}
+	if count, _ := observations(apiRequestDuration); count-durationsBefore != 1 {
+		t.Errorf("expected 1 duration observation, got %d", count-durationsBefore)
+	}
+	if count, sum := observations(apiResponseSize); count-sizesBefore != 1 || sum-bytesBefore != 5 {
+		t.Errorf("expected 1 size observation of 5 bytes, got %d totalling %v", count-sizesBefore, sum-bytesBefore)
+	}
+	if n := testutil.ToFloat64(apiRequestsInFlight.With(labels)); n != 0 {
+		t.Errorf("expected no requests in flight, got %v", n)
+	}
+}
+
+func TestControllerConfig_GetRequestTimeouts(t *testing.T) {
+	c := &ControllerConfig{
+		Timeouts: timeoutConfig{RequestTimeout: 60, IdleTimeout: 0},
+		EndpointTimeouts: map[string]timeoutConfig{
+			"jenkins": {RequestTimeout: 300},
+			"aws":     {IdleTimeout: 10},
+		},
+	}
+	tests := []struct {
+		endpointType string
+		wantRequest  time.Duration
+		wantIdle     time.Duration
+	}{
+		{"kubernetes", 60 * time.Second, 0},
+		{"jenkins", 300 * time.Second, 0},
+		{"aws", 60 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpointType, func(t *testing.T) {
+			request, idle := c.GetRequestTimeouts(tt.endpointType)
+			if request != tt.wantRequest || idle != tt.wantIdle {
+				t.Errorf("GetRequestTimeouts() = %s, %s, want %s, %s", request, idle, tt.wantRequest, tt.wantIdle)
+			}
+		})
+	}
+}
+
+// useTestKeyset makes "key1" the only service key, returning it.
+func useTestKeyset(t *testing.T) jwk.Key {
+	jwtKeyset = jwtutil.NewKeyset("key1")
+	t.Cleanup(func() { jwtKeyset = jwtutil.NewKeyset("") })
+	if err := jwtKeyset.Load(map[string][]byte{"key1": []byte("key 1")}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwtKeyset.CurrentKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testServiceTokenIdentity is the identity a controller uses by default.
+var testServiceTokenIdentity = jwtutil.Identity{Issuer: defaultServiceTokenIssuer, Audience: defaultServiceTokenAudience}
+
+func TestServiceAPIHandler_tokenExpiry(t *testing.T) {
+	key := useTestKeyset(t)
+
+	noExpiry, err := jwtutil.MakeJWT(key, testServiceTokenIdentity, "jenkins", "ep1", "agent1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.New()
+	_ = token.Set(jwt.IssuerKey, "opsmx")
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(-time.Hour))
+	_ = token.Set("t", "jenkins")
+	_ = token.Set("n", "ep1")
+	_ = token.Set("a", "agent1")
+	signed, err := jwt.Sign(token, jwa.HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := string(signed)
+
+	tests := []struct {
+		name              string
+		token             string
+		requireExpiration bool
+		wantStatus        int
+		wantBody          string
+	}{
+		{"expired token", expired, false, http.StatusUnauthorized, "token has expired"},
+		{"no expiration, expiration required", noExpiry, true, http.StatusUnauthorized, "token has no expiration"},
+		{"garbage token", "garbage", false, http.StatusBadRequest, "no valid credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &ControllerConfig{ServiceAuth: serviceAuthConfig{RequireExpiration: tt.requireExpiration}}
+			defer func() { config = nil }()
+
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			r.Header.Set("X-Opsmx-Token", tt.token)
+			w := httptest.NewRecorder()
+			serviceAPIHandler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("expected body to contain '%s', got '%s'", tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServiceAPIHandler_anyAgent(t *testing.T) {
+	key := useTestKeyset(t)
+	token, err := jwtutil.MakeJWT(key, testServiceTokenIdentity, "kubernetes", "ep1", fwdapi.AnyAgent, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _ := startFakeAgent(func(msg *HTTPMessage) {
+		go func() {
+			msg.Out <- &tunnel.AgentToControllerWrapper{
+				Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+					HttpResponse: &tunnel.HttpResponse{
+						Id:      msg.Cmd.Id,
+						Status:  http.StatusNoContent,
+						Headers: []*tunnel.HttpHeader{{Name: "x-birger-agent", Values: []string{"spoofed"}}},
+					},
+				},
+			}
+		}()
+	})
+	defer func() { _ = agents.RemoveAgent(state) }()
+
+	t.Run("not allowed", func(t *testing.T) {
+		config = &ControllerConfig{}
+		defer func() { config = nil }()
+		r := httptest.NewRequest("GET", "https://localhost/api", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		serviceAPIHandler(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		config = &ControllerConfig{ServiceAuth: serviceAuthConfig{AllowAnyAgent: true}}
+		defer func() { config = nil }()
+		served := apiMetricLabels(agent.Search{Name: "agent1", EndpointType: "kubernetes"})
+		var before dto.Metric
+		if err := apiRequestDuration.With(served).(prometheus.Histogram).Write(&before); err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "https://localhost/api", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		serviceAPIHandler(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		if got := w.Header().Values(servedByHeader); len(got) != 1 || got[0] != "agent1" {
+			t.Errorf("%s = %v, want only agent1", servedByHeader, got)
+		}
+		var after dto.Metric
+		if err := apiRequestDuration.With(served).(prometheus.Histogram).Write(&after); err != nil {
+			t.Fatal(err)
+		}
+		if n := after.Histogram.GetSampleCount() - before.Histogram.GetSampleCount(); n != 1 {
+			t.Errorf("expected 1 duration observation for the serving agent, got %d", n)
+		}
+	})
+}
+
+func TestServiceAPIHandler_authMode(t *testing.T) {
+	key := useTestKeyset(t)
+
+	token := jwt.New()
+	_ = token.Set(jwt.IssuerKey, "opsmx")
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(-time.Hour))
+	_ = token.Set("t", "jenkins")
+	_ = token.Set("n", "ep1")
+	_ = token.Set("a", "agent1")
+	signed, err := jwt.Sign(token, jwa.HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := string(signed)
+
+	_ = token.Set(jwt.JwtIDKey, "revoked1")
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	signed, err = jwt.Sign(token, jwa.HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := string(signed)
+	serviceTokenDenyList.Load(map[string]time.Time{"revoked1": {}})
+	defer serviceTokenDenyList.Load(map[string]time.Time{})
+
+	controlCert := &x509.Certificate{
+		Subject: pkix.Name{
+			Names: []pkix.AttributeTypeAndValue{
+				{
+					Type:  asn1.ObjectIdentifier{2, 5, 4, ca.OpsMxOIDValue},
+					Value: `{"purpose":"control","name":"ep1"}`,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		mode          string
+		cert          *x509.Certificate
+		token         string
+		wantStatus    int
+		wantReason    string
+		wantChallenge string
+	}{
+		{"optional, no credentials", "", nil, "", http.StatusBadRequest, authReasonNoCredentials, ""},
+		{"optional, control cert", "optional", controlCert, "", http.StatusBadRequest, authReasonBadCertPurpose, ""},
+		{"optional, invalid token", "", nil, "garbage", http.StatusBadRequest, authReasonInvalidJWT, ""},
+		{"optional, expired token", "", nil, expired, http.StatusUnauthorized, authReasonExpiredJWT, `Bearer realm="opsmx-forwarder", error="invalid_token"`},
+		{"optional, revoked token", "", nil, revoked, http.StatusUnauthorized, authReasonRevokedJWT, `Bearer realm="opsmx-forwarder", error="invalid_token"`},
+		{"required, no credentials", "required", nil, "", http.StatusUnauthorized, authReasonNoCredentials, `Bearer realm="opsmx-forwarder"`},
+		{"required, control cert", "required", controlCert, "", http.StatusUnauthorized, authReasonBadCertPurpose, `Bearer realm="opsmx-forwarder"`},
+		{"required, invalid token", "required", nil, "garbage", http.StatusUnauthorized, authReasonInvalidJWT, `Bearer realm="opsmx-forwarder", error="invalid_token"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &ControllerConfig{ServiceAuth: serviceAuthConfig{Mode: tt.mode}}
+			defer func() { config = nil }()
+			failures := serviceAuthFailuresCounter.WithLabelValues(tt.wantReason)
+			before := testutil.ToFloat64(failures)
+
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			if tt.cert != nil {
+				r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			serviceAPIHandler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantChallenge)
+			}
+			checkErrorBody(t, w)
+			if got := testutil.ToFloat64(failures) - before; got != 1 {
+				t.Errorf("expected 1 failure counted as %s, got %v", tt.wantReason, got)
+			}
+		})
+	}
+}
+
+func TestValidateServiceToken(t *testing.T) {
+	key := useTestKeyset(t)
+
+	current, err := jwtutil.MakeJWT(key, testServiceTokenIdentity, "jenkins", "ep1", "agent1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIssuer, err := jwtutil.MakeJWT(key, jwtutil.Identity{Issuer: "other", Audience: defaultServiceTokenAudience}, "jenkins", "ep1", "agent1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.New()
+	_ = token.Set(jwt.IssuerKey, "opsmx")
+	_ = token.Set("t", "jenkins")
+	_ = token.Set("n", "ep1")
+	_ = token.Set("a", "agent1")
+	signed, err := jwt.Sign(token, jwa.HS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := string(signed)
+
+	tests := []struct {
+		name         string
+		token        string
+		acceptLegacy bool
+		wantErr      bool
+		wantLegacy   bool
+	}{
+		{"current", current, false, false, false},
+		{"other issuer", otherIssuer, true, true, false},
+		{"legacy, rejected", legacy, false, true, false},
+		{"legacy, accepted", legacy, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &ControllerConfig{ServiceAuth: serviceAuthConfig{AcceptLegacyTokens: tt.acceptLegacy}}
+			defer func() { config = nil }()
+
+			claims, err := validateServiceToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateServiceToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if claims.Agent != "agent1" || claims.EndpointName != "ep1" || claims.Legacy != tt.wantLegacy {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestExtractEndpoint_tokenSources(t *testing.T) {
+	key := useTestKeyset(t)
+
+	tokenFor := func(agentName string) string {
+		token, err := jwtutil.MakeJWT(key, testServiceTokenIdentity, "jenkins", "ep1", agentName, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	bearerToken := tokenFor("bearer-agent")
+	headerToken := tokenFor("header-agent")
+	basicToken := tokenFor("basic-agent")
+
+	serviceCert := &x509.Certificate{
+		Subject: pkix.Name{
+			Names: []pkix.AttributeTypeAndValue{
+				{
+					Type:  asn1.ObjectIdentifier{2, 5, 4, ca.OpsMxOIDValue},
+					Value: `{"purpose":"service","agent":"cert-agent","type":"jenkins","name":"ep1"}`,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		headerName    string
+		cert          *x509.Certificate
+		headers       map[string]string
+		basicPassword string
+		wantAgent     string
+		wantErr       string
+	}{
+		{"bearer", "", nil, map[string]string{"Authorization": "Bearer " + bearerToken}, "", "bearer-agent", ""},
+		{"bearer, lower case scheme", "", nil, map[string]string{"Authorization": "bearer " + bearerToken}, "", "bearer-agent", ""},
+		{"default header", "", nil, map[string]string{"X-Opsmx-Token": headerToken}, "", "header-agent", ""},
+		{"configured header", "X-Custom-Token", nil, map[string]string{"X-Custom-Token": headerToken}, "", "header-agent", ""},
+		{"default header ignored when another is configured", "X-Custom-Token", nil, map[string]string{"X-Opsmx-Token": headerToken}, "", "", "no valid credentials"},
+		{"basic auth", "", nil, nil, basicToken, "basic-agent", ""},
+		{"bearer preferred over header", "", nil, map[string]string{"Authorization": "Bearer " + bearerToken, "X-Opsmx-Token": headerToken}, "", "bearer-agent", ""},
+		{"header preferred over basic auth", "", nil, map[string]string{"X-Opsmx-Token": headerToken}, basicToken, "header-agent", ""},
+		{"cert preferred over bearer", "", serviceCert, map[string]string{"Authorization": "Bearer " + bearerToken}, "", "cert-agent", ""},
+		{"bearer without token", "", nil, map[string]string{"Authorization": "Bearer"}, "", "", "malformed Bearer"},
+		{"bearer with extra fields", "", nil, map[string]string{"Authorization": "Bearer a b"}, "", "", "malformed Bearer"},
+		{"unknown scheme", "", nil, map[string]string{"Authorization": "Digest " + bearerToken}, "", "", "no valid credentials"},
+		{"no credentials", "", nil, nil, "", "", "no valid credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &ControllerConfig{ServiceAuth: serviceAuthConfig{HeaderName: tt.headerName}}
+			defer func() { config = nil }()
+
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			if tt.cert != nil {
+				r.TLS.PeerCertificates = []*x509.Certificate{tt.cert}
+			}
+			if tt.basicPassword != "" {
+				r.SetBasicAuth("user", tt.basicPassword)
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			agentIdentity, _, _, err := extractEndpoint(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected error containing '%s', got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if agentIdentity != tt.wantAgent {
+				t.Errorf("expected agent '%s', got '%s'", tt.wantAgent, agentIdentity)
+			}
+			if tt.cert == nil && strings.HasPrefix(tt.headers["Authorization"], "Bearer") && r.Header.Get("Authorization") != "" {
+				t.Errorf("expected the Bearer Authorization header to be removed")
+			}
+			if r.Header.Get(config.GetServiceAuthHeaderName()) != "" {
+				t.Errorf("expected the token header to be removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 authentication for the service listener.  The
+// "aws" service credential is an access key of the form name.agent, with
+// the service JWT as both the secret key and the session token.  The token
+// identifies the endpoint, and is the key the request must be signed with.
+
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat     = "20060102T150405Z"
+	sigV4MaxSkew        = 15 * time.Minute
+	sigV4UnsignedBody   = "UNSIGNED-PAYLOAD"
+	sigV4StreamingBody  = "STREAMING-"
+	sigV4MaxBufferedLen = 16 * 1024 * 1024
+)
+
+var (
+	errPayloadHashMismatch = errors.New("request body does not match X-Amz-Content-Sha256")
+
+	// for testing
+	sigV4Now = time.Now
+)
+
+type sigV4Authorization struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+}
+
+func (a *sigV4Authorization) scope() string {
+	return strings.Join([]string{a.date, a.region, a.service, "aws4_request"}, "/")
+}
+
+func isSigV4Request(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ")
+}
+
+// parseSigV4Authorization parses an Authorization header of the form
+// "AWS4-HMAC-SHA256 Credential=AKID/20210601/us-east-1/s3/aws4_request,
+// SignedHeaders=host;x-amz-date, Signature=hex".
+func parseSigV4Authorization(header string) (*sigV4Authorization, error) {
+	if !strings.HasPrefix(header, sigV4Algorithm+" ") {
+		return nil, fmt.Errorf("authorization is not %s", sigV4Algorithm)
+	}
+	ret := &sigV4Authorization{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, sigV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed authorization component '%s'", part)
+		}
+		switch kv[0] {
+		case "Credential":
+			credential := strings.Split(kv[1], "/")
+			if len(credential) != 5 || credential[4] != "aws4_request" {
+				return nil, fmt.Errorf("malformed credential scope '%s'", kv[1])
+			}
+			ret.accessKey = credential[0]
+			ret.date = credential[1]
+			ret.region = credential[2]
+			ret.service = credential[3]
+		case "SignedHeaders":
+			ret.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			ret.signature = kv[1]
+		}
+	}
+	if ret.accessKey == "" || len(ret.signedHeaders) == 0 || ret.signature == "" {
+		return nil, fmt.Errorf("authorization requires Credential, SignedHeaders, and Signature")
+	}
+	return ret, nil
+}
+
+// sigV4Encode URI encodes s as AWS requires, leaving only the unreserved
+// characters as-is.
+func sigV4Encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sigV4CanonicalURI(r *http.Request, service string) string {
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// S3 signs the path as sent, every other service encodes it again.
+	if service == "s3" {
+		return path
+	}
+	return sigV4Encode(path, false)
+}
+
+func sigV4CanonicalQuery(query url.Values) string {
+	params := []string{}
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, sigV4Encode(key, true)+"="+sigV4Encode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func sigV4HeaderValue(r *http.Request, name string) (string, bool) {
+	switch name {
+	case "host":
+		return r.Host, r.Host != ""
+	case "content-length":
+		if r.Header.Get("Content-Length") == "" && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10), true
+		}
+	}
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(trimmed, ","), true
+}
+
+func sigV4CanonicalRequest(r *http.Request, auth *sigV4Authorization, payloadHash string) (string, error) {
+	var headers strings.Builder
+	for _, name := range auth.signedHeaders {
+		value, found := sigV4HeaderValue(r, name)
+		if !found {
+			return "", fmt.Errorf("signed header '%s' is missing", name)
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	return strings.Join([]string{
+		r.Method,
+		sigV4CanonicalURI(r, auth.service),
+		sigV4CanonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(auth.signedHeaders, ";"),
+		payloadHash,
+	}, "\n"), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sigV4Signature(secret string, auth *sigV4Authorization, amzDate string, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		auth.scope(),
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secret), auth.date)
+	key = hmacSHA256(key, auth.region)
+	key = hmacSHA256(key, auth.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// payloadVerifier passes the body through, failing at EOF if it does not
+// match the signed payload hash.
+type payloadVerifier struct {
+	body io.ReadCloser
+	hash hash.Hash
+	want string
+}
+
+func (v *payloadVerifier) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	_, _ = v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+		return n, errPayloadHashMismatch
+	}
+	return n, err
+}
+
+func (v *payloadVerifier) Close() error {
+	return v.body.Close()
+}
+
+// sigV4PayloadHash returns the payload hash the signature covers.  When the
+// client sends the hash, the body is checked as it is streamed to the agent;
+// otherwise it is read here to compute it.
+func sigV4PayloadHash(r *http.Request) (string, error) {
+	want := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case want == sigV4UnsignedBody:
+		return want, nil
+	case strings.HasPrefix(want, sigV4StreamingBody):
+		return "", fmt.Errorf("X-Amz-Content-Sha256 '%s' is not supported", want)
+	case want != "":
+		if _, err := hex.DecodeString(want); err != nil || len(want) != sha256.Size*2 {
+			return "", fmt.Errorf("X-Amz-Content-Sha256 is malformed")
+		}
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+			empty := sha256.Sum256(nil)
+			if hex.EncodeToString(empty[:]) != want {
+				return "", errPayloadHashMismatch
+			}
+			return want, nil
+		}
+		r.Body = &payloadVerifier{body: r.Body, hash: sha256.New(), want: want}
+		return want, nil
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, sigV4MaxBufferedLen+1))
+		if err != nil {
+			return "", err
+		}
+		if len(body) > sigV4MaxBufferedLen {
+			return "", fmt.Errorf("request body too large to sign without X-Amz-Content-Sha256")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// extractEndpointFromSigV4 authenticates a request signed with an "aws"
+// service credential.  The session token is validated as for basic auth,
+// the access key must name the same endpoint and agent, and the signature
+// must have been made with the token as the secret key.
+func extractEndpointFromSigV4(r *http.Request) (agentIdentity string, endpointType string, endpointName string, err error) {
+	auth, err := parseSigV4Authorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	ts, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		return "", "", "", fmt.Errorf("X-Amz-Date is missing or malformed")
+	}
+	if skew := sigV4Now().Sub(ts); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return "", "", "", &errUnauthorized{reason: authReasonInvalidSignature, err: fmt.Errorf("request time %s is too far from the server time", amzDate)}
+	}
+	if auth.date != ts.Format("20060102") {
+		return "", "", "", fmt.Errorf("credential date %s does not match X-Amz-Date", auth.date)
+	}
+	if !contains(auth.signedHeaders, "host") || !contains(auth.signedHeaders, "x-amz-date") {
+		return "", "", "", fmt.Errorf("host and x-amz-date must be signed")
+	}
+
+	token := r.Header.Get("X-Amz-Security-Token")
+	if token == "" {
+		return "", "", "", fmt.Errorf("X-Amz-Security-Token is required")
+	}
+	claims, err := validateServiceToken(token)
+	if err != nil {
+		return "", "", "", rejectedServiceToken(err)
+	}
+	agentIdentity, endpointType, endpointName = claims.Agent, claims.EndpointType, claims.EndpointName
+	if auth.accessKey != endpointName+"."+agentIdentity {
+		return "", "", "", &errUnauthorized{reason: authReasonInvalidSignature, err: fmt.Errorf("access key does not match the session token")}
+	}
+
+	payloadHash, err := sigV4PayloadHash(r)
+	if err != nil {
+		return "", "", "", err
+	}
+	canonicalRequest, err := sigV4CanonicalRequest(r, auth, payloadHash)
+	if err != nil {
+		return "", "", "", err
+	}
+	want := sigV4Signature(token, auth, amzDate, canonicalRequest)
+	if !hmac.Equal([]byte(want), []byte(auth.signature)) {
+		return "", "", "", &errUnauthorized{reason: authReasonInvalidSignature, err: fmt.Errorf("signature does not match")}
+	}
+
+	r.Header.Del("X-Amz-Security-Token")
+	return agentIdentity, endpointType, endpointName, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
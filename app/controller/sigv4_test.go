@@ -0,0 +1,135 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/opsmx/oes-birger/pkg/jwtutil"
+)
+
+func TestExtractEndpointFromSigV4(t *testing.T) {
+	key := useTestKeyset(t)
+	config = &ControllerConfig{}
+	defer func() { config = nil }()
+
+	token, err := jwtutil.MakeJWT(key, testServiceTokenIdentity, "aws", "ep1", "agent1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := jwtutil.MakeJWT(key, testServiceTokenIdentity, "aws", "ep2", "agent1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	sigV4Now = func() time.Time { return now }
+	defer func() { sigV4Now = time.Now }()
+
+	tests := []struct {
+		name       string
+		service    string
+		body       string
+		accessKey  string
+		secret     string
+		signedAt   time.Time
+		modify     func(r *http.Request)
+		wantErr    bool
+		wantUnauth bool
+		wantReadOK bool
+	}{
+		{"valid", "ec2", "", "ep1.agent1", token, now, nil, false, false, true},
+		{"valid with body", "ec2", "Action=DescribeInstances", "ep1.agent1", token, now, nil, false, false, true},
+		{"s3 with body", "s3", "some object", "ep1.agent1", token, now, nil, false, false, true},
+		{"skew within limit", "s3", "", "ep1.agent1", token, now.Add(-14 * time.Minute), nil, false, false, true},
+		{"skew too large", "s3", "", "ep1.agent1", token, now.Add(16 * time.Minute), nil, true, true, false},
+		{"wrong secret", "s3", "", "ep1.agent1", other, now, nil, true, true, false},
+		{"access key mismatch", "s3", "", "ep2.agent1", token, now, nil, true, true, false},
+		{
+			"signed header modified", "s3", "", "ep1.agent1", token, now,
+			func(r *http.Request) { r.Header.Set("X-Amz-Date", now.Add(time.Minute).Format(sigV4TimeFormat)) },
+			true, true, false,
+		},
+		{
+			"host not signed", "s3", "", "ep1.agent1", token, now,
+			func(r *http.Request) {
+				auth := r.Header.Get("Authorization")
+				r.Header.Set("Authorization", string(bytes.Replace([]byte(auth), []byte("host;"), nil, 1)))
+			},
+			true, false, false,
+		},
+		{
+			"body tampered", "s3", "some object", "ep1.agent1", token, now,
+			func(r *http.Request) { r.Body = ioutil.NopCloser(bytes.NewBufferString("other object")) },
+			false, false, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "https://localhost/bucket/some%20key?b=2&a=1", bytes.NewBufferString(tt.body))
+			signer := v4.NewSigner(credentials.NewStaticCredentials(tt.accessKey, tt.secret, token), func(s *v4.Signer) {
+				// as the S3 client does
+				s.DisableURIPathEscaping = tt.service == "s3"
+			})
+			var body io.ReadSeeker
+			if tt.body != "" {
+				body = bytes.NewReader([]byte(tt.body))
+			}
+			if _, err := signer.Sign(r, body, tt.service, "us-east-1", tt.signedAt); err != nil {
+				t.Fatal(err)
+			}
+			if tt.modify != nil {
+				tt.modify(r)
+			}
+
+			agentIdentity, endpointType, endpointName, err := extractEndpoint(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, ok := err.(*errUnauthorized); ok != tt.wantUnauth {
+					t.Errorf("expected unauthorized %v, got %T", tt.wantUnauth, err)
+				}
+				return
+			}
+			if agentIdentity != "agent1" || endpointType != "aws" || endpointName != "ep1" {
+				t.Errorf("unexpected endpoint %s/%s/%s", agentIdentity, endpointType, endpointName)
+			}
+			if r.Header.Get("X-Amz-Security-Token") != "" {
+				t.Errorf("expected X-Amz-Security-Token to be removed")
+			}
+			if r.Body == nil {
+				r.Body = http.NoBody
+			}
+			got, err := ioutil.ReadAll(r.Body)
+			if (err == nil) != tt.wantReadOK {
+				t.Errorf("reading body: error = %v, want success %v", err, tt.wantReadOK)
+			}
+			if err == nil && string(got) != tt.body {
+				t.Errorf("expected body '%s', got '%s'", tt.body, got)
+			}
+		})
+	}
+}
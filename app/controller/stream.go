@@ -0,0 +1,171 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// streamDataMessage carries bytes from the client of an upgraded
+// connection to the agent session handling the stream.
+type streamDataMessage struct {
+	data *tunnel.StreamData
+}
+
+// streamCloseMessage tells the agent the client's connection has closed,
+// and frees the stream's transaction entry.
+type streamCloseMessage struct {
+	id string
+}
+
+// isUpgradeRequest returns true if the client asked to switch protocols,
+// as kubectl does for exec, attach, and port-forward.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// closeStream tells the agent the stream is finished, and discards anything
+// it sends until the transaction's channel is closed.
+func closeStream(ep agent.Search, id string, out chan *tunnel.AgentToControllerWrapper) {
+	logger := util.LogWith("transaction", id, "agent", ep.Name)
+	go func() {
+		for range out {
+		}
+	}()
+	if err := agents.SendToSession(ep, &streamCloseMessage{id: id}); err != nil {
+		logger.Warnf("while closing stream: %v", err)
+	}
+}
+
+func writeSwitchingProtocols(w *bufio.Writer, resp *tunnel.HttpResponse) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", resp.Status, http.StatusText(int(resp.Status))); err != nil {
+		return err
+	}
+	headers := http.Header{}
+	for _, header := range resp.Headers {
+		for _, value := range header.Values {
+			headers.Add(header.Name, value)
+		}
+	}
+	if err := headers.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// streamFromClient sends everything read from the client to the agent, and
+// closes done when the client's side of the connection closes or fails.
+func streamFromClient(ep agent.Search, id string, r io.Reader, done chan struct{}) {
+	logger := util.LogWith("transaction", id, "agent", ep.Name)
+	defer close(done)
+	buf := make([]byte, requestBodyChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			message := &streamDataMessage{data: &tunnel.StreamData{Id: id, Data: data}}
+			if err := agents.SendToSession(ep, message); err != nil {
+				logger.Warnf("while sending stream data: %v", err)
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// runStream takes over the client's connection once the agent reports the
+// upstream server has switched protocols, and copies bytes between it and
+// the agent.  When either side closes or fails, the other is closed and the
+// transaction is freed.
+func runStream(ep agent.Search, id string, w http.ResponseWriter, resp *tunnel.HttpResponse, out chan *tunnel.AgentToControllerWrapper) {
+	logger := util.LogWith("transaction", id, "agent", ep.Name)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Warnf("Connection cannot be upgraded")
+		closeStream(ep, id, out)
+		util.FailRequestWithID(w, fmt.Errorf("connection cannot be upgraded"), http.StatusInternalServerError, id)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Warnf("Unable to take over connection: %v", err)
+		closeStream(ep, id, out)
+		return
+	}
+	defer conn.Close()
+
+	if err := writeSwitchingProtocols(rw.Writer, resp); err != nil {
+		logger.Warnf("Unable to write response: %v", err)
+		closeStream(ep, id, out)
+		return
+	}
+
+	clientDone := make(chan struct{})
+	go streamFromClient(ep, id, rw.Reader, clientDone)
+
+	for {
+		select {
+		case in, more := <-out:
+			if !more {
+				// The agent went away, or the stream was cancelled.
+				return
+			}
+			switch x := in.Event.(type) {
+			case *tunnel.AgentToControllerWrapper_StreamData:
+				if _, err := conn.Write(in.GetStreamData().Data); err != nil {
+					logger.Warnf("Unable to write to client: %v", err)
+					closeStream(ep, id, out)
+					return
+				}
+			case *tunnel.AgentToControllerWrapper_StreamClose:
+				if message := in.GetStreamClose().Message; message != "" {
+					logger.Debugf("Agent closed stream: %s", message)
+				}
+				return
+			default:
+				logger.Warnf("Unexpected message on stream: %T", x)
+			}
+		case <-clientDone:
+			closeStream(ep, id, out)
+			return
+		}
+	}
+}
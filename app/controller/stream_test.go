@@ -0,0 +1,199 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"plain request", map[string]string{}, false},
+		{"websocket", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, true},
+		{"spdy, token list", map[string]string{"Connection": "keep-alive, upgrade", "Upgrade": "SPDY/3.1"}, true},
+		{"no upgrade protocol", map[string]string{"Connection": "Upgrade"}, false},
+		{"upgrade not in connection", map[string]string{"Connection": "keep-alive", "Upgrade": "websocket"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://localhost/api", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := isUpgradeRequest(r); got != tt.want {
+				t.Errorf("isUpgradeRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// startFakeStreamAgent connects an agent which accepts every upgrade and
+// echoes stream data back, except for "bye" which makes it close the stream
+// as the tunnel does when the upstream connection ends.  The returned
+// channel is closed when the controller closes the stream.
+func startFakeStreamAgent(t *testing.T) (*agent.DirectlyConnectedAgent, chan struct{}) {
+	state := &agent.DirectlyConnectedAgent{
+		Name:            "agent1",
+		Session:         "session1",
+		Endpoints:       []agent.Endpoint{{Name: "ep1", Type: "kubernetes", Configured: true}},
+		InRequest:       make(chan interface{}, 1),
+		InCancelRequest: make(chan string, 1),
+	}
+	closed := make(chan struct{})
+	go func() {
+		var msg *HTTPMessage
+		for m := range state.InRequest {
+			switch x := m.(type) {
+			case *HTTPMessage:
+				if !x.Upgrade {
+					t.Errorf("expected an upgrade request")
+				}
+				msg = x
+				msg.Out <- &tunnel.AgentToControllerWrapper{
+					Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+						HttpResponse: &tunnel.HttpResponse{
+							Id:     msg.Cmd.Id,
+							Status: http.StatusSwitchingProtocols,
+							Headers: []*tunnel.HttpHeader{
+								{Name: "Connection", Values: []string{"Upgrade"}},
+								{Name: "Upgrade", Values: []string{"test"}},
+							},
+						},
+					},
+				}
+			case *streamDataMessage:
+				if string(x.data.Data) == "bye" {
+					msg.Out <- &tunnel.AgentToControllerWrapper{
+						Event: &tunnel.AgentToControllerWrapper_StreamClose{
+							StreamClose: &tunnel.StreamClose{Id: x.data.Id},
+						},
+					}
+					msg.Close()
+					continue
+				}
+				msg.Out <- &tunnel.AgentToControllerWrapper{
+					Event: &tunnel.AgentToControllerWrapper_StreamData{
+						StreamData: &tunnel.StreamData{Id: x.data.Id, Data: x.data.Data},
+					},
+				}
+			case *streamCloseMessage:
+				msg.Close()
+				close(closed)
+			}
+		}
+	}()
+	agents.AddAgent(state)
+	return state, closed
+}
+
+// dialUpgrade connects to the server and asks to switch protocols.
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("GET /api/v1/namespaces/ns/pods/pod/exec HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "test" {
+		t.Fatalf("expected 101 with Upgrade: test, got %d %v", resp.StatusCode, resp.Header)
+	}
+	return conn, br
+}
+
+func TestRunAPIHandler_stream(t *testing.T) {
+	config = &ControllerConfig{Timeouts: timeoutConfig{RequestTimeout: 5}}
+	defer func() { config = nil }()
+
+	tests := []struct {
+		name        string
+		clientClose bool
+	}{
+		{"client closes", true},
+		{"agent closes", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, closed := startFakeStreamAgent(t)
+			defer func() { _ = agents.RemoveAgent(state) }()
+
+			ep := agent.Search{Name: "agent1", EndpointType: "kubernetes", EndpointName: "ep1"}
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				runAPIHandler(ep, w, r)
+				close(done)
+			}))
+			defer srv.Close()
+
+			conn, br := dialUpgrade(t, srv.Listener.Addr().String())
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("expected echoed 'ping', got '%s' (%v)", buf, err)
+			}
+
+			if tt.clientClose {
+				conn.Close()
+				select {
+				case <-closed:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("agent was not told the stream closed")
+				}
+			} else {
+				if _, err := conn.Write([]byte("bye")); err != nil {
+					t.Fatal(err)
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := br.ReadByte(); err != io.EOF {
+					t.Fatalf("expected the client connection to be closed, got %v", err)
+				}
+			}
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("runAPIHandler did not return")
+			}
+			if n := agents.Outstanding(state.Session); n != 0 {
+				t.Errorf("expected no outstanding transactions, got %d", n)
+			}
+		})
+	}
+}
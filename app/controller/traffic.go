@@ -0,0 +1,115 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// trafficCounters are the traffic counters of one agent and endpoint type.
+type trafficCounters struct {
+	requestBytes   prometheus.Counter
+	requestChunks  prometheus.Counter
+	responseBytes  prometheus.Counter
+	responseChunks prometheus.Counter
+}
+
+// tunnelTraffic counts the HTTP data through an agent's tunnel, both in the
+// session's totals and in the metrics.  The counters for each endpoint
+// type are looked up once and kept, so counting a chunk takes no lock.  It
+// is used by one goroutine only; the sending and receiving sides of a
+// tunnel each have their own.
+type tunnelTraffic struct {
+	agentName string
+	session   *agent.Traffic
+	counters  map[string]*trafficCounters
+}
+
+func newTunnelTraffic(agentName string, session *agent.Traffic) *tunnelTraffic {
+	return &tunnelTraffic{
+		agentName: agentName,
+		session:   session,
+		counters:  map[string]*trafficCounters{},
+	}
+}
+
+func (t *tunnelTraffic) forType(endpointType string) *trafficCounters {
+	c, found := t.counters[endpointType]
+	if !found {
+		c = &trafficCounters{
+			requestBytes:   tunnelRequestBytesCounter.WithLabelValues(t.agentName, endpointType),
+			requestChunks:  tunnelRequestChunksCounter.WithLabelValues(t.agentName, endpointType),
+			responseBytes:  tunnelResponseBytesCounter.WithLabelValues(t.agentName, endpointType),
+			responseChunks: tunnelResponseChunksCounter.WithLabelValues(t.agentName, endpointType),
+		}
+		t.counters[endpointType] = c
+	}
+	return c
+}
+
+// requestChunk counts request body sent to the agent.  The empty chunk
+// which ends a body carries no data, so is not counted.
+func (t *tunnelTraffic) requestChunk(endpointType string, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	c := t.forType(endpointType)
+	c.requestBytes.Add(float64(len(body)))
+	c.requestChunks.Inc()
+	t.session.AddRequestChunk(len(body))
+}
+
+// responseHeaders counts the headers of a response from the agent.
+func (t *tunnelTraffic) responseHeaders(endpointType string, headers []*tunnel.HttpHeader) {
+	n := headerBytes(headers)
+	t.forType(endpointType).responseBytes.Add(float64(n))
+	t.session.AddResponseHeaders(n)
+}
+
+// responseChunk counts response body received from the agent.  As with
+// requests, the empty chunk which ends a body is not counted.
+func (t *tunnelTraffic) responseChunk(endpointType string, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	c := t.forType(endpointType)
+	c.responseBytes.Add(float64(len(body)))
+	c.responseChunks.Inc()
+	t.session.AddResponseChunk(len(body))
+}
+
+// transactionEndpointType returns the endpoint type an HTTP transaction was
+// sent to.
+func transactionEndpointType(t pendingTransaction) string {
+	if m, ok := t.(*HTTPMessage); ok {
+		return m.Cmd.Type
+	}
+	return "unknown"
+}
+
+// headerBytes returns the size of the names and values of headers.
+func headerBytes(headers []*tunnel.HttpHeader) int {
+	n := 0
+	for _, h := range headers {
+		for _, v := range h.Values {
+			n += len(h.Name) + len(v)
+		}
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/opsmx/oes-birger/app/controller/agent"
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func TestTunnelTraffic(t *testing.T) {
+	const agentName = "traffic"
+	s := newAgentServer()
+	stream := &fakeAgentStream{in: make(chan *tunnel.AgentToControllerWrapper)}
+	state := &agent.DirectlyConnectedAgent{Name: agentName, Session: "session"}
+	httpids := newSessionList()
+
+	requestBytes := tunnelRequestBytesCounter.WithLabelValues(agentName, "jenkins")
+	requestChunks := tunnelRequestChunksCounter.WithLabelValues(agentName, "jenkins")
+	responseBytes := tunnelResponseBytesCounter.WithLabelValues(agentName, "jenkins")
+	responseChunks := tunnelResponseChunksCounter.WithLabelValues(agentName, "jenkins")
+	before := []float64{
+		testutil.ToFloat64(requestBytes),
+		testutil.ToFloat64(requestChunks),
+		testutil.ToFloat64(responseBytes),
+		testutil.ToFloat64(responseChunks),
+	}
+
+	// One request with its body buffered, and another streaming its body
+	// in two chunks and the empty one which ends it.
+	requests := make(chan interface{})
+	state.InRequest = requests
+	sendDone := make(chan struct{})
+	go func() {
+		s.handleHTTPRequests(state, httpids, newTunnelTraffic(agentName, &state.Traffic), stream)
+		close(sendDone)
+	}()
+	replies := make(chan *tunnel.AgentToControllerWrapper, 10)
+	requests <- &HTTPMessage{Out: replies, Cmd: &tunnel.HttpRequest{Id: "buffered", Type: "jenkins", Body: []byte("12345")}}
+	requests <- &HTTPMessage{Out: make(chan *tunnel.AgentToControllerWrapper, 10), Cmd: &tunnel.HttpRequest{Id: "streamed", Type: "jenkins"}}
+	for _, body := range []string{"1234567890", "123", ""} {
+		requests <- &httpRequestChunkMessage{chunk: &tunnel.HttpRequestChunk{Id: "streamed", Body: []byte(body)}, endpointType: "jenkins"}
+	}
+	close(requests)
+	<-sendDone
+
+	// The response to the first, with its headers and a chunked body.
+	recvDone := make(chan error, 1)
+	go func() { recvDone <- s.receive(stream, state, httpids, make(chan struct{})) }()
+	stream.in <- &tunnel.AgentToControllerWrapper{
+		Event: &tunnel.AgentToControllerWrapper_HttpResponse{
+			HttpResponse: &tunnel.HttpResponse{
+				Id:            "buffered",
+				Status:        200,
+				ContentLength: -1,
+				Headers:       []*tunnel.HttpHeader{{Name: "Content-Type", Values: []string{"text/plain"}}},
+			},
+		},
+	}
+	for _, body := range []string{"abcdefgh", "ij", ""} {
+		stream.in <- &tunnel.AgentToControllerWrapper{
+			Event: &tunnel.AgentToControllerWrapper_HttpChunkedResponse{
+				HttpChunkedResponse: &tunnel.HttpChunkedResponse{Id: "buffered", Body: []byte(body)},
+			},
+		}
+	}
+	close(stream.in)
+	if err := <-recvDone; err != nil {
+		t.Fatalf("receive() = %v", err)
+	}
+
+	want := agent.Traffic{
+		RequestBytes:   5 + 10 + 3,
+		RequestChunks:  3,
+		ResponseBytes:  uint64(len("Content-Type")+len("text/plain")) + 8 + 2,
+		ResponseChunks: 2,
+	}
+	if got := state.Traffic.Snapshot(); got != want {
+		t.Errorf("session traffic = %+v, want %+v", got, want)
+	}
+	stats := state.GetStatistics().(*agent.DirectlyConnectedAgentStatistics)
+	if stats.Traffic != want {
+		t.Errorf("statistics traffic = %+v, want %+v", stats.Traffic, want)
+	}
+
+	counters := []struct {
+		name string
+		got  float64
+		want uint64
+	}{
+		{"request bytes", testutil.ToFloat64(requestBytes) - before[0], want.RequestBytes},
+		{"request chunks", testutil.ToFloat64(requestChunks) - before[1], want.RequestChunks},
+		{"response bytes", testutil.ToFloat64(responseBytes) - before[2], want.ResponseBytes},
+		{"response chunks", testutil.ToFloat64(responseChunks) - before[3], want.ResponseChunks},
+	}
+	for _, c := range counters {
+		if c.got != float64(c.want) {
+			t.Errorf("%s metric = %v, want %d", c.name, c.got, c.want)
+		}
+	}
+}
@@ -36,6 +36,7 @@ var (
 	agentIdentity = flag.String("agent", "", "agent name")
 	endpointType  = flag.String("type", "", "endpoint type")
 	action        = flag.String("action", "", "action, one of: agent, kubectl, agent-manifest, remote-command, control")
+	format        = flag.String("format", "", "output format; agent-manifest: json, yaml, helm-values, or kustomize; kubectl: json or kubeconfig")
 )
 
 func usage(message string) {
@@ -44,10 +45,10 @@ func usage(message string) {
 	}
 	flag.Usage()
 	fmt.Fprintf(os.Stderr, "\n")
-	fmt.Fprintf(os.Stderr, "  'kubectl' requires: agent, endpointName.\n")
+	fmt.Fprintf(os.Stderr, "  'kubectl' requires: agent, endpointName, and optionally format.\n")
 	fmt.Fprintf(os.Stderr, "  'service' requires: agent, endpointType, endpointName.\n")
 	fmt.Fprintf(os.Stderr, "  'remote-command' requires: agent, endpointName.\n")
-	fmt.Fprintf(os.Stderr, "  'agent-manifest' requires: agent.\n")
+	fmt.Fprintf(os.Stderr, "  'agent-manifest' requires: agent, and optionally format.\n")
 	fmt.Fprintf(os.Stderr, "  'control' requires no other options.\n")
 	os.Exit(-1)
 }
@@ -67,6 +68,7 @@ func getKubeconfigCreds() {
 	request := fwdapi.KubeConfigRequest{
 		AgentName: *agentIdentity,
 		Name:      *endpointName,
+		Format:    *format,
 	}
 	client := makeClient()
 	resp, err := client.R().
@@ -85,6 +87,7 @@ func getKubeconfigCreds() {
 func getAgentManifest() {
 	request := fwdapi.ManifestRequest{
 		AgentName: *agentIdentity,
+		Format:    *format,
 	}
 	client := makeClient()
 	resp, err := client.R().
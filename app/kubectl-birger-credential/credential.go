@@ -0,0 +1,154 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The ExecCredential version kubectl asks for if it does not say.
+const defaultAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// The ExecCredential API versions we can answer.
+var execCredentialAPIVersions = map[string]bool{
+	"client.authentication.k8s.io/v1alpha1": true,
+	"client.authentication.k8s.io/v1beta1":  true,
+	"client.authentication.k8s.io/v1":       true,
+}
+
+// A cached token is fetched again once it is this close to expiring, so
+// kubectl is not handed a token which expires mid-request.
+const cacheExpirySkew = time.Minute
+
+// execCredential is the ExecCredential exchanged with kubectl.  Only the
+// fields we use are included.
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialStatus struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp"`
+}
+
+// requestedAPIVersion returns the ExecCredential version kubectl asked for
+// in KUBERNETES_EXEC_INFO, which older versions do not set.
+func requestedAPIVersion(info string) (string, error) {
+	if info == "" {
+		return defaultAPIVersion, nil
+	}
+	var msg execCredential
+	if err := json.Unmarshal([]byte(info), &msg); err != nil {
+		return "", fmt.Errorf("unable to parse KUBERNETES_EXEC_INFO: %v", err)
+	}
+	if msg.APIVersion == "" {
+		return defaultAPIVersion, nil
+	}
+	if !execCredentialAPIVersions[msg.APIVersion] {
+		return "", fmt.Errorf("ExecCredential apiVersion '%s' is not supported", msg.APIVersion)
+	}
+	return msg.APIVersion, nil
+}
+
+func makeExecCredential(apiVersion string, token *cachedToken) ([]byte, error) {
+	return json.Marshal(execCredential{
+		APIVersion: apiVersion,
+		Kind:       "ExecCredential",
+		Status: &execCredentialStatus{
+			Token:               token.Token,
+			ExpirationTimestamp: token.Expiry.UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+// cachedToken is a service token and when it expires.
+type cachedToken struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// tokenCache keeps a token in a file of its own, named for the controller,
+// agent and endpoint it is for.  A cache with no directory keeps nothing.
+type tokenCache struct {
+	filename string
+}
+
+func newTokenCache(dir string, controlURL string, agentName string, endpointName string) *tokenCache {
+	if dir == "" {
+		return &tokenCache{}
+	}
+	sum := sha256.Sum256([]byte(controlURL + "\x00" + agentName + "\x00" + endpointName))
+	return &tokenCache{filename: filepath.Join(dir, hex.EncodeToString(sum[:16])+".json")}
+}
+
+// get returns the cached token, or nil if there is none which will still
+// be valid for a while after now.  An unreadable cache is treated as empty.
+func (c *tokenCache) get(now time.Time) *cachedToken {
+	if c.filename == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(c.filename)
+	if err != nil {
+		return nil
+	}
+	var token cachedToken
+	if err := json.Unmarshal(buf, &token); err != nil || token.Token == "" {
+		return nil
+	}
+	if !now.Add(cacheExpirySkew).Before(token.Expiry) {
+		return nil
+	}
+	return &token
+}
+
+// put replaces the cached token.  The file is readable only by its owner,
+// and is replaced whole so a concurrent get never sees part of it.
+func (c *tokenCache) put(token *cachedToken) error {
+	if c.filename == "" {
+		return nil
+	}
+	buf, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(c.filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.filename)
+}
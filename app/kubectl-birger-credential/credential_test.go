@@ -0,0 +1,141 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+func TestRequestedAPIVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    string
+		want    string
+		wantErr bool
+	}{
+		{"unset", "", defaultAPIVersion, false},
+		{"v1", `{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","spec":{"interactive":false}}`, "client.authentication.k8s.io/v1", false},
+		{"no version", `{"kind":"ExecCredential"}`, defaultAPIVersion, false},
+		{"unknown version", `{"apiVersion":"client.authentication.k8s.io/v2"}`, "", true},
+		{"bad json", `{`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := requestedAPIVersion(tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("requestedAPIVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("requestedAPIVersion() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeExecCredential(t *testing.T) {
+	expiry := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	out, err := makeExecCredential("client.authentication.k8s.io/v1", &cachedToken{Token: "abc", Expiry: expiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"abc","expirationTimestamp":"2021-06-01T12:00:00Z"}}`
+	if string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestServiceToken(t *testing.T) {
+	// The credential is decoded from JSON, so is a map rather than the
+	// struct the controller encoded.
+	var resp fwdapi.ServiceCredentialResponse
+	body := `{"credentialType":"basic","credential":{"username":"ep.agent","password":"token"}}`
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	got, err := serviceToken(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "token" {
+		t.Errorf("serviceToken() = %s, want token", got)
+	}
+
+	resp.CredentialType = "aws"
+	if _, err := serviceToken(&resp); err == nil {
+		t.Errorf("expected an error for an aws credential")
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	cache := newTokenCache(filepath.Join(dir, "birger"), "https://control", "agent1", "ep1")
+
+	if got := cache.get(now); got != nil {
+		t.Fatalf("empty cache returned %v", got)
+	}
+	token := &cachedToken{Token: "abc", Expiry: now.Add(10 * time.Minute)}
+	if err := cache.put(token); err != nil {
+		t.Fatal(err)
+	}
+	got := cache.get(now)
+	if got == nil || got.Token != "abc" {
+		t.Fatalf("get() = %v, want the token put", got)
+	}
+	info, err := os.Stat(cache.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("cache file mode is %o, want 600", info.Mode().Perm())
+	}
+
+	// A token about to expire is not used.
+	if got := cache.get(now.Add(10*time.Minute - cacheExpirySkew)); got != nil {
+		t.Errorf("get() returned a token about to expire")
+	}
+
+	// Each endpoint has its own token.
+	other := newTokenCache(filepath.Join(dir, "birger"), "https://control", "agent1", "ep2")
+	if got := other.get(now); got != nil {
+		t.Errorf("get() for another endpoint returned %v", got)
+	}
+
+	// A damaged cache is ignored.
+	if err := ioutil.WriteFile(cache.filename, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := cache.get(now); got != nil {
+		t.Errorf("get() from a damaged cache returned %v", got)
+	}
+
+	// With no directory, nothing is kept.
+	none := newTokenCache("", "https://control", "agent1", "ep1")
+	if err := none.put(token); err != nil {
+		t.Fatal(err)
+	}
+	if got := none.get(now); got != nil {
+		t.Errorf("get() with no cache returned %v", got)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/cncclient"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+var (
+	versionBuild = -1
+	version      = util.Versions{Major: 1, Minor: 0, Patch: 0, Build: versionBuild}
+
+	controlURL   = flag.String("url", "https://forwarder-controller:9003", "The URL of the controller's control endpoint")
+	agentName    = flag.String("agent", "", "The agent whose Kubernetes endpoint the token is for")
+	endpointName = flag.String("name", "", "The name of the agent's Kubernetes endpoint")
+	certFile     = flag.String("certFile", defaultPath("control-cert.pem"), "The file containing the control certificate used to connect to the controller")
+	keyFile      = flag.String("keyFile", defaultPath("control-key.pem"), "The file containing the control certificate's key")
+	caCertFile   = flag.String("caCertFile", defaultPath("ca-cert.pem"), "The file containing the CA certificate we will use to verify the controller's cert")
+	expiresIn    = flag.Duration("expiresIn", 15*time.Minute, "How long each token is valid")
+	cacheDir     = flag.String("cacheDir", defaultCacheDir(), "The directory tokens are cached in, or empty to not cache them")
+
+	showVersion = flag.Bool("version", false, "Print the version and exit")
+)
+
+// defaultPath returns name in ~/.birger, where the control certificate is
+// looked for unless another file is given.
+func defaultPath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(home, ".birger", name)
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "birger")
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", fwdapi.KubeConfigCredentialPlugin, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// fetchToken asks the controller for a new service token.
+func fetchToken(ctx context.Context, now time.Time) (*cachedToken, error) {
+	certPEM, err := ioutil.ReadFile(*certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(*caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := cncclient.New(*controlURL, certPEM, keyPEM, caPEM)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GenerateServiceCredentials(ctx, fwdapi.ServiceCredentialRequest{
+		AgentName: *agentName,
+		Type:      "kubernetes",
+		Name:      *endpointName,
+		ExpiresIn: int64(expiresIn.Seconds()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	token, err := serviceToken(resp)
+	if err != nil {
+		return nil, err
+	}
+	// The expiry is counted from before the request, so it is never later
+	// than the controller's.
+	return &cachedToken{Token: token, Expiry: now.Add(*expiresIn).Truncate(time.Second)}, nil
+}
+
+// serviceToken returns the bearer token from a basic service credential,
+// which is its password.
+func serviceToken(resp *fwdapi.ServiceCredentialResponse) (string, error) {
+	if resp.CredentialType != "basic" {
+		return "", fmt.Errorf("controller returned a '%s' credential, not 'basic'", resp.CredentialType)
+	}
+	buf, err := json.Marshal(resp.Credential)
+	if err != nil {
+		return "", err
+	}
+	var basic fwdapi.BasicCredentialResponse
+	if err := json.Unmarshal(buf, &basic); err != nil {
+		return "", fmt.Errorf("decoding credential: %v", err)
+	}
+	if basic.Password == "" {
+		return "", fmt.Errorf("controller returned no token")
+	}
+	return basic.Password, nil
+}
+
+// main runs as a kubectl exec credential plugin.  It uses a control
+// certificate to fetch a short-lived service token for an agent's
+// Kubernetes endpoint, and prints it as an ExecCredential.  Tokens are
+// cached on disk until shortly before they expire.
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("%s %s\n", fwdapi.KubeConfigCredentialPlugin, version.Detailed())
+		os.Exit(0)
+	}
+	if *agentName == "" || *endpointName == "" {
+		fatalf("-agent and -name are required")
+	}
+	if *expiresIn < time.Minute {
+		fatalf("-expiresIn must be at least 1m")
+	}
+
+	apiVersion, err := requestedAPIVersion(os.Getenv("KUBERNETES_EXEC_INFO"))
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	now := time.Now()
+	cache := newTokenCache(*cacheDir, *controlURL, *agentName, *endpointName)
+	token := cache.get(now)
+	if token == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), cncclient.DefaultTimeout)
+		defer cancel()
+		token, err = fetchToken(ctx, now)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if err := cache.put(token); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: unable to cache token: %v\n", fwdapi.KubeConfigCredentialPlugin, err)
+		}
+	}
+
+	out, err := makeExecCredential(apiVersion, token)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if _, err := os.Stdout.Write(out); err != nil {
+		os.Exit(1)
+	}
+}
@@ -30,6 +30,10 @@ var (
 	namespace         = flag.String("namespace", "", "The namespace to place the secrets into")
 	caSecretName      = flag.String("caSecretName", "ca-secret", "the name of the CA secret")
 	controlSecretName = flag.String("controlSecretName", "oes-control-secret", "the name of the secret for the control secret")
+	caKeyType         = flag.String("caKeyType", "rsa4096", "the CA key type, one of rsa2048, rsa4096, ecdsa-p256, ecdsa-p384")
+	keyType           = flag.String("keyType", "rsa2048", "the control certificate key type, one of rsa2048, rsa4096, ecdsa-p256, ecdsa-p384")
+	caCertFile        = flag.String("caCertFile", "", "if set with caKeyFile, also write the CA certificate to this file, for the controller's caConfig.caCertFile")
+	caKeyFile         = flag.String("caKeyFile", "", "if set with caCertFile, also write the CA key to this file, for the controller's caConfig.caKeyFile")
 )
 
 func maybePrintNamespace(f *os.File) {
@@ -41,7 +45,20 @@ func maybePrintNamespace(f *os.File) {
 func main() {
 	flag.Parse()
 
-	cacert, caPrivateKey, err := ca.MakeCertificateAuthority()
+	if (*caCertFile == "") != (*caKeyFile == "") {
+		log.Fatal("caCertFile and caKeyFile must be set together")
+	}
+
+	caKey, err := ca.ParseKeyType(*caKeyType)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	controlKey, err := ca.ParseKeyType(*keyType)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	cacert, caPrivateKey, err := ca.MakeCertificateAuthority(caKey)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -58,7 +75,7 @@ func main() {
 		Name:    "oes",
 		Purpose: ca.CertificatePurposeControl,
 	}
-	ca64too, cert64, certPrivKey64, err := authority.GenerateCertificate(name)
+	ca64too, cert64, certPrivKey64, err := authority.GenerateCertificate(name, controlKey, 0)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -124,4 +141,12 @@ func main() {
 	if err != nil {
 		log.Panicf("%v", err)
 	}
+
+	if *caCertFile != "" {
+		store := &ca.FileStore{CertFile: *caCertFile, KeyFile: *caKeyFile}
+		log.Printf("Writing authority certificate and key to %s", store)
+		if err := store.Save(cacert, caPrivateKey); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
 }
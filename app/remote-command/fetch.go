@@ -0,0 +1,138 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// receiveFile writes the file sent by the agent to local, and returns the
+// exit code this process should use.  It is written to a temporary file
+// beside local, which only replaces local once its size and SHA-256 match
+// those the agent sent, so a failed transfer leaves nothing behind.
+func receiveFile(ctx context.Context, stream tunnel.CmdToolTunnelService_EventTunnelClient, local string, out output) int {
+	tmp, err := ioutil.TempFile(filepath.Dir(local), "."+filepath.Base(local))
+	if err != nil {
+		closeSend(stream)
+		return out.exit(1, fmt.Sprintf("Unable to write %s: %v", local, err))
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	w := io.MultiWriter(tmp, hash)
+	acks := &outputAcker{stream: stream}
+	var size uint64
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			closeSend(stream)
+			return out.exit(exitConnectionLost, "Connection to the controller was lost before the file was received")
+		}
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return out.exit(exitTimeout, "Timed out waiting for the file")
+			}
+			if ctx.Err() == context.Canceled {
+				return out.exit(exitCancelled, "Cancelled before the file was received")
+			}
+			return out.exit(exitConnectionLost, fmt.Sprintf("Connection to the controller was lost: %v", err))
+		}
+		switch x := in.Event.(type) {
+		case *tunnel.ControllerToCmdToolWrapper_FileChunk:
+			body := in.GetFileChunk().Body
+			if _, err := w.Write(body); err != nil {
+				closeSend(stream)
+				return out.exit(1, fmt.Sprintf("Unable to write %s: %v", local, err))
+			}
+			size += uint64(len(body))
+			acks.written(len(body))
+		case *tunnel.ControllerToCmdToolWrapper_FileTermination:
+			closeSend(stream)
+			result := in.GetFileTermination()
+			if result.Error != "" {
+				return out.exit(1, result.Error)
+			}
+			sum := hash.Sum(nil)
+			if result.Size != size || !bytes.Equal(result.Sha256, sum) {
+				return out.exit(1, fmt.Sprintf("File was corrupted in transfer: received %d bytes with SHA-256 %x, agent sent %d bytes with SHA-256 %x",
+					size, sum, result.Size, result.Sha256))
+			}
+			if err := tmp.Close(); err != nil {
+				return out.exit(1, fmt.Sprintf("Unable to write %s: %v", local, err))
+			}
+			if err := os.Rename(tmp.Name(), local); err != nil {
+				return out.exit(1, fmt.Sprintf("Unable to write %s: %v", local, err))
+			}
+			util.Infof("Fetched %d bytes, SHA-256 %x", size, sum)
+			return out.exit(0, "")
+		case nil:
+			continue
+		default:
+			util.Warnf("Received unknown message: %T", x)
+		}
+	}
+}
+
+// fetchFile fetches the file at remote on the agent into local, and returns
+// the exit code this process should use.  timeout and signals are handled
+// as they are for a command.
+func fetchFile(client tunnel.CmdToolTunnelServiceClient, remote string, local string, timeout time.Duration, out output) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+
+	tunnelStream, err := client.EventTunnel(ctx)
+	if err != nil {
+		fatalf(out, "%v.EventTunnel(_) = _, %v", client, err)
+	}
+	stream := &lockedStream{CmdToolTunnelService_EventTunnelClient: tunnelStream}
+
+	req := &tunnel.CmdToolToControllerWrapper{
+		Event: &tunnel.CmdToolToControllerWrapper_FileRequest{
+			FileRequest: &tunnel.CmdToolFileRequest{
+				Path:   remote,
+				Window: outputWindow,
+			},
+		},
+	}
+	if err := stream.Send(req); err != nil {
+		fatalf(out, "while sending to stream: %v", err)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go cancelOnSignal(ctx, stream, signals, cancel)
+
+	return receiveFile(ctx, stream, local, out)
+}
@@ -0,0 +1,138 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+)
+
+func fileChunk(body string) *tunnel.ControllerToCmdToolWrapper {
+	return &tunnel.ControllerToCmdToolWrapper{
+		Event: &tunnel.ControllerToCmdToolWrapper_FileChunk{
+			FileChunk: &tunnel.CmdToolFileChunk{Body: []byte(body)},
+		},
+	}
+}
+
+func fileTermination(content string, errMessage string) *tunnel.ControllerToCmdToolWrapper {
+	sum := sha256.Sum256([]byte(content))
+	return &tunnel.ControllerToCmdToolWrapper{
+		Event: &tunnel.ControllerToCmdToolWrapper_FileTermination{
+			FileTermination: &tunnel.CmdToolFileTermination{
+				Size:   uint64(len(content)),
+				Sha256: sum[:],
+				Error:  errMessage,
+			},
+		},
+	}
+}
+
+func TestReceiveFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []*tunnel.ControllerToCmdToolWrapper
+		err      error
+		want     int
+	}{
+		{
+			"success",
+			[]*tunnel.ControllerToCmdToolWrapper{fileChunk("hello, "), fileChunk("world"), fileTermination("hello, world", "")},
+			io.EOF,
+			0,
+		},
+		{
+			"empty file",
+			[]*tunnel.ControllerToCmdToolWrapper{fileTermination("", "")},
+			io.EOF,
+			0,
+		},
+		{
+			"checksum mismatch",
+			[]*tunnel.ControllerToCmdToolWrapper{fileChunk("hello, world"), fileTermination("hello, World", "")},
+			io.EOF,
+			1,
+		},
+		{
+			"size mismatch",
+			[]*tunnel.ControllerToCmdToolWrapper{fileChunk("hello"), fileTermination("hello, world", "")},
+			io.EOF,
+			1,
+		},
+		{
+			"refused by agent",
+			[]*tunnel.ControllerToCmdToolWrapper{fileTermination("", "Agent: path '/etc/passwd' is not in a directory files may be fetched from")},
+			io.EOF,
+			1,
+		},
+		{
+			"disconnected mid-transfer",
+			[]*tunnel.ControllerToCmdToolWrapper{fileChunk("hello, ")},
+			io.EOF,
+			exitConnectionLost,
+		},
+		{
+			"stream error mid-transfer",
+			[]*tunnel.ControllerToCmdToolWrapper{fileChunk("hello, ")},
+			errors.New("transport is closing"),
+			exitConnectionLost,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			local := filepath.Join(dir, "fetched")
+			out, err := makeOutput(outputRaw, ioutil.Discard, ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream := &fakeStream{messages: tt.messages, err: tt.err}
+			if got := receiveFile(context.Background(), stream, local, out); got != tt.want {
+				t.Errorf("receiveFile() = %d, want %d", got, tt.want)
+			}
+
+			// Only a verified file is left behind.
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != 0 {
+				if len(files) != 0 {
+					t.Errorf("left %d files after a failed transfer", len(files))
+				}
+				return
+			}
+			if len(files) != 1 || files[0].Name() != "fetched" {
+				t.Fatalf("expected only the fetched file, got %d files", len(files))
+			}
+			got, err := ioutil.ReadFile(local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.messages[len(tt.messages)-1].GetFileTermination().Size; uint64(len(got)) != want {
+				t.Errorf("fetched %d bytes, want %d", len(got), want)
+			}
+		})
+	}
+}
@@ -24,12 +24,15 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"github.com/opsmx/oes-birger/pkg/util"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
@@ -37,12 +40,26 @@ import (
 type environment []string
 
 var (
+	versionBuild = -1
+	version      = util.Versions{Major: 1, Minor: 0, Patch: 0, Build: versionBuild}
+
 	certFile   = flag.String("certFile", "tls.crt", "The file containing the certificate used to connect to the controller")
 	keyFile    = flag.String("keyFile", "tls.key", "The file containing the certificate used to connect to the controller")
 	caCertFile = flag.String("caCertFile", "ca.pem", "The file containing the CA certificate we will use to verify the controller's cert")
 	host       = flag.String("host", "forwarder-controller:9001", "The hostname of the controller")
 	cmd        = flag.String("cmd", "", "The remote command name to run")
+	dir        = flag.String("dir", "", "The absolute directory on the agent to run the command in, which the agent must allow")
+	fetch      = flag.String("fetch", "", "The absolute path of a file on the agent to fetch, instead of running a command")
+	fetchTo    = flag.String("o", "", "With -fetch, the local file to write")
+	sendStdin  = flag.Bool("stdin", false, "Send standard input to the remote command")
+	timeout    = flag.Duration("timeout", 0, "Give up, exiting with status 124, if the command has not finished in this time (0 waits forever)")
+	logLevel   = flag.String("logLevel", "warn", "The minimum level to log: debug, info, warn, or error")
+	logFormat  = flag.String("logFormat", "console", "The log format: console or json")
+	outputMode = flag.String("output", outputRaw, "How to write the command's output: raw, or json for one JSON object per line")
+	quiet      = flag.Bool("quiet", false, "Do not write log messages to standard error")
 	env        environment
+
+	showVersion = flag.Bool("version", false, "Print the version and exit")
 )
 
 func usage(message string) {
@@ -65,22 +82,203 @@ func (i *environment) Set(value string) error {
 	return nil
 }
 
-func loadCert() []byte {
-	cert, err := ioutil.ReadFile(*caCertFile)
-	if err != nil {
-		log.Fatalf("Unable to load certificate: %v", err)
+// fatalf reports an error which stops the command from running, and exits
+// with status 1.
+func fatalf(out output, format string, args ...interface{}) {
+	os.Exit(out.exit(1, fmt.Sprintf(format, args...)))
+}
+
+// stdinSender sends standard input to the controller in chunks, followed by
+// a closed message at EOF.
+func stdinSender(stream tunnel.CmdToolTunnelService_EventTunnelClient, in io.Reader) {
+	buffer := make([]byte, 10240)
+	for {
+		n, err := in.Read(buffer)
+		if n > 0 {
+			msg := &tunnel.CmdToolToControllerWrapper{
+				Event: &tunnel.CmdToolToControllerWrapper_CommandData{
+					CommandData: &tunnel.CmdToolCommandData{
+						Body:    buffer[:n],
+						Channel: tunnel.ChannelDirection_STDIN,
+					},
+				},
+			}
+			if err := stream.Send(msg); err != nil {
+				util.Warnf("while sending stdin: %v", err)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				util.Warnf("while reading stdin: %v", err)
+			}
+			msg := &tunnel.CmdToolToControllerWrapper{
+				Event: &tunnel.CmdToolToControllerWrapper_CommandData{
+					CommandData: &tunnel.CmdToolCommandData{
+						Channel: tunnel.ChannelDirection_STDIN,
+						Closed:  true,
+					},
+				},
+			}
+			if err := stream.Send(msg); err != nil {
+				util.Warnf("while sending stdin: %v", err)
+			}
+			return
+		}
 	}
-	return cert
 }
 
-func runCommand(client tunnel.CmdToolTunnelServiceClient, cmd string, env []string, args []string) {
-	ctx := context.Background()
-	stream, err := client.EventTunnel(ctx)
-	if err != nil {
-		log.Fatalf("%v.EventTunnel(_) = _, %v", client, err)
+// Exit codes used when the remote command's own exit code is not known,
+// following the conventions of timeout(1) and ssh(1).
+const (
+	exitTimeout        = 124
+	exitCancelled      = 130
+	exitConnectionLost = 255
+)
+
+// lockedStream allows messages to be sent from more than one goroutine.
+type lockedStream struct {
+	tunnel.CmdToolTunnelService_EventTunnelClient
+	sync.Mutex
+}
+
+func (s *lockedStream) Send(msg *tunnel.CmdToolToControllerWrapper) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.CmdToolTunnelService_EventTunnelClient.Send(msg)
+}
+
+// CloseSend may not be called while another goroutine is sending.
+func (s *lockedStream) CloseSend() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.CmdToolTunnelService_EventTunnelClient.CloseSend()
+}
+
+// cancelOnSignal asks the controller to stop the command on the first
+// signal, and then waits for its termination to arrive as usual.  A second
+// signal gives up waiting by calling cancel.
+func cancelOnSignal(ctx context.Context, stream tunnel.CmdToolTunnelService_EventTunnelClient, signals chan os.Signal, cancel context.CancelFunc) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-signals:
+	}
+	msg := &tunnel.CmdToolToControllerWrapper{
+		Event: &tunnel.CmdToolToControllerWrapper_CommandCancel{
+			CommandCancel: &tunnel.CmdToolCommandCancel{},
+		},
+	}
+	if err := stream.Send(msg); err != nil {
+		util.Warnf("while sending cancel: %v", err)
+		cancel()
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-signals:
+		cancel()
+	}
+}
+
+// How much of the command's output the agent may send before waiting for
+// it to be written here, and how much is written between acks.
+const (
+	outputWindow   = 1024 * 1024
+	outputAckEvery = outputWindow / 4
+)
+
+// outputAcker tells the controller how much of the command's output has
+// been written, so the agent may send more.
+type outputAcker struct {
+	stream   tunnel.CmdToolTunnelService_EventTunnelClient
+	consumed uint64
+	acked    uint64
+}
+
+// written records n more bytes written, sending an ack once enough have
+// been written since the last.
+func (a *outputAcker) written(n int) {
+	a.consumed += uint64(n)
+	if a.consumed-a.acked < outputAckEvery {
+		return
+	}
+	msg := &tunnel.CmdToolToControllerWrapper{
+		Event: &tunnel.CmdToolToControllerWrapper_CommandAck{
+			CommandAck: &tunnel.CmdToolCommandAck{Consumed: a.consumed},
+		},
+	}
+	if err := a.stream.Send(msg); err != nil {
+		util.Warnf("while sending ack: %v", err)
+		return
+	}
+	a.acked = a.consumed
+}
+
+func closeSend(stream tunnel.CmdToolTunnelService_EventTunnelClient) {
+	if err := stream.CloseSend(); err != nil {
+		util.Warnf("While closing stream: %v", err)
 	}
+}
 
-	waitc := make(chan struct{})
+// receive copies the command's output to out until it terminates, and
+// returns the exit code this process should use.
+func receive(ctx context.Context, stream tunnel.CmdToolTunnelService_EventTunnelClient, out output) int {
+	acks := &outputAcker{stream: stream}
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			// Server has closed the connection without telling us how
+			// the command ended.
+			closeSend(stream)
+			return out.exit(exitConnectionLost, "Connection to the controller was lost before the command finished")
+		}
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return out.exit(exitTimeout, "Timed out waiting for the command to finish")
+			}
+			if ctx.Err() == context.Canceled {
+				return out.exit(exitCancelled, "Cancelled before the command finished")
+			}
+			return out.exit(exitConnectionLost, fmt.Sprintf("Connection to the controller was lost: %v", err))
+		}
+		switch x := in.Event.(type) {
+		case *tunnel.ControllerToCmdToolWrapper_CommandData:
+			req := in.GetCommandData()
+			if req.Channel == tunnel.ChannelDirection_STDOUT {
+				out.stdout(req.Body)
+			} else {
+				out.stderr(req.Body)
+			}
+			acks.written(len(req.Body))
+		case *tunnel.ControllerToCmdToolWrapper_CommandTermination:
+			req := in.GetCommandTermination()
+			closeSend(stream)
+			return out.exit(int(req.ExitCode), req.Message)
+		case nil:
+			continue
+		default:
+			util.Warnf("Received unknown message: %T", x)
+		}
+	}
+}
+
+// runCommand runs the command on the agent, writing its output to out, and
+// returns the exit code this process should use.  If timeout is not zero and
+// the command has not finished in time, the stream is cancelled.  SIGINT or
+// SIGTERM stops the remote command.
+func runCommand(client tunnel.CmdToolTunnelServiceClient, cmd string, env []string, args []string, timeout time.Duration, out output) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+
+	tunnelStream, err := client.EventTunnel(ctx)
+	if err != nil {
+		fatalf(out, "%v.EventTunnel(_) = _, %v", client, err)
+	}
+	stream := &lockedStream{CmdToolTunnelService_EventTunnelClient: tunnelStream}
 
 	run := tunnel.CmdToolToControllerWrapper{
 		Event: &tunnel.CmdToolToControllerWrapper_CommandRequest{
@@ -88,55 +286,58 @@ func runCommand(client tunnel.CmdToolTunnelServiceClient, cmd string, env []stri
 				Name:        cmd,
 				Arguments:   args,
 				Environment: env,
+				Stdin:       *sendStdin,
+				Window:      outputWindow,
+
+				WorkingDirectory: *dir,
 			},
 		},
 	}
 	err = stream.Send(&run)
 	if err != nil {
-		log.Fatalf("while sending to stream: %v", err)
-	}
-	go func() {
-		for {
-			in, err := stream.Recv()
-			if err == io.EOF {
-				// Server has closed the connection.
-				close(waitc)
-				return
-			}
-			if err != nil {
-				log.Fatalf("Failed to receive a message: %T: %v", err, err)
-			}
-			switch x := in.Event.(type) {
-			case *tunnel.ControllerToCmdToolWrapper_CommandData:
-				req := in.GetCommandData()
-				if req.Channel == tunnel.ChannelDirection_STDOUT {
-					fmt.Fprintf(os.Stdout, "%s", string(req.Body))
-				} else {
-					fmt.Fprintf(os.Stderr, "%s", string(req.Body))
-				}
-			case *tunnel.ControllerToCmdToolWrapper_CommandTermination:
-				req := in.GetCommandTermination()
-				if len(req.Message) > 0 {
-					fmt.Fprintf(os.Stderr, "%s\n", req.Message)
-				}
-				os.Exit(int(req.ExitCode))
-			case nil:
-				continue
-			default:
-				log.Printf("Received unknown message: %T", x)
-			}
-		}
-	}()
-	<-waitc
-	err = stream.CloseSend()
-	log.Fatalf("While closing stream: %v", err)
+		fatalf(out, "while sending to stream: %v", err)
+	}
+	if *sendStdin {
+		go stdinSender(stream, os.Stdin)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go cancelOnSignal(ctx, stream, signals, cancel)
+
+	return receive(ctx, stream, out)
 }
 
 func main() {
 	flag.Var(&env, "env", "[repeatable] environment variable as NAME=value")
 	flag.Parse()
-	if len(*cmd) == 0 {
-		usage("cmd must be specified")
+	if *showVersion {
+		fmt.Printf("remote-command %s\n", version.Detailed())
+		return
+	}
+	if err := util.SetupLogging(*logLevel, *logFormat); err != nil {
+		usage(err.Error())
+	}
+	if *quiet {
+		util.SetLogOutput(ioutil.Discard)
+	}
+	out, err := makeOutput(*outputMode, os.Stdout, os.Stderr)
+	if err != nil {
+		usage(err.Error())
+	}
+	if len(*fetch) > 0 {
+		if len(*cmd) > 0 {
+			usage("only one of cmd and fetch may be specified")
+		}
+		if len(*dir) > 0 {
+			usage("dir cannot be used with fetch")
+		}
+		if len(*fetchTo) == 0 {
+			usage("o must be specified with fetch")
+		}
+	} else if len(*cmd) == 0 {
+		usage("cmd or fetch must be specified")
 	}
 	if len(*host) == 0 {
 		usage("host must be specified")
@@ -147,12 +348,15 @@ func main() {
 	// load client cert/key, cacert
 	clcert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
 	if err != nil {
-		log.Fatalf("Unable to load certificate or key: %v", err)
+		fatalf(out, "Unable to load certificate or key: %v", err)
 	}
 	caCertPool := x509.NewCertPool()
-	srvcert := loadCert()
+	srvcert, err := ioutil.ReadFile(*caCertFile)
+	if err != nil {
+		fatalf(out, "Unable to load certificate: %v", err)
+	}
 	if ok := caCertPool.AppendCertsFromPEM(srvcert); !ok {
-		log.Fatalf("Unable to append certificate to pool: %v", err)
+		fatalf(out, "Unable to append certificate to pool: no certificates found in %s", *caCertFile)
 	}
 
 	ta := credentials.NewTLS(&tls.Config{
@@ -166,14 +370,20 @@ func main() {
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 	conn, err := grpc.DialContext(ctx, *host, opts...)
+	cancel()
 	if err != nil {
-		log.Fatalf("Could not connect: %v", err)
+		fatalf(out, "Could not connect: %v", err)
 	}
-	defer conn.Close()
 
 	client := tunnel.NewCmdToolTunnelServiceClient(conn)
 
-	runCommand(client, *cmd, env, args)
+	var exitCode int
+	if len(*fetch) > 0 {
+		exitCode = fetchFile(client, *fetch, *fetchTo, *timeout, out)
+	} else {
+		exitCode = runCommand(client, *cmd, env, args, *timeout, out)
+	}
+	conn.Close()
+	os.Exit(exitCode)
 }
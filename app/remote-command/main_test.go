@@ -0,0 +1,252 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/tunnel"
+	"google.golang.org/grpc"
+)
+
+// fakeStream replays messages from the controller, and then returns err.
+type fakeStream struct {
+	grpc.ClientStream
+	messages []*tunnel.ControllerToCmdToolWrapper
+	err      error
+	closeErr error
+}
+
+func (s *fakeStream) Send(*tunnel.CmdToolToControllerWrapper) error {
+	return nil
+}
+
+func (s *fakeStream) Recv() (*tunnel.ControllerToCmdToolWrapper, error) {
+	if len(s.messages) == 0 {
+		return nil, s.err
+	}
+	m := s.messages[0]
+	s.messages = s.messages[1:]
+	return m, nil
+}
+
+func (s *fakeStream) CloseSend() error {
+	return s.closeErr
+}
+
+func termination(exitCode int32) *tunnel.ControllerToCmdToolWrapper {
+	return &tunnel.ControllerToCmdToolWrapper{
+		Event: &tunnel.ControllerToCmdToolWrapper_CommandTermination{
+			CommandTermination: &tunnel.CmdToolCommandTermination{ExitCode: exitCode},
+		},
+	}
+}
+
+func TestReceive(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-expired.Done()
+	cancelled, stop := context.WithCancel(context.Background())
+	stop()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		stream *fakeStream
+		want   int
+	}{
+		{
+			"success",
+			context.Background(),
+			&fakeStream{messages: []*tunnel.ControllerToCmdToolWrapper{termination(0)}, err: io.EOF},
+			0,
+		},
+		{
+			"remote exit code",
+			context.Background(),
+			&fakeStream{messages: []*tunnel.ControllerToCmdToolWrapper{termination(3)}, err: io.EOF},
+			3,
+		},
+		{
+			"close fails after termination",
+			context.Background(),
+			&fakeStream{messages: []*tunnel.ControllerToCmdToolWrapper{termination(0)}, closeErr: errors.New("closed")},
+			0,
+		},
+		{
+			"EOF without termination",
+			context.Background(),
+			&fakeStream{err: io.EOF},
+			exitConnectionLost,
+		},
+		{
+			"stream error",
+			context.Background(),
+			&fakeStream{err: errors.New("transport is closing")},
+			exitConnectionLost,
+		},
+		{
+			"cancelled",
+			cancelled,
+			&fakeStream{err: errors.New("context canceled")},
+			exitCancelled,
+		},
+		{
+			"cancelled remotely",
+			context.Background(),
+			&fakeStream{messages: []*tunnel.ControllerToCmdToolWrapper{termination(exitCancelled)}, err: io.EOF},
+			exitCancelled,
+		},
+		{
+			"timeout",
+			expired,
+			&fakeStream{err: errors.New("context deadline exceeded")},
+			exitTimeout,
+		},
+	}
+	for _, mode := range []string{outputRaw, outputJSON} {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				out, err := makeOutput(mode, ioutil.Discard, ioutil.Discard)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stream := *tt.stream
+				if got := receive(tt.ctx, &stream, out); got != tt.want {
+					t.Errorf("receive() = %d, want %d", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// sendingStream records the messages sent to the controller.
+type sendingStream struct {
+	fakeStream
+	sent chan *tunnel.CmdToolToControllerWrapper
+}
+
+func (s *sendingStream) Send(msg *tunnel.CmdToolToControllerWrapper) error {
+	s.sent <- msg
+	return nil
+}
+
+func TestCancelOnSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &sendingStream{sent: make(chan *tunnel.CmdToolToControllerWrapper, 1)}
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		cancelOnSignal(ctx, stream, signals, cancel)
+		close(done)
+	}()
+
+	signals <- os.Interrupt
+	select {
+	case msg := <-stream.sent:
+		if msg.GetCommandCancel() == nil {
+			t.Errorf("expected CommandCancel, got %T", msg.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no cancel sent")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("first signal should wait for the command to terminate")
+	}
+
+	signals <- os.Interrupt
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second signal did not give up")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("second signal should cancel the stream")
+	}
+}
+
+// overlapStream records whether Send or CloseSend was ever called while
+// another call was in progress.
+type overlapStream struct {
+	fakeStream
+	busy    int32
+	overlap int32
+}
+
+func (s *overlapStream) call() {
+	if atomic.AddInt32(&s.busy, 1) > 1 {
+		atomic.StoreInt32(&s.overlap, 1)
+	}
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&s.busy, -1)
+}
+
+func (s *overlapStream) Send(*tunnel.CmdToolToControllerWrapper) error {
+	s.call()
+	return nil
+}
+
+func (s *overlapStream) CloseSend() error {
+	s.call()
+	return nil
+}
+
+func TestLockedStream(t *testing.T) {
+	fake := &overlapStream{}
+	stream := &lockedStream{CmdToolTunnelService_EventTunnelClient: fake}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); _ = stream.Send(&tunnel.CmdToolToControllerWrapper{}) }()
+		go func() { defer wg.Done(); closeSend(stream) }()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&fake.overlap) != 0 {
+		t.Errorf("CloseSend was called while sending")
+	}
+}
+
+func TestOutputAcker(t *testing.T) {
+	stream := &sendingStream{sent: make(chan *tunnel.CmdToolToControllerWrapper, 10)}
+	acks := &outputAcker{stream: stream}
+
+	acks.written(outputAckEvery - 1)
+	if len(stream.sent) != 0 {
+		t.Fatalf("ack sent before %d bytes were written", outputAckEvery)
+	}
+	acks.written(1)
+	acks.written(outputAckEvery / 2)
+	acks.written(outputAckEvery)
+	if len(stream.sent) != 2 {
+		t.Fatalf("expected 2 acks, got %d", len(stream.sent))
+	}
+	for _, want := range []uint64{outputAckEvery, outputAckEvery * 5 / 2} {
+		msg := <-stream.sent
+		if got := msg.GetCommandAck().GetConsumed(); got != want {
+			t.Errorf("ack consumed = %d, want %d", got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// Values for the -output flag.
+const (
+	outputRaw  = "raw"
+	outputJSON = "json"
+)
+
+// output writes what the remote command sends, and how it ended.
+type output interface {
+	stdout(data []byte)
+	stderr(data []byte)
+	// exit reports the exit code this process will use, with an optional
+	// message explaining it, and returns the code.
+	exit(code int, message string) int
+}
+
+func makeOutput(format string, stdout io.Writer, stderr io.Writer) (output, error) {
+	switch format {
+	case outputRaw:
+		return &rawOutput{out: stdout, err: stderr}, nil
+	case outputJSON:
+		return &jsonOutput{enc: json.NewEncoder(stdout)}, nil
+	}
+	return nil, fmt.Errorf("unknown output format '%s', must be %s or %s", format, outputRaw, outputJSON)
+}
+
+// rawOutput passes the command's output through unchanged, and writes any
+// message about how it ended to standard error.
+type rawOutput struct {
+	out io.Writer
+	err io.Writer
+}
+
+func (o *rawOutput) stdout(data []byte) {
+	_, _ = o.out.Write(data)
+}
+
+func (o *rawOutput) stderr(data []byte) {
+	_, _ = o.err.Write(data)
+}
+
+func (o *rawOutput) exit(code int, message string) int {
+	if len(message) > 0 {
+		fmt.Fprintf(o.err, "%s\n", message)
+	}
+	return code
+}
+
+// jsonOutput writes one JSON object per line.  The command's output is
+// base64 encoded, as it need not be UTF-8, and the last line holds the
+// exit code.
+type jsonOutput struct {
+	enc *json.Encoder
+}
+
+type streamEvent struct {
+	Stream string `json:"stream"`
+	Data   []byte `json:"data"`
+}
+
+type exitEvent struct {
+	ExitCode int    `json:"exitCode"`
+	Message  string `json:"message"`
+}
+
+func (o *jsonOutput) write(event interface{}) {
+	if err := o.enc.Encode(event); err != nil {
+		util.Warnf("while writing output: %v", err)
+	}
+}
+
+func (o *jsonOutput) stdout(data []byte) {
+	o.write(streamEvent{Stream: "stdout", Data: data})
+}
+
+func (o *jsonOutput) stderr(data []byte) {
+	o.write(streamEvent{Stream: "stderr", Data: data})
+}
+
+func (o *jsonOutput) exit(code int, message string) int {
+	o.write(exitEvent{ExitCode: code, Message: message})
+	return code
+}
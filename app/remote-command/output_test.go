@@ -0,0 +1,70 @@
+package main
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOutput(t *testing.T) {
+	binary := []byte{0xff, 0xfe, 'h', 'i', '\n'}
+	tests := []struct {
+		mode       string
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			outputRaw,
+			string(binary),
+			"oops\nexited\n",
+		},
+		{
+			outputJSON,
+			`{"stream":"stdout","data":"//5oaQo="}` + "\n" +
+				`{"stream":"stderr","data":"b29wcwo="}` + "\n" +
+				`{"exitCode":3,"message":"exited"}` + "\n",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			out, err := makeOutput(tt.mode, &stdout, &stderr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out.stdout(binary)
+			out.stderr([]byte("oops\n"))
+			if got := out.exit(3, "exited"); got != 3 {
+				t.Errorf("exit() = %d, want 3", got)
+			}
+			if stdout.String() != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.wantStdout)
+			}
+			if stderr.String() != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestOutput_unknownMode(t *testing.T) {
+	if _, err := makeOutput("xml", nil, nil); err == nil {
+		t.Errorf("expected an error for an unknown output mode")
+	}
+}
@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/aws/aws-sdk-go v1.38.46
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-resty/resty/v2 v2.6.0
 	github.com/goccy/go-json v0.5.1 // indirect
 	github.com/golang/protobuf v1.5.2
@@ -16,6 +17,7 @@ require (
 	github.com/lestrrat-go/jwx v1.2.0
 	github.com/oklog/ulid/v2 v2.0.2
 	github.com/prometheus/client_golang v1.10.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.25.0 // indirect
 	github.com/tevino/abool v1.2.0
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
@@ -22,7 +22,6 @@ package ca
 import (
 	"bytes"
 	crand "crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -31,7 +30,10 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"strings"
 	"time"
+
+	"github.com/opsmx/oes-birger/pkg/util"
 )
 
 const (
@@ -44,7 +46,7 @@ const (
 
 // CertificateIssuer implements a generic CA
 type CertificateIssuer interface {
-	GenerateCertificate(CertificateName) (string, string, string, error)
+	GenerateCertificate(CertificateName, KeyType, time.Duration) (string, string, string, error)
 	GetCACert() (string, error)
 }
 
@@ -57,17 +59,36 @@ type CertPoolGenerator interface {
 // CA holds the state for the certificate authority.
 //
 type CA struct {
-	config *Config
-	caCert tls.Certificate
+	config      *Config
+	caCert      tls.Certificate
+	keyType     KeyType
+	validity    ValidityConfig
+	maxValidity time.Duration
+	revocations *revocationList
 }
 
 //
 // Config holds the filenames for a CA, and has mappings for loading from
-// YAML or JSON.
+// YAML or JSON.  KeyType is the default for certificates the CA issues.
+// MaxValidity caps the lifetime a caller may request in place of the
+// per-purpose Validity.  If SecretName is set, the CA is kept in that
+// Kubernetes secret rather than in CACertFile and CAKeyFile.  BootstrapCA
+// allows a new CA to be generated and saved if none exists yet.
+//
+// While the CA is being rotated, the new CA's certificate may be followed by
+// the previous CA's.  Certificates issued by either are trusted, and the
+// bundle of both is handed out so agents trust controllers using either.
 //
 type Config struct {
-	CACertFile string `yaml:"caCertFile,omitempty" json:"caCertFile,omitempty"`
-	CAKeyFile  string `yaml:"caKeyFile,omitempty" json:"caKeyFile,omitempty"`
+	CACertFile         string         `yaml:"caCertFile,omitempty" json:"caCertFile,omitempty"`
+	CAKeyFile          string         `yaml:"caKeyFile,omitempty" json:"caKeyFile,omitempty"`
+	SecretName         string         `yaml:"secretName,omitempty" json:"secretName,omitempty"`
+	SecretNamespace    string         `yaml:"secretNamespace,omitempty" json:"secretNamespace,omitempty"`
+	BootstrapCA        bool           `yaml:"bootstrapCA,omitempty" json:"bootstrapCA,omitempty"`
+	RevocationListFile string         `yaml:"revocationListFile,omitempty" json:"revocationListFile,omitempty"`
+	KeyType            KeyType        `yaml:"keyType,omitempty" json:"keyType,omitempty"`
+	Validity           ValidityConfig `yaml:"validity,omitempty" json:"validity,omitempty"`
+	MaxValidity        time.Duration  `yaml:"maxValidity,omitempty" json:"maxValidity,omitempty"`
 }
 
 func (c *Config) applyDefaults() {
@@ -77,28 +98,88 @@ func (c *Config) applyDefaults() {
 	if len(c.CAKeyFile) == 0 {
 		c.CAKeyFile = defaultTLSKeyPath
 	}
+	if len(c.RevocationListFile) == 0 {
+		c.RevocationListFile = defaultRevocationListPath
+	}
+	if len(c.KeyType) == 0 {
+		c.KeyType = defaultKeyType
+	}
+	c.Validity.applyDefaults()
+	if c.MaxValidity == 0 {
+		c.MaxValidity = defaultMaxValidity
+	}
 }
 
-func (c *CA) loadCertificate() error {
-	caCert, err := tls.LoadX509KeyPair(c.config.CACertFile, c.config.CAKeyFile)
+// Validate checks the configuration for values which would prevent
+// the authority from being loaded, other than the certificate files
+// themselves.
+func (c Config) Validate() error {
+	if _, err := ParseKeyType(string(c.KeyType)); err != nil {
+		return err
+	}
+	if err := c.Validity.validate(); err != nil {
+		return err
+	}
+	if c.MaxValidity < 0 {
+		return fmt.Errorf("maxValidity cannot be negative")
+	}
+	return nil
+}
+
+func (c *CA) loadCertificate(store Store) error {
+	certPEM, keyPEM, err := store.Load()
+	if err == ErrCANotFound && c.config.BootstrapCA {
+		util.Infof("No CA found in %s, generating a new one", store)
+		certPEM, keyPEM, err = bootstrapCA(store)
+	}
+	if err == ErrCANotFound {
+		return fmt.Errorf("no CA found in %s: create one with make-ca, or set bootstrapCA", store)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to load CA cetificate or key: %v", err)
+		return fmt.Errorf("unable to load CA from %s: %v", store, err)
+	}
+	caCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("unable to load CA cetificate or key from %s: %v", store, err)
 	}
 	c.caCert = caCert
 	return nil
 }
 
 //
-// LoadCAFromFile will load an existing authority.
+// LoadCAFromFile will load an existing authority from the configured
+// certificate and key files.
 //
 func LoadCAFromFile(c Config) (*CA, error) {
 	c.applyDefaults()
+	return LoadCA(c, &FileStore{CertFile: c.CACertFile, KeyFile: c.CAKeyFile})
+}
+
+//
+// LoadCA will load an existing authority from store, or create and save
+// one if there is none and the config allows it.
+//
+func LoadCA(c Config, store Store) (*CA, error) {
+	c.applyDefaults()
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 
 	ca := &CA{
-		config: &c,
+		config:      &c,
+		keyType:     c.KeyType,
+		validity:    c.Validity,
+		maxValidity: c.MaxValidity,
+		revocations: newRevocationList(c.RevocationListFile),
+	}
+
+	err := ca.loadCertificate(store)
+	if err != nil {
+		return nil, err
 	}
 
-	err := ca.loadCertificate()
+	err = ca.revocations.load()
 	if err != nil {
 		return nil, err
 	}
@@ -107,24 +188,59 @@ func LoadCAFromFile(c Config) (*CA, error) {
 
 //
 // MakeCAFromData does approximately the same thing as MakeCA() except the CA
-// contents are loaded from PEM strings.
+// contents are loaded from PEM strings.  Revocations are kept only in memory,
+// and the default key type and lifetimes are used.
 //
 func MakeCAFromData(certPEM []byte, certPrivKeyPEM []byte) (*CA, error) {
 	caCert, err := tls.X509KeyPair(certPEM, certPrivKeyPEM)
 	if err != nil {
 		return nil, err
 	}
-	ca := &CA{caCert: caCert}
+	ca := &CA{
+		caCert:      caCert,
+		keyType:     defaultKeyType,
+		maxValidity: defaultMaxValidity,
+		revocations: newRevocationList(""),
+	}
+	ca.validity.applyDefaults()
 	return ca, nil
 }
 
 //
-// GetCACertificate returns the public certificate for the CA.
+// GetCACertificate returns the public certificate for the CA, without any
+// previous CA certificates.
 //
 func (c *CA) GetCACertificate() []byte {
 	return c.caCert.Certificate[0]
 }
 
+//
+// ParseCertificates returns every certificate in a PEM bundle, ignoring
+// any other blocks.  It is an error if there are none.
+//
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
 func toPEM(data []byte, t string) ([]byte, error) {
 	p := &bytes.Buffer{}
 	err := pem.Encode(p, &pem.Block{
@@ -139,8 +255,12 @@ func toPEM(data []byte, t string) ([]byte, error) {
 
 //
 // MakeCertificateAuthority generates a new certificate authority key, and self-signs it.
+// If keyType is empty, a 4096 bit RSA key is used.
 //
-func MakeCertificateAuthority() ([]byte, []byte, error) {
+func MakeCertificateAuthority(keyType KeyType) ([]byte, []byte, error) {
+	if keyType == "" {
+		keyType = defaultCAKeyType
+	}
 	now := time.Now().UTC()
 	rootTemplate := &x509.Certificate{
 		SerialNumber: big.NewInt(now.UnixNano()),
@@ -157,13 +277,13 @@ func MakeCertificateAuthority() ([]byte, []byte, error) {
 	}
 	empty := []byte{}
 
-	priv, err := rsa.GenerateKey(crand.Reader, 4096)
+	priv, err := generateKey(keyType)
 	if err != nil {
 		return empty, empty, err
 	}
 
 	// Self-sign the CA key.
-	certBytes, err := x509.CreateCertificate(crand.Reader, rootTemplate, rootTemplate, &priv.PublicKey, priv)
+	certBytes, err := x509.CreateCertificate(crand.Reader, rootTemplate, rootTemplate, priv.Public(), priv)
 	if err != nil {
 		return empty, empty, err
 	}
@@ -173,7 +293,7 @@ func MakeCertificateAuthority() ([]byte, []byte, error) {
 		return []byte{}, []byte{}, err
 	}
 
-	certPrivKeyPEM, err := toPEM(x509.MarshalPKCS1PrivateKey(priv), "RSA PRIVATE KEY")
+	certPrivKeyPEM, err := privateKeyToPEM(priv)
 	if err != nil {
 		return []byte{}, []byte{}, err
 	}
@@ -183,7 +303,7 @@ func MakeCertificateAuthority() ([]byte, []byte, error) {
 
 //
 // MakeServerCert will generate a new server certificate, signed with the authority,
-// with a validity period of 1 year.  The DNS names will be applied.
+// valid for the configured server lifetime.  The DNS names will be applied.
 //
 func (c *CA) MakeServerCert(names []string) (*tls.Certificate, error) {
 	now := time.Now().UTC()
@@ -193,7 +313,7 @@ func (c *CA) MakeServerCert(names []string) (*tls.Certificate, error) {
 		return nil, err
 	}
 
-	certPrivKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	certPrivKey, err := generateKey(c.keyType)
 	if err != nil {
 		return nil, err
 	}
@@ -205,13 +325,13 @@ func (c *CA) MakeServerCert(names []string) (*tls.Certificate, error) {
 			Country:      []string{"DF"},
 		},
 		NotBefore:   now.Add(-10 * time.Second),
-		NotAfter:    now.AddDate(1, 0, 0),
+		NotAfter:    now.Add(c.validity.Server),
 		KeyUsage:    x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		DNSNames:    names,
 	}
 
-	certBytes, err := x509.CreateCertificate(crand.Reader, certTemplate, caCert, &certPrivKey.PublicKey, c.caCert.PrivateKey)
+	certBytes, err := x509.CreateCertificate(crand.Reader, certTemplate, caCert, certPrivKey.Public(), c.caCert.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
@@ -221,7 +341,7 @@ func (c *CA) MakeServerCert(names []string) (*tls.Certificate, error) {
 		return nil, err
 	}
 
-	certPrivKeyPEM, err := toPEM(x509.MarshalPKCS1PrivateKey(certPrivKey), "RSA PRIVATE KEY")
+	certPrivKeyPEM, err := privateKeyToPEM(certPrivKey)
 	if err != nil {
 		return nil, err
 	}
@@ -254,7 +374,8 @@ const (
 )
 
 // GetCertificateNameFromCert extracts the CertificateName from the certificate, or returns
-// an error if not found.
+// an error if not found.  Certificates from an external PKI, which cannot
+// carry the custom name attribute, may hold the same JSON in the CommonName.
 func GetCertificateNameFromCert(cert *x509.Certificate) (*CertificateName, error) {
 	for _, atv := range cert.Subject.Names {
 		if atv.Type.Equal([]int{2, 5, 4, OpsMxOIDValue}) {
@@ -270,15 +391,35 @@ func GetCertificateNameFromCert(cert *x509.Certificate) (*CertificateName, error
 			return &name, nil
 		}
 	}
+	if strings.HasPrefix(cert.Subject.CommonName, "{") {
+		var name CertificateName
+		if err := json.Unmarshal([]byte(cert.Subject.CommonName), &name); err != nil {
+			return nil, fmt.Errorf("cannot extract name from CommonName: %v", err)
+		}
+		if name.Purpose == "" {
+			return nil, fmt.Errorf("name in CommonName has no purpose")
+		}
+		return &name, nil
+	}
 	return nil, fmt.Errorf("did not find custom name in cert")
 }
 
 //
 // GenerateCertificate will make a new certificate, and return a base64 encoded
-// string for the certificate, key, and authority certificate.
+// string for the certificate, key, and authority certificate.  If keyType is
+// empty, the CA's configured key type is used.  If validity is zero, the
+// configured lifetime for the name's purpose is used, otherwise it may not
+// exceed the CA's maximum.
 //
-func (c *CA) GenerateCertificate(name CertificateName) (string, string, string, error) {
-	now := time.Now().UTC()
+func (c *CA) GenerateCertificate(name CertificateName, keyType KeyType, validity time.Duration) (string, string, string, error) {
+	if keyType == "" {
+		keyType = c.keyType
+	}
+	validity, err := c.certificateValidity(name.Purpose, validity)
+	if err != nil {
+		return "", "", "", err
+	}
+	now := c.revocations.issueAfterRevocation(name)
 	jsonName, err := json.Marshal(name)
 	if err != nil {
 		return "", "", "", err
@@ -294,11 +435,11 @@ func (c *CA) GenerateCertificate(name CertificateName) (string, string, string,
 			},
 		},
 		NotBefore:   now,
-		NotAfter:    now.AddDate(1, 0, 0),
+		NotAfter:    now.Add(validity),
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:    x509.KeyUsageDigitalSignature,
 	}
-	certPrivKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	certPrivKey, err := generateKey(keyType)
 	if err != nil {
 		return "", "", "", err
 	}
@@ -310,7 +451,7 @@ func (c *CA) GenerateCertificate(name CertificateName) (string, string, string,
 		return "", "", "", err
 	}
 
-	certBytes, err := x509.CreateCertificate(crand.Reader, cert, caCert, &certPrivKey.PublicKey, c.caCert.PrivateKey)
+	certBytes, err := x509.CreateCertificate(crand.Reader, cert, caCert, certPrivKey.Public(), c.caCert.PrivateKey)
 	if err != nil {
 		return "", "", "", err
 	}
@@ -325,17 +466,27 @@ func (c *CA) GenerateCertificate(name CertificateName) (string, string, string,
 		return "", "", "", err
 	}
 
-	certPrivKey64, err := bytesTo64("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(certPrivKey))
+	certPrivKeyPEM, err := privateKeyToPEM(certPrivKey)
 	if err != nil {
 		return "", "", "", err
 	}
+	certPrivKey64 := base64.StdEncoding.EncodeToString(certPrivKeyPEM)
 
 	return ca64, cert64, certPrivKey64, nil
 }
 
-// GetCACert returns the authority certificate encoded as base64.
+// GetCACert returns the authority certificate, followed by any previous
+// CA certificates still trusted, encoded as base64.
 func (c *CA) GetCACert() (string, error) {
-	return bytesTo64("CERTIFICATE", c.caCert.Certificate[0])
+	bundle := []byte{}
+	for _, cert := range c.caCert.Certificate {
+		p, err := toPEM(cert, "CERTIFICATE")
+		if err != nil {
+			return "", err
+		}
+		bundle = append(bundle, p...)
+	}
+	return base64.StdEncoding.EncodeToString(bundle), nil
 }
 
 func bytesTo64(prefix string, data []byte) (string, error) {
@@ -347,7 +498,8 @@ func bytesTo64(prefix string, data []byte) (string, error) {
 }
 
 //
-// MakeCertPool will return a certificate pool with our CA installed.
+// MakeCertPool will return a certificate pool with our CA, and any previous
+// CA still trusted, installed.
 //
 func (c *CA) MakeCertPool() (*x509.CertPool, error) {
 	caCertPool := x509.NewCertPool()
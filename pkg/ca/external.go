@@ -0,0 +1,206 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+//
+// ExternalConfig is used in place of a CA when certificates are issued by
+// an external PKI.  The server certificate and key are read from files,
+// and read again when renewed, so they may be replaced while the
+// controller runs.  ClientCAFile is a PEM bundle of the authorities which
+// issue agent, service, and control certificates.  If the controller
+// connects to peers, PeerCertFile and PeerKeyFile hold the control
+// certificate it presents to them.  IssuanceURL, if set, is where users
+// are told to get certificates instead.
+//
+type ExternalConfig struct {
+	ServerCertFile     string `yaml:"serverCertFile,omitempty" json:"serverCertFile,omitempty"`
+	ServerKeyFile      string `yaml:"serverKeyFile,omitempty" json:"serverKeyFile,omitempty"`
+	ClientCAFile       string `yaml:"clientCAFile,omitempty" json:"clientCAFile,omitempty"`
+	PeerCertFile       string `yaml:"peerCertFile,omitempty" json:"peerCertFile,omitempty"`
+	PeerKeyFile        string `yaml:"peerKeyFile,omitempty" json:"peerKeyFile,omitempty"`
+	RevocationListFile string `yaml:"revocationListFile,omitempty" json:"revocationListFile,omitempty"`
+	IssuanceURL        string `yaml:"issuanceURL,omitempty" json:"issuanceURL,omitempty"`
+}
+
+func (c *ExternalConfig) applyDefaults() {
+	if len(c.RevocationListFile) == 0 {
+		c.RevocationListFile = defaultRevocationListPath
+	}
+}
+
+// Validate checks that the files which must be provided are named.
+func (c ExternalConfig) Validate() error {
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"serverCertFile", c.ServerCertFile},
+		{"serverKeyFile", c.ServerKeyFile},
+		{"clientCAFile", c.ClientCAFile},
+	} {
+		if f.value == "" {
+			return fmt.Errorf("%s not set", f.name)
+		}
+	}
+	if (c.PeerCertFile == "") != (c.PeerKeyFile == "") {
+		return fmt.Errorf("peerCertFile and peerKeyFile must be set together")
+	}
+	return nil
+}
+
+//
+// ExternalPKIError is returned when a certificate is requested from an
+// authority which cannot issue them, as they come from an external PKI.
+//
+type ExternalPKIError struct {
+	URL string
+}
+
+func (e *ExternalPKIError) Error() string {
+	if e.URL == "" {
+		return "certificates are issued by an external PKI, not by this controller"
+	}
+	return fmt.Sprintf("certificates are issued by an external PKI, not by this controller: request one from %s", e.URL)
+}
+
+//
+// ReadOnlyCA verifies certificates issued by an external PKI.  Their names
+// are found as they are in certificates this package issues, or in the
+// CommonName with the same encoding.  It keeps its own revocation list,
+// but cannot issue certificates.
+//
+type ReadOnlyCA struct {
+	config      ExternalConfig
+	caPEM       []byte
+	caCerts     []*x509.Certificate
+	revocations *revocationList
+}
+
+//
+// LoadReadOnlyCA loads the client CA bundle and revocation list, and
+// checks that the server certificate can be loaded.
+//
+func LoadReadOnlyCA(c ExternalConfig) (*ReadOnlyCA, error) {
+	c.applyDefaults()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load client CA bundle: %v", err)
+	}
+	caCerts, err := ParseCertificates(caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load client CA bundle %s: %v", c.ClientCAFile, err)
+	}
+	ca := &ReadOnlyCA{
+		config:      c,
+		caPEM:       caPEM,
+		caCerts:     caCerts,
+		revocations: newRevocationList(c.RevocationListFile),
+	}
+	if _, err := ca.LoadServerCert(); err != nil {
+		return nil, err
+	}
+	if err := ca.revocations.load(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// LoadServerCert reads the server certificate and key.
+func (c *ReadOnlyCA) LoadServerCert() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.config.ServerCertFile, c.config.ServerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load server certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+//
+// LoadPeerCert reads the certificate presented to peer controllers.  It is
+// an error if none is configured.
+//
+func (c *ReadOnlyCA) LoadPeerCert() (*tls.Certificate, error) {
+	if c.config.PeerCertFile == "" {
+		return nil, fmt.Errorf("no peer certificate configured")
+	}
+	cert, err := tls.LoadX509KeyPair(c.config.PeerCertFile, c.config.PeerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load peer certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+// IssuanceError returns the error given in place of a new certificate.
+func (c *ReadOnlyCA) IssuanceError() error {
+	return &ExternalPKIError{URL: c.config.IssuanceURL}
+}
+
+// GenerateCertificate always fails with an ExternalPKIError.
+func (c *ReadOnlyCA) GenerateCertificate(name CertificateName, keyType KeyType, validity time.Duration) (string, string, string, error) {
+	return "", "", "", c.IssuanceError()
+}
+
+// GetCACert returns the client CA bundle encoded as base64.
+func (c *ReadOnlyCA) GetCACert() (string, error) {
+	return base64.StdEncoding.EncodeToString(c.caPEM), nil
+}
+
+// GetCACertificate returns the first certificate in the client CA bundle.
+func (c *ReadOnlyCA) GetCACertificate() []byte {
+	return c.caCerts[0].Raw
+}
+
+// MakeCertPool returns a certificate pool holding the client CA bundle.
+func (c *ReadOnlyCA) MakeCertPool() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, cert := range c.caCerts {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// Revoke adds a certificate serial number to the revocation list.
+func (c *ReadOnlyCA) Revoke(serial *big.Int) error {
+	return c.revocations.revokeSerial(serial)
+}
+
+// RevokeName revokes every certificate issued for the name up to now.
+func (c *ReadOnlyCA) RevokeName(name CertificateName) error {
+	return c.revocations.revokeName(name)
+}
+
+// IsRevoked returns true if the certificate has been revoked.
+func (c *ReadOnlyCA) IsRevoked(cert *x509.Certificate) bool {
+	return c.revocations.isRevoked(cert)
+}
+
+// VerifyPeerCertificate rejects a peer presenting a revoked certificate.
+func (c *ReadOnlyCA) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return c.revocations.verifyPeerCertificate(verifiedChains)
+}
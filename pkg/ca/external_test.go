@@ -0,0 +1,201 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// externalPKI stands in for an enterprise PKI, which puts the name in the
+// CommonName rather than in the custom attribute.
+type externalPKI struct {
+	t      *testing.T
+	caPEM  []byte
+	caCert tls.Certificate
+	serial int64
+}
+
+func newExternalPKI(t *testing.T) *externalPKI {
+	certPEM, keyPEM, err := MakeCertificateAuthority(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &externalPKI{t: t, caPEM: certPEM, caCert: caCert}
+}
+
+// issue returns a PEM certificate and key with the CommonName.
+func (p *externalPKI) issue(commonName string, dnsNames ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, err := x509.ParseCertificate(p.caCert.Certificate[0])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, key.Public(), p.caCert.PrivateKey)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	keyPEM, err := privateKeyToPEM(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM
+}
+
+func writeTestFile(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadReadOnlyCA(t *testing.T) {
+	pki := newExternalPKI(t)
+	other := newExternalPKI(t)
+	dir := t.TempDir()
+	serverCert, serverKey := pki.issue("controller", "controller.example.com")
+	config := ExternalConfig{
+		ServerCertFile:     writeTestFile(t, dir, "server.crt", serverCert),
+		ServerKeyFile:      writeTestFile(t, dir, "server.key", serverKey),
+		ClientCAFile:       writeTestFile(t, dir, "ca-bundle.pem", append(append([]byte{}, other.caPEM...), pki.caPEM...)),
+		RevocationListFile: filepath.Join(dir, "revocations.json"),
+		IssuanceURL:        "https://pki.example.com/",
+	}
+	c, err := LoadReadOnlyCA(config)
+	if err != nil {
+		t.Fatalf("LoadReadOnlyCA() = %v", err)
+	}
+
+	// Certificates from any authority in the bundle are accepted, and the
+	// name is found in the CommonName.
+	agentPEM, _ := pki.issue(`{"agent":"agent1","purpose":"agent"}`)
+	block, _ := pem.Decode(agentPEM)
+	agentCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := c.MakeCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agentCert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("agent certificate not verified by the bundle: %v", err)
+	}
+	name, err := GetCertificateNameFromCert(agentCert)
+	if err != nil {
+		t.Fatalf("GetCertificateNameFromCert() = %v", err)
+	}
+	if want := (CertificateName{Agent: "agent1", Purpose: CertificatePurposeAgent}); *name != want {
+		t.Errorf("name = %+v, want %+v", *name, want)
+	}
+
+	_, _, _, err = c.GenerateCertificate(*name, "", 0)
+	if e, ok := err.(*ExternalPKIError); !ok || e.URL != config.IssuanceURL {
+		t.Errorf("GenerateCertificate() = %v, want an ExternalPKIError with the issuance URL", err)
+	}
+
+	if err := c.Revoke(agentCert.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.VerifyPeerCertificate(nil, [][]*x509.Certificate{{agentCert}}); err == nil {
+		t.Errorf("revoked certificate accepted")
+	}
+
+	if _, err := c.LoadPeerCert(); err == nil {
+		t.Errorf("LoadPeerCert() succeeded with none configured")
+	}
+}
+
+func TestLoadReadOnlyCA_invalid(t *testing.T) {
+	pki := newExternalPKI(t)
+	dir := t.TempDir()
+	serverCert, serverKey := pki.issue("controller")
+	certFile := writeTestFile(t, dir, "server.crt", serverCert)
+	keyFile := writeTestFile(t, dir, "server.key", serverKey)
+	bundle := writeTestFile(t, dir, "ca-bundle.pem", pki.caPEM)
+	empty := writeTestFile(t, dir, "empty.pem", []byte("not a certificate\n"))
+
+	tests := []struct {
+		name   string
+		config ExternalConfig
+	}{
+		{"no server cert", ExternalConfig{ServerKeyFile: keyFile, ClientCAFile: bundle}},
+		{"no client CA", ExternalConfig{ServerCertFile: certFile, ServerKeyFile: keyFile}},
+		{"peer cert without key", ExternalConfig{ServerCertFile: certFile, ServerKeyFile: keyFile, ClientCAFile: bundle, PeerCertFile: certFile}},
+		{"missing bundle", ExternalConfig{ServerCertFile: certFile, ServerKeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing.pem")}},
+		{"empty bundle", ExternalConfig{ServerCertFile: certFile, ServerKeyFile: keyFile, ClientCAFile: empty}},
+		{"mismatched key", ExternalConfig{ServerCertFile: certFile, ServerKeyFile: bundle, ClientCAFile: bundle}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.RevocationListFile = filepath.Join(dir, "revocations.json")
+			if _, err := LoadReadOnlyCA(tt.config); err == nil {
+				t.Errorf("LoadReadOnlyCA() succeeded")
+			}
+		})
+	}
+}
+
+func TestGetCertificateNameFromCert_commonName(t *testing.T) {
+	tests := []struct {
+		name       string
+		commonName string
+		wantErr    bool
+	}{
+		{"json", `{"agent":"a","purpose":"agent"}`, false},
+		{"no purpose", `{"agent":"a"}`, true},
+		{"invalid json", `{"agent":`, true},
+		{"plain", "controller.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: tt.commonName}}
+			_, err := GetCertificateNameFromCert(cert)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetCertificateNameFromCert() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+)
+
+//
+// KeyType selects the algorithm and size of generated private keys.
+//
+type KeyType string
+
+// Supported key types.
+const (
+	KeyTypeRSA2048   KeyType = "rsa2048"
+	KeyTypeRSA4096   KeyType = "rsa4096"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeECDSAP384 KeyType = "ecdsa-p384"
+)
+
+const (
+	// defaultKeyType is used for issued certificates when none is configured.
+	defaultKeyType = KeyTypeRSA2048
+
+	// defaultCAKeyType is used for a new authority when none is requested.
+	defaultCAKeyType = KeyTypeRSA4096
+)
+
+//
+// ParseKeyType validates a key type name.  An empty name returns an empty
+// KeyType, meaning the default should be used.
+//
+func ParseKeyType(name string) (KeyType, error) {
+	switch KeyType(name) {
+	case "", KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeECDSAP256, KeyTypeECDSAP384:
+		return KeyType(name), nil
+	}
+	return "", fmt.Errorf("unknown key type '%s', must be one of %s, %s, %s, or %s",
+		name, KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeECDSAP256, KeyTypeECDSAP384)
+}
+
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(crand.Reader, 2048)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(crand.Reader, 4096)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), crand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type '%s'", keyType)
+}
+
+// privateKeyToPEM encodes RSA keys as PKCS#1 and ECDSA keys as SEC 1, the
+// formats tls.X509KeyPair() accepts.
+func privateKeyToPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return toPEM(x509.MarshalPKCS1PrivateKey(k), "RSA PRIVATE KEY")
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return toPEM(der, "EC PRIVATE KEY")
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"testing"
+)
+
+func decode64PEM(t *testing.T, s string) []byte {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid base64: %v", err)
+	}
+	return data
+}
+
+// checkKeyType ensures the key is of the expected type and size.
+func checkKeyType(t *testing.T, key interface{}, keyType KeyType) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		want := map[KeyType]int{KeyTypeRSA2048: 2048, KeyTypeRSA4096: 4096}[keyType]
+		if k.N.BitLen() != want {
+			t.Errorf("expected %s, got RSA %d", keyType, k.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		want := map[KeyType]elliptic.Curve{KeyTypeECDSAP256: elliptic.P256(), KeyTypeECDSAP384: elliptic.P384()}[keyType]
+		if k.Curve != want {
+			t.Errorf("expected %s, got ECDSA %s", keyType, k.Curve.Params().Name)
+		}
+	default:
+		t.Errorf("expected %s, got %T", keyType, key)
+	}
+}
+
+func TestGenerateCertificate_keyTypes(t *testing.T) {
+	certPEM, keyPEM, err := MakeCertificateAuthority(KeyTypeECDSAP384)
+	if err != nil {
+		t.Fatalf("unable to make CA: %v", err)
+	}
+	c, err := MakeCAFromData(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("unable to make CA: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(c.GetCACertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeyType(t, caCert.PublicKey, KeyTypeECDSAP384)
+
+	tests := []struct {
+		keyType KeyType
+		want    KeyType
+	}{
+		{"", KeyTypeRSA2048},
+		{KeyTypeRSA2048, KeyTypeRSA2048},
+		{KeyTypeECDSAP256, KeyTypeECDSAP256},
+		{KeyTypeECDSAP384, KeyTypeECDSAP384},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.want), func(t *testing.T) {
+			name := CertificateName{Agent: "smith", Purpose: CertificatePurposeAgent}
+			_, cert64, key64, err := c.GenerateCertificate(name, tt.keyType, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			certPEM := decode64PEM(t, cert64)
+			keyPEM := decode64PEM(t, key64)
+
+			pair, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatalf("returned certificate and key do not load: %v", err)
+			}
+			cert, err := x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkKeyType(t, cert.PublicKey, tt.want)
+			if err := cert.CheckSignatureFrom(caCert); err != nil {
+				t.Errorf("certificate not signed by CA: %v", err)
+			}
+
+			block, _ := pem.Decode(keyPEM)
+			wantBlock := map[bool]string{true: "EC PRIVATE KEY", false: "RSA PRIVATE KEY"}[cert.PublicKeyAlgorithm == x509.ECDSA]
+			if block.Type != wantBlock {
+				t.Errorf("expected key PEM type %s, got %s", wantBlock, block.Type)
+			}
+		})
+	}
+
+	if _, _, _, err := c.GenerateCertificate(CertificateName{Purpose: CertificatePurposeAgent}, "dsa", 0); err == nil {
+		t.Errorf("expected an error for an unknown key type")
+	}
+}
+
+func TestParseKeyType(t *testing.T) {
+	for _, name := range []string{"", "rsa2048", "rsa4096", "ecdsa-p256", "ecdsa-p384"} {
+		if _, err := ParseKeyType(name); err != nil {
+			t.Errorf("unexpected error for '%s': %v", name, err)
+		}
+	}
+	if _, err := ParseKeyType("ed25519"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// TestHandshake_mixedKeyTypes connects a client and server whose
+// certificates use different key types than each other and the CA, as the
+// controller listeners and agent do.
+func TestHandshake_mixedKeyTypes(t *testing.T) {
+	certPEM, keyPEM, err := MakeCertificateAuthority(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatalf("unable to make CA: %v", err)
+	}
+	c, err := MakeCAFromData(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("unable to make CA: %v", err)
+	}
+	certPool, err := c.MakeCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		serverKeyType KeyType
+		clientKeyType KeyType
+		maxVersion    uint16
+	}{
+		{"rsa server, ecdsa client", KeyTypeRSA2048, KeyTypeECDSAP384, tls.VersionTLS13},
+		{"ecdsa server, rsa client", KeyTypeECDSAP256, KeyTypeRSA2048, tls.VersionTLS13},
+		{"rsa server, ecdsa client, tls 1.2", KeyTypeRSA2048, KeyTypeECDSAP256, tls.VersionTLS12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.keyType = tt.serverKeyType
+			serverCert, err := c.MakeServerCert([]string{"localhost"})
+			if err != nil {
+				t.Fatalf("unable to make server certificate: %v", err)
+			}
+
+			name := CertificateName{Agent: "smith", Purpose: CertificatePurposeAgent}
+			_, cert64, key64, err := c.GenerateCertificate(name, tt.clientKeyType, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientCert, err := tls.X509KeyPair(decode64PEM(t, cert64), decode64PEM(t, key64))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serverConn, clientConn := net.Pipe()
+			server := tls.Server(serverConn, &tls.Config{
+				ClientCAs:             certPool,
+				ClientAuth:            tls.RequireAndVerifyClientCert,
+				Certificates:          []tls.Certificate{*serverCert},
+				MinVersion:            tls.VersionTLS12,
+				VerifyPeerCertificate: c.VerifyPeerCertificate,
+			})
+			client := tls.Client(clientConn, &tls.Config{
+				Certificates: []tls.Certificate{clientCert},
+				RootCAs:      certPool,
+				ServerName:   "localhost",
+				MaxVersion:   tt.maxVersion,
+			})
+			defer server.Close()
+			defer client.Close()
+
+			errc := make(chan error, 1)
+			go func() { errc <- server.Handshake() }()
+			if err := client.Handshake(); err != nil {
+				t.Fatalf("client handshake failed: %v", err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("server handshake failed: %v", err)
+			}
+			peer := server.ConnectionState().PeerCertificates[0]
+			checkKeyType(t, peer.PublicKey, tt.clientKeyType)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRevocationListPath = "/app/revocations/revocations.json"
+
+	// how long a generated CRL is valid for
+	crlValidity = 24 * time.Hour
+)
+
+// CertificateRevoker implements revoking certificates, and checking
+// presented certificates against the revocation list.
+type CertificateRevoker interface {
+	Revoke(serial *big.Int) error
+	RevokeName(name CertificateName) error
+	VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+}
+
+//
+// Revocation is a single entry in the revocation list.  Either a specific
+// serial number is revoked, or every certificate issued with the given
+// CertificateName before RevokedAt.
+//
+type Revocation struct {
+	Serial    string           `json:"serial,omitempty"`
+	Name      *CertificateName `json:"name,omitempty"`
+	RevokedAt time.Time        `json:"revokedAt"`
+}
+
+type revocationList struct {
+	sync.RWMutex
+	path    string
+	entries []Revocation
+	serials map[string]bool
+}
+
+func newRevocationList(path string) *revocationList {
+	return &revocationList{
+		path:    path,
+		serials: map[string]bool{},
+	}
+}
+
+// load reads the list from disk.  A missing file is an empty list.
+func (r *revocationList) load() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read revocation list: %v", err)
+	}
+	var entries []Revocation
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("unable to parse revocation list %s: %v", r.path, err)
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.entries = entries
+	for _, e := range entries {
+		if e.Serial != "" {
+			r.serials[e.Serial] = true
+		}
+	}
+	return nil
+}
+
+// save writes the list to disk, replacing the old file atomically.
+// The caller must hold the lock.
+func (r *revocationList) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(r.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to save revocation list: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, ".revocations")
+	if err != nil {
+		return fmt.Errorf("unable to save revocation list: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to save revocation list: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to save revocation list: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("unable to save revocation list: %v", err)
+	}
+	return nil
+}
+
+func (r *revocationList) add(e Revocation) error {
+	r.Lock()
+	defer r.Unlock()
+	old := r.entries
+	r.entries = append(r.entries, e)
+	if err := r.save(); err != nil {
+		r.entries = old
+		return err
+	}
+	if e.Serial != "" {
+		r.serials[e.Serial] = true
+	}
+	return nil
+}
+
+func (r *revocationList) isRevoked(cert *x509.Certificate) bool {
+	r.RLock()
+	defer r.RUnlock()
+	if r.serials[cert.SerialNumber.String()] {
+		return true
+	}
+	name, err := GetCertificateNameFromCert(cert)
+	if err != nil {
+		return false
+	}
+	for _, e := range r.entries {
+		if e.Name != nil && *e.Name == *name && !cert.NotBefore.After(e.RevokedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastRevoked returns when the name was last revoked, or the zero time if
+// it never was.
+func (r *revocationList) lastRevoked(name CertificateName) time.Time {
+	r.RLock()
+	defer r.RUnlock()
+	var last time.Time
+	for _, e := range r.entries {
+		if e.Name != nil && *e.Name == name && e.RevokedAt.After(last) {
+			last = e.RevokedAt
+		}
+	}
+	return last
+}
+
+// issueAfterRevocation returns the time to issue a certificate for name
+// at, which is now unless the name was revoked within the current second.
+// NotBefore holds only whole seconds, so a certificate issued then would
+// seem to predate the revocation, and issuing waits for the next second.
+func (r *revocationList) issueAfterRevocation(name CertificateName) time.Time {
+	now := time.Now().UTC()
+	revoked := r.lastRevoked(name)
+	if now.Truncate(time.Second).After(revoked) {
+		return now
+	}
+	time.Sleep(revoked.Truncate(time.Second).Add(time.Second).Sub(now))
+	return time.Now().UTC()
+}
+
+func (r *revocationList) revokeSerial(serial *big.Int) error {
+	if serial == nil || serial.Sign() <= 0 {
+		return fmt.Errorf("invalid serial number")
+	}
+	return r.add(Revocation{
+		Serial:    serial.String(),
+		RevokedAt: time.Now().UTC(),
+	})
+}
+
+func (r *revocationList) revokeName(name CertificateName) error {
+	if name.Purpose == "" {
+		return fmt.Errorf("certificate name must include a purpose")
+	}
+	return r.add(Revocation{
+		Name:      &name,
+		RevokedAt: time.Now().UTC(),
+	})
+}
+
+func (r *revocationList) verifyPeerCertificate(verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if len(chain) > 0 && r.isRevoked(chain[0]) {
+			return fmt.Errorf("certificate serial %s has been revoked", chain[0].SerialNumber)
+		}
+	}
+	return nil
+}
+
+//
+// Revoke adds a certificate serial number to the revocation list.
+//
+func (c *CA) Revoke(serial *big.Int) error {
+	return c.revocations.revokeSerial(serial)
+}
+
+//
+// RevokeName revokes every certificate issued for the CertificateName up
+// to now.  Certificates issued for the same name afterwards are valid,
+// though issuing one within the same second waits for the next.
+//
+func (c *CA) RevokeName(name CertificateName) error {
+	return c.revocations.revokeName(name)
+}
+
+//
+// IsRevoked returns true if the certificate has been revoked.
+//
+func (c *CA) IsRevoked(cert *x509.Certificate) bool {
+	return c.revocations.isRevoked(cert)
+}
+
+//
+// VerifyPeerCertificate is intended to be installed in a tls.Config, and
+// will reject a peer presenting a revoked certificate.  It only checks
+// certificates which have already been verified against the CA.
+//
+func (c *CA) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return c.revocations.verifyPeerCertificate(verifiedChains)
+}
+
+//
+// GenerateCRL returns a PEM encoded certificate revocation list, signed by
+// the CA, containing all revoked serial numbers.  Revocations by name are
+// not included, as they do not refer to specific certificates.
+//
+func (c *CA) GenerateCRL() ([]byte, error) {
+	caCert, err := x509.ParseCertificate(c.caCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := c.caCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA private key cannot be used for signing")
+	}
+
+	c.revocations.RLock()
+	revoked := []pkix.RevokedCertificate{}
+	for _, e := range c.revocations.entries {
+		if e.Serial == "" {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(e.Serial, 10)
+		if !ok {
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: e.RevokedAt,
+		})
+	}
+	c.revocations.RUnlock()
+
+	now := time.Now().UTC()
+	template := &x509.RevocationList{
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+		RevokedCertificates: revoked,
+	}
+	crl, err := x509.CreateRevocationList(crand.Reader, template, caCert, signer)
+	if err != nil {
+		return nil, err
+	}
+	return toPEM(crl, "X509 CRL")
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeTestCA(t *testing.T) (string, string) {
+	certPEM, keyPEM, err := MakeCertificateAuthority(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatalf("unable to make CA: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func issue(t *testing.T, c *CA, name CertificateName) *x509.Certificate {
+	_, cert64, _, err := c.GenerateCertificate(name, "", 0)
+	if err != nil {
+		t.Fatalf("unable to generate certificate: %v", err)
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(cert64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCA_Revoke(t *testing.T) {
+	certFile, keyFile := makeTestCA(t)
+	config := Config{
+		CACertFile:         certFile,
+		CAKeyFile:          keyFile,
+		RevocationListFile: filepath.Join(t.TempDir(), "revocations.json"),
+	}
+	c, err := LoadCAFromFile(config)
+	if err != nil {
+		t.Fatalf("unable to load CA: %v", err)
+	}
+
+	agentName := CertificateName{Agent: "smith", Purpose: CertificatePurposeAgent}
+	serviceName := CertificateName{Agent: "smith", Type: "kubernetes", Name: "bob", Purpose: CertificatePurposeService}
+	revokedBySerial := issue(t, c, agentName)
+	valid := issue(t, c, agentName)
+	revokedByName := issue(t, c, serviceName)
+
+	if err := c.Revoke(revokedBySerial.SerialNumber); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.RevokeName(serviceName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	check := func(t *testing.T, c *CA) {
+		if !c.IsRevoked(revokedBySerial) {
+			t.Errorf("expected serial %s to be revoked", revokedBySerial.SerialNumber)
+		}
+		if !c.IsRevoked(revokedByName) {
+			t.Errorf("expected %v to be revoked", serviceName)
+		}
+		if c.IsRevoked(valid) {
+			t.Errorf("expected serial %s to be valid", valid.SerialNumber)
+		}
+		if err := c.VerifyPeerCertificate(nil, [][]*x509.Certificate{{revokedBySerial}}); err == nil {
+			t.Errorf("expected VerifyPeerCertificate to fail for a revoked certificate")
+		}
+		if err := c.VerifyPeerCertificate(nil, [][]*x509.Certificate{{valid}}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	check(t, c)
+
+	// revocations must survive a restart
+	reloaded, err := LoadCAFromFile(config)
+	if err != nil {
+		t.Fatalf("unable to reload CA: %v", err)
+	}
+	check(t, reloaded)
+}
+
+// TestCA_RevokeName_reissue checks that a certificate issued right after
+// its name is revoked, usually in the same second, is valid.
+func TestCA_RevokeName_reissue(t *testing.T) {
+	certFile, keyFile := makeTestCA(t)
+	c, err := LoadCAFromFile(Config{CACertFile: certFile, CAKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("unable to load CA: %v", err)
+	}
+
+	name := CertificateName{Agent: "smith", Purpose: CertificatePurposeAgent}
+	old := issue(t, c, name)
+	if err := c.RevokeName(name); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reissued := issue(t, c, name)
+	if !c.IsRevoked(old) {
+		t.Errorf("expected the certificate issued before the revocation to be revoked")
+	}
+	if c.IsRevoked(reissued) {
+		t.Errorf("expected the certificate issued after the revocation to be valid")
+	}
+	if now := time.Now(); reissued.NotBefore.After(now) {
+		t.Errorf("NotBefore %v is after the time it was issued, %v", reissued.NotBefore, now)
+	}
+}
+
+func TestCA_Revoke_invalid(t *testing.T) {
+	c := &CA{revocations: newRevocationList("")}
+	if err := c.Revoke(nil); err == nil {
+		t.Errorf("expected an error for a nil serial")
+	}
+	if err := c.RevokeName(CertificateName{Agent: "smith"}); err == nil {
+		t.Errorf("expected an error for a name without a purpose")
+	}
+}
+
+func TestCA_GenerateCRL(t *testing.T) {
+	certPEM, keyPEM, err := MakeCertificateAuthority(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatalf("unable to make CA: %v", err)
+	}
+	c, err := MakeCAFromData(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("unable to make CA: %v", err)
+	}
+	cert := issue(t, c, CertificateName{Agent: "smith", Purpose: CertificatePurposeAgent})
+	if err := c.Revoke(cert.SerialNumber); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	crlPEM, err := c.GenerateCRL()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	block, _ := pem.Decode(crlPEM)
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("expected a PEM encoded CRL, got %q", string(crlPEM))
+	}
+	crl, err := x509.ParseCRL(block.Bytes)
+	if err != nil {
+		t.Fatalf("unable to parse CRL: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(c.caCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caCert.CheckCRLSignature(crl); err != nil {
+		t.Errorf("CRL signature invalid: %v", err)
+	}
+	revoked := crl.TBSCertList.RevokedCertificates
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("expected serial %s in CRL, got %v", cert.SerialNumber, revoked)
+	}
+}
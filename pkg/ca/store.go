@@ -0,0 +1,100 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrCANotFound is returned by a Store which does not hold a CA.
+var ErrCANotFound = errors.New("CA certificate and key not found")
+
+// Store holds the authority's certificate and key in PEM form, so the same
+// CA is used each time the controller starts.
+type Store interface {
+	// Load returns ErrCANotFound if neither the certificate nor the key
+	// exist.
+	Load() (certPEM []byte, keyPEM []byte, err error)
+	// Save must not replace an existing CA.
+	Save(certPEM []byte, keyPEM []byte) error
+	String() string
+}
+
+// FileStore keeps the CA in a certificate and key file pair.
+type FileStore struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Load reads the certificate and key files.
+func (s *FileStore) Load() ([]byte, []byte, error) {
+	certPEM, certErr := ioutil.ReadFile(s.CertFile)
+	keyPEM, keyErr := ioutil.ReadFile(s.KeyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return nil, nil, ErrCANotFound
+	}
+	if certErr != nil {
+		return nil, nil, certErr
+	}
+	if keyErr != nil {
+		return nil, nil, keyErr
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Save writes the certificate and key files, failing if either exists.
+func (s *FileStore) Save(certPEM []byte, keyPEM []byte) error {
+	if err := writeNewFile(s.KeyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeNewFile(s.CertFile, certPEM, 0644)
+}
+
+func (s *FileStore) String() string {
+	return fmt.Sprintf("files %s and %s", s.CertFile, s.KeyFile)
+}
+
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// bootstrapCA generates a new authority and saves it to store.
+func bootstrapCA(store Store) ([]byte, []byte, error) {
+	certPEM, keyPEM, err := MakeCertificateAuthority("")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := store.Save(certPEM, keyPEM); err != nil {
+		return nil, nil, fmt.Errorf("unable to save new CA to %s: %v", store, err)
+	}
+	return certPEM, keyPEM, nil
+}
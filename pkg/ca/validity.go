@@ -0,0 +1,90 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultValidity    = 365 * 24 * time.Hour
+	defaultMaxValidity = 365 * 24 * time.Hour
+)
+
+//
+// ValidityConfig holds how long issued certificates are valid for, by
+// purpose, as durations such as "8h" or "8760h".  Server is used for the
+// controller's own TLS certificate.  Unset purposes default to one year.
+//
+type ValidityConfig struct {
+	Agent         time.Duration `yaml:"agent,omitempty" json:"agent,omitempty"`
+	Service       time.Duration `yaml:"service,omitempty" json:"service,omitempty"`
+	Control       time.Duration `yaml:"control,omitempty" json:"control,omitempty"`
+	RemoteCommand time.Duration `yaml:"remoteCommand,omitempty" json:"remoteCommand,omitempty"`
+	Server        time.Duration `yaml:"server,omitempty" json:"server,omitempty"`
+}
+
+func (v *ValidityConfig) applyDefaults() {
+	for _, d := range []*time.Duration{&v.Agent, &v.Service, &v.Control, &v.RemoteCommand, &v.Server} {
+		if *d == 0 {
+			*d = defaultValidity
+		}
+	}
+}
+
+func (v *ValidityConfig) validate() error {
+	for _, d := range []time.Duration{v.Agent, v.Service, v.Control, v.RemoteCommand, v.Server} {
+		if d < 0 {
+			return fmt.Errorf("certificate validity cannot be negative")
+		}
+	}
+	return nil
+}
+
+// forPurpose returns the configured lifetime for certificates with the
+// purpose.
+func (v *ValidityConfig) forPurpose(purpose string) time.Duration {
+	switch purpose {
+	case CertificatePurposeAgent:
+		return v.Agent
+	case CertificatePurposeService:
+		return v.Service
+	case CertificatePurposeControl:
+		return v.Control
+	case CertificatePurposeRemoteCommand:
+		return v.RemoteCommand
+	default:
+		return defaultValidity
+	}
+}
+
+// certificateValidity returns how long a certificate should be valid for.
+// If requested is zero, the configured lifetime for the purpose is used;
+// otherwise it must not exceed the CA's maximum.
+func (c *CA) certificateValidity(purpose string, requested time.Duration) (time.Duration, error) {
+	if requested == 0 {
+		return c.validity.forPurpose(purpose), nil
+	}
+	if requested < 0 {
+		return 0, fmt.Errorf("certificate validity cannot be negative")
+	}
+	if requested > c.maxValidity {
+		return 0, fmt.Errorf("requested validity %s exceeds the maximum of %s", requested, c.maxValidity)
+	}
+	return requested, nil
+}
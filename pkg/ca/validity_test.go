@@ -0,0 +1,128 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func lifetime(cert *x509.Certificate) time.Duration {
+	return cert.NotAfter.Sub(cert.NotBefore)
+}
+
+func TestConfig_validityFromYAML(t *testing.T) {
+	var c Config
+	err := yaml.Unmarshal([]byte("validity:\n  service: 8h\n  agent: 8760h\nmaxValidity: 720h\n"), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.applyDefaults()
+	if c.Validity.Service != 8*time.Hour || c.Validity.Agent != 8760*time.Hour {
+		t.Errorf("unexpected validity %+v", c.Validity)
+	}
+	if c.Validity.Control != defaultValidity || c.Validity.Server != defaultValidity {
+		t.Errorf("expected unset purposes to default, got %+v", c.Validity)
+	}
+	if c.MaxValidity != 720*time.Hour {
+		t.Errorf("expected maxValidity 720h, got %s", c.MaxValidity)
+	}
+}
+
+func TestCA_certificateLifetimes(t *testing.T) {
+	certFile, keyFile := makeTestCA(t)
+	c, err := LoadCAFromFile(Config{
+		CACertFile:         certFile,
+		CAKeyFile:          keyFile,
+		RevocationListFile: t.TempDir() + "/revocations.json",
+		KeyType:            KeyTypeECDSAP256,
+		Validity:           ValidityConfig{Service: 8 * time.Hour, Server: 48 * time.Hour},
+		MaxValidity:        30 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unable to load CA: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		purpose   string
+		requested time.Duration
+		want      time.Duration
+		wantErr   bool
+	}{
+		{"service default", CertificatePurposeService, 0, 8 * time.Hour, false},
+		{"agent default", CertificatePurposeAgent, 0, defaultValidity, false},
+		{"requested", CertificatePurposeAgent, 7 * 24 * time.Hour, 7 * 24 * time.Hour, false},
+		{"at maximum", CertificatePurposeAgent, 30 * 24 * time.Hour, 30 * 24 * time.Hour, false},
+		{"over maximum", CertificatePurposeAgent, 31 * 24 * time.Hour, 0, true},
+		{"negative", CertificatePurposeAgent, -time.Hour, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := CertificateName{Agent: "smith", Purpose: tt.purpose}
+			_, cert64, _, err := c.GenerateCertificate(name, "", tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateCertificate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			certPEM, err := base64.StdEncoding.DecodeString(cert64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, _ := pem.Decode(certPEM)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lifetime(cert); got != tt.want {
+				t.Errorf("expected lifetime %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	serverCert, err := c.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server certificate is backdated slightly for clock skew.
+	if got := leaf.NotAfter.Sub(leaf.NotBefore.Add(10 * time.Second)); got != 48*time.Hour {
+		t.Errorf("expected server lifetime 48h, got %s", got)
+	}
+}
+
+func TestLoadCAFromFile_invalidValidity(t *testing.T) {
+	certFile, keyFile := makeTestCA(t)
+	_, err := LoadCAFromFile(Config{
+		CACertFile: certFile,
+		CAKeyFile:  keyFile,
+		Validity:   ValidityConfig{Agent: -time.Hour},
+	})
+	if err == nil {
+		t.Errorf("expected an error for a negative validity")
+	}
+}
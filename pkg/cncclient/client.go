@@ -0,0 +1,328 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//
+// Package cncclient is a client for the controller's control API, which
+// authenticates with a control certificate and exchanges the request and
+// response types of the fwdapi package.
+//
+package cncclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+// Timeouts used by a Client.  A context passed to a call may end it sooner.
+const (
+	// DefaultTimeout limits each call, from connecting until the whole
+	// response has been read.
+	DefaultTimeout = 30 * time.Second
+
+	dialTimeout         = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// The most of an error response body kept in an Error.
+const maxErrorBodyBytes = 64 * 1024
+
+//
+// Client calls the control API of one controller.  It is safe for
+// concurrent use.
+//
+type Client struct {
+	controlURL string
+	httpClient *http.Client
+}
+
+//
+// New returns a client for the control API at controlURL, such as
+// "https://forwarder-controller:9003".  certPEM and keyPEM are the control
+// certificate and key to authenticate with, and caPEM is the authority
+// certificate the controller's certificate is verified with.  All are PEM
+// encoded.
+//
+func New(controlURL string, certPEM []byte, keyPEM []byte, caPEM []byte) (*Client, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading control certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no CA certificates found")
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      roots,
+			MinVersion:   tls.VersionTLS12,
+		},
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        10,
+	}
+	return &Client{
+		controlURL: strings.TrimSuffix(controlURL, "/"),
+		httpClient: &http.Client{Transport: transport, Timeout: DefaultTimeout},
+	}, nil
+}
+
+//
+// Error is returned when the controller refuses a request, with the HTTP
+// status and the message it gave.  RequestID is set if the controller
+// logged the failure with one, and Fields if it found fields of the
+// request invalid, mapping each field's JSON name to the problem.
+//
+type Error struct {
+	StatusCode int
+	Message    string
+	RequestID  string
+	Fields     map[string]string
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("controller returned %d: %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("controller returned %d: %s", e.StatusCode, e.Message)
+}
+
+// errorResponse is the body of a failed request, as written by
+// util.FailRequest.
+type errorResponse struct {
+	Error struct {
+		Message   string            `json:"message"`
+		RequestID string            `json:"requestId"`
+		Fields    map[string]string `json:"fields"`
+	} `json:"error"`
+}
+
+func makeError(resp *http.Response) *Error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	ret := &Error{StatusCode: resp.StatusCode}
+	var parsed errorResponse
+	if err := json.Unmarshal(body, &parsed); err == nil && parsed.Error.Message != "" {
+		ret.Message = parsed.Error.Message
+		ret.RequestID = parsed.Error.RequestID
+		ret.Fields = parsed.Error.Fields
+		return ret
+	}
+	ret.Message = strings.TrimSpace(string(body))
+	if ret.Message == "" {
+		ret.Message = http.StatusText(resp.StatusCode)
+	}
+	return ret
+}
+
+// do sends a request to path, with request as its JSON body if it is not
+// nil, and returns the response body.
+func (c *Client) do(ctx context.Context, method string, path string, request interface{}) ([]byte, error) {
+	var body io.Reader
+	if request != nil {
+		buf, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.controlURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, makeError(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// call is do, decoding the response body as JSON into response.
+func (c *Client) call(ctx context.Context, method string, path string, request interface{}, response interface{}) error {
+	body, err := c.do(ctx, method, path, request)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("decoding response from %s: %v", path, err)
+	}
+	return nil
+}
+
+// checkJSONFormat returns an error unless format asks for JSON, as the
+// typed calls decode the response.
+func checkJSONFormat(format string) error {
+	if format != "" && format != "json" {
+		return fmt.Errorf("format %q is not JSON", format)
+	}
+	return nil
+}
+
+//
+// GenerateKubeConfig returns the components of a kubeconfig for an agent's
+// Kubernetes endpoint.  req.Format must be empty or
+// fwdapi.KubeConfigFormatJSON; see GenerateKubeConfigFile for a complete
+// kubeconfig.
+//
+func (c *Client) GenerateKubeConfig(ctx context.Context, req fwdapi.KubeConfigRequest) (*fwdapi.KubeConfigResponse, error) {
+	if err := checkJSONFormat(req.Format); err != nil {
+		return nil, err
+	}
+	var ret fwdapi.KubeConfigResponse
+	if err := c.call(ctx, http.MethodPost, fwdapi.KubeconfigEndpoint, req, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+//
+// GenerateKubeConfigFile returns a complete kubeconfig file for an agent's
+// Kubernetes endpoint, ready to be written out.  req.Format is ignored.
+//
+func (c *Client) GenerateKubeConfigFile(ctx context.Context, req fwdapi.KubeConfigRequest) ([]byte, error) {
+	req.Format = fwdapi.KubeConfigFormatKubeconfig
+	return c.do(ctx, http.MethodPost, fwdapi.KubeconfigEndpoint, req)
+}
+
+//
+// GenerateAgentManifest returns the certificate and connection details for
+// a new agent.  req.Format must be empty or fwdapi.ManifestFormatJSON.
+//
+func (c *Client) GenerateAgentManifest(ctx context.Context, req fwdapi.ManifestRequest) (*fwdapi.ManifestResponse, error) {
+	if err := checkJSONFormat(req.Format); err != nil {
+		return nil, err
+	}
+	var ret fwdapi.ManifestResponse
+	if err := c.call(ctx, http.MethodPost, fwdapi.ManifestEndpoint, req, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+//
+// GenerateServiceCredentials returns a credential for calling an agent's
+// service endpoint through the controller.  req.Format must be empty or
+// fwdapi.ServiceCredentialFormatJSON; see GenerateServiceCredentialSecret
+// for a Kubernetes Secret.
+//
+func (c *Client) GenerateServiceCredentials(ctx context.Context, req fwdapi.ServiceCredentialRequest) (*fwdapi.ServiceCredentialResponse, error) {
+	if err := checkJSONFormat(req.Format); err != nil {
+		return nil, err
+	}
+	var ret fwdapi.ServiceCredentialResponse
+	if err := c.call(ctx, http.MethodPost, fwdapi.ServiceEndpoint, req, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+//
+// GenerateServiceCredentialSecret returns a Kubernetes Secret manifest
+// holding a credential for an agent's service endpoint, ready to be
+// applied.  req.Format is ignored.
+//
+func (c *Client) GenerateServiceCredentialSecret(ctx context.Context, req fwdapi.ServiceCredentialRequest) ([]byte, error) {
+	req.Format = fwdapi.ServiceCredentialFormatSecret
+	return c.do(ctx, http.MethodPost, fwdapi.ServiceEndpoint, req)
+}
+
+//
+// GenerateControlCredentials returns a new control certificate.
+//
+func (c *Client) GenerateControlCredentials(ctx context.Context, req fwdapi.ControlCredentialsRequest) (*fwdapi.ControlCredentialsResponse, error) {
+	var ret fwdapi.ControlCredentialsResponse
+	if err := c.call(ctx, http.MethodPost, fwdapi.ControlEndpoint, req, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+//
+// GetStatistics returns the controller's statistics for its connected
+// agents.  A controller sending any other version of the response than
+// fwdapi.StatisticsAPIVersion, including one configured for the legacy
+// response, is an error.
+//
+func (c *Client) GetStatistics(ctx context.Context) (*fwdapi.StatisticsResponse, error) {
+	var ret fwdapi.StatisticsResponse
+	if err := c.call(ctx, http.MethodGet, fwdapi.StatisticsEndpoint, nil, &ret); err != nil {
+		return nil, err
+	}
+	if ret.APIVersion != fwdapi.StatisticsAPIVersion {
+		return nil, fmt.Errorf("controller sent statistics version '%s', want '%s'", ret.APIVersion, fwdapi.StatisticsAPIVersion)
+	}
+	return &ret, nil
+}
+
+//
+// DisconnectAgent closes an agent's sessions on the controller, and revokes
+// its certificates first if req.Revoke is set.
+//
+func (c *Client) DisconnectAgent(ctx context.Context, req fwdapi.DisconnectAgentRequest) (*fwdapi.DisconnectAgentResponse, error) {
+	var ret fwdapi.DisconnectAgentResponse
+	if err := c.call(ctx, http.MethodPost, fwdapi.DisconnectEndpoint, req, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+//
+// SetLimits changes the controller's limits on outstanding requests, and
+// returns those now in force.  Limits not set in req are unchanged.
+//
+func (c *Client) SetLimits(ctx context.Context, req fwdapi.LimitsRequest) (*fwdapi.LimitsResponse, error) {
+	var ret fwdapi.LimitsResponse
+	if err := c.call(ctx, http.MethodPost, fwdapi.LimitsEndpoint, req, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+//
+// RevokeServiceToken revokes a service token, given whole or by its ID, so
+// the controller refuses it from now on.
+//
+func (c *Client) RevokeServiceToken(ctx context.Context, req fwdapi.RevokeServiceTokenRequest) (*fwdapi.RevokeServiceTokenResponse, error) {
+	var ret fwdapi.RevokeServiceTokenResponse
+	if err := c.call(ctx, http.MethodPost, fwdapi.RevokeServiceTokenEndpoint, req, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
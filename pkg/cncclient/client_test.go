@@ -0,0 +1,279 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncclient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/ca"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+func decode64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// startControlServer starts a TLS server which requires a client
+// certificate from the authority, and returns a client for it.
+func startControlServer(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	caCertPEM, caKeyPEM, err := ca.MakeCertificateAuthority(ca.KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := ca.MakeCAFromData(caCertPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := authority.MakeServerCert([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := authority.MakeCertPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	name := ca.CertificateName{Name: "test", Purpose: ca.CertificatePurposeControl}
+	_, cert64, key64, err := authority.GenerateCertificate(name, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	client, err := New(url, decode64(t, cert64), decode64(t, key64), caCertPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestClient_calls(t *testing.T) {
+	client := startControlServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			t.Errorf("%s: no client certificate", r.URL.Path)
+		}
+		var body map[string]interface{}
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("%s: %v", r.URL.Path, err)
+			}
+		}
+		switch fmt.Sprintf("%s %s", r.Method, r.URL.Path) {
+		case "POST " + fwdapi.KubeconfigEndpoint:
+			if body["format"] == fwdapi.KubeConfigFormatKubeconfig {
+				fmt.Fprint(w, "apiVersion: v1\n")
+				return
+			}
+			fmt.Fprintf(w, `{"agentName":"%s","name":"%s","serverUrl":"https://c:9002"}`, body["agentName"], body["name"])
+		case "POST " + fwdapi.ManifestEndpoint:
+			fmt.Fprintf(w, `{"agentName":"%s","serverPort":9001}`, body["agentName"])
+		case "POST " + fwdapi.ServiceEndpoint:
+			if body["format"] == fwdapi.ServiceCredentialFormatSecret {
+				fmt.Fprint(w, "kind: Secret\n")
+				return
+			}
+			fmt.Fprintf(w, `{"agentName":"%s","type":"%s","credentialType":"basic","credential":{"username":"u"}}`, body["agentName"], body["Type"])
+		case "POST " + fwdapi.ControlEndpoint:
+			fmt.Fprintf(w, `{"name":"%s","url":"https://c:9003"}`, body["name"])
+		case "POST " + fwdapi.DisconnectEndpoint:
+			fmt.Fprintf(w, `{"agentName":"%s","sessionsClosed":2,"revoked":%v}`, body["agentName"], body["revoke"])
+		case "POST " + fwdapi.LimitsEndpoint:
+			fmt.Fprintf(w, `{"maxOutstandingPerSession":%v,"maxOutstanding":0,"outstanding":3}`, body["maxOutstandingPerSession"])
+		case "POST " + fwdapi.RevokeServiceTokenEndpoint:
+			fmt.Fprintf(w, `{"jti":"%s"}`, body["jti"])
+		case "GET " + fwdapi.StatisticsEndpoint:
+			fmt.Fprintf(w, `{"apiVersion":"%s","serverTime":1234,"version":"v1","connectedAgents":[{"name":"agent1","sessions":[{"session":"s1","inFlight":2}]}]}`, fwdapi.StatisticsAPIVersion)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	ctx := context.Background()
+
+	kc, err := client.GenerateKubeConfig(ctx, fwdapi.KubeConfigRequest{AgentName: "agent1", Name: "k8s"})
+	if err != nil || kc.AgentName != "agent1" || kc.Name != "k8s" || kc.ServerURL != "https://c:9002" {
+		t.Errorf("GenerateKubeConfig() = %+v, %v", kc, err)
+	}
+	file, err := client.GenerateKubeConfigFile(ctx, fwdapi.KubeConfigRequest{AgentName: "agent1", Name: "k8s"})
+	if err != nil || string(file) != "apiVersion: v1\n" {
+		t.Errorf("GenerateKubeConfigFile() = %q, %v", file, err)
+	}
+	if _, err := client.GenerateKubeConfig(ctx, fwdapi.KubeConfigRequest{Format: fwdapi.KubeConfigFormatKubeconfig}); err == nil {
+		t.Errorf("GenerateKubeConfig() accepted a kubeconfig format")
+	}
+	manifest, err := client.GenerateAgentManifest(ctx, fwdapi.ManifestRequest{AgentName: "agent1"})
+	if err != nil || manifest.AgentName != "agent1" || manifest.ServerPort != 9001 {
+		t.Errorf("GenerateAgentManifest() = %+v, %v", manifest, err)
+	}
+	service, err := client.GenerateServiceCredentials(ctx, fwdapi.ServiceCredentialRequest{AgentName: "agent1", Type: "jenkins", Name: "j"})
+	if err != nil || service.Type != "jenkins" || service.CredentialType != "basic" {
+		t.Errorf("GenerateServiceCredentials() = %+v, %v", service, err)
+	}
+	secret, err := client.GenerateServiceCredentialSecret(ctx, fwdapi.ServiceCredentialRequest{AgentName: "agent1", Type: "jenkins", Name: "j"})
+	if err != nil || string(secret) != "kind: Secret\n" {
+		t.Errorf("GenerateServiceCredentialSecret() = %q, %v", secret, err)
+	}
+	if _, err := client.GenerateServiceCredentials(ctx, fwdapi.ServiceCredentialRequest{Format: fwdapi.ServiceCredentialFormatSecret}); err == nil {
+		t.Errorf("GenerateServiceCredentials() accepted a secret format")
+	}
+	control, err := client.GenerateControlCredentials(ctx, fwdapi.ControlCredentialsRequest{Name: "ctl"})
+	if err != nil || control.Name != "ctl" || control.URL != "https://c:9003" {
+		t.Errorf("GenerateControlCredentials() = %+v, %v", control, err)
+	}
+	disconnect, err := client.DisconnectAgent(ctx, fwdapi.DisconnectAgentRequest{AgentName: "agent1", Revoke: true})
+	if err != nil || disconnect.AgentName != "agent1" || disconnect.SessionsClosed != 2 || !disconnect.Revoked {
+		t.Errorf("DisconnectAgent() = %+v, %v", disconnect, err)
+	}
+	perSession := 10
+	limits, err := client.SetLimits(ctx, fwdapi.LimitsRequest{MaxOutstandingPerSession: &perSession})
+	if err != nil || limits.MaxOutstandingPerSession != 10 || limits.Outstanding != 3 {
+		t.Errorf("SetLimits() = %+v, %v", limits, err)
+	}
+	revoked, err := client.RevokeServiceToken(ctx, fwdapi.RevokeServiceTokenRequest{ID: "01F4R9T4G0TESTTOKEN0000000"})
+	if err != nil || revoked.ID != "01F4R9T4G0TESTTOKEN0000000" {
+		t.Errorf("RevokeServiceToken() = %+v, %v", revoked, err)
+	}
+	stats, err := client.GetStatistics(ctx)
+	if err != nil || stats.ServerTime != 1234 || stats.Version != "v1" {
+		t.Fatalf("GetStatistics() = %+v, %v", stats, err)
+	}
+	if len(stats.ConnectedAgents) != 1 || stats.ConnectedAgents[0].Sessions[0].InFlight != 2 {
+		t.Errorf("GetStatistics() agents = %+v", stats.ConnectedAgents)
+	}
+}
+
+func TestClient_GetStatistics_legacy(t *testing.T) {
+	client := startControlServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"serverTime":1234,"version":"v1","connectedAgents":[{"name":"agent1","session":"s1"}]}`)
+	})
+	if stats, err := client.GetStatistics(context.Background()); err == nil {
+		t.Errorf("GetStatistics() = %+v, want an error for the legacy response", stats)
+	}
+}
+
+func TestClient_errors(t *testing.T) {
+	client := startControlServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case fwdapi.KubeconfigEndpoint:
+			util.FailRequestWithID(w, errors.New("agent name is required"), http.StatusBadRequest, "req1")
+		case fwdapi.ServiceEndpoint:
+			req := fwdapi.ControlCredentialsRequest{ValidityDays: -1}
+			util.FailRequest(w, req.Validate(), http.StatusBadRequest)
+		case fwdapi.ManifestEndpoint:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "not allowed\n")
+		case fwdapi.ControlEndpoint:
+			w.WriteHeader(http.StatusInternalServerError)
+		case fwdapi.StatisticsEndpoint:
+			time.Sleep(200 * time.Millisecond)
+		}
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		want Error
+	}{
+		{
+			"json error",
+			func() error {
+				_, err := client.GenerateKubeConfig(ctx, fwdapi.KubeConfigRequest{})
+				return err
+			},
+			Error{StatusCode: 400, Message: "Unable to process request: agent name is required", RequestID: "req1"},
+		},
+		{
+			"field errors",
+			func() error {
+				_, err := client.GenerateServiceCredentials(ctx, fwdapi.ServiceCredentialRequest{})
+				return err
+			},
+			Error{
+				StatusCode: 400,
+				Message:    "Unable to process request: 'name' is required; 'validityDays' must not be negative",
+				Fields:     map[string]string{"name": "is required", "validityDays": "must not be negative"},
+			},
+		},
+		{
+			"text error",
+			func() error {
+				_, err := client.GenerateAgentManifest(ctx, fwdapi.ManifestRequest{})
+				return err
+			},
+			Error{StatusCode: 403, Message: "not allowed"},
+		},
+		{
+			"empty error",
+			func() error {
+				_, err := client.GenerateControlCredentials(ctx, fwdapi.ControlCredentialsRequest{})
+				return err
+			},
+			Error{StatusCode: 500, Message: "Internal Server Error"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			var got *Error
+			if !errors.As(err, &got) {
+				t.Fatalf("expected an *Error, got %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("error = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+	t.Run("context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := client.GetStatistics(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the context deadline to end the call, got %v", err)
+		}
+	})
+}
+
+func TestNew_badCredentials(t *testing.T) {
+	if _, err := New("https://localhost", []byte("junk"), []byte("junk"), nil); err == nil {
+		t.Errorf("expected an error for a bad certificate")
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cncclient_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/cncclient"
+	"github.com/opsmx/oes-birger/pkg/fwdapi"
+)
+
+// This fetches a kubeconfig for the "kubernetes1" endpoint of agent
+// "agent1", and writes it out for kubectl.
+func ExampleClient_GenerateKubeConfigFile() {
+	certPEM, err := ioutil.ReadFile("control-cert.pem")
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyPEM, err := ioutil.ReadFile("control-key.pem")
+	if err != nil {
+		log.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile("ca-cert.pem")
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := cncclient.New("https://forwarder-controller:9003", certPEM, keyPEM, caPEM)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	kubeconfig, err := client.GenerateKubeConfigFile(ctx, fwdapi.KubeConfigRequest{
+		AgentName: "agent1",
+		Name:      "kubernetes1",
+	})
+	var cncErr *cncclient.Error
+	if errors.As(err, &cncErr) {
+		log.Fatalf("controller refused with status %d: %s", cncErr.StatusCode, cncErr.Message)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("kubeconfig.yaml", kubeconfig, 0600); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -27,19 +27,63 @@ const (
 	ServiceEndpoint    = "/api/v1/generateServiceCredentials"
 	StatisticsEndpoint = "/api/v1/getAgentStatistics"
 	ControlEndpoint    = "/api/v1/generateControlCredentials"
+	AgentsEndpoint     = "/api/v1/agents"
+	RevokeEndpoint     = "/api/v1/revokeCertificate"
+	RenewEndpoint      = "/api/v1/renewServerCertificate"
+	DisconnectEndpoint = "/api/v1/disconnectAgent"
+	LimitsEndpoint     = "/api/v1/limits"
+
+	RevokeServiceTokenEndpoint = "/api/v1/revokeServiceToken"
+
+	// AgentProxyPrefix is followed by <agent>/<type>/<name>/<path>, and
+	// forwards the request to that endpoint if the controller allows it.
+	AgentProxyPrefix = "/agents/"
 )
 
+// Formats which may be requested from the KubeconfigEndpoint
+const (
+	KubeConfigFormatJSON       = "json"
+	KubeConfigFormatKubeconfig = "kubeconfig"
+)
+
+// How the user of a kubeconfig from the KubeconfigEndpoint authenticates.
+const (
+	// KubeConfigCredentialModeCertificate embeds a new client certificate.
+	KubeConfigCredentialModeCertificate = "certificate"
+
+	// KubeConfigCredentialModeExec runs KubeConfigCredentialPlugin, which
+	// uses a control certificate to fetch short-lived service tokens.
+	KubeConfigCredentialModeExec = "exec"
+)
+
+// KubeConfigCredentialPlugin is the command a kubeconfig using
+// KubeConfigCredentialModeExec runs to obtain a token.
+const KubeConfigCredentialPlugin = "kubectl-birger-credential"
+
 //
 // KubeConfigRequest defines the request for the KubeconfigEndpoint
 //
+// If Format is KubeConfigFormatKubeconfig, a complete kubeconfig file is
+// returned rather than a KubeConfigResponse.  ValidityDays overrides the
+// controller's default certificate lifetime, up to its configured maximum.
+// If CredentialMode is KubeConfigCredentialModeExec, no certificate is
+// issued, so KeyType and ValidityDays may not be set.
+//
 type KubeConfigRequest struct {
-	AgentName string `json:"agentName,omitempty"`
-	Name      string `json:"name,omitempty"`
+	AgentName      string `json:"agentName,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Format         string `json:"format,omitempty"`
+	KeyType        string `json:"keyType,omitempty"`
+	ValidityDays   int    `json:"validityDays,omitempty"`
+	CredentialMode string `json:"credentialMode,omitempty"`
 }
 
 //
 // KubeConfigResponse defines the response for the KubeconfigEndpoint
 //
+// With KubeConfigCredentialModeExec, UserCertificate and UserKey are
+// empty, and ControlURL is where the plugin fetches tokens.
+//
 type KubeConfigResponse struct {
 	AgentName       string `json:"agentName,omitempty"`
 	Name            string `json:"name,omitempty"`
@@ -47,13 +91,37 @@ type KubeConfigResponse struct {
 	UserCertificate string `json:"userCertificate,omitempty"`
 	UserKey         string `json:"userKey,omitempty"`
 	CACert          string `json:"caCert,omitempty"`
+	CredentialMode  string `json:"credentialMode,omitempty"`
+	ControlURL      string `json:"controlUrl,omitempty"`
 }
 
+// Formats which may be requested from the ManifestEndpoint
+const (
+	ManifestFormatJSON       = "json"
+	ManifestFormatYAML       = "yaml"
+	ManifestFormatHelmValues = "helm-values"
+	ManifestFormatKustomize  = "kustomize"
+)
+
 //
 // ManifestRequest defines the request for the ManifestEndpoint
 //
+// If Format is ManifestFormatYAML, a complete Kubernetes manifest is returned
+// rather than a ManifestResponse.  Image and Namespace override the
+// controller's defaults for that manifest.  ManifestFormatHelmValues returns
+// a values.yaml snippet for the agent's Helm chart, and
+// ManifestFormatKustomize a secretGenerator for a kustomization, in the
+// Namespace given or the controller's default.  KeyType and ValidityDays
+// override the controller's default agent key type and certificate
+// lifetime, up to its configured maximum.
+//
 type ManifestRequest struct {
-	AgentName string `json:"agentName,omitempty"`
+	AgentName    string `json:"agentName,omitempty"`
+	Format       string `json:"format,omitempty"`
+	Image        string `json:"image,omitempty"`
+	Namespace    string `json:"namespace,omitempty"`
+	KeyType      string `json:"keyType,omitempty"`
+	ValidityDays int    `json:"validityDays,omitempty"`
 }
 
 //
@@ -68,22 +136,142 @@ type ManifestResponse struct {
 	CACert           string `json:"caCert,omitempty"`
 }
 
+// StatisticsAPIVersion is the APIVersion of the StatisticsResponse
+// described here.  A controller configured for the older, untyped
+// response sends none.
+const StatisticsAPIVersion = "statistics/v2"
+
 //
-// StatisticsResponse defines the response for the StatisticsEndpoint
+// StatisticsResponse defines the response for the StatisticsEndpoint.
+// ConnectedAgents is sorted by agent name.
 //
 type StatisticsResponse struct {
-	ServerTime      uint64      `json:"serverTime,omitempty"`
-	Version         string      `json:"version,omitempty"`
-	ConnectedAgents interface{} `json:"connectedAgents,omitempty"`
+	APIVersion      string            `json:"apiVersion"`
+	ServerTime      uint64            `json:"serverTime,omitempty"`
+	Version         string            `json:"version,omitempty"`
+	ConnectedAgents []AgentStatistics `json:"connectedAgents"`
 }
 
+//
+// AgentStatistics describes an agent and each of its sessions, sorted by
+// session.
+//
+type AgentStatistics struct {
+	Name     string              `json:"name"`
+	Sessions []SessionStatistics `json:"sessions"`
+}
+
+// The ConnectionTypes of a SessionStatistics.
+const (
+	ConnectionTypeDirect = "direct"
+	ConnectionTypePeer   = "peer"
+)
+
+//
+// SessionStatistics describes one session of an agent.  Sessions connected
+// to a peer controller name it in Peer, and have no ping or traffic
+// counts.  InFlight is the number of requests sent to the session which
+// have not completed.  Times are in milliseconds since the Unix epoch.
+//
+type SessionStatistics struct {
+	Session        string             `json:"session"`
+	ConnectionType string             `json:"connectionType"`
+	Peer           string             `json:"peer,omitempty"`
+	ConnectedAt    uint64             `json:"connectedAt"`
+	LastPing       uint64             `json:"lastPing,omitempty"`
+	LastUse        uint64             `json:"lastUse,omitempty"`
+	RTTMillis      float64            `json:"rttMillis,omitempty"`
+	Version        string             `json:"version,omitempty"`
+	Commit         string             `json:"commit,omitempty"`
+	BuildDate      string             `json:"buildDate,omitempty"`
+	Hostname       string             `json:"hostname,omitempty"`
+	InFlight       int                `json:"inFlight"`
+	Endpoints      []Endpoint         `json:"endpoints"`
+	Traffic        *TrafficStatistics `json:"traffic,omitempty"`
+}
+
+//
+// TrafficStatistics counts the HTTP data through a session since it
+// connected.  Request bytes are request bodies, and response bytes are
+// the headers and bodies of responses.
+//
+type TrafficStatistics struct {
+	RequestBytes   uint64 `json:"requestBytes"`
+	RequestChunks  uint64 `json:"requestChunks"`
+	ResponseBytes  uint64 `json:"responseBytes"`
+	ResponseChunks uint64 `json:"responseChunks"`
+}
+
+//
+// AgentsResponse defines the response for the AgentsEndpoint
+//
+type AgentsResponse struct {
+	ServerTime uint64      `json:"serverTime,omitempty"`
+	Agents     []AgentInfo `json:"agents"`
+}
+
+//
+// AgentInfo describes a single connected agent session.  RTTMillis is
+// the round-trip time of the controller's most recently answered ping,
+// and is omitted for agents which do not answer pings.
+//
+type AgentInfo struct {
+	Name          string     `json:"name,omitempty"`
+	Session       string     `json:"session,omitempty"`
+	ConnectedAt   uint64     `json:"connectedAt"`
+	LastPing      uint64     `json:"lastPing"`
+	RTTMillis     float64    `json:"rttMillis,omitempty"`
+	RemoteAddress string     `json:"remoteAddress,omitempty"`
+	Version       string     `json:"version,omitempty"`
+	Commit        string     `json:"commit,omitempty"`
+	BuildDate     string     `json:"buildDate,omitempty"`
+	Peer          string     `json:"peer,omitempty"`
+	Endpoints     []Endpoint `json:"endpoints"`
+}
+
+//
+// Endpoint describes a service endpoint advertised by an agent.
+//
+type Endpoint struct {
+	Name       string   `json:"name,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Configured bool     `json:"configured"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	TLSMode    string   `json:"tlsMode,omitempty"`
+}
+
+// AnyAgent, as the agent name of a service credential, lets requests be
+// served by any connected agent with the endpoint, if the controller
+// allows it.
+const AnyAgent = "*"
+
+// Formats which may be requested from the ServiceEndpoint
+const (
+	ServiceCredentialFormatJSON   = "json"
+	ServiceCredentialFormatSecret = "secret"
+)
+
 //
 // ServiceCredentialRequest defines the request for the ServiceEndpoint
 //
+// ExpiresIn is the lifetime of the credential in seconds.  If not set, the
+// controller's default is used.
+//
+// If Format is ServiceCredentialFormatSecret, a Kubernetes Secret manifest
+// holding the credential and CA certificate is returned rather than a
+// ServiceCredentialResponse.  SecretName and Namespace override the
+// controller's defaults for that Secret.
+//
+// AgentName may be AnyAgent if the controller allows it.
+//
 type ServiceCredentialRequest struct {
-	AgentName string `json:"agentName,omitempty"`
-	Type      string `json:"Type,omitempty"`
-	Name      string `json:"Name,omitempty"`
+	AgentName  string `json:"agentName,omitempty"`
+	Type       string `json:"Type,omitempty"`
+	Name       string `json:"Name,omitempty"`
+	ExpiresIn  int64  `json:"expiresIn,omitempty"`
+	Format     string `json:"format,omitempty"`
+	SecretName string `json:"secretName,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
 }
 
 //
@@ -111,13 +299,18 @@ type BasicCredentialResponse struct {
 type AwsCredentialResponse struct {
 	AwsAccessKey       string `json:"awsAccessKey,omitempty"`
 	AwsSecretAccessKey string `json:"awsSecretAccessKey,omitempty"`
+	AwsSessionToken    string `json:"awsSessionToken,omitempty"`
 }
 
 //
 // ControlCredentialsRequest defines the request for the ControlEndpoint
 //
+// ValidityDays overrides the controller's default certificate lifetime,
+// up to its configured maximum.
+//
 type ControlCredentialsRequest struct {
-	Name string `json:"name,omitempty"`
+	Name         string `json:"name,omitempty"`
+	ValidityDays int    `json:"validityDays,omitempty"`
 }
 
 //
@@ -130,3 +323,107 @@ type ControlCredentialsResponse struct {
 	Key         string `json:"userKey,omitempty"`
 	CACert      string `json:"caCert,omitempty"`
 }
+
+//
+// RevokeCertificateRequest defines the request for the RevokeEndpoint
+//
+// Either Serial is set, to revoke a single certificate, or Purpose and the
+// other naming fields are set, to revoke every certificate issued so far
+// with that name.  Serial may be decimal, or hex with a leading "0x".
+//
+type RevokeCertificateRequest struct {
+	Serial    string `json:"serial,omitempty"`
+	AgentName string `json:"agentName,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
+}
+
+//
+// RevokeCertificateResponse defines the response for the RevokeEndpoint
+//
+type RevokeCertificateResponse struct {
+	Serial    string `json:"serial,omitempty"`
+	AgentName string `json:"agentName,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
+}
+
+//
+// DisconnectAgentRequest defines the request for the DisconnectEndpoint
+//
+// Every session of the agent connected to the controller is closed, or
+// only the one with the given Session ID if it is set.  If Revoke is set,
+// the agent's certificates are revoked first, so it cannot reconnect.
+//
+type DisconnectAgentRequest struct {
+	AgentName string `json:"agentName,omitempty"`
+	Session   string `json:"session,omitempty"`
+	Revoke    bool   `json:"revoke,omitempty"`
+}
+
+//
+// DisconnectAgentResponse defines the response for the DisconnectEndpoint
+//
+type DisconnectAgentResponse struct {
+	AgentName      string `json:"agentName,omitempty"`
+	SessionsClosed int    `json:"sessionsClosed"`
+	Revoked        bool   `json:"revoked,omitempty"`
+}
+
+//
+// RevokeServiceTokenRequest defines the request for the
+// RevokeServiceTokenEndpoint
+//
+// Either ID is set to the token's jti claim, or Token is set to the whole
+// token, whose ID is used.  A token issued before tokens carried an ID
+// cannot be revoked this way.
+//
+type RevokeServiceTokenRequest struct {
+	ID    string `json:"jti,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+//
+// RevokeServiceTokenResponse defines the response for the
+// RevokeServiceTokenEndpoint.  ExpiresAt is when the token expires, in
+// milliseconds since the epoch, if it was given as a whole token which
+// expires.
+//
+type RevokeServiceTokenResponse struct {
+	ID        string `json:"jti"`
+	ExpiresAt uint64 `json:"expiresAt,omitempty"`
+}
+
+//
+// RenewServerCertificateResponse defines the response for the RenewEndpoint,
+// describing the server certificate now in use.  NotAfter is in
+// milliseconds since the epoch, as ServerTime is.
+//
+type RenewServerCertificateResponse struct {
+	Serial   string `json:"serial,omitempty"`
+	NotAfter uint64 `json:"notAfter,omitempty"`
+}
+
+//
+// LimitsRequest defines the request for the LimitsEndpoint
+//
+// Each limit given replaces the controller's current one, and those left
+// out are unchanged, so an empty request returns the limits in force.
+// Zero is unlimited.
+//
+type LimitsRequest struct {
+	MaxOutstandingPerSession *int `json:"maxOutstandingPerSession,omitempty"`
+	MaxOutstanding           *int `json:"maxOutstanding,omitempty"`
+}
+
+//
+// LimitsResponse defines the response for the LimitsEndpoint, with the
+// limits now in force and the transactions outstanding on all agents.
+//
+type LimitsResponse struct {
+	MaxOutstandingPerSession int `json:"maxOutstandingPerSession"`
+	MaxOutstanding           int `json:"maxOutstanding"`
+	Outstanding              int `json:"outstanding"`
+}
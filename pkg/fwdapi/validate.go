@@ -20,8 +20,66 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"sort"
+	"strings"
 )
 
+var kubernetesNameRegexp = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
+
+// controlNameRegexp limits control certificate names to characters which
+// are safe in logs, file names, and allowlist patterns.
+var controlNameRegexp = regexp.MustCompile("^[A-Za-z0-9]([-._A-Za-z0-9]*[A-Za-z0-9])?$")
+
+// tokenIDRegexp limits the IDs of service tokens to those which may be
+// used as keys in a Kubernetes ConfigMap, which ULIDs always are.
+var tokenIDRegexp = regexp.MustCompile("^[-._A-Za-z0-9]{1,253}$")
+
+// MaxControlNameLength is the longest name a control certificate may have.
+const MaxControlNameLength = 64
+
+//
+// ValidationError is returned by Validate when fields of a request are
+// invalid.  Fields maps the JSON name of each field to what is wrong
+// with it.
+//
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) add(field string, format string, args ...interface{}) {
+	if e.Fields == nil {
+		e.Fields = map[string]string{}
+	}
+	e.Fields[field] = fmt.Sprintf(format, args...)
+}
+
+// errorOrNil returns e if any field was found invalid, and nil otherwise.
+func (e *ValidationError) errorOrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := make([]string, len(names))
+	for i, name := range names {
+		problems[i] = fmt.Sprintf("'%s' %s", name, e.Fields[name])
+	}
+	return strings.Join(problems, "; ")
+}
+
+// FieldErrors returns the problem with each invalid field, so they can be
+// listed in the error response.
+func (e *ValidationError) FieldErrors() map[string]string {
+	return e.Fields
+}
+
 // NamePresent ensures the string is not null.
 func namePresent(n string) bool {
 	return n != ""
@@ -38,11 +96,28 @@ func typeValid(n string) bool {
 	return matched
 }
 
+// KubernetesNameValid returns true if the name is a valid DNS label, as
+// required for namespaces and most resource names.
+func KubernetesNameValid(n string) bool {
+	return len(n) <= 63 && kubernetesNameRegexp.MatchString(n)
+}
+
 // Validate ensures that the required fields are set to reasonable values, usually just non-empty strings.
+// When a Secret is requested, any name and namespace given must be usable as Kubernetes names.
+// The agent name may not be AnyAgent; see ValidateAnyAgent.
 func (req *ServiceCredentialRequest) Validate() error {
+	return req.ValidateAnyAgent(false)
+}
+
+// ValidateAnyAgent is Validate, but the agent name may also be AnyAgent if
+// allowAnyAgent is true.
+func (req *ServiceCredentialRequest) ValidateAnyAgent(allowAnyAgent bool) error {
 	if !namePresent(req.AgentName) {
 		return fmt.Errorf("'agentName' is invalid")
 	}
+	if req.AgentName == AnyAgent && !allowAnyAgent {
+		return fmt.Errorf("'agentName' may not be '%s', as this controller does not allow credentials for any agent", AnyAgent)
+	}
 
 	if !namePresent(req.Name) {
 		return fmt.Errorf("'name' is invalid")
@@ -52,6 +127,23 @@ func (req *ServiceCredentialRequest) Validate() error {
 		return fmt.Errorf("'type' is invalid")
 	}
 
+	if req.ExpiresIn < 0 {
+		return fmt.Errorf("'expiresIn' is invalid")
+	}
+
+	switch req.Format {
+	case "", ServiceCredentialFormatJSON:
+	case ServiceCredentialFormatSecret:
+		if req.SecretName != "" && !KubernetesNameValid(req.SecretName) {
+			return fmt.Errorf("'secretName' is invalid")
+		}
+		if req.Namespace != "" && !KubernetesNameValid(req.Namespace) {
+			return fmt.Errorf("'namespace' is invalid")
+		}
+	default:
+		return fmt.Errorf("'format' must be one of '%s' or '%s'", ServiceCredentialFormatJSON, ServiceCredentialFormatSecret)
+	}
+
 	return nil
 }
 
@@ -65,23 +157,136 @@ func (req *KubeConfigRequest) Validate() error {
 		return fmt.Errorf("'name' is invalid")
 	}
 
+	switch req.Format {
+	case "", KubeConfigFormatJSON, KubeConfigFormatKubeconfig:
+	default:
+		return fmt.Errorf("'format' must be one of '%s' or '%s'", KubeConfigFormatJSON, KubeConfigFormatKubeconfig)
+	}
+
+	if req.ValidityDays < 0 {
+		return fmt.Errorf("'validityDays' is invalid")
+	}
+
+	switch req.CredentialMode {
+	case "", KubeConfigCredentialModeCertificate:
+	case KubeConfigCredentialModeExec:
+		if req.KeyType != "" || req.ValidityDays != 0 {
+			return fmt.Errorf("'keyType' and 'validityDays' may not be set with 'credentialMode' '%s'", KubeConfigCredentialModeExec)
+		}
+	default:
+		return fmt.Errorf("'credentialMode' must be one of '%s' or '%s'", KubeConfigCredentialModeCertificate, KubeConfigCredentialModeExec)
+	}
+
 	return nil
 }
 
 // Validate ensures that the required fields are set to reasonable values, usually just non-empty strings.
+// When a YAML manifest is requested, the agent name and namespace must also be usable as
+// Kubernetes resource names.
 func (req *ManifestRequest) Validate() error {
 	if !namePresent(req.AgentName) {
 		return fmt.Errorf("'agentName' is invalid")
 	}
 
+	switch req.Format {
+	case "", ManifestFormatJSON:
+	case ManifestFormatYAML, ManifestFormatHelmValues, ManifestFormatKustomize:
+		if !KubernetesNameValid(req.AgentName) {
+			return fmt.Errorf("'agentName' must be a valid Kubernetes name for %s format", req.Format)
+		}
+		if req.Namespace != "" && !KubernetesNameValid(req.Namespace) {
+			return fmt.Errorf("'namespace' is invalid")
+		}
+	default:
+		return fmt.Errorf("'format' must be one of '%s', '%s', '%s', or '%s'",
+			ManifestFormatJSON, ManifestFormatYAML, ManifestFormatHelmValues, ManifestFormatKustomize)
+	}
+
+	if req.ValidityDays < 0 {
+		return fmt.Errorf("'validityDays' is invalid")
+	}
+
 	return nil
 }
 
-// Validate ensures that the required fields are set to reasonable values, usually just non-empty strings.
+// Validate ensures that the name is usable for a certificate, and returns a
+// *ValidationError listing every invalid field if not.
 func (req *ControlCredentialsRequest) Validate() error {
-	if !namePresent(req.Name) {
-		return fmt.Errorf("'name' is invalid")
+	problems := &ValidationError{}
+
+	switch {
+	case !namePresent(req.Name):
+		problems.add("name", "is required")
+	case len(req.Name) > MaxControlNameLength:
+		problems.add("name", "must be at most %d characters", MaxControlNameLength)
+	case !controlNameRegexp.MatchString(req.Name):
+		problems.add("name", "must contain only letters, digits, '-', '.', and '_', and start and end with a letter or digit")
+	}
+
+	if req.ValidityDays < 0 {
+		problems.add("validityDays", "must not be negative")
+	}
+
+	return problems.errorOrNil()
+}
+
+// Validate ensures that either a serial number or a certificate name is set, but not both.
+func (req *RevokeCertificateRequest) Validate() error {
+	hasName := namePresent(req.AgentName) || namePresent(req.Type) || namePresent(req.Name) || namePresent(req.Purpose)
+
+	if namePresent(req.Serial) {
+		if hasName {
+			return fmt.Errorf("only one of 'serial' or a certificate name may be given")
+		}
+		return nil
+	}
+
+	if !namePresent(req.Purpose) {
+		return fmt.Errorf("'serial' or 'purpose' is required")
 	}
 
 	return nil
 }
+
+// Validate ensures that the agent name is set, and returns a
+// *ValidationError if not.
+func (req *DisconnectAgentRequest) Validate() error {
+	problems := &ValidationError{}
+
+	if !namePresent(req.AgentName) {
+		problems.add("agentName", "is required")
+	}
+
+	return problems.errorOrNil()
+}
+
+// Validate ensures that exactly one of the token's ID or the token itself
+// is given, and that an ID is well formed.
+func (req *RevokeServiceTokenRequest) Validate() error {
+	switch {
+	case namePresent(req.ID) && namePresent(req.Token):
+		return fmt.Errorf("only one of 'jti' or 'token' may be given")
+	case namePresent(req.Token):
+		return nil
+	case !namePresent(req.ID):
+		return fmt.Errorf("'jti' or 'token' is required")
+	case !tokenIDRegexp.MatchString(req.ID):
+		return fmt.Errorf("'jti' is invalid")
+	}
+	return nil
+}
+
+// Validate ensures that no limit is negative, and returns a
+// *ValidationError listing any which are.
+func (req *LimitsRequest) Validate() error {
+	problems := &ValidationError{}
+
+	if req.MaxOutstandingPerSession != nil && *req.MaxOutstandingPerSession < 0 {
+		problems.add("maxOutstandingPerSession", "must not be negative")
+	}
+	if req.MaxOutstanding != nil && *req.MaxOutstanding < 0 {
+		problems.add("maxOutstanding", "must not be negative")
+	}
+
+	return problems.errorOrNil()
+}
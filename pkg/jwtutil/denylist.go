@@ -0,0 +1,58 @@
+/*
+ * Copyright 2021 OpsMx.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DenyList holds the IDs of revoked tokens, each with the time the token
+// expires, after which it need not be denied.  A zero time is a token
+// which never expires.  The IDs may be replaced while in use; each lookup
+// sees either the old set or the new one.
+type DenyList struct {
+	ids atomic.Value // map[string]time.Time
+}
+
+// NewDenyList returns an empty deny list.
+func NewDenyList() *DenyList {
+	d := &DenyList{}
+	d.ids.Store(map[string]time.Time{})
+	return d
+}
+
+// Load replaces the denied IDs with those in ids.  ids must not be
+// modified afterwards.
+func (d *DenyList) Load(ids map[string]time.Time) {
+	d.ids.Store(ids)
+}
+
+// Contains returns true if id has been revoked.  An empty ID, from a token
+// issued before tokens carried one, is never denied.
+func (d *DenyList) Contains(id string) bool {
+	if id == "" {
+		return false
+	}
+	_, found := d.ids.Load().(map[string]time.Time)[id]
+	return found
+}
+
+// Len returns the number of denied IDs.
+func (d *DenyList) Len() int {
+	return len(d.ids.Load().(map[string]time.Time))
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2021 OpsMx.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDenyList(t *testing.T) {
+	d := NewDenyList()
+	if d.Contains("a") || d.Len() != 0 {
+		t.Fatalf("new deny list is not empty")
+	}
+	d.Load(map[string]time.Time{"a": {}, "b": testTime})
+	if !d.Contains("a") || !d.Contains("b") || d.Contains("c") {
+		t.Errorf("Contains() does not match the loaded IDs")
+	}
+	if d.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", d.Len())
+	}
+	d.Load(map[string]time.Time{"": {}})
+	if d.Contains("") {
+		t.Errorf("an empty ID should never be denied")
+	}
+	if d.Contains("a") {
+		t.Errorf("Load() should replace the IDs")
+	}
+}
@@ -20,28 +20,127 @@
 package jwtutil
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/lestrrat-go/jwx/jwt"
+
+	"github.com/opsmx/oes-birger/pkg/ulid"
 )
 
 const (
 	jwtEndpointTypeKey = "t"
 	jwtEndpointNameKey = "n"
 	jwtAgentKey        = "a"
+
+	// allowed clock difference when checking exp and nbf
+	clockSkew = time.Minute
+)
+
+var (
+	// ErrTokenExpired is returned by ValidateJWT when the token's exp claim has passed.
+	ErrTokenExpired = errors.New("token has expired")
+
+	// ErrNoExpiration is returned by ValidateJWT when an exp claim is
+	// required, but the token does not have one.
+	ErrNoExpiration = errors.New("token has no expiration")
+
+	// ErrLegacyToken is returned by ValidateJWT when the token has no
+	// audience claim, and legacy tokens are not accepted.
+	ErrLegacyToken = errors.New("token has no issuer and audience, and legacy tokens are not accepted")
+
+	// ErrTokenRevoked is returned by ValidateJWT when the token's ID is in
+	// the deny list.
+	ErrTokenRevoked = errors.New("token has been revoked")
+
+	// for testing
+	timeNow    = time.Now
+	newTokenID = ulid.NewContext().Ulid
 )
 
-// MakeJWT will return a token with provided type, name, and agent name embedded in the claims.
-func MakeJWT(key jwk.Key, epType string, epName string, agent string) (string, error) {
+// Identity is the issuer of a token, naming the controller which made it,
+// and the audience, naming the deployment it may be used with.
+type Identity struct {
+	Issuer   string
+	Audience string
+}
+
+// Validation is what ValidateJWT requires of a token.  Legacy tokens, made
+// before tokens carried an audience, are only accepted if AcceptLegacy is
+// set, and their issuer is not checked.  If Denied is set, tokens whose ID
+// it holds are rejected.
+type Validation struct {
+	Identity
+	RequireExpiration bool
+	AcceptLegacy      bool
+	Denied            *DenyList
+}
+
+// Claims are the claims of a validated token.
+type Claims struct {
+	EndpointType string
+	EndpointName string
+	Agent        string
+	// ID is the token's jti, which is empty for tokens issued before
+	// tokens carried one.
+	ID string
+	// Legacy is set if the token has no audience.
+	Legacy bool
+}
+
+// subject returns the sub claim for a token, in the same name.agent form
+// as an AWS access key.
+func subject(epName string, agent string) string {
+	return epName + "." + agent
+}
+
+// MakeJWT will return a token with provided type, name, and agent name embedded in the claims,
+// issued by id.Issuer for id.Audience.  The token is valid from now, and if ttl is non-zero,
+// expires after ttl.  Each token has a unique ID, by which it may be revoked.
+func MakeJWT(key jwk.Key, id Identity, epType string, epName string, agent string, ttl time.Duration) (string, error) {
 	t := jwt.New()
 
-	err := t.Set(jwt.IssuerKey, "opsmx")
+	err := t.Set(jwt.JwtIDKey, newTokenID())
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Set(jwt.IssuerKey, id.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Set(jwt.AudienceKey, id.Audience)
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Set(jwt.SubjectKey, subject(epName, agent))
 	if err != nil {
 		return "", err
 	}
 
+	now := timeNow()
+	err = t.Set(jwt.IssuedAtKey, now)
+	if err != nil {
+		return "", err
+	}
+
+	err = t.Set(jwt.NotBeforeKey, now)
+	if err != nil {
+		return "", err
+	}
+
+	if ttl > 0 {
+		err = t.Set(jwt.ExpirationKey, now.Add(ttl))
+		if err != nil {
+			return "", err
+		}
+	}
+
 	err = t.Set(jwtEndpointTypeKey, epType)
 	if err != nil {
 		return "", err
@@ -71,24 +170,83 @@ func getField(token jwt.Token, name string) (string, error) {
 	return "", fmt.Errorf("missing %s", name)
 }
 
-// ValidateJWT will validate and return the enbedded claims.
-func ValidateJWT(keyset jwk.Set, tokenString string) (epType string, epName string, agent string, err error) {
+// ValidateJWT will validate and return the enbedded claims.  Revoked tokens
+// return ErrTokenRevoked, and expired tokens return ErrTokenExpired.  Tokens without an exp claim are accepted unless
+// v.RequireExpiration is set, in which case ErrNoExpiration is returned.
+// The token's issuer and audience must match v, unless it is a legacy
+// token, which returns ErrLegacyToken unless v.AcceptLegacy is set.
+func ValidateJWT(keyset jwk.Set, tokenString string, v Validation) (*Claims, error) {
 	token, err := jwt.Parse(
 		[]byte(tokenString),
-		jwt.WithValidate(true),
 		jwt.WithKeySet(keyset),
 	)
 	if err != nil {
-		return
+		return nil, err
+	}
+	if v.Denied != nil && v.Denied.Contains(token.JwtID()) {
+		return nil, ErrTokenRevoked
+	}
+	now := timeNow()
+	if exp := token.Expiration(); !exp.IsZero() {
+		if now.After(exp.Add(clockSkew)) {
+			return nil, ErrTokenExpired
+		}
+	} else if v.RequireExpiration {
+		return nil, ErrNoExpiration
+	}
+	if nbf := token.NotBefore(); !nbf.IsZero() && now.Add(clockSkew).Before(nbf) {
+		return nil, fmt.Errorf("token is not yet valid")
+	}
+	claims := &Claims{ID: token.JwtID(), Legacy: len(token.Audience()) == 0}
+	if claims.Legacy && !v.AcceptLegacy {
+		return nil, ErrLegacyToken
 	}
-	if epType, err = getField(token, jwtEndpointTypeKey); err != nil {
-		return "", "", "", err
+	if !claims.Legacy {
+		if token.Issuer() != v.Issuer {
+			return nil, fmt.Errorf("token issuer '%s' is not '%s'", token.Issuer(), v.Issuer)
+		}
+		if !contains(token.Audience(), v.Audience) {
+			return nil, fmt.Errorf("token audience %v does not include '%s'", token.Audience(), v.Audience)
+		}
 	}
-	if epName, err = getField(token, jwtEndpointNameKey); err != nil {
-		return "", "", "", err
+	if claims.EndpointType, err = getField(token, jwtEndpointTypeKey); err != nil {
+		return nil, err
 	}
-	if agent, err = getField(token, jwtAgentKey); err != nil {
-		return "", "", "", err
+	if claims.EndpointName, err = getField(token, jwtEndpointNameKey); err != nil {
+		return nil, err
+	}
+	if claims.Agent, err = getField(token, jwtAgentKey); err != nil {
+		return nil, err
+	}
+	if sub := token.Subject(); sub != "" && sub != subject(claims.EndpointName, claims.Agent) {
+		return nil, fmt.Errorf("token subject '%s' does not match its endpoint and agent", sub)
+	}
+	return claims, nil
+}
+
+// ParseTokenID returns the ID and expiry of a token signed by a key in
+// keyset, so it can be revoked.  The token need not be valid otherwise, as
+// one which has expired, or is not yet valid, may still be revoked.  The
+// expiry is zero if the token has none.
+func ParseTokenID(keyset jwk.Set, tokenString string) (string, time.Time, error) {
+	token, err := jwt.Parse(
+		[]byte(tokenString),
+		jwt.WithKeySet(keyset),
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if token.JwtID() == "" {
+		return "", time.Time{}, fmt.Errorf("token has no ID, and can only be revoked by removing the key it was signed with")
+	}
+	return token.JwtID(), token.Expiration(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
-	return
+	return false
 }
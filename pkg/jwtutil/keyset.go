@@ -0,0 +1,105 @@
+/*
+ * Copyright 2021 OpsMx.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// Keyset holds the keys used to sign and validate service tokens, one of
+// which is the current key new tokens are signed with.  The keys may be
+// replaced while in use; each reader sees either the old set or the new
+// one, never a mix.
+type Keyset struct {
+	currentKey string
+	keys       atomic.Value // snapshot
+}
+
+type snapshot struct {
+	set   jwk.Set
+	names []string
+}
+
+// NewKeyset returns an empty keyset which signs with the key named
+// currentKey, once it has been loaded.
+func NewKeyset(currentKey string) *Keyset {
+	k := &Keyset{currentKey: currentKey}
+	k.keys.Store(snapshot{set: jwk.NewSet()})
+	return k
+}
+
+// Load replaces every key with those in raw, which holds each key's
+// secret by its key ID.  If the current key is not among them, the keys
+// are left as they were, and an error is returned, as tokens could no
+// longer be issued.
+func (k *Keyset) Load(raw map[string][]byte) error {
+	if _, found := raw[k.currentKey]; !found {
+		return fmt.Errorf("current key %q not found, keeping the %d keys already loaded", k.currentKey, k.Set().Len())
+	}
+	set := jwk.NewSet()
+	names := make([]string, 0, len(raw))
+	for name, secret := range raw {
+		key, err := makeKey(name, secret)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", name, err)
+		}
+		set.Add(key)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	k.keys.Store(snapshot{set: set, names: names})
+	return nil
+}
+
+func makeKey(name string, secret []byte) (jwk.Key, error) {
+	key, err := jwk.New(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.Set(jwk.KeyIDKey, name); err != nil {
+		return nil, err
+	}
+	if err := key.Set(jwk.AlgorithmKey, jwa.HS256); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Set returns the keys tokens are validated against.  The set must not be
+// modified.
+func (k *Keyset) Set() jwk.Set {
+	return k.keys.Load().(snapshot).set
+}
+
+// Names returns the key IDs, sorted.
+func (k *Keyset) Names() []string {
+	return k.keys.Load().(snapshot).names
+}
+
+// CurrentKey returns the key new tokens are signed with.
+func (k *Keyset) CurrentKey() (jwk.Key, error) {
+	key, found := k.Set().LookupKeyID(k.currentKey)
+	if !found {
+		return nil, fmt.Errorf("unable to find service key '%s'", k.currentKey)
+	}
+	return key, nil
+}
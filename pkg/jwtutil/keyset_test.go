@@ -0,0 +1,79 @@
+/*
+ * Copyright 2021 OpsMx.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jwtutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeyset_Load(t *testing.T) {
+	k := NewKeyset("key2")
+	if _, err := k.CurrentKey(); err == nil {
+		t.Errorf("expected an error before any keys are loaded")
+	}
+
+	if err := k.Load(map[string][]byte{"key1": []byte("key 1"), "key2": []byte("key 2")}); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if got := k.Names(); !reflect.DeepEqual(got, []string{"key1", "key2"}) {
+		t.Errorf("Names() = %v", got)
+	}
+	key, err := k.CurrentKey()
+	if err != nil {
+		t.Fatalf("CurrentKey() = %v", err)
+	}
+	token, err := MakeJWT(key, Identity{Issuer: "i", Audience: "a"}, "jenkins", "ep1", "agent1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateJWT(k.Set(), token, Validation{Identity: Identity{Issuer: "i", Audience: "a"}}); err != nil {
+		t.Errorf("ValidateJWT() = %v", err)
+	}
+
+	// Removing a key which is not current is fine, and tokens it signed
+	// are no longer valid.
+	if err := k.Load(map[string][]byte{"key2": []byte("key 2 rotated")}); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if got := k.Names(); !reflect.DeepEqual(got, []string{"key2"}) {
+		t.Errorf("Names() = %v", got)
+	}
+	if _, err := ValidateJWT(k.Set(), token, Validation{Identity: Identity{Issuer: "i", Audience: "a"}}); err == nil {
+		t.Errorf("expected a token signed with the old key to be rejected")
+	}
+}
+
+func TestKeyset_LoadWithoutCurrentKey(t *testing.T) {
+	k := NewKeyset("key1")
+	if err := k.Load(map[string][]byte{"key1": []byte("key 1")}); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	before := k.Set()
+
+	err := k.Load(map[string][]byte{"key2": []byte("key 2")})
+	if err == nil || !strings.Contains(err.Error(), `current key "key1" not found`) {
+		t.Errorf("Load() = %v, expected the current key to be missing", err)
+	}
+	if k.Set() != before {
+		t.Errorf("keys were replaced by a rejected load")
+	}
+	if _, err := k.CurrentKey(); err != nil {
+		t.Errorf("CurrentKey() = %v after a rejected load", err)
+	}
+}
@@ -71,10 +71,36 @@ type User struct {
 	User UserDetails `yaml:"user" json:"user"`
 }
 
-// UserDetails holds the user's certificate information.
+// UserDetails holds the user's credentials: a client certificate, a
+// static bearer token, a username and password, or an exec plugin which
+// provides a token.
 type UserDetails struct {
-	ClientCertificateData string `yaml:"client-certificate-data" json:"client-certificate-data"`
-	ClientKeyData         string `yaml:"client-key-data" json:"client-key-data"`
+	ClientCertificateData string      `yaml:"client-certificate-data,omitempty" json:"client-certificate-data,omitempty"`
+	ClientKeyData         string      `yaml:"client-key-data,omitempty" json:"client-key-data,omitempty"`
+	Token                 string      `yaml:"token,omitempty" json:"token,omitempty"`
+	Username              string      `yaml:"username,omitempty" json:"username,omitempty"`
+	Password              string      `yaml:"password,omitempty" json:"password,omitempty"`
+	Exec                  *ExecConfig `yaml:"exec,omitempty" json:"exec,omitempty"`
+}
+
+// ExecConfig describes a credential plugin, such as `aws eks get-token`,
+// which is run to obtain a token.
+type ExecConfig struct {
+	APIVersion string       `yaml:"apiVersion" json:"apiVersion"`
+	Command    string       `yaml:"command" json:"command"`
+	Args       []string     `yaml:"args,omitempty" json:"args,omitempty"`
+	Env        []ExecEnvVar `yaml:"env,omitempty" json:"env,omitempty"`
+}
+
+// ExecEnvVar is an environment variable set when running an exec plugin.
+type ExecEnvVar struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+}
+
+// HasClientCertificate returns true if the user has a client certificate.
+func (u *UserDetails) HasClientCertificate() bool {
+	return u.ClientCertificateData != "" || u.ClientKeyData != ""
 }
 
 // ReadKubeConfig will read in the YAML config located in $HOME/.kube/config
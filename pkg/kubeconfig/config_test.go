@@ -216,3 +216,81 @@ clusters:
 		t.Errorf("Found cluster named '%s' but expected 'clusterOne'", cluster.Name)
 	}
 }
+
+func TestUserCredentials(t *testing.T) {
+	contents := `
+apiVersion: v1
+kind: Config
+users:
+- name: cert
+  user:
+    client-certificate-data: Y2VydA==
+    client-key-data: a2V5
+- name: token
+  user:
+    token: abc123
+- name: basic
+  user:
+    username: admin
+    password: s3cret
+- name: eks
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: aws
+      args:
+      - eks
+      - get-token
+      - --cluster-name
+      - prod
+      env:
+      - name: AWS_PROFILE
+        value: prod
+`
+	kc, err := ReadKubeConfig(strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("Got an unexpected error: %v", err)
+	}
+
+	cert, err := kc.findUser("cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.User.HasClientCertificate() {
+		t.Error("Expected user 'cert' to have a client certificate")
+	}
+
+	token, err := kc.findUser("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.User.Token != "abc123" || token.User.HasClientCertificate() {
+		t.Errorf("Unexpected user 'token': %#v", token.User)
+	}
+
+	basic, err := kc.findUser("basic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if basic.User.Username != "admin" || basic.User.Password != "s3cret" {
+		t.Errorf("Unexpected user 'basic': %#v", basic.User)
+	}
+
+	eks, err := kc.findUser("eks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := eks.User.Exec
+	if exec == nil {
+		t.Fatal("Expected user 'eks' to have an exec stanza")
+	}
+	if exec.APIVersion != "client.authentication.k8s.io/v1beta1" || exec.Command != "aws" {
+		t.Errorf("Unexpected exec stanza: %#v", exec)
+	}
+	if strings.Join(exec.Args, " ") != "eks get-token --cluster-name prod" {
+		t.Errorf("Unexpected exec args: %v", exec.Args)
+	}
+	if len(exec.Env) != 1 || exec.Env[0] != (ExecEnvVar{Name: "AWS_PROFILE", Value: "prod"}) {
+		t.Errorf("Unexpected exec env: %v", exec.Env)
+	}
+}
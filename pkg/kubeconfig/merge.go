@@ -0,0 +1,96 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubeconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SplitPaths splits a list of kubeconfig files, such as the value of the
+// KUBECONFIG environment variable, dropping empty entries.
+func SplitPaths(list string) []string {
+	paths := []string{}
+	for _, path := range filepath.SplitList(list) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// ReadKubeConfigFiles reads and merges the kubeconfig files at paths, as
+// kubectl does with KUBECONFIG.  Files which do not exist are skipped, but
+// if none exist an error satisfying os.IsNotExist is returned.
+func ReadKubeConfigFiles(paths []string) (*KubeConfig, error) {
+	configs := []*KubeConfig{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kc, err := ReadKubeConfig(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		configs = append(configs, kc)
+	}
+	if len(configs) == 0 {
+		return nil, &os.PathError{Op: "open", Path: strings.Join(paths, string(filepath.ListSeparator)), Err: os.ErrNotExist}
+	}
+	return Merge(configs...), nil
+}
+
+// Merge combines kubeconfigs following kubectl's rules: the first cluster,
+// context, or user with each name is used and later ones are ignored, and
+// the current context is the first one set.
+func Merge(configs ...*KubeConfig) *KubeConfig {
+	ret := &KubeConfig{APIVersion: "v1", Kind: "Config"}
+	clusters := map[string]bool{}
+	contexts := map[string]bool{}
+	users := map[string]bool{}
+	for _, kc := range configs {
+		if ret.CurrentContext == "" {
+			ret.CurrentContext = kc.CurrentContext
+		}
+		for _, c := range kc.Clusters {
+			if !clusters[c.Name] {
+				clusters[c.Name] = true
+				ret.Clusters = append(ret.Clusters, c)
+			}
+		}
+		for _, c := range kc.Contexts {
+			if !contexts[c.Name] {
+				contexts[c.Name] = true
+				ret.Contexts = append(ret.Contexts, c)
+			}
+		}
+		for _, u := range kc.Users {
+			if !users[u.Name] {
+				users[u.Name] = true
+				ret.Users = append(ret.Users, u)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubeconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitPaths(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", []string{}},
+		{"/a", []string{"/a"}},
+		{"/a:/b", []string{"/a", "/b"}},
+		{"/a::/b:", []string{"/a", "/b"}},
+	}
+	for _, tt := range tests {
+		if got := SplitPaths(tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitPaths(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+const teamA = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: shared
+  cluster:
+    server: https://a.example.com
+contexts:
+- name: team-a
+  context: {cluster: shared, user: a}
+- name: shared
+  context: {cluster: shared, user: a}
+users:
+- name: a
+  user:
+    token: token-a
+`
+
+const teamB = `
+apiVersion: v1
+kind: Config
+current-context: team-b
+clusters:
+- name: shared
+  cluster:
+    server: https://b.example.com
+- name: b
+  cluster:
+    server: https://b-only.example.com
+contexts:
+- name: team-b
+  context: {cluster: b, user: b}
+- name: shared
+  context: {cluster: b, user: b}
+users:
+- name: b
+  user:
+    token: token-b
+`
+
+const teamC = `
+apiVersion: v1
+kind: Config
+current-context: team-c
+`
+
+func writeKubeConfigs(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadKubeConfigFiles_merge(t *testing.T) {
+	dir := writeKubeConfigs(t, map[string]string{"a": teamA, "b": teamB, "c": teamC})
+	paths := []string{filepath.Join(dir, "a"), filepath.Join(dir, "missing"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+	kc, err := ReadKubeConfigFiles(paths)
+	if err != nil {
+		t.Fatalf("ReadKubeConfigFiles() error = %v", err)
+	}
+
+	// a sets no current context, so the first one set, by b, is used.
+	if kc.CurrentContext != "team-b" {
+		t.Errorf("expected current context team-b, got %s", kc.CurrentContext)
+	}
+	if got, want := kc.GetContextNames(), []string{"team-a", "shared", "team-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetContextNames() = %v, want %v", got, want)
+	}
+
+	// The first definition of a name wins.
+	user, cluster, err := kc.FindContext("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "a" || cluster.Cluster.Server != "https://a.example.com" {
+		t.Errorf("expected shared to come from a, got user %s, server %s", user.Name, cluster.Cluster.Server)
+	}
+	user, cluster, err = kc.FindContext("team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.User.Token != "token-b" || cluster.Cluster.Server != "https://b-only.example.com" {
+		t.Errorf("unexpected team-b: user %#v, server %s", user.User, cluster.Cluster.Server)
+	}
+}
+
+func TestReadKubeConfigFiles_errors(t *testing.T) {
+	dir := writeKubeConfigs(t, map[string]string{"a": teamA, "bad": "apiVersion: v2\nkind: Config\n"})
+
+	_, err := ReadKubeConfigFiles([]string{filepath.Join(dir, "missing1"), filepath.Join(dir, "missing2")})
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error when no files exist, got %v", err)
+	}
+
+	_, err = ReadKubeConfigFiles([]string{filepath.Join(dir, "a"), filepath.Join(dir, "bad")})
+	if err == nil || os.IsNotExist(err) || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("expected an error naming the invalid file, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secrets
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/util/retry"
+)
+
+// GetConfigMap returns the data of a ConfigMap in the loader's namespace.
+func (s *KubernetesSecretLoader) GetConfigMap(name string) (map[string]string, error) {
+	cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// WatchConfigMap watches the named ConfigMap, reporting each time it is
+// created, changed, or deleted, until ctx is done or the watch is stopped.
+func (s *KubernetesSecretLoader) WatchConfigMap(ctx context.Context, name string) (watch.Interface, error) {
+	return s.clientset.CoreV1().ConfigMaps(s.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	})
+}
+
+// UpdateConfigMap changes the data of the named ConfigMap with update,
+// creating the ConfigMap if it does not exist.  If another writer changes
+// it first, it is read again and update is called again, so update must
+// only depend on the data it is given.
+func (s *KubernetesSecretLoader) UpdateConfigMap(ctx context.Context, name string, update func(data map[string]string) error) error {
+	client := s.clientset.CoreV1().ConfigMaps(s.namespace)
+	return retry.OnError(retry.DefaultRetry, isConflict, func() error {
+		cm, err := client.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: s.namespace,
+				},
+			}
+			if err := applyUpdate(cm, update); err != nil {
+				return err
+			}
+			_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if err := applyUpdate(cm, update); err != nil {
+			return err
+		}
+		_, err = client.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func applyUpdate(cm *v1.ConfigMap, update func(data map[string]string) error) error {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	return update(cm.Data)
+}
+
+// isConflict returns true if err means another writer changed or created
+// the object first.
+func isConflict(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+}
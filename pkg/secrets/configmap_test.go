@@ -0,0 +1,70 @@
+package secrets
+
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestKubernetesSecretLoader_UpdateConfigMap(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	loader := MakeKubernetesSecretLoaderFromClientset("ns1", client)
+
+	add := func(key string) func(map[string]string) error {
+		return func(data map[string]string) error {
+			data[key] = "value"
+			return nil
+		}
+	}
+
+	// A missing ConfigMap is created.
+	if err := loader.UpdateConfigMap(context.Background(), "cm1", add("a")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// An update which conflicts with another writer is tried again.
+	conflicts := 1
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			return false, nil, nil
+		}
+		conflicts--
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "cm1", nil)
+	})
+	if err := loader.UpdateConfigMap(context.Background(), "cm1", add("b")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	actual, err := loader.GetConfigMap("cm1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if diff := cmp.Diff(actual, map[string]string{"a": "value", "b": "value"}); diff != "" {
+		t.Errorf("ConfigMap differs (-got, +want): %s", diff)
+	}
+	if _, err := loader.GetConfigMap("missing"); !IsNotFound(err) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+}
@@ -23,7 +23,11 @@ package secrets
 import (
 	"context"
 
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -86,3 +90,31 @@ func (s *KubernetesSecretLoader) GetSecret(name string) (*map[string][]byte, err
 	}
 	return &secret.Data, nil
 }
+
+// WatchSecret watches the named secret, reporting each time it is
+// created, changed, or deleted, until ctx is done or the watch is stopped.
+func (s *KubernetesSecretLoader) WatchSecret(ctx context.Context, name string) (watch.Interface, error) {
+	return s.clientset.CoreV1().Secrets(s.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	})
+}
+
+// CreateSecret will create a new secret of the given type in Kubernetes.
+// It fails if the secret already exists.
+func (s *KubernetesSecretLoader) CreateSecret(name string, secretType string, data map[string][]byte) error {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: s.namespace,
+		},
+		Type: v1.SecretType(secretType),
+		Data: data,
+	}
+	_, err := s.clientset.CoreV1().Secrets(s.namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	return err
+}
+
+// IsNotFound returns true if err indicates the secret does not exist.
+func IsNotFound(err error) bool {
+	return apierrors.IsNotFound(err)
+}
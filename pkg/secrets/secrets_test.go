@@ -93,3 +93,26 @@ func TestKubernetesSecretLoader_GetSecret(t *testing.T) {
 		})
 	}
 }
+
+func TestKubernetesSecretLoader_CreateSecret(t *testing.T) {
+	client := fake.NewSimpleClientset(secret("secret1"))
+	loader := MakeKubernetesSecretLoaderFromClientset("ns1", client)
+
+	if err := loader.CreateSecret("secret2", "Opaque", secret1Map); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	actual, err := loader.GetSecret("secret2")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if diff := cmp.Diff(actual, &secret1Map); diff != "" {
+		t.Errorf("secret differs (-got, +want): %s", diff)
+	}
+
+	if err := loader.CreateSecret("secret1", "Opaque", secret1Map); err == nil {
+		t.Errorf("Expected an error creating an existing secret, did not get one")
+	}
+	if _, err := loader.GetSecret("missing"); !IsNotFound(err) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+}
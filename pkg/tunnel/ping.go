@@ -0,0 +1,48 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"time"
+)
+
+// MakePingResponse answers req, which arrived at received.
+func MakePingResponse(req *PingRequest, received time.Time) *PingResponse {
+	return &PingResponse{
+		Ts:         uint64(time.Now().UnixNano()),
+		EchoedTs:   req.Ts,
+		ReceivedTs: uint64(received.UnixNano()),
+	}
+}
+
+// RoundTripTime returns how long a ping we sent took to be answered by
+// resp, which arrived at now.  Any time the other end says it took to
+// answer is left out.  False is returned if resp echoes no time, or the
+// result makes no sense.
+func RoundTripTime(resp *PingResponse, now time.Time) (time.Duration, bool) {
+	if resp.EchoedTs == 0 {
+		return 0, false
+	}
+	rtt := now.Sub(time.Unix(0, int64(resp.EchoedTs)))
+	if resp.ReceivedTs != 0 && resp.Ts > resp.ReceivedTs {
+		rtt -= time.Duration(resp.Ts - resp.ReceivedTs)
+	}
+	if rtt < 0 {
+		return 0, false
+	}
+	return rtt, true
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoundTripTime(t *testing.T) {
+	sent := time.Unix(1000, 0)
+	ns := func(d time.Duration) uint64 { return uint64(sent.Add(d).UnixNano()) }
+
+	tests := []struct {
+		name   string
+		resp   *PingResponse
+		now    time.Time
+		want   time.Duration
+		wantOK bool
+	}{
+		{"no echo", &PingResponse{Ts: ns(time.Second)}, sent.Add(time.Second), 0, false},
+		{"old peer", &PingResponse{EchoedTs: ns(0), Ts: ns(time.Hour)}, sent.Add(50 * time.Millisecond), 50 * time.Millisecond, true},
+		{
+			"answer delay removed",
+			&PingResponse{EchoedTs: ns(0), ReceivedTs: ns(time.Hour), Ts: ns(time.Hour + 20*time.Millisecond)},
+			sent.Add(70 * time.Millisecond),
+			50 * time.Millisecond,
+			true,
+		},
+		{"clock went backwards", &PingResponse{EchoedTs: ns(0)}, sent.Add(-time.Second), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := RoundTripTime(tt.resp, tt.now)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("RoundTripTime() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMakePingResponse(t *testing.T) {
+	received := time.Now()
+	resp := MakePingResponse(&PingRequest{Ts: 42}, received)
+	if resp.EchoedTs != 42 {
+		t.Errorf("EchoedTs = %d, want 42", resp.EchoedTs)
+	}
+	if resp.ReceivedTs != uint64(received.UnixNano()) || resp.Ts < resp.ReceivedTs {
+		t.Errorf("ReceivedTs = %d, Ts = %d, want the receive time and a later one", resp.ReceivedTs, resp.Ts)
+	}
+}
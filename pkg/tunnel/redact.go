@@ -0,0 +1,67 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+// The requests and responses here carry credentials in their headers and
+// bodies, so they are never logged directly.  LogString describes them
+// with the headers util.IsRedactedHeader names redacted, and bodies
+// reduced to their length.
+
+func headerLogString(headers []*HttpHeader) string {
+	h := http.Header{}
+	for _, header := range headers {
+		h[header.Name] = append(h[header.Name], header.Values...)
+	}
+	return util.HeaderLogString(h)
+}
+
+// LogString describes the request for a log line.
+func (t *HttpRequest) LogString() string {
+	return fmt.Sprintf("%s %s/%s %s %s headers: {%s} body: %d bytes",
+		t.Id, t.Type, t.Name, t.Method, t.URI, headerLogString(t.Headers), len(t.Body))
+}
+
+// environmentNames returns the names of NAME=value environment entries.
+func environmentNames(environment []string) []string {
+	names := make([]string, len(environment))
+	for i, env := range environment {
+		names[i] = strings.SplitN(env, "=", 2)[0]
+	}
+	return names
+}
+
+// LogString describes the command request for a log line.  Only the
+// names of the environment variables are given.
+func (t *CommandRequest) LogString() string {
+	return fmt.Sprintf("%s %s %v environment: %v directory: %q",
+		t.Id, t.Name, t.Arguments, environmentNames(t.Environment), t.WorkingDirectory)
+}
+
+// LogString describes the command-tool's request for a log line.  Only the
+// names of the environment variables are given.
+func (t *CmdToolCommandRequest) LogString() string {
+	return fmt.Sprintf("%s %v environment: %v directory: %q",
+		t.Name, t.Arguments, environmentNames(t.Environment), t.WorkingDirectory)
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHttpRequest_LogString(t *testing.T) {
+	req := &HttpRequest{
+		Id:     "txn1",
+		Type:   "kubernetes",
+		Name:   "ctx1",
+		Method: "POST",
+		URI:    "/api/v1/namespaces/default/secrets",
+		Headers: []*HttpHeader{
+			{Name: "Authorization", Values: []string{"Bearer s3cret"}},
+			{Name: "Content-Type", Values: []string{"application/json"}},
+		},
+		Body: []byte(`{"data":{"password":"s3cret"}}`),
+	}
+	got := req.LogString()
+	want := "txn1 kubernetes/ctx1 POST /api/v1/namespaces/default/secrets headers: {Authorization=[[REDACTED]] Content-Type=[application/json]} body: 30 bytes"
+	if got != want {
+		t.Errorf("LogString() = %q, want %q", got, want)
+	}
+	if strings.Contains(got, "s3cret") {
+		t.Errorf("LogString() leaks a secret: %q", got)
+	}
+}
+
+func TestCommandRequest_LogString(t *testing.T) {
+	req := &CommandRequest{
+		Id:          "cmd1",
+		Name:        "kubectl",
+		Arguments:   []string{"get", "pods"},
+		Environment: []string{"KUBECONFIG=/tmp/config", "TOKEN=s3cret", "EMPTY"},
+	}
+	got := req.LogString()
+	want := `cmd1 kubectl [get pods] environment: [KUBECONFIG TOKEN EMPTY] directory: ""`
+	if got != want {
+		t.Errorf("LogString() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,35 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import "net/http"
+
+// ResponseHasBody returns false for the responses which never have a body,
+// whatever their headers say: those to a HEAD request, and those with a
+// 1xx, 204 or 304 status.  An agent sends these with a ContentLength of
+// zero and no chunks.
+func ResponseHasBody(method string, status int) bool {
+	switch {
+	case method == http.MethodHead:
+		return false
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+// The TLS modes an agent reports in EndpointHealth for the connection from
+// the agent to each endpoint's upstream server.
+const (
+	// TLSModeVerified verifies the server against the usual CAs.
+	TLSModeVerified = "verified"
+	// TLSModeCustom verifies the server with an extra CA bundle or an
+	// overridden server name.
+	TLSModeCustom = "custom"
+	// TLSModeInsecure does not verify the server's certificate.
+	TLSModeInsecure = "insecure"
+	// TLSModePlaintext does not use TLS at all.
+	TLSModePlaintext = "plaintext"
+)
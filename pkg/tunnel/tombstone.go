@@ -0,0 +1,73 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultTombstoneTTL is how long a cancelled transaction ID is remembered.
+// It only needs to outlive messages already queued in the tunnel when the
+// cancel was sent.
+const DefaultTombstoneTTL = time.Minute
+
+// Tombstones is a short-lived set of cancelled transaction IDs.  Either
+// side of the tunnel uses it to quietly discard messages which were in
+// flight when a transaction was cancelled, and to ignore a second cancel
+// for the same ID.
+type Tombstones struct {
+	sync.Mutex
+	m   map[string]time.Time
+	now func() time.Time
+	ttl time.Duration
+}
+
+// NewTombstones returns an empty set whose entries expire after ttl.
+func NewTombstones(ttl time.Duration) *Tombstones {
+	return &Tombstones{
+		m:   make(map[string]time.Time),
+		now: time.Now,
+		ttl: ttl,
+	}
+}
+
+// Add records id as cancelled.  It returns false if id was already
+// recorded, in which case the cancel is a duplicate.
+func (t *Tombstones) Add(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	now := t.now()
+	for k, expires := range t.m {
+		if !now.Before(expires) {
+			delete(t.m, k)
+		}
+	}
+	if _, found := t.m[id]; found {
+		return false
+	}
+	t.m[id] = now.Add(t.ttl)
+	return true
+}
+
+// Contains returns true if id was cancelled within the TTL.
+func (t *Tombstones) Contains(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	expires, found := t.m[id]
+	return found && t.now().Before(expires)
+}
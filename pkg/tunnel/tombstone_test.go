@@ -0,0 +1,55 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ts := NewTombstones(time.Minute)
+	ts.now = func() time.Time { return now }
+
+	if ts.Contains("a") {
+		t.Errorf("Contains(a) = true before Add")
+	}
+	if !ts.Add("a") {
+		t.Errorf("first Add(a) = false, want true")
+	}
+	if ts.Add("a") {
+		t.Errorf("second Add(a) = true, want false")
+	}
+	if !ts.Contains("a") {
+		t.Errorf("Contains(a) = false after Add")
+	}
+
+	now = now.Add(time.Minute)
+	if ts.Contains("a") {
+		t.Errorf("Contains(a) = true after the TTL")
+	}
+	if !ts.Add("b") {
+		t.Errorf("Add(b) = false, want true")
+	}
+	if _, found := ts.m["a"]; found {
+		t.Errorf("expired entry was not pruned by Add")
+	}
+	if !ts.Add("a") {
+		t.Errorf("Add(a) after expiry = false, want true")
+	}
+}
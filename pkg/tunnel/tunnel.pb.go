@@ -93,6 +93,8 @@ func (ChannelDirection) EnumDescriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{0}
 }
 
+// Pings are sent by the agent, and by the controller to agents which say
+// in their hello that they answer them.  Times are Unix nanoseconds.
 type PingRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -140,13 +142,16 @@ func (x *PingRequest) GetTs() uint64 {
 	return 0
 }
 
+// Answers a PingRequest, echoing its ts.  receivedTs is when the request
+// arrived, so the time taken to answer is left out of the round trip.
 type PingResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Ts       uint64 `protobuf:"varint,1,opt,name=ts,proto3" json:"ts,omitempty"`
-	EchoedTs uint64 `protobuf:"varint,2,opt,name=echoedTs,proto3" json:"echoedTs,omitempty"`
+	Ts         uint64 `protobuf:"varint,1,opt,name=ts,proto3" json:"ts,omitempty"`
+	EchoedTs   uint64 `protobuf:"varint,2,opt,name=echoedTs,proto3" json:"echoedTs,omitempty"`
+	ReceivedTs uint64 `protobuf:"varint,3,opt,name=receivedTs,proto3" json:"receivedTs,omitempty"`
 }
 
 func (x *PingResponse) Reset() {
@@ -195,6 +200,13 @@ func (x *PingResponse) GetEchoedTs() uint64 {
 	return 0
 }
 
+func (x *PingResponse) GetReceivedTs() uint64 {
+	if x != nil {
+		return x.ReceivedTs
+	}
+	return 0
+}
+
 type HttpHeader struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -255,13 +267,14 @@ type HttpRequest struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id      string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Name    string        `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
-	Type    string        `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
-	Method  string        `protobuf:"bytes,4,opt,name=method,proto3" json:"method,omitempty"`
-	URI     string        `protobuf:"bytes,5,opt,name=URI,proto3" json:"URI,omitempty"`
-	Headers []*HttpHeader `protobuf:"bytes,6,rep,name=headers,proto3" json:"headers,omitempty"`
-	Body    []byte        `protobuf:"bytes,7,opt,name=body,proto3" json:"body,omitempty"`
+	Id            string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string        `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Type          string        `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	Method        string        `protobuf:"bytes,4,opt,name=method,proto3" json:"method,omitempty"`
+	URI           string        `protobuf:"bytes,5,opt,name=URI,proto3" json:"URI,omitempty"`
+	Headers       []*HttpHeader `protobuf:"bytes,6,rep,name=headers,proto3" json:"headers,omitempty"`
+	Body          []byte        `protobuf:"bytes,7,opt,name=body,proto3" json:"body,omitempty"`
+	ContentLength int64         `protobuf:"varint,8,opt,name=contentLength,proto3" json:"contentLength,omitempty"`
 }
 
 func (x *HttpRequest) Reset() {
@@ -345,16 +358,27 @@ func (x *HttpRequest) GetBody() []byte {
 	return nil
 }
 
-type CancelRequest struct {
+func (x *HttpRequest) GetContentLength() int64 {
+	if x != nil {
+		return x.ContentLength
+	}
+	return 0
+}
+
+// The body of an HttpRequest is sent as a series of HttpRequestChunk
+// messages following the HttpRequest, with a zero length body meaning EOF.
+// If the HttpRequest's contentLength is 0, no chunks are sent.
+type HttpRequestChunk struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
 }
 
-func (x *CancelRequest) Reset() {
-	*x = CancelRequest{}
+func (x *HttpRequestChunk) Reset() {
+	*x = HttpRequestChunk{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -362,13 +386,13 @@ func (x *CancelRequest) Reset() {
 	}
 }
 
-func (x *CancelRequest) String() string {
+func (x *HttpRequestChunk) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CancelRequest) ProtoMessage() {}
+func (*HttpRequestChunk) ProtoMessage() {}
 
-func (x *CancelRequest) ProtoReflect() protoreflect.Message {
+func (x *HttpRequestChunk) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -380,34 +404,40 @@ func (x *CancelRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CancelRequest.ProtoReflect.Descriptor instead.
-func (*CancelRequest) Descriptor() ([]byte, []int) {
+// Deprecated: Use HttpRequestChunk.ProtoReflect.Descriptor instead.
+func (*HttpRequestChunk) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{4}
 }
 
-func (x *CancelRequest) GetId() string {
+func (x *HttpRequestChunk) GetId() string {
 	if x != nil {
 		return x.Id
 	}
 	return ""
 }
 
-// This is the initial response sent to the controller from the agent.
-// The body is sent back in a series of HttpChunkedResponse messages,
-// with a zero length meaning EOF.
-type HttpResponse struct {
+func (x *HttpRequestChunk) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+// Sent by the controller, to agents which say in their hello that they
+// accept it, when a client is reading a response more slowly than the
+// agent sends it.  While paused, the agent sends no more of the response's
+// body, and it continues once the same message arrives with paused unset.
+type HttpFlowControl struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id            string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Status        int32         `protobuf:"varint,2,opt,name=status,proto3" json:"status,omitempty"`
-	Headers       []*HttpHeader `protobuf:"bytes,3,rep,name=headers,proto3" json:"headers,omitempty"`
-	ContentLength int64         `protobuf:"varint,4,opt,name=contentLength,proto3" json:"contentLength,omitempty"`
+	Id     string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Paused bool   `protobuf:"varint,2,opt,name=paused,proto3" json:"paused,omitempty"`
 }
 
-func (x *HttpResponse) Reset() {
-	*x = HttpResponse{}
+func (x *HttpFlowControl) Reset() {
+	*x = HttpFlowControl{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -415,13 +445,13 @@ func (x *HttpResponse) Reset() {
 	}
 }
 
-func (x *HttpResponse) String() string {
+func (x *HttpFlowControl) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*HttpResponse) ProtoMessage() {}
+func (*HttpFlowControl) ProtoMessage() {}
 
-func (x *HttpResponse) ProtoReflect() protoreflect.Message {
+func (x *HttpFlowControl) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -433,50 +463,35 @@ func (x *HttpResponse) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use HttpResponse.ProtoReflect.Descriptor instead.
-func (*HttpResponse) Descriptor() ([]byte, []int) {
+// Deprecated: Use HttpFlowControl.ProtoReflect.Descriptor instead.
+func (*HttpFlowControl) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{5}
 }
 
-func (x *HttpResponse) GetId() string {
+func (x *HttpFlowControl) GetId() string {
 	if x != nil {
 		return x.Id
 	}
 	return ""
 }
 
-func (x *HttpResponse) GetStatus() int32 {
-	if x != nil {
-		return x.Status
-	}
-	return 0
-}
-
-func (x *HttpResponse) GetHeaders() []*HttpHeader {
-	if x != nil {
-		return x.Headers
-	}
-	return nil
-}
-
-func (x *HttpResponse) GetContentLength() int64 {
+func (x *HttpFlowControl) GetPaused() bool {
 	if x != nil {
-		return x.ContentLength
+		return x.Paused
 	}
-	return 0
+	return false
 }
 
-type HttpChunkedResponse struct {
+type CancelRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 }
 
-func (x *HttpChunkedResponse) Reset() {
-	*x = HttpChunkedResponse{}
+func (x *CancelRequest) Reset() {
+	*x = CancelRequest{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -484,13 +499,13 @@ func (x *HttpChunkedResponse) Reset() {
 	}
 }
 
-func (x *HttpChunkedResponse) String() string {
+func (x *CancelRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*HttpChunkedResponse) ProtoMessage() {}
+func (*CancelRequest) ProtoMessage() {}
 
-func (x *HttpChunkedResponse) ProtoReflect() protoreflect.Message {
+func (x *CancelRequest) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -502,38 +517,31 @@ func (x *HttpChunkedResponse) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use HttpChunkedResponse.ProtoReflect.Descriptor instead.
-func (*HttpChunkedResponse) Descriptor() ([]byte, []int) {
+// Deprecated: Use CancelRequest.ProtoReflect.Descriptor instead.
+func (*CancelRequest) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{6}
 }
 
-func (x *HttpChunkedResponse) GetId() string {
+func (x *CancelRequest) GetId() string {
 	if x != nil {
 		return x.Id
 	}
 	return ""
 }
 
-func (x *HttpChunkedResponse) GetBody() []byte {
-	if x != nil {
-		return x.Body
-	}
-	return nil
-}
-
-type CommandRequest struct {
+// Sent by the agent once it has stopped work on a cancelled request.
+// Messages for the ID may still arrive after this, having been sent
+// before the cancel was seen.
+type CancelAck struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id          string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Name        string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
-	Arguments   []string `protobuf:"bytes,3,rep,name=arguments,proto3" json:"arguments,omitempty"`
-	Environment []string `protobuf:"bytes,4,rep,name=environment,proto3" json:"environment,omitempty"`
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 }
 
-func (x *CommandRequest) Reset() {
-	*x = CommandRequest{}
+func (x *CancelAck) Reset() {
+	*x = CancelAck{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[7]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -541,13 +549,13 @@ func (x *CommandRequest) Reset() {
 	}
 }
 
-func (x *CommandRequest) String() string {
+func (x *CancelAck) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CommandRequest) ProtoMessage() {}
+func (*CancelAck) ProtoMessage() {}
 
-func (x *CommandRequest) ProtoReflect() protoreflect.Message {
+func (x *CancelAck) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[7]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -559,54 +567,34 @@ func (x *CommandRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CommandRequest.ProtoReflect.Descriptor instead.
-func (*CommandRequest) Descriptor() ([]byte, []int) {
+// Deprecated: Use CancelAck.ProtoReflect.Descriptor instead.
+func (*CancelAck) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{7}
 }
 
-func (x *CommandRequest) GetId() string {
+func (x *CancelAck) GetId() string {
 	if x != nil {
 		return x.Id
 	}
 	return ""
 }
 
-func (x *CommandRequest) GetName() string {
-	if x != nil {
-		return x.Name
-	}
-	return ""
-}
-
-func (x *CommandRequest) GetArguments() []string {
-	if x != nil {
-		return x.Arguments
-	}
-	return nil
-}
-
-func (x *CommandRequest) GetEnvironment() []string {
-	if x != nil {
-		return x.Environment
-	}
-	return nil
-}
-
-// A simplified message, used for command-tool <-> controller communication.
-// This does not have the "id" or "target" field, as these are set by
-// the controller based on authentication used.
-type CmdToolCommandRequest struct {
+// This is the initial response sent to the controller from the agent.
+// The body is sent back in a series of HttpChunkedResponse messages,
+// with a zero length meaning EOF.
+type HttpResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Name        string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Arguments   []string `protobuf:"bytes,2,rep,name=arguments,proto3" json:"arguments,omitempty"`
-	Environment []string `protobuf:"bytes,3,rep,name=environment,proto3" json:"environment,omitempty"`
+	Id            string        `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Status        int32         `protobuf:"varint,2,opt,name=status,proto3" json:"status,omitempty"`
+	Headers       []*HttpHeader `protobuf:"bytes,3,rep,name=headers,proto3" json:"headers,omitempty"`
+	ContentLength int64         `protobuf:"varint,4,opt,name=contentLength,proto3" json:"contentLength,omitempty"`
 }
 
-func (x *CmdToolCommandRequest) Reset() {
-	*x = CmdToolCommandRequest{}
+func (x *HttpResponse) Reset() {
+	*x = HttpResponse{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[8]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -614,13 +602,13 @@ func (x *CmdToolCommandRequest) Reset() {
 	}
 }
 
-func (x *CmdToolCommandRequest) String() string {
+func (x *HttpResponse) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CmdToolCommandRequest) ProtoMessage() {}
+func (*HttpResponse) ProtoMessage() {}
 
-func (x *CmdToolCommandRequest) ProtoReflect() protoreflect.Message {
+func (x *HttpResponse) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[8]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -632,45 +620,50 @@ func (x *CmdToolCommandRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CmdToolCommandRequest.ProtoReflect.Descriptor instead.
-func (*CmdToolCommandRequest) Descriptor() ([]byte, []int) {
+// Deprecated: Use HttpResponse.ProtoReflect.Descriptor instead.
+func (*HttpResponse) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{8}
 }
 
-func (x *CmdToolCommandRequest) GetName() string {
+func (x *HttpResponse) GetId() string {
 	if x != nil {
-		return x.Name
+		return x.Id
 	}
 	return ""
 }
 
-func (x *CmdToolCommandRequest) GetArguments() []string {
+func (x *HttpResponse) GetStatus() int32 {
 	if x != nil {
-		return x.Arguments
+		return x.Status
 	}
-	return nil
+	return 0
 }
 
-func (x *CmdToolCommandRequest) GetEnvironment() []string {
+func (x *HttpResponse) GetHeaders() []*HttpHeader {
 	if x != nil {
-		return x.Environment
+		return x.Headers
 	}
 	return nil
 }
 
-type CommandData struct {
+func (x *HttpResponse) GetContentLength() int64 {
+	if x != nil {
+		return x.ContentLength
+	}
+	return 0
+}
+
+type HttpChunkedResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id      string           `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Body    []byte           `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
-	Channel ChannelDirection `protobuf:"varint,3,opt,name=channel,proto3,enum=tunnel.ChannelDirection" json:"channel,omitempty"`
-	Closed  bool             `protobuf:"varint,4,opt,name=Closed,proto3" json:"Closed,omitempty"`
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
 }
 
-func (x *CommandData) Reset() {
-	*x = CommandData{}
+func (x *HttpChunkedResponse) Reset() {
+	*x = HttpChunkedResponse{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -678,13 +671,13 @@ func (x *CommandData) Reset() {
 	}
 }
 
-func (x *CommandData) String() string {
+func (x *HttpChunkedResponse) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CommandData) ProtoMessage() {}
+func (*HttpChunkedResponse) ProtoMessage() {}
 
-func (x *CommandData) ProtoReflect() protoreflect.Message {
+func (x *HttpChunkedResponse) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -696,54 +689,44 @@ func (x *CommandData) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CommandData.ProtoReflect.Descriptor instead.
-func (*CommandData) Descriptor() ([]byte, []int) {
+// Deprecated: Use HttpChunkedResponse.ProtoReflect.Descriptor instead.
+func (*HttpChunkedResponse) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{9}
 }
 
-func (x *CommandData) GetId() string {
+func (x *HttpChunkedResponse) GetId() string {
 	if x != nil {
 		return x.Id
 	}
 	return ""
 }
 
-func (x *CommandData) GetBody() []byte {
+func (x *HttpChunkedResponse) GetBody() []byte {
 	if x != nil {
 		return x.Body
 	}
 	return nil
 }
 
-func (x *CommandData) GetChannel() ChannelDirection {
-	if x != nil {
-		return x.Channel
-	}
-	return ChannelDirection_STDIN
-}
-
-func (x *CommandData) GetClosed() bool {
-	if x != nil {
-		return x.Closed
-	}
-	return false
-}
-
-// A simplified message, used for command-tool <-> controller communication.
-// This does not have the "id" or "target" field, as these are set by
-// the controller based on authentication used.
-type CmdToolCommandData struct {
+// Sent by the agent when the upstream request fails.  If no HttpResponse
+// has been sent yet, the controller will respond with the status and
+// message; otherwise the response is ended.  No further messages will be
+// sent for this request id.  Draining is set when the agent refused the
+// request because it is shutting down, so the controller may retry it on
+// another session of the same agent.
+type HttpError struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Body    []byte           `protobuf:"bytes,1,opt,name=body,proto3" json:"body,omitempty"`
-	Channel ChannelDirection `protobuf:"varint,2,opt,name=channel,proto3,enum=tunnel.ChannelDirection" json:"channel,omitempty"`
-	Closed  bool             `protobuf:"varint,3,opt,name=Closed,proto3" json:"Closed,omitempty"`
+	Id       string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Status   int32  `protobuf:"varint,2,opt,name=status,proto3" json:"status,omitempty"`
+	Message  string `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	Draining bool   `protobuf:"varint,4,opt,name=draining,proto3" json:"draining,omitempty"`
 }
 
-func (x *CmdToolCommandData) Reset() {
-	*x = CmdToolCommandData{}
+func (x *HttpError) Reset() {
+	*x = HttpError{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[10]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -751,13 +734,13 @@ func (x *CmdToolCommandData) Reset() {
 	}
 }
 
-func (x *CmdToolCommandData) String() string {
+func (x *HttpError) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CmdToolCommandData) ProtoMessage() {}
+func (*HttpError) ProtoMessage() {}
 
-func (x *CmdToolCommandData) ProtoReflect() protoreflect.Message {
+func (x *HttpError) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[10]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -769,44 +752,55 @@ func (x *CmdToolCommandData) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CmdToolCommandData.ProtoReflect.Descriptor instead.
-func (*CmdToolCommandData) Descriptor() ([]byte, []int) {
+// Deprecated: Use HttpError.ProtoReflect.Descriptor instead.
+func (*HttpError) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{10}
 }
 
-func (x *CmdToolCommandData) GetBody() []byte {
+func (x *HttpError) GetId() string {
 	if x != nil {
-		return x.Body
+		return x.Id
 	}
-	return nil
+	return ""
 }
 
-func (x *CmdToolCommandData) GetChannel() ChannelDirection {
+func (x *HttpError) GetStatus() int32 {
 	if x != nil {
-		return x.Channel
+		return x.Status
 	}
-	return ChannelDirection_STDIN
+	return 0
 }
 
-func (x *CmdToolCommandData) GetClosed() bool {
+func (x *HttpError) GetMessage() string {
 	if x != nil {
-		return x.Closed
+		return x.Message
+	}
+	return ""
+}
+
+func (x *HttpError) GetDraining() bool {
+	if x != nil {
+		return x.Draining
 	}
 	return false
 }
 
-type CommandTermination struct {
+// Sent by the controller in place of an HttpRequest when the client asks
+// for a connection upgrade, such as the websocket or SPDY connections used
+// by kubectl exec, attach, and port-forward.  The agent replies with an
+// HttpResponse.  If its status is 101 (Switching Protocols) the upgraded
+// connection is carried as StreamData in both directions until either side
+// sends StreamClose; otherwise the response continues as for HttpRequest.
+type StreamOpen struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Id       string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	ExitCode int32  `protobuf:"varint,2,opt,name=exitCode,proto3" json:"exitCode,omitempty"`
-	Message  string `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	Request *HttpRequest `protobuf:"bytes,1,opt,name=request,proto3" json:"request,omitempty"`
 }
 
-func (x *CommandTermination) Reset() {
-	*x = CommandTermination{}
+func (x *StreamOpen) Reset() {
+	*x = StreamOpen{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[11]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -814,13 +808,13 @@ func (x *CommandTermination) Reset() {
 	}
 }
 
-func (x *CommandTermination) String() string {
+func (x *StreamOpen) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CommandTermination) ProtoMessage() {}
+func (*StreamOpen) ProtoMessage() {}
 
-func (x *CommandTermination) ProtoReflect() protoreflect.Message {
+func (x *StreamOpen) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[11]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -832,46 +826,29 @@ func (x *CommandTermination) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CommandTermination.ProtoReflect.Descriptor instead.
-func (*CommandTermination) Descriptor() ([]byte, []int) {
+// Deprecated: Use StreamOpen.ProtoReflect.Descriptor instead.
+func (*StreamOpen) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{11}
 }
 
-func (x *CommandTermination) GetId() string {
-	if x != nil {
-		return x.Id
-	}
-	return ""
-}
-
-func (x *CommandTermination) GetExitCode() int32 {
-	if x != nil {
-		return x.ExitCode
-	}
-	return 0
-}
-
-func (x *CommandTermination) GetMessage() string {
+func (x *StreamOpen) GetRequest() *HttpRequest {
 	if x != nil {
-		return x.Message
+		return x.Request
 	}
-	return ""
+	return nil
 }
 
-// A simplified message, used for command-tool <-> controller communication.
-// This does not have the "id" or "target" field, as these are set by
-// the controller based on authentication used.
-type CmdToolCommandTermination struct {
+type StreamData struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	ExitCode int32  `protobuf:"varint,1,opt,name=exitCode,proto3" json:"exitCode,omitempty"`
-	Message  string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Data []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
 }
 
-func (x *CmdToolCommandTermination) Reset() {
-	*x = CmdToolCommandTermination{}
+func (x *StreamData) Reset() {
+	*x = StreamData{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[12]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -879,13 +856,13 @@ func (x *CmdToolCommandTermination) Reset() {
 	}
 }
 
-func (x *CmdToolCommandTermination) String() string {
+func (x *StreamData) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CmdToolCommandTermination) ProtoMessage() {}
+func (*StreamData) ProtoMessage() {}
 
-func (x *CmdToolCommandTermination) ProtoReflect() protoreflect.Message {
+func (x *StreamData) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[12]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -897,38 +874,39 @@ func (x *CmdToolCommandTermination) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CmdToolCommandTermination.ProtoReflect.Descriptor instead.
-func (*CmdToolCommandTermination) Descriptor() ([]byte, []int) {
+// Deprecated: Use StreamData.ProtoReflect.Descriptor instead.
+func (*StreamData) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{12}
 }
 
-func (x *CmdToolCommandTermination) GetExitCode() int32 {
+func (x *StreamData) GetId() string {
 	if x != nil {
-		return x.ExitCode
+		return x.Id
 	}
-	return 0
+	return ""
 }
 
-func (x *CmdToolCommandTermination) GetMessage() string {
+func (x *StreamData) GetData() []byte {
 	if x != nil {
-		return x.Message
+		return x.Data
 	}
-	return ""
+	return nil
 }
 
-type EndpointHealth struct {
+// Sent by either side when its half of a stream closes or fails.  The
+// receiver closes its own connection, and no further messages are sent
+// for the id.
+type StreamClose struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Name       string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Type       string   `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
-	Configured bool     `protobuf:"varint,3,opt,name=configured,proto3" json:"configured,omitempty"`
-	Namespaces []string `protobuf:"bytes,4,rep,name=namespaces,proto3" json:"namespaces,omitempty"`
+	Id      string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Message string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
 }
 
-func (x *EndpointHealth) Reset() {
-	*x = EndpointHealth{}
+func (x *StreamClose) Reset() {
+	*x = StreamClose{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[13]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -936,13 +914,13 @@ func (x *EndpointHealth) Reset() {
 	}
 }
 
-func (x *EndpointHealth) String() string {
+func (x *StreamClose) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*EndpointHealth) ProtoMessage() {}
+func (*StreamClose) ProtoMessage() {}
 
-func (x *EndpointHealth) ProtoReflect() protoreflect.Message {
+func (x *StreamClose) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[13]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -954,51 +932,50 @@ func (x *EndpointHealth) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use EndpointHealth.ProtoReflect.Descriptor instead.
-func (*EndpointHealth) Descriptor() ([]byte, []int) {
+// Deprecated: Use StreamClose.ProtoReflect.Descriptor instead.
+func (*StreamClose) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{13}
 }
 
-func (x *EndpointHealth) GetName() string {
+func (x *StreamClose) GetId() string {
 	if x != nil {
-		return x.Name
+		return x.Id
 	}
 	return ""
 }
 
-func (x *EndpointHealth) GetType() string {
+func (x *StreamClose) GetMessage() string {
 	if x != nil {
-		return x.Type
+		return x.Message
 	}
 	return ""
 }
 
-func (x *EndpointHealth) GetConfigured() bool {
-	if x != nil {
-		return x.Configured
-	}
-	return false
-}
-
-func (x *EndpointHealth) GetNamespaces() []string {
-	if x != nil {
-		return x.Namespaces
-	}
-	return nil
-}
-
-type AgentHello struct {
+// If stdin is set, the command's standard input is fed by CommandData
+// messages on the STDIN channel, ending with one marked Closed.  Otherwise
+// the command's standard input is empty.
+//
+// If window is not zero, the agent stops reading the command's output once
+// that many bytes of STDOUT and STDERR data have been sent but not yet
+// acknowledged by a CommandAck.
+type CommandRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Endpoints []*EndpointHealth `protobuf:"bytes,1,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
-	Version   string            `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
-	Hostname  string            `protobuf:"bytes,3,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Id          string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name        string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Arguments   []string `protobuf:"bytes,3,rep,name=arguments,proto3" json:"arguments,omitempty"`
+	Environment []string `protobuf:"bytes,4,rep,name=environment,proto3" json:"environment,omitempty"`
+	Stdin       bool     `protobuf:"varint,5,opt,name=stdin,proto3" json:"stdin,omitempty"`
+	Window      uint64   `protobuf:"varint,6,opt,name=window,proto3" json:"window,omitempty"`
+	// If set, the absolute directory the command runs in, which must be
+	// within one the agent allows commands to run in.
+	WorkingDirectory string `protobuf:"bytes,7,opt,name=workingDirectory,proto3" json:"workingDirectory,omitempty"`
 }
 
-func (x *AgentHello) Reset() {
-	*x = AgentHello{}
+func (x *CommandRequest) Reset() {
+	*x = CommandRequest{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[14]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -1006,13 +983,13 @@ func (x *AgentHello) Reset() {
 	}
 }
 
-func (x *AgentHello) String() string {
+func (x *CommandRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*AgentHello) ProtoMessage() {}
+func (*CommandRequest) ProtoMessage() {}
 
-func (x *AgentHello) ProtoReflect() protoreflect.Message {
+func (x *CommandRequest) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[14]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -1024,49 +1001,78 @@ func (x *AgentHello) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use AgentHello.ProtoReflect.Descriptor instead.
-func (*AgentHello) Descriptor() ([]byte, []int) {
+// Deprecated: Use CommandRequest.ProtoReflect.Descriptor instead.
+func (*CommandRequest) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{14}
 }
 
-func (x *AgentHello) GetEndpoints() []*EndpointHealth {
+func (x *CommandRequest) GetId() string {
 	if x != nil {
-		return x.Endpoints
+		return x.Id
 	}
-	return nil
+	return ""
 }
 
-func (x *AgentHello) GetVersion() string {
+func (x *CommandRequest) GetName() string {
 	if x != nil {
-		return x.Version
+		return x.Name
 	}
 	return ""
 }
 
-func (x *AgentHello) GetHostname() string {
+func (x *CommandRequest) GetArguments() []string {
 	if x != nil {
-		return x.Hostname
+		return x.Arguments
+	}
+	return nil
+}
+
+func (x *CommandRequest) GetEnvironment() []string {
+	if x != nil {
+		return x.Environment
+	}
+	return nil
+}
+
+func (x *CommandRequest) GetStdin() bool {
+	if x != nil {
+		return x.Stdin
+	}
+	return false
+}
+
+func (x *CommandRequest) GetWindow() uint64 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+func (x *CommandRequest) GetWorkingDirectory() string {
+	if x != nil {
+		return x.WorkingDirectory
 	}
 	return ""
 }
 
-// Messages sent from server to agent
-type ControllerToAgentWrapper struct {
+// A simplified message, used for command-tool <-> controller communication.
+// This does not have the "id" or "target" field, as these are set by
+// the controller based on authentication used.
+type CmdToolCommandRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	// Types that are assignable to Event:
-	//	*ControllerToAgentWrapper_PingResponse
-	//	*ControllerToAgentWrapper_HttpRequest
-	//	*ControllerToAgentWrapper_CancelRequest
-	//	*ControllerToAgentWrapper_CommandRequest
-	//	*ControllerToAgentWrapper_CommandData
-	Event isControllerToAgentWrapper_Event `protobuf_oneof:"event"`
+	Name             string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Arguments        []string `protobuf:"bytes,2,rep,name=arguments,proto3" json:"arguments,omitempty"`
+	Environment      []string `protobuf:"bytes,3,rep,name=environment,proto3" json:"environment,omitempty"`
+	Stdin            bool     `protobuf:"varint,4,opt,name=stdin,proto3" json:"stdin,omitempty"`
+	Window           uint64   `protobuf:"varint,5,opt,name=window,proto3" json:"window,omitempty"`
+	WorkingDirectory string   `protobuf:"bytes,6,opt,name=workingDirectory,proto3" json:"workingDirectory,omitempty"`
 }
 
-func (x *ControllerToAgentWrapper) Reset() {
-	*x = ControllerToAgentWrapper{}
+func (x *CmdToolCommandRequest) Reset() {
+	*x = CmdToolCommandRequest{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[15]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -1074,13 +1080,13 @@ func (x *ControllerToAgentWrapper) Reset() {
 	}
 }
 
-func (x *ControllerToAgentWrapper) String() string {
+func (x *CmdToolCommandRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ControllerToAgentWrapper) ProtoMessage() {}
+func (*CmdToolCommandRequest) ProtoMessage() {}
 
-func (x *ControllerToAgentWrapper) ProtoReflect() protoreflect.Message {
+func (x *CmdToolCommandRequest) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[15]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -1092,105 +1098,66 @@ func (x *ControllerToAgentWrapper) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ControllerToAgentWrapper.ProtoReflect.Descriptor instead.
-func (*ControllerToAgentWrapper) Descriptor() ([]byte, []int) {
+// Deprecated: Use CmdToolCommandRequest.ProtoReflect.Descriptor instead.
+func (*CmdToolCommandRequest) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{15}
 }
 
-func (m *ControllerToAgentWrapper) GetEvent() isControllerToAgentWrapper_Event {
-	if m != nil {
-		return m.Event
+func (x *CmdToolCommandRequest) GetName() string {
+	if x != nil {
+		return x.Name
 	}
-	return nil
+	return ""
 }
 
-func (x *ControllerToAgentWrapper) GetPingResponse() *PingResponse {
-	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_PingResponse); ok {
-		return x.PingResponse
+func (x *CmdToolCommandRequest) GetArguments() []string {
+	if x != nil {
+		return x.Arguments
 	}
 	return nil
 }
 
-func (x *ControllerToAgentWrapper) GetHttpRequest() *HttpRequest {
-	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_HttpRequest); ok {
-		return x.HttpRequest
+func (x *CmdToolCommandRequest) GetEnvironment() []string {
+	if x != nil {
+		return x.Environment
 	}
 	return nil
 }
 
-func (x *ControllerToAgentWrapper) GetCancelRequest() *CancelRequest {
-	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CancelRequest); ok {
-		return x.CancelRequest
+func (x *CmdToolCommandRequest) GetStdin() bool {
+	if x != nil {
+		return x.Stdin
 	}
-	return nil
+	return false
 }
 
-func (x *ControllerToAgentWrapper) GetCommandRequest() *CommandRequest {
-	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CommandRequest); ok {
-		return x.CommandRequest
+func (x *CmdToolCommandRequest) GetWindow() uint64 {
+	if x != nil {
+		return x.Window
 	}
-	return nil
+	return 0
 }
 
-func (x *ControllerToAgentWrapper) GetCommandData() *CommandData {
-	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CommandData); ok {
-		return x.CommandData
+func (x *CmdToolCommandRequest) GetWorkingDirectory() string {
+	if x != nil {
+		return x.WorkingDirectory
 	}
-	return nil
-}
-
-type isControllerToAgentWrapper_Event interface {
-	isControllerToAgentWrapper_Event()
-}
-
-type ControllerToAgentWrapper_PingResponse struct {
-	PingResponse *PingResponse `protobuf:"bytes,1,opt,name=pingResponse,proto3,oneof"`
-}
-
-type ControllerToAgentWrapper_HttpRequest struct {
-	HttpRequest *HttpRequest `protobuf:"bytes,2,opt,name=httpRequest,proto3,oneof"`
-}
-
-type ControllerToAgentWrapper_CancelRequest struct {
-	CancelRequest *CancelRequest `protobuf:"bytes,3,opt,name=cancelRequest,proto3,oneof"`
-}
-
-type ControllerToAgentWrapper_CommandRequest struct {
-	CommandRequest *CommandRequest `protobuf:"bytes,4,opt,name=commandRequest,proto3,oneof"`
-}
-
-type ControllerToAgentWrapper_CommandData struct {
-	CommandData *CommandData `protobuf:"bytes,5,opt,name=commandData,proto3,oneof"`
+	return ""
 }
 
-func (*ControllerToAgentWrapper_PingResponse) isControllerToAgentWrapper_Event() {}
-
-func (*ControllerToAgentWrapper_HttpRequest) isControllerToAgentWrapper_Event() {}
-
-func (*ControllerToAgentWrapper_CancelRequest) isControllerToAgentWrapper_Event() {}
-
-func (*ControllerToAgentWrapper_CommandRequest) isControllerToAgentWrapper_Event() {}
-
-func (*ControllerToAgentWrapper_CommandData) isControllerToAgentWrapper_Event() {}
-
-// Messages sent from agent to server
-type AgentToControllerWrapper struct {
+type CommandData struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	// Types that are assignable to Event:
-	//	*AgentToControllerWrapper_PingRequest
-	//	*AgentToControllerWrapper_HttpResponse
-	//	*AgentToControllerWrapper_HttpChunkedResponse
-	//	*AgentToControllerWrapper_AgentHello
-	//	*AgentToControllerWrapper_CommandData
-	//	*AgentToControllerWrapper_CommandTermination
-	Event isAgentToControllerWrapper_Event `protobuf_oneof:"event"`
+	Id      string           `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Body    []byte           `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	Channel ChannelDirection `protobuf:"varint,3,opt,name=channel,proto3,enum=tunnel.ChannelDirection" json:"channel,omitempty"`
+	Closed  bool             `protobuf:"varint,4,opt,name=Closed,proto3" json:"Closed,omitempty"`
 }
 
-func (x *AgentToControllerWrapper) Reset() {
-	*x = AgentToControllerWrapper{}
+func (x *CommandData) Reset() {
+	*x = CommandData{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[16]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -1198,13 +1165,13 @@ func (x *AgentToControllerWrapper) Reset() {
 	}
 }
 
-func (x *AgentToControllerWrapper) String() string {
+func (x *CommandData) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*AgentToControllerWrapper) ProtoMessage() {}
+func (*CommandData) ProtoMessage() {}
 
-func (x *AgentToControllerWrapper) ProtoReflect() protoreflect.Message {
+func (x *CommandData) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[16]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -1216,129 +1183,134 @@ func (x *AgentToControllerWrapper) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use AgentToControllerWrapper.ProtoReflect.Descriptor instead.
-func (*AgentToControllerWrapper) Descriptor() ([]byte, []int) {
+// Deprecated: Use CommandData.ProtoReflect.Descriptor instead.
+func (*CommandData) Descriptor() ([]byte, []int) {
 	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{16}
 }
 
-func (m *AgentToControllerWrapper) GetEvent() isAgentToControllerWrapper_Event {
-	if m != nil {
-		return m.Event
+func (x *CommandData) GetId() string {
+	if x != nil {
+		return x.Id
 	}
-	return nil
+	return ""
 }
 
-func (x *AgentToControllerWrapper) GetPingRequest() *PingRequest {
-	if x, ok := x.GetEvent().(*AgentToControllerWrapper_PingRequest); ok {
-		return x.PingRequest
+func (x *CommandData) GetBody() []byte {
+	if x != nil {
+		return x.Body
 	}
 	return nil
 }
 
-func (x *AgentToControllerWrapper) GetHttpResponse() *HttpResponse {
-	if x, ok := x.GetEvent().(*AgentToControllerWrapper_HttpResponse); ok {
-		return x.HttpResponse
+func (x *CommandData) GetChannel() ChannelDirection {
+	if x != nil {
+		return x.Channel
 	}
-	return nil
+	return ChannelDirection_STDIN
 }
 
-func (x *AgentToControllerWrapper) GetHttpChunkedResponse() *HttpChunkedResponse {
-	if x, ok := x.GetEvent().(*AgentToControllerWrapper_HttpChunkedResponse); ok {
-		return x.HttpChunkedResponse
+func (x *CommandData) GetClosed() bool {
+	if x != nil {
+		return x.Closed
 	}
-	return nil
+	return false
 }
 
-func (x *AgentToControllerWrapper) GetAgentHello() *AgentHello {
-	if x, ok := x.GetEvent().(*AgentToControllerWrapper_AgentHello); ok {
-		return x.AgentHello
-	}
-	return nil
-}
+// A simplified message, used for command-tool <-> controller communication.
+// This does not have the "id" or "target" field, as these are set by
+// the controller based on authentication used.
+type CmdToolCommandData struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
 
-func (x *AgentToControllerWrapper) GetCommandData() *CommandData {
-	if x, ok := x.GetEvent().(*AgentToControllerWrapper_CommandData); ok {
-		return x.CommandData
-	}
-	return nil
+	Body    []byte           `protobuf:"bytes,1,opt,name=body,proto3" json:"body,omitempty"`
+	Channel ChannelDirection `protobuf:"varint,2,opt,name=channel,proto3,enum=tunnel.ChannelDirection" json:"channel,omitempty"`
+	Closed  bool             `protobuf:"varint,3,opt,name=Closed,proto3" json:"Closed,omitempty"`
 }
 
-func (x *AgentToControllerWrapper) GetCommandTermination() *CommandTermination {
-	if x, ok := x.GetEvent().(*AgentToControllerWrapper_CommandTermination); ok {
-		return x.CommandTermination
+func (x *CmdToolCommandData) Reset() {
+	*x = CmdToolCommandData{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[17]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
 	}
-	return nil
 }
 
-type isAgentToControllerWrapper_Event interface {
-	isAgentToControllerWrapper_Event()
+func (x *CmdToolCommandData) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-type AgentToControllerWrapper_PingRequest struct {
-	PingRequest *PingRequest `protobuf:"bytes,1,opt,name=pingRequest,proto3,oneof"`
-}
+func (*CmdToolCommandData) ProtoMessage() {}
 
-type AgentToControllerWrapper_HttpResponse struct {
-	HttpResponse *HttpResponse `protobuf:"bytes,2,opt,name=httpResponse,proto3,oneof"`
+func (x *CmdToolCommandData) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[17]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
 }
 
-type AgentToControllerWrapper_HttpChunkedResponse struct {
-	HttpChunkedResponse *HttpChunkedResponse `protobuf:"bytes,3,opt,name=httpChunkedResponse,proto3,oneof"`
+// Deprecated: Use CmdToolCommandData.ProtoReflect.Descriptor instead.
+func (*CmdToolCommandData) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{17}
 }
 
-type AgentToControllerWrapper_AgentHello struct {
-	AgentHello *AgentHello `protobuf:"bytes,4,opt,name=agentHello,proto3,oneof"`
+func (x *CmdToolCommandData) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
 }
 
-type AgentToControllerWrapper_CommandData struct {
-	CommandData *CommandData `protobuf:"bytes,5,opt,name=commandData,proto3,oneof"`
+func (x *CmdToolCommandData) GetChannel() ChannelDirection {
+	if x != nil {
+		return x.Channel
+	}
+	return ChannelDirection_STDIN
 }
 
-type AgentToControllerWrapper_CommandTermination struct {
-	CommandTermination *CommandTermination `protobuf:"bytes,6,opt,name=commandTermination,proto3,oneof"`
+func (x *CmdToolCommandData) GetClosed() bool {
+	if x != nil {
+		return x.Closed
+	}
+	return false
 }
 
-func (*AgentToControllerWrapper_PingRequest) isAgentToControllerWrapper_Event() {}
-
-func (*AgentToControllerWrapper_HttpResponse) isAgentToControllerWrapper_Event() {}
-
-func (*AgentToControllerWrapper_HttpChunkedResponse) isAgentToControllerWrapper_Event() {}
-
-func (*AgentToControllerWrapper_AgentHello) isAgentToControllerWrapper_Event() {}
-
-func (*AgentToControllerWrapper_CommandData) isAgentToControllerWrapper_Event() {}
-
-func (*AgentToControllerWrapper_CommandTermination) isAgentToControllerWrapper_Event() {}
-
-// Messages sent from command-tool to controller
-type CmdToolToControllerWrapper struct {
+// Sent by the controller when the command-tool asks for a running command
+// to be stopped.  The agent kills the command's process group and reports
+// a CommandTermination with exit code 130, as a shell does for SIGINT.
+// Unlike CancelRequest, replies are still delivered.
+type CommandCancel struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	// Types that are assignable to Event:
-	//	*CmdToolToControllerWrapper_CommandRequest
-	//	*CmdToolToControllerWrapper_CommandData
-	Event isCmdToolToControllerWrapper_Event `protobuf_oneof:"event"`
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
 }
 
-func (x *CmdToolToControllerWrapper) Reset() {
-	*x = CmdToolToControllerWrapper{}
+func (x *CommandCancel) Reset() {
+	*x = CommandCancel{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[17]
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[18]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *CmdToolToControllerWrapper) String() string {
+func (x *CommandCancel) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CmdToolToControllerWrapper) ProtoMessage() {}
+func (*CommandCancel) ProtoMessage() {}
 
-func (x *CmdToolToControllerWrapper) ProtoReflect() protoreflect.Message {
-	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[17]
+func (x *CommandCancel) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[18]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1349,77 +1321,87 @@ func (x *CmdToolToControllerWrapper) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CmdToolToControllerWrapper.ProtoReflect.Descriptor instead.
-func (*CmdToolToControllerWrapper) Descriptor() ([]byte, []int) {
-	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{17}
+// Deprecated: Use CommandCancel.ProtoReflect.Descriptor instead.
+func (*CommandCancel) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{18}
 }
 
-func (m *CmdToolToControllerWrapper) GetEvent() isCmdToolToControllerWrapper_Event {
-	if m != nil {
-		return m.Event
+func (x *CommandCancel) GetId() string {
+	if x != nil {
+		return x.Id
 	}
-	return nil
+	return ""
 }
 
-func (x *CmdToolToControllerWrapper) GetCommandRequest() *CmdToolCommandRequest {
-	if x, ok := x.GetEvent().(*CmdToolToControllerWrapper_CommandRequest); ok {
-		return x.CommandRequest
-	}
-	return nil
+// A simplified message, used for command-tool <-> controller communication.
+// The command is the one started on this stream.
+type CmdToolCommandCancel struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
 }
 
-func (x *CmdToolToControllerWrapper) GetCommandData() *CmdToolCommandData {
-	if x, ok := x.GetEvent().(*CmdToolToControllerWrapper_CommandData); ok {
-		return x.CommandData
+func (x *CmdToolCommandCancel) Reset() {
+	*x = CmdToolCommandCancel{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[19]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
 	}
-	return nil
 }
 
-type isCmdToolToControllerWrapper_Event interface {
-	isCmdToolToControllerWrapper_Event()
+func (x *CmdToolCommandCancel) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-type CmdToolToControllerWrapper_CommandRequest struct {
-	CommandRequest *CmdToolCommandRequest `protobuf:"bytes,1,opt,name=commandRequest,proto3,oneof"`
-}
+func (*CmdToolCommandCancel) ProtoMessage() {}
 
-type CmdToolToControllerWrapper_CommandData struct {
-	CommandData *CmdToolCommandData `protobuf:"bytes,2,opt,name=commandData,proto3,oneof"`
+func (x *CmdToolCommandCancel) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[19]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
 }
 
-func (*CmdToolToControllerWrapper_CommandRequest) isCmdToolToControllerWrapper_Event() {}
-
-func (*CmdToolToControllerWrapper_CommandData) isCmdToolToControllerWrapper_Event() {}
+// Deprecated: Use CmdToolCommandCancel.ProtoReflect.Descriptor instead.
+func (*CmdToolCommandCancel) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{19}
+}
 
-// Messages sent from the controller to the command-tool
-type ControllerToCmdToolWrapper struct {
+// Sent by the controller as the command's output is consumed.  consumed is
+// the total number of bytes of STDOUT and STDERR data written so far, so a
+// later ack replaces any earlier one.
+type CommandAck struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	// Types that are assignable to Event:
-	//	*ControllerToCmdToolWrapper_CommandTermination
-	//	*ControllerToCmdToolWrapper_CommandData
-	Event isControllerToCmdToolWrapper_Event `protobuf_oneof:"event"`
+	Id       string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Consumed uint64 `protobuf:"varint,2,opt,name=consumed,proto3" json:"consumed,omitempty"`
 }
 
-func (x *ControllerToCmdToolWrapper) Reset() {
-	*x = ControllerToCmdToolWrapper{}
+func (x *CommandAck) Reset() {
+	*x = CommandAck{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[18]
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[20]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *ControllerToCmdToolWrapper) String() string {
+func (x *CommandAck) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ControllerToCmdToolWrapper) ProtoMessage() {}
+func (*CommandAck) ProtoMessage() {}
 
-func (x *ControllerToCmdToolWrapper) ProtoReflect() protoreflect.Message {
-	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[18]
+func (x *CommandAck) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[20]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1430,63 +1412,2148 @@ func (x *ControllerToCmdToolWrapper) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ControllerToCmdToolWrapper.ProtoReflect.Descriptor instead.
-func (*ControllerToCmdToolWrapper) Descriptor() ([]byte, []int) {
-	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{18}
+// Deprecated: Use CommandAck.ProtoReflect.Descriptor instead.
+func (*CommandAck) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{20}
 }
 
-func (m *ControllerToCmdToolWrapper) GetEvent() isControllerToCmdToolWrapper_Event {
-	if m != nil {
-		return m.Event
+func (x *CommandAck) GetId() string {
+	if x != nil {
+		return x.Id
 	}
-	return nil
+	return ""
 }
 
-func (x *ControllerToCmdToolWrapper) GetCommandTermination() *CmdToolCommandTermination {
-	if x, ok := x.GetEvent().(*ControllerToCmdToolWrapper_CommandTermination); ok {
-		return x.CommandTermination
+func (x *CommandAck) GetConsumed() uint64 {
+	if x != nil {
+		return x.Consumed
 	}
-	return nil
+	return 0
 }
 
-func (x *ControllerToCmdToolWrapper) GetCommandData() *CmdToolCommandData {
-	if x, ok := x.GetEvent().(*ControllerToCmdToolWrapper_CommandData); ok {
-		return x.CommandData
-	}
-	return nil
-}
+// A simplified message, used for command-tool <-> controller communication.
+// The command is the one started on this stream.
+type CmdToolCommandAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
 
-type isControllerToCmdToolWrapper_Event interface {
-	isControllerToCmdToolWrapper_Event()
+	Consumed uint64 `protobuf:"varint,1,opt,name=consumed,proto3" json:"consumed,omitempty"`
 }
 
-type ControllerToCmdToolWrapper_CommandTermination struct {
-	CommandTermination *CmdToolCommandTermination `protobuf:"bytes,1,opt,name=commandTermination,proto3,oneof"`
+func (x *CmdToolCommandAck) Reset() {
+	*x = CmdToolCommandAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[21]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
 }
 
-type ControllerToCmdToolWrapper_CommandData struct {
-	CommandData *CmdToolCommandData `protobuf:"bytes,2,opt,name=commandData,proto3,oneof"`
+func (x *CmdToolCommandAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ControllerToCmdToolWrapper_CommandTermination) isControllerToCmdToolWrapper_Event() {}
+func (*CmdToolCommandAck) ProtoMessage() {}
 
-func (*ControllerToCmdToolWrapper_CommandData) isControllerToCmdToolWrapper_Event() {}
+func (x *CmdToolCommandAck) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[21]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
 
-var File_pkg_tunnel_tunnel_proto protoreflect.FileDescriptor
+// Deprecated: Use CmdToolCommandAck.ProtoReflect.Descriptor instead.
+func (*CmdToolCommandAck) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{21}
+}
 
-var file_pkg_tunnel_tunnel_proto_rawDesc = []byte{
-	0x0a, 0x17, 0x70, 0x6b, 0x67, 0x2f, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2f, 0x74, 0x75, 0x6e,
+func (x *CmdToolCommandAck) GetConsumed() uint64 {
+	if x != nil {
+		return x.Consumed
+	}
+	return 0
+}
+
+type CommandTermination struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id       string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	ExitCode int32  `protobuf:"varint,2,opt,name=exitCode,proto3" json:"exitCode,omitempty"`
+	Message  string `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+}
+
+func (x *CommandTermination) Reset() {
+	*x = CommandTermination{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[22]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CommandTermination) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommandTermination) ProtoMessage() {}
+
+func (x *CommandTermination) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[22]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommandTermination.ProtoReflect.Descriptor instead.
+func (*CommandTermination) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *CommandTermination) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *CommandTermination) GetExitCode() int32 {
+	if x != nil {
+		return x.ExitCode
+	}
+	return 0
+}
+
+func (x *CommandTermination) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+// A simplified message, used for command-tool <-> controller communication.
+// This does not have the "id" or "target" field, as these are set by
+// the controller based on authentication used.
+type CmdToolCommandTermination struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ExitCode int32  `protobuf:"varint,1,opt,name=exitCode,proto3" json:"exitCode,omitempty"`
+	Message  string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+}
+
+func (x *CmdToolCommandTermination) Reset() {
+	*x = CmdToolCommandTermination{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[23]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CmdToolCommandTermination) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CmdToolCommandTermination) ProtoMessage() {}
+
+func (x *CmdToolCommandTermination) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[23]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CmdToolCommandTermination.ProtoReflect.Descriptor instead.
+func (*CmdToolCommandTermination) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *CmdToolCommandTermination) GetExitCode() int32 {
+	if x != nil {
+		return x.ExitCode
+	}
+	return 0
+}
+
+func (x *CmdToolCommandTermination) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+// Sent by the controller to fetch a file from the agent.  path is absolute,
+// and must be within a directory the agent allows files to be fetched
+// from.  window limits the unacknowledged bytes sent, as for a command's
+// output, with CommandAck.  CommandCancel stops the transfer.
+type FileRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id     string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Path   string `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+	Window uint64 `protobuf:"varint,3,opt,name=window,proto3" json:"window,omitempty"`
+}
+
+func (x *FileRequest) Reset() {
+	*x = FileRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[24]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FileRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileRequest) ProtoMessage() {}
+
+func (x *FileRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[24]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileRequest.ProtoReflect.Descriptor instead.
+func (*FileRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *FileRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *FileRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *FileRequest) GetWindow() uint64 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+// A simplified message, used for command-tool <-> controller communication.
+// This does not have the "id" field, as it is set by the controller.
+type CmdToolFileRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Path   string `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Window uint64 `protobuf:"varint,2,opt,name=window,proto3" json:"window,omitempty"`
+}
+
+func (x *CmdToolFileRequest) Reset() {
+	*x = CmdToolFileRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[25]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CmdToolFileRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CmdToolFileRequest) ProtoMessage() {}
+
+func (x *CmdToolFileRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[25]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CmdToolFileRequest.ProtoReflect.Descriptor instead.
+func (*CmdToolFileRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *CmdToolFileRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *CmdToolFileRequest) GetWindow() uint64 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+// The next piece of a file, in order.
+type FileChunk struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+}
+
+func (x *FileChunk) Reset() {
+	*x = FileChunk{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[26]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FileChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileChunk) ProtoMessage() {}
+
+func (x *FileChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[26]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileChunk.ProtoReflect.Descriptor instead.
+func (*FileChunk) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *FileChunk) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *FileChunk) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+// A simplified message, used for command-tool <-> controller communication.
+type CmdToolFileChunk struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Body []byte `protobuf:"bytes,1,opt,name=body,proto3" json:"body,omitempty"`
+}
+
+func (x *CmdToolFileChunk) Reset() {
+	*x = CmdToolFileChunk{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[27]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CmdToolFileChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CmdToolFileChunk) ProtoMessage() {}
+
+func (x *CmdToolFileChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[27]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CmdToolFileChunk.ProtoReflect.Descriptor instead.
+func (*CmdToolFileChunk) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{27}
+}
+
+func (x *CmdToolFileChunk) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+// Sent once the whole file has been sent, with its size and SHA-256, or
+// instead with an error if the file could not be sent.
+type FileTermination struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id     string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Size   uint64 `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	Sha256 []byte `protobuf:"bytes,3,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Error  string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *FileTermination) Reset() {
+	*x = FileTermination{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[28]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FileTermination) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileTermination) ProtoMessage() {}
+
+func (x *FileTermination) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[28]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileTermination.ProtoReflect.Descriptor instead.
+func (*FileTermination) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{28}
+}
+
+func (x *FileTermination) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *FileTermination) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *FileTermination) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+func (x *FileTermination) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+// A simplified message, used for command-tool <-> controller communication.
+type CmdToolFileTermination struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Size   uint64 `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	Sha256 []byte `protobuf:"bytes,2,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Error  string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *CmdToolFileTermination) Reset() {
+	*x = CmdToolFileTermination{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[29]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CmdToolFileTermination) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CmdToolFileTermination) ProtoMessage() {}
+
+func (x *CmdToolFileTermination) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[29]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CmdToolFileTermination.ProtoReflect.Descriptor instead.
+func (*CmdToolFileTermination) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{29}
+}
+
+func (x *CmdToolFileTermination) GetSize() uint64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *CmdToolFileTermination) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
+func (x *CmdToolFileTermination) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type EndpointHealth struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name       string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Type       string   `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Configured bool     `protobuf:"varint,3,opt,name=configured,proto3" json:"configured,omitempty"`
+	Namespaces []string `protobuf:"bytes,4,rep,name=namespaces,proto3" json:"namespaces,omitempty"`
+	// One of the TLSMode constants, or empty if the agent does not say.
+	TlsMode string `protobuf:"bytes,5,opt,name=tlsMode,proto3" json:"tlsMode,omitempty"`
+}
+
+func (x *EndpointHealth) Reset() {
+	*x = EndpointHealth{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[30]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EndpointHealth) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndpointHealth) ProtoMessage() {}
+
+func (x *EndpointHealth) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[30]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndpointHealth.ProtoReflect.Descriptor instead.
+func (*EndpointHealth) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{30}
+}
+
+func (x *EndpointHealth) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *EndpointHealth) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *EndpointHealth) GetConfigured() bool {
+	if x != nil {
+		return x.Configured
+	}
+	return false
+}
+
+func (x *EndpointHealth) GetNamespaces() []string {
+	if x != nil {
+		return x.Namespaces
+	}
+	return nil
+}
+
+func (x *EndpointHealth) GetTlsMode() string {
+	if x != nil {
+		return x.TlsMode
+	}
+	return ""
+}
+
+type AgentHello struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Endpoints []*EndpointHealth `protobuf:"bytes,1,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+	Version   string            `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Hostname  string            `protobuf:"bytes,3,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Commit    string            `protobuf:"bytes,4,opt,name=commit,proto3" json:"commit,omitempty"`
+	BuildDate string            `protobuf:"bytes,5,opt,name=buildDate,proto3" json:"buildDate,omitempty"`
+	// The largest response body chunk the agent sends, and how many of a
+	// response's chunks it buffers before waiting for them to be sent.
+	// Both are zero from agents which do not report them.
+	ResponseChunkSize      uint32 `protobuf:"varint,6,opt,name=responseChunkSize,proto3" json:"responseChunkSize,omitempty"`
+	ResponseChunksInFlight uint32 `protobuf:"varint,7,opt,name=responseChunksInFlight,proto3" json:"responseChunksInFlight,omitempty"`
+	// Set by agents which answer PingRequests from the controller.
+	AnswersPings bool `protobuf:"varint,8,opt,name=answersPings,proto3" json:"answersPings,omitempty"`
+	// Set by agents which pause responses on HttpFlowControl.
+	AcceptsFlowControl bool `protobuf:"varint,9,opt,name=acceptsFlowControl,proto3" json:"acceptsFlowControl,omitempty"`
+}
+
+func (x *AgentHello) Reset() {
+	*x = AgentHello{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[31]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AgentHello) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentHello) ProtoMessage() {}
+
+func (x *AgentHello) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[31]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentHello.ProtoReflect.Descriptor instead.
+func (*AgentHello) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{31}
+}
+
+func (x *AgentHello) GetEndpoints() []*EndpointHealth {
+	if x != nil {
+		return x.Endpoints
+	}
+	return nil
+}
+
+func (x *AgentHello) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *AgentHello) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *AgentHello) GetCommit() string {
+	if x != nil {
+		return x.Commit
+	}
+	return ""
+}
+
+func (x *AgentHello) GetBuildDate() string {
+	if x != nil {
+		return x.BuildDate
+	}
+	return ""
+}
+
+func (x *AgentHello) GetResponseChunkSize() uint32 {
+	if x != nil {
+		return x.ResponseChunkSize
+	}
+	return 0
+}
+
+func (x *AgentHello) GetResponseChunksInFlight() uint32 {
+	if x != nil {
+		return x.ResponseChunksInFlight
+	}
+	return 0
+}
+
+func (x *AgentHello) GetAnswersPings() bool {
+	if x != nil {
+		return x.AnswersPings
+	}
+	return false
+}
+
+func (x *AgentHello) GetAcceptsFlowControl() bool {
+	if x != nil {
+		return x.AcceptsFlowControl
+	}
+	return false
+}
+
+// Sent by the agent when its endpoints change after the hello, as when its
+// configuration is reloaded.  The list replaces the one sent before.
+type EndpointsUpdate struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Endpoints []*EndpointHealth `protobuf:"bytes,1,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+}
+
+func (x *EndpointsUpdate) Reset() {
+	*x = EndpointsUpdate{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[32]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EndpointsUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndpointsUpdate) ProtoMessage() {}
+
+func (x *EndpointsUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[32]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndpointsUpdate.ProtoReflect.Descriptor instead.
+func (*EndpointsUpdate) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{32}
+}
+
+func (x *EndpointsUpdate) GetEndpoints() []*EndpointHealth {
+	if x != nil {
+		return x.Endpoints
+	}
+	return nil
+}
+
+// Sent by the controller when it is shutting down.  No new requests will
+// be sent on this stream, and it will be closed once in-flight requests
+// complete or the controller's grace period expires.
+type ControllerDraining struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Ts uint64 `protobuf:"varint,1,opt,name=ts,proto3" json:"ts,omitempty"`
+}
+
+func (x *ControllerDraining) Reset() {
+	*x = ControllerDraining{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[33]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ControllerDraining) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ControllerDraining) ProtoMessage() {}
+
+func (x *ControllerDraining) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[33]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ControllerDraining.ProtoReflect.Descriptor instead.
+func (*ControllerDraining) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{33}
+}
+
+func (x *ControllerDraining) GetTs() uint64 {
+	if x != nil {
+		return x.Ts
+	}
+	return 0
+}
+
+// Sent by the controller when a newer session of the same agent has
+// replaced this one.  The stream is closed immediately afterwards.
+type AgentReplaced struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Ts uint64 `protobuf:"varint,1,opt,name=ts,proto3" json:"ts,omitempty"`
+}
+
+func (x *AgentReplaced) Reset() {
+	*x = AgentReplaced{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[34]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AgentReplaced) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentReplaced) ProtoMessage() {}
+
+func (x *AgentReplaced) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[34]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentReplaced.ProtoReflect.Descriptor instead.
+func (*AgentReplaced) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{34}
+}
+
+func (x *AgentReplaced) GetTs() uint64 {
+	if x != nil {
+		return x.Ts
+	}
+	return 0
+}
+
+// Messages sent from server to agent
+type ControllerToAgentWrapper struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Event:
+	//	*ControllerToAgentWrapper_PingResponse
+	//	*ControllerToAgentWrapper_HttpRequest
+	//	*ControllerToAgentWrapper_CancelRequest
+	//	*ControllerToAgentWrapper_CommandRequest
+	//	*ControllerToAgentWrapper_CommandData
+	//	*ControllerToAgentWrapper_HttpRequestChunk
+	//	*ControllerToAgentWrapper_ControllerDraining
+	//	*ControllerToAgentWrapper_StreamOpen
+	//	*ControllerToAgentWrapper_StreamData
+	//	*ControllerToAgentWrapper_StreamClose
+	//	*ControllerToAgentWrapper_CommandCancel
+	//	*ControllerToAgentWrapper_AgentReplaced
+	//	*ControllerToAgentWrapper_CommandAck
+	//	*ControllerToAgentWrapper_FileRequest
+	//	*ControllerToAgentWrapper_PingRequest
+	//	*ControllerToAgentWrapper_HttpFlowControl
+	Event isControllerToAgentWrapper_Event `protobuf_oneof:"event"`
+}
+
+func (x *ControllerToAgentWrapper) Reset() {
+	*x = ControllerToAgentWrapper{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[35]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ControllerToAgentWrapper) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ControllerToAgentWrapper) ProtoMessage() {}
+
+func (x *ControllerToAgentWrapper) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[35]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ControllerToAgentWrapper.ProtoReflect.Descriptor instead.
+func (*ControllerToAgentWrapper) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{35}
+}
+
+func (m *ControllerToAgentWrapper) GetEvent() isControllerToAgentWrapper_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetPingResponse() *PingResponse {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_PingResponse); ok {
+		return x.PingResponse
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetHttpRequest() *HttpRequest {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_HttpRequest); ok {
+		return x.HttpRequest
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetCancelRequest() *CancelRequest {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CancelRequest); ok {
+		return x.CancelRequest
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetCommandRequest() *CommandRequest {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CommandRequest); ok {
+		return x.CommandRequest
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetCommandData() *CommandData {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CommandData); ok {
+		return x.CommandData
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetHttpRequestChunk() *HttpRequestChunk {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_HttpRequestChunk); ok {
+		return x.HttpRequestChunk
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetControllerDraining() *ControllerDraining {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_ControllerDraining); ok {
+		return x.ControllerDraining
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetStreamOpen() *StreamOpen {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_StreamOpen); ok {
+		return x.StreamOpen
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetStreamData() *StreamData {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_StreamData); ok {
+		return x.StreamData
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetStreamClose() *StreamClose {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_StreamClose); ok {
+		return x.StreamClose
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetCommandCancel() *CommandCancel {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CommandCancel); ok {
+		return x.CommandCancel
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetAgentReplaced() *AgentReplaced {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_AgentReplaced); ok {
+		return x.AgentReplaced
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetCommandAck() *CommandAck {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_CommandAck); ok {
+		return x.CommandAck
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetFileRequest() *FileRequest {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_FileRequest); ok {
+		return x.FileRequest
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetPingRequest() *PingRequest {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_PingRequest); ok {
+		return x.PingRequest
+	}
+	return nil
+}
+
+func (x *ControllerToAgentWrapper) GetHttpFlowControl() *HttpFlowControl {
+	if x, ok := x.GetEvent().(*ControllerToAgentWrapper_HttpFlowControl); ok {
+		return x.HttpFlowControl
+	}
+	return nil
+}
+
+type isControllerToAgentWrapper_Event interface {
+	isControllerToAgentWrapper_Event()
+}
+
+type ControllerToAgentWrapper_PingResponse struct {
+	PingResponse *PingResponse `protobuf:"bytes,1,opt,name=pingResponse,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_HttpRequest struct {
+	HttpRequest *HttpRequest `protobuf:"bytes,2,opt,name=httpRequest,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_CancelRequest struct {
+	CancelRequest *CancelRequest `protobuf:"bytes,3,opt,name=cancelRequest,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_CommandRequest struct {
+	CommandRequest *CommandRequest `protobuf:"bytes,4,opt,name=commandRequest,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_CommandData struct {
+	CommandData *CommandData `protobuf:"bytes,5,opt,name=commandData,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_HttpRequestChunk struct {
+	HttpRequestChunk *HttpRequestChunk `protobuf:"bytes,6,opt,name=httpRequestChunk,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_ControllerDraining struct {
+	ControllerDraining *ControllerDraining `protobuf:"bytes,7,opt,name=controllerDraining,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_StreamOpen struct {
+	StreamOpen *StreamOpen `protobuf:"bytes,8,opt,name=streamOpen,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_StreamData struct {
+	StreamData *StreamData `protobuf:"bytes,9,opt,name=streamData,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_StreamClose struct {
+	StreamClose *StreamClose `protobuf:"bytes,10,opt,name=streamClose,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_CommandCancel struct {
+	CommandCancel *CommandCancel `protobuf:"bytes,11,opt,name=commandCancel,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_AgentReplaced struct {
+	AgentReplaced *AgentReplaced `protobuf:"bytes,12,opt,name=agentReplaced,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_CommandAck struct {
+	CommandAck *CommandAck `protobuf:"bytes,13,opt,name=commandAck,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_FileRequest struct {
+	FileRequest *FileRequest `protobuf:"bytes,14,opt,name=fileRequest,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_PingRequest struct {
+	PingRequest *PingRequest `protobuf:"bytes,15,opt,name=pingRequest,proto3,oneof"`
+}
+
+type ControllerToAgentWrapper_HttpFlowControl struct {
+	HttpFlowControl *HttpFlowControl `protobuf:"bytes,16,opt,name=httpFlowControl,proto3,oneof"`
+}
+
+func (*ControllerToAgentWrapper_PingResponse) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_HttpRequest) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_CancelRequest) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_CommandRequest) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_CommandData) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_HttpRequestChunk) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_ControllerDraining) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_StreamOpen) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_StreamData) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_StreamClose) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_CommandCancel) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_AgentReplaced) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_CommandAck) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_FileRequest) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_PingRequest) isControllerToAgentWrapper_Event() {}
+
+func (*ControllerToAgentWrapper_HttpFlowControl) isControllerToAgentWrapper_Event() {}
+
+// Messages sent from agent to server
+type AgentToControllerWrapper struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Event:
+	//	*AgentToControllerWrapper_PingRequest
+	//	*AgentToControllerWrapper_HttpResponse
+	//	*AgentToControllerWrapper_HttpChunkedResponse
+	//	*AgentToControllerWrapper_AgentHello
+	//	*AgentToControllerWrapper_CommandData
+	//	*AgentToControllerWrapper_CommandTermination
+	//	*AgentToControllerWrapper_HttpError
+	//	*AgentToControllerWrapper_StreamData
+	//	*AgentToControllerWrapper_StreamClose
+	//	*AgentToControllerWrapper_CancelAck
+	//	*AgentToControllerWrapper_EndpointsUpdate
+	//	*AgentToControllerWrapper_FileChunk
+	//	*AgentToControllerWrapper_FileTermination
+	//	*AgentToControllerWrapper_PingResponse
+	Event isAgentToControllerWrapper_Event `protobuf_oneof:"event"`
+}
+
+func (x *AgentToControllerWrapper) Reset() {
+	*x = AgentToControllerWrapper{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[36]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AgentToControllerWrapper) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentToControllerWrapper) ProtoMessage() {}
+
+func (x *AgentToControllerWrapper) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[36]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentToControllerWrapper.ProtoReflect.Descriptor instead.
+func (*AgentToControllerWrapper) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{36}
+}
+
+func (m *AgentToControllerWrapper) GetEvent() isAgentToControllerWrapper_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetPingRequest() *PingRequest {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_PingRequest); ok {
+		return x.PingRequest
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetHttpResponse() *HttpResponse {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_HttpResponse); ok {
+		return x.HttpResponse
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetHttpChunkedResponse() *HttpChunkedResponse {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_HttpChunkedResponse); ok {
+		return x.HttpChunkedResponse
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetAgentHello() *AgentHello {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_AgentHello); ok {
+		return x.AgentHello
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetCommandData() *CommandData {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_CommandData); ok {
+		return x.CommandData
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetCommandTermination() *CommandTermination {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_CommandTermination); ok {
+		return x.CommandTermination
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetHttpError() *HttpError {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_HttpError); ok {
+		return x.HttpError
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetStreamData() *StreamData {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_StreamData); ok {
+		return x.StreamData
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetStreamClose() *StreamClose {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_StreamClose); ok {
+		return x.StreamClose
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetCancelAck() *CancelAck {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_CancelAck); ok {
+		return x.CancelAck
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetEndpointsUpdate() *EndpointsUpdate {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_EndpointsUpdate); ok {
+		return x.EndpointsUpdate
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetFileChunk() *FileChunk {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_FileChunk); ok {
+		return x.FileChunk
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetFileTermination() *FileTermination {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_FileTermination); ok {
+		return x.FileTermination
+	}
+	return nil
+}
+
+func (x *AgentToControllerWrapper) GetPingResponse() *PingResponse {
+	if x, ok := x.GetEvent().(*AgentToControllerWrapper_PingResponse); ok {
+		return x.PingResponse
+	}
+	return nil
+}
+
+type isAgentToControllerWrapper_Event interface {
+	isAgentToControllerWrapper_Event()
+}
+
+type AgentToControllerWrapper_PingRequest struct {
+	PingRequest *PingRequest `protobuf:"bytes,1,opt,name=pingRequest,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_HttpResponse struct {
+	HttpResponse *HttpResponse `protobuf:"bytes,2,opt,name=httpResponse,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_HttpChunkedResponse struct {
+	HttpChunkedResponse *HttpChunkedResponse `protobuf:"bytes,3,opt,name=httpChunkedResponse,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_AgentHello struct {
+	AgentHello *AgentHello `protobuf:"bytes,4,opt,name=agentHello,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_CommandData struct {
+	CommandData *CommandData `protobuf:"bytes,5,opt,name=commandData,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_CommandTermination struct {
+	CommandTermination *CommandTermination `protobuf:"bytes,6,opt,name=commandTermination,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_HttpError struct {
+	HttpError *HttpError `protobuf:"bytes,7,opt,name=httpError,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_StreamData struct {
+	StreamData *StreamData `protobuf:"bytes,8,opt,name=streamData,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_StreamClose struct {
+	StreamClose *StreamClose `protobuf:"bytes,9,opt,name=streamClose,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_CancelAck struct {
+	CancelAck *CancelAck `protobuf:"bytes,10,opt,name=cancelAck,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_EndpointsUpdate struct {
+	EndpointsUpdate *EndpointsUpdate `protobuf:"bytes,11,opt,name=endpointsUpdate,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_FileChunk struct {
+	FileChunk *FileChunk `protobuf:"bytes,12,opt,name=fileChunk,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_FileTermination struct {
+	FileTermination *FileTermination `protobuf:"bytes,13,opt,name=fileTermination,proto3,oneof"`
+}
+
+type AgentToControllerWrapper_PingResponse struct {
+	PingResponse *PingResponse `protobuf:"bytes,14,opt,name=pingResponse,proto3,oneof"`
+}
+
+func (*AgentToControllerWrapper_PingRequest) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_HttpResponse) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_HttpChunkedResponse) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_AgentHello) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_CommandData) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_CommandTermination) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_HttpError) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_StreamData) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_StreamClose) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_CancelAck) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_EndpointsUpdate) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_FileChunk) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_FileTermination) isAgentToControllerWrapper_Event() {}
+
+func (*AgentToControllerWrapper_PingResponse) isAgentToControllerWrapper_Event() {}
+
+// Messages sent from command-tool to controller
+type CmdToolToControllerWrapper struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Event:
+	//	*CmdToolToControllerWrapper_CommandRequest
+	//	*CmdToolToControllerWrapper_CommandData
+	//	*CmdToolToControllerWrapper_CommandCancel
+	//	*CmdToolToControllerWrapper_CommandAck
+	//	*CmdToolToControllerWrapper_FileRequest
+	Event isCmdToolToControllerWrapper_Event `protobuf_oneof:"event"`
+}
+
+func (x *CmdToolToControllerWrapper) Reset() {
+	*x = CmdToolToControllerWrapper{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[37]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CmdToolToControllerWrapper) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CmdToolToControllerWrapper) ProtoMessage() {}
+
+func (x *CmdToolToControllerWrapper) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[37]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CmdToolToControllerWrapper.ProtoReflect.Descriptor instead.
+func (*CmdToolToControllerWrapper) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{37}
+}
+
+func (m *CmdToolToControllerWrapper) GetEvent() isCmdToolToControllerWrapper_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (x *CmdToolToControllerWrapper) GetCommandRequest() *CmdToolCommandRequest {
+	if x, ok := x.GetEvent().(*CmdToolToControllerWrapper_CommandRequest); ok {
+		return x.CommandRequest
+	}
+	return nil
+}
+
+func (x *CmdToolToControllerWrapper) GetCommandData() *CmdToolCommandData {
+	if x, ok := x.GetEvent().(*CmdToolToControllerWrapper_CommandData); ok {
+		return x.CommandData
+	}
+	return nil
+}
+
+func (x *CmdToolToControllerWrapper) GetCommandCancel() *CmdToolCommandCancel {
+	if x, ok := x.GetEvent().(*CmdToolToControllerWrapper_CommandCancel); ok {
+		return x.CommandCancel
+	}
+	return nil
+}
+
+func (x *CmdToolToControllerWrapper) GetCommandAck() *CmdToolCommandAck {
+	if x, ok := x.GetEvent().(*CmdToolToControllerWrapper_CommandAck); ok {
+		return x.CommandAck
+	}
+	return nil
+}
+
+func (x *CmdToolToControllerWrapper) GetFileRequest() *CmdToolFileRequest {
+	if x, ok := x.GetEvent().(*CmdToolToControllerWrapper_FileRequest); ok {
+		return x.FileRequest
+	}
+	return nil
+}
+
+type isCmdToolToControllerWrapper_Event interface {
+	isCmdToolToControllerWrapper_Event()
+}
+
+type CmdToolToControllerWrapper_CommandRequest struct {
+	CommandRequest *CmdToolCommandRequest `protobuf:"bytes,1,opt,name=commandRequest,proto3,oneof"`
+}
+
+type CmdToolToControllerWrapper_CommandData struct {
+	CommandData *CmdToolCommandData `protobuf:"bytes,2,opt,name=commandData,proto3,oneof"`
+}
+
+type CmdToolToControllerWrapper_CommandCancel struct {
+	CommandCancel *CmdToolCommandCancel `protobuf:"bytes,3,opt,name=commandCancel,proto3,oneof"`
+}
+
+type CmdToolToControllerWrapper_CommandAck struct {
+	CommandAck *CmdToolCommandAck `protobuf:"bytes,4,opt,name=commandAck,proto3,oneof"`
+}
+
+type CmdToolToControllerWrapper_FileRequest struct {
+	FileRequest *CmdToolFileRequest `protobuf:"bytes,5,opt,name=fileRequest,proto3,oneof"`
+}
+
+func (*CmdToolToControllerWrapper_CommandRequest) isCmdToolToControllerWrapper_Event() {}
+
+func (*CmdToolToControllerWrapper_CommandData) isCmdToolToControllerWrapper_Event() {}
+
+func (*CmdToolToControllerWrapper_CommandCancel) isCmdToolToControllerWrapper_Event() {}
+
+func (*CmdToolToControllerWrapper_CommandAck) isCmdToolToControllerWrapper_Event() {}
+
+func (*CmdToolToControllerWrapper_FileRequest) isCmdToolToControllerWrapper_Event() {}
+
+// Messages sent from the controller to the command-tool
+type ControllerToCmdToolWrapper struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Event:
+	//	*ControllerToCmdToolWrapper_CommandTermination
+	//	*ControllerToCmdToolWrapper_CommandData
+	//	*ControllerToCmdToolWrapper_FileChunk
+	//	*ControllerToCmdToolWrapper_FileTermination
+	Event isControllerToCmdToolWrapper_Event `protobuf_oneof:"event"`
+}
+
+func (x *ControllerToCmdToolWrapper) Reset() {
+	*x = ControllerToCmdToolWrapper{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[38]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ControllerToCmdToolWrapper) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ControllerToCmdToolWrapper) ProtoMessage() {}
+
+func (x *ControllerToCmdToolWrapper) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[38]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ControllerToCmdToolWrapper.ProtoReflect.Descriptor instead.
+func (*ControllerToCmdToolWrapper) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{38}
+}
+
+func (m *ControllerToCmdToolWrapper) GetEvent() isControllerToCmdToolWrapper_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (x *ControllerToCmdToolWrapper) GetCommandTermination() *CmdToolCommandTermination {
+	if x, ok := x.GetEvent().(*ControllerToCmdToolWrapper_CommandTermination); ok {
+		return x.CommandTermination
+	}
+	return nil
+}
+
+func (x *ControllerToCmdToolWrapper) GetCommandData() *CmdToolCommandData {
+	if x, ok := x.GetEvent().(*ControllerToCmdToolWrapper_CommandData); ok {
+		return x.CommandData
+	}
+	return nil
+}
+
+func (x *ControllerToCmdToolWrapper) GetFileChunk() *CmdToolFileChunk {
+	if x, ok := x.GetEvent().(*ControllerToCmdToolWrapper_FileChunk); ok {
+		return x.FileChunk
+	}
+	return nil
+}
+
+func (x *ControllerToCmdToolWrapper) GetFileTermination() *CmdToolFileTermination {
+	if x, ok := x.GetEvent().(*ControllerToCmdToolWrapper_FileTermination); ok {
+		return x.FileTermination
+	}
+	return nil
+}
+
+type isControllerToCmdToolWrapper_Event interface {
+	isControllerToCmdToolWrapper_Event()
+}
+
+type ControllerToCmdToolWrapper_CommandTermination struct {
+	CommandTermination *CmdToolCommandTermination `protobuf:"bytes,1,opt,name=commandTermination,proto3,oneof"`
+}
+
+type ControllerToCmdToolWrapper_CommandData struct {
+	CommandData *CmdToolCommandData `protobuf:"bytes,2,opt,name=commandData,proto3,oneof"`
+}
+
+type ControllerToCmdToolWrapper_FileChunk struct {
+	FileChunk *CmdToolFileChunk `protobuf:"bytes,3,opt,name=fileChunk,proto3,oneof"`
+}
+
+type ControllerToCmdToolWrapper_FileTermination struct {
+	FileTermination *CmdToolFileTermination `protobuf:"bytes,4,opt,name=fileTermination,proto3,oneof"`
+}
+
+func (*ControllerToCmdToolWrapper_CommandTermination) isControllerToCmdToolWrapper_Event() {}
+
+func (*ControllerToCmdToolWrapper_CommandData) isControllerToCmdToolWrapper_Event() {}
+
+func (*ControllerToCmdToolWrapper_FileChunk) isControllerToCmdToolWrapper_Event() {}
+
+func (*ControllerToCmdToolWrapper_FileTermination) isControllerToCmdToolWrapper_Event() {}
+
+// An agent session directly connected to a peer controller.
+type PeerAgent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name      string            `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Session   string            `protobuf:"bytes,2,opt,name=session,proto3" json:"session,omitempty"`
+	Endpoints []*EndpointHealth `protobuf:"bytes,3,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+	Version   string            `protobuf:"bytes,4,opt,name=version,proto3" json:"version,omitempty"`
+	Commit    string            `protobuf:"bytes,5,opt,name=commit,proto3" json:"commit,omitempty"`
+	BuildDate string            `protobuf:"bytes,6,opt,name=buildDate,proto3" json:"buildDate,omitempty"`
+}
+
+func (x *PeerAgent) Reset() {
+	*x = PeerAgent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[39]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PeerAgent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerAgent) ProtoMessage() {}
+
+func (x *PeerAgent) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[39]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerAgent.ProtoReflect.Descriptor instead.
+func (*PeerAgent) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{39}
+}
+
+func (x *PeerAgent) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *PeerAgent) GetSession() string {
+	if x != nil {
+		return x.Session
+	}
+	return ""
+}
+
+func (x *PeerAgent) GetEndpoints() []*EndpointHealth {
+	if x != nil {
+		return x.Endpoints
+	}
+	return nil
+}
+
+func (x *PeerAgent) GetVersion() string {
+	if x != nil {
+		return x.Version
+	}
+	return ""
+}
+
+func (x *PeerAgent) GetCommit() string {
+	if x != nil {
+		return x.Commit
+	}
+	return ""
+}
+
+func (x *PeerAgent) GetBuildDate() string {
+	if x != nil {
+		return x.BuildDate
+	}
+	return ""
+}
+
+// Sent by each peer controller when its directly connected agents change.
+// The list replaces any previously advertised.
+type PeerAdvertisement struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Agents []*PeerAgent `protobuf:"bytes,1,rep,name=agents,proto3" json:"agents,omitempty"`
+}
+
+func (x *PeerAdvertisement) Reset() {
+	*x = PeerAdvertisement{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[40]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PeerAdvertisement) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerAdvertisement) ProtoMessage() {}
+
+func (x *PeerAdvertisement) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[40]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerAdvertisement.ProtoReflect.Descriptor instead.
+func (*PeerAdvertisement) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{40}
+}
+
+func (x *PeerAdvertisement) GetAgents() []*PeerAgent {
+	if x != nil {
+		return x.Agents
+	}
+	return nil
+}
+
+// A request forwarded to a peer controller for one of the agents it
+// advertised.  hops counts the controllers which have forwarded it, and
+// a peer only delivers requests to its directly connected agents.
+type PeerHttpRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	AgentName string       `protobuf:"bytes,1,opt,name=agentName,proto3" json:"agentName,omitempty"`
+	Request   *HttpRequest `protobuf:"bytes,2,opt,name=request,proto3" json:"request,omitempty"`
+	Hops      uint32       `protobuf:"varint,3,opt,name=hops,proto3" json:"hops,omitempty"`
+}
+
+func (x *PeerHttpRequest) Reset() {
+	*x = PeerHttpRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[41]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PeerHttpRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerHttpRequest) ProtoMessage() {}
+
+func (x *PeerHttpRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[41]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerHttpRequest.ProtoReflect.Descriptor instead.
+func (*PeerHttpRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{41}
+}
+
+func (x *PeerHttpRequest) GetAgentName() string {
+	if x != nil {
+		return x.AgentName
+	}
+	return ""
+}
+
+func (x *PeerHttpRequest) GetRequest() *HttpRequest {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *PeerHttpRequest) GetHops() uint32 {
+	if x != nil {
+		return x.Hops
+	}
+	return 0
+}
+
+// Messages sent in either direction between peer controllers
+type PeerWrapper struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Event:
+	//	*PeerWrapper_Advertisement
+	//	*PeerWrapper_HttpRequest
+	//	*PeerWrapper_HttpRequestChunk
+	//	*PeerWrapper_CancelRequest
+	//	*PeerWrapper_HttpResponse
+	//	*PeerWrapper_HttpChunkedResponse
+	//	*PeerWrapper_HttpError
+	Event isPeerWrapper_Event `protobuf_oneof:"event"`
+}
+
+func (x *PeerWrapper) Reset() {
+	*x = PeerWrapper{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[42]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PeerWrapper) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PeerWrapper) ProtoMessage() {}
+
+func (x *PeerWrapper) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[42]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PeerWrapper.ProtoReflect.Descriptor instead.
+func (*PeerWrapper) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{42}
+}
+
+func (m *PeerWrapper) GetEvent() isPeerWrapper_Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (x *PeerWrapper) GetAdvertisement() *PeerAdvertisement {
+	if x, ok := x.GetEvent().(*PeerWrapper_Advertisement); ok {
+		return x.Advertisement
+	}
+	return nil
+}
+
+func (x *PeerWrapper) GetHttpRequest() *PeerHttpRequest {
+	if x, ok := x.GetEvent().(*PeerWrapper_HttpRequest); ok {
+		return x.HttpRequest
+	}
+	return nil
+}
+
+func (x *PeerWrapper) GetHttpRequestChunk() *HttpRequestChunk {
+	if x, ok := x.GetEvent().(*PeerWrapper_HttpRequestChunk); ok {
+		return x.HttpRequestChunk
+	}
+	return nil
+}
+
+func (x *PeerWrapper) GetCancelRequest() *CancelRequest {
+	if x, ok := x.GetEvent().(*PeerWrapper_CancelRequest); ok {
+		return x.CancelRequest
+	}
+	return nil
+}
+
+func (x *PeerWrapper) GetHttpResponse() *HttpResponse {
+	if x, ok := x.GetEvent().(*PeerWrapper_HttpResponse); ok {
+		return x.HttpResponse
+	}
+	return nil
+}
+
+func (x *PeerWrapper) GetHttpChunkedResponse() *HttpChunkedResponse {
+	if x, ok := x.GetEvent().(*PeerWrapper_HttpChunkedResponse); ok {
+		return x.HttpChunkedResponse
+	}
+	return nil
+}
+
+func (x *PeerWrapper) GetHttpError() *HttpError {
+	if x, ok := x.GetEvent().(*PeerWrapper_HttpError); ok {
+		return x.HttpError
+	}
+	return nil
+}
+
+type isPeerWrapper_Event interface {
+	isPeerWrapper_Event()
+}
+
+type PeerWrapper_Advertisement struct {
+	Advertisement *PeerAdvertisement `protobuf:"bytes,1,opt,name=advertisement,proto3,oneof"`
+}
+
+type PeerWrapper_HttpRequest struct {
+	HttpRequest *PeerHttpRequest `protobuf:"bytes,2,opt,name=httpRequest,proto3,oneof"`
+}
+
+type PeerWrapper_HttpRequestChunk struct {
+	HttpRequestChunk *HttpRequestChunk `protobuf:"bytes,3,opt,name=httpRequestChunk,proto3,oneof"`
+}
+
+type PeerWrapper_CancelRequest struct {
+	CancelRequest *CancelRequest `protobuf:"bytes,4,opt,name=cancelRequest,proto3,oneof"`
+}
+
+type PeerWrapper_HttpResponse struct {
+	HttpResponse *HttpResponse `protobuf:"bytes,5,opt,name=httpResponse,proto3,oneof"`
+}
+
+type PeerWrapper_HttpChunkedResponse struct {
+	HttpChunkedResponse *HttpChunkedResponse `protobuf:"bytes,6,opt,name=httpChunkedResponse,proto3,oneof"`
+}
+
+type PeerWrapper_HttpError struct {
+	HttpError *HttpError `protobuf:"bytes,7,opt,name=httpError,proto3,oneof"`
+}
+
+func (*PeerWrapper_Advertisement) isPeerWrapper_Event() {}
+
+func (*PeerWrapper_HttpRequest) isPeerWrapper_Event() {}
+
+func (*PeerWrapper_HttpRequestChunk) isPeerWrapper_Event() {}
+
+func (*PeerWrapper_CancelRequest) isPeerWrapper_Event() {}
+
+func (*PeerWrapper_HttpResponse) isPeerWrapper_Event() {}
+
+func (*PeerWrapper_HttpChunkedResponse) isPeerWrapper_Event() {}
+
+func (*PeerWrapper_HttpError) isPeerWrapper_Event() {}
+
+// Sent by an agent whose certificate is near expiry, over a connection
+// authenticated by that certificate.  The controller issues a new one for
+// the same name.
+type CertificateRenewalRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *CertificateRenewalRequest) Reset() {
+	*x = CertificateRenewalRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[43]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CertificateRenewalRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CertificateRenewalRequest) ProtoMessage() {}
+
+func (x *CertificateRenewalRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[43]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CertificateRenewalRequest.ProtoReflect.Descriptor instead.
+func (*CertificateRenewalRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{43}
+}
+
+// The renewed certificate and its private key, and the CA certificate, as
+// PEM.  notAfter is when the certificate expires, in milliseconds since the
+// Unix epoch.
+type CertificateRenewalResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Certificate   []byte `protobuf:"bytes,1,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	Key           []byte `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	CaCertificate []byte `protobuf:"bytes,3,opt,name=caCertificate,proto3" json:"caCertificate,omitempty"`
+	NotAfter      uint64 `protobuf:"varint,4,opt,name=notAfter,proto3" json:"notAfter,omitempty"`
+}
+
+func (x *CertificateRenewalResponse) Reset() {
+	*x = CertificateRenewalResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_tunnel_tunnel_proto_msgTypes[44]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CertificateRenewalResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CertificateRenewalResponse) ProtoMessage() {}
+
+func (x *CertificateRenewalResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_tunnel_tunnel_proto_msgTypes[44]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CertificateRenewalResponse.ProtoReflect.Descriptor instead.
+func (*CertificateRenewalResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_tunnel_tunnel_proto_rawDescGZIP(), []int{44}
+}
+
+func (x *CertificateRenewalResponse) GetCertificate() []byte {
+	if x != nil {
+		return x.Certificate
+	}
+	return nil
+}
+
+func (x *CertificateRenewalResponse) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *CertificateRenewalResponse) GetCaCertificate() []byte {
+	if x != nil {
+		return x.CaCertificate
+	}
+	return nil
+}
+
+func (x *CertificateRenewalResponse) GetNotAfter() uint64 {
+	if x != nil {
+		return x.NotAfter
+	}
+	return 0
+}
+
+var File_pkg_tunnel_tunnel_proto protoreflect.FileDescriptor
+
+var file_pkg_tunnel_tunnel_proto_rawDesc = []byte{
+	0x0a, 0x17, 0x70, 0x6b, 0x67, 0x2f, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2f, 0x74, 0x75, 0x6e,
 	0x6e, 0x65, 0x6c, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06, 0x74, 0x75, 0x6e, 0x6e, 0x65,
 	0x6c, 0x22, 0x1d, 0x0a, 0x0b, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
 	0x12, 0x0e, 0x0a, 0x02, 0x74, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x74, 0x73,
-	0x22, 0x3a, 0x0a, 0x0c, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0x5a, 0x0a, 0x0c, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
 	0x12, 0x0e, 0x0a, 0x02, 0x74, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x74, 0x73,
 	0x12, 0x1a, 0x0a, 0x08, 0x65, 0x63, 0x68, 0x6f, 0x65, 0x64, 0x54, 0x73, 0x18, 0x02, 0x20, 0x01,
-	0x28, 0x04, 0x52, 0x08, 0x65, 0x63, 0x68, 0x6f, 0x65, 0x64, 0x54, 0x73, 0x22, 0x38, 0x0a, 0x0a,
+	0x28, 0x04, 0x52, 0x08, 0x65, 0x63, 0x68, 0x6f, 0x65, 0x64, 0x54, 0x73, 0x12, 0x1e, 0x0a, 0x0a,
+	0x72, 0x65, 0x63, 0x65, 0x69, 0x76, 0x65, 0x64, 0x54, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x0a, 0x72, 0x65, 0x63, 0x65, 0x69, 0x76, 0x65, 0x64, 0x54, 0x73, 0x22, 0x38, 0x0a, 0x0a,
 	0x48, 0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61,
 	0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16,
 	0x0a, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06,
-	0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x22, 0xb1, 0x01, 0x0a, 0x0b, 0x48, 0x74, 0x74, 0x70, 0x52,
+	0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x22, 0xd7, 0x01, 0x0a, 0x0b, 0x48, 0x74, 0x74, 0x70, 0x52,
 	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01,
 	0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02,
 	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x79,
@@ -1497,167 +3564,437 @@ var file_pkg_tunnel_tunnel_proto_rawDesc = []byte{
 	0x65, 0x72, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e,
 	0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x07, 0x68,
 	0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x07,
-	0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x22, 0x1f, 0x0a, 0x0d, 0x43, 0x61,
-	0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69,
-	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x22, 0x8a, 0x01, 0x0a, 0x0c,
-	0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02,
-	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x16, 0x0a, 0x06,
-	0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x73, 0x74,
-	0x61, 0x74, 0x75, 0x73, 0x12, 0x2c, 0x0a, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x18,
-	0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48,
-	0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65,
-	0x72, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e,
-	0x67, 0x74, 0x68, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x65,
-	0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22, 0x39, 0x0a, 0x13, 0x48, 0x74, 0x74, 0x70,
-	0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
-	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12,
-	0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62,
-	0x6f, 0x64, 0x79, 0x22, 0x74, 0x0a, 0x0e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x72, 0x67,
-	0x75, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x61, 0x72,
-	0x67, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x65, 0x6e, 0x76, 0x69, 0x72,
-	0x6f, 0x6e, 0x6d, 0x65, 0x6e, 0x74, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x65, 0x6e,
-	0x76, 0x69, 0x72, 0x6f, 0x6e, 0x6d, 0x65, 0x6e, 0x74, 0x22, 0x6b, 0x0a, 0x15, 0x43, 0x6d, 0x64,
-	0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x72, 0x67, 0x75, 0x6d, 0x65,
-	0x6e, 0x74, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x61, 0x72, 0x67, 0x75, 0x6d,
-	0x65, 0x6e, 0x74, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x6e, 0x6d,
-	0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x65, 0x6e, 0x76, 0x69, 0x72,
-	0x6f, 0x6e, 0x6d, 0x65, 0x6e, 0x74, 0x22, 0x7d, 0x0a, 0x0b, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e,
-	0x64, 0x44, 0x61, 0x74, 0x61, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x6f,
+	0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x08, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68,
+	0x22, 0x36, 0x0a, 0x10, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x43,
+	0x68, 0x75, 0x6e, 0x6b, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x22, 0x39, 0x0a, 0x0f, 0x48, 0x74, 0x74, 0x70,
+	0x46, 0x6c, 0x6f, 0x77, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x12, 0x0e, 0x0a, 0x02, 0x69,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x70,
+	0x61, 0x75, 0x73, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x70, 0x61, 0x75,
+	0x73, 0x65, 0x64, 0x22, 0x1f, 0x0a, 0x0d, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x02, 0x69, 0x64, 0x22, 0x1b, 0x0a, 0x09, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x41, 0x63,
+	0x6b, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69,
+	0x64, 0x22, 0x8a, 0x01, 0x0a, 0x0c, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02,
+	0x69, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x2c, 0x0a, 0x07, 0x68, 0x65,
+	0x61, 0x64, 0x65, 0x72, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x52,
+	0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x6f, 0x6e, 0x74,
+	0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x0d, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x22, 0x39,
+	0x0a, 0x13, 0x48, 0x74, 0x74, 0x70, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
 	0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x02, 0x20,
-	0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x32, 0x0a, 0x07, 0x63, 0x68, 0x61,
-	0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x18, 0x2e, 0x74, 0x75, 0x6e,
-	0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x44, 0x69, 0x72, 0x65, 0x63,
-	0x74, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x16, 0x0a,
-	0x06, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x43,
-	0x6c, 0x6f, 0x73, 0x65, 0x64, 0x22, 0x74, 0x0a, 0x12, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c,
-	0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x12, 0x12, 0x0a, 0x04, 0x62,
-	0x6f, 0x64, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12,
-	0x32, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e,
-	0x32, 0x18, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65,
-	0x6c, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x63, 0x68, 0x61, 0x6e,
-	0x6e, 0x65, 0x6c, 0x12, 0x16, 0x0a, 0x06, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x64, 0x18, 0x03, 0x20,
-	0x01, 0x28, 0x08, 0x52, 0x06, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x64, 0x22, 0x5a, 0x0a, 0x12, 0x43,
-	0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f,
-	0x6e, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69,
-	0x64, 0x12, 0x1a, 0x0a, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43, 0x6f, 0x64, 0x65, 0x18, 0x02, 0x20,
-	0x01, 0x28, 0x05, 0x52, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x18, 0x0a,
-	0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
-	0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x51, 0x0a, 0x19, 0x43, 0x6d, 0x64, 0x54, 0x6f,
-	0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61,
-	0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43, 0x6f, 0x64, 0x65,
-	0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43, 0x6f, 0x64, 0x65,
-	0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x78, 0x0a, 0x0e, 0x45, 0x6e,
-	0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x12, 0x12, 0x0a, 0x04,
-	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65,
-	0x12, 0x12, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04,
-	0x74, 0x79, 0x70, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72,
-	0x65, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67,
-	0x75, 0x72, 0x65, 0x64, 0x12, 0x1e, 0x0a, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63,
-	0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70,
-	0x61, 0x63, 0x65, 0x73, 0x22, 0x78, 0x0a, 0x0a, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x48, 0x65, 0x6c,
-	0x6c, 0x6f, 0x12, 0x34, 0x0a, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x18,
-	0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x45,
-	0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x52, 0x09, 0x65,
-	0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73,
-	0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69,
-	0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0xd2,
-	0x02, 0x0a, 0x18, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x54, 0x6f, 0x41,
-	0x67, 0x65, 0x6e, 0x74, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x3a, 0x0a, 0x0c, 0x70,
-	0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x0b, 0x32, 0x14, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52,
-	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52, 0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52,
-	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x37, 0x0a, 0x0b, 0x68, 0x74, 0x74, 0x70, 0x52,
-	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74,
-	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x48, 0x00, 0x52, 0x0b, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
-	0x12, 0x3d, 0x0a, 0x0d, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
-	0x2e, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00,
-	0x52, 0x0d, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
-	0x40, 0x0a, 0x0e, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
-	0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48,
-	0x00, 0x52, 0x0e, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x12, 0x37, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61,
-	0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
-	0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x48, 0x00, 0x52, 0x0b, 0x63,
-	0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76,
-	0x65, 0x6e, 0x74, 0x22, 0xa6, 0x03, 0x0a, 0x18, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x54, 0x6f, 0x43,
-	0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72,
-	0x12, 0x37, 0x0a, 0x0b, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50,
-	0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x70, 0x69,
-	0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3a, 0x0a, 0x0c, 0x68, 0x74, 0x74,
-	0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
-	0x14, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x73,
-	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52, 0x0c, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x73,
-	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x4f, 0x0a, 0x13, 0x68, 0x74, 0x74, 0x70, 0x43, 0x68, 0x75,
-	0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x03, 0x20, 0x01,
-	0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70,
-	0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48,
-	0x00, 0x52, 0x13, 0x68, 0x74, 0x74, 0x70, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65,
-	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x34, 0x0a, 0x0a, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x48,
-	0x65, 0x6c, 0x6c, 0x6f, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e,
-	0x6e, 0x65, 0x6c, 0x2e, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x48, 0x00,
-	0x52, 0x0a, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x37, 0x0a, 0x0b,
-	0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x18, 0x05, 0x20, 0x01, 0x28,
-	0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61,
-	0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x48, 0x00, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e,
-	0x64, 0x44, 0x61, 0x74, 0x61, 0x12, 0x4c, 0x0a, 0x12, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
-	0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20, 0x01, 0x28,
-	0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61,
-	0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x00, 0x52,
-	0x12, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74,
-	0x69, 0x6f, 0x6e, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x22, 0xae, 0x01, 0x0a,
-	0x1a, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x54, 0x6f, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f,
-	0x6c, 0x6c, 0x65, 0x72, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x47, 0x0a, 0x0e, 0x63,
-	0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64,
-	0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x48, 0x00, 0x52, 0x0e, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71,
-	0x75, 0x65, 0x73, 0x74, 0x12, 0x3e, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44,
-	0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e,
-	0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e,
-	0x64, 0x44, 0x61, 0x74, 0x61, 0x48, 0x00, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
-	0x44, 0x61, 0x74, 0x61, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x22, 0xba, 0x01,
-	0x0a, 0x1a, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x54, 0x6f, 0x43, 0x6d,
-	0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x53, 0x0a, 0x12,
-	0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69,
-	0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65,
-	0x6c, 0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
-	0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x00, 0x52, 0x12, 0x63,
-	0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f,
-	0x6e, 0x12, 0x3e, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61,
-	0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
-	0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x22, 0x69, 0x0a, 0x09, 0x48, 0x74, 0x74,
+	0x70, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x18,
+	0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x64, 0x72, 0x61, 0x69,
+	0x6e, 0x69, 0x6e, 0x67, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x64, 0x72, 0x61, 0x69,
+	0x6e, 0x69, 0x6e, 0x67, 0x22, 0x3b, 0x0a, 0x0a, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x4f, 0x70,
+	0x65, 0x6e, 0x12, 0x2d, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74,
+	0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x22, 0x30, 0x0a, 0x0a, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x44, 0x61, 0x74, 0x61, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12,
+	0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64,
+	0x61, 0x74, 0x61, 0x22, 0x37, 0x0a, 0x0b, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x43, 0x6c, 0x6f,
+	0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02,
+	0x69, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0xce, 0x01, 0x0a,
+	0x0e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12,
+	0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e,
+	0x61, 0x6d, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x72, 0x67, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x73,
+	0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09, 0x61, 0x72, 0x67, 0x75, 0x6d, 0x65, 0x6e, 0x74,
+	0x73, 0x12, 0x20, 0x0a, 0x0b, 0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x6e, 0x6d, 0x65, 0x6e, 0x74,
+	0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x6e, 0x6d,
+	0x65, 0x6e, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x64, 0x69, 0x6e, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x05, 0x73, 0x74, 0x64, 0x69, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x69, 0x6e,
+	0x64, 0x6f, 0x77, 0x18, 0x06, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f,
+	0x77, 0x12, 0x2a, 0x0a, 0x10, 0x77, 0x6f, 0x72, 0x6b, 0x69, 0x6e, 0x67, 0x44, 0x69, 0x72, 0x65,
+	0x63, 0x74, 0x6f, 0x72, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x10, 0x77, 0x6f, 0x72,
+	0x6b, 0x69, 0x6e, 0x67, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x79, 0x22, 0xc5, 0x01,
+	0x0a, 0x15, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x61,
+	0x72, 0x67, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x09,
+	0x61, 0x72, 0x67, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x65, 0x6e, 0x76,
+	0x69, 0x72, 0x6f, 0x6e, 0x6d, 0x65, 0x6e, 0x74, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b,
+	0x65, 0x6e, 0x76, 0x69, 0x72, 0x6f, 0x6e, 0x6d, 0x65, 0x6e, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x73,
+	0x74, 0x64, 0x69, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x05, 0x73, 0x74, 0x64, 0x69,
+	0x6e, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x12, 0x2a, 0x0a, 0x10, 0x77, 0x6f, 0x72,
+	0x6b, 0x69, 0x6e, 0x67, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x79, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x10, 0x77, 0x6f, 0x72, 0x6b, 0x69, 0x6e, 0x67, 0x44, 0x69, 0x72, 0x65,
+	0x63, 0x74, 0x6f, 0x72, 0x79, 0x22, 0x7d, 0x0a, 0x0b, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
+	0x44, 0x61, 0x74, 0x61, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x32, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x6e,
+	0x6e, 0x65, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x18, 0x2e, 0x74, 0x75, 0x6e, 0x6e,
+	0x65, 0x6c, 0x2e, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74,
+	0x69, 0x6f, 0x6e, 0x52, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x16, 0x0a, 0x06,
+	0x43, 0x6c, 0x6f, 0x73, 0x65, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x43, 0x6c,
+	0x6f, 0x73, 0x65, 0x64, 0x22, 0x74, 0x0a, 0x12, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43,
+	0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f,
+	0x64, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x32,
+	0x0a, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x18, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c,
+	0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x6e,
+	0x65, 0x6c, 0x12, 0x16, 0x0a, 0x06, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x64, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x06, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x64, 0x22, 0x1f, 0x0a, 0x0d, 0x43, 0x6f,
+	0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x12, 0x0e, 0x0a, 0x02, 0x69,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x22, 0x16, 0x0a, 0x14, 0x43,
+	0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x43, 0x61, 0x6e,
+	0x63, 0x65, 0x6c, 0x22, 0x38, 0x0a, 0x0a, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x41, 0x63,
+	0x6b, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69,
+	0x64, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6f, 0x6e, 0x73, 0x75, 0x6d, 0x65, 0x64, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x04, 0x52, 0x08, 0x63, 0x6f, 0x6e, 0x73, 0x75, 0x6d, 0x65, 0x64, 0x22, 0x2f, 0x0a,
+	0x11, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x41,
+	0x63, 0x6b, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6f, 0x6e, 0x73, 0x75, 0x6d, 0x65, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x08, 0x63, 0x6f, 0x6e, 0x73, 0x75, 0x6d, 0x65, 0x64, 0x22, 0x5a,
+	0x0a, 0x12, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x02, 0x69, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43, 0x6f, 0x64, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43, 0x6f, 0x64, 0x65,
+	0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x51, 0x0a, 0x19, 0x43, 0x6d,
+	0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d,
+	0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43,
+	0x6f, 0x64, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x65, 0x78, 0x69, 0x74, 0x43,
+	0x6f, 0x64, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x22, 0x49, 0x0a,
+	0x0b, 0x46, 0x69, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02,
+	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04,
+	0x70, 0x61, 0x74, 0x68, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x61, 0x74, 0x68,
+	0x12, 0x16, 0x0a, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x22, 0x40, 0x0a, 0x12, 0x43, 0x6d, 0x64, 0x54,
+	0x6f, 0x6f, 0x6c, 0x46, 0x69, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12,
+	0x0a, 0x04, 0x70, 0x61, 0x74, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x61,
+	0x74, 0x68, 0x12, 0x16, 0x0a, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x06, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x22, 0x2f, 0x0a, 0x09, 0x46, 0x69,
+	0x6c, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x22, 0x26, 0x0a, 0x10, 0x43,
+	0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12,
+	0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x62,
+	0x6f, 0x64, 0x79, 0x22, 0x63, 0x0a, 0x0f, 0x46, 0x69, 0x6c, 0x65, 0x54, 0x65, 0x72, 0x6d, 0x69,
+	0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x68,
+	0x61, 0x32, 0x35, 0x36, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x73, 0x68, 0x61, 0x32,
+	0x35, 0x36, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x5a, 0x0a, 0x16, 0x43, 0x6d, 0x64, 0x54,
+	0x6f, 0x6f, 0x6c, 0x46, 0x69, 0x6c, 0x65, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x68, 0x61, 0x32, 0x35, 0x36,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x73, 0x68, 0x61, 0x32, 0x35, 0x36, 0x12, 0x14,
+	0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65,
+	0x72, 0x72, 0x6f, 0x72, 0x22, 0x92, 0x01, 0x0a, 0x0e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e,
+	0x74, 0x48, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x74,
+	0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12,
+	0x1e, 0x0a, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x65, 0x64, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x75, 0x72, 0x65, 0x64, 0x12,
+	0x1e, 0x0a, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x73, 0x18, 0x04, 0x20,
+	0x03, 0x28, 0x09, 0x52, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x73, 0x12,
+	0x18, 0x0a, 0x07, 0x74, 0x6c, 0x73, 0x4d, 0x6f, 0x64, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x74, 0x6c, 0x73, 0x4d, 0x6f, 0x64, 0x65, 0x22, 0xe8, 0x02, 0x0a, 0x0a, 0x41, 0x67,
+	0x65, 0x6e, 0x74, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x34, 0x0a, 0x09, 0x65, 0x6e, 0x64, 0x70,
+	0x6f, 0x69, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61,
+	0x6c, 0x74, 0x68, 0x52, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x12, 0x18,
+	0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x68, 0x6f, 0x73, 0x74,
+	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73, 0x74,
+	0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x12, 0x1c, 0x0a, 0x09,
+	0x62, 0x75, 0x69, 0x6c, 0x64, 0x44, 0x61, 0x74, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x09, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x44, 0x61, 0x74, 0x65, 0x12, 0x2c, 0x0a, 0x11, 0x72, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x11, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x43,
+	0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x36, 0x0a, 0x16, 0x72, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73, 0x49, 0x6e, 0x46, 0x6c, 0x69, 0x67,
+	0x68, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x16, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73, 0x49, 0x6e, 0x46, 0x6c, 0x69, 0x67, 0x68, 0x74,
+	0x12, 0x22, 0x0a, 0x0c, 0x61, 0x6e, 0x73, 0x77, 0x65, 0x72, 0x73, 0x50, 0x69, 0x6e, 0x67, 0x73,
+	0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0c, 0x61, 0x6e, 0x73, 0x77, 0x65, 0x72, 0x73, 0x50,
+	0x69, 0x6e, 0x67, 0x73, 0x12, 0x2e, 0x0a, 0x12, 0x61, 0x63, 0x63, 0x65, 0x70, 0x74, 0x73, 0x46,
+	0x6c, 0x6f, 0x77, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x18, 0x09, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x12, 0x61, 0x63, 0x63, 0x65, 0x70, 0x74, 0x73, 0x46, 0x6c, 0x6f, 0x77, 0x43, 0x6f, 0x6e,
+	0x74, 0x72, 0x6f, 0x6c, 0x22, 0x47, 0x0a, 0x0f, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74,
+	0x73, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x12, 0x34, 0x0a, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f,
+	0x69, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x6c,
+	0x74, 0x68, 0x52, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x22, 0x24, 0x0a,
+	0x12, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x44, 0x72, 0x61, 0x69, 0x6e,
+	0x69, 0x6e, 0x67, 0x12, 0x0e, 0x0a, 0x02, 0x74, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52,
+	0x02, 0x74, 0x73, 0x22, 0x1f, 0x0a, 0x0d, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x52, 0x65, 0x70, 0x6c,
+	0x61, 0x63, 0x65, 0x64, 0x12, 0x0e, 0x0a, 0x02, 0x74, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x02, 0x74, 0x73, 0x22, 0xf8, 0x07, 0x0a, 0x18, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c,
+	0x6c, 0x65, 0x72, 0x54, 0x6f, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65,
+	0x72, 0x12, 0x3a, 0x0a, 0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52,
+	0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x37, 0x0a,
+	0x0b, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x68, 0x74, 0x74, 0x70, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3d, 0x0a, 0x0d, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x15, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0d, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x40, 0x0a, 0x0e, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0e, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x37, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61,
+	0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74,
+	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74,
+	0x61, 0x48, 0x00, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61,
+	0x12, 0x46, 0x0a, 0x10, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x43,
+	0x68, 0x75, 0x6e, 0x6b, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x74, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x43,
+	0x68, 0x75, 0x6e, 0x6b, 0x48, 0x00, 0x52, 0x10, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x4c, 0x0a, 0x12, 0x63, 0x6f, 0x6e, 0x74,
+	0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x44, 0x72, 0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67, 0x18, 0x07,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x44, 0x72, 0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67,
+	0x48, 0x00, 0x52, 0x12, 0x63, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x44, 0x72,
+	0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67, 0x12, 0x34, 0x0a, 0x0a, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x4f, 0x70, 0x65, 0x6e, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x4f, 0x70, 0x65, 0x6e, 0x48, 0x00,
+	0x52, 0x0a, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x4f, 0x70, 0x65, 0x6e, 0x12, 0x34, 0x0a, 0x0a,
+	0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x44, 0x61, 0x74, 0x61, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x44, 0x61, 0x74, 0x61, 0x48, 0x00, 0x52, 0x0a, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x44, 0x61,
+	0x74, 0x61, 0x12, 0x37, 0x0a, 0x0b, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x43, 0x6c, 0x6f, 0x73,
+	0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x2e, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x48, 0x00, 0x52, 0x0b,
+	0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x12, 0x3d, 0x0a, 0x0d, 0x63,
+	0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x18, 0x0b, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d,
+	0x61, 0x6e, 0x64, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x48, 0x00, 0x52, 0x0d, 0x63, 0x6f, 0x6d,
+	0x6d, 0x61, 0x6e, 0x64, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x12, 0x3d, 0x0a, 0x0d, 0x61, 0x67,
+	0x65, 0x6e, 0x74, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x64, 0x18, 0x0c, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x15, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x41, 0x67, 0x65, 0x6e, 0x74,
+	0x52, 0x65, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x64, 0x48, 0x00, 0x52, 0x0d, 0x61, 0x67, 0x65, 0x6e,
+	0x74, 0x52, 0x65, 0x70, 0x6c, 0x61, 0x63, 0x65, 0x64, 0x12, 0x34, 0x0a, 0x0a, 0x63, 0x6f, 0x6d,
+	0x6d, 0x61, 0x6e, 0x64, 0x41, 0x63, 0x6b, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x41, 0x63,
+	0x6b, 0x48, 0x00, 0x52, 0x0a, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x41, 0x63, 0x6b, 0x12,
+	0x37, 0x0a, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x0e,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x46, 0x69,
+	0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x66, 0x69, 0x6c,
+	0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x37, 0x0a, 0x0b, 0x70, 0x69, 0x6e, 0x67,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x43, 0x0a, 0x0f, 0x68, 0x74, 0x74, 0x70, 0x46, 0x6c, 0x6f, 0x77, 0x43, 0x6f, 0x6e,
+	0x74, 0x72, 0x6f, 0x6c, 0x18, 0x10, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x74, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x46, 0x6c, 0x6f, 0x77, 0x43, 0x6f, 0x6e, 0x74,
+	0x72, 0x6f, 0x6c, 0x48, 0x00, 0x52, 0x0f, 0x68, 0x74, 0x74, 0x70, 0x46, 0x6c, 0x6f, 0x77, 0x43,
+	0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x22,
+	0xf4, 0x06, 0x0a, 0x18, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x54, 0x6f, 0x43, 0x6f, 0x6e, 0x74, 0x72,
+	0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x37, 0x0a, 0x0b,
+	0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3a, 0x0a, 0x0c, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x73,
+	0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x74, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x48, 0x00, 0x52, 0x0c, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x4f, 0x0a, 0x13, 0x68, 0x74, 0x74, 0x70, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1b,
+	0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x43, 0x68, 0x75, 0x6e,
+	0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52, 0x13, 0x68,
+	0x74, 0x74, 0x70, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x34, 0x0a, 0x0a, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x48, 0x65, 0x6c, 0x6c, 0x6f,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
+	0x41, 0x67, 0x65, 0x6e, 0x74, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x48, 0x00, 0x52, 0x0a, 0x61, 0x67,
+	0x65, 0x6e, 0x74, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x37, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d,
+	0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61,
 	0x74, 0x61, 0x48, 0x00, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74,
-	0x61, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x2a, 0x35, 0x0a, 0x10, 0x43, 0x68,
-	0x61, 0x6e, 0x6e, 0x65, 0x6c, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x09,
-	0x0a, 0x05, 0x53, 0x54, 0x44, 0x49, 0x4e, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x53, 0x54, 0x44,
-	0x4f, 0x55, 0x54, 0x10, 0x01, 0x12, 0x0a, 0x0a, 0x06, 0x53, 0x54, 0x44, 0x45, 0x52, 0x52, 0x10,
-	0x02, 0x32, 0x6d, 0x0a, 0x12, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
-	0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x57, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e, 0x74,
-	0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x20, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
-	0x41, 0x67, 0x65, 0x6e, 0x74, 0x54, 0x6f, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65,
-	0x72, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x1a, 0x20, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65,
-	0x6c, 0x2e, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x54, 0x6f, 0x41, 0x67,
-	0x65, 0x6e, 0x74, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01,
-	0x32, 0x73, 0x0a, 0x14, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x54, 0x75, 0x6e, 0x6e, 0x65,
-	0x6c, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x5b, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e,
-	0x74, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x12, 0x22, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
-	0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x54, 0x6f, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f,
-	0x6c, 0x6c, 0x65, 0x72, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x1a, 0x22, 0x2e, 0x74, 0x75,
-	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x54,
-	0x6f, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x22,
-	0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x0b, 0x5a, 0x09, 0x2e, 0x2f, 0x3b, 0x74, 0x75, 0x6e, 0x6e,
-	0x65, 0x6c, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x61, 0x12, 0x4c, 0x0a, 0x12, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d,
+	0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65,
+	0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x00, 0x52, 0x12, 0x63, 0x6f, 0x6d,
+	0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12,
+	0x31, 0x0a, 0x09, 0x68, 0x74, 0x74, 0x70, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x07, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70,
+	0x45, 0x72, 0x72, 0x6f, 0x72, 0x48, 0x00, 0x52, 0x09, 0x68, 0x74, 0x74, 0x70, 0x45, 0x72, 0x72,
+	0x6f, 0x72, 0x12, 0x34, 0x0a, 0x0a, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x44, 0x61, 0x74, 0x61,
+	0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
+	0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x44, 0x61, 0x74, 0x61, 0x48, 0x00, 0x52, 0x0a, 0x73, 0x74,
+	0x72, 0x65, 0x61, 0x6d, 0x44, 0x61, 0x74, 0x61, 0x12, 0x37, 0x0a, 0x0b, 0x73, 0x74, 0x72, 0x65,
+	0x61, 0x6d, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x43, 0x6c, 0x6f,
+	0x73, 0x65, 0x48, 0x00, 0x52, 0x0b, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x43, 0x6c, 0x6f, 0x73,
+	0x65, 0x12, 0x31, 0x0a, 0x09, 0x63, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x41, 0x63, 0x6b, 0x18, 0x0a,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x61,
+	0x6e, 0x63, 0x65, 0x6c, 0x41, 0x63, 0x6b, 0x48, 0x00, 0x52, 0x09, 0x63, 0x61, 0x6e, 0x63, 0x65,
+	0x6c, 0x41, 0x63, 0x6b, 0x12, 0x43, 0x0a, 0x0f, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74,
+	0x73, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73,
+	0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x48, 0x00, 0x52, 0x0f, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69,
+	0x6e, 0x74, 0x73, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x12, 0x31, 0x0a, 0x09, 0x66, 0x69, 0x6c,
+	0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74,
+	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x48,
+	0x00, 0x52, 0x09, 0x66, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x43, 0x0a, 0x0f,
+	0x66, 0x69, 0x6c, 0x65, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18,
+	0x0d, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x46,
+	0x69, 0x6c, 0x65, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x00,
+	0x52, 0x0f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x12, 0x3a, 0x0a, 0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52,
+	0x0c, 0x70, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x07, 0x0a,
+	0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x22, 0xf1, 0x02, 0x0a, 0x1a, 0x43, 0x6d, 0x64, 0x54, 0x6f,
+	0x6f, 0x6c, 0x54, 0x6f, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x57, 0x72,
+	0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x47, 0x0a, 0x0e, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f,
+	0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0e,
+	0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3e,
+	0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64,
+	0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x48,
+	0x00, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x12, 0x44,
+	0x0a, 0x0d, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x43, 0x61, 0x6e, 0x63, 0x65, 0x6c, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1c, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43,
+	0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x43, 0x61, 0x6e,
+	0x63, 0x65, 0x6c, 0x48, 0x00, 0x52, 0x0d, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x43, 0x61,
+	0x6e, 0x63, 0x65, 0x6c, 0x12, 0x3b, 0x0a, 0x0a, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x41,
+	0x63, 0x6b, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65,
+	0x6c, 0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64,
+	0x41, 0x63, 0x6b, 0x48, 0x00, 0x52, 0x0a, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x41, 0x63,
+	0x6b, 0x12, 0x3e, 0x0a, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e,
+	0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x46, 0x69, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x22, 0xc0, 0x02, 0x0a, 0x1a, 0x43,
+	0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x54, 0x6f, 0x43, 0x6d, 0x64, 0x54, 0x6f,
+	0x6f, 0x6c, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x12, 0x53, 0x0a, 0x12, 0x63, 0x6f, 0x6d,
+	0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43,
+	0x6d, 0x64, 0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x54, 0x65, 0x72,
+	0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x00, 0x52, 0x12, 0x63, 0x6f, 0x6d, 0x6d,
+	0x61, 0x6e, 0x64, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x3e,
+	0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64,
+	0x54, 0x6f, 0x6f, 0x6c, 0x43, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x48,
+	0x00, 0x52, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x44, 0x61, 0x74, 0x61, 0x12, 0x38,
+	0x0a, 0x09, 0x66, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x18, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f,
+	0x6f, 0x6c, 0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x48, 0x00, 0x52, 0x09, 0x66,
+	0x69, 0x6c, 0x65, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x4a, 0x0a, 0x0f, 0x66, 0x69, 0x6c, 0x65,
+	0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1e, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f,
+	0x6f, 0x6c, 0x46, 0x69, 0x6c, 0x65, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x48, 0x00, 0x52, 0x0f, 0x66, 0x69, 0x6c, 0x65, 0x54, 0x65, 0x72, 0x6d, 0x69, 0x6e, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x22, 0xbf, 0x01,
+	0x0a, 0x09, 0x50, 0x65, 0x65, 0x72, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e,
+	0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12,
+	0x18, 0x0a, 0x07, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x34, 0x0a, 0x09, 0x65, 0x6e, 0x64,
+	0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x74,
+	0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x48, 0x65,
+	0x61, 0x6c, 0x74, 0x68, 0x52, 0x09, 0x65, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73, 0x12,
+	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x0a, 0x06, 0x63, 0x6f, 0x6d,
+	0x6d, 0x69, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x63, 0x6f, 0x6d, 0x6d, 0x69,
+	0x74, 0x12, 0x1c, 0x0a, 0x09, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x44, 0x61, 0x74, 0x65, 0x18, 0x06,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x62, 0x75, 0x69, 0x6c, 0x64, 0x44, 0x61, 0x74, 0x65, 0x22,
+	0x3e, 0x0a, 0x11, 0x50, 0x65, 0x65, 0x72, 0x41, 0x64, 0x76, 0x65, 0x72, 0x74, 0x69, 0x73, 0x65,
+	0x6d, 0x65, 0x6e, 0x74, 0x12, 0x29, 0x0a, 0x06, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x01,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x65,
+	0x65, 0x72, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x52, 0x06, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x73, 0x22,
+	0x72, 0x0a, 0x0f, 0x50, 0x65, 0x65, 0x72, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x1c, 0x0a, 0x09, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x4e, 0x61, 0x6d, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x61, 0x67, 0x65, 0x6e, 0x74, 0x4e, 0x61, 0x6d, 0x65,
+	0x12, 0x2d, 0x0a, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x12, 0x0a, 0x04, 0x68, 0x6f, 0x70, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x68,
+	0x6f, 0x70, 0x73, 0x22, 0xdd, 0x03, 0x0a, 0x0b, 0x50, 0x65, 0x65, 0x72, 0x57, 0x72, 0x61, 0x70,
+	0x70, 0x65, 0x72, 0x12, 0x41, 0x0a, 0x0d, 0x61, 0x64, 0x76, 0x65, 0x72, 0x74, 0x69, 0x73, 0x65,
+	0x6d, 0x65, 0x6e, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x74, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x65, 0x65, 0x72, 0x41, 0x64, 0x76, 0x65, 0x72, 0x74, 0x69, 0x73,
+	0x65, 0x6d, 0x65, 0x6e, 0x74, 0x48, 0x00, 0x52, 0x0d, 0x61, 0x64, 0x76, 0x65, 0x72, 0x74, 0x69,
+	0x73, 0x65, 0x6d, 0x65, 0x6e, 0x74, 0x12, 0x3b, 0x0a, 0x0b, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x74, 0x75,
+	0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x65, 0x65, 0x72, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0b, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x12, 0x46, 0x0a, 0x10, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x18, 0x2e,
+	0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x48, 0x00, 0x52, 0x10, 0x68, 0x74, 0x74, 0x70, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x3d, 0x0a, 0x0d, 0x63,
+	0x61, 0x6e, 0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x15, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x61, 0x6e, 0x63,
+	0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x0d, 0x63, 0x61, 0x6e,
+	0x63, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3a, 0x0a, 0x0c, 0x68, 0x74,
+	0x74, 0x70, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x14, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x48, 0x00, 0x52, 0x0c, 0x68, 0x74, 0x74, 0x70, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x4f, 0x0a, 0x13, 0x68, 0x74, 0x74, 0x70, 0x43, 0x68,
+	0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74,
+	0x70, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x48, 0x00, 0x52, 0x13, 0x68, 0x74, 0x74, 0x70, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x31, 0x0a, 0x09, 0x68, 0x74, 0x74, 0x70, 0x45,
+	0x72, 0x72, 0x6f, 0x72, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x74, 0x75, 0x6e,
+	0x6e, 0x65, 0x6c, 0x2e, 0x48, 0x74, 0x74, 0x70, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x48, 0x00, 0x52,
+	0x09, 0x68, 0x74, 0x74, 0x70, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x42, 0x07, 0x0a, 0x05, 0x65, 0x76,
+	0x65, 0x6e, 0x74, 0x22, 0x1b, 0x0a, 0x19, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61,
+	0x74, 0x65, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x61, 0x6c, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x22, 0x92, 0x01, 0x0a, 0x1a, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65,
+	0x52, 0x65, 0x6e, 0x65, 0x77, 0x61, 0x6c, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
+	0x20, 0x0a, 0x0b, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74,
+	0x65, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03,
+	0x6b, 0x65, 0x79, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x61, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69,
+	0x63, 0x61, 0x74, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0d, 0x63, 0x61, 0x43, 0x65,
+	0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x6e, 0x6f, 0x74,
+	0x41, 0x66, 0x74, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x08, 0x6e, 0x6f, 0x74,
+	0x41, 0x66, 0x74, 0x65, 0x72, 0x2a, 0x35, 0x0a, 0x10, 0x43, 0x68, 0x61, 0x6e, 0x6e, 0x65, 0x6c,
+	0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x09, 0x0a, 0x05, 0x53, 0x54, 0x44,
+	0x49, 0x4e, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x53, 0x54, 0x44, 0x4f, 0x55, 0x54, 0x10, 0x01,
+	0x12, 0x0a, 0x0a, 0x06, 0x53, 0x54, 0x44, 0x45, 0x52, 0x52, 0x10, 0x02, 0x32, 0xca, 0x01, 0x0a,
+	0x12, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x53, 0x65, 0x72, 0x76,
+	0x69, 0x63, 0x65, 0x12, 0x57, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e,
+	0x65, 0x6c, 0x12, 0x20, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x41, 0x67, 0x65, 0x6e,
+	0x74, 0x54, 0x6f, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x57, 0x72, 0x61,
+	0x70, 0x70, 0x65, 0x72, 0x1a, 0x20, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x54, 0x6f, 0x41, 0x67, 0x65, 0x6e, 0x74, 0x57,
+	0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x12, 0x5b, 0x0a, 0x10,
+	0x52, 0x65, 0x6e, 0x65, 0x77, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65,
+	0x12, 0x21, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66,
+	0x69, 0x63, 0x61, 0x74, 0x65, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x61, 0x6c, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x22, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x65, 0x72,
+	0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x52, 0x65, 0x6e, 0x65, 0x77, 0x61, 0x6c, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x32, 0x73, 0x0a, 0x14, 0x43, 0x6d, 0x64,
+	0x54, 0x6f, 0x6f, 0x6c, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x12, 0x5b, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x12, 0x22, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f,
+	0x6c, 0x54, 0x6f, 0x43, 0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x57, 0x72, 0x61,
+	0x70, 0x70, 0x65, 0x72, 0x1a, 0x22, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x43, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x72, 0x54, 0x6f, 0x43, 0x6d, 0x64, 0x54, 0x6f, 0x6f,
+	0x6c, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x32, 0x52,
+	0x0a, 0x11, 0x50, 0x65, 0x65, 0x72, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x53, 0x65, 0x72, 0x76,
+	0x69, 0x63, 0x65, 0x12, 0x3d, 0x0a, 0x0b, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x75, 0x6e, 0x6e,
+	0x65, 0x6c, 0x12, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x2e, 0x50, 0x65, 0x65, 0x72,
+	0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x1a, 0x13, 0x2e, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c,
+	0x2e, 0x50, 0x65, 0x65, 0x72, 0x57, 0x72, 0x61, 0x70, 0x70, 0x65, 0x72, 0x22, 0x00, 0x28, 0x01,
+	0x30, 0x01, 0x42, 0x0b, 0x5a, 0x09, 0x2e, 0x2f, 0x3b, 0x74, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x62,
+	0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -1673,59 +4010,125 @@ func file_pkg_tunnel_tunnel_proto_rawDescGZIP() []byte {
 }
 
 var file_pkg_tunnel_tunnel_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_pkg_tunnel_tunnel_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
+var file_pkg_tunnel_tunnel_proto_msgTypes = make([]protoimpl.MessageInfo, 45)
 var file_pkg_tunnel_tunnel_proto_goTypes = []interface{}{
 	(ChannelDirection)(0),              // 0: tunnel.ChannelDirection
 	(*PingRequest)(nil),                // 1: tunnel.PingRequest
 	(*PingResponse)(nil),               // 2: tunnel.PingResponse
 	(*HttpHeader)(nil),                 // 3: tunnel.HttpHeader
 	(*HttpRequest)(nil),                // 4: tunnel.HttpRequest
-	(*CancelRequest)(nil),              // 5: tunnel.CancelRequest
-	(*HttpResponse)(nil),               // 6: tunnel.HttpResponse
-	(*HttpChunkedResponse)(nil),        // 7: tunnel.HttpChunkedResponse
-	(*CommandRequest)(nil),             // 8: tunnel.CommandRequest
-	(*CmdToolCommandRequest)(nil),      // 9: tunnel.CmdToolCommandRequest
-	(*CommandData)(nil),                // 10: tunnel.CommandData
-	(*CmdToolCommandData)(nil),         // 11: tunnel.CmdToolCommandData
-	(*CommandTermination)(nil),         // 12: tunnel.CommandTermination
-	(*CmdToolCommandTermination)(nil),  // 13: tunnel.CmdToolCommandTermination
-	(*EndpointHealth)(nil),             // 14: tunnel.EndpointHealth
-	(*AgentHello)(nil),                 // 15: tunnel.AgentHello
-	(*ControllerToAgentWrapper)(nil),   // 16: tunnel.ControllerToAgentWrapper
-	(*AgentToControllerWrapper)(nil),   // 17: tunnel.AgentToControllerWrapper
-	(*CmdToolToControllerWrapper)(nil), // 18: tunnel.CmdToolToControllerWrapper
-	(*ControllerToCmdToolWrapper)(nil), // 19: tunnel.ControllerToCmdToolWrapper
+	(*HttpRequestChunk)(nil),           // 5: tunnel.HttpRequestChunk
+	(*HttpFlowControl)(nil),            // 6: tunnel.HttpFlowControl
+	(*CancelRequest)(nil),              // 7: tunnel.CancelRequest
+	(*CancelAck)(nil),                  // 8: tunnel.CancelAck
+	(*HttpResponse)(nil),               // 9: tunnel.HttpResponse
+	(*HttpChunkedResponse)(nil),        // 10: tunnel.HttpChunkedResponse
+	(*HttpError)(nil),                  // 11: tunnel.HttpError
+	(*StreamOpen)(nil),                 // 12: tunnel.StreamOpen
+	(*StreamData)(nil),                 // 13: tunnel.StreamData
+	(*StreamClose)(nil),                // 14: tunnel.StreamClose
+	(*CommandRequest)(nil),             // 15: tunnel.CommandRequest
+	(*CmdToolCommandRequest)(nil),      // 16: tunnel.CmdToolCommandRequest
+	(*CommandData)(nil),                // 17: tunnel.CommandData
+	(*CmdToolCommandData)(nil),         // 18: tunnel.CmdToolCommandData
+	(*CommandCancel)(nil),              // 19: tunnel.CommandCancel
+	(*CmdToolCommandCancel)(nil),       // 20: tunnel.CmdToolCommandCancel
+	(*CommandAck)(nil),                 // 21: tunnel.CommandAck
+	(*CmdToolCommandAck)(nil),          // 22: tunnel.CmdToolCommandAck
+	(*CommandTermination)(nil),         // 23: tunnel.CommandTermination
+	(*CmdToolCommandTermination)(nil),  // 24: tunnel.CmdToolCommandTermination
+	(*FileRequest)(nil),                // 25: tunnel.FileRequest
+	(*CmdToolFileRequest)(nil),         // 26: tunnel.CmdToolFileRequest
+	(*FileChunk)(nil),                  // 27: tunnel.FileChunk
+	(*CmdToolFileChunk)(nil),           // 28: tunnel.CmdToolFileChunk
+	(*FileTermination)(nil),            // 29: tunnel.FileTermination
+	(*CmdToolFileTermination)(nil),     // 30: tunnel.CmdToolFileTermination
+	(*EndpointHealth)(nil),             // 31: tunnel.EndpointHealth
+	(*AgentHello)(nil),                 // 32: tunnel.AgentHello
+	(*EndpointsUpdate)(nil),            // 33: tunnel.EndpointsUpdate
+	(*ControllerDraining)(nil),         // 34: tunnel.ControllerDraining
+	(*AgentReplaced)(nil),              // 35: tunnel.AgentReplaced
+	(*ControllerToAgentWrapper)(nil),   // 36: tunnel.ControllerToAgentWrapper
+	(*AgentToControllerWrapper)(nil),   // 37: tunnel.AgentToControllerWrapper
+	(*CmdToolToControllerWrapper)(nil), // 38: tunnel.CmdToolToControllerWrapper
+	(*ControllerToCmdToolWrapper)(nil), // 39: tunnel.ControllerToCmdToolWrapper
+	(*PeerAgent)(nil),                  // 40: tunnel.PeerAgent
+	(*PeerAdvertisement)(nil),          // 41: tunnel.PeerAdvertisement
+	(*PeerHttpRequest)(nil),            // 42: tunnel.PeerHttpRequest
+	(*PeerWrapper)(nil),                // 43: tunnel.PeerWrapper
+	(*CertificateRenewalRequest)(nil),  // 44: tunnel.CertificateRenewalRequest
+	(*CertificateRenewalResponse)(nil), // 45: tunnel.CertificateRenewalResponse
 }
 var file_pkg_tunnel_tunnel_proto_depIdxs = []int32{
 	3,  // 0: tunnel.HttpRequest.headers:type_name -> tunnel.HttpHeader
 	3,  // 1: tunnel.HttpResponse.headers:type_name -> tunnel.HttpHeader
-	0,  // 2: tunnel.CommandData.channel:type_name -> tunnel.ChannelDirection
-	0,  // 3: tunnel.CmdToolCommandData.channel:type_name -> tunnel.ChannelDirection
-	14, // 4: tunnel.AgentHello.endpoints:type_name -> tunnel.EndpointHealth
-	2,  // 5: tunnel.ControllerToAgentWrapper.pingResponse:type_name -> tunnel.PingResponse
-	4,  // 6: tunnel.ControllerToAgentWrapper.httpRequest:type_name -> tunnel.HttpRequest
-	5,  // 7: tunnel.ControllerToAgentWrapper.cancelRequest:type_name -> tunnel.CancelRequest
-	8,  // 8: tunnel.ControllerToAgentWrapper.commandRequest:type_name -> tunnel.CommandRequest
-	10, // 9: tunnel.ControllerToAgentWrapper.commandData:type_name -> tunnel.CommandData
-	1,  // 10: tunnel.AgentToControllerWrapper.pingRequest:type_name -> tunnel.PingRequest
-	6,  // 11: tunnel.AgentToControllerWrapper.httpResponse:type_name -> tunnel.HttpResponse
-	7,  // 12: tunnel.AgentToControllerWrapper.httpChunkedResponse:type_name -> tunnel.HttpChunkedResponse
-	15, // 13: tunnel.AgentToControllerWrapper.agentHello:type_name -> tunnel.AgentHello
-	10, // 14: tunnel.AgentToControllerWrapper.commandData:type_name -> tunnel.CommandData
-	12, // 15: tunnel.AgentToControllerWrapper.commandTermination:type_name -> tunnel.CommandTermination
-	9,  // 16: tunnel.CmdToolToControllerWrapper.commandRequest:type_name -> tunnel.CmdToolCommandRequest
-	11, // 17: tunnel.CmdToolToControllerWrapper.commandData:type_name -> tunnel.CmdToolCommandData
-	13, // 18: tunnel.ControllerToCmdToolWrapper.commandTermination:type_name -> tunnel.CmdToolCommandTermination
-	11, // 19: tunnel.ControllerToCmdToolWrapper.commandData:type_name -> tunnel.CmdToolCommandData
-	17, // 20: tunnel.AgentTunnelService.EventTunnel:input_type -> tunnel.AgentToControllerWrapper
-	18, // 21: tunnel.CmdToolTunnelService.EventTunnel:input_type -> tunnel.CmdToolToControllerWrapper
-	16, // 22: tunnel.AgentTunnelService.EventTunnel:output_type -> tunnel.ControllerToAgentWrapper
-	19, // 23: tunnel.CmdToolTunnelService.EventTunnel:output_type -> tunnel.ControllerToCmdToolWrapper
-	22, // [22:24] is the sub-list for method output_type
-	20, // [20:22] is the sub-list for method input_type
-	20, // [20:20] is the sub-list for extension type_name
-	20, // [20:20] is the sub-list for extension extendee
-	0,  // [0:20] is the sub-list for field type_name
+	4,  // 2: tunnel.StreamOpen.request:type_name -> tunnel.HttpRequest
+	0,  // 3: tunnel.CommandData.channel:type_name -> tunnel.ChannelDirection
+	0,  // 4: tunnel.CmdToolCommandData.channel:type_name -> tunnel.ChannelDirection
+	31, // 5: tunnel.AgentHello.endpoints:type_name -> tunnel.EndpointHealth
+	31, // 6: tunnel.EndpointsUpdate.endpoints:type_name -> tunnel.EndpointHealth
+	2,  // 7: tunnel.ControllerToAgentWrapper.pingResponse:type_name -> tunnel.PingResponse
+	4,  // 8: tunnel.ControllerToAgentWrapper.httpRequest:type_name -> tunnel.HttpRequest
+	7,  // 9: tunnel.ControllerToAgentWrapper.cancelRequest:type_name -> tunnel.CancelRequest
+	15, // 10: tunnel.ControllerToAgentWrapper.commandRequest:type_name -> tunnel.CommandRequest
+	17, // 11: tunnel.ControllerToAgentWrapper.commandData:type_name -> tunnel.CommandData
+	5,  // 12: tunnel.ControllerToAgentWrapper.httpRequestChunk:type_name -> tunnel.HttpRequestChunk
+	34, // 13: tunnel.ControllerToAgentWrapper.controllerDraining:type_name -> tunnel.ControllerDraining
+	12, // 14: tunnel.ControllerToAgentWrapper.streamOpen:type_name -> tunnel.StreamOpen
+	13, // 15: tunnel.ControllerToAgentWrapper.streamData:type_name -> tunnel.StreamData
+	14, // 16: tunnel.ControllerToAgentWrapper.streamClose:type_name -> tunnel.StreamClose
+	19, // 17: tunnel.ControllerToAgentWrapper.commandCancel:type_name -> tunnel.CommandCancel
+	35, // 18: tunnel.ControllerToAgentWrapper.agentReplaced:type_name -> tunnel.AgentReplaced
+	21, // 19: tunnel.ControllerToAgentWrapper.commandAck:type_name -> tunnel.CommandAck
+	25, // 20: tunnel.ControllerToAgentWrapper.fileRequest:type_name -> tunnel.FileRequest
+	1,  // 21: tunnel.ControllerToAgentWrapper.pingRequest:type_name -> tunnel.PingRequest
+	6,  // 22: tunnel.ControllerToAgentWrapper.httpFlowControl:type_name -> tunnel.HttpFlowControl
+	1,  // 23: tunnel.AgentToControllerWrapper.pingRequest:type_name -> tunnel.PingRequest
+	9,  // 24: tunnel.AgentToControllerWrapper.httpResponse:type_name -> tunnel.HttpResponse
+	10, // 25: tunnel.AgentToControllerWrapper.httpChunkedResponse:type_name -> tunnel.HttpChunkedResponse
+	32, // 26: tunnel.AgentToControllerWrapper.agentHello:type_name -> tunnel.AgentHello
+	17, // 27: tunnel.AgentToControllerWrapper.commandData:type_name -> tunnel.CommandData
+	23, // 28: tunnel.AgentToControllerWrapper.commandTermination:type_name -> tunnel.CommandTermination
+	11, // 29: tunnel.AgentToControllerWrapper.httpError:type_name -> tunnel.HttpError
+	13, // 30: tunnel.AgentToControllerWrapper.streamData:type_name -> tunnel.StreamData
+	14, // 31: tunnel.AgentToControllerWrapper.streamClose:type_name -> tunnel.StreamClose
+	8,  // 32: tunnel.AgentToControllerWrapper.cancelAck:type_name -> tunnel.CancelAck
+	33, // 33: tunnel.AgentToControllerWrapper.endpointsUpdate:type_name -> tunnel.EndpointsUpdate
+	27, // 34: tunnel.AgentToControllerWrapper.fileChunk:type_name -> tunnel.FileChunk
+	29, // 35: tunnel.AgentToControllerWrapper.fileTermination:type_name -> tunnel.FileTermination
+	2,  // 36: tunnel.AgentToControllerWrapper.pingResponse:type_name -> tunnel.PingResponse
+	16, // 37: tunnel.CmdToolToControllerWrapper.commandRequest:type_name -> tunnel.CmdToolCommandRequest
+	18, // 38: tunnel.CmdToolToControllerWrapper.commandData:type_name -> tunnel.CmdToolCommandData
+	20, // 39: tunnel.CmdToolToControllerWrapper.commandCancel:type_name -> tunnel.CmdToolCommandCancel
+	22, // 40: tunnel.CmdToolToControllerWrapper.commandAck:type_name -> tunnel.CmdToolCommandAck
+	26, // 41: tunnel.CmdToolToControllerWrapper.fileRequest:type_name -> tunnel.CmdToolFileRequest
+	24, // 42: tunnel.ControllerToCmdToolWrapper.commandTermination:type_name -> tunnel.CmdToolCommandTermination
+	18, // 43: tunnel.ControllerToCmdToolWrapper.commandData:type_name -> tunnel.CmdToolCommandData
+	28, // 44: tunnel.ControllerToCmdToolWrapper.fileChunk:type_name -> tunnel.CmdToolFileChunk
+	30, // 45: tunnel.ControllerToCmdToolWrapper.fileTermination:type_name -> tunnel.CmdToolFileTermination
+	31, // 46: tunnel.PeerAgent.endpoints:type_name -> tunnel.EndpointHealth
+	40, // 47: tunnel.PeerAdvertisement.agents:type_name -> tunnel.PeerAgent
+	4,  // 48: tunnel.PeerHttpRequest.request:type_name -> tunnel.HttpRequest
+	41, // 49: tunnel.PeerWrapper.advertisement:type_name -> tunnel.PeerAdvertisement
+	42, // 50: tunnel.PeerWrapper.httpRequest:type_name -> tunnel.PeerHttpRequest
+	5,  // 51: tunnel.PeerWrapper.httpRequestChunk:type_name -> tunnel.HttpRequestChunk
+	7,  // 52: tunnel.PeerWrapper.cancelRequest:type_name -> tunnel.CancelRequest
+	9,  // 53: tunnel.PeerWrapper.httpResponse:type_name -> tunnel.HttpResponse
+	10, // 54: tunnel.PeerWrapper.httpChunkedResponse:type_name -> tunnel.HttpChunkedResponse
+	11, // 55: tunnel.PeerWrapper.httpError:type_name -> tunnel.HttpError
+	37, // 56: tunnel.AgentTunnelService.EventTunnel:input_type -> tunnel.AgentToControllerWrapper
+	44, // 57: tunnel.AgentTunnelService.RenewCertificate:input_type -> tunnel.CertificateRenewalRequest
+	38, // 58: tunnel.CmdToolTunnelService.EventTunnel:input_type -> tunnel.CmdToolToControllerWrapper
+	43, // 59: tunnel.PeerTunnelService.EventTunnel:input_type -> tunnel.PeerWrapper
+	36, // 60: tunnel.AgentTunnelService.EventTunnel:output_type -> tunnel.ControllerToAgentWrapper
+	45, // 61: tunnel.AgentTunnelService.RenewCertificate:output_type -> tunnel.CertificateRenewalResponse
+	39, // 62: tunnel.CmdToolTunnelService.EventTunnel:output_type -> tunnel.ControllerToCmdToolWrapper
+	43, // 63: tunnel.PeerTunnelService.EventTunnel:output_type -> tunnel.PeerWrapper
+	60, // [60:64] is the sub-list for method output_type
+	56, // [56:60] is the sub-list for method input_type
+	56, // [56:56] is the sub-list for extension type_name
+	56, // [56:56] is the sub-list for extension extendee
+	0,  // [0:56] is the sub-list for field type_name
 }
 
 func init() { file_pkg_tunnel_tunnel_proto_init() }
@@ -1746,8 +4149,164 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*PingResponse); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PingResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpHeader); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpRequestChunk); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpFlowControl); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CancelRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CancelAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpChunkedResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HttpError); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StreamOpen); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StreamData); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StreamClose); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CommandRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1758,8 +4317,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*HttpHeader); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolCommandRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1770,8 +4329,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*HttpRequest); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[16].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CommandData); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1782,8 +4341,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CancelRequest); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[17].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolCommandData); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1794,8 +4353,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*HttpResponse); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[18].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CommandCancel); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1806,8 +4365,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*HttpChunkedResponse); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[19].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolCommandCancel); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1818,8 +4377,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CommandRequest); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[20].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CommandAck); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1830,8 +4389,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CmdToolCommandRequest); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[21].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolCommandAck); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1842,8 +4401,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CommandData); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[22].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CommandTermination); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1854,8 +4413,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CmdToolCommandData); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[23].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolCommandTermination); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1866,8 +4425,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CommandTermination); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[24].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1878,8 +4437,8 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CmdToolCommandTermination); i {
+		file_pkg_tunnel_tunnel_proto_msgTypes[25].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolFileRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1890,7 +4449,55 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_tunnel_tunnel_proto_msgTypes[26].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileChunk); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[27].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolFileChunk); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[28].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileTermination); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[29].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CmdToolFileTermination); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[30].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*EndpointHealth); i {
 			case 0:
 				return &v.state
@@ -1902,7 +4509,7 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_tunnel_tunnel_proto_msgTypes[31].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*AgentHello); i {
 			case 0:
 				return &v.state
@@ -1914,7 +4521,43 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_tunnel_tunnel_proto_msgTypes[32].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*EndpointsUpdate); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[33].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ControllerDraining); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[34].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AgentReplaced); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[35].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*ControllerToAgentWrapper); i {
 			case 0:
 				return &v.state
@@ -1926,7 +4569,7 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[16].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_tunnel_tunnel_proto_msgTypes[36].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*AgentToControllerWrapper); i {
 			case 0:
 				return &v.state
@@ -1938,7 +4581,7 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[17].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_tunnel_tunnel_proto_msgTypes[37].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*CmdToolToControllerWrapper); i {
 			case 0:
 				return &v.state
@@ -1950,7 +4593,7 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_tunnel_tunnel_proto_msgTypes[18].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_tunnel_tunnel_proto_msgTypes[38].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*ControllerToCmdToolWrapper); i {
 			case 0:
 				return &v.state
@@ -1962,29 +4605,134 @@ func file_pkg_tunnel_tunnel_proto_init() {
 				return nil
 			}
 		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[39].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PeerAgent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[40].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PeerAdvertisement); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[41].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PeerHttpRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[42].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PeerWrapper); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[43].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CertificateRenewalRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_tunnel_tunnel_proto_msgTypes[44].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CertificateRenewalResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
-	file_pkg_tunnel_tunnel_proto_msgTypes[15].OneofWrappers = []interface{}{
+	file_pkg_tunnel_tunnel_proto_msgTypes[35].OneofWrappers = []interface{}{
 		(*ControllerToAgentWrapper_PingResponse)(nil),
 		(*ControllerToAgentWrapper_HttpRequest)(nil),
 		(*ControllerToAgentWrapper_CancelRequest)(nil),
 		(*ControllerToAgentWrapper_CommandRequest)(nil),
 		(*ControllerToAgentWrapper_CommandData)(nil),
+		(*ControllerToAgentWrapper_HttpRequestChunk)(nil),
+		(*ControllerToAgentWrapper_ControllerDraining)(nil),
+		(*ControllerToAgentWrapper_StreamOpen)(nil),
+		(*ControllerToAgentWrapper_StreamData)(nil),
+		(*ControllerToAgentWrapper_StreamClose)(nil),
+		(*ControllerToAgentWrapper_CommandCancel)(nil),
+		(*ControllerToAgentWrapper_AgentReplaced)(nil),
+		(*ControllerToAgentWrapper_CommandAck)(nil),
+		(*ControllerToAgentWrapper_FileRequest)(nil),
+		(*ControllerToAgentWrapper_PingRequest)(nil),
+		(*ControllerToAgentWrapper_HttpFlowControl)(nil),
 	}
-	file_pkg_tunnel_tunnel_proto_msgTypes[16].OneofWrappers = []interface{}{
+	file_pkg_tunnel_tunnel_proto_msgTypes[36].OneofWrappers = []interface{}{
 		(*AgentToControllerWrapper_PingRequest)(nil),
 		(*AgentToControllerWrapper_HttpResponse)(nil),
 		(*AgentToControllerWrapper_HttpChunkedResponse)(nil),
 		(*AgentToControllerWrapper_AgentHello)(nil),
 		(*AgentToControllerWrapper_CommandData)(nil),
 		(*AgentToControllerWrapper_CommandTermination)(nil),
+		(*AgentToControllerWrapper_HttpError)(nil),
+		(*AgentToControllerWrapper_StreamData)(nil),
+		(*AgentToControllerWrapper_StreamClose)(nil),
+		(*AgentToControllerWrapper_CancelAck)(nil),
+		(*AgentToControllerWrapper_EndpointsUpdate)(nil),
+		(*AgentToControllerWrapper_FileChunk)(nil),
+		(*AgentToControllerWrapper_FileTermination)(nil),
+		(*AgentToControllerWrapper_PingResponse)(nil),
 	}
-	file_pkg_tunnel_tunnel_proto_msgTypes[17].OneofWrappers = []interface{}{
+	file_pkg_tunnel_tunnel_proto_msgTypes[37].OneofWrappers = []interface{}{
 		(*CmdToolToControllerWrapper_CommandRequest)(nil),
 		(*CmdToolToControllerWrapper_CommandData)(nil),
+		(*CmdToolToControllerWrapper_CommandCancel)(nil),
+		(*CmdToolToControllerWrapper_CommandAck)(nil),
+		(*CmdToolToControllerWrapper_FileRequest)(nil),
 	}
-	file_pkg_tunnel_tunnel_proto_msgTypes[18].OneofWrappers = []interface{}{
+	file_pkg_tunnel_tunnel_proto_msgTypes[38].OneofWrappers = []interface{}{
 		(*ControllerToCmdToolWrapper_CommandTermination)(nil),
 		(*ControllerToCmdToolWrapper_CommandData)(nil),
+		(*ControllerToCmdToolWrapper_FileChunk)(nil),
+		(*ControllerToCmdToolWrapper_FileTermination)(nil),
+	}
+	file_pkg_tunnel_tunnel_proto_msgTypes[42].OneofWrappers = []interface{}{
+		(*PeerWrapper_Advertisement)(nil),
+		(*PeerWrapper_HttpRequest)(nil),
+		(*PeerWrapper_HttpRequestChunk)(nil),
+		(*PeerWrapper_CancelRequest)(nil),
+		(*PeerWrapper_HttpResponse)(nil),
+		(*PeerWrapper_HttpChunkedResponse)(nil),
+		(*PeerWrapper_HttpError)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -1992,9 +4740,9 @@ func file_pkg_tunnel_tunnel_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_pkg_tunnel_tunnel_proto_rawDesc,
 			NumEnums:      1,
-			NumMessages:   19,
+			NumMessages:   45,
 			NumExtensions: 0,
-			NumServices:   2,
+			NumServices:   3,
 		},
 		GoTypes:           file_pkg_tunnel_tunnel_proto_goTypes,
 		DependencyIndexes: file_pkg_tunnel_tunnel_proto_depIdxs,
@@ -2020,6 +4768,7 @@ const _ = grpc.SupportPackageIsVersion6
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type AgentTunnelServiceClient interface {
 	EventTunnel(ctx context.Context, opts ...grpc.CallOption) (AgentTunnelService_EventTunnelClient, error)
+	RenewCertificate(ctx context.Context, in *CertificateRenewalRequest, opts ...grpc.CallOption) (*CertificateRenewalResponse, error)
 }
 
 type agentTunnelServiceClient struct {
@@ -2061,9 +4810,19 @@ func (x *agentTunnelServiceEventTunnelClient) Recv() (*ControllerToAgentWrapper,
 	return m, nil
 }
 
+func (c *agentTunnelServiceClient) RenewCertificate(ctx context.Context, in *CertificateRenewalRequest, opts ...grpc.CallOption) (*CertificateRenewalResponse, error) {
+	out := new(CertificateRenewalResponse)
+	err := c.cc.Invoke(ctx, "/tunnel.AgentTunnelService/RenewCertificate", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // AgentTunnelServiceServer is the server API for AgentTunnelService service.
 type AgentTunnelServiceServer interface {
 	EventTunnel(AgentTunnelService_EventTunnelServer) error
+	RenewCertificate(context.Context, *CertificateRenewalRequest) (*CertificateRenewalResponse, error)
 }
 
 // UnimplementedAgentTunnelServiceServer can be embedded to have forward compatible implementations.
@@ -2073,6 +4832,9 @@ type UnimplementedAgentTunnelServiceServer struct {
 func (*UnimplementedAgentTunnelServiceServer) EventTunnel(AgentTunnelService_EventTunnelServer) error {
 	return status.Errorf(codes.Unimplemented, "method EventTunnel not implemented")
 }
+func (*UnimplementedAgentTunnelServiceServer) RenewCertificate(context.Context, *CertificateRenewalRequest) (*CertificateRenewalResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenewCertificate not implemented")
+}
 
 func RegisterAgentTunnelServiceServer(s *grpc.Server, srv AgentTunnelServiceServer) {
 	s.RegisterService(&_AgentTunnelService_serviceDesc, srv)
@@ -2104,10 +4866,33 @@ func (x *agentTunnelServiceEventTunnelServer) Recv() (*AgentToControllerWrapper,
 	return m, nil
 }
 
+func _AgentTunnelService_RenewCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CertificateRenewalRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentTunnelServiceServer).RenewCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/tunnel.AgentTunnelService/RenewCertificate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentTunnelServiceServer).RenewCertificate(ctx, req.(*CertificateRenewalRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _AgentTunnelService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "tunnel.AgentTunnelService",
 	HandlerType: (*AgentTunnelServiceServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RenewCertificate",
+			Handler:    _AgentTunnelService_RenewCertificate_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "EventTunnel",
@@ -2222,3 +5007,107 @@ var _CmdToolTunnelService_serviceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "pkg/tunnel/tunnel.proto",
 }
+
+// PeerTunnelServiceClient is the client API for PeerTunnelService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type PeerTunnelServiceClient interface {
+	EventTunnel(ctx context.Context, opts ...grpc.CallOption) (PeerTunnelService_EventTunnelClient, error)
+}
+
+type peerTunnelServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPeerTunnelServiceClient(cc grpc.ClientConnInterface) PeerTunnelServiceClient {
+	return &peerTunnelServiceClient{cc}
+}
+
+func (c *peerTunnelServiceClient) EventTunnel(ctx context.Context, opts ...grpc.CallOption) (PeerTunnelService_EventTunnelClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_PeerTunnelService_serviceDesc.Streams[0], "/tunnel.PeerTunnelService/EventTunnel", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &peerTunnelServiceEventTunnelClient{stream}
+	return x, nil
+}
+
+type PeerTunnelService_EventTunnelClient interface {
+	Send(*PeerWrapper) error
+	Recv() (*PeerWrapper, error)
+	grpc.ClientStream
+}
+
+type peerTunnelServiceEventTunnelClient struct {
+	grpc.ClientStream
+}
+
+func (x *peerTunnelServiceEventTunnelClient) Send(m *PeerWrapper) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *peerTunnelServiceEventTunnelClient) Recv() (*PeerWrapper, error) {
+	m := new(PeerWrapper)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PeerTunnelServiceServer is the server API for PeerTunnelService service.
+type PeerTunnelServiceServer interface {
+	EventTunnel(PeerTunnelService_EventTunnelServer) error
+}
+
+// UnimplementedPeerTunnelServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedPeerTunnelServiceServer struct {
+}
+
+func (*UnimplementedPeerTunnelServiceServer) EventTunnel(PeerTunnelService_EventTunnelServer) error {
+	return status.Errorf(codes.Unimplemented, "method EventTunnel not implemented")
+}
+
+func RegisterPeerTunnelServiceServer(s *grpc.Server, srv PeerTunnelServiceServer) {
+	s.RegisterService(&_PeerTunnelService_serviceDesc, srv)
+}
+
+func _PeerTunnelService_EventTunnel_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PeerTunnelServiceServer).EventTunnel(&peerTunnelServiceEventTunnelServer{stream})
+}
+
+type PeerTunnelService_EventTunnelServer interface {
+	Send(*PeerWrapper) error
+	Recv() (*PeerWrapper, error)
+	grpc.ServerStream
+}
+
+type peerTunnelServiceEventTunnelServer struct {
+	grpc.ServerStream
+}
+
+func (x *peerTunnelServiceEventTunnelServer) Send(m *PeerWrapper) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *peerTunnelServiceEventTunnelServer) Recv() (*PeerWrapper, error) {
+	m := new(PeerWrapper)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _PeerTunnelService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "tunnel.PeerTunnelService",
+	HandlerType: (*PeerTunnelServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "EventTunnel",
+			Handler:       _PeerTunnelService_EventTunnel_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pkg/tunnel/tunnel.proto",
+}
@@ -22,6 +22,7 @@ package ulid
 
 import (
 	cryptorand "crypto/rand"
+	"io"
 	"sync"
 	"time"
 
@@ -31,21 +32,46 @@ import (
 // Context holds the state needed to generate a ULID using random values.  This
 // is a locked structure, so should not be used by a lot of threads if IDs are
 // generated at a high rate.
+//
+// IDs from one context always increase, even if the clock steps backwards,
+// so no two are the same.  The random part comes from crypto/rand, as IDs
+// are seen outside the process.
 type Context struct {
 	sync.Mutex
 	entropy *ulid.MonotonicEntropy
+	now     func() time.Time
+	last    uint64
 }
 
 // NewContext returns the context needed for subsequent calls.
 func NewContext() *Context {
-	entropy := ulid.Monotonic(cryptorand.Reader, 0)
-	return &Context{entropy: entropy}
+	return newContext(cryptorand.Reader, time.Now)
+}
+
+func newContext(entropy io.Reader, now func() time.Time) *Context {
+	return &Context{entropy: ulid.Monotonic(entropy, 0), now: now}
 }
 
 // Ulid - return a new ULID as a string.
 func (ctx *Context) Ulid() string {
 	ctx.Lock()
 	defer ctx.Unlock()
-	t := time.Now().Unix()
-	return ulid.MustNew(uint64(t), ctx.entropy).String()
+	ms := ulid.Timestamp(ctx.now())
+	if ms < ctx.last {
+		ms = ctx.last
+	}
+	for {
+		id, err := ulid.New(ms, ctx.entropy)
+		if err == ulid.ErrMonotonicOverflow {
+			// Every ID in this millisecond has been used, so borrow
+			// the next one.
+			ms++
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+		ctx.last = ms
+		return id.String()
+	}
 }
@@ -16,7 +16,12 @@
 package ulid
 
 import (
+	cryptorand "crypto/rand"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
 func TestUlid(t *testing.T) {
@@ -26,3 +31,80 @@ func TestUlid(t *testing.T) {
 		t.Errorf("Expected ulid length to be == 26, not %d", len(id))
 	}
 }
+
+func TestUlid_concurrent(t *testing.T) {
+	goroutines, each := 100, 10000
+	if testing.Short() {
+		each = 100
+	}
+	ctx := NewContext()
+	results := make([][]string, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			ids := make([]string, each)
+			for i := range ids {
+				ids[i] = ctx.Ulid()
+			}
+			results[g] = ids
+		}(g)
+	}
+	wg.Wait()
+
+	seen := make(map[string]struct{}, goroutines*each)
+	for _, ids := range results {
+		for i, id := range ids {
+			if _, found := seen[id]; found {
+				t.Fatalf("duplicate ID %s", id)
+			}
+			seen[id] = struct{}{}
+			if i > 0 && id <= ids[i-1] {
+				t.Fatalf("ID %s is not after %s", id, ids[i-1])
+			}
+		}
+	}
+}
+
+func TestUlid_clockStepsBack(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	ctx := newContext(cryptorand.Reader, func() time.Time { return now })
+	first := ctx.Ulid()
+	now = now.Add(-time.Hour)
+	second := ctx.Ulid()
+	if second <= first {
+		t.Errorf("ID %s is not after %s", second, first)
+	}
+	if got := ulid.MustParse(first).Time(); got != ulid.Timestamp(time.Unix(1600000000, 0)) {
+		t.Errorf("timestamp is %d, expected milliseconds", got)
+	}
+}
+
+// maxEntropy makes the first ID's random part as large as it can be, so
+// the next ID in the same millisecond overflows.  Later bytes are not zero,
+// as the increment is drawn from them and must not be zero.
+type maxEntropy struct {
+	used bool
+}
+
+func (e *maxEntropy) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 1
+		if !e.used && i < 10 {
+			p[i] = 0xff
+		}
+	}
+	e.used = true
+	return len(p), nil
+}
+
+func TestUlid_overflow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	ctx := newContext(&maxEntropy{}, func() time.Time { return now })
+	first := ctx.Ulid()
+	second := ctx.Ulid()
+	if second <= first {
+		t.Errorf("ID %s is not after %s", second, first)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// DebugVars returns the values dumped at /debug/vars.  It is called for
+// each request, so should only copy counters it can read cheaply.
+type DebugVars func() map[string]interface{}
+
+// DebugHandler serves the net/http/pprof profiles under /debug/pprof/, and
+// a JSON object at /debug/vars holding the goroutine count and whatever
+// vars returns.  It should be mounted at /debug/.
+func DebugHandler(vars DebugVars) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		ret := map[string]interface{}{}
+		if vars != nil {
+			ret = vars()
+		}
+		ret["goroutines"] = runtime.NumGoroutine()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ret)
+	})
+	return mux
+}
@@ -21,43 +21,78 @@ package util
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 )
 
 type httpErrorMessage struct {
-	Message string `json:"message"`
+	Code      int               `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"requestId,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// fieldErrors is implemented by errors which describe problems with
+// individual fields of a request, such as fwdapi.ValidationError.
+type fieldErrors interface {
+	FieldErrors() map[string]string
+}
+
+// errorDetails is implemented by errors which name what the request was
+// for, such as the agent and endpoint no agent could be found for.
+type errorDetails interface {
+	ErrorDetails() map[string]string
 }
 
 type httpErrorResponse struct {
 	Error *httpErrorMessage `json:"error"`
 }
 
-func httpError(err error) []byte {
+func httpError(err error, code int, requestID string) []byte {
 	ret := &httpErrorResponse{
 		Error: &httpErrorMessage{
-			Message: fmt.Sprintf("Unable to process request: %v", err),
+			Code:      code,
+			Message:   fmt.Sprintf("Unable to process request: %v", err),
+			RequestID: requestID,
 		},
 	}
+	var fe fieldErrors
+	if errors.As(err, &fe) {
+		ret.Error.Fields = fe.FieldErrors()
+	}
+	var ed errorDetails
+	if errors.As(err, &ed) {
+		ret.Error.Details = ed.ErrorDetails()
+	}
 	json, err := json.Marshal(ret)
 	if err != nil {
-		return []byte(`{"error":{"message":"Unknown Error"}}`)
+		return []byte(fmt.Sprintf(`{"error":{"code":%d,"message":"Unknown Error"}}`, code))
 	}
 	return json
 }
 
 // FailRequest marks a request as failed.  This will set the provided status code,
-// and write to the message body a JSON format error message.  The http.ResponseWriter
+// and write to the message body a JSON format error message, which repeats the
+// code.  If err describes invalid fields of the request, or has details of what
+// it was for, they are listed as well.  The http.ResponseWriter
 // should not have been used, or be used after calling FailRequest.
 func FailRequest(w http.ResponseWriter, err error, code int) {
+	FailRequestWithID(w, err, code, "")
+}
+
+// FailRequestWithID is FailRequest, with the request ID included in the
+// error so it can be matched with the controller's logs.
+func FailRequestWithID(w http.ResponseWriter, err error, code int, requestID string) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	errmsg := httpError(err)
+	errmsg := httpError(err, code, requestID)
 	n, err := w.Write(errmsg)
 	if err != nil {
-		log.Printf("failed to write message in FailRequest: %v", err)
+		Warnf("failed to write message in FailRequest: %v", err)
 	}
 	if n != len(errmsg) {
-		log.Printf("failed to write entire message in FailRequest: %d of %d bytes written", n, len(errmsg))
+		Warnf("failed to write entire message in FailRequest: %d of %d bytes written", n, len(errmsg))
 	}
 }
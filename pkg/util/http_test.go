@@ -0,0 +1,80 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testFieldError struct{}
+
+func (testFieldError) Error() string { return "'name' is required" }
+
+func (testFieldError) FieldErrors() map[string]string {
+	return map[string]string{"name": "is required"}
+}
+
+type testDetailsError struct{}
+
+func (testDetailsError) Error() string { return "no agents connected" }
+
+func (testDetailsError) ErrorDetails() map[string]string {
+	return map[string]string{"agentName": "agent1"}
+}
+
+func TestFailRequestWithID(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		requestID string
+		want      string
+	}{
+		{"no id", errors.New("oops"), "", `{"error":{"code":401,"message":"Unable to process request: oops"}}`},
+		{"id", errors.New("oops"), "01F", `{"error":{"code":401,"message":"Unable to process request: oops","requestId":"01F"}}`},
+		{
+			"fields",
+			fmt.Errorf("validating: %w", testFieldError{}),
+			"",
+			`{"error":{"code":401,"message":"Unable to process request: validating: 'name' is required","fields":{"name":"is required"}}}`,
+		},
+		{
+			"details",
+			testDetailsError{},
+			"01F",
+			`{"error":{"code":401,"message":"Unable to process request: no agents connected","requestId":"01F","details":{"agentName":"agent1"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			FailRequestWithID(w, tt.err, http.StatusUnauthorized, tt.requestID)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message.  Messages below the
+// configured level are discarded.
+type LogLevel int
+
+// The log levels, from least to most severe.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLogLevel converts a -logLevel flag value to a LogLevel.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s', must be one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Log formats accepted by SetupLogging.
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
+// logOutput is shared by every Logger, so lines are never interleaved.
+var logOutput = struct {
+	sync.Mutex
+	w      io.Writer
+	level  LogLevel
+	format string
+	now    func() time.Time
+}{w: os.Stderr, level: LevelInfo, format: LogFormatConsole, now: time.Now}
+
+// SetupLogging sets the minimum level logged, and whether each line is
+// written for people ("console") or as a JSON object ("json").
+func SetupLogging(level string, format string) error {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != LogFormatConsole && format != LogFormatJSON {
+		return fmt.Errorf("unknown log format '%s', must be %s or %s", format, LogFormatConsole, LogFormatJSON)
+	}
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.level = l
+	logOutput.format = format
+	return nil
+}
+
+// SetLogOutput sends log lines to w, which is standard error by default.
+func SetLogOutput(w io.Writer) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.w = w
+}
+
+// Logger writes leveled messages, each carrying the logger's fields.  The
+// zero value has no fields.
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a logger which adds the given key, value pairs to every
+// message, after any fields this logger already has.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keysAndValues...)
+	return &Logger{fields: fields}
+}
+
+// Debugf logs at debug level.
+func (l *Logger) Debugf(format string, args ...interface{}) { l.output(LevelDebug, format, args) }
+
+// Infof logs at info level.
+func (l *Logger) Infof(format string, args ...interface{}) { l.output(LevelInfo, format, args) }
+
+// Warnf logs at warn level.
+func (l *Logger) Warnf(format string, args ...interface{}) { l.output(LevelWarn, format, args) }
+
+// Errorf logs at error level.
+func (l *Logger) Errorf(format string, args ...interface{}) { l.output(LevelError, format, args) }
+
+// Fatalf logs at error level, and then exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.output(LevelError, format, args)
+	os.Exit(1)
+}
+
+func (l *Logger) output(level LogLevel, format string, args []interface{}) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	if level < logOutput.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	ts := logOutput.now()
+	var buf bytes.Buffer
+	if logOutput.format == LogFormatJSON {
+		buf.WriteString(`{"ts":`)
+		writeJSON(&buf, ts.UTC().Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i < len(l.fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(l.fields[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, fieldValue(l.fields, i+1))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s", ts.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), strings.TrimSuffix(msg, "\n"))
+		for i := 0; i < len(l.fields); i += 2 {
+			fmt.Fprintf(&buf, " %v=%v", l.fields[i], fieldValue(l.fields, i+1))
+		}
+		buf.WriteByte('\n')
+	}
+	_, _ = logOutput.w.Write(buf.Bytes())
+}
+
+// fieldValue returns the value at i, allowing for a key without a value.
+// Errors are logged as their message.
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i >= len(fields) {
+		return "(missing)"
+	}
+	if err, ok := fields[i].(error); ok {
+		return err.Error()
+	}
+	return fields[i]
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// The process-wide logger, which has no fields.
+var rootLogger = &Logger{}
+
+// LogWith returns a logger which adds the given key, value pairs to every
+// message, such as a transaction ID and agent name for one request.
+func LogWith(keysAndValues ...interface{}) *Logger {
+	return rootLogger.With(keysAndValues...)
+}
+
+// Debugf logs at debug level.
+func Debugf(format string, args ...interface{}) { rootLogger.output(LevelDebug, format, args) }
+
+// Infof logs at info level.
+func Infof(format string, args ...interface{}) { rootLogger.output(LevelInfo, format, args) }
+
+// Warnf logs at warn level.
+func Warnf(format string, args ...interface{}) { rootLogger.output(LevelWarn, format, args) }
+
+// Errorf logs at error level.
+func Errorf(format string, args ...interface{}) { rootLogger.output(LevelError, format, args) }
+
+// Fatalf logs at error level, and then exits.
+func Fatalf(format string, args ...interface{}) {
+	rootLogger.output(LevelError, format, args)
+	os.Exit(1)
+}
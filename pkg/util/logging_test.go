@@ -0,0 +1,144 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// captureLogs sends log output to a buffer, with a fixed clock, until the
+// returned function is called.
+func captureLogs(t *testing.T, logLevel string, logFormat string) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	logOutput.Lock()
+	w, now, level, format := logOutput.w, logOutput.now, logOutput.level, logOutput.format
+	logOutput.w = &buf
+	logOutput.now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	logOutput.Unlock()
+	if err := SetupLogging(logLevel, logFormat); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &buf, func() {
+		logOutput.Lock()
+		defer logOutput.Unlock()
+		logOutput.w, logOutput.now, logOutput.level, logOutput.format = w, now, level, format
+	}
+}
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  string
+		format string
+		log    func()
+		want   string
+	}{
+		{
+			"console",
+			"info",
+			LogFormatConsole,
+			func() { LogWith("transaction", "01F7", "agent", "smith").Warnf("Unable to write: %v", "EOF") },
+			"2021/06/01 12:00:00 WARN  Unable to write: EOF transaction=01F7 agent=smith\n",
+		},
+		{
+			"json",
+			"info",
+			LogFormatJSON,
+			func() { LogWith("transaction", "01F7", "err", errors.New("boom")).Infof("Sending %d bytes", 10) },
+			`{"ts":"2021-06-01T12:00:00Z","level":"info","msg":"Sending 10 bytes","transaction":"01F7","err":"boom"}` + "\n",
+		},
+		{
+			"below level",
+			"warn",
+			LogFormatConsole,
+			func() { Infof("not logged"); Debugf("not logged") },
+			"",
+		},
+		{
+			"debug",
+			"debug",
+			LogFormatConsole,
+			func() { Debugf("logged") },
+			"2021/06/01 12:00:00 DEBUG logged\n",
+		},
+		{
+			"missing value",
+			"info",
+			LogFormatConsole,
+			func() { LogWith("transaction").Errorf("odd") },
+			"2021/06/01 12:00:00 ERROR odd transaction=(missing)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, restore := captureLogs(t, tt.level, tt.format)
+			defer restore()
+			tt.log()
+			if buf.String() != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestLogger_With(t *testing.T) {
+	parent := LogWith("agent", "smith")
+	child := parent.With("transaction", "01F7")
+	if len(parent.fields) != 2 {
+		t.Errorf("With must not change the parent, got %v", parent.fields)
+	}
+	if len(child.fields) != 4 {
+		t.Errorf("expected 4 fields, got %v", child.fields)
+	}
+}
+
+func TestSetupLogging_invalid(t *testing.T) {
+	if err := SetupLogging("verbose", LogFormatConsole); err == nil {
+		t.Errorf("expected an error for an unknown level")
+	}
+	if err := SetupLogging("info", "xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    LogLevel
+		wantErr bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"warn", LevelWarn, false},
+		{"error", LevelError, false},
+		{"trace", LevelInfo, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLogLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLogLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLogLevel() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
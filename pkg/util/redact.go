@@ -0,0 +1,106 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// RedactedValue replaces the value of a sensitive header wherever
+// headers are logged.
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactedHeaders are the headers redacted unless others are
+// configured.
+var DefaultRedactedHeaders = []string{"Authorization", "Cookie", "X-Api-Key"}
+
+var redactedHeaders = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: headerSet(DefaultRedactedHeaders)}
+
+func headerSet(names []string) map[string]bool {
+	ret := make(map[string]bool, len(names))
+	for _, name := range names {
+		ret[http.CanonicalHeaderKey(name)] = true
+	}
+	return ret
+}
+
+// ValidateHeaderNames checks that each entry of names is a header name.
+func ValidateHeaderNames(names []string) error {
+	for i, name := range names {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("[%d]: '%s' is not a valid header name", i, name)
+		}
+	}
+	return nil
+}
+
+// SetRedactedHeaders sets the headers whose values are redacted.  An
+// empty list restores the defaults.
+func SetRedactedHeaders(names []string) {
+	if len(names) == 0 {
+		names = DefaultRedactedHeaders
+	}
+	set := headerSet(names)
+	redactedHeaders.Lock()
+	defer redactedHeaders.Unlock()
+	redactedHeaders.names = set
+}
+
+// IsRedactedHeader returns true if the named header's values are redacted.
+// Header names are not case sensitive.
+func IsRedactedHeader(name string) bool {
+	redactedHeaders.RLock()
+	defer redactedHeaders.RUnlock()
+	return redactedHeaders.names[http.CanonicalHeaderKey(name)]
+}
+
+// RedactHeaderValues returns the values of the named header as they may be
+// logged.
+func RedactHeaderValues(name string, values []string) []string {
+	if !IsRedactedHeader(name) {
+		return values
+	}
+	ret := make([]string, len(values))
+	for i := range values {
+		ret[i] = RedactedValue
+	}
+	return ret
+}
+
+// HeaderLogString formats h for a log line, with sensitive values
+// redacted, as "Name=[value ...]" pairs sorted by name.
+func HeaderLogString(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=[" + strings.Join(RedactHeaderValues(name, h[name]), " ") + "]"
+	}
+	return strings.Join(parts, " ")
+}
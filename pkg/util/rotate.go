@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile appends to a file.  Once a write would grow it past
+// maxBytes it is renamed with a ".1" suffix, older files moving up to
+// ".maxBackups", and a new file started.  Each write is kept whole in one
+// file.  It is safe for concurrent use.
+type RotatingFile struct {
+	sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens, or creates, the file.  A maxBytes of zero
+// disables rotation.
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", rf.path, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to open %s: %v", rf.path, err)
+	}
+	rf.f = f
+	rf.size = st.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %v", rf.path, err)
+	}
+	rf.f = nil
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			from := fmt.Sprintf("%s.%d", rf.path, i)
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", rf.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("unable to rotate %s: %v", rf.path, err)
+			}
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return fmt.Errorf("unable to rotate %s: %v", rf.path, err)
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return fmt.Errorf("unable to rotate %s: %v", rf.path, err)
+	}
+	return rf.open()
+}
+
+// Write appends p to the file, rotating it first if needed.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	return rf.write(p, false)
+}
+
+// WriteSync is Write, and then syncs the file to disk.
+func (rf *RotatingFile) WriteSync(p []byte) (int, error) {
+	return rf.write(p, true)
+}
+
+func (rf *RotatingFile) write(p []byte, sync bool) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if sync {
+		if err := rf.f.Sync(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
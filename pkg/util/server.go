@@ -0,0 +1,52 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RunHTTPServer runs serve (typically srv.ListenAndServe or ListenAndServeTLS)
+// until ctx is cancelled, then shuts the server down.  New connections are
+// refused immediately, and in-flight requests are given up to grace to
+// complete before their connections are forcibly closed.  An error is
+// returned only if the server fails for some reason other than shutdown.
+func RunHTTPServer(ctx context.Context, srv *http.Server, serve func() error, grace time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		Warnf("HTTP server on %s did not shut down cleanly: %v", srv.Addr, err)
+		_ = srv.Close()
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunHTTPServer_drainsInFlight(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	url := "http://" + lis.Addr().String()
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- RunHTTPServer(ctx, srv, func() error { return srv.Serve(lis) }, 5*time.Second)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+
+	<-started
+	cancel()
+
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request got %q, want \"done\"", got)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("RunHTTPServer() = %v, want nil", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("expected new connections to be refused after shutdown")
+	}
+}
+
+func TestRunHTTPServer_serveError(t *testing.T) {
+	srv := &http.Server{Addr: "bogus-address"}
+	err := RunHTTPServer(context.Background(), srv, srv.ListenAndServe, time.Second)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig restricts the protocol versions and cipher suites used on a
+// connection.  Versions are "1.2" or "1.3", and cipher suites are named as
+// in crypto/tls, for example TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.  Cipher
+// suites only apply to TLS 1.2, as TLS 1.3 suites are not configurable.
+// Anything left unset keeps the default of the connection it is applied to.
+type TLSConfig struct {
+	MinVersion   string   `yaml:"minVersion,omitempty"`
+	MaxVersion   string   `yaml:"maxVersion,omitempty"`
+	CipherSuites []string `yaml:"cipherSuites,omitempty"`
+}
+
+// Validate returns an error describing every problem with the settings.
+func (c TLSConfig) Validate() error {
+	problems := []string{}
+	for _, v := range []struct{ name, value string }{
+		{"minVersion", c.MinVersion},
+		{"maxVersion", c.MaxVersion},
+	} {
+		if _, ok := tlsVersions[v.value]; v.value != "" && !ok {
+			problems = append(problems, fmt.Sprintf("%s %q is not supported, use 1.2 or 1.3", v.name, v.value))
+		}
+	}
+	min, max := tlsVersions[c.MinVersion], tlsVersions[c.MaxVersion]
+	if min != 0 && max != 0 && max < min {
+		problems = append(problems, "maxVersion is lower than minVersion")
+	}
+	supported := cipherSuitesByName()
+	for _, name := range c.CipherSuites {
+		if _, ok := supported[name]; !ok {
+			problems = append(problems, fmt.Sprintf("cipher suite %q is not supported, use one of %s",
+				name, strings.Join(SupportedCipherSuites(), ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Apply sets the configured versions and cipher suites on tc.  Settings
+// which do not pass Validate are ignored.
+func (c TLSConfig) Apply(tc *tls.Config) {
+	if v, ok := tlsVersions[c.MinVersion]; ok {
+		tc.MinVersion = v
+	}
+	if v, ok := tlsVersions[c.MaxVersion]; ok {
+		tc.MaxVersion = v
+	}
+	if len(c.CipherSuites) == 0 {
+		return
+	}
+	supported := cipherSuitesByName()
+	tc.CipherSuites = nil
+	for _, name := range c.CipherSuites {
+		if id, ok := supported[name]; ok {
+			tc.CipherSuites = append(tc.CipherSuites, id)
+		}
+	}
+}
+
+// SupportedCipherSuites returns the names of the cipher suites which may
+// be configured.  Suites crypto/tls considers insecure are not included.
+func SupportedCipherSuites() []string {
+	names := []string{}
+	for _, s := range configurableCipherSuites() {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func cipherSuitesByName() map[string]uint16 {
+	ret := map[string]uint16{}
+	for _, s := range configurableCipherSuites() {
+		ret[s.Name] = s.ID
+	}
+	return ret
+}
+
+func configurableCipherSuites() []*tls.CipherSuite {
+	ret := []*tls.CipherSuite{}
+	for _, s := range tls.CipherSuites() {
+		for _, v := range s.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				ret = append(ret, s)
+				break
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTLSConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    TLSConfig
+		wantError []string
+	}{
+		{"empty", TLSConfig{}, nil},
+		{
+			"1.3 only",
+			TLSConfig{MinVersion: "1.3", MaxVersion: "1.3"},
+			nil,
+		},
+		{
+			"suites",
+			TLSConfig{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			nil,
+		},
+		{
+			"old version",
+			TLSConfig{MinVersion: "1.0"},
+			[]string{`minVersion "1.0" is not supported`},
+		},
+		{
+			"inverted",
+			TLSConfig{MinVersion: "1.3", MaxVersion: "1.2"},
+			[]string{"maxVersion is lower than minVersion"},
+		},
+		{
+			"insecure suite",
+			TLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			[]string{`cipher suite "TLS_RSA_WITH_RC4_128_SHA" is not supported`, "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		},
+		{
+			"TLS 1.3 suite",
+			TLSConfig{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+			[]string{`cipher suite "TLS_AES_128_GCM_SHA256" is not supported`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if len(tt.wantError) == 0 {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want an error")
+			}
+			for _, want := range tt.wantError {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error '%v' to contain '%s'", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTLSConfig_Apply(t *testing.T) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	TLSConfig{}.Apply(tc)
+	if tc.MinVersion != tls.VersionTLS12 || tc.MaxVersion != 0 || tc.CipherSuites != nil {
+		t.Errorf("empty config changed %+v", tc)
+	}
+
+	TLSConfig{
+		MinVersion: "1.2",
+		MaxVersion: "1.3",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		},
+	}.Apply(tc)
+	if tc.MinVersion != tls.VersionTLS12 || tc.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("versions = %x, %x", tc.MinVersion, tc.MaxVersion)
+	}
+	want := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	if !reflect.DeepEqual(tc.CipherSuites, want) {
+		t.Errorf("CipherSuites = %v, want %v", tc.CipherSuites, want)
+	}
+}
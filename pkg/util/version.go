@@ -32,3 +32,17 @@ func (v *Versions) String() string {
 	}
 	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
 }
+
+// GitCommit and BuildDate describe the build of the running binary.  They
+// are set at link time, for example:
+//
+//	go build -ldflags "-X github.com/opsmx/oes-birger/pkg/util.GitCommit=$(git rev-parse HEAD)"
+var (
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// Detailed returns the version followed by the commit and build date.
+func (v *Versions) Detailed() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", v.String(), GitCommit, BuildDate)
+}
@@ -60,3 +60,16 @@ func TestVersions_String(t *testing.T) {
 		})
 	}
 }
+
+func TestVersions_Detailed(t *testing.T) {
+	oldCommit, oldDate := GitCommit, BuildDate
+	defer func() { GitCommit, BuildDate = oldCommit, oldDate }()
+	GitCommit = "abc123"
+	BuildDate = "2021-06-01T00:00:00Z"
+
+	v := &Versions{Major: 1, Minor: 2, Patch: 3}
+	want := "1.2.3 (commit abc123, built 2021-06-01T00:00:00Z)"
+	if got := v.Detailed(); got != want {
+		t.Errorf("Versions.Detailed() = %v, want %v", got, want)
+	}
+}
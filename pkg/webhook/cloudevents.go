@@ -0,0 +1,107 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"fmt"
+	"time"
+)
+
+// Formats events may be delivered in.
+const (
+	// FormatLegacy posts each event as JSON, as it was sent.
+	FormatLegacy = "legacy"
+
+	// FormatCloudEvents posts each event as a CloudEvents 1.0 structured
+	// mode JSON event, with the event sent as its data.
+	FormatCloudEvents = "cloudevents"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json; charset=UTF-8"
+
+	// CloudEventTypePrefix begins the type of each event we send.
+	CloudEventTypePrefix = "io.opsmx.birger."
+
+	// defaultCloudEventType is used for events which do not implement
+	// Event.
+	defaultCloudEventType = CloudEventTypePrefix + "event"
+)
+
+//
+// Event is implemented by events which know their CloudEvents type and
+// subject.  The type is appended to CloudEventTypePrefix, so
+// "agent.connected" becomes "io.opsmx.birger.agent.connected".
+//
+type Event interface {
+	CloudEventType() string
+	CloudEventSubject() string
+}
+
+//
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format.
+//
+type CloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+func validateFormat(format string) error {
+	switch format {
+	case "", FormatLegacy, FormatCloudEvents:
+		return nil
+	}
+	return fmt.Errorf("unknown format '%s', must be %s or %s", format, FormatLegacy, FormatCloudEvents)
+}
+
+// makeCloudEvent wraps msg, giving it an ID which is kept as delivery is
+// retried, so receivers can discard duplicates.
+func makeCloudEvent(msg interface{}, source string, id string, now time.Time) *CloudEvent {
+	ce := &CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              id,
+		Source:          source,
+		Type:            defaultCloudEventType,
+		Time:            now.UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            msg,
+	}
+	if e, ok := msg.(Event); ok {
+		ce.Type = CloudEventTypePrefix + e.CloudEventType()
+		ce.Subject = e.CloudEventSubject()
+	}
+	return ce
+}
+
+// describe names msg for a log line.  Events may carry details which do
+// not belong in logs, so their contents are never included.
+func describe(msg interface{}) string {
+	switch e := msg.(type) {
+	case *CloudEvent:
+		return fmt.Sprintf("%s %s", e.Type, e.ID)
+	case Event:
+		return fmt.Sprintf("%s %s", e.CloudEventType(), e.CloudEventSubject())
+	}
+	return fmt.Sprintf("%T", msg)
+}
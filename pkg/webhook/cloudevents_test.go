@@ -0,0 +1,194 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// typedEvent implements Event.
+type typedEvent struct {
+	Agent string `json:"agent"`
+}
+
+func (e typedEvent) CloudEventType() string    { return "agent.connected" }
+func (e typedEvent) CloudEventSubject() string { return e.Agent }
+
+// capture is a webhook receiver which keeps each request's content type
+// and body, failing the first failures requests.
+type capture struct {
+	failures     int
+	contentTypes chan string
+	bodies       chan []byte
+}
+
+func newCapture(failures int) *capture {
+	return &capture{failures: failures, contentTypes: make(chan string, 10), bodies: make(chan []byte, 10)}
+}
+
+func (c *capture) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	c.contentTypes <- req.Header.Get("Content-Type")
+	c.bodies <- body
+	if c.failures > 0 {
+		c.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (c *capture) next(t *testing.T) (string, []byte) {
+	select {
+	case ct := <-c.contentTypes:
+		return ct, <-c.bodies
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a delivery")
+		return "", nil
+	}
+}
+
+func TestRunner_formats(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		msg      interface{}
+		wantType string
+		want     string
+	}{
+		{
+			"legacy",
+			"",
+			typedEvent{"agent1"},
+			"application/json",
+			`{"agent":"agent1"}`,
+		},
+		{
+			"cloudevents",
+			FormatCloudEvents,
+			typedEvent{"agent1"},
+			cloudEventsContentType,
+			`{"specversion":"1.0","id":"ID","source":"https://control.example.com:9003","type":"io.opsmx.birger.agent.connected","subject":"agent1","time":"TIME","datacontenttype":"application/json","data":{"agent":"agent1"}}`,
+		},
+		{
+			"cloudevents without a type",
+			FormatCloudEvents,
+			event{"agent1", 1},
+			cloudEventsContentType,
+			`{"specversion":"1.0","id":"ID","source":"https://control.example.com:9003","type":"io.opsmx.birger.event","time":"TIME","datacontenttype":"application/json","data":{"agent":"agent1","n":1}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCapture(1)
+			server := httptest.NewServer(c)
+			defer server.Close()
+			wr, err := NewRunner(server.URL, Config{
+				Format:         tt.format,
+				Source:         "https://control.example.com:9003",
+				InitialBackoff: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewRunner: %v", err)
+			}
+			go wr.Run()
+			defer wr.Close()
+
+			wr.Send(tt.msg)
+			_, first := c.next(t)
+			contentType, body := c.next(t)
+			if contentType != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", contentType, tt.wantType)
+			}
+			if string(first) != string(body) {
+				t.Errorf("retry sent %s, first attempt sent %s", body, first)
+			}
+
+			// The ID and time vary, so are checked and then replaced.
+			var ce CloudEvent
+			if err := json.Unmarshal(body, &ce); err != nil {
+				t.Fatal(err)
+			}
+			got := string(body)
+			if tt.format == FormatCloudEvents {
+				if len(ce.ID) != 26 {
+					t.Errorf("id = %q, want a ULID", ce.ID)
+				}
+				if _, err := time.Parse(time.RFC3339Nano, ce.Time); err != nil {
+					t.Errorf("time = %q: %v", ce.Time, err)
+				}
+				got = strings.Replace(got, ce.ID, "ID", 1)
+				got = strings.Replace(got, ce.Time, "TIME", 1)
+			}
+			if got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{"default", Config{}, ""},
+		{"legacy", Config{Format: FormatLegacy}, ""},
+		{"cloudevents", Config{Format: FormatCloudEvents, Source: "controller"}, ""},
+		{"cloudevents without source", Config{Format: FormatCloudEvents}, "source must be set"},
+		{"unknown format", Config{Format: "xml"}, "unknown format 'xml'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		msg  interface{}
+		want string
+	}{
+		{"event", typedEvent{"agent1"}, "agent.connected agent1"},
+		{"cloud event", makeCloudEvent(typedEvent{"agent1"}, "controller", "id1", now), CloudEventTypePrefix + "agent.connected id1"},
+		{"other", map[string]string{"token": "s3cret"}, "map[string]string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describe(tt.msg); got != tt.want {
+				t.Errorf("describe() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
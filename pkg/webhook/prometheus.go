@@ -0,0 +1,49 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	deliveredCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_events_delivered_total",
+		Help: "The total number of webhook events delivered",
+	})
+
+	retriedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "webhook_events_retried_total",
+		Help: "The total number of webhook delivery attempts which failed and were retried",
+	})
+
+	attemptsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_delivery_attempts_total",
+		Help: "The total number of webhook delivery attempts, by HTTP status code, or timeout or error if there was no response",
+	}, []string{"result"})
+
+	durationHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "webhook_delivery_duration_seconds",
+		Help: "The time taken by each webhook delivery attempt",
+	})
+
+	droppedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_events_dropped_total",
+		Help: "The total number of webhook events dropped, because the queue was full or delivery kept failing",
+	}, []string{"reason"})
+)
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader holds "sha256=" followed by the hex HMAC-SHA256 of
+	// the timestamp, a period, and the body, keyed with the shared secret.
+	SignatureHeader = "X-OpsMX-Signature"
+
+	// TimestampHeader holds the Unix time, in seconds, the request was
+	// signed.
+	TimestampHeader = "X-OpsMX-Timestamp"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	// ErrInvalidSignature is returned by Verify when the signature is
+	// missing or does not match.
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+
+	// ErrStaleTimestamp is returned by Verify when the timestamp is
+	// missing, or too far from the current time.
+	ErrStaleTimestamp = errors.New("webhook: missing or stale timestamp")
+)
+
+//
+// Sign returns the value of the SignatureHeader for the body, sent with
+// the given TimestampHeader value.
+//
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest sets the signature headers on a request about to be sent.
+func signRequest(h http.Header, secret []byte, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	h.Set(TimestampHeader, timestamp)
+	h.Set(SignatureHeader, Sign(secret, timestamp, body))
+}
+
+//
+// Verify checks the signature headers of a webhook request against the
+// exact body received.  Requests signed more than maxAge before or after
+// the current time are rejected, so a captured request cannot be
+// replayed later.
+//
+func Verify(secret []byte, h http.Header, body []byte, maxAge time.Duration) error {
+	return verifyAt(secret, h, body, maxAge, time.Now())
+}
+
+func verifyAt(secret []byte, h http.Header, body []byte, maxAge time.Duration, now time.Time) error {
+	timestamp := h.Get(TimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > maxAge || age < -maxAge {
+		return ErrStaleTimestamp
+	}
+	signature := h.Get(SignatureHeader)
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{
+			"event",
+			"secret",
+			"1622505600",
+			`{"agent":"a","n":1}`,
+			"sha256=f3fec7302839c6b45c55f7f35b766884d4bb2a44a336b861e9af258414acc09c",
+		},
+		{
+			"empty body",
+			"key",
+			"0",
+			"",
+			"sha256=85841b4efc3cd7776c3c8f9b7cca9e281c550e5d19889d78e9e669c6337f000d",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign([]byte(tt.secret), tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("Sign() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"agent":"a","n":1}`)
+	signedAt := time.Unix(1622505600, 0)
+	signed := http.Header{}
+	signRequest(signed, secret, body, signedAt)
+	retimed := signed.Clone()
+	retimed.Set(TimestampHeader, "1622505601")
+	unsigned := signed.Clone()
+	unsigned.Del(SignatureHeader)
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  http.Header
+		body    string
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", "secret", signed, string(body), signedAt.Add(time.Minute), nil},
+		{"wrong secret", "other", signed, string(body), signedAt, ErrInvalidSignature},
+		{"modified body", "secret", signed, `{"agent":"b","n":1}`, signedAt, ErrInvalidSignature},
+		{"replayed", "secret", signed, string(body), signedAt.Add(10 * time.Minute), ErrStaleTimestamp},
+		{"from the future", "secret", signed, string(body), signedAt.Add(-10 * time.Minute), ErrStaleTimestamp},
+		{"unsigned", "secret", http.Header{}, string(body), signedAt, ErrStaleTimestamp},
+		{"timestamp changed", "secret", retimed, string(body), signedAt, ErrInvalidSignature},
+		{"no signature", "secret", unsigned, string(body), signedAt, ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyAt([]byte(tt.secret), tt.header, []byte(tt.body), 5*time.Minute, tt.now)
+			if err != tt.wantErr {
+				t.Errorf("verifyAt() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunner_signs(t *testing.T) {
+	verified := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = Verify([]byte("s3cret"), r.Header, body, time.Minute)
+		}
+		verified <- err
+	}))
+	defer server.Close()
+
+	wr, err := NewRunner(server.URL, Config{Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("NewRunner: %v", err)
+	}
+	defer wr.Close()
+	if err := wr.perform(event{"a", 1}); err != nil {
+		t.Fatalf("perform() = %v", err)
+	}
+	if err := <-verified; err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
@@ -15,77 +15,364 @@
  */
 
 //
-// Package webhook will
+// Package webhook will deliver JSON events to a URL.  Events are queued
+// and delivered in order, and retried with a backoff if delivery fails.
+// If a secret is configured, each request is signed, and receivers can
+// check the signature with Verify.  Events are posted as they were sent,
+// or wrapped as CloudEvents.
 package webhook
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opsmx/oes-birger/pkg/ulid"
+	"github.com/opsmx/oes-birger/pkg/util"
+)
+
+const (
+	defaultQueueDepth     = 100
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultTimeout        = 10 * time.Second
 )
 
+//
+// Config controls how events are queued, delivered, and retried.  Zero
+// values use the defaults.  Timeout limits each delivery attempt.
+//
+// CACertFile, if set, is a PEM bundle used instead of the system roots to
+// verify the webhook's server certificate.  ClientCertFile and
+// ClientKeyFile, if set, are presented as a client certificate.
+//
+// Secret, if set, is used to sign each request so the receiver can check
+// it came from us; see Verify.
+//
+// Format is FormatLegacy, the default, or FormatCloudEvents.  Source is
+// the CloudEvents source of each event.
+type Config struct {
+	QueueDepth     int           `yaml:"queueDepth,omitempty"`
+	MaxAttempts    int           `yaml:"maxAttempts,omitempty"`
+	InitialBackoff time.Duration `yaml:"initialBackoff,omitempty"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff,omitempty"`
+	Timeout        time.Duration `yaml:"timeout,omitempty"`
+	CACertFile     string        `yaml:"caCertFile,omitempty"`
+	ClientCertFile string        `yaml:"clientCertFile,omitempty"`
+	ClientKeyFile  string        `yaml:"clientKeyFile,omitempty"`
+	Secret         string        `yaml:"secret,omitempty"`
+	Format         string        `yaml:"format,omitempty"`
+	Source         string        `yaml:"source,omitempty"`
+}
+
+// Validate checks the settings which are not files to be loaded.
+func (c Config) Validate() error {
+	if err := validateFormat(c.Format); err != nil {
+		return fmt.Errorf("format: %v", err)
+	}
+	if c.Format == FormatCloudEvents && c.Source == "" {
+		return fmt.Errorf("source must be set for %s", FormatCloudEvents)
+	}
+	return nil
+}
+
+func (c *Config) applyDefaults() {
+	if c.QueueDepth <= 0 {
+		c.QueueDepth = defaultQueueDepth
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultMaxAttempts
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = defaultInitialBackoff
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		c.MaxBackoff = defaultMaxBackoff
+		if c.MaxBackoff < c.InitialBackoff {
+			c.MaxBackoff = c.InitialBackoff
+		}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+}
+
+// tlsConfig returns the TLS settings for the webhook client, or nil to
+// use the defaults.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.CACertFile == "" && c.ClientCertFile == "" && c.ClientKeyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("caCertFile: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("caCertFile: no certificates found in %s", c.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCertFile != "" || c.ClientKeyFile != "" {
+		if c.ClientCertFile == "" || c.ClientKeyFile == "" {
+			return nil, fmt.Errorf("clientCertFile and clientKeyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
 //
 // Runner holds state for the specific runner.
 type Runner struct {
-	url string
-	rc  chan interface{}
+	url    string
+	config Config
+	client *http.Client
+	ids    *ulid.Context
+
+	sync.Mutex
+	queue  []interface{}
+	closed bool
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 //
-// NewRunner returns a new webhook runner.  Call `Close` when done.
-func NewRunner(url string) *Runner {
-	return &Runner{
-		url: url,
-		rc:  make(chan interface{}),
+// NewRunner returns a new webhook runner.  Call `Close` when done.  An
+// error is returned if the config is invalid, or its TLS files cannot be
+// loaded.
+func NewRunner(url string, config Config) (*Runner, error) {
+	config.applyDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("webhook: %v", err)
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %v", err)
 	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		url:    url,
+		config: config,
+		client: &http.Client{Transport: transport},
+		ids:    ulid.NewContext(),
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
 }
 
 //
-// Close will close the webhook goroutine down.
+// Close will close the webhook goroutine down, abandoning any delivery in
+// progress.  Events not yet delivered are discarded.
 //
 func (wr *Runner) Close() {
-	close(wr.rc)
+	wr.Lock()
+	defer wr.Unlock()
+	if wr.closed {
+		return
+	}
+	wr.closed = true
+	wr.cancel()
 }
 
 //
-// Send will queue a webhook request.  It will run at some time in the
-// future, perhaps on a new goroutine.  There is no return status,
-// and errors are logged but otherwise silently ignored.
+// Send will queue a webhook request.  It will be delivered at some time in
+// the future, after any events queued before it.  Send never blocks: if the
+// queue is full, the oldest queued event is dropped.  There is no return
+// status, and errors are logged but otherwise silently ignored.
+//
+// In the CloudEvents format, msg becomes the data of an event whose type
+// and subject come from msg if it implements Event.
 //
 func (wr *Runner) Send(msg interface{}) {
-	wr.rc <- msg
+	if wr.config.Format == FormatCloudEvents {
+		msg = makeCloudEvent(msg, wr.config.Source, wr.ids.Ulid(), time.Now())
+	}
+	wr.Lock()
+	if wr.closed {
+		wr.Unlock()
+		return
+	}
+	if len(wr.queue) >= wr.config.QueueDepth {
+		util.Warnf("Webhook queue is full, dropping oldest event: %s", describe(wr.queue[0]))
+		wr.queue[0] = nil
+		wr.queue = wr.queue[1:]
+		droppedCounter.WithLabelValues("queueFull").Inc()
+	}
+	wr.queue = append(wr.queue, msg)
+	wr.Unlock()
+
+	select {
+	case wr.wake <- struct{}{}:
+	default:
+	}
 }
 
 //
-// Run starts a goroutine to process incoming web requests.
+// QueueDepth returns the number of events waiting to be delivered.
+//
+func (wr *Runner) QueueDepth() int {
+	wr.Lock()
+	defer wr.Unlock()
+	return len(wr.queue)
+}
+
+//
+// Run delivers queued events, one at a time, until Close is called.
 //
 func (wr *Runner) Run() {
 	for {
-		event, more := <-wr.rc
-		if !more {
+		msg, ok := wr.next()
+		if !ok {
+			return
+		}
+		wr.deliver(msg)
+	}
+}
+
+// next waits for the next event to deliver, returning false once closed.
+func (wr *Runner) next() (interface{}, bool) {
+	for {
+		wr.Lock()
+		if wr.closed {
+			wr.Unlock()
+			return nil, false
+		}
+		if len(wr.queue) > 0 {
+			msg := wr.queue[0]
+			wr.queue[0] = nil
+			wr.queue = wr.queue[1:]
+			wr.Unlock()
+			return msg, true
+		}
+		wr.Unlock()
+
+		select {
+		case <-wr.wake:
+		case <-wr.ctx.Done():
+		}
+	}
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+func (wr *Runner) backoff(retry int) time.Duration {
+	d := wr.config.InitialBackoff
+	for i := 1; i < retry && d < wr.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > wr.config.MaxBackoff {
+		d = wr.config.MaxBackoff
+	}
+	return d
+}
+
+// deliver tries to deliver the event until it succeeds, the attempts run
+// out, or the runner is closed.  Later events wait, so order is preserved.
+func (wr *Runner) deliver(msg interface{}) {
+	for attempt := 1; ; attempt++ {
+		err := wr.perform(msg)
+		if err == nil {
+			deliveredCounter.Inc()
+			return
+		}
+		if attempt >= wr.config.MaxAttempts {
+			util.Errorf("Webhook delivery failed after %d attempts, dropping event: %v", attempt, err)
+			droppedCounter.WithLabelValues("maxAttempts").Inc()
+			return
+		}
+		delay := wr.backoff(attempt)
+		util.Warnf("Webhook delivery failed, retrying in %s: %v", delay, err)
+		retriedCounter.Inc()
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-wr.ctx.Done():
+			t.Stop()
 			return
 		}
-		go wr.perform(event)
 	}
 }
 
 //
-// Perform an actual web request
+// Perform an actual web request, giving up after the configured timeout
+// or when the runner is closed.
 //
-func (wr *Runner) perform(msg interface{}) {
-	log.Printf("Webhook request: %v", msg)
+func (wr *Runner) perform(msg interface{}) error {
+	util.Debugf("Webhook request: %s", describe(msg))
 	jsonString, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Unable to marshal json: %v", err)
-		return
+		// retrying will not help, so this is not returned.
+		util.Warnf("Unable to marshal json: %v", err)
+		return nil
 	}
-	resp, err := http.Post(wr.url, "application/json", bytes.NewBuffer(jsonString))
+	ctx, cancel := context.WithTimeout(wr.ctx, wr.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wr.url, bytes.NewBuffer(jsonString))
 	if err != nil {
-		log.Printf("Unable to send web request: %v", err)
-		return
+		return fmt.Errorf("unable to create web request: %v", err)
+	}
+	if wr.config.Format == FormatCloudEvents {
+		req.Header.Set("Content-Type", cloudEventsContentType)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if wr.config.Secret != "" {
+		signRequest(req.Header, []byte(wr.config.Secret), jsonString, time.Now())
+	}
+
+	start := time.Now()
+	resp, err := wr.client.Do(req)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	elapsed := time.Since(start)
+	result := deliveryResult(ctx, resp, err)
+	attemptsCounter.WithLabelValues(result).Inc()
+	durationHistogram.Observe(elapsed.Seconds())
+	util.Debugf("Webhook delivery attempt: result %s in %s", result, elapsed)
+
+	if err != nil {
+		return fmt.Errorf("unable to send web request: %v", err)
 	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		log.Printf("Webhook returned %s", resp.Status)
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// deliveryResult describes the outcome of a delivery attempt for metrics:
+// the status code if there was a response, otherwise "timeout" or "error".
+func deliveryResult(ctx context.Context, resp *http.Response, err error) string {
+	switch {
+	case err == nil:
+		return strconv.Itoa(resp.StatusCode)
+	case ctx.Err() == context.DeadlineExceeded:
+		return "timeout"
+	default:
+		return "error"
 	}
 }
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2021 OpsMx, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type event struct {
+	Agent string `json:"agent"`
+	N     int    `json:"n"`
+}
+
+// recorder is a webhook receiver which fails the first failures requests,
+// and then stalls the next stalls requests until the client gives up.
+type recorder struct {
+	sync.Mutex
+	failures int
+	stalls   int
+	attempts int
+	received []event
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	r.attempts++
+	if r.attempts <= r.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.attempts <= r.failures+r.stalls {
+		// The server only notices the client going away once the body
+		// has been read.
+		_, _ = ioutil.ReadAll(req.Body)
+		r.Unlock()
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		r.Lock()
+		return
+	}
+	var e event
+	if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.received = append(r.received, e)
+}
+
+func (r *recorder) waitFor(t *testing.T, n int) []event {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.Lock()
+		if len(r.received) >= n {
+			ret := append([]event{}, r.received...)
+			r.Unlock()
+			return ret
+		}
+		r.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d events", n)
+	return nil
+}
+
+func TestRunner_retriesInOrder(t *testing.T) {
+	r := &recorder{failures: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	wr, err := NewRunner(server.URL, Config{InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewRunner: %v", err)
+	}
+	go wr.Run()
+	defer wr.Close()
+
+	want := []event{{"a", 1}, {"b", 1}, {"a", 2}, {"b", 2}}
+	for _, e := range want {
+		wr.Send(e)
+	}
+	got := r.waitFor(t, len(want))
+	if len(got) != len(want) {
+		t.Fatalf("expected %d events, got %v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestRunner_maxAttempts(t *testing.T) {
+	r := &recorder{failures: 3}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	wr, err := NewRunner(server.URL, Config{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewRunner: %v", err)
+	}
+	go wr.Run()
+	defer wr.Close()
+
+	wr.Send(event{"a", 1})
+	wr.Send(event{"a", 2})
+	got := r.waitFor(t, 1)
+	if got[0] != (event{"a", 2}) {
+		t.Errorf("expected the first event to be dropped, got %v", got)
+	}
+}
+
+func TestRunner_queueFull(t *testing.T) {
+	wr, err := NewRunner("http://localhost", Config{QueueDepth: 2})
+	if err != nil {
+		t.Fatalf("NewRunner: %v", err)
+	}
+	wr.Send(event{"a", 1})
+	wr.Send(event{"a", 2})
+	wr.Send(event{"a", 3})
+	if len(wr.queue) != 2 || wr.queue[0] != (event{"a", 2}) || wr.queue[1] != (event{"a", 3}) {
+		t.Errorf("expected the oldest event to be dropped, got %v", wr.queue)
+	}
+}
+
+func TestRunner_backoff(t *testing.T) {
+	wr, err := NewRunner("http://localhost", Config{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewRunner: %v", err)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range want {
+		if got := wr.backoff(i + 1); got != d {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, d)
+		}
+	}
+}
+
+func TestRunner_timeout(t *testing.T) {
+	r := &recorder{stalls: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	wr, err := NewRunner(server.URL, Config{Timeout: 50 * time.Millisecond, MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewRunner: %v", err)
+	}
+	go wr.Run()
+	defer wr.Close()
+
+	start := time.Now()
+	wr.Send(event{"a", 1})
+	got := r.waitFor(t, 1)
+	if got[0] != (event{"a", 1}) {
+		t.Errorf("expected the event to be delivered, got %v", got)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stalled deliveries were not abandoned, took %s", elapsed)
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", r.attempts)
+	}
+}
+
+func TestRunner_tls(t *testing.T) {
+	r := &recorder{}
+	server := httptest.NewUnstartedServer(r)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	// The server's certificate serves as both the CA bundle and the
+	// client certificate.
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	cert := server.TLS.Certificates[0]
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	notPEMFile := filepath.Join(dir, "not.pem")
+	if err := ioutil.WriteFile(notPEMFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"ca and client cert", Config{CACertFile: certFile, ClientCertFile: certFile, ClientKeyFile: keyFile}, false},
+		{"missing ca", Config{CACertFile: filepath.Join(dir, "missing.pem")}, true},
+		{"ca is not PEM", Config{CACertFile: notPEMFile}, true},
+		{"client cert without key", Config{ClientCertFile: certFile}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wr, err := NewRunner(server.URL, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRunner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer wr.Close()
+			if err := wr.perform(event{"a", 1}); err != nil {
+				t.Errorf("perform() = %v", err)
+			}
+		})
+	}
+}